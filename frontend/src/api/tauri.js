@@ -6,24 +6,69 @@ import { listen } from '@tauri-apps/api/event';
 export const CheckLogin = () => invoke('check_login');
 export const StartQRLogin = () => invoke('start_qr_login');
 export const StopQRLogin = () => invoke('stop_qr_login');
+// Without a path the backend shows a file picker
+export const ImportCookiesFromHAR = (path) => invoke('import_cookies_from_har', { path: path || null });
 export const GetUserState = () => invoke('get_user_state');
 export const SaveUserState = (state) => invoke('save_user_state_cmd', { state });
 export const GetMembers = () => invoke('get_members');
+export const GetMembersDiagnostics = () => invoke('get_members_diagnostics');
+export const GetActiveUserKey = () => invoke('get_active_user_key');
+export const GetMemoryStats = () => invoke('get_memory_stats');
+// Resolves with [{ hop, url, ok, status, kind, hint, ms }]; kind names the failure category
+export const ProbeNetwork = (proxy) => invoke('probe_network', { proxy: proxy || null });
+// Resolves with { settings, known_good, newest_success, oldest_success, restored, cache_hits }
+export const OpenOrderInBrowser = () => invoke('open_order_in_browser');
+export const ExportRunReport = (format) => invoke('export_run_report', { format: format || null });
+export const GetProxyPoolStatus = () => invoke('get_proxy_pool_status');
+export const SaveProxySettings = (settings) => invoke('save_proxy_settings', { settings });
+export const GetActiveExtraHeaders = () => invoke('get_active_extra_headers');
 
 // --- Data Fetching ---
 
+// Resolves with { cities, source, stale }; stale means the embedded fallback list was used
 export const GetCities = () => invoke('get_cities');
 
+export const RefreshCities = () => invoke('refresh_cities');
+
+export const GetAreaTree = () => invoke('get_area_tree');
+
 export const GetHospitalsByCity = (cityId) => invoke('get_hospitals_by_city', { cityId: cityId });
 
+export const GetHospitalAnnouncements = (unitId) => invoke('get_hospital_announcements', { unitId: unitId });
+
 export const GetDepsByUnit = (unitId, cityPinyin) => invoke('get_deps_by_unit', { unitId: unitId, cityPinyin: cityPinyin || '' });
 
+// Every doctor of the department as [{ doctor_id, doctor_name, title, specialty }], whatever the date
+export const GetDoctorsByDep = (unitId, depId) => invoke('get_doctors_by_dep', { unitId: unitId, depId: depId });
+
 export const GetSchedule = (unitId, depId, date) => invoke('get_schedule', {
     unitId: unitId,
     depId: depId,
     date: date
 });
 
+// Doctors sorted by tickets left, slots grouped by time type, plus a summary header
+export const GetScheduleView = (unitId, depId, date) => invoke('get_schedule_view', {
+    unitId: unitId,
+    depId: depId,
+    date: date
+});
+
+export const GetScheduleStats = (unitId, depId, date) => invoke('get_schedule_stats', {
+    unitId: unitId,
+    depId: depId,
+    date: date
+});
+
+// Streams 'scan-progress' events; resolves with the (possibly partial) report
+export const GenerateScanReport = (unitId, depId, days) => invoke('generate_scan_report', {
+    unitId: unitId,
+    depId: depId,
+    days: days
+});
+
+export const CancelScanReport = () => invoke('cancel_scan_report');
+
 export const GetTicketDetail = (unitId, depId, scheduleId, memberId) => invoke('get_ticket_detail', {
     unitId: unitId,
     depId: depId,
@@ -35,10 +80,27 @@ export const GetTicketDetail = (unitId, depId, scheduleId, memberId) => invoke('
 
 export const StartGrab = (config) => invoke('start_grab', { config });
 export const StopGrab = () => invoke('stop_grab');
+export const PauseGrab = () => invoke('pause_grab');
+export const ResumeGrab = () => invoke('resume_grab');
+export const GetGrabberState = () => invoke('get_grabber_state');
+export const GetGrabStatus = () => invoke('get_grab_status');
+export const AppendGrabDates = (dates) => invoke('append_grab_dates', { dates });
+export const ProvideCaptchaSolution = (fields) => invoke('provide_captcha_solution', { fields });
 
 // --- Logs ---
 
 export const ExportLogs = (logs) => invoke('export_logs', { logs });
+export const GetPaths = () => invoke('get_paths');
+export const SetLogLocale = (locale) => invoke('set_log_locale', { locale });
+export const GetRecentLogs = (n) => invoke('get_recent_logs', { n });
+export const SendTestEmail = () => invoke('send_test_email');
+export const TestNotification = (sink) => invoke('test_notification', { sink: sink });
+
+// --- Pacing ---
+
+export const GetPacingProfile = (unitId) => invoke('get_pacing_profile', { unitId: unitId });
+export const SavePacingProfile = (unitId, profile) => invoke('save_pacing_profile_cmd', { unitId: unitId, profile: profile });
+export const GetDepartmentInsights = (unitId, depId) => invoke('get_department_insights', { unitId: unitId, depId: depId });
 
 // --- Events ---
 
@@ -3,12 +3,14 @@ import {
     CheckLogin,
     StartQRLogin,
     StopQRLogin,
+    ImportCookiesFromHAR,
     GetUserState,
     SaveUserState,
     GetMembers,
     EventsOn
 } from '../api/tauri'
 import { useLogger } from './useLogger'
+import { useSessions } from './useSessions'
 
 // Global Auth State
 const userState = ref({})
@@ -29,6 +31,7 @@ const loginFailLimit = 3
 
 export function useAuth() {
     const { pushLog, stringifyError } = useLogger()
+    const { beginSession, isStaleEvent, isAlreadyStarting } = useSessions()
 
     const statusLabel = computed(() => {
         if (!loginChecked.value) return '待检查'
@@ -41,8 +44,12 @@ export function useAuth() {
         loginAttemptActive.value = true
         loginRunning.value = true
         try {
-            await StartQRLogin()
+            const session = await StartQRLogin()
+            beginSession('qr', session)
         } catch (err) {
+            if (isAlreadyStarting(err)) {
+                return
+            }
             loginRunning.value = false
             pushLog('error', `启动扫码失败: ${stringifyError(err)}`)
         }
@@ -65,6 +72,18 @@ export function useAuth() {
         }
     }
 
+    // Session captured from the mobile app; login-status updates loggedIn
+    const importHar = async () => {
+        try {
+            const report = await ImportCookiesFromHAR()
+            if (report?.truncated) {
+                pushLog('warn', 'HAR 中 Cookie 过多，仅导入了前一部分')
+            }
+        } catch (err) {
+            pushLog('error', `导入 HAR 失败: ${stringifyError(err)}`)
+        }
+    }
+
     // Load User Configuration (persisted preferences)
     const loadUserState = async () => {
         try {
@@ -124,6 +143,7 @@ export function useAuth() {
 
         // QR Image Update
         EventsOn('qr-image', (payload) => {
+            if (isStaleEvent('qr', payload)) return
             const base64 = payload?.base64 || ''
             const mime = base64.startsWith('/9j/') ? 'image/jpeg' : 'image/png'
             qrImageUrl.value = base64 ? `data:${mime};base64,${base64}` : ''
@@ -134,13 +154,21 @@ export function useAuth() {
 
         // QR Status Update
         EventsOn('qr-status', (payload) => {
+            if (isStaleEvent('qr', payload)) return
             if (payload?.message) {
                 qrStatus.value = payload.message
             }
         })
 
+        // Login about to expire before a scheduled grab
+        EventsOn('session-will-expire', (payload) => {
+            const expiresAt = payload?.expiresAt ? new Date(payload.expiresAt).toLocaleString() : ''
+            loginNotice.value = `登录将于 ${expiresAt} 过期，早于计划抢号时间，请提前重新扫码登录`
+        })
+
         // Login Status Update
         EventsOn('login-status', (payload) => {
+            if (isStaleEvent('qr', payload)) return
             const isLoggedIn = Boolean(payload?.loggedIn)
             loggedIn.value = isLoggedIn
             loginChecked.value = true
@@ -188,6 +216,7 @@ export function useAuth() {
         startLogin,
         stopLogin,
         toggleLogin,
+        importHar,
         loadUserState,
         saveUserState,
         loadMembers,
@@ -1,6 +1,7 @@
 import { ref } from 'vue'
-import { StartGrab, StopGrab, EventsOn } from '../api/tauri'
+import { StartGrab, StopGrab, OpenOrderInBrowser, ExportRunReport, GetGrabStatus, EventsOn } from '../api/tauri'
 import { useLogger } from './useLogger'
+import { useSessions } from './useSessions'
 
 // Task Configuration State
 const targetDates = ref([])
@@ -9,9 +10,11 @@ const grabResult = ref(null)
 const preferredHours = ref([])
 const timeTypes = ref([])
 const selectedScheduleId = ref('')
+const grabStatus = ref(null)
 
 export function useGrabTask() {
     const { pushLog, stringifyError } = useLogger()
+    const { beginSession, isStaleEvent, isAlreadyStarting } = useSessions()
 
     // Date Management
     const addDateRange = (startDateStr, days) => { // 单选日期模式：仅使用起始日期
@@ -50,14 +53,16 @@ export function useGrabTask() {
     const buildGrabConfig = (rawConfig) => {
         // Validate required fields
         const errors = []
-        if (!rawConfig.unit_id) errors.push('医院 ID')
+        if (!rawConfig.unit_id && !(rawConfig.unit_name && rawConfig.city_id)) errors.push('医院 ID')
         if (!rawConfig.dep_id) errors.push('科室 ID')
-        if (!rawConfig.member_id) errors.push('就诊人 ID')
         if (!rawConfig.target_dates || rawConfig.target_dates.length === 0) errors.push('就诊日期')
 
         if (errors.length > 0) {
             throw new Error(`缺少必填项: ${errors.join(' / ')}`)
         }
+        if (rawConfig.min_left_num !== undefined && !(Number(rawConfig.min_left_num) >= 1)) {
+            throw new Error('最少剩余号源必须至少为 1')
+        }
 
         return rawConfig
     }
@@ -68,9 +73,14 @@ export function useGrabTask() {
             const validConfig = buildGrabConfig(configPayload)
             grabRunning.value = true
             // We pass the config to backend
-            await StartGrab(validConfig)
+            const session = await StartGrab(validConfig)
+            beginSession('grab', session)
             pushLog('info', '抢号任务已启动')
         } catch (err) {
+            if (isAlreadyStarting(err)) {
+                pushLog('warn', '抢号任务正在启动，请勿重复点击')
+                return
+            }
             grabRunning.value = false
             pushLog('error', `启动抢号失败: ${stringifyError(err)}`)
         }
@@ -88,10 +98,53 @@ export function useGrabTask() {
         grabRunning.value = false
     }
 
+    // Opens the booked order, or the order list when the success page URL was not captured
+    const openOrder = async () => {
+        try {
+            await OpenOrderInBrowser()
+        } catch (err) {
+            pushLog('error', `打开订单失败: ${stringifyError(err)}`)
+        }
+    }
+
+    // Markdown by default; the save dialog picks the destination
+    const exportReport = async (format = 'md') => {
+        try {
+            const path = await ExportRunReport(format)
+            pushLog('success', `报告已保存: ${path}`)
+        } catch (err) {
+            pushLog('error', `导出报告失败: ${stringifyError(err)}`)
+        }
+    }
+
+    // Today's submit count against max_submits_per_day, for the status line
+    const refreshGrabStatus = async () => {
+        try {
+            grabStatus.value = await GetGrabStatus()
+        } catch (err) {
+            pushLog('warn', `读取提交次数失败: ${stringifyError(err)}`)
+        }
+    }
+
     const initGrabListeners = () => {
+        // Booked but unpaid: the hospital cancels the order unless it is paid before the deadline
+        EventsOn('payment-required', (payload) => {
+            if (isStaleEvent('grab', payload)) return
+            const deadline = payload?.deadline ? `，截止 ${payload.deadline}` : ''
+            pushLog('error', `挂号成功但需在线支付${deadline}，请尽快支付: ${payload?.url || ''}`)
+        })
+
+        // The hospital only books patients registered with it; retrying cannot help until they are bound
+        EventsOn('member-binding-required', (payload) => {
+            if (isStaleEvent('grab', payload)) return
+            pushLog('error', payload?.message || '该医院要求就诊人先在医院平台绑定建档，请绑定后重新开始')
+        })
+
         EventsOn('grab-finished', (payload) => {
+            if (isStaleEvent('grab', payload)) return
             grabRunning.value = false
             grabResult.value = payload || null
+            refreshGrabStatus()
             if (payload?.success) {
                 pushLog('success', payload?.message || '抢号完成')
             } else {
@@ -107,6 +160,7 @@ export function useGrabTask() {
         preferredHours,
         timeTypes,
         selectedScheduleId,
+        grabStatus,
 
         addDateRange,
         addTargetDate,
@@ -114,6 +168,9 @@ export function useGrabTask() {
         clearTargetDates,
         startGrab,
         stopGrab,
+        openOrder,
+        exportReport,
+        refreshGrabStatus,
         initGrabListeners
     }
 }
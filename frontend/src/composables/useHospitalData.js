@@ -1,15 +1,20 @@
 import { ref, computed } from 'vue'
 import {
     GetCities,
+    RefreshCities,
     GetHospitalsByCity,
     GetDepsByUnit,
-    GetSchedule
+    GetDoctorsByDep,
+    GetSchedule,
+    GetScheduleView
 } from '../api/tauri'
 import { useLogger } from './useLogger'
 import { useAuth } from './useAuth'
 
 // Global Data State (Shared)
 const cities = ref([])
+// True while showing the embedded fallback list, which may be missing cities
+const citiesStale = ref(false)
 const selectedCity = ref('')
 const hospitals = ref([])
 const deps = ref([])
@@ -76,7 +81,11 @@ export function useHospitalData() {
         loadingCities.value = true
         try {
             const data = await GetCities()
-            cities.value = Array.isArray(data) ? data : []
+            cities.value = Array.isArray(data?.cities) ? data.cities : []
+            citiesStale.value = Boolean(data?.stale)
+            if (citiesStale.value) {
+                pushLog('warn', '城市列表可能不完整，点击刷新')
+            }
             if (cities.value.length > 0) {
                 const match = cities.value.find(c => String(c.cityId) === String(preferredCity))
                 selectedCity.value = match ? String(match.cityId) : String(cities.value[0].cityId)
@@ -88,6 +97,20 @@ export function useHospitalData() {
         }
     }
 
+    const refreshCities = async () => {
+        loadingCities.value = true
+        try {
+            const data = await RefreshCities()
+            cities.value = Array.isArray(data?.cities) ? data.cities : cities.value
+            citiesStale.value = false
+            pushLog('success', `城市列表已刷新 (${cities.value.length})`)
+        } catch (err) {
+            pushLog('error', `城市列表刷新失败: ${stringifyError(err)}`)
+        } finally {
+            loadingCities.value = false
+        }
+    }
+
     const loadHospitals = async (cityId) => {
         if (!cityId) {
             hospitals.value = []
@@ -106,6 +129,9 @@ export function useHospitalData() {
                 ? data.map(item => ({
                     id: String(item.unit_id || ''),
                     name: String(item.unit_name || ''),
+                    level: item.level || '',
+                    address: item.address || '',
+                    district: item.district || '',
                 })).filter(item => item.id && item.name)
                 : []
             applySelection(unitId, hospitals.value)
@@ -146,19 +172,22 @@ export function useHospitalData() {
             pushLog('info', `正在根据城市拼音加载科室: ${cityPinyin || '默认(www)'} (医院ID: ${unitIdVal})`)
 
             const data = await GetDepsByUnit(String(unitIdVal), cityPinyin)
+            // Categories of departments; nested sub-departments stay in their category's group
             const items = []
+            const addDeps = (list, group) => {
+                list.forEach((child) => {
+                    const id = String(child.dep_id || child.id || '')
+                    const name = String(child.dep_name || child.name || '')
+                    if (id && name) items.push({ id, name, group })
+                    if (Array.isArray(child.childs)) addDeps(child.childs, group)
+                })
+            }
             if (Array.isArray(data)) {
                 data.forEach((item) => {
                     if (Array.isArray(item.childs)) {
-                        item.childs.forEach((child) => {
-                            const id = String(child.dep_id || child.id || '')
-                            const name = String(child.dep_name || child.name || '')
-                            if (id && name) items.push({ id, name })
-                        })
+                        addDeps(item.childs, String(item.pubcat || ''))
                     } else {
-                        const id = String(item.dep_id || item.id || '')
-                        const name = String(item.dep_name || item.name || '')
-                        if (id && name) items.push({ id, name })
+                        addDeps([item], '')
                     }
                 })
             }
@@ -183,16 +212,18 @@ export function useHospitalData() {
         }
         loadingDoctors.value = true
         try {
-            const data = await GetSchedule(String(unitIdVal), String(depIdVal), String(dateValue))
-            doctors.value = Array.isArray(data)
-                ? data.map(doc => ({
-                    id: String(doc.doctor_id || ''),
-                    name: String(doc.doctor_name || ''),
-                    left: Number(doc.total_left_num || 0),
-                    fee: String(doc.reg_fee || ''),
-                    schedules: Array.isArray(doc.schedules) ? doc.schedules : []
-                })).filter(doc => doc.id && doc.name)
-                : []
+            const view = await GetScheduleView(String(unitIdVal), String(depIdVal), String(dateValue))
+            const items = Array.isArray(view?.doctors) ? view.doctors : []
+            doctors.value = items.map(doc => ({
+                id: doc.doctor_id,
+                name: doc.doctor_name,
+                title: doc.title,
+                photo: doc.photo_url || '',
+                left: doc.total_left,
+                fee: doc.reg_fee,
+                groups: doc.groups,
+                schedules: doc.groups.flatMap(group => group.slots)
+            })).filter(doc => doc.id && doc.name)
         } catch (err) {
             pushLog('error', `排班加载失败: ${stringifyError(err)}`)
         } finally {
@@ -220,20 +251,41 @@ export function useHospitalData() {
     }
 
     const loadDoctorPool = async (unitIdVal, depIdVal, baseDateStr, rangeDays = 0) => {
-        if (!unitIdVal || !depIdVal || !baseDateStr) {
+        if (!unitIdVal || !depIdVal) {
             doctorPool.value = []
             return
         }
 
-        const dates = buildDateRange(baseDateStr, rangeDays)
-        if (dates.length === 0) {
-            doctorPool.value = []
-            return
-        }
+        // Without a date the pool holds the department's doctor list only
+        const dates = baseDateStr ? buildDateRange(baseDateStr, rangeDays) : []
 
         loadingDoctorPool.value = true
         try {
             const map = new Map()
+            // The department page lists doctors who have no slots in the range as well
+            try {
+                const listed = await GetDoctorsByDep(String(unitIdVal), String(depIdVal))
+                if (Array.isArray(listed)) {
+                    listed.forEach((doc) => {
+                        const id = String(doc?.doctor_id || '')
+                        const name = String(doc?.doctor_name || '')
+                        if (!id || !name) return
+                        map.set(id, {
+                            id,
+                            name,
+                            title: String(doc?.title || ''),
+                            specialty: String(doc?.specialty || ''),
+                            fee: '',
+                            left: 0,
+                            scheduleDays: new Set(),
+                            scheduleSlots: 0,
+                            latestDate: ''
+                        })
+                    })
+                }
+            } catch (err) {
+                pushLog('warn', `科室医生列表获取失败: ${stringifyError(err)}`)
+            }
             for (const date of dates) {
                 let data = []
                 try {
@@ -253,6 +305,8 @@ export function useHospitalData() {
                     const entry = map.get(id) || {
                         id,
                         name,
+                        title: '',
+                        specialty: '',
                         fee,
                         left: 0,
                         scheduleDays: new Set(),
@@ -275,6 +329,8 @@ export function useHospitalData() {
                 .map(item => ({
                     id: item.id,
                     name: item.name,
+                    title: item.title,
+                    specialty: item.specialty,
                     fee: item.fee,
                     left: item.left,
                     scheduleDays: item.scheduleDays.size,
@@ -296,6 +352,7 @@ export function useHospitalData() {
 
     return {
         cities,
+        citiesStale,
         selectedCity,
         hospitals,
         deps,
@@ -318,6 +375,7 @@ export function useHospitalData() {
         selectedDepName,
 
         loadCities,
+        refreshCities,
         loadHospitals,
         loadDeps,
         loadDoctors,
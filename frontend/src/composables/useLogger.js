@@ -1,5 +1,6 @@
 import { ref, reactive, computed } from 'vue'
-import { ExportLogs, EventsOn } from '../api/tauri'
+import { ExportLogs, EventsOn, GetRecentLogs } from '../api/tauri'
+import { useSessions } from './useSessions'
 
 // Global state to share logs across components
 const logs = ref([])
@@ -19,10 +20,10 @@ export function useLogger() {
         return 'info'
     }
 
-    const pushLog = (level, message) => {
+    const pushLog = (level, message, key = '', params = {}) => {
         const timestamp = new Date().toLocaleTimeString()
         const normalizedLevel = normalizeLevel(level)
-        logs.value.push({ level: normalizedLevel, message, time: timestamp })
+        logs.value.push({ level: normalizedLevel, message, time: timestamp, key, params })
 
         // Keep last 200 logs
         if (logs.value.length > 200) {
@@ -99,6 +100,8 @@ export function useLogger() {
             time: String(item?.time || ''),
             level: normalizeLevel(item?.level),
             message: String(item?.message || ''),
+            key: String(item?.key || ''),
+            params: item?.params || {},
         }))
 
         if (payload.length === 0) {
@@ -122,12 +125,32 @@ export function useLogger() {
         logs.value = []
     }
 
+    // Show the tail of the last grab log while no grab is running
+    const loadRecentLogs = async () => {
+        if (logs.value.length > 0) return
+        try {
+            const entries = await GetRecentLogs(200)
+            logs.value = (entries || []).map((item) => ({
+                level: normalizeLevel(item?.level),
+                message: String(item?.message || ''),
+                time: String(item?.time || ''),
+                key: String(item?.key || ''),
+                params: item?.params || {},
+            }))
+        } catch (err) {
+            console.warn('load recent logs failed', err)
+        }
+    }
+
     // Init listeners
     const initLogListeners = () => {
+        loadRecentLogs()
+        const { isStaleEvent } = useSessions()
         EventsOn('log-message', (payload) => {
+            if (isStaleEvent(payload?.flow, payload)) return
             const level = payload?.level || 'info'
             const message = payload?.message || String(payload || '')
-            pushLog(level, message)
+            pushLog(level, message, payload?.key || '', payload?.params || {})
         })
     }
 
@@ -144,6 +167,7 @@ export function useLogger() {
         exportLogs,
         clearLogs,
         initLogListeners,
+        loadRecentLogs,
         normalizeLevel,
         stringifyError
     }
@@ -0,0 +1,42 @@
+import { EventsOn, TestNotification } from '../api/tauri'
+import { useLogger } from './useLogger'
+
+export function useNotifications() {
+    const { pushLog, stringifyError } = useLogger()
+
+    // Desktop sink: the backend routes an event here, the webview raises the system notification
+    const showDesktopNotification = async (payload) => {
+        const title = payload?.title || 'SkylineMed'
+        const body = payload?.body || ''
+        if (typeof Notification === 'undefined') {
+            pushLog('info', `${title} ${body}`)
+            return
+        }
+        if (Notification.permission === 'default') {
+            await Notification.requestPermission()
+        }
+        if (Notification.permission === 'granted') {
+            new Notification(title, { body })
+        } else {
+            pushLog('info', `${title} ${body}`)
+        }
+    }
+
+    const testNotification = async (sink) => {
+        try {
+            await TestNotification(sink)
+            pushLog('success', `已发送 ${sink} 测试通知`)
+        } catch (err) {
+            pushLog('error', `${sink} 测试通知失败: ${stringifyError(err)}`)
+        }
+    }
+
+    const initNotificationListeners = () => {
+        EventsOn('desktop-notification', showDesktopNotification)
+    }
+
+    return {
+        testNotification,
+        initNotificationListeners
+    }
+}
@@ -0,0 +1,34 @@
+import { ref } from 'vue'
+
+// Latest session id returned by each start command; events from older sessions are ignored
+const sessions = {
+    qr: ref(0),
+    grab: ref(0),
+}
+
+// Error returned by start commands on a double-click
+export const ALREADY_STARTING = 'already starting'
+
+export function useSessions() {
+    const beginSession = (flow, id) => {
+        const value = Number(id) || 0
+        if (sessions[flow] && value > sessions[flow].value) {
+            sessions[flow].value = value
+        }
+    }
+
+    // Untagged events are never stale; tagged ones are stale once a newer session started
+    const isStaleEvent = (flow, payload) => {
+        const id = Number(payload?.session) || 0
+        if (!id || !sessions[flow]) return false
+        return id < sessions[flow].value
+    }
+
+    const isAlreadyStarting = (err) => String(err?.message || err || '').includes(ALREADY_STARTING)
+
+    return {
+        beginSession,
+        isStaleEvent,
+        isAlreadyStarting
+    }
+}
@@ -0,0 +1,63 @@
+//! SkylineMed command line
+//! Inspects the tasks of a running (or crashed) GUI through logs/tasks; never writes to them
+
+use std::process::ExitCode;
+
+use quick_doctor_lib::core::taskmanager::{read_task_statuses, tasks_dir};
+
+const USAGE: &str = "usage: skylinemed-cli status [--json] [--all]";
+
+fn main() -> ExitCode {
+    let args: Vec<String> = std::env::args().skip(1).collect();
+    match args.first().map(String::as_str) {
+        Some("status") => status(&args[1..]),
+        _ => {
+            eprintln!("{}", USAGE);
+            ExitCode::from(2)
+        }
+    }
+}
+
+/// Print active tasks, or every kept task with --all
+fn status(flags: &[String]) -> ExitCode {
+    let json = flags.iter().any(|f| f == "--json");
+    let all = flags.iter().any(|f| f == "--all");
+    let dir = match tasks_dir() {
+        Ok(dir) => dir,
+        Err(e) => {
+            eprintln!("logs directory unavailable: {}", e);
+            return ExitCode::FAILURE;
+        }
+    };
+    let tasks: Vec<_> = read_task_statuses(&dir)
+        .into_iter()
+        .filter(|task| all || task.is_active())
+        .collect();
+
+    if json {
+        println!("{}", serde_json::to_string_pretty(&tasks).unwrap_or_else(|_| "[]".into()));
+        return ExitCode::SUCCESS;
+    }
+    if tasks.is_empty() {
+        println!("no {}tasks in {}", if all { "" } else { "active " }, dir.display());
+        return ExitCode::SUCCESS;
+    }
+    for task in &tasks {
+        println!(
+            "{}  {:<9} pid {:<7} unit {} dep {} dates {}  attempts {}  updated {}",
+            task.task_id,
+            task.state,
+            task.pid,
+            task.unit_id,
+            task.dep_id,
+            task.target_dates.join(","),
+            task.attempts,
+            task.updated_at.format("%H:%M:%S"),
+        );
+        let line = task.result.as_deref().unwrap_or(&task.last_message);
+        if !line.is_empty() {
+            println!("    {}", line);
+        }
+    }
+    ExitCode::SUCCESS
+}
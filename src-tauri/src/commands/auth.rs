@@ -0,0 +1,312 @@
+//! Login commands: QR login, login checks, HAR cookie import and session expiry warnings
+
+use std::sync::atomic::Ordering;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+
+use chrono::{DateTime, Local};
+use tauri::{AppHandle, Emitter, Manager, State};
+use tauri_plugin_dialog::DialogExt;
+use tokio_util::sync::CancellationToken;
+
+use crate::core::{
+    cookies::touch_cookie_records,
+    errors::AppError,
+    har::{read_har_cookies, HarImportReport},
+    messages::LogMessage,
+    notifier::NotifyEvent,
+    qr_login::{FastQRLogin, QR_SESSION_SUPERSEDED},
+    GrabberState, HealthClient,
+};
+use super::{AppState, ALREADY_STARTING, START_DEBOUNCE_WINDOW, SESSION_QR, emit_log, emit_session_log, publish_notification};
+use super::booking::prefetch_caches;
+
+/// How often auth cookie expiry is compared against the scheduled grab
+const SESSION_EXPIRY_CHECK_INTERVAL: Duration = Duration::from_secs(3600);
+
+/// Check auth cookie expiry on startup and then every hour
+pub fn spawn_session_expiry_check(app: AppHandle) {
+    tauri::async_runtime::spawn(async move {
+        loop {
+            check_session_expiry(&app).await;
+            tokio::time::sleep(SESSION_EXPIRY_CHECK_INTERVAL).await;
+        }
+    });
+}
+
+/// Expiry to warn about: the login dies before the next scheduled grab and was not warned about yet
+fn expiry_to_warn(
+    expires: Option<DateTime<Local>>,
+    next_grab: Option<DateTime<Local>>,
+    last_warned: Option<DateTime<Local>>,
+) -> Option<DateTime<Local>> {
+    let (expires, next_grab) = (expires?, next_grab?);
+    (expires < next_grab && last_warned != Some(expires)).then_some(expires)
+}
+
+/// Warn the user to re-login when the auth cookies expire before the scheduled grab starts
+pub(super) async fn check_session_expiry(app: &AppHandle) {
+    let state = app.state::<AppState>();
+    let next_grab = if *state.grab_state.read().await == GrabberState::Idle {
+        None
+    } else {
+        (*state.grab_scheduled_start.read().await).filter(|start| *start > Local::now())
+    };
+    let expires = state.client.auth_cookie_expiry().await;
+
+    let mut warned = state.expiry_warned.write().await;
+    let Some(expires) = expiry_to_warn(expires, next_grab, *warned) else {
+        return;
+    };
+    *warned = Some(expires);
+    drop(warned);
+
+    let next_grab = next_grab.unwrap_or(expires);
+    let (expires_at, grab_at) = (expires.format("%Y-%m-%d %H:%M").to_string(), next_grab.format("%Y-%m-%d %H:%M").to_string());
+    emit_log(
+        app,
+        "warn",
+        &LogMessage::new("session.will_expire").param("expires", &expires_at).param("start", &grab_at),
+    );
+    let _ = app.emit(
+        "session-will-expire",
+        serde_json::json!({
+            "expiresAt": expires.to_rfc3339(),
+            "nextGrabAt": next_grab.to_rfc3339(),
+        }),
+    );
+
+    publish_notification(app, NotifyEvent::LoginExpiring { expires_at, grab_at }).await;
+}
+
+/// Check login status
+#[tauri::command]
+pub async fn check_login(app: AppHandle, state: State<'_, AppState>) -> Result<bool, String> {
+    println!(">>> Command: check_login");
+    let loaded = state.client.ensure_cookies_loaded().await;
+
+    if !loaded && !state.client.has_access_hash().await {
+        emit_log(&app, "warn", &LogMessage::new("login.no_cookie"));
+    }
+
+    if !state.client.has_access_hash().await {
+        emit_log(&app, "warn", &LogMessage::new("login.missing_access_hash"));
+        return Ok(false);
+    }
+
+    let ok = state.client.check_login().await;
+    if ok {
+        emit_log(&app, "success", &LogMessage::new("login.check_ok"));
+        prefetch_caches(state.client.clone(), state.prefetch_cancel.clone(), state.grab_state.clone());
+    } else {
+        emit_log(&app, "warn", &LogMessage::new("login.check_failed"));
+    }
+
+    Ok(ok)
+}
+
+/// Import the session from a HAR captured off the mobile app; without a path a file picker is shown
+#[tauri::command]
+pub async fn import_cookies_from_har(
+    app: AppHandle,
+    state: State<'_, AppState>,
+    path: Option<String>,
+) -> Result<HarImportReport, String> {
+    let path = match path.filter(|p| !p.trim().is_empty()) {
+        Some(path) => std::path::PathBuf::from(path.trim()),
+        None => pick_har_file(&app).await.ok_or_else(|| "未选择文件".to_string())?,
+    };
+    println!(">>> Command: import_cookies_from_har({})", path.display());
+
+    // Captures can be tens of MB; parse off the async workers
+    let (records, report) = tokio::task::spawn_blocking(move || read_har_cookies(&path))
+        .await
+        .map_err(|e| e.to_string())?
+        .map_err(|e| e.to_string())?;
+    state
+        .client
+        .save_cookies_from_records(touch_cookie_records(records, &[]))
+        .await
+        .map_err(|e| e.to_string())?;
+
+    emit_log(
+        &app,
+        "success",
+        &LogMessage::new("login.har_imported")
+            .param("count", report.cookies.len())
+            .param("matched", report.matched_entries)
+            .param("entries", report.entries),
+    );
+    let _ = app.emit("login-status", serde_json::json!({"loggedIn": true}));
+    Ok(report)
+}
+
+/// Let the user pick a .har file; None when the dialog was dismissed
+async fn pick_har_file(app: &AppHandle) -> Option<std::path::PathBuf> {
+    let (tx, rx) = tokio::sync::oneshot::channel();
+    app.dialog()
+        .file()
+        .add_filter("HAR", &["har", "json"])
+        .pick_file(move |file| {
+            let _ = tx.send(file);
+        });
+    rx.await.ok().flatten()?.into_path().ok()
+}
+
+/// Start QR login, returning the session id that tags its events
+#[tauri::command]
+pub async fn start_qr_login(app: AppHandle, state: State<'_, AppState>) -> Result<u64, String> {
+    println!(">>> Command: start_qr_login");
+    if !state.qr_start.try_start(Instant::now(), START_DEBOUNCE_WINDOW) {
+        return Err(ALREADY_STARTING.into());
+    }
+    // Cancel any existing QR login
+    {
+        let mut cancel = state.qr_cancel.write().await;
+        if let Some(token) = cancel.take() {
+            token.cancel();
+        }
+    }
+
+    let cancel_token = CancellationToken::new();
+    {
+        let mut cancel = state.qr_cancel.write().await;
+        *cancel = Some(cancel_token.clone());
+    }
+
+    let session = state.qr_generation.fetch_add(1, Ordering::SeqCst) + 1;
+    let app_clone = app.clone();
+    let client = state.client.clone();
+
+    tokio::spawn(async move {
+        run_qr_login(app_clone, client, cancel_token, session).await;
+    });
+
+    Ok(session)
+}
+
+/// Stop QR login
+#[tauri::command]
+pub async fn stop_qr_login(state: State<'_, AppState>) -> Result<(), String> {
+    let mut cancel = state.qr_cancel.write().await;
+    if let Some(token) = cancel.take() {
+        token.cancel();
+    }
+    Ok(())
+}
+
+/// Run QR login flow
+async fn run_qr_login(app: AppHandle, client: Arc<HealthClient>, cancel_token: CancellationToken, session: u64) {
+    emit_qr_status(&app, session, "正在获取二维码...");
+
+    let login = match FastQRLogin::for_session(cancel_token.clone()) {
+        Ok(l) => l,
+        Err(e) => {
+            emit_session_log(&app, Some((SESSION_QR, session)), "error", &LogMessage::new("qr.init_failed").param("error", e));
+            emit_qr_status(&app, session, "二维码登录初始化失败");
+            return;
+        }
+    };
+
+    let (base64, uuid) = match login.get_qr_image_base64(&cancel_token).await {
+        Ok(r) => r,
+        // Stopped or superseded; the caller already moved on
+        Err(AppError::Cancelled) => return,
+        Err(e) => {
+            emit_session_log(&app, Some((SESSION_QR, session)), "error", &LogMessage::new("qr.fetch_failed").param("error", e));
+            emit_qr_status(&app, session, "获取二维码失败");
+            return;
+        }
+    };
+
+    // Emit QR image
+    println!(">>> Emitting qr-image event...");
+    let _ = app.emit(
+        "qr-image",
+        serde_json::json!({
+            "uuid": uuid,
+            "base64": base64,
+            "session": session,
+        }),
+    );
+
+    emit_qr_status(&app, session, "请使用微信扫码");
+
+    let app_clone = app.clone();
+    let result = login
+        .poll_status(std::time::Duration::from_secs(300), |msg| {
+            let translated = translate_qr_status(msg);
+            emit_qr_status(&app_clone, session, &translated);
+        })
+        .await;
+    // Drop the superseded session's client and its pooled connections before anything else
+    drop(login);
+
+    if result.message == QR_SESSION_SUPERSEDED {
+        emit_session_log(&app, Some((SESSION_QR, session)), "warn", &LogMessage::new("qr.stale_discarded").param("session", session));
+        return;
+    }
+
+    if result.success {
+        emit_session_log(&app, Some((SESSION_QR, session)), "success", &LogMessage::new("login.success"));
+        let _ = app.emit("login-status", serde_json::json!({"loggedIn": true, "session": session}));
+        client.load_cookies().await;
+        let state = app.state::<AppState>();
+        prefetch_caches(client.clone(), state.prefetch_cancel.clone(), state.grab_state.clone());
+    } else {
+        let translated = translate_qr_error(&result.message);
+        emit_session_log(&app, Some((SESSION_QR, session)), "error", &LogMessage::new("login.failed").param("error", translated));
+        let _ = app.emit("login-status", serde_json::json!({"loggedIn": false, "session": session}));
+    }
+}
+
+/// Emit QR status
+fn emit_qr_status(app: &AppHandle, session: u64, message: &str) {
+    let _ = app.emit("qr-status", serde_json::json!({"message": message, "session": session}));
+}
+
+/// Translate QR status message
+fn translate_qr_status(message: &str) -> String {
+    match message {
+        "waiting for scan" => "等待扫码...".into(),
+        "scanned, confirm on phone" => "已扫码，请在手机上确认".into(),
+        "logging in" => "正在登录...".into(),
+        "confirmed but no code, retrying" => "已确认但未获取到登录码，正在重试...".into(),
+        _ => message.into(),
+    }
+}
+
+/// Translate QR error message
+fn translate_qr_error(message: &str) -> String {
+    match message {
+        "canceled" => "已取消".into(),
+        "qr expired" => "二维码已过期".into(),
+        "uuid not initialized" => "二维码未初始化".into(),
+        "no cookies received" => "未获取到有效 Cookie".into(),
+        "missing access_hash" => "登录未完成：缺少 access_hash".into(),
+        _ => message.into(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_expiry_to_warn() {
+        let now = Local::now();
+        let expires = now + chrono::Duration::hours(2);
+        let grab = now + chrono::Duration::hours(10);
+
+        assert_eq!(expiry_to_warn(Some(expires), Some(grab), None), Some(expires));
+        // Silent without a scheduled grab or a known expiry
+        assert_eq!(expiry_to_warn(Some(expires), None, None), None);
+        assert_eq!(expiry_to_warn(None, Some(grab), None), None);
+        // Expiry after the grab starts is fine
+        assert_eq!(expiry_to_warn(Some(grab + chrono::Duration::hours(1)), Some(grab), None), None);
+        // Same expiry warns once; a new expiry warns again
+        assert_eq!(expiry_to_warn(Some(expires), Some(grab), Some(expires)), None);
+        let renewed = expires + chrono::Duration::hours(1);
+        assert_eq!(expiry_to_warn(Some(renewed), Some(grab), Some(expires)), Some(renewed));
+    }
+}
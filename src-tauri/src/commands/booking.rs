@@ -0,0 +1,363 @@
+//! Booking commands: cities, hospitals, departments, members, schedules and single orders
+//! Also warms the hospital and department caches after login
+
+use std::collections::HashMap;
+use std::sync::Arc;
+use std::time::Duration;
+
+use serde_json::Value;
+use tauri::{AppHandle, Emitter, State};
+use tauri_plugin_shell::ShellExt;
+use tokio::sync::RwLock;
+use tokio_util::sync::CancellationToken;
+
+use crate::core::{
+    areas,
+    cities,
+    errors::AppError,
+    messages::LogMessage,
+    paths::{areas_path, cities_path},
+    scan,
+    schedule_view::build_schedule_view,
+    state::{load_prefetch_on_login, load_user_state},
+    AreaNode, GrabberState, HealthClient, Member, MembersResult, ScanReport,
+};
+use super::{AppState, emit_log};
+
+/// Head start given to the page's own requests before the login prefetch begins
+const PREFETCH_DELAY: Duration = Duration::from_secs(2);
+
+/// Order list on the user center, opened when no order URL was captured
+const ORDER_LIST_URL: &str = "https://user.91160.com/order.html";
+
+/// Get cities list: cities.json, else the network, else the embedded fallback marked stale
+#[tauri::command]
+pub async fn get_cities(state: State<'_, AppState>) -> Result<crate::core::types::CityList, String> {
+    println!(">>> Command: get_cities");
+    let path = cities_path().map_err(|e| e.to_string())?;
+    Ok(cities::load_cities(&path, || state.client.fetch_cities()).await)
+}
+
+/// Re-fetch the city list and overwrite cities.json
+#[tauri::command]
+pub async fn refresh_cities(state: State<'_, AppState>) -> Result<crate::core::types::CityList, String> {
+    println!(">>> Command: refresh_cities");
+    let path = cities_path().map_err(|e| e.to_string())?;
+    let cities = cities::refresh_city_file(&path, || state.client.fetch_cities())
+        .await
+        .map_err(|e| e.to_string())?;
+    Ok(crate::core::types::CityList {
+        cities,
+        source: cities::CITY_SOURCE_NETWORK.into(),
+        stale: false,
+    })
+}
+
+/// Get the province/city/district tree for the address picker, cached in areas.json
+#[tauri::command]
+pub async fn get_area_tree(state: State<'_, AppState>) -> Result<Vec<AreaNode>, String> {
+    println!(">>> Command: get_area_tree");
+    let path = areas_path().map_err(|e| e.to_string())?;
+    state.client.ensure_cookies_loaded().await;
+    areas::load_area_tree(&path, || state.client.fetch_area_tree())
+        .await
+        .map_err(|e| e.to_string())
+}
+
+/// Warm the hospital cache for the saved city and the department cache for the last unit in the background
+/// Single flight: a prefetch already running is left alone. A grab that starts cancels it, and failures only
+/// reach the console, so the booking screen reads from cache without ever seeing the prefetch.
+pub fn prefetch_caches(client: Arc<HealthClient>, slot: Arc<RwLock<Option<CancellationToken>>>, grab_state: Arc<RwLock<GrabberState>>) {
+    if !load_prefetch_on_login() {
+        return;
+    }
+    let state = load_user_state().unwrap_or_default();
+    let read = |key: &str| state.get(key).and_then(|v| v.as_str()).map(|s| s.trim().to_string()).unwrap_or_default();
+    let (city_id, unit_id) = (read("city_id"), read("unit_id"));
+    if city_id.is_empty() {
+        return;
+    }
+
+    tauri::async_runtime::spawn(async move {
+        let token = {
+            let mut running = slot.write().await;
+            if running.as_ref().is_some_and(|token| !token.is_cancelled()) {
+                return;
+            }
+            if *grab_state.read().await != GrabberState::Idle {
+                return;
+            }
+            let token = CancellationToken::new();
+            *running = Some(token.clone());
+            token
+        };
+
+        tokio::select! {
+            _ = token.cancelled() => println!(">>> prefetch cancelled"),
+            _ = prefetch_booking_lists(&client, &city_id, &unit_id) => {}
+        }
+
+        // A cancelled prefetch was already taken out of the slot, which may hold a newer one by now
+        if !token.is_cancelled() {
+            *slot.write().await = None;
+        }
+    });
+}
+
+/// Hospitals of city_id, then departments of unit_id, one request at a time
+async fn prefetch_booking_lists(client: &HealthClient, city_id: &str, unit_id: &str) {
+    tokio::time::sleep(PREFETCH_DELAY).await;
+    client.ensure_cookies_loaded().await;
+    if let Err(e) = client.get_hospitals_by_city(city_id).await {
+        println!(">>> prefetch hospitals for city {} failed: {}", city_id, e);
+        return;
+    }
+    if unit_id.is_empty() {
+        return;
+    }
+    // The department request goes to the city's subdomain, like the booking screen's
+    let pinyin = match cities_path() {
+        Ok(path) => cities::load_cities(&path, || client.fetch_cities())
+            .await
+            .cities
+            .into_iter()
+            .find(|city| city.city_id == city_id)
+            .map(|city| city.pinyin)
+            .unwrap_or_default(),
+        Err(_) => String::new(),
+    };
+    if let Err(e) = client.get_deps_by_unit(unit_id, &pinyin).await {
+        println!(">>> prefetch departments for unit {} failed: {}", unit_id, e);
+    }
+}
+
+/// Get hospitals by city
+#[tauri::command]
+pub async fn get_hospitals_by_city(
+    state: State<'_, AppState>,
+    city_id: String,
+) -> Result<Vec<crate::core::types::Hospital>, String> {
+    println!(">>> Command: get_hospitals_by_city(id={})", city_id);
+    state.client.ensure_cookies_loaded().await;
+    state
+        .client
+        .get_hospitals_by_city(&city_id)
+        .await
+        .map_err(|e| {
+            println!(">>> get_hospitals_by_city failed: {}", e);
+            e.to_frontend_string()
+        })
+}
+
+/// Get hospital announcements
+#[tauri::command]
+pub async fn get_hospital_announcements(
+    state: State<'_, AppState>,
+    unit_id: String,
+) -> Result<Vec<crate::core::types::Announcement>, String> {
+    println!(">>> Command: get_hospital_announcements(id={})", unit_id);
+    state
+        .client
+        .get_hospital_announcements(&unit_id)
+        .await
+        .map_err(|e| e.to_string())
+}
+
+/// Get departments by unit
+#[tauri::command]
+pub async fn get_deps_by_unit(
+    state: State<'_, AppState>,
+    unit_id: String,
+    city_pinyin: String,
+) -> Result<Vec<crate::core::types::DepartmentCategory>, String> {
+    println!(">>> Command: get_deps_by_unit(id={}, city={})", unit_id, city_pinyin);
+    state.client.ensure_cookies_loaded().await;
+    state
+        .client
+        .get_deps_by_unit(&unit_id, &city_pinyin)
+        .await
+        .map_err(|e| e.to_string())
+}
+
+/// Get members
+#[tauri::command]
+pub async fn get_members(app: AppHandle, state: State<'_, AppState>) -> Result<Vec<Member>, String> {
+    println!(">>> Command: get_members");
+    state.client.ensure_cookies_loaded().await;
+    let result = state.client.get_members_detailed().await.map_err(|e| e.to_string())?;
+    emit_member_skips(&app, &result);
+    Ok(result.members)
+}
+
+/// Warn about member page rows that could not be parsed, so a missing person has an explanation
+pub(super) fn emit_member_skips(app: &AppHandle, result: &MembersResult) {
+    for skip in &result.skipped_rows {
+        emit_log(
+            app,
+            "warn",
+            &LogMessage::new("member.row_skipped")
+                .param("index", skip.index)
+                .param("reason", &skip.reason)
+                .param("detail", if skip.detail.is_empty() { "-" } else { skip.detail.as_str() }),
+        );
+    }
+}
+
+/// Get every doctor of a department, independent of any date's schedule
+#[tauri::command]
+pub async fn get_doctors_by_dep(
+    state: State<'_, AppState>,
+    unit_id: String,
+    dep_id: String,
+) -> Result<Vec<crate::core::types::DepartmentDoctor>, String> {
+    println!(">>> Command: get_doctors_by_dep(unit={}, dep={})", unit_id, dep_id);
+    state.client.ensure_cookies_loaded().await;
+
+    state
+        .client
+        .get_doctors_by_dep(&unit_id, &dep_id)
+        .await
+        .map_err(|e| e.to_string())
+}
+
+/// Get schedule
+#[tauri::command]
+pub async fn get_schedule(
+    state: State<'_, AppState>,
+    unit_id: String,
+    dep_id: String,
+    date: String,
+) -> Result<Vec<crate::core::types::DoctorSchedule>, String> {
+    println!(">>> Command: get_schedule(unit={}, dep={}, date={})", unit_id, dep_id, date);
+    state.client.ensure_cookies_loaded().await;
+
+    state
+        .client
+        .get_schedule(&unit_id, &dep_id, &date)
+        .await
+        .map_err(|e| e.to_string())
+}
+
+/// Get schedule statistics
+#[tauri::command]
+pub async fn get_schedule_stats(
+    state: State<'_, AppState>,
+    unit_id: String,
+    dep_id: String,
+    date: String,
+) -> Result<crate::core::types::ScheduleStats, String> {
+    println!(">>> Command: get_schedule_stats(unit={}, dep={}, date={})", unit_id, dep_id, date);
+    state.client.ensure_cookies_loaded().await;
+
+    state
+        .client
+        .get_schedule_stats(&unit_id, &dep_id, &date)
+        .await
+        .map_err(|e| e.to_string())
+}
+
+/// Get the schedule of a date shaped for display: doctors by availability, slots grouped by time type
+#[tauri::command]
+pub async fn get_schedule_view(
+    state: State<'_, AppState>,
+    unit_id: String,
+    dep_id: String,
+    date: String,
+) -> Result<crate::core::types::ScheduleView, String> {
+    println!(">>> Command: get_schedule_view(unit={}, dep={}, date={})", unit_id, dep_id, date);
+    state.client.ensure_cookies_loaded().await;
+
+    let docs = match state.client.get_schedule(&unit_id, &dep_id, &date).await {
+        Ok(docs) => docs,
+        Err(AppError::ScheduleEmpty) => Vec::new(),
+        Err(e) => return Err(e.to_string()),
+    };
+    Ok(build_schedule_view(&date, &docs))
+}
+
+/// Get ticket detail
+#[tauri::command]
+pub async fn get_ticket_detail(
+    state: State<'_, AppState>,
+    unit_id: String,
+    dep_id: String,
+    schedule_id: String,
+    member_id: String,
+) -> Result<Value, String> {
+    state.client.ensure_cookies_loaded().await;
+
+    let detail = state
+        .client
+        .get_ticket_detail(&unit_id, &dep_id, &schedule_id, &member_id)
+        .await
+        .map_err(|e| e.to_string())?;
+
+    serde_json::to_value(detail).map_err(|e| e.to_string())
+}
+
+/// Submit order
+#[tauri::command]
+pub async fn submit_order(
+    state: State<'_, AppState>,
+    params: HashMap<String, String>,
+) -> Result<Value, String> {
+    state.client.ensure_cookies_loaded().await;
+
+    let result = state
+        .client
+        .submit_order(&params, None, false)
+        .await
+        .map_err(|e| e.to_string())?;
+
+    serde_json::to_value(result).map_err(|e| e.to_string())
+}
+
+/// Open the last booked order in the system browser, or the order list when no order URL was captured
+/// Returns the opened URL
+#[tauri::command]
+pub async fn open_order_in_browser(app: AppHandle, state: State<'_, AppState>) -> Result<String, String> {
+    let url = state
+        .last_order
+        .read()
+        .await
+        .as_ref()
+        .and_then(|order| order.order_url())
+        .unwrap_or(ORDER_LIST_URL)
+        .to_string();
+    #[allow(deprecated)]
+    app.shell().open(&url, None).map_err(|e| e.to_string())?;
+    Ok(url)
+}
+
+/// Scan a department's schedule for the next days plus the past week, streaming "scan-progress" events
+#[tauri::command]
+pub async fn generate_scan_report(
+    app: AppHandle,
+    state: State<'_, AppState>,
+    unit_id: String,
+    dep_id: String,
+    days: u32,
+) -> Result<ScanReport, String> {
+    println!(">>> Command: generate_scan_report(unit={}, dep={}, days={})", unit_id, dep_id, days);
+    state.client.ensure_cookies_loaded().await;
+
+    let cancel_token = CancellationToken::new();
+    if let Some(previous) = state.scan_cancel.write().await.replace(cancel_token.clone()) {
+        previous.cancel();
+    }
+
+    let report = scan::generate_scan_report(&state.client, &unit_id, &dep_id, days, cancel_token, |progress| {
+        let _ = app.emit("scan-progress", progress);
+    })
+    .await;
+    Ok(report)
+}
+
+/// Stop a running schedule scan; the partial report is still returned
+#[tauri::command]
+pub async fn cancel_scan_report(state: State<'_, AppState>) -> Result<(), String> {
+    if let Some(token) = state.scan_cancel.write().await.take() {
+        token.cancel();
+    }
+    Ok(())
+}
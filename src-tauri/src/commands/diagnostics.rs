@@ -0,0 +1,137 @@
+//! Diagnostics commands: logs, paths, memory, session key, member parsing and insights
+
+use std::fs;
+
+use tauri::{AppHandle, State};
+
+use crate::core::{
+    logfile::{read_recent_logs, DEFAULT_RECENT_LOG_LINES},
+    memory::{log_ring_stats, process_rss_bytes, MemoryStats},
+    netclass::{probe_hops, HopProbe},
+    insights::{department_insights, DepartmentInsights},
+    messages::LogMessage,
+    LogEntry, MembersResult,
+};
+use super::AppState;
+use super::booking::emit_member_skips;
+
+/// Export logs to file
+#[tauri::command]
+pub async fn export_logs(
+    _app: AppHandle,
+    entries: Vec<LogEntry>,
+) -> Result<Option<String>, String> {
+    // Dialog plugin is registered in main.rs but not used here anymore as we use paths directly
+    // If needed for future interactive saves, we can re-enable it.
+
+    if entries.is_empty() {
+        return Err("log entries is empty".into());
+    }
+
+    let filename = format!(
+        "quickdoctor_logs_{}.txt",
+        chrono::Local::now().format("%Y%m%d_%H%M%S")
+    );
+
+    // Save to logs directory
+    let logs_dir = crate::core::paths::logs_dir().map_err(|e| e.to_string())?;
+    let path = logs_dir.join(&filename);
+
+    let mut content = String::new();
+    content.push_str("QuickDoctor Logs Export\n");
+    content.push_str(&format!(
+        "ExportedAt: {}\n",
+        chrono::Local::now().format("%Y-%m-%d %H:%M:%S")
+    ));
+    content.push_str(&format!("Total: {}\n\n", entries.len()));
+
+    for entry in &entries {
+        let level = if entry.level.trim().is_empty() {
+            "INFO"
+        } else {
+            &entry.level.to_uppercase()
+        };
+        if entry.key.is_empty() {
+            content.push_str(&format!("[{}] [{}] {}\n", entry.time, level, entry.message));
+        } else {
+            // Keep the raw key and params next to the rendered text for machine analysis
+            let raw = LogMessage {
+                key: entry.key.clone(),
+                params: entry.params.clone(),
+            };
+            content.push_str(&format!("[{}] [{}] {} | {}\n", entry.time, level, entry.message, raw.raw()));
+        }
+    }
+
+    fs::write(&path, content).map_err(|e| e.to_string())?;
+    Ok(Some(path.to_string_lossy().to_string()))
+}
+
+/// Get the last n entries of the most recent grab log (default 200)
+#[tauri::command]
+pub async fn get_recent_logs(n: Option<usize>) -> Result<Vec<LogEntry>, String> {
+    println!(">>> Command: get_recent_logs");
+    read_recent_logs(n.unwrap_or(DEFAULT_RECENT_LOG_LINES)).map_err(|e| e.to_string())
+}
+
+/// Get the booking window learned for a department: release times, time to sellout and a
+/// suggested start_time together with the number of observations behind it
+#[tauri::command]
+pub async fn get_department_insights(unit_id: String, dep_id: String) -> Result<DepartmentInsights, String> {
+    println!(">>> Command: get_department_insights unit_id={} dep_id={}", unit_id, dep_id);
+    if unit_id.trim().is_empty() || dep_id.trim().is_empty() {
+        return Err("unit_id and dep_id are required".into());
+    }
+    department_insights(&unit_id, &dep_id).map_err(|e| e.to_string())
+}
+
+/// Get resolved application paths
+#[tauri::command]
+pub async fn get_paths() -> Result<crate::core::types::AppPaths, String> {
+    println!(">>> Command: get_paths");
+    let config = crate::core::paths::config_dir().map_err(|e| e.to_string())?;
+    let logs = crate::core::paths::logs_dir().map_err(|e| e.to_string())?;
+    let cookies = crate::core::paths::cookies_path().map_err(|e| e.to_string())?;
+    Ok(crate::core::types::AppPaths {
+        config_dir: config.to_string_lossy().to_string(),
+        logs_dir: logs.to_string_lossy().to_string(),
+        cookie_path: cookies.to_string_lossy().to_string(),
+        logs_fallback: crate::core::paths::logs_dir_is_fallback(),
+    })
+}
+
+/// Get process memory and the size of each in-memory buffer against its cap
+#[tauri::command]
+pub async fn get_memory_stats(state: State<'_, AppState>) -> Result<MemoryStats, String> {
+    let mut buffers = state.client.buffer_stats().await;
+    buffers.push(log_ring_stats(state.client.memory_budget()));
+    Ok(MemoryStats {
+        rss_bytes: process_rss_bytes(),
+        buffers,
+    })
+}
+
+/// Self-check: request the site and the gate host once, optionally through a proxy, and label the
+/// category of each hop that failed
+#[tauri::command]
+pub async fn probe_network(proxy: Option<String>) -> Result<Vec<HopProbe>, String> {
+    println!(">>> Command: probe_network proxy={}", proxy.as_deref().unwrap_or("-"));
+    let proxy = proxy.filter(|p| !p.trim().is_empty());
+    Ok(probe_hops(proxy.as_deref().map(str::trim)).await)
+}
+
+/// Get the masked user_key the schedule API last accepted
+#[tauri::command]
+pub async fn get_active_user_key(state: State<'_, AppState>) -> Result<String, String> {
+    Ok(state.client.active_user_key().await)
+}
+
+/// Get members with member page parse diagnostics
+#[tauri::command]
+pub async fn get_members_diagnostics(app: AppHandle, state: State<'_, AppState>) -> Result<MembersResult, String> {
+    println!(">>> Command: get_members_diagnostics");
+    state.client.ensure_cookies_loaded().await;
+    let result = state.client.get_members_detailed().await.map_err(|e| e.to_string())?;
+    emit_member_skips(&app, &result);
+    Ok(result)
+}
@@ -0,0 +1,534 @@
+//! Grab commands: starting, steering and stopping a grab run, and its report
+
+use std::collections::HashMap;
+use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
+use std::sync::Arc;
+use std::time::Instant;
+
+use chrono::Local;
+use serde_json::Value;
+use tauri::{AppHandle, Emitter, State};
+use tauri_plugin_dialog::DialogExt;
+use tokio::sync::RwLock;
+use tokio_util::sync::CancellationToken;
+
+use crate::core::{
+    captcha::ManualCaptchaSolver,
+    cookies::unique_strings,
+    grabber::Grabber,
+    history::load_history,
+    logfile::{read_recent_logs, GrabLogWriter, LEVEL_DEBUG},
+    hooks::run_hook,
+    payload::{build_success_payload, SuccessPayload},
+    notifier::NotifyEvent,
+    notify::SUMMARY_LOG_LINES,
+    messages::{log_locale, LogMessage},
+    paths::write_file_atomic,
+    report::{render_run_report, ReportFormat, RunReport},
+    proxy::ProxyPool,
+    taskmanager::{TaskManager, STATUS_WRITE_INTERVAL, TASK_STATE_FAILED, TASK_STATE_STOPPED, TASK_STATE_SUCCEEDED},
+    state::{load_hook_command, read_submit_cap, user_state_to_grab_config, load_user_state, ON_FAILURE_COMMAND_KEY, ON_SUCCESS_COMMAND_KEY},
+    submit_counts::submits_today,
+    CaptchaChallenge, CaptchaSolution, GrabberState, GrabResult, GrabStatus, GrabStats, GrabSuccess, HealthClient, GrabConfig,
+};
+use super::{AppState, ALREADY_STARTING, START_DEBOUNCE_WINDOW, SESSION_GRAB, emit_log, emit_session_log, publish_notification};
+use super::auth::check_session_expiry;
+
+/// Export the last finished run as a Markdown ("md", default) or HTML ("html") report
+/// Asks where to save it and returns the written path
+#[tauri::command]
+pub async fn export_run_report(app: AppHandle, state: State<'_, AppState>, format: Option<String>) -> Result<String, String> {
+    println!(">>> Command: export_run_report({:?})", format);
+    let format = ReportFormat::parse(format.as_deref().unwrap_or_default()).ok_or_else(|| "不支持的报告格式".to_string())?;
+    let report = state.last_report.read().await.clone().ok_or_else(|| "还没有已结束的抢号任务".to_string())?;
+    let history = load_history().unwrap_or_default();
+    let text = render_run_report(&report, &history, format).map_err(|e| e.to_string())?;
+
+    let file_name = format!("skylinemed_report_{}.{}", report.finished_at.format("%Y%m%d_%H%M%S"), format.extension());
+    let path = pick_report_path(&app, &file_name, format).await.ok_or_else(|| "未选择保存位置".to_string())?;
+    write_file_atomic(&path, text.as_bytes()).map_err(|e| e.to_string())?;
+    Ok(path.to_string_lossy().to_string())
+}
+
+/// Ask for the report destination; None when the dialog is dismissed
+async fn pick_report_path(app: &AppHandle, file_name: &str, format: ReportFormat) -> Option<std::path::PathBuf> {
+    let (tx, rx) = tokio::sync::oneshot::channel();
+    let label = match format {
+        ReportFormat::Markdown => "Markdown",
+        ReportFormat::Html => "HTML",
+    };
+    app.dialog()
+        .file()
+        .add_filter(label, &[format.extension()])
+        .set_file_name(file_name)
+        .save_file(move |file| {
+            let _ = tx.send(file);
+        });
+    rx.await.ok().flatten()?.into_path().ok()
+}
+
+/// Start grab, returning the session id that tags its events
+#[tauri::command]
+pub async fn start_grab(
+    app: AppHandle,
+    state: State<'_, AppState>,
+    config: HashMap<String, Value>,
+) -> Result<u64, String> {
+    let mut config = user_state_to_grab_config(&config).map_err(|e| e.to_string())?;
+    println!(">>> Command: start_grab(unit={})", config.unit_id);
+    if !state.grab_start.try_start(Instant::now(), START_DEBOUNCE_WINDOW) {
+        return Err(ALREADY_STARTING.into());
+    }
+
+    // Resolve unit_id from a pasted hospital name
+    if config.unit_id.trim().is_empty() && !config.unit_name.trim().is_empty() && !config.city_id.trim().is_empty() {
+        config.unit_id = state
+            .client
+            .resolve_unit_id(&config.city_id, &config.unit_name)
+            .await
+            .map_err(|e| e.to_string())?;
+        emit_log(
+            &app,
+            "info",
+            &LogMessage::new("grab.unit_resolved").param("name", &config.unit_name).param("unit", &config.unit_id),
+        );
+    }
+    // Ensure logged in
+    state.client.ensure_cookies_loaded().await;
+    if !state.client.has_access_hash().await {
+        emit_log(&app, "error", &LogMessage::new("grab.missing_access_hash"));
+        let _ = app.emit("login-status", serde_json::json!({"loggedIn": false}));
+        return Err("请先扫码登录".into());
+    }
+
+    emit_log(&app, "info", &LogMessage::new("grab.access_hash_found"));
+
+    // Pick the member from member_name or the account's only certified member
+    if config.member_id.trim().is_empty() {
+        let member = match state.client.resolve_member(&config.member_name).await {
+            Ok(member) => member,
+            Err(e) => {
+                emit_log(&app, "error", &LogMessage::new("grab.config_invalid").param("error", &e));
+                return Err(e.to_string());
+            }
+        };
+        emit_log(
+            &app,
+            "warn",
+            &LogMessage::new("grab.member_resolved").param("name", &member.name).param("member", &member.id),
+        );
+        config.member_id = member.id;
+        config.member_name = member.name;
+    }
+
+    // The grab gets the connection to itself
+    if let Some(token) = state.prefetch_cancel.write().await.take() {
+        token.cancel();
+    }
+
+    // Cancel any existing grab
+    {
+        let mut cancel = state.grab_cancel.write().await;
+        if let Some(token) = cancel.take() {
+            token.cancel();
+        }
+    }
+
+    let cancel_token = CancellationToken::new();
+    {
+        let mut cancel = state.grab_cancel.write().await;
+        *state.grab_dates.write().await = unique_strings(config.target_dates.clone());
+        *cancel = Some(cancel_token.clone());
+    }
+
+    let generation = state.grab_generation.fetch_add(1, Ordering::SeqCst) + 1;
+    state.grab_paused.store(false, Ordering::SeqCst);
+    set_grab_state(&app, &state.grab_state, GrabberState::Running).await;
+    *state.grab_scheduled_start.write().await = config.scheduled_start(Local::now());
+    let check_app = app.clone();
+    tauri::async_runtime::spawn(async move { check_session_expiry(&check_app).await });
+
+    let app_clone = app.clone();
+    let client = state.client.clone();
+    let run = GrabRun {
+        state: state.grab_state.clone(),
+        paused: state.grab_paused.clone(),
+        generation,
+        current_generation: state.grab_generation.clone(),
+        dates: state.grab_dates.clone(),
+        captcha_solver: state.captcha_solver.clone(),
+        proxy_pool: state.proxy_pool.clone(),
+        tasks: state.tasks.clone(),
+        last_order: state.last_order.clone(),
+        last_report: state.last_report.clone(),
+    };
+
+    tokio::spawn(async move {
+        run_grab(app_clone, client, config, cancel_token, run).await;
+    });
+
+    Ok(generation)
+}
+
+/// Stop grab
+#[tauri::command]
+pub async fn stop_grab(app: AppHandle, state: State<'_, AppState>) -> Result<(), String> {
+    let mut cancel = state.grab_cancel.write().await;
+    if let Some(token) = cancel.take() {
+        set_grab_state(&app, &state.grab_state, GrabberState::Stopping).await;
+        state.grab_paused.store(false, Ordering::SeqCst);
+        token.cancel();
+    }
+    Ok(())
+}
+
+/// Pause grab between attempts
+#[tauri::command]
+pub async fn pause_grab(app: AppHandle, state: State<'_, AppState>) -> Result<(), String> {
+    if *state.grab_state.read().await != GrabberState::Running {
+        return Err("grabber is not running".into());
+    }
+    state.grab_paused.store(true, Ordering::SeqCst);
+    set_grab_state(&app, &state.grab_state, GrabberState::Paused).await;
+    Ok(())
+}
+
+/// Resume a paused grab
+#[tauri::command]
+pub async fn resume_grab(app: AppHandle, state: State<'_, AppState>) -> Result<(), String> {
+    if *state.grab_state.read().await != GrabberState::Paused {
+        return Err("grabber is not paused".into());
+    }
+    state.grab_paused.store(false, Ordering::SeqCst);
+    set_grab_state(&app, &state.grab_state, GrabberState::Running).await;
+    Ok(())
+}
+
+/// Append target dates to the running grab without restarting it
+#[tauri::command]
+pub async fn append_grab_dates(app: AppHandle, state: State<'_, AppState>, dates: Vec<String>) -> Result<(), String> {
+    for date in &dates {
+        if chrono::NaiveDate::parse_from_str(date, "%Y-%m-%d").is_err() {
+            return Err(format!("invalid date: {}", date));
+        }
+    }
+
+    // Hold the grab lock so a concurrent start/stop cannot swap the date list underneath us
+    let cancel = state.grab_cancel.read().await;
+    if cancel.is_none() || *state.grab_state.read().await == GrabberState::Idle {
+        return Err("grabber is not running".into());
+    }
+
+    let mut current = state.grab_dates.write().await;
+    let mut merged = current.clone();
+    merged.extend(dates);
+    *current = unique_strings(merged);
+    emit_log(&app, "info", &LogMessage::new("grab.dates_updated").param("dates", current.join(",")));
+    Ok(())
+}
+
+/// Provide the answer to a pending captcha challenge
+#[tauri::command]
+pub async fn provide_captcha_solution(
+    state: State<'_, AppState>,
+    fields: HashMap<String, String>,
+) -> Result<(), String> {
+    if state.captcha_solver.provide_solution(CaptchaSolution { fields }).await {
+        Ok(())
+    } else {
+        Err("no captcha challenge is waiting".into())
+    }
+}
+
+/// Get grabber state
+#[tauri::command]
+pub async fn get_grabber_state(state: State<'_, AppState>) -> Result<GrabberState, String> {
+    Ok(*state.grab_state.read().await)
+}
+
+/// Get grabber state with today's submit count of the saved member against max_submits_per_day
+/// and the adaptive retry interval
+#[tauri::command]
+pub async fn get_grab_status(state: State<'_, AppState>) -> Result<GrabStatus, String> {
+    let saved = load_user_state().map_err(|e| e.to_string())?;
+    let member_id = saved.get("member_id").and_then(|v| v.as_str()).unwrap_or_default().trim().to_string();
+    let submits_today = if member_id.is_empty() {
+        0
+    } else {
+        submits_today(&member_id).map_err(|e| e.to_string())?
+    };
+    Ok(GrabStatus {
+        state: *state.grab_state.read().await,
+        member_id,
+        submits_today,
+        max_submits_per_day: read_submit_cap(&saved, "max_submits_per_day").unwrap_or(0),
+        governor: state.client.governor_status().await,
+    })
+}
+
+/// Handles shared between a spawned grab run and AppState
+struct GrabRun {
+    state: Arc<RwLock<GrabberState>>,
+    paused: Arc<AtomicBool>,
+    generation: u64,
+    current_generation: Arc<AtomicU64>,
+    dates: Arc<RwLock<Vec<String>>>,
+    captcha_solver: Arc<ManualCaptchaSolver>,
+    proxy_pool: Arc<ProxyPool>,
+    tasks: Arc<TaskManager>,
+    last_order: Arc<RwLock<Option<GrabSuccess>>>,
+    last_report: Arc<RwLock<Option<RunReport>>>,
+}
+
+/// Run grab flow
+async fn run_grab(
+    app: AppHandle,
+    client: Arc<HealthClient>,
+    config: GrabConfig,
+    cancel_token: CancellationToken,
+    run: GrabRun,
+) {
+    run_grab_inner(&app, client, config, cancel_token, &run).await;
+
+    // A newer grab may have started meanwhile; leave its state alone
+    if run.current_generation.load(Ordering::SeqCst) == run.generation {
+        run.paused.store(false, Ordering::SeqCst);
+        set_grab_state(&app, &run.state, GrabberState::Idle).await;
+    }
+}
+
+/// Run the grabber and emit its result
+async fn run_grab_inner(
+    app: &AppHandle,
+    client: Arc<HealthClient>,
+    config: GrabConfig,
+    cancel_token: CancellationToken,
+    run: &GrabRun,
+) {
+    use tokio::sync::mpsc;
+
+    let app_for_events = app.clone();
+    let mut grabber = Grabber::new(client)
+        .with_proxy_pool(run.proxy_pool.clone())
+        .with_pause_flag(run.paused.clone())
+        .with_target_dates(run.dates.clone())
+        .with_event_publisher(Arc::new(move |event: NotifyEvent| {
+            let app = app_for_events.clone();
+            tokio::spawn(async move { publish_notification(&app, event).await });
+        }));
+    let session = run.generation;
+    if config.manual_captcha {
+        let app_for_captcha = app.clone();
+        run.captcha_solver
+            .set_notifier(Arc::new(move |challenge: &CaptchaChallenge| {
+                let mut payload = serde_json::to_value(challenge).unwrap_or_default();
+                if let Some(fields) = payload.as_object_mut() {
+                    fields.insert("session".into(), session.into());
+                }
+                let _ = app_for_captcha.emit("captcha-challenge", payload);
+            }))
+            .await;
+        grabber = grabber.with_captcha_solver(run.captcha_solver.clone());
+    }
+
+    run.tasks.start_grab(session, &config);
+    // Status updates are throttled; write the pending ones while the task runs
+    let tasks_for_flush = run.tasks.clone();
+    tokio::spawn(async move {
+        loop {
+            tokio::time::sleep(STATUS_WRITE_INTERVAL).await;
+            if !tasks_for_flush.is_active(session) {
+                break;
+            }
+            tasks_for_flush.flush();
+        }
+    });
+
+    // Create channel for log messages
+    let (log_tx, mut log_rx) = mpsc::unbounded_channel::<(String, LogMessage)>();
+
+    // Spawn log receiver task
+    let app_for_log = app.clone();
+    let tasks_for_log = run.tasks.clone();
+    let log_handle = tokio::spawn(async move {
+        let mut log_file = match GrabLogWriter::create() {
+            Ok(writer) => Some(writer),
+            Err(e) => {
+                println!(">>> Warning: grab log file unavailable: {}", e);
+                None
+            }
+        };
+        while let Some((level, message)) = log_rx.recv().await {
+            // Flight recorder context goes to the file only
+            if level != LEVEL_DEBUG {
+                emit_session_log(&app_for_log, Some((SESSION_GRAB, session)), &level, &message);
+                let redacted = message.redacted();
+                tasks_for_log.record_log(session, &redacted, &redacted.render(&log_locale()));
+            }
+            if let Some(writer) = log_file.as_mut() {
+                let message = message.redacted();
+                let _ = writer.write(&level, &message.render(&log_locale()), &message);
+            }
+        }
+    });
+
+    let (config_unit_id, config_member_id) = (config.unit_id.clone(), config.member_id.clone());
+    let (report_config, started_at) = (config.clone(), Local::now());
+
+    // Run grabber with channel-based logging
+    let log_sender = log_tx.clone();
+    let result = grabber
+        .run(config, cancel_token.clone(), move |level: &str, message: &LogMessage| {
+            let _ = log_sender.send((level.to_string(), message.clone()));
+        })
+        .await;
+
+    // Close channel and wait for log task
+    drop(log_tx);
+    let _ = log_handle.await;
+
+    let stats = grabber.stats().await;
+    // A submit already in flight when stop was pressed is awaited; if it booked, report the booking
+    let stopped = cancel_token.is_cancelled() && !result.success;
+    if stopped {
+        run.tasks.finish(session, TASK_STATE_STOPPED, "stopped");
+    } else if result.success {
+        run.tasks.finish(session, TASK_STATE_SUCCEEDED, &result.message);
+    } else {
+        run.tasks.finish(session, TASK_STATE_FAILED, &result.message);
+    }
+    let payload = result
+        .detail
+        .as_ref()
+        .map(|detail| build_success_payload(&session.to_string(), detail, &stats));
+    if !stopped {
+        tokio::spawn(run_grab_hook(app.clone(), result.clone(), payload.clone()));
+    }
+    // The order is cancelled unless paid in time, so tell the UI separately from grab-finished
+    if let Some(detail) = result.detail.as_ref().filter(|d| d.payment_required) {
+        let _ = app.emit(
+            "payment-required",
+            serde_json::json!({
+                "url": detail.payment_url,
+                "deadline": detail.payment_deadline,
+                "doctor": detail.doctor_name,
+                "date": detail.date,
+                "session": session,
+            }),
+        );
+    }
+    // Restarting cannot help until the patient is bound on the hospital's own platform
+    if stats.his_mem_missing {
+        let _ = app.emit(
+            "member-binding-required",
+            serde_json::json!({
+                "unit_id": config_unit_id,
+                "member_id": config_member_id,
+                "message": result.message,
+                "session": session,
+            }),
+        );
+    }
+    tokio::spawn(notify_grab_finished(
+        app.clone(),
+        result.clone(),
+        stats.clone(),
+        stopped,
+    ));
+    *run.last_report.write().await = Some(RunReport {
+        config: report_config,
+        result: result.clone(),
+        stats: stats.clone(),
+        stopped,
+        started_at,
+        finished_at: Local::now(),
+    });
+
+    if stopped {
+        let _ = app.emit(
+            "grab-finished",
+            serde_json::json!({
+                "success": false,
+                "message": "stopped",
+                "stats": stats,
+                "session": session,
+            }),
+        );
+        return;
+    }
+
+    if result.success {
+        if let Some(detail) = &result.detail {
+            *run.last_order.write().await = Some(detail.clone());
+        }
+        let order_url = result.detail.as_ref().and_then(|d| d.order_url());
+        let _ = app.emit(
+            "grab-finished",
+            serde_json::json!({
+                "success": true,
+                "message": result.message,
+                "detail": result.detail,
+                // false means open_order_in_browser falls back to the order list
+                "order_url_available": order_url.is_some(),
+                "payload": payload,
+                "stats": stats,
+                "session": session,
+            }),
+        );
+    } else {
+        let _ = app.emit(
+            "grab-finished",
+            serde_json::json!({
+                "success": false,
+                "message": result.message,
+                "stats": stats,
+                "session": session,
+            }),
+        );
+    }
+}
+
+/// Run the user's on_success/on_failure command; its outcome never changes the grab result
+/// Success hooks also get the machine-readable payload under "payload"
+async fn run_grab_hook(app: AppHandle, result: GrabResult, payload: Option<SuccessPayload>) {
+    let key = if result.success { ON_SUCCESS_COMMAND_KEY } else { ON_FAILURE_COMMAND_KEY };
+    let Some(hook) = load_hook_command(key) else {
+        return;
+    };
+    let mut stdin = serde_json::to_value(&result).unwrap_or_default();
+    if let (Some(payload), Some(object)) = (payload, stdin.as_object_mut()) {
+        object.insert("payload".into(), serde_json::to_value(payload).unwrap_or_default());
+    }
+    let stdin_json = stdin.to_string();
+    match run_hook(&hook, &result, &stdin_json).await {
+        Ok(output) => emit_log(
+            &app,
+            "debug",
+            &LogMessage::new("hook.finished")
+                .param("hook", key)
+                .param("code", output.code.map_or("-".to_string(), |c| c.to_string()))
+                .param("stdout", output.stdout)
+                .param("stderr", output.stderr),
+        ),
+        Err(e) => emit_log(&app, "warn", &LogMessage::new("hook.failed").param("hook", key).param("error", e)),
+    }
+}
+
+/// Publish the run summary to the sinks routed for grab_success / grab_failure
+async fn notify_grab_finished(app: AppHandle, result: GrabResult, stats: GrabStats, stopped: bool) {
+    let logs = read_recent_logs(SUMMARY_LOG_LINES).unwrap_or_default();
+    publish_notification(&app, NotifyEvent::GrabFinished { result, stats, stopped, logs }).await;
+}
+
+/// Update grabber state and notify the frontend
+async fn set_grab_state(app: &AppHandle, state: &RwLock<GrabberState>, next: GrabberState) {
+    let mut current = state.write().await;
+    if *current == next {
+        return;
+    }
+    *current = next;
+    if let Some(app_state) = app.try_state::<AppState>() {
+        app_state.tasks.set_grabber_state(next);
+    }
+    let _ = app.emit("grabber-state-changed", serde_json::json!({"state": next}));
+}
@@ -0,0 +1,236 @@
+//! Tauri commands for QuickDoctor
+//! Corresponds to app.go - frontend/backend bridge
+//! Commands are grouped by area, one module each; shared state and event helpers live here
+//! The frontend invokes commands by name, so moving one between modules changes nothing for it
+
+use std::sync::atomic::{AtomicBool, AtomicU64};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+use chrono::{DateTime, Local};
+use tauri::{AppHandle, Emitter};
+use tokio::sync::RwLock;
+use tokio_util::sync::CancellationToken;
+
+use crate::core::{
+    captcha::ManualCaptchaSolver,
+    errors::AppError,
+    messages::{log_locale, LogMessage},
+    notifier::{EmailSink, NotificationSink, NotifierRegistry, Notification, NotifyEvent, SendFuture, EVENT_TYPES, SINK_DESKTOP},
+    proxy::ProxyPool,
+    state::{load_notify_routes, load_smtp_settings},
+    report::RunReport,
+    taskmanager::TaskManager,
+    GrabberState, GrabSuccess, HealthClient,
+};
+
+pub mod auth;
+pub mod booking;
+pub mod diagnostics;
+pub mod grab;
+pub mod settings;
+
+/// Minimum gap between two starts of the same flow, to absorb UI double-clicks
+const START_DEBOUNCE_WINDOW: Duration = Duration::from_millis(750);
+/// Error returned when a start arrives within the debounce window of the previous one
+pub const ALREADY_STARTING: &str = "already starting";
+
+/// Rejects a start that arrives within a short window of the previous one
+#[derive(Default)]
+pub struct StartDebounce {
+    last: Mutex<Option<Instant>>,
+}
+
+impl StartDebounce {
+    /// Record a start at now; returns false if the previous start was less than window ago
+    fn try_start(&self, now: Instant, window: Duration) -> bool {
+        let mut last = self.last.lock().unwrap_or_else(|e| e.into_inner());
+        if let Some(prev) = *last {
+            if now.saturating_duration_since(prev) < window {
+                return false;
+            }
+        }
+        *last = Some(now);
+        true
+    }
+}
+
+/// Flows whose events carry a session id
+const SESSION_QR: &str = "qr";
+const SESSION_GRAB: &str = "grab";
+
+/// Application state
+pub struct AppState {
+    pub client: Arc<HealthClient>,
+    pub qr_cancel: RwLock<Option<CancellationToken>>,
+    pub grab_cancel: RwLock<Option<CancellationToken>>,
+    pub grab_state: Arc<RwLock<GrabberState>>,
+    pub grab_paused: Arc<AtomicBool>,
+    /// Incremented per started grab so a finished run only resets its own state
+    pub grab_generation: Arc<AtomicU64>,
+    /// Target dates of the running grab, appendable without restart
+    pub grab_dates: Arc<RwLock<Vec<String>>>,
+    pub captcha_solver: Arc<ManualCaptchaSolver>,
+    /// Incremented per started QR login; events carry it as "session"
+    pub qr_generation: Arc<AtomicU64>,
+    pub qr_start: StartDebounce,
+    pub grab_start: StartDebounce,
+    /// Scheduled start of the pending grab, if it is waiting for start_time
+    pub grab_scheduled_start: Arc<RwLock<Option<DateTime<Local>>>>,
+    /// Cookie expiry the user was last warned about, so each expiry warns once
+    pub expiry_warned: Arc<RwLock<Option<DateTime<Local>>>>,
+    pub scan_cancel: RwLock<Option<CancellationToken>>,
+    /// Running login prefetch, cancelled when a grab starts
+    pub prefetch_cancel: Arc<RwLock<Option<CancellationToken>>>,
+    /// Shared by every grab run; restored from config/proxies.json
+    pub proxy_pool: Arc<ProxyPool>,
+    /// Task registry; mirrors every grab run to logs/tasks for the CLI
+    pub tasks: Arc<TaskManager>,
+    /// Most recent booking, opened by open_order_in_browser
+    pub last_order: Arc<RwLock<Option<GrabSuccess>>>,
+    /// Most recent finished run, exported by export_run_report
+    pub last_report: Arc<RwLock<Option<RunReport>>>,
+}
+
+impl AppState {
+    pub fn new() -> Result<Self, AppError> {
+        let client = HealthClient::new()?;
+        Ok(Self {
+            client: Arc::new(client),
+            qr_cancel: RwLock::new(None),
+            grab_cancel: RwLock::new(None),
+            grab_state: Arc::new(RwLock::new(GrabberState::Idle)),
+            grab_paused: Arc::new(AtomicBool::new(false)),
+            grab_generation: Arc::new(AtomicU64::new(0)),
+            grab_dates: Arc::new(RwLock::new(Vec::new())),
+            captcha_solver: Arc::new(ManualCaptchaSolver::new()),
+            qr_generation: Arc::new(AtomicU64::new(0)),
+            qr_start: StartDebounce::default(),
+            grab_start: StartDebounce::default(),
+            grab_scheduled_start: Arc::new(RwLock::new(None)),
+            expiry_warned: Arc::new(RwLock::new(None)),
+            scan_cancel: RwLock::new(None),
+            prefetch_cancel: Arc::new(RwLock::new(None)),
+            proxy_pool: Arc::new(ProxyPool::restore()),
+            tasks: Arc::new(TaskManager::new()),
+            last_order: Arc::new(RwLock::new(None)),
+            last_report: Arc::new(RwLock::new(None)),
+        })
+    }
+}
+
+impl Default for AppState {
+    fn default() -> Self {
+        Self::new().expect("Failed to create AppState")
+    }
+}
+
+/// Emit log message
+/// The message is rendered in the current log locale; key and params are kept for file export
+fn emit_log(app: &AppHandle, level: &str, message: &LogMessage) {
+    emit_session_log(app, None, level, message);
+}
+
+/// Emit log message tagged with the (flow, session) that produced it
+fn emit_session_log(app: &AppHandle, session: Option<(&str, u64)>, level: &str, message: &LogMessage) {
+    let message = message.redacted();
+    let _ = app.emit(
+        "log-message",
+        serde_json::json!({
+            "level": level,
+            "message": message.render(&log_locale()),
+            "key": message.key,
+            "params": message.params,
+            "flow": session.map(|(flow, _)| flow),
+            "session": session.map(|(_, id)| id),
+        }),
+    );
+}
+
+/// Shows notifications through the frontend, which raises a desktop notification
+struct DesktopSink {
+    app: AppHandle,
+}
+
+impl NotificationSink for DesktopSink {
+    fn id(&self) -> &str {
+        SINK_DESKTOP
+    }
+
+    fn handles(&self) -> Vec<&'static str> {
+        EVENT_TYPES.to_vec()
+    }
+
+    fn send<'a>(&'a self, event: &'a NotifyEvent, notification: &'a Notification) -> SendFuture<'a> {
+        Box::pin(async move {
+            self.app
+                .emit(
+                    "desktop-notification",
+                    serde_json::json!({
+                        "event": event.event_type(),
+                        "title": notification.subject,
+                        "body": notification.body,
+                    }),
+                )
+                .map_err(|e| AppError::Other(e.to_string()))
+        })
+    }
+}
+
+/// Sinks available with the current settings; built per use so SMTP changes apply without a restart
+fn notifier(app: &AppHandle) -> NotifierRegistry {
+    let mut registry = NotifierRegistry::new();
+    if let Some(settings) = load_smtp_settings() {
+        registry.register(Arc::new(EmailSink::new(settings)));
+    }
+    registry.register(Arc::new(DesktopSink { app: app.clone() }));
+    registry
+}
+
+/// Route an event to the sinks the user chose for its type and log each delivery
+async fn publish_notification(app: &AppHandle, event: NotifyEvent) {
+    let routes = load_notify_routes();
+    for delivery in notifier(app).publish(&event, &routes).await {
+        match delivery.result {
+            Ok(()) => emit_log(
+                app,
+                "info",
+                &LogMessage::new("notify.sent").param("sink", &delivery.sink).param("event", event.event_type()),
+            ),
+            Err(e) => emit_log(app, "warn", &LogMessage::new("notify.failed").param("sink", &delivery.sink).param("error", e)),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_start_debounce_rapid_starts() {
+        let debounce = StartDebounce::default();
+        let t0 = Instant::now();
+
+        assert!(debounce.try_start(t0, START_DEBOUNCE_WINDOW));
+        // Double-click: rejected
+        assert!(!debounce.try_start(t0 + Duration::from_millis(120), START_DEBOUNCE_WINDOW));
+        // Rejected starts don't extend the window
+        assert!(debounce.try_start(t0 + Duration::from_millis(760), START_DEBOUNCE_WINDOW));
+        assert!(!debounce.try_start(t0 + Duration::from_millis(800), START_DEBOUNCE_WINDOW));
+    }
+
+    #[test]
+    fn test_start_debounce_concurrent_starts() {
+        let debounce = Arc::new(StartDebounce::default());
+        let now = Instant::now();
+        let handles: Vec<_> = (0..8)
+            .map(|_| {
+                let debounce = debounce.clone();
+                std::thread::spawn(move || debounce.try_start(now, START_DEBOUNCE_WINDOW))
+            })
+            .collect();
+
+        let started = handles.into_iter().map(|h| h.join().unwrap()).filter(|ok| *ok).count();
+        assert_eq!(started, 1);
+    }
+}
@@ -0,0 +1,135 @@
+//! Settings commands: user state, pacing, log locale, SMTP and notification tests, proxies and extra headers
+
+use std::sync::Arc;
+
+use serde_json::Value;
+use tauri::{AppHandle, State};
+
+use crate::core::{
+    notify::send_email,
+    pacing::{load_pacing_profile, save_pacing_profile, PacingProfile},
+    messages::log_locale,
+    proxy::{ProxyPool, ProxyPoolStatus, ProxySettings},
+    state::{load_smtp_settings, load_user_state, save_user_state},
+    ActiveExtraHeaders,
+};
+use super::{notifier, AppState};
+
+/// Get user state
+#[tauri::command]
+pub async fn get_user_state() -> Result<crate::core::types::UserState, String> {
+    println!(">>> Command: get_user_state");
+    let map = load_user_state().map_err(|e| e.to_string())?;
+    Ok(crate::core::state::to_user_state_struct(&map))
+}
+
+/// Save user state
+#[tauri::command]
+pub async fn save_user_state_cmd(
+    app_state: State<'_, AppState>,
+    state: crate::core::types::UserState,
+) -> Result<(), String> {
+    println!(">>> Command: save_user_state_cmd: {:?}", state);
+    let extra_headers = state.extra_headers.clone();
+    let val = serde_json::to_value(state).map_err(|e| e.to_string())?;
+    if let Value::Object(map) = val {
+        let converted = map.into_iter().collect();
+        save_user_state(converted).map_err(|e| e.to_string())?;
+        if let Some(extra) = extra_headers {
+            app_state.client.set_extra_headers(extra).await;
+        }
+        Ok(())
+    } else {
+        Err("invalid state object".into())
+    }
+}
+
+/// Send a test notification through one sink ("email", "desktop"), whatever the routing says
+#[tauri::command]
+pub async fn test_notification(app: AppHandle, sink: String) -> Result<(), String> {
+    println!(">>> Command: test_notification sink={}", sink);
+    notifier(&app).test(sink.trim()).await.map_err(|e| e.to_string())
+}
+
+/// Send a test email with the saved SMTP settings
+#[tauri::command]
+pub async fn send_test_email() -> Result<(), String> {
+    println!(">>> Command: send_test_email");
+    let settings = load_smtp_settings().ok_or("smtp settings not configured")?;
+    send_email(
+        &settings,
+        "[SkylineMed] Test email",
+        "SMTP settings work. Grab summaries will be sent to this address.",
+    )
+    .await
+    .map_err(|e| e.to_string())
+}
+
+/// Get the pacing profile for a hospital; hospitals without one get the defaults
+#[tauri::command]
+pub async fn get_pacing_profile(unit_id: String) -> Result<PacingProfile, String> {
+    println!(">>> Command: get_pacing_profile unit_id={}", unit_id);
+    if unit_id.trim().is_empty() {
+        return Err("unit_id is required".into());
+    }
+    Ok(load_pacing_profile(&unit_id).unwrap_or_default())
+}
+
+/// Save the pacing profile for a hospital
+#[tauri::command]
+pub async fn save_pacing_profile_cmd(unit_id: String, profile: PacingProfile) -> Result<(), String> {
+    println!(">>> Command: save_pacing_profile_cmd unit_id={}", unit_id);
+    if unit_id.trim().is_empty() {
+        return Err("unit_id is required".into());
+    }
+    if profile.min_schedule_interval < 0.0 || profile.min_submit_interval < 0.0 {
+        return Err("intervals must not be negative".into());
+    }
+    save_pacing_profile(&unit_id, profile).map_err(|e| e.to_string())
+}
+
+/// Set the locale used for log messages ("zh-CN" | "en")
+#[tauri::command]
+pub async fn set_log_locale(locale: String) -> Result<String, String> {
+    crate::core::messages::set_log_locale(&locale);
+    Ok(log_locale())
+}
+
+/// Re-probe the known-good proxies restored at startup, so the first submit does not pay for dead ones
+pub fn reprobe_proxies(pool: Arc<ProxyPool>) {
+    tauri::async_runtime::spawn(async move {
+        let restored = pool.status().await.restored;
+        if restored == 0 {
+            return;
+        }
+        let alive = pool.reprobe_known().await;
+        println!(">>> proxy cache: {} of {} restored proxies still working", alive, restored);
+    });
+}
+
+/// Get the extra request headers that are applied, per scope
+#[tauri::command]
+pub async fn get_active_extra_headers(state: State<'_, AppState>) -> Result<ActiveExtraHeaders, String> {
+    Ok(state.client.active_extra_headers().await)
+}
+
+/// Get the persisted proxy pool state: settings, known-good count and freshness
+#[tauri::command]
+pub async fn get_proxy_pool_status(state: State<'_, AppState>) -> Result<ProxyPoolStatus, String> {
+    Ok(state.proxy_pool.status().await)
+}
+
+/// Save the proxy settings
+#[tauri::command]
+pub async fn save_proxy_settings(state: State<'_, AppState>, settings: ProxySettings) -> Result<ProxyPoolStatus, String> {
+    println!(">>> Command: save_proxy_settings protocol={} country={}", settings.protocol, settings.country);
+    if settings.keep == 0 {
+        return Err("keep must be at least 1".into());
+    }
+    let path = settings.user_list_path.trim();
+    if !path.is_empty() && !std::path::Path::new(path).is_file() {
+        return Err(format!("proxy list not found: {}", path));
+    }
+    state.proxy_pool.set_settings(settings).await;
+    Ok(state.proxy_pool.status().await)
+}
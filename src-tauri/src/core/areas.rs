@@ -0,0 +1,163 @@
+//! Address area tree (省/市/区) for SkylineMed
+//! The site's cascading address selector changes rarely, so the tree is fetched once and kept in
+//! config/areas.json; a picked district id plus a typed street stands in for a missing member address.
+
+use std::collections::HashMap;
+use std::future::Future;
+use std::path::Path;
+use std::sync::{Mutex, OnceLock};
+
+use super::errors::{AppError, AppResult};
+use super::paths::{areas_path, write_file_atomic};
+use super::types::AreaNode;
+
+/// Field names the area payload uses for ids, names and children, in priority order
+const AREA_ID_FIELDS: [&str; 4] = ["id", "area_id", "value", "code"];
+const AREA_NAME_FIELDS: [&str; 4] = ["name", "area_name", "label", "text"];
+const AREA_CHILD_FIELDS: [&str; 4] = ["children", "childs", "child", "sub"];
+
+/// Labels already resolved from the cached tree, so the submit path does not re-read areas.json
+static AREA_LABELS: OnceLock<Mutex<HashMap<String, String>>> = OnceLock::new();
+
+fn area_labels() -> std::sync::MutexGuard<'static, HashMap<String, String>> {
+    AREA_LABELS
+        .get_or_init(|| Mutex::new(HashMap::new()))
+        .lock()
+        .unwrap_or_else(|poisoned| poisoned.into_inner())
+}
+
+/// Parse the area payload: a list of nodes, or an object wrapping one under "data"
+pub fn parse_area_tree(value: &serde_json::Value) -> Vec<AreaNode> {
+    let list = value.get("data").unwrap_or(value);
+    list.as_array().map(|items| items.iter().filter_map(parse_area_node).collect()).unwrap_or_default()
+}
+
+fn parse_area_node(value: &serde_json::Value) -> Option<AreaNode> {
+    let field = |names: &[&str]| {
+        names
+            .iter()
+            .filter_map(|name| value.get(*name))
+            .find_map(|v| match v {
+                serde_json::Value::String(s) if !s.trim().is_empty() => Some(s.trim().to_string()),
+                serde_json::Value::Number(n) => Some(n.to_string()),
+                _ => None,
+            })
+    };
+    let children = AREA_CHILD_FIELDS
+        .iter()
+        .find_map(|name| value.get(*name))
+        .map(parse_area_tree)
+        .unwrap_or_default();
+    Some(AreaNode {
+        id: field(&AREA_ID_FIELDS)?,
+        name: field(&AREA_NAME_FIELDS)?,
+        children,
+    })
+}
+
+/// Fetch the tree and overwrite path with it; the file is left alone when the fetch fails or is empty
+pub async fn refresh_area_file<F, Fut>(path: &Path, fetch: F) -> AppResult<Vec<AreaNode>>
+where
+    F: FnOnce() -> Fut,
+    Fut: Future<Output = AppResult<Vec<AreaNode>>>,
+{
+    let tree = fetch().await?;
+    if tree.is_empty() {
+        return Err(AppError::ParseError("area tree is empty".into()));
+    }
+    write_file_atomic(path, serde_json::to_string(&tree)?.as_bytes())?;
+    area_labels().clear();
+    Ok(tree)
+}
+
+/// Read a non-empty cached tree from path
+fn read_area_file(path: &Path) -> Option<Vec<AreaNode>> {
+    let data = std::fs::read_to_string(path).ok()?;
+    let tree: Vec<AreaNode> = serde_json::from_str(&data).ok()?;
+    (!tree.is_empty()).then_some(tree)
+}
+
+/// Load the tree from the cache file, fetching and caching it when missing
+pub async fn load_area_tree<F, Fut>(path: &Path, fetch: F) -> AppResult<Vec<AreaNode>>
+where
+    F: FnOnce() -> Fut,
+    Fut: Future<Output = AppResult<Vec<AreaNode>>>,
+{
+    match read_area_file(path) {
+        Some(tree) => Ok(tree),
+        None => refresh_area_file(path, fetch).await,
+    }
+}
+
+/// Names from the province down to the area with the given id
+pub fn area_path(tree: &[AreaNode], id: &str) -> Option<Vec<String>> {
+    for node in tree {
+        if node.id == id {
+            return Some(vec![node.name.clone()]);
+        }
+        if let Some(mut path) = area_path(&node.children, id) {
+            path.insert(0, node.name.clone());
+            return Some(path);
+        }
+    }
+    None
+}
+
+/// "广东省 深圳市 南山区" for an area id, from the cached tree
+/// Resolved labels are remembered until the tree is refreshed
+pub fn cached_area_label(id: &str) -> Option<String> {
+    let id = id.trim();
+    if let Some(label) = area_labels().get(id) {
+        return Some(label.clone());
+    }
+    let tree = read_area_file(&areas_path().ok()?)?;
+    let label = area_path(&tree, id)?.join(" ");
+    area_labels().insert(id.to_string(), label.clone());
+    Some(label)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    fn sample() -> serde_json::Value {
+        json!({"data": [
+            {"area_id": 440000, "area_name": "广东省", "childs": [
+                {"id": "440300", "name": "深圳市", "children": [
+                    {"value": "440305", "label": "南山区"},
+                    {"value": "", "label": "无效"}
+                ]}
+            ]},
+            {"id": "110000", "name": "北京市"}
+        ]})
+    }
+
+    #[test]
+    fn test_parse_area_tree_and_path() {
+        let tree = parse_area_tree(&sample());
+        assert_eq!(tree.len(), 2);
+        assert_eq!(tree[0].id, "440000");
+        assert_eq!(tree[0].children[0].children.len(), 1);
+
+        assert_eq!(area_path(&tree, "440305").unwrap(), vec!["广东省", "深圳市", "南山区"]);
+        assert_eq!(area_path(&tree, "110000").unwrap(), vec!["北京市"]);
+        assert!(area_path(&tree, "999999").is_none());
+    }
+
+    #[tokio::test]
+    async fn test_load_area_tree_caches() {
+        let dir = std::env::temp_dir().join(format!("skylinemed_areas_{}", std::process::id()));
+        let _ = std::fs::remove_dir_all(&dir);
+        std::fs::create_dir_all(&dir).unwrap();
+        let path = dir.join("areas.json");
+
+        let offline = || async { Err::<Vec<AreaNode>, _>(AppError::Other("offline".into())) };
+        assert!(load_area_tree(&path, offline).await.is_err());
+
+        let tree = load_area_tree(&path, || async { Ok(parse_area_tree(&sample())) }).await.unwrap();
+        assert_eq!(tree.len(), 2);
+        // Served from the file afterwards
+        assert_eq!(load_area_tree(&path, offline).await.unwrap(), tree);
+    }
+}
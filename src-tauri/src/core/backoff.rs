@@ -0,0 +1,195 @@
+//! Retry backoff shared by the submit, proxy API and transport retries
+//! A policy turns an attempt number into a delay; Backoff walks a policy attempt by attempt.
+
+use std::time::Duration;
+
+use rand::rngs::StdRng;
+use rand::{Rng, SeedableRng};
+use tokio_util::sync::CancellationToken;
+
+/// Delay schedule for retries
+/// The delay of attempt n starts at min * factor^n, capped at max; jitter then randomizes that
+/// fraction of the headroom up to max. factor 1 with jitter 1 is a uniform delay in [min, max].
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub struct BackoffPolicy {
+    pub min: Duration,
+    pub max: Duration,
+    /// Growth per attempt; values below 1 are treated as 1
+    pub factor: f64,
+    /// Randomized fraction of the headroom between the grown delay and max, 0..=1
+    pub jitter: f64,
+}
+
+impl BackoffPolicy {
+    /// The same delay every time
+    pub const fn constant(delay: Duration) -> Self {
+        Self {
+            min: delay,
+            max: delay,
+            factor: 1.0,
+            jitter: 0.0,
+        }
+    }
+
+    /// A uniformly random delay in [min, max] every time
+    pub const fn jittered(min: Duration, max: Duration) -> Self {
+        Self {
+            min,
+            max,
+            factor: 1.0,
+            jitter: 1.0,
+        }
+    }
+
+    /// min, min * factor, min * factor^2 ... up to max
+    pub const fn exponential(min: Duration, max: Duration, factor: f64) -> Self {
+        Self {
+            min,
+            max,
+            factor,
+            jitter: 0.0,
+        }
+    }
+
+    pub const fn with_jitter(mut self, jitter: f64) -> Self {
+        self.jitter = jitter;
+        self
+    }
+
+    /// Delay before retry number attempt (0 for the first retry)
+    pub fn delay<R: Rng + ?Sized>(&self, attempt: u32, rng: &mut R) -> Duration {
+        let min = self.min.as_secs_f64() * 1000.0;
+        let max = (self.max.as_secs_f64() * 1000.0).max(min);
+        let factor = if self.factor.is_finite() && self.factor > 1.0 { self.factor } else { 1.0 };
+        // powf saturates to infinity for large attempts, which the cap absorbs
+        let grown = (min * factor.powf(attempt as f64)).min(max);
+        let jitter = if self.jitter.is_finite() { self.jitter.clamp(0.0, 1.0) } else { 0.0 };
+        let ms = if jitter > 0.0 && max > grown {
+            grown + jitter * rng.gen_range(0.0..=1.0) * (max - grown)
+        } else {
+            grown
+        };
+        Duration::from_millis(ms.round() as u64)
+    }
+}
+
+/// A policy with its attempt counter
+pub struct Backoff<R = StdRng> {
+    policy: BackoffPolicy,
+    attempt: u32,
+    rng: R,
+}
+
+impl Backoff {
+    pub fn new(policy: BackoffPolicy) -> Self {
+        Self::with_rng(policy, StdRng::from_entropy())
+    }
+}
+
+impl<R: Rng> Backoff<R> {
+    /// Backoff drawing its jitter from rng, e.g. a seeded one in tests
+    pub fn with_rng(policy: BackoffPolicy, rng: R) -> Self {
+        Self { policy, attempt: 0, rng }
+    }
+
+    /// Delay for the next retry; advances the attempt counter
+    pub fn next(&mut self) -> Duration {
+        let delay = self.policy.delay(self.attempt, &mut self.rng);
+        self.attempt = self.attempt.saturating_add(1);
+        delay
+    }
+
+    /// Start over from the first delay, e.g. after a success
+    pub fn reset(&mut self) {
+        self.attempt = 0;
+    }
+
+    /// Retries handed out since the last reset
+    pub fn attempt(&self) -> u32 {
+        self.attempt
+    }
+
+    /// Sleep for the next delay
+    pub async fn wait(&mut self) {
+        tokio::time::sleep(self.next()).await;
+    }
+
+    /// Sleep for the next delay; false if cancel fired first
+    pub async fn wait_or_cancel(&mut self, cancel: &CancellationToken) -> bool {
+        let delay = self.next();
+        tokio::select! {
+            _ = tokio::time::sleep(delay) => true,
+            _ = cancel.cancelled() => false,
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use rand::rngs::mock::StepRng;
+
+    fn ms(value: u64) -> Duration {
+        Duration::from_millis(value)
+    }
+
+    #[test]
+    fn test_delay_bounds() {
+        // rng at 0 yields the grown delay, rng at its top yields max
+        let low = || StepRng::new(0, 0);
+        let high = || StepRng::new(u64::MAX, 0);
+        let cases: Vec<(&str, BackoffPolicy, u32, Duration, Duration)> = vec![
+            ("constant", BackoffPolicy::constant(ms(300)), 5, ms(300), ms(300)),
+            ("zero", BackoffPolicy::jittered(ms(0), ms(0)), 0, ms(0), ms(0)),
+            ("min equals max", BackoffPolicy::jittered(ms(900), ms(900)), 0, ms(900), ms(900)),
+            ("max below min", BackoffPolicy::jittered(ms(900), ms(400)), 0, ms(900), ms(900)),
+            ("jittered", BackoffPolicy::jittered(ms(400), ms(900)), 7, ms(400), ms(900)),
+            ("exponential start", BackoffPolicy::exponential(ms(100), ms(5000), 2.0), 0, ms(100), ms(100)),
+            ("exponential grown", BackoffPolicy::exponential(ms(100), ms(5000), 2.0), 3, ms(800), ms(800)),
+            ("exponential capped", BackoffPolicy::exponential(ms(100), ms(5000), 2.0), 10, ms(5000), ms(5000)),
+            ("overflow", BackoffPolicy::exponential(ms(100), ms(5000), 2.0), u32::MAX, ms(5000), ms(5000)),
+            ("shrinking factor", BackoffPolicy::exponential(ms(100), ms(5000), 0.5), 4, ms(100), ms(100)),
+            ("half jitter", BackoffPolicy::exponential(ms(100), ms(1000), 2.0).with_jitter(0.5), 2, ms(400), ms(700)),
+        ];
+        for (name, policy, attempt, expected_low, expected_high) in cases {
+            assert_eq!(policy.delay(attempt, &mut low()), expected_low, "{} low", name);
+            let high = policy.delay(attempt, &mut high());
+            assert!(high <= expected_high && high + ms(1) >= expected_high, "{} high: {:?}", name, high);
+        }
+    }
+
+    #[test]
+    fn test_backoff_sequence_and_reset() {
+        let policy = BackoffPolicy::exponential(ms(250), ms(2000), 2.0);
+        let mut backoff = Backoff::with_rng(policy, StepRng::new(0, 0));
+        let delays: Vec<Duration> = (0..5).map(|_| backoff.next()).collect();
+        assert_eq!(delays, vec![ms(250), ms(500), ms(1000), ms(2000), ms(2000)]);
+        assert_eq!(backoff.attempt(), 5);
+        backoff.reset();
+        assert_eq!(backoff.next(), ms(250));
+    }
+
+    #[test]
+    fn test_seeded_jitter_is_deterministic() {
+        let policy = BackoffPolicy::jittered(ms(2500), ms(4200));
+        let run = || {
+            let mut backoff = Backoff::with_rng(policy, StdRng::seed_from_u64(7));
+            (0..20).map(|_| backoff.next()).collect::<Vec<_>>()
+        };
+        let delays = run();
+        assert_eq!(delays, run());
+        assert!(delays.iter().all(|d| *d >= ms(2500) && *d <= ms(4200)));
+        assert!(delays.windows(2).any(|w| w[0] != w[1]));
+    }
+
+    #[tokio::test]
+    async fn test_wait_or_cancel() {
+        let cancel = CancellationToken::new();
+        cancel.cancel();
+        let mut backoff = Backoff::new(BackoffPolicy::constant(Duration::from_secs(60)));
+        assert!(!backoff.wait_or_cancel(&cancel).await);
+
+        let mut backoff = Backoff::new(BackoffPolicy::constant(ms(1)));
+        assert!(backoff.wait_or_cancel(&CancellationToken::new()).await);
+    }
+}
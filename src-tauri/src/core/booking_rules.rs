@@ -0,0 +1,123 @@
+//! Booking rules for SkylineMed
+//! The advance-booking window a hospital announces ("提前7天预约"), used to tell dates that are not
+//! released yet from dates that cannot be released before the day gets closer.
+
+use chrono::{Duration as ChronoDuration, NaiveDate};
+use regex::Regex;
+
+use super::types::Announcement;
+
+/// Largest window taken from announcement text; larger numbers are not booking windows
+const MAX_ADVANCE_DAYS: u32 = 90;
+
+/// Rules a hospital publishes for booking
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct BookingRules {
+    /// Days ahead of today a schedule can be booked, today included as day 0
+    pub advance_days: Option<u32>,
+}
+
+impl BookingRules {
+    /// Whether date can be booked today; unknown windows accept every date
+    pub fn in_window(&self, date: NaiveDate, today: NaiveDate) -> bool {
+        match self.advance_days {
+            Some(days) => date <= today + ChronoDuration::days(days as i64),
+            None => true,
+        }
+    }
+
+    /// First day date enters the window, None when it already has or the window is unknown
+    pub fn opens_on(&self, date: NaiveDate, today: NaiveDate) -> Option<NaiveDate> {
+        let days = self.advance_days?;
+        if self.in_window(date, today) {
+            return None;
+        }
+        Some(date - ChronoDuration::days(days as i64))
+    }
+
+    /// Target dates ("YYYY-MM-DD") beyond the window with the day each opens; unparsable dates are left to the query
+    pub fn outside_window(&self, dates: &[String], today: NaiveDate) -> Vec<(String, NaiveDate)> {
+        dates
+            .iter()
+            .filter_map(|date| {
+                let parsed = NaiveDate::parse_from_str(date.trim(), "%Y-%m-%d").ok()?;
+                Some((date.clone(), self.opens_on(parsed, today)?))
+            })
+            .collect()
+    }
+}
+
+/// Read the advance window from announcement titles and bodies, the first match wins
+pub fn parse_booking_rules(announcements: &[Announcement]) -> BookingRules {
+    let patterns = [
+        r"提前\s*(\d{1,2})\s*天",
+        r"(?:可预约|预约)(?:未来)?\s*(\d{1,2})\s*天",
+        r"(\d{1,2})\s*天内(?:的)?(?:号源|预约)",
+    ];
+    let regexes: Vec<Regex> = patterns.iter().filter_map(|p| Regex::new(p).ok()).collect();
+    let advance_days = announcements
+        .iter()
+        .flat_map(|item| [item.title.as_str(), item.body.as_str()])
+        .find_map(|text| {
+            regexes.iter().find_map(|re| {
+                re.captures(text)
+                    .and_then(|caps| caps[1].parse::<u32>().ok())
+                    .filter(|days| (1..=MAX_ADVANCE_DAYS).contains(days))
+            })
+        });
+    BookingRules { advance_days }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn announcement(title: &str, body: &str) -> Announcement {
+        Announcement {
+            title: title.into(),
+            date: String::new(),
+            url: String::new(),
+            body: body.into(),
+        }
+    }
+
+    #[test]
+    fn test_parse_booking_rules() {
+        let items = vec![
+            announcement("春节停诊通知", "2月10日至2月17日门诊停诊"),
+            announcement("关于调整预约周期的公告", "自即日起，本院门诊号源提前7天开放预约，每日8:00放号"),
+        ];
+        assert_eq!(parse_booking_rules(&items).advance_days, Some(7));
+
+        let items = vec![announcement("可预约未来14天号源", "")];
+        assert_eq!(parse_booking_rules(&items).advance_days, Some(14));
+
+        let items = vec![announcement("门诊须知", "请提前30分钟到院"), announcement("停车通知", "")];
+        assert_eq!(parse_booking_rules(&items).advance_days, None);
+    }
+
+    #[test]
+    fn test_booking_window() {
+        let today = NaiveDate::from_ymd_opt(2024, 3, 1).unwrap();
+        let rules = BookingRules { advance_days: Some(7) };
+
+        let inside = NaiveDate::from_ymd_opt(2024, 3, 8).unwrap();
+        assert!(rules.in_window(inside, today));
+        assert_eq!(rules.opens_on(inside, today), None);
+
+        let beyond = NaiveDate::from_ymd_opt(2024, 3, 11).unwrap();
+        assert!(!rules.in_window(beyond, today));
+        assert_eq!(rules.opens_on(beyond, today), NaiveDate::from_ymd_opt(2024, 3, 4));
+
+        let unknown = BookingRules::default();
+        assert!(unknown.in_window(beyond, today));
+        assert_eq!(unknown.opens_on(beyond, today), None);
+
+        let dates = vec!["2024-03-08".to_string(), "2024-03-11".to_string(), "soon".to_string()];
+        assert_eq!(
+            rules.outside_window(&dates, today),
+            vec![("2024-03-11".to_string(), NaiveDate::from_ymd_opt(2024, 3, 4).unwrap())]
+        );
+        assert!(unknown.outside_window(&dates, today).is_empty());
+    }
+}
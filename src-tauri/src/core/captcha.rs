@@ -0,0 +1,178 @@
+//! Captcha solving hooks for QuickDoctor
+//! The submit flow detects a captcha challenge and asks a solver for the extra form fields.
+
+use std::future::Future;
+use std::pin::Pin;
+use std::sync::Arc;
+
+use regex::Regex;
+use tokio::sync::{oneshot, RwLock};
+
+use super::errors::{AppError, AppResult};
+use super::types::{CaptchaChallenge, CaptchaSolution};
+
+pub const CAPTCHA_KIND_IMAGE: &str = "image";
+pub const CAPTCHA_KIND_SLIDER: &str = "slider";
+
+/// Boxed future returned by captcha solvers
+pub type SolveFuture<'a> = Pin<Box<dyn Future<Output = AppResult<CaptchaSolution>> + Send + 'a>>;
+
+/// Callback notified when a challenge needs manual solving
+pub type ChallengeNotifier = Arc<dyn Fn(&CaptchaChallenge) + Send + Sync>;
+
+/// Solves captcha challenges attached to ysubmit
+/// Callers bound the wait with a timeout and cancellation; implementations may block until solved
+pub trait CaptchaSolver: Send + Sync {
+    fn solve<'a>(&'a self, challenge: &'a CaptchaChallenge) -> SolveFuture<'a>;
+}
+
+/// Solver that fails fast, used when no solving is configured
+pub struct NoopCaptchaSolver;
+
+impl CaptchaSolver for NoopCaptchaSolver {
+    fn solve<'a>(&'a self, challenge: &'a CaptchaChallenge) -> SolveFuture<'a> {
+        Box::pin(async move {
+            Err(AppError::ApiError(format!(
+                "{} captcha required, no solver configured",
+                challenge.kind
+            )))
+        })
+    }
+}
+
+/// Solver that hands the challenge to the UI and waits for provide_solution
+#[derive(Default)]
+pub struct ManualCaptchaSolver {
+    pending: RwLock<Option<oneshot::Sender<CaptchaSolution>>>,
+    notifier: RwLock<Option<ChallengeNotifier>>,
+}
+
+impl ManualCaptchaSolver {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Set the callback used to show challenges to the user
+    pub async fn set_notifier(&self, notifier: ChallengeNotifier) {
+        *self.notifier.write().await = Some(notifier);
+    }
+
+    /// Deliver a solution to the waiting submit; returns false if nothing is waiting
+    pub async fn provide_solution(&self, solution: CaptchaSolution) -> bool {
+        match self.pending.write().await.take() {
+            Some(tx) => tx.send(solution).is_ok(),
+            None => false,
+        }
+    }
+}
+
+impl CaptchaSolver for ManualCaptchaSolver {
+    fn solve<'a>(&'a self, challenge: &'a CaptchaChallenge) -> SolveFuture<'a> {
+        Box::pin(async move {
+            let (tx, rx) = oneshot::channel();
+            // A newer challenge replaces any stale one
+            *self.pending.write().await = Some(tx);
+
+            match self.notifier.read().await.clone() {
+                Some(notify) => notify(challenge),
+                None => {
+                    self.pending.write().await.take();
+                    return Err(AppError::ConfigError("captcha notifier not set".into()));
+                }
+            }
+
+            rx.await
+                .map_err(|_| AppError::Other("captcha challenge abandoned".into()))
+        })
+    }
+}
+
+/// Detect a captcha challenge in a ysubmit response body
+pub fn detect_captcha(body: &str) -> Option<CaptchaChallenge> {
+    static INPUT_RE: std::sync::OnceLock<Regex> = std::sync::OnceLock::new();
+    static IMAGE_RE: std::sync::OnceLock<Regex> = std::sync::OnceLock::new();
+    static TOKEN_RE: std::sync::OnceLock<Regex> = std::sync::OnceLock::new();
+
+    let input_re = INPUT_RE.get_or_init(|| {
+        Regex::new(r#"(?i)<input[^>]*name=["']?(captcha[\w-]*|verify_?code|yzm)["']?"#).unwrap()
+    });
+    let image_re = IMAGE_RE.get_or_init(|| {
+        Regex::new(r#"(?i)<img[^>]*(?:id|class)=["'][^"']*(?:captcha|verify)[^"']*["'][^>]*src=["']([^"']+)["']"#).unwrap()
+    });
+    let token_re = TOKEN_RE.get_or_init(|| {
+        Regex::new(r#"(?i)(?:captcha_token|slider_token)["']?\s*[:=]\s*["']([^"']+)["']"#).unwrap()
+    });
+
+    let lower = body.to_lowercase();
+    let is_slider = lower.contains("slider-captcha") || lower.contains("slide_captcha") || lower.contains("滑块验证");
+    let field = input_re.captures(body).map(|c| c[1].to_string());
+    if field.is_none() && !is_slider {
+        return None;
+    }
+
+    Some(CaptchaChallenge {
+        kind: if is_slider { CAPTCHA_KIND_SLIDER } else { CAPTCHA_KIND_IMAGE }.into(),
+        image: image_re.captures(body).map(|c| c[1].to_string()).unwrap_or_default(),
+        field: field.unwrap_or_else(|| "captcha".into()),
+        token: token_re.captures(body).map(|c| c[1].to_string()).unwrap_or_default(),
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::collections::HashMap;
+
+    #[test]
+    fn test_detect_captcha() {
+        let image = r#"<form><img id="captchaImg" src="data:image/png;base64,AAA="><input type="text" name="captcha_code"></form>"#;
+        let challenge = detect_captcha(image).unwrap();
+        assert_eq!(challenge.kind, CAPTCHA_KIND_IMAGE);
+        assert_eq!(challenge.field, "captcha_code");
+        assert_eq!(challenge.image, "data:image/png;base64,AAA=");
+
+        let slider = r#"<div class="slider-captcha"></div><script>var slider_token = "tok123";</script>"#;
+        let challenge = detect_captcha(slider).unwrap();
+        assert_eq!(challenge.kind, CAPTCHA_KIND_SLIDER);
+        assert_eq!(challenge.token, "tok123");
+
+        assert!(detect_captcha("<div class=\"error\">号源已满</div>").is_none());
+    }
+
+    #[tokio::test]
+    async fn test_manual_solver() {
+        let solver = Arc::new(ManualCaptchaSolver::new());
+        let challenge = CaptchaChallenge {
+            kind: CAPTCHA_KIND_IMAGE.into(),
+            field: "captcha".into(),
+            ..Default::default()
+        };
+
+        // No notifier: fail instead of waiting forever
+        assert!(solver.solve(&challenge).await.is_err());
+        assert!(!solver.provide_solution(CaptchaSolution::default()).await);
+
+        let (seen_tx, mut seen_rx) = tokio::sync::mpsc::unbounded_channel();
+        solver
+            .set_notifier(Arc::new(move |c: &CaptchaChallenge| {
+                let _ = seen_tx.send(c.field.clone());
+            }))
+            .await;
+
+        let waiting = solver.clone();
+        let handle = tokio::spawn(async move { waiting.solve(&challenge).await });
+        assert_eq!(seen_rx.recv().await.as_deref(), Some("captcha"));
+
+        let mut fields = HashMap::new();
+        fields.insert("captcha".to_string(), "ab12".to_string());
+        assert!(solver.provide_solution(CaptchaSolution { fields }).await);
+        let solution = handle.await.unwrap().unwrap();
+        assert_eq!(solution.fields["captcha"], "ab12");
+    }
+
+    #[tokio::test]
+    async fn test_noop_solver_fails_fast() {
+        let challenge = CaptchaChallenge::default();
+        assert!(NoopCaptchaSolver.solve(&challenge).await.is_err());
+    }
+}
@@ -0,0 +1,257 @@
+//! Development fault injection for SkylineMed
+//! With SKYLINEMED_CHAOS pointing at a scenario file, requests matching a rule get extra latency,
+//! synthetic errors or canned responses instead of reaching 91160. Release builds ignore it.
+
+use std::path::Path;
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+
+use reqwest::header::CONTENT_TYPE;
+use reqwest::ResponseBuilderExt;
+use serde::Deserialize;
+
+use super::errors::AppResult;
+
+/// Environment variable holding the scenario file path
+pub const CHAOS_ENV: &str = "SKYLINEMED_CHAOS";
+
+const INJECTED_ERROR_BODY: &str = "injected fault";
+
+/// Response returned instead of the real one
+#[derive(Debug, Clone, Deserialize)]
+pub struct CannedResponse {
+    #[serde(default = "default_canned_status")]
+    pub status: u16,
+    /// Strings are sent as-is (HTML), anything else as JSON
+    #[serde(default)]
+    pub body: serde_json::Value,
+    /// Recorded page sent as-is instead of body, relative to the scenario file
+    #[serde(default)]
+    pub body_file: Option<String>,
+}
+
+fn default_canned_status() -> u16 {
+    200
+}
+
+/// Faults for requests whose URL contains a pattern
+#[derive(Debug, Clone, Deserialize)]
+pub struct FaultRule {
+    pub url_contains: String,
+    #[serde(default)]
+    pub latency_ms: u64,
+    /// Probability (0..=1) of answering with error_status
+    #[serde(default)]
+    pub error_rate: f64,
+    #[serde(default = "default_error_status")]
+    pub error_status: u16,
+    #[serde(default)]
+    pub respond: Option<CannedResponse>,
+    /// Apply to the first N matching requests only, after which later rules take over
+    #[serde(default)]
+    pub times: Option<u32>,
+}
+
+fn default_error_status() -> u16 {
+    502
+}
+
+/// A named set of rules; the first matching rule that is not used up applies
+#[derive(Debug, Clone, Default, Deserialize)]
+pub struct ChaosScenario {
+    #[serde(default)]
+    pub name: String,
+    #[serde(default)]
+    pub rules: Vec<FaultRule>,
+}
+
+/// Applies a scenario to outgoing requests
+#[derive(Debug)]
+pub struct FaultInjector {
+    scenario: ChaosScenario,
+    hits: Mutex<Vec<u32>>,
+    /// URLs in the order they were intercepted
+    #[cfg(test)]
+    requests: Mutex<Vec<String>>,
+}
+
+impl FaultInjector {
+    pub fn new(scenario: ChaosScenario) -> Self {
+        let hits = Mutex::new(vec![0; scenario.rules.len()]);
+        Self {
+            scenario,
+            hits,
+            #[cfg(test)]
+            requests: Mutex::new(Vec::new()),
+        }
+    }
+
+    /// Load a scenario file, reading recorded bodies next to it
+    pub fn load(path: &Path) -> AppResult<Self> {
+        let data = std::fs::read_to_string(path)?;
+        let mut scenario: ChaosScenario = serde_json::from_str(&data)?;
+        let dir = path.parent().unwrap_or_else(|| Path::new("."));
+        for canned in scenario.rules.iter_mut().filter_map(|rule| rule.respond.as_mut()) {
+            if let Some(file) = canned.body_file.take() {
+                canned.body = serde_json::Value::String(std::fs::read_to_string(dir.join(file))?);
+            }
+        }
+        Ok(Self::new(scenario))
+    }
+
+    /// Requests each rule has answered so far, in rule order
+    #[cfg(test)]
+    pub fn rule_hits(&self) -> Vec<u32> {
+        self.hits.lock().unwrap_or_else(|e| e.into_inner()).clone()
+    }
+
+    /// URLs intercepted so far, in arrival order
+    #[cfg(test)]
+    pub fn requests(&self) -> Vec<String> {
+        self.requests.lock().unwrap_or_else(|e| e.into_inner()).clone()
+    }
+
+    /// Injector configured by SKYLINEMED_CHAOS, only in debug builds
+    pub fn from_env() -> Option<Arc<Self>> {
+        if !cfg!(debug_assertions) {
+            return None;
+        }
+        let path = std::env::var(CHAOS_ENV).ok().filter(|p| !p.trim().is_empty())?;
+        match Self::load(Path::new(path.trim())) {
+            Ok(injector) => {
+                println!(">>> chaos scenario '{}' active ({} rules)", injector.scenario.name, injector.scenario.rules.len());
+                Some(Arc::new(injector))
+            }
+            Err(e) => {
+                println!(">>> chaos scenario {} not loaded: {}", path, e);
+                None
+            }
+        }
+    }
+
+    /// Claim the rule for a URL, counting the hit against its limit
+    fn claim_rule(&self, url: &str) -> Option<FaultRule> {
+        let mut hits = self.hits.lock().unwrap_or_else(|e| e.into_inner());
+        for (index, rule) in self.scenario.rules.iter().enumerate() {
+            if !url.contains(&rule.url_contains) || rule.times.map_or(false, |n| hits[index] >= n) {
+                continue;
+            }
+            hits[index] += 1;
+            return Some(rule.clone());
+        }
+        None
+    }
+
+    /// Apply the matching rule: sleep its latency, then maybe answer in place of the server
+    pub async fn intercept(&self, url: &str) -> Option<reqwest::Response> {
+        #[cfg(test)]
+        self.requests.lock().unwrap_or_else(|e| e.into_inner()).push(url.to_string());
+        let rule = self.claim_rule(url)?;
+        if rule.latency_ms > 0 {
+            tokio::time::sleep(Duration::from_millis(rule.latency_ms)).await;
+        }
+        if rule.error_rate > 0.0 && rand::random::<f64>() < rule.error_rate {
+            return Some(build_response(url, rule.error_status, "text/plain", INJECTED_ERROR_BODY.into()));
+        }
+        rule.respond.map(|canned| match canned.body {
+            serde_json::Value::String(html) => build_response(url, canned.status, "text/html; charset=utf-8", html),
+            body => build_response(url, canned.status, "application/json", body.to_string()),
+        })
+    }
+}
+
+/// Synthetic response carrying the request URL, so redirect-based checks see no redirect and
+/// relative links in the body resolve against the real host
+fn build_response(url: &str, status: u16, content_type: &str, body: String) -> reqwest::Response {
+    let mut builder = http::Response::builder();
+    if let Ok(url) = reqwest::Url::parse(url) {
+        builder = builder.url(url);
+    }
+    let resp = builder
+        .status(status)
+        .header(CONTENT_TYPE, content_type)
+        .body(body)
+        .unwrap_or_else(|_| http::Response::new(INJECTED_ERROR_BODY.to_string()));
+    reqwest::Response::from(resp)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::core::client::HealthClient;
+    use crate::core::errors::AppError;
+    use crate::core::CookieRecord;
+    use std::path::PathBuf;
+    use tokio_util::sync::CancellationToken;
+
+    fn example_scenario() -> FaultInjector {
+        let path = PathBuf::from(env!("CARGO_MANIFEST_DIR")).join("testdata").join("chaos").join("race_day.json");
+        FaultInjector::load(&path).unwrap()
+    }
+
+    #[tokio::test]
+    async fn test_rules_apply_in_order_until_used_up() {
+        let injector = example_scenario();
+        let url = "https://gate.91160.com/guahao/v1/pc/sch/dep?unit_id=1&dep_id=2&date=2026-10-20&p=0&user_key=k";
+
+        let statuses = [
+            injector.intercept(url).await.unwrap().status().as_u16(),
+            injector.intercept(url).await.unwrap().status().as_u16(),
+            injector.intercept(url).await.unwrap().status().as_u16(),
+        ];
+        assert_eq!(statuses, [502, 502, 200]);
+
+        // URLs no rule matches pass through
+        assert!(injector.intercept("https://www.91160.com/news/uid-1.html").await.is_none());
+    }
+
+    /// The schedule query retries through injected 502s and parses the canned schedule
+    #[tokio::test]
+    async fn test_schedule_survives_injected_gateway_errors() {
+        let client = HealthClient::new().unwrap().with_fault_injector(Arc::new(example_scenario()));
+        client
+            .set_cookie_records(vec![CookieRecord {
+                name: "access_hash".into(),
+                value: "chaos-key-000000".into(),
+                domain: ".91160.com".into(),
+                path: "/".into(),
+                ..Default::default()
+            }])
+            .await;
+
+        let docs = client.get_schedule("200001", "300001", "2026-10-20").await.unwrap();
+        assert_eq!(docs.len(), 1);
+        assert_eq!(docs[0].doctor_name, "张医生");
+        assert_eq!(docs[0].schedules.len(), 1);
+    }
+
+    /// Stopping the run abandons a schedule query stuck behind a slow gateway
+    #[tokio::test]
+    async fn test_cancel_aborts_slow_schedule_query() {
+        let scenario = ChaosScenario {
+            name: "slow gate".into(),
+            rules: vec![serde_json::from_value(serde_json::json!({ "url_contains": "/sch/", "latency_ms": 30_000 })).unwrap()],
+        };
+        let client = HealthClient::new().unwrap().with_fault_injector(Arc::new(FaultInjector::new(scenario)));
+        client
+            .set_cookie_records(vec![CookieRecord {
+                name: "access_hash".into(),
+                value: "chaos-key-000000".into(),
+                domain: ".91160.com".into(),
+                path: "/".into(),
+                ..Default::default()
+            }])
+            .await;
+
+        let cancel = CancellationToken::new();
+        let stopper = cancel.clone();
+        tokio::spawn(async move {
+            tokio::time::sleep(Duration::from_millis(100)).await;
+            stopper.cancel();
+        });
+        let started = std::time::Instant::now();
+        let result = client.get_schedule_result_with_cancel("200001", "300001", "2026-10-20", &cancel).await;
+        assert!(matches!(result, Err(AppError::Cancelled)));
+        assert!(started.elapsed() < Duration::from_millis(500));
+    }
+}
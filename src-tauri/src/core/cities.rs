@@ -0,0 +1,122 @@
+//! City list loading for QuickDoctor
+//! Precedence is cities.json, then the network, then a compact list embedded in the binary,
+//! so a first run without network access still has something to pick from.
+
+use std::future::Future;
+use std::path::Path;
+
+use super::errors::{AppError, AppResult};
+use super::paths::write_file_atomic;
+use super::types::{City, CityList};
+
+/// Last-resort city list (id, name, pinyin) for the cities 91160 mainly serves
+const EMBEDDED_CITIES: &str = include_str!("cities_fallback.json");
+
+pub const CITY_SOURCE_FILE: &str = "file";
+pub const CITY_SOURCE_NETWORK: &str = "network";
+pub const CITY_SOURCE_EMBEDDED: &str = "embedded";
+
+/// Cities compiled into the binary
+pub fn embedded_cities() -> Vec<City> {
+    serde_json::from_str(EMBEDDED_CITIES).unwrap_or_default()
+}
+
+/// Read a non-empty city list from path
+fn read_city_file(path: &Path) -> Option<Vec<City>> {
+    let data = std::fs::read_to_string(path).ok()?;
+    let cities: Vec<City> = serde_json::from_str(&data).ok()?;
+    (!cities.is_empty()).then_some(cities)
+}
+
+/// Fetch cities and overwrite path with them; the file is left alone when the fetch fails or is empty
+pub async fn refresh_city_file<F, Fut>(path: &Path, fetch: F) -> AppResult<Vec<City>>
+where
+    F: FnOnce() -> Fut,
+    Fut: Future<Output = AppResult<Vec<City>>>,
+{
+    let cities = fetch().await?;
+    if cities.is_empty() {
+        return Err(AppError::ParseError("city list is empty".into()));
+    }
+    write_file_atomic(path, serde_json::to_string_pretty(&cities)?.as_bytes())?;
+    Ok(cities)
+}
+
+/// Load cities: the file if readable, else the network (saved to the file), else the embedded list marked stale
+pub async fn load_cities<F, Fut>(path: &Path, fetch: F) -> CityList
+where
+    F: FnOnce() -> Fut,
+    Fut: Future<Output = AppResult<Vec<City>>>,
+{
+    if let Some(cities) = read_city_file(path) {
+        return CityList { cities, source: CITY_SOURCE_FILE.into(), stale: false };
+    }
+    match refresh_city_file(path, fetch).await {
+        Ok(cities) => CityList { cities, source: CITY_SOURCE_NETWORK.into(), stale: false },
+        Err(e) => {
+            println!(">>> city list fetch failed, using embedded list: {}", e);
+            CityList { cities: embedded_cities(), source: CITY_SOURCE_EMBEDDED.into(), stale: true }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::path::PathBuf;
+
+    fn temp_test_dir(name: &str) -> PathBuf {
+        let dir = std::env::temp_dir().join(format!("skylinemed_{}_{}", name, std::process::id()));
+        let _ = std::fs::remove_dir_all(&dir);
+        std::fs::create_dir_all(&dir).unwrap();
+        dir
+    }
+
+    fn city(id: &str, name: &str) -> City {
+        City {
+            city_id: id.into(),
+            name: name.into(),
+            match_key: String::new(),
+            pinyin: String::new(),
+            sanzima: String::new(),
+        }
+    }
+
+    #[tokio::test]
+    async fn test_load_cities_precedence() {
+        let dir = temp_test_dir("cities");
+        let path = dir.join("cities.json");
+        let offline = || async { Err::<Vec<City>, _>(AppError::Other("offline".into())) };
+
+        // No file, no network: embedded and stale, nothing written
+        let list = load_cities(&path, offline).await;
+        assert_eq!((list.source.as_str(), list.stale), (CITY_SOURCE_EMBEDDED, true));
+        assert!(list.cities.len() >= 50);
+        assert!(!path.exists());
+
+        // Network wins over embedded and is saved
+        let list = load_cities(&path, || async { Ok(vec![city("5", "深圳"), city("2918", "广州")]) }).await;
+        assert_eq!((list.source.as_str(), list.stale, list.cities.len()), (CITY_SOURCE_NETWORK, false, 2));
+        assert!(path.exists());
+
+        // The file wins over the network
+        let list = load_cities(&path, || async { Ok(vec![city("1", "other")]) }).await;
+        assert_eq!((list.source.as_str(), list.cities.len()), (CITY_SOURCE_FILE, 2));
+
+        // A failed refresh keeps the file
+        assert!(refresh_city_file(&path, offline).await.is_err());
+        assert_eq!(load_cities(&path, offline).await.cities.len(), 2);
+
+        // An unreadable file falls through to the network
+        std::fs::write(&path, "not json").unwrap();
+        let list = load_cities(&path, || async { Ok(vec![city("5", "深圳")]) }).await;
+        assert_eq!((list.source.as_str(), list.cities.len()), (CITY_SOURCE_NETWORK, 1));
+    }
+
+    #[test]
+    fn test_embedded_cities() {
+        let cities = embedded_cities();
+        assert!(cities.iter().any(|c| c.city_id == "5" && c.name == "深圳"));
+        assert!(cities.iter().all(|c| !c.city_id.is_empty() && !c.name.is_empty()));
+    }
+}
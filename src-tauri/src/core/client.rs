@@ -1,59 +1,466 @@
 //! HTTP Client for QuickDoctor
 //! Corresponds to core/client.go - HTTP client with cookie management and API methods
 
-use std::collections::HashMap;
-use std::sync::Arc;
-use std::time::Duration;
-
+use std::collections::{HashMap, HashSet};
+use std::future::Future;
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+use std::sync::{Arc, OnceLock};
+use std::time::{Duration, Instant};
+
+use opentelemetry::global::BoxedTracer;
+use opentelemetry::trace::{Span, Status, Tracer, TracerProvider};
+use opentelemetry::KeyValue;
 use reqwest::cookie::Jar;
-use reqwest::header::{HeaderMap, HeaderValue, ACCEPT, CONTENT_TYPE, ORIGIN, REFERER, USER_AGENT};
+use reqwest::header::{HeaderMap, HeaderValue, ACCEPT, CONTENT_TYPE, ORIGIN, REFERER, SET_COOKIE, USER_AGENT};
 use reqwest::Client;
 use scraper::{Html, Selector};
+use hmac::{Hmac, Mac};
+use sha2::Sha256;
 use tokio::sync::RwLock;
+use tokio_util::sync::CancellationToken;
+use unicode_normalization::UnicodeNormalization;
 use url::Url;
 
-use super::cookies::{has_access_hash, load_cookie_file, save_cookie_file, unique_strings};
-use super::errors::{AppError, AppResult};
-use super::types::{CookieRecord, DepartmentCategory, DoctorSchedule, Member, ScheduleSlot, SubmitOrderResult, TicketDetail, TimeSlot, AddressOption, Hospital};
+use super::areas::parse_area_tree;
+use super::backoff::BackoffPolicy;
+use super::captcha::detect_captcha;
+use super::chaos::FaultInjector;
+use super::cookies::{earliest_expiry, has_access_hash, load_cookie_file, normalize_cookie_records, parse_set_cookie, save_cookie_file, touch_cookie_records, unique_strings};
+use super::errors::{redact_secrets, AppError, AppResult};
+use super::governor::{GovernorChange, GovernorStatus, RetryGovernor};
+use super::gates::{gate_host_for, load_gate_hosts, record_gate_host};
+use super::memory::{evict_oldest, record_evictions, Buffer, BufferStats, MemoryBudget};
+use super::netclass::{classify_transport, NetErrorKind};
+use super::paths::ConfigDir;
+use super::profiles::{builtin_profiles, ClientProfile};
+use super::schedule_decode::{decode_schedule_payload, schedule_doctor_id, GateDoctor, GateSlot};
+use super::state::{load_extra_headers, load_memory_budget};
+use super::store::{open_store, Store};
+use super::telemetry::{
+    default_tracer, tracer_from_provider, ATTR_DATE, ATTR_SCHEDULE_ID, ATTR_SUCCESS, ATTR_UNIT_ID, SPAN_GET_SCHEDULE,
+    SPAN_GET_TICKET_DETAIL, SPAN_SUBMIT_ORDER,
+};
+use super::types::{MEMBER_SKIP_NO_CELLS, MEMBER_SKIP_NO_ID, MEMBER_SKIP_NO_ID_OR_NAME, ActiveExtraHeaders, Announcement, City, CookieRecord, Department, DepartmentCategory, DepartmentDoctor, DoctorSchedule, ExtraHeaders, AreaNode, Member, MembersResult, ScheduleMeta, ScheduleResult, ScheduleSlot, ScheduleStats, SubmitOrderResult, TicketDetail, DiseaseRequirement, ConsentField, TimeSlot, AddressOption, Hospital};
+
+const SCHEDULE_STATS_CACHE_TTL: Duration = Duration::from_secs(3);
+const HOSPITAL_CACHE_TTL: Duration = Duration::from_secs(3600);
+const DEPARTMENT_CACHE_TTL: Duration = Duration::from_secs(3600);
+const FULLY_BOOKED_MARKER: &str = "已约满";
+/// Markers of a waitlist (候补) form on the ystep1 page and of a successful waitlist response
+const WAITLIST_MARKERS: [&str; 2] = ["houbu", "waitlist"];
+const WAITLIST_SUCCESS_MARKERS: [&str; 2] = ["已加入候补", "候补成功"];
+
+/// URL fragments of cashier pages; hospitals that require online payment redirect the submit there
+const CASHIER_URL_MARKERS: [&str; 5] = ["cashier", "/pay/", "pay.91160.com", "topay", "payorder"];
+
+/// Area tree used by the member address selector
+const AREA_TREE_URL: &str = "https://user.91160.com/ajax/getarea.html";
+
+/// Cookies whose rotation must be persisted so a crash doesn't lose the session
+const AUTH_COOKIE_NAMES: [&str; 2] = ["access_hash", "PHPSESSID"];
+/// Doctor title fields in schedule payloads, in priority order
+const DOCTOR_TITLE_FIELDS: [&str; 3] = ["doctor_title", "zc_name", "title"];
+/// Fields that may carry the doctor's photo URL, in priority order
+const DOCTOR_PHOTO_FIELDS: [&str; 4] = ["doctor_image", "image", "photo", "avatar"];
+/// Doctor cards on the department page, tried in order until one matches
+const DEP_DOCTOR_CARD_SELECTORS: [&str; 4] = [".doctor-item", ".doc-item", "li.doctor", "[data-doctor-id]"];
+/// Internet hospital pre-consultation flow (互联网医院预问诊)
+pub const FLOW_INTERNET_HOSPITAL: &str = "互联网医院预问诊";
+/// URL fragments of internet hospital pages
+const INTERNET_HOSPITAL_URL_MARKERS: [&str; 3] = ["/hlwyy", "hlwyy.", "/internet_hospital"];
+const COOKIE_PERSIST_MIN_INTERVAL: Duration = Duration::from_secs(30);
+const COOKIE_PERSIST_SUBMIT_POLL: Duration = Duration::from_millis(200);
+
+/// Submit params with this prefix are sent as-is under the remaining name
+pub const SUBMIT_EXTRA_FIELD_PREFIX: &str = "extra:";
+
+/// Form field carrying the submit form signature
+const SUBMIT_SIG_FIELD: &str = "_sig";
+/// Form field carrying the per-submit idempotency nonce; callers may supply one to reuse across retries
+pub const SUBMIT_NONCE_FIELD: &str = "nonce";
+const SUBMIT_AUDIT_TTL: Duration = Duration::from_secs(600);
+/// Consecutive empty schedule answers from a unit's gate host before its alternates are probed
+const GATE_PROBE_EMPTY_STREAK: u32 = 3;
+
+/// Request kinds used as keys for per-request retry policies
+pub const REQUEST_SCHEDULE: &str = "schedule";
+pub const REQUEST_SUBMIT: &str = "submit";
+pub const REQUEST_TICKET: &str = "ticket";
+pub const REQUEST_MEMBER: &str = "member";
+
+/// 429 is not retried on the spot: the governor widens the request interval instead
+const DEFAULT_RETRYABLE_STATUS_CODES: [u16; 4] = [500, 502, 503, 504];
+
+/// API error message fields, in priority order
+const DEFAULT_ERROR_MESSAGE_FIELDS: [&str; 5] = ["error_msg", "error_desc", "msg", "message", "result_msg"];
+const ERROR_CODE_FIELDS: [&str; 2] = ["error_code", "result_code"];
+/// Characters of an unexpected response body kept in the error
+const RESPONSE_SNIPPET_CHARS: usize = 120;
+
+/// Retry policy for a request kind
+#[derive(Debug, Clone)]
+pub struct RetryPolicy {
+    pub max_retries: u32,
+    pub backoff_ms: u64,
+    pub retryable_status_codes: Vec<u16>,
+}
+
+impl RetryPolicy {
+    /// Create a policy retrying the default status codes
+    pub fn new(max_retries: u32, backoff_ms: u64) -> Self {
+        Self {
+            max_retries,
+            backoff_ms,
+            retryable_status_codes: DEFAULT_RETRYABLE_STATUS_CODES.to_vec(),
+        }
+    }
+
+    /// Policy that never retries
+    pub fn none() -> Self {
+        Self::new(0, 0)
+    }
+
+    /// Pause between attempts
+    pub fn backoff(&self) -> BackoffPolicy {
+        BackoffPolicy::constant(Duration::from_millis(self.backoff_ms))
+    }
+}
+
+/// Health client configuration
+#[derive(Debug, Clone)]
+pub struct ClientConfig {
+    pub request_retry_policies: HashMap<String, RetryPolicy>,
+    pub error_message_fields: Vec<String>,
+    pub memory_budget: MemoryBudget,
+}
+
+impl Default for ClientConfig {
+    fn default() -> Self {
+        let mut policies = HashMap::new();
+        policies.insert(REQUEST_SCHEDULE.to_string(), RetryPolicy::new(2, 500));
+        // POST submissions are not idempotent
+        policies.insert(REQUEST_SUBMIT.to_string(), RetryPolicy::none());
+        policies.insert(REQUEST_TICKET.to_string(), RetryPolicy::new(2, 500));
+        policies.insert(REQUEST_MEMBER.to_string(), RetryPolicy::new(1, 500));
+        Self {
+            request_retry_policies: policies,
+            error_message_fields: DEFAULT_ERROR_MESSAGE_FIELDS.iter().map(|f| f.to_string()).collect(),
+            memory_budget: MemoryBudget::default(),
+        }
+    }
+}
+
+/// Debounced persistence of cookies rotated by the server
+#[derive(Default)]
+struct CookiePersistState {
+    disabled: AtomicBool,
+    pending: AtomicBool,
+    /// Submits in flight; a shared client can have several at once
+    submitting: AtomicUsize,
+    last_saved: RwLock<Option<Instant>>,
+}
+
+/// Cached hospital list for a city
+struct HospitalCacheEntry {
+    hospitals: Vec<Hospital>,
+    fetched_at: Instant,
+}
+
+/// Cached department list for a unit
+struct DepartmentCacheEntry {
+    categories: Vec<DepartmentCategory>,
+    fetched_at: Instant,
+}
+
+/// Empty-schedule tracking per unit; alternates are probed at most once per unit per session
+#[derive(Default)]
+struct GateProbeState {
+    empty_streaks: HashMap<String, u32>,
+    probed: HashSet<String>,
+}
+
+/// Marks a submit window; cookie persistence waits until every open one is dropped
+struct SubmitWindow(Arc<CookiePersistState>);
+
+impl SubmitWindow {
+    fn enter(state: &Arc<CookiePersistState>) -> Self {
+        state.submitting.fetch_add(1, Ordering::SeqCst);
+        Self(state.clone())
+    }
+}
+
+impl Drop for SubmitWindow {
+    fn drop(&mut self) {
+        self.0.submitting.fetch_sub(1, Ordering::SeqCst);
+    }
+}
+
+/// What is known about a submit sent with a nonce
+#[derive(Debug, Clone)]
+enum SubmitOutcome {
+    /// Sent, not answered yet
+    InFlight,
+    /// Failed before it could reach the hospital
+    NotSent,
+    /// The hospital answered
+    Answered(SubmitOrderResult),
+    /// Failed after it may have reached the hospital
+    Unknown,
+}
 
-const DEFAULT_USER_AGENT: &str = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36";
+/// One submit recorded for idempotency checks
+#[derive(Debug, Clone)]
+struct SubmitAuditEntry {
+    nonce: String,
+    at: Instant,
+    outcome: SubmitOutcome,
+}
 
 /// Health client for 91160 API
+///
+/// One client may be shared by several grabbers. Headers are built per request and the
+/// user-configured extra headers are swapped as a whole, so no request sees a half-updated set.
+/// Redirects follow the reqwest default and are never toggled at runtime. Caches, members,
+/// cookies and the submit audit sit behind their own locks. last_error/last_status_code are
+/// diagnostics only: they hold whatever the most recent caller saw and are never read back
+/// to decide a result.
 pub struct HealthClient {
-    client: Client,
+    /// Replaced as a whole when the profile rotates; requests clone it before sending
+    client: std::sync::RwLock<Client>,
     cookie_jar: Arc<Jar>,
-    cookies: RwLock<Vec<CookieRecord>>,
+    /// Identities rotated through, see profiles.rs; the first is used until a rotation
+    profiles: Vec<ClientProfile>,
+    profile_index: AtomicUsize,
+    cookies: Arc<RwLock<Vec<CookieRecord>>>,
+    cookie_persist: Arc<CookiePersistState>,
     last_error: RwLock<String>,
     last_status_code: RwLock<i32>,
+    schedule_cache: RwLock<HashMap<String, (Instant, Vec<DoctorSchedule>)>>,
+    hospital_cache: RwLock<HashMap<String, HospitalCacheEntry>>,
+    department_cache: RwLock<HashMap<String, DepartmentCacheEntry>>,
+    submit_audit: RwLock<Vec<SubmitAuditEntry>>,
+    members: RwLock<Vec<Member>>,
+    /// Last access_hash the schedule API accepted; tried first on the next query
+    active_user_key: RwLock<Option<String>>,
+    /// User-configured headers, replaceable at runtime
+    extra_headers: RwLock<ExtraHeaders>,
+    gate_probe: RwLock<GateProbeState>,
+    /// Throttled share of recent answers, widening the grabber's retry interval
+    governor: RwLock<RetryGovernor>,
+    /// Development fault injection, see chaos.rs
+    faults: Option<Arc<FaultInjector>>,
+    config: ClientConfig,
+    tracer: BoxedTracer,
+    /// Where cookies, gate hosts and user state are kept, see paths.rs
+    config_dir: ConfigDir,
+    /// Store of a client given its own config dir; None uses the process store
+    store: Option<Box<dyn Store>>,
 }
 
 impl HealthClient {
     /// Create a new health client
+    /// It starts on the first built-in profile and rotates through the others when throttled
     pub fn new() -> AppResult<Self> {
-        let cookie_jar = Arc::new(Jar::default());
+        Self::new_in(ConfigDir::default())
+    }
 
-        let client = Client::builder()
-            .user_agent(DEFAULT_USER_AGENT)
-            .cookie_provider(cookie_jar.clone())
-            .timeout(Duration::from_secs(30))
-            .connect_timeout(Duration::from_secs(10))
-            .gzip(true)
-            .brotli(true)
-            .build()
-            .map_err(|e| AppError::HttpError(e))?;
+    /// Create a health client keeping its files and store in config_dir
+    pub fn new_in(config_dir: ConfigDir) -> AppResult<Self> {
+        let cookie_jar = Arc::new(Jar::default());
+        let profiles = builtin_profiles();
+        let client = profiles[0].build_client(cookie_jar.clone()).map_err(|e| AppError::HttpError(e))?;
+        let store = if config_dir.is_default() { None } else { Some(open_store(&config_dir)?) };
 
         Ok(Self {
-            client,
+            client: std::sync::RwLock::new(client),
             cookie_jar,
-            cookies: RwLock::new(Vec::new()),
+            profiles,
+            profile_index: AtomicUsize::new(0),
+            cookies: Arc::new(RwLock::new(Vec::new())),
+            cookie_persist: Arc::new(CookiePersistState::default()),
             last_error: RwLock::new(String::new()),
             last_status_code: RwLock::new(0),
+            schedule_cache: RwLock::new(HashMap::new()),
+            hospital_cache: RwLock::new(HashMap::new()),
+            department_cache: RwLock::new(HashMap::new()),
+            submit_audit: RwLock::new(Vec::new()),
+            members: RwLock::new(Vec::new()),
+            active_user_key: RwLock::new(None),
+            extra_headers: RwLock::new(load_extra_headers(&config_dir)),
+            gate_probe: RwLock::new(GateProbeState::default()),
+            governor: RwLock::new(RetryGovernor::default()),
+            faults: FaultInjector::from_env(),
+            config: ClientConfig {
+                memory_budget: load_memory_budget(&config_dir),
+                ..Default::default()
+            },
+            tracer: default_tracer(),
+            config_dir,
+            store,
         })
     }
 
+    /// Rotate through these profiles, starting with the first; the cookie jar stays the same
+    #[allow(dead_code)]
+    pub fn with_client_profiles(mut self, profiles: Vec<ClientProfile>) -> AppResult<Self> {
+        let Some(first) = profiles.first() else {
+            return Ok(self);
+        };
+        self.client = std::sync::RwLock::new(first.build_client(self.cookie_jar.clone())?);
+        self.profiles = profiles;
+        self.profile_index = AtomicUsize::new(0);
+        Ok(self)
+    }
+
+    /// Override retry policies for the given request kinds; kinds left out keep their default
+    #[allow(dead_code)]
+    pub fn with_request_retry_policies(mut self, policies: HashMap<String, RetryPolicy>) -> Self {
+        self.config.request_retry_policies.extend(policies);
+        self
+    }
+
+    /// Override the API error message fields, in priority order
+    #[allow(dead_code)]
+    pub fn with_error_message_fields(mut self, fields: Vec<String>) -> Self {
+        self.config.error_message_fields = fields;
+        self
+    }
+
+    /// Trace requests with the given provider instead of the global one
+    #[allow(dead_code)]
+    pub fn with_tracer<P>(mut self, provider: &P) -> Self
+    where
+        P: TracerProvider,
+        P::Tracer: Send + Sync + 'static,
+        <P::Tracer as Tracer>::Span: Send + Sync + 'static,
+    {
+        self.tracer = tracer_from_provider(provider);
+        self
+    }
+
+    /// Override the in-memory buffer budget
+    #[allow(dead_code)]
+    pub fn with_memory_budget(mut self, budget: MemoryBudget) -> Self {
+        self.config.memory_budget = budget;
+        self
+    }
+
+    /// Budget the client's and the grabber's buffers are held to
+    pub fn memory_budget(&self) -> &MemoryBudget {
+        &self.config.memory_budget
+    }
+
+    /// Sizes of the client's buffers against their caps
+    pub async fn buffer_stats(&self) -> Vec<BufferStats> {
+        let budget = &self.config.memory_budget;
+        vec![
+            BufferStats::new(Buffer::ScheduleCache, self.schedule_cache.read().await.len(), budget.schedule_cache_entries),
+            BufferStats::new(Buffer::HospitalCache, self.hospital_cache.read().await.len(), budget.hospital_cache_cities),
+            BufferStats::new(Buffer::DepartmentCache, self.department_cache.read().await.len(), budget.department_cache_units),
+            BufferStats::new(Buffer::SubmitAudit, self.submit_audit.read().await.len(), budget.submit_audit_entries),
+        ]
+    }
+
+    /// Route requests through a fault injector instead of the one from SKYLINEMED_CHAOS
+    #[allow(dead_code)]
+    pub fn with_fault_injector(mut self, faults: Arc<FaultInjector>) -> Self {
+        self.faults = Some(faults);
+        self
+    }
+
+    /// HTTP client of the current profile
+    fn http(&self) -> Client {
+        self.client.read().unwrap_or_else(|e| e.into_inner()).clone()
+    }
+
+    /// Profile requests are currently sent with
+    pub fn client_profile(&self) -> &ClientProfile {
+        &self.profiles[self.profile_index.load(Ordering::SeqCst) % self.profiles.len()]
+    }
+
+    /// Switch to the next profile in round-robin order, keeping the cookie jar
+    /// Returns the new profile's name, or None when there is nothing to rotate to
+    pub fn rotate_client_profile(&self) -> AppResult<Option<String>> {
+        if self.profiles.len() < 2 {
+            return Ok(None);
+        }
+        let mut client = self.client.write().unwrap_or_else(|e| e.into_inner());
+        let next = (self.profile_index.load(Ordering::SeqCst) + 1) % self.profiles.len();
+        let profile = &self.profiles[next];
+        // The jar is shared, not copied, so cookies set by in-flight requests are kept as well
+        *client = profile.build_client(self.cookie_jar.clone())?;
+        self.profile_index.store(next, Ordering::SeqCst);
+        Ok(Some(profile.name.clone()))
+    }
+
+    /// Send a request, letting the fault injector delay or answer it when one is configured
+    async fn send(&self, request: reqwest::RequestBuilder) -> reqwest::Result<reqwest::Response> {
+        let result = match &self.faults {
+            None => request.send().await,
+            Some(faults) => {
+                let (client, request) = request.build_split();
+                let request = request?;
+                match faults.intercept(request.url().as_str()).await {
+                    Some(resp) => Ok(resp),
+                    None => client.execute(request).await,
+                }
+            }
+        };
+        if let Ok(resp) = &result {
+            self.governor.write().await.observe(resp.status() == reqwest::StatusCode::TOO_MANY_REQUESTS);
+        }
+        result
+    }
+
+    /// Count the last answer as throttled although its status was fine, e.g. a "too fast" submit
+    pub async fn note_throttled_answer(&self) {
+        self.governor.write().await.mark_last_throttled();
+    }
+
+    /// Set the retry interval a run was configured with
+    pub async fn set_governor_base_interval(&self, seconds: f64) {
+        self.governor.write().await.set_base_interval(seconds);
+    }
+
+    /// Retry interval to wait for a base interval, with the change since the previous call
+    pub async fn governed_interval(&self, base: f64) -> (f64, Option<GovernorChange>) {
+        let mut governor = self.governor.write().await;
+        (governor.effective_interval(base), governor.take_change())
+    }
+
+    pub async fn governor_status(&self) -> GovernorStatus {
+        self.governor.read().await.status()
+    }
+
+    /// Tracer used for grab spans
+    pub fn tracer(&self) -> &BoxedTracer {
+        &self.tracer
+    }
+
+    pub fn config_dir(&self) -> &ConfigDir {
+        &self.config_dir
+    }
+
+    /// Store for history, insights, pacing and submit counters of this client's runs
+    pub fn store(&self) -> AppResult<&dyn Store> {
+        match &self.store {
+            Some(store) => Ok(store.as_ref()),
+            None => super::store::store(),
+        }
+    }
+
+    /// Get the retry policy for a request kind
+    fn retry_policy(&self, kind: &str) -> RetryPolicy {
+        self.config
+            .request_retry_policies
+            .get(kind)
+            .cloned()
+            .unwrap_or_else(RetryPolicy::none)
+    }
+
     /// Load cookies from file and apply to client
     pub async fn load_cookies(&self) -> bool {
-        match load_cookie_file() {
+        match load_cookie_file(&self.config_dir) {
             Ok(records) if !records.is_empty() => {
                 self.apply_cookies(&records).await;
                 let mut cookies = self.cookies.write().await;
@@ -64,7 +471,7 @@ impl HealthClient {
         }
     }
 
-    /// Ensure cookies are loaded
+    /// Ensure cookies are loaded; expired records in memory or on disk do not count
     pub async fn ensure_cookies_loaded(&self) -> bool {
         if self.has_access_hash().await {
             return true;
@@ -78,18 +485,42 @@ impl HealthClient {
         has_access_hash(&cookies)
     }
 
+    /// Earliest known expiry of the auth cookies
+    pub async fn auth_cookie_expiry(&self) -> Option<chrono::DateTime<chrono::Local>> {
+        earliest_expiry(&self.cookies.read().await, &AUTH_COOKIE_NAMES)
+    }
+
     /// Get access_hash values
     pub async fn get_access_hash_values(&self) -> Vec<String> {
         let cookies = self.cookies.read().await;
         unique_strings(
             cookies
                 .iter()
-                .filter(|c| c.name == "access_hash" && !c.value.is_empty())
+                .filter(|c| c.name == "access_hash" && !c.value.is_empty() && !c.is_expired())
                 .map(|c| c.value.clone())
                 .collect(),
         )
     }
 
+    /// access_hash values with the last-known-good one first
+    async fn user_keys_in_order(&self) -> Vec<String> {
+        let active = self.active_user_key.read().await.clone();
+        order_user_keys(self.get_access_hash_values().await, active.as_deref())
+    }
+
+    /// Remember a user_key the schedule API accepted
+    async fn promote_user_key(&self, key: &str) {
+        let mut active = self.active_user_key.write().await;
+        if active.as_deref() != Some(key) {
+            *active = Some(key.to_string());
+        }
+    }
+
+    /// Masked last-known-good user_key for diagnostics; empty if none succeeded yet
+    pub async fn active_user_key(&self) -> String {
+        self.active_user_key.read().await.as_deref().map(mask_secret).unwrap_or_default()
+    }
+
     /// Apply cookies to the client jar
     async fn apply_cookies(&self, records: &[CookieRecord]) {
         for record in records {
@@ -107,23 +538,79 @@ impl HealthClient {
         }
     }
 
+    /// Enable or disable saving server-rotated auth cookies to disk
+    pub fn set_cookie_persistence(&self, enabled: bool) {
+        self.cookie_persist.disabled.store(!enabled, Ordering::SeqCst);
+    }
+
+    /// Merge auth cookies rotated via Set-Cookie and schedule a debounced save
+    async fn observe_set_cookies(&self, resp: &reqwest::Response) {
+        let host = resp.url().host_str().unwrap_or_default().to_string();
+        let rotated: Vec<CookieRecord> = resp
+            .headers()
+            .get_all(SET_COOKIE)
+            .iter()
+            .filter_map(|v| v.to_str().ok())
+            .filter_map(|v| parse_set_cookie(v, &host))
+            .filter(|r| AUTH_COOKIE_NAMES.contains(&r.name.as_str()))
+            .collect();
+        if rotated.is_empty() || self.cookie_persist.disabled.load(Ordering::SeqCst) {
+            return;
+        }
+        merge_cookie_records(&self.cookies, rotated).await;
+        if self.cookie_persist.pending.swap(true, Ordering::SeqCst) {
+            // A save is already scheduled and will pick up the newest values
+            return;
+        }
+
+        let cookies = self.cookies.clone();
+        let state = self.cookie_persist.clone();
+        let dir = self.config_dir.clone();
+        tokio::spawn(async move {
+            let since_last = state.last_saved.read().await.map(|t| t.elapsed());
+            if let Some(elapsed) = since_last {
+                if elapsed < COOKIE_PERSIST_MIN_INTERVAL {
+                    tokio::time::sleep(COOKIE_PERSIST_MIN_INTERVAL - elapsed).await;
+                }
+            }
+            // Never touch the disk while a submit is in flight
+            while state.submitting.load(Ordering::SeqCst) > 0 {
+                tokio::time::sleep(COOKIE_PERSIST_SUBMIT_POLL).await;
+            }
+
+            let records = cookies.read().await.clone();
+            match save_cookie_file(&dir, &records) {
+                Ok(()) => println!(">>> Rotated cookies persisted"),
+                Err(e) => println!(">>> Warning: persist rotated cookies failed: {}", e),
+            }
+            *state.last_saved.write().await = Some(Instant::now());
+            state.pending.store(false, Ordering::SeqCst);
+        });
+    }
+
     /// Save cookies from current jar to file
-    #[allow(dead_code)]
     pub async fn save_cookies_from_records(&self, records: Vec<CookieRecord>) -> AppResult<()> {
         if records.is_empty() {
             return Err(AppError::ConfigError("No cookies to save".into()));
         }
-        save_cookie_file(&records)?;
+        save_cookie_file(&self.config_dir, &records)?;
         self.apply_cookies(&records).await;
         let mut cookies = self.cookies.write().await;
         *cookies = records;
         Ok(())
     }
 
+    /// Use cookies for this session without writing them to the cookie file
+    #[allow(dead_code)]
+    pub async fn set_cookie_records(&self, records: Vec<CookieRecord>) {
+        self.apply_cookies(&records).await;
+        *self.cookies.write().await = records;
+    }
+
     /// Set last error
     async fn set_last_error(&self, message: &str) {
         let mut error = self.last_error.write().await;
-        *error = message.to_string();
+        *error = redact_secrets(message);
     }
 
     /// Set last status code
@@ -132,7 +619,7 @@ impl HealthClient {
         *status = code;
     }
 
-    /// Get last error
+    /// Get last error; with a shared client this is the most recent error of any caller
     pub async fn last_error(&self) -> String {
         self.last_error.read().await.clone()
     }
@@ -158,6 +645,30 @@ impl HealthClient {
         headers
     }
 
+    /// Replace the user-configured headers; applies from the next request
+    pub async fn set_extra_headers(&self, extra: ExtraHeaders) {
+        *self.extra_headers.write().await = extra;
+    }
+
+    /// User-configured headers as they will be sent
+    pub async fn active_extra_headers(&self) -> ActiveExtraHeaders {
+        self.extra_headers.read().await.active()
+    }
+
+    /// Put the current profile's identity headers on a request, then the user-configured headers for
+    /// the request URL's host
+    async fn with_extra_headers(&self, url: &str, mut headers: HeaderMap) -> HeaderMap {
+        self.client_profile().apply(&mut headers);
+        let extra = self.extra_headers.read().await;
+        if extra.is_empty() {
+            return headers;
+        }
+        if let Some(host) = Url::parse(url).ok().and_then(|u| u.host_str().map(str::to_string)) {
+            extra.apply(&host, &mut headers);
+        }
+        headers
+    }
+
     /// Check login status
     pub async fn check_login(&self) -> bool {
         if !self.has_access_hash().await {
@@ -175,12 +686,9 @@ impl HealthClient {
         headers.insert("Sec-Fetch-User", HeaderValue::from_static("?1"));
         headers.insert("Upgrade-Insecure-Requests", HeaderValue::from_static("1"));
 
-        let result = self
-            .client
-            .get("https://user.91160.com/user/index.html")
-            .headers(headers)
-            .send()
-            .await;
+        let url = "https://user.91160.com/user/index.html";
+        let headers = self.with_extra_headers(url, headers).await;
+        let result = self.send(self.http().get(url).headers(headers)).await;
 
         match result {
             Ok(resp) if resp.status().is_success() => true,
@@ -191,32 +699,166 @@ impl HealthClient {
         }
     }
 
+    /// get_hospitals_by_city that gives up with AppError::Cancelled as soon as cancel fires
+    pub async fn get_hospitals_by_city_with_cancel(&self, city_id: &str, cancel: &CancellationToken) -> AppResult<Vec<Hospital>> {
+        with_cancel(cancel, self.get_hospitals_by_city(city_id)).await
+    }
+
     /// Get hospitals by city
+    /// Served from cache when fetched within the last hour
     pub async fn get_hospitals_by_city(&self, city_id: &str) -> AppResult<Vec<Hospital>> {
         let city = if city_id.is_empty() { "5" } else { city_id };
 
+        if let Some(entry) = self.hospital_cache.read().await.get(city) {
+            if entry.fetched_at.elapsed() < HOSPITAL_CACHE_TTL {
+                return Ok(entry.hospitals.clone());
+            }
+        }
+
+        let data = self.fetch_hospitals_by_city(city).await?;
+        self.store_hospital_cache(city, &data).await;
+        Ok(data)
+    }
+
+    /// Cache a city's hospitals, evicting the least recently fetched cities over budget
+    async fn store_hospital_cache(&self, city: &str, hospitals: &[Hospital]) {
+        let mut cache = self.hospital_cache.write().await;
+        cache.insert(
+            city.to_string(),
+            HospitalCacheEntry {
+                hospitals: hospitals.to_vec(),
+                fetched_at: Instant::now(),
+            },
+        );
+        let evicted = evict_oldest(&mut cache, self.config.memory_budget.hospital_cache_cities, |e| e.fetched_at);
+        record_evictions(Buffer::HospitalCache, evicted);
+    }
+
+    /// Cache a unit's departments, evicting the least recently fetched units over budget
+    async fn store_department_cache(&self, unit_id: &str, categories: &[DepartmentCategory]) {
+        let mut cache = self.department_cache.write().await;
+        cache.insert(
+            unit_id.to_string(),
+            DepartmentCacheEntry {
+                categories: categories.to_vec(),
+                fetched_at: Instant::now(),
+            },
+        );
+        let evicted = evict_oldest(&mut cache, self.config.memory_budget.department_cache_units, |e| e.fetched_at);
+        record_evictions(Buffer::DepartmentCache, evicted);
+    }
+
+    /// Latest recorded outcome of a recent submit with this nonce
+    async fn recorded_submit(&self, nonce: &str) -> Option<SubmitOutcome> {
+        self.submit_audit
+            .read()
+            .await
+            .iter()
+            .rev()
+            .find(|e| e.nonce == nonce && e.at.elapsed() < SUBMIT_AUDIT_TTL)
+            .map(|e| e.outcome.clone())
+    }
+
+    /// Record a submit outcome in the audit log, keeping the most recent entries
+    async fn record_submit(&self, nonce: &str, outcome: SubmitOutcome) {
+        let mut audit = self.submit_audit.write().await;
+        audit.retain(|e| e.at.elapsed() < SUBMIT_AUDIT_TTL);
+        audit.push(SubmitAuditEntry {
+            nonce: nonce.to_string(),
+            at: Instant::now(),
+            outcome,
+        });
+        let cap = self.config.memory_budget.submit_audit_entries;
+        if audit.len() > cap {
+            let excess = audit.len() - cap;
+            audit.drain(..excess);
+            record_evictions(Buffer::SubmitAudit, excess);
+        }
+    }
+
+    /// Resolve a hospital name to its unit_id within a city
+    /// An exact name match wins over a contains match
+    pub async fn resolve_unit_id(&self, city_id: &str, hospital_name: &str) -> AppResult<String> {
+        if normalize_keyword(hospital_name).is_empty() {
+            return Err(AppError::ConfigError("hospital name is required".into()));
+        }
+
+        let hospitals = self.get_hospitals_by_city(city_id).await?;
+        best_unit_match(&hospitals, hospital_name)
+            .ok_or_else(|| AppError::ConfigError(format!("no hospital matches \"{}\" in city {}", hospital_name, city_id)))
+    }
+
+    /// Resolve the member to book for when the config has no member_id
+    /// member_name picks that member; without it the account must have exactly one certified member
+    pub async fn resolve_member(&self, member_name: &str) -> AppResult<Member> {
+        let members = self.get_members().await?;
+        select_member(&members, member_name)
+    }
+
+    /// Fetch hospitals of a city from the site
+    async fn fetch_hospitals_by_city(&self, city: &str) -> AppResult<Vec<Hospital>> {
+
         let mut headers = Self::default_headers();
         headers.insert("X-Requested-With", HeaderValue::from_static("XMLHttpRequest"));
         headers.insert(CONTENT_TYPE, HeaderValue::from_static("application/x-www-form-urlencoded; charset=UTF-8"));
         headers.insert(REFERER, HeaderValue::from_static("https://www.91160.com/"));
         headers.insert(ORIGIN, HeaderValue::from_static("https://www.91160.com"));
 
-        let resp = self
-            .client
-            .post("https://www.91160.com/ajax/getunitbycity.html")
-            .headers(headers)
-            .form(&[("c", city)])
-            .send()
-            .await?;
+        let url = "https://www.91160.com/ajax/getunitbycity.html";
+        let headers = self.with_extra_headers(url, headers).await;
+        let resp = self.send(self.http().post(url).headers(headers).form(&[("c", city)])).await?;
 
         let text = resp.text().await?;
-        let data: Vec<Hospital> = serde_json::from_str(&text)?;
-        Ok(data)
+        parse_hospitals_response(&text, city, &self.config.error_message_fields)
+    }
+
+    /// Fetch the list of cities 91160 serves
+    pub async fn fetch_cities(&self) -> AppResult<Vec<City>> {
+        let mut headers = Self::default_headers();
+        headers.insert("X-Requested-With", HeaderValue::from_static("XMLHttpRequest"));
+        headers.insert(REFERER, HeaderValue::from_static("https://www.91160.com/"));
+
+        let url = "https://www.91160.com/ajax/getcitylist.html";
+        let headers = self.with_extra_headers(url, headers).await;
+        let resp = self.send(self.http().get(url).headers(headers)).await?;
+        if !resp.status().is_success() {
+            return Err(status_error(resp).await);
+        }
+        Ok(serde_json::from_str(&resp.text().await?)?)
+    }
+
+    /// Fetch the province/city/district tree behind the member address selector
+    pub async fn fetch_area_tree(&self) -> AppResult<Vec<AreaNode>> {
+        let mut headers = Self::default_headers();
+        headers.insert("X-Requested-With", HeaderValue::from_static("XMLHttpRequest"));
+        headers.insert(REFERER, HeaderValue::from_static("https://user.91160.com/member.html"));
+
+        let headers = self.with_extra_headers(AREA_TREE_URL, headers).await;
+        let resp = self.send(self.http().get(AREA_TREE_URL).headers(headers)).await?;
+        if !resp.status().is_success() {
+            return Err(status_error(resp).await);
+        }
+        let payload: serde_json::Value = serde_json::from_str(&resp.text().await?)?;
+        Ok(parse_area_tree(&payload))
     }
 
     /// Get departments by unit
-    /// city_pinyin is used to construct the correct subdomain (e.g., "sz" -> "sz.91160.com")
+    /// Served from cache when fetched within the last hour
     pub async fn get_deps_by_unit(&self, unit_id: &str, city_pinyin: &str) -> AppResult<Vec<DepartmentCategory>> {
+        if let Some(entry) = self.department_cache.read().await.get(unit_id) {
+            if entry.fetched_at.elapsed() < DEPARTMENT_CACHE_TTL {
+                return Ok(entry.categories.clone());
+            }
+        }
+
+        let categories = self.fetch_deps_by_unit(unit_id, city_pinyin).await?;
+        self.store_department_cache(unit_id, &categories).await;
+        Ok(categories)
+    }
+
+    /// Fetch departments of a unit from the site
+    /// city_pinyin is used to construct the correct subdomain (e.g., "sz" -> "sz.91160.com")
+    async fn fetch_deps_by_unit(&self, unit_id: &str, city_pinyin: &str) -> AppResult<Vec<DepartmentCategory>> {
         // Use city pinyin as subdomain, fallback to "www" if empty
         let subdomain = if city_pinyin.is_empty() { "www" } else { city_pinyin };
         let url = format!("https://{}.91160.com/ajax/getdepbyunit.html", subdomain);
@@ -234,13 +876,8 @@ impl HealthClient {
         headers.insert(REFERER, HeaderValue::from_str(&referer).unwrap_or(HeaderValue::from_static("https://www.91160.com/")));
         headers.insert(ORIGIN, HeaderValue::from_str(&origin).unwrap_or(HeaderValue::from_static("https://www.91160.com")));
 
-        let resp = self
-            .client
-            .post(&url)
-            .headers(headers)
-            .form(&[("keyValue", unit_id)])
-            .send()
-            .await?;
+        let headers = self.with_extra_headers(&url, headers).await;
+        let resp = self.send(self.http().post(&url).headers(headers).form(&[("keyValue", unit_id)])).await?;
 
         let status = resp.status();
         println!(">>> [get_deps_by_unit] Response status: {}", status);
@@ -250,23 +887,32 @@ impl HealthClient {
         let preview = if text.len() > 500 { &text[..500] } else { &text };
         println!(">>> [get_deps_by_unit] Response body (preview): {}", preview);
         
-        // API returns: [{pubcat, yuyue_num, childs: [departments]}]
-        // We return the raw category structure so frontend can handle hierarchy
-        match serde_json::from_str::<Vec<DepartmentCategory>>(&text) {
+        // We return the category tree so the frontend can group departments
+        match parse_departments_response(&text, unit_id) {
             Ok(categories) => {
                 println!(">>> [get_deps_by_unit] Parsed {} categories successfully", categories.len());
                 Ok(categories)
             }
             Err(e) => {
-                println!(">>> [get_deps_by_unit] JSON parse error: {}", e);
+                println!(">>> [get_deps_by_unit] Parse error: {}", e);
                 println!(">>> [get_deps_by_unit] Full response: {}", text);
-                Err(AppError::JsonError(e))
+                Err(e)
             }
         }
     }
 
+    /// get_members that gives up with AppError::Cancelled as soon as cancel fires
+    pub async fn get_members_with_cancel(&self, cancel: &CancellationToken) -> AppResult<Vec<Member>> {
+        with_cancel(cancel, self.get_members()).await
+    }
+
     /// Get members (patients)
     pub async fn get_members(&self) -> AppResult<Vec<Member>> {
+        Ok(self.get_members_detailed().await?.members)
+    }
+
+    /// Get members together with diagnostics on how the member page was parsed
+    pub async fn get_members_detailed(&self) -> AppResult<MembersResult> {
         let mut headers = Self::default_headers();
         // Page request - no XMLHttpRequest
         headers.insert(ACCEPT, HeaderValue::from_static("text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7"));
@@ -277,54 +923,65 @@ impl HealthClient {
         headers.insert("Upgrade-Insecure-Requests", HeaderValue::from_static("1"));
         headers.insert(REFERER, HeaderValue::from_static("https://user.91160.com/user/index.html"));
 
-        let resp = self
-            .client
-            .get("https://user.91160.com/member.html")
-            .headers(headers)
-            .send()
-            .await?;
+        let url = "https://user.91160.com/member.html";
+        let headers = self.with_extra_headers(url, headers).await;
+        let resp = with_retry(&self.retry_policy(REQUEST_MEMBER), || {
+            self.send(self.http().get(url).headers(headers.clone()))
+        })
+        .await?;
 
         let url = resp.url().to_string();
         let body = resp.text().await?;
 
-        // Check if redirected to login
-        if url.to_lowercase().contains("login") || body.contains("登录") {
-            return Ok(Vec::new());
+        let result = parse_members_page(&body, &url);
+        if !result.members.is_empty() {
+            let mut cached = self.members.write().await;
+            *cached = result.members.clone();
         }
 
-        // Parse HTML
-        let document = Html::parse_document(&body);
-        let row_selector = Selector::parse("tbody#mem_list tr").unwrap();
-        let td_selector = Selector::parse("td").unwrap();
-
-        let mut members = Vec::new();
+        Ok(result)
+    }
 
-        for row in document.select(&row_selector) {
-            let id = row
-                .value()
-                .attr("id")
-                .unwrap_or("")
-                .trim_start_matches("mem")
-                .to_string();
+    /// get_member_by_id that gives up with AppError::Cancelled as soon as cancel fires
+    pub async fn get_member_by_id_with_cancel(&self, member_id: &str, cancel: &CancellationToken) -> AppResult<Option<Member>> {
+        with_cancel(cancel, self.get_member_by_id(member_id)).await
+    }
 
-            let tds: Vec<_> = row.select(&td_selector).collect();
-            if tds.is_empty() {
-                continue;
+    /// Get a member by ID, using the cached member list when possible
+    pub async fn get_member_by_id(&self, member_id: &str) -> AppResult<Option<Member>> {
+        {
+            let cached = self.members.read().await;
+            if let Some(member) = cached.iter().find(|m| m.id == member_id) {
+                return Ok(Some(member.clone()));
             }
+        }
 
-            let mut name = tds[0].text().collect::<String>().trim().to_string();
-            name = name.replace("默认", "");
-
-            let certified = tds.iter().any(|td| td.text().collect::<String>().contains("认证"));
-
-            if id.is_empty() && name.is_empty() {
-                continue;
-            }
+        let members = self.get_members().await?;
+        Ok(members.into_iter().find(|m| m.id == member_id))
+    }
 
-            members.push(Member { id, name, certified });
-        }
+    /// get_schedule_result that gives up with AppError::Cancelled as soon as cancel fires
+    pub async fn get_schedule_result_with_cancel(
+        &self,
+        unit_id: &str,
+        dep_id: &str,
+        date: &str,
+        cancel: &CancellationToken,
+    ) -> AppResult<ScheduleResult> {
+        with_cancel(cancel, self.get_schedule_result(unit_id, dep_id, date)).await
+    }
 
-        Ok(members)
+    /// get_doctors_schedule that gives up with AppError::Cancelled as soon as cancel fires
+    pub async fn get_doctors_schedule_with_cancel(
+        &self,
+        unit_id: &str,
+        dep_id: &str,
+        date: &str,
+        doctor_ids: &HashSet<String>,
+        ready: Option<&(dyn Fn(&str, &ScheduleSlot) -> bool + Sync)>,
+        cancel: &CancellationToken,
+    ) -> AppResult<ScheduleResult> {
+        with_cancel(cancel, self.get_doctors_schedule(unit_id, dep_id, date, doctor_ids, ready)).await
     }
 
     /// Get schedule for a department on a date
@@ -334,27 +991,160 @@ impl HealthClient {
         dep_id: &str,
         date: &str,
     ) -> AppResult<Vec<DoctorSchedule>> {
-        self.set_last_error("").await;
-        self.set_last_status_code(0).await;
+        Ok(self.get_schedule_result(unit_id, dep_id, date).await?.docs)
+    }
 
+    /// Get schedule for a department on a date, with where and when the answer came from
+    pub async fn get_schedule_result(
+        &self,
+        unit_id: &str,
+        dep_id: &str,
+        date: &str,
+    ) -> AppResult<ScheduleResult> {
         let date = if date.is_empty() {
             chrono::Local::now().format("%Y-%m-%d").to_string()
         } else {
             date.to_string()
         };
 
-        let user_keys = self.get_access_hash_values().await;
+        let mut span = self.tracer.start(SPAN_GET_SCHEDULE);
+        span.set_attribute(KeyValue::new(ATTR_UNIT_ID, unit_id.to_string()));
+        span.set_attribute(KeyValue::new(ATTR_DATE, date.clone()));
+
+        let (data, meta) = match self.fetch_schedule_data(unit_id, dep_id, &date, None).await {
+            Ok(answer) => answer,
+            Err(e) => {
+                span.set_status(Status::error(e.to_string()));
+                return Err(e);
+            }
+        };
+        let docs = parse_schedule_docs(&data, None);
+        self.store_schedule_cache(unit_id, dep_id, &date, &docs).await;
+        Ok(ScheduleResult { docs, meta })
+    }
+
+    /// Get the schedule of the given doctors only; other doctors' slots are skipped while decoding
+    /// With ready set, doctors after the first one holding a ready slot are not normalized.
+    /// The result is partial, so it is never cached.
+    pub async fn get_doctors_schedule(
+        &self,
+        unit_id: &str,
+        dep_id: &str,
+        date: &str,
+        doctor_ids: &HashSet<String>,
+        ready: Option<&(dyn Fn(&str, &ScheduleSlot) -> bool + Sync)>,
+    ) -> AppResult<ScheduleResult> {
+        let (data, meta) = self.fetch_schedule_data(unit_id, dep_id, date, Some(doctor_ids)).await?;
+        let docs = match ready {
+            Some(ready) => parse_schedule_docs_until(&data, ready),
+            None => parse_schedule_docs(&data, None),
+        };
+        Ok(ScheduleResult { docs, meta })
+    }
+
+    /// Refresh the slots of a single doctor, e.g. after a submit lost the race
+    /// Queries the department schedule but only decodes the requested doctor
+    pub async fn refresh_doctor_slots(
+        &self,
+        unit_id: &str,
+        dep_id: &str,
+        date: &str,
+        doctor_id: &str,
+    ) -> AppResult<Vec<ScheduleSlot>> {
+        let doctors: HashSet<String> = [doctor_id.to_string()].into_iter().collect();
+        let (data, _) = self.fetch_schedule_data(unit_id, dep_id, date, Some(&doctors)).await?;
+        Ok(parse_schedule_docs(&data, Some(doctor_id))
+            .into_iter()
+            .next()
+            .map(|doc| doc.schedules)
+            .unwrap_or_default())
+    }
+
+    /// Fetch the raw sch/dep payload data, trying each access_hash in turn
+    /// With doctors set, only their entries are decoded
+    /// The error is tracked locally and only published to last_error at the end, so concurrent queries don't mix
+    async fn fetch_schedule_data(
+        &self,
+        unit_id: &str,
+        dep_id: &str,
+        date: &str,
+        doctors: Option<&HashSet<String>>,
+    ) -> AppResult<(serde_json::Value, ScheduleMeta)> {
+        let host = gate_host_for(&self.config_dir, unit_id);
+        if let Some(answer) = self.fetch_schedule_from(&host, unit_id, dep_id, date, doctors).await? {
+            self.gate_probe.write().await.empty_streaks.remove(unit_id);
+            return Ok(answer);
+        }
+
+        if self.note_empty_schedule(unit_id).await {
+            if let Some(answer) = self.probe_gate_hosts(unit_id, dep_id, date, doctors).await {
+                return Ok(answer);
+            }
+        }
+
+        self.set_last_error("schedule query returned no doctors").await;
+        Err(AppError::ScheduleEmpty)
+    }
+
+    /// Count an empty answer for a unit; true once the streak calls for a probe that has not run yet
+    async fn note_empty_schedule(&self, unit_id: &str) -> bool {
+        let mut probe = self.gate_probe.write().await;
+        let streak = probe.empty_streaks.entry(unit_id.to_string()).or_insert(0);
+        *streak += 1;
+        *streak >= GATE_PROBE_EMPTY_STREAK && probe.probed.insert(unit_id.to_string())
+    }
+
+    /// Try each alternate gate host once; the first that returns doctors is recorded for the unit
+    async fn probe_gate_hosts(
+        &self,
+        unit_id: &str,
+        dep_id: &str,
+        date: &str,
+        doctors: Option<&HashSet<String>>,
+    ) -> Option<(serde_json::Value, ScheduleMeta)> {
+        let candidates = load_gate_hosts(&self.config_dir).unwrap_or_default().probe_candidates(unit_id);
+        for host in candidates {
+            match self.fetch_schedule_from(&host, unit_id, dep_id, date, doctors).await {
+                Ok(Some(answer)) => {
+                    println!(">>> gate host {} answered for unit {}", host, unit_id);
+                    if let Err(e) = record_gate_host(&self.config_dir, unit_id, &host) {
+                        println!(">>> saving gate host failed: {}", e);
+                    }
+                    self.gate_probe.write().await.empty_streaks.remove(unit_id);
+                    return Some(answer);
+                }
+                Ok(None) => {}
+                Err(e) => println!(">>> gate host {} probe failed: {}", host, e),
+            }
+        }
+        None
+    }
+
+    /// Query the schedule from one gate host; Ok(None) means the API answered without doctors
+    async fn fetch_schedule_from(
+        &self,
+        host: &str,
+        unit_id: &str,
+        dep_id: &str,
+        date: &str,
+        doctors: Option<&HashSet<String>>,
+    ) -> AppResult<Option<(serde_json::Value, ScheduleMeta)>> {
+        let user_keys = self.user_keys_in_order().await;
         if user_keys.is_empty() {
             self.set_last_error("missing access_hash").await;
             return Err(AppError::LoginRequired("missing access_hash".into()));
         }
 
         let mut login_expired = false;
+        let mut answered_empty = false;
+        let mut last_err = String::new();
+        // Set while the latest failure is a network one, so the caller learns which hop failed
+        let mut last_net: Option<NetErrorKind> = None;
 
         for key in &user_keys {
             let url = format!(
-                "https://gate.91160.com/guahao/v1/pc/sch/dep?unit_id={}&dep_id={}&date={}&p=0&user_key={}",
-                unit_id, dep_id, date, key
+                "https://{}/guahao/v1/pc/sch/dep?unit_id={}&dep_id={}&date={}&p=0&user_key={}",
+                host, unit_id, dep_id, date, key
             );
 
             let mut headers = Self::default_headers();
@@ -365,145 +1155,74 @@ impl HealthClient {
                 headers.insert(REFERER, v);
             }
 
-            let resp = match self.client.get(&url).headers(headers).send().await {
+            let headers = self.with_extra_headers(&url, headers).await;
+            let policy = self.retry_policy(REQUEST_SCHEDULE);
+            let started = Instant::now();
+            let resp = match with_retry(&policy, || self.send(self.http().get(&url).headers(headers.clone()))).await {
                 Ok(r) => r,
                 Err(e) => {
-                    self.set_last_error(&format!("schedule request failed: {}", e)).await;
+                    last_err = format!("schedule request failed: {}", e);
+                    last_net = Some(classify_transport(&e, false));
                     continue;
                 }
             };
 
-            self.set_last_status_code(resp.status().as_u16() as i32).await;
+            let http_status = resp.status().as_u16();
+            self.set_last_status_code(http_status as i32).await;
+            self.observe_set_cookies(&resp).await;
 
             if !resp.status().is_success() {
-                self.set_last_error(&format!("schedule http {}", resp.status())).await;
+                last_err = format!("schedule http {}", resp.status());
+                last_net = resp.status().is_server_error().then_some(NetErrorKind::ServerError);
                 continue;
             }
 
-            let payload: serde_json::Value = match resp.json().await {
-                Ok(v) => v,
+            let body = match resp.bytes().await {
+                Ok(body) => body,
+                Err(e) => {
+                    last_err = format!("schedule read failed: {}", e);
+                    last_net = Some(classify_transport(&e, false));
+                    continue;
+                }
+            };
+            let mut meta = ScheduleMeta {
+                fetched_at: chrono::Local::now(),
+                round_trip_ms: started.elapsed().as_millis() as u64,
+                host: host.to_string(),
+                user_key: mask_secret(key),
+                http_status,
+                roster: Vec::new(),
+                sch_keys: Vec::new(),
+            };
+            let mut payload = match decode_schedule_payload(&body, doctors) {
+                Ok(payload) => payload,
                 Err(e) => {
-                    self.set_last_error(&format!("schedule decode failed: {}", e)).await;
+                    last_err = format!("schedule decode failed: {}", e);
+                    last_net = None;
                     continue;
                 }
             };
 
-            let result_code = payload.get("result_code").and_then(|v| v.as_str()).unwrap_or("");
+            let result_code = payload.fields.get("result_code").and_then(|v| v.as_str()).unwrap_or("");
 
             if result_code == "1" {
-                let data = payload.get("data");
-                let doc_list = data
-                    .and_then(|d| d.get("doc"))
-                    .and_then(|d| d.as_array())
-                    .cloned()
-                    .unwrap_or_default();
-                let sch_map = data
-                    .and_then(|d| d.get("sch"))
-                    .and_then(|s| s.as_object())
-                    .cloned()
-                    .unwrap_or_default();
-
-                let mut valid_docs = Vec::new();
-
-                for doc_value in &doc_list {
-                    let doctor_id = if let Some(s) = doc_value.get("doctor_id").and_then(|v| v.as_str()) {
-                        s.to_string()
-                    } else if let Some(n) = doc_value.get("doctor_id").and_then(|v| v.as_i64()) {
-                        n.to_string()
-                    } else {
-                        String::new()
-                    };
-
-                    if doctor_id.is_empty() {
-                        continue;
-                    }
-
-                    let raw_schedule = sch_map.get(&doctor_id);
-                    if raw_schedule.is_none() {
-                        continue;
-                    }
-
-                    let mut schedules = Vec::new();
-
-                    if let Some(sch_data) = raw_schedule.and_then(|s| s.as_object()) {
-                        for time_type in ["am", "pm"] {
-                            if let Some(type_data) = sch_data.get(time_type) {
-                                let slots: Vec<&serde_json::Value> = if type_data.is_object() {
-                                    type_data.as_object().unwrap().values().collect()
-                                } else if type_data.is_array() {
-                                    type_data.as_array().unwrap().iter().collect()
-                                } else {
-                                    continue;
-                                };
-
-                                for slot in slots {
-                                    let schedule_id = if let Some(s) = slot.get("schedule_id").and_then(|v| v.as_str()) {
-                                        s.to_string()
-                                    } else if let Some(n) = slot.get("schedule_id").and_then(|v| v.as_i64()) {
-                                        n.to_string()
-                                    } else {
-                                        String::new()
-                                    };
-
-                                    if !schedule_id.is_empty() {
-                                        schedules.push(ScheduleSlot {
-                                            schedule_id,
-                                            time_type: slot.get("time_type").and_then(|v| v.as_str()).unwrap_or("").to_string(),
-                                            time_type_desc: slot.get("time_type_desc").and_then(|v| v.as_str()).unwrap_or("").to_string(),
-                                            left_num: slot.get("left_num").and_then(|v| v.as_i64()).unwrap_or(0) as i32,
-                                            sch_date: slot.get("sch_date").and_then(|v| v.as_str()).unwrap_or("").to_string(),
-                                        });
-                                    }
-                                }
-                            }
-                        }
-                    }
-
-                    if schedules.is_empty() {
-                        continue;
-                    }
-
-                    let total_left: i32 = schedules.iter().map(|s| s.left_num).sum();
-
-                    valid_docs.push(DoctorSchedule {
-                        doctor_id,
-                        doctor_name: doc_value.get("doctor_name").and_then(|v| v.as_str()).unwrap_or("").to_string(),
-                        reg_fee: doc_value.get("reg_fee").and_then(|v| v.as_str()).unwrap_or("").to_string(),
-                        total_left_num: total_left,
-                        his_doc_id: doc_value.get("his_doc_id").and_then(|v| v.as_str()).unwrap_or("").to_string(),
-                        his_dep_id: doc_value.get("his_dep_id").and_then(|v| v.as_str()).unwrap_or("").to_string(),
-                        schedule_id: schedules.first().map(|s| s.schedule_id.clone()).unwrap_or_default(),
-                        time_type_desc: schedules.first().map(|s| s.time_type_desc.clone()).unwrap_or_default(),
-                        schedules,
-                    });
-                }
-
-                if !valid_docs.is_empty() {
-                    self.set_last_error("").await;
-                    return Ok(valid_docs);
-                }
-
-                if !doc_list.is_empty() {
+                self.promote_user_key(key).await;
+                // Judged on the unfiltered count, so a filter matching nobody is not an empty answer
+                if payload.data.doc_total > 0 {
                     self.set_last_error("").await;
-                    return Ok(Vec::new());
+                    meta.roster = std::mem::take(&mut payload.data.roster);
+                    meta.sch_keys = std::mem::take(&mut payload.data.sch_keys);
+                    return Ok(Some((payload.data.into_value(), meta)));
                 }
-            } else if payload.get("error_code").and_then(|v| v.as_str()) == Some("10022") {
+                answered_empty = true;
+            } else if payload.fields.get("error_code").and_then(|v| v.as_str()) == Some("10022") {
                 login_expired = true;
                 continue;
             } else {
-                let error_msg = payload
-                    .get("error_msg")
-                    .or_else(|| payload.get("error_desc"))
-                    .or_else(|| payload.get("msg"))
-                    .or_else(|| payload.get("message"))
-                    .and_then(|v| v.as_str())
-                    .unwrap_or("");
-                let error_code = payload
-                    .get("error_code")
-                    .or_else(|| payload.get("result_code"))
-                    .and_then(|v| v.as_str())
-                    .unwrap_or("");
-                self.set_last_error(&format!("schedule api error: code={} msg={}", error_code, error_msg)).await;
+                let fields = serde_json::Value::Object(payload.fields);
+                let (error_code, error_msg) = parse_api_error(&fields, &self.config.error_message_fields);
+                last_err = format!("schedule api error: code={} msg={}", error_code, error_msg);
+                last_net = None;
             }
         }
 
@@ -512,11 +1231,124 @@ impl HealthClient {
             return Err(AppError::LoginRequired("error_code=10022".into()));
         }
 
-        let err = self.last_error().await;
-        if err.is_empty() {
-            self.set_last_error("schedule query failed").await;
+        if answered_empty {
+            return Ok(None);
+        }
+        if last_err.is_empty() {
+            last_err = "schedule query failed".into();
+        }
+        self.set_last_error(&last_err).await;
+        match last_net {
+            Some(kind) => Err(AppError::Network { kind, detail: redact_secrets(&last_err) }),
+            None => Err(AppError::ApiError(redact_secrets(&last_err))),
+        }
+    }
+
+    /// Get announcements from the hospital's news page
+    pub async fn get_hospital_announcements(&self, unit_id: &str) -> AppResult<Vec<Announcement>> {
+        let url = format!("https://www.91160.com/news/uid-{}.html", unit_id);
+
+        let mut headers = Self::default_headers();
+        headers.insert(ACCEPT, HeaderValue::from_static("text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"));
+        headers.insert("Sec-Fetch-Dest", HeaderValue::from_static("document"));
+        headers.insert("Sec-Fetch-Mode", HeaderValue::from_static("navigate"));
+        headers.insert(REFERER, HeaderValue::from_static("https://www.91160.com/"));
+
+        let headers = self.with_extra_headers(&url, headers).await;
+        let resp = self.send(self.http().get(&url).headers(headers)).await?;
+        if !resp.status().is_success() {
+            return Err(status_error(resp).await);
+        }
+
+        let body = resp.text().await?;
+        Ok(parse_announcements(&body, &url))
+    }
+
+    /// List every doctor of a department from the department page, whether or not they have slots
+    pub async fn get_doctors_by_dep(&self, unit_id: &str, dep_id: &str) -> AppResult<Vec<DepartmentDoctor>> {
+        if !self.has_access_hash().await {
+            return Err(AppError::LoginRequired("missing access_hash".into()));
+        }
+        let url = format!("https://www.91160.com/guahao/ystep1/uid-{}/depid-{}.html", unit_id, dep_id);
+
+        let mut headers = Self::default_headers();
+        headers.insert(ACCEPT, HeaderValue::from_static("text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8"));
+        headers.insert("Sec-Fetch-Dest", HeaderValue::from_static("document"));
+        headers.insert("Sec-Fetch-Mode", HeaderValue::from_static("navigate"));
+        let referer = format!("https://www.91160.com/unit/index/uid-{}.html", unit_id);
+        if let Ok(v) = HeaderValue::from_str(&referer) {
+            headers.insert(REFERER, v);
+        }
+
+        let headers = self.with_extra_headers(&url, headers).await;
+        let resp = with_retry(&self.retry_policy(REQUEST_TICKET), || {
+            self.send(self.http().get(&url).headers(headers.clone()))
+        })
+        .await?;
+        self.observe_set_cookies(&resp).await;
+        if !resp.status().is_success() {
+            return Err(status_error(resp).await);
+        }
+
+        let page_url = resp.url().to_string();
+        if page_url.to_lowercase().contains("login") {
+            self.set_last_error("department page redirected to login").await;
+            return Err(AppError::LoginRequired("department page redirected to login".into()));
+        }
+        let body = resp.text().await?;
+        Ok(parse_department_doctors(&body))
+    }
+
+    /// Get aggregate schedule statistics without the full doctor list
+    /// Results younger than SCHEDULE_STATS_CACHE_TTL are served from the schedule cache
+    pub async fn get_schedule_stats(
+        &self,
+        unit_id: &str,
+        dep_id: &str,
+        date: &str,
+    ) -> AppResult<ScheduleStats> {
+        let date = if date.is_empty() {
+            chrono::Local::now().format("%Y-%m-%d").to_string()
+        } else {
+            date.to_string()
+        };
+
+        if let Some(docs) = self.cached_schedule(unit_id, dep_id, &date, SCHEDULE_STATS_CACHE_TTL).await {
+            return Ok(ScheduleStats::from_schedule(&docs));
         }
-        Err(AppError::ApiError(self.last_error().await))
+
+        let docs = self.get_schedule(unit_id, dep_id, &date).await?;
+        Ok(ScheduleStats::from_schedule(&docs))
+    }
+
+    /// Get a cached schedule result if it is younger than ttl
+    async fn cached_schedule(&self, unit_id: &str, dep_id: &str, date: &str, ttl: Duration) -> Option<Vec<DoctorSchedule>> {
+        let cache = self.schedule_cache.read().await;
+        cache
+            .get(&schedule_cache_key(unit_id, dep_id, date))
+            .filter(|(fetched_at, _)| fetched_at.elapsed() < ttl)
+            .map(|(_, docs)| docs.clone())
+    }
+
+    /// Store a successful schedule result in the cache
+    async fn store_schedule_cache(&self, unit_id: &str, dep_id: &str, date: &str, docs: &[DoctorSchedule]) {
+        let mut cache = self.schedule_cache.write().await;
+        cache.retain(|_, (fetched_at, _)| fetched_at.elapsed() < SCHEDULE_STATS_CACHE_TTL);
+        cache.insert(schedule_cache_key(unit_id, dep_id, date), (Instant::now(), docs.to_vec()));
+        let evicted = evict_oldest(&mut cache, self.config.memory_budget.schedule_cache_entries, |(at, _)| *at);
+        record_evictions(Buffer::ScheduleCache, evicted);
+    }
+
+    /// get_ticket_detail that gives up with AppError::Cancelled as soon as cancel fires
+    pub async fn get_ticket_detail_with_cancel(
+        &self,
+        unit_id: &str,
+        dep_id: &str,
+        schedule_id: &str,
+        member_id: &str,
+        cancel: &CancellationToken,
+    ) -> AppResult<TicketDetail> {
+        with_cancel(cancel, self.get_ticket_detail(unit_id, dep_id, schedule_id, member_id)).await
     }
 
     /// Get ticket detail for a schedule
@@ -525,105 +1357,197 @@ impl HealthClient {
         unit_id: &str,
         dep_id: &str,
         schedule_id: &str,
-        _member_id: &str,
+        member_id: &str,
     ) -> AppResult<TicketDetail> {
+        let mut span = self.tracer.start(SPAN_GET_TICKET_DETAIL);
+        span.set_attribute(KeyValue::new(ATTR_SCHEDULE_ID, schedule_id.to_string()));
+
+        let body = match self.fetch_ticket_page(unit_id, dep_id, schedule_id).await {
+            Ok(body) => body,
+            Err(e) => {
+                span.set_status(Status::error(e.to_string()));
+                return Err(e);
+            }
+        };
+        Ok(parse_ticket_detail(&body, member_id))
+    }
+
+    /// recheck_ticket_available that gives up with AppError::Cancelled as soon as cancel fires
+    pub async fn recheck_ticket_available_with_cancel(
+        &self,
+        unit_id: &str,
+        dep_id: &str,
+        schedule_id: &str,
+        member_id: &str,
+        detlid: &str,
+        cancel: &CancellationToken,
+    ) -> AppResult<bool> {
+        with_cancel(cancel, self.recheck_ticket_available(unit_id, dep_id, schedule_id, member_id, detlid)).await
+    }
+
+    /// Re-fetch the ystep1 page and check the selected time slot is still bookable
+    pub async fn recheck_ticket_available(
+        &self,
+        unit_id: &str,
+        dep_id: &str,
+        schedule_id: &str,
+        member_id: &str,
+        detlid: &str,
+    ) -> AppResult<bool> {
+        let body = self.fetch_ticket_page(unit_id, dep_id, schedule_id).await?;
+        Ok(ticket_still_available(&body, member_id, detlid))
+    }
+
+    /// Fetch the raw ystep1 appointment page
+    async fn fetch_ticket_page(&self, unit_id: &str, dep_id: &str, schedule_id: &str) -> AppResult<String> {
         let url = format!(
             "https://www.91160.com/guahao/ystep1/uid-{}/depid-{}/schid-{}.html",
             unit_id, dep_id, schedule_id
         );
 
-        let resp = self
-            .client
-            .get(&url)
-            .headers(Self::default_headers())
-            .send()
-            .await?;
+        let headers = self.with_extra_headers(&url, Self::default_headers()).await;
+        let resp = with_retry(&self.retry_policy(REQUEST_TICKET), || {
+            self.send(self.http().get(&url).headers(headers.clone()))
+        })
+        .await?;
+        self.observe_set_cookies(&resp).await;
 
+        let page_url = resp.url().to_string();
         let body = resp.text().await?;
-        let document = Html::parse_document(&body);
+        if let Some(flow) = detect_unsupported_flow(&page_url, &body) {
+            return Err(AppError::FlowUnsupported { flow: flow.into(), url: page_url });
+        }
+        Ok(body)
+    }
 
-        // Parse time slots
-        let li_selector = Selector::parse("#delts li").unwrap();
-        let time_slots: Vec<TimeSlot> = document
-            .select(&li_selector)
-            .filter_map(|el| {
-                let name = el.text().collect::<String>().trim().to_string();
-                let value = el.value().attr("val").unwrap_or("").to_string();
+    /// Join the waitlist (候补) for a fully booked schedule
+    /// The waitlist form is read from the ystep1 page since it posts to a different endpoint than ysubmit
+    pub async fn submit_waitlist(
+        &self,
+        unit_id: &str,
+        dep_id: &str,
+        schedule_id: &str,
+        member_id: &str,
+    ) -> AppResult<SubmitOrderResult> {
+        let body = self.fetch_ticket_page(unit_id, dep_id, schedule_id).await?;
+        let Some((action, mut data)) = parse_waitlist_form(&body) else {
+            return Err(AppError::ApiError("waitlist not offered for this schedule".into()));
+        };
+        for field in ["mid", "member_id"] {
+            if let Some(value) = data.get_mut(field) {
                 if value.is_empty() {
-                    None
-                } else {
-                    Some(TimeSlot { name, value })
-                }
-            })
-            .collect();
-
-        // Helper to get input value
-        let get_input_value = |selectors: &[&str]| -> String {
-            for selector in selectors {
-                if let Ok(sel) = Selector::parse(selector) {
-                    if let Some(el) = document.select(&sel).next() {
-                        if let Some(val) = el.value().attr("value") {
-                            return val.trim().to_string();
-                        }
-                    }
+                    *value = member_id.to_string();
                 }
             }
-            String::new()
-        };
+        }
+        data.entry("unit_id".into()).or_insert_with(|| unit_id.to_string());
+        data.entry("dep_id".into()).or_insert_with(|| dep_id.to_string());
+        data.entry("schedule_id".into()).or_insert_with(|| schedule_id.to_string());
 
-        // Parse addresses from select
-        let mut addresses = Vec::new();
-        let address_selectors = ["select[name='addressId']", "#addressId", "#useraddress_area"];
-        for selector in address_selectors {
-            if let Ok(sel) = Selector::parse(selector) {
-                if let Some(select_el) = document.select(&sel).next() {
-                    if let Ok(option_sel) = Selector::parse("option") {
-                        for option in select_el.select(&option_sel) {
-                            let id = option.value().attr("value").unwrap_or("").trim().to_string();
-                            let text = option.text().collect::<String>().trim().to_string();
-                            if !id.is_empty() && id != "0" && id != "-1" && !text.is_empty() {
-                                addresses.push(AddressOption { id, text });
-                            }
-                        }
-                    }
-                    break;
-                }
-            }
+        let mut headers = Self::default_headers();
+        headers.insert(CONTENT_TYPE, HeaderValue::from_static("application/x-www-form-urlencoded"));
+        headers.insert(ORIGIN, HeaderValue::from_static("https://www.91160.com"));
+        let referer = format!(
+            "https://www.91160.com/guahao/ystep1/uid-{}/depid-{}/schid-{}.html",
+            unit_id, dep_id, schedule_id
+        );
+        if let Ok(v) = HeaderValue::from_str(&referer) {
+            headers.insert(REFERER, v);
         }
 
-        let mut address_id = get_input_value(&["input[name='addressId']", "#addressId"]);
-        let mut address = get_input_value(&["input[name='address']", "#address"]);
+        let headers = self.with_extra_headers(&action, headers).await;
+        let _submit_window = SubmitWindow::enter(&self.cookie_persist);
+        let resp = with_retry(&self.retry_policy(REQUEST_SUBMIT), || {
+            self.send(self.http().post(&action).headers(headers.clone()).form(&data))
+        })
+        .await?;
+        let url = resp.url().to_string();
+        let body = resp.text().await?;
 
-        // Fallback to first address
-        if (address_id.is_empty() || address.is_empty()) && !addresses.is_empty() {
-            if address_id.is_empty() {
-                address_id = addresses[0].id.clone();
-            }
-            if address.is_empty() {
-                address = addresses[0].text.clone();
-            }
-        }
-
-        Ok(TicketDetail {
-            times: time_slots.clone(),
-            time_slots,
-            sch_data: get_input_value(&["input[name='sch_data']"]),
-            detlid_realtime: get_input_value(&["#detlid_realtime"]),
-            level_code: get_input_value(&["#level_code"]),
-            sch_date: get_input_value(&["input[name='sch_date']", "#sch_date"]),
-            order_no: get_input_value(&["input[name='order_no']", "#order_no"]),
-            disease_content: get_input_value(&["input[name='disease_content']", "#disease_content"]),
-            disease_input: get_input_value(&["textarea[name='disease_input']", "#disease_input"]),
-            is_hot: get_input_value(&["input[name='is_hot']", "#is_hot"]),
-            his_mem_id: get_input_value(&["input[name='hisMemId']", "#hismemid"]),
-            address_id,
-            address,
-            addresses,
+        if is_waitlist_success(&body) {
+            return Ok(SubmitOrderResult {
+                success: true,
+                status: true,
+                message: WAITLIST_SUCCESS_MARKERS[0].into(),
+                url: Some(url),
+                captcha: None,
+                ..Default::default()
+            });
+        }
+
+        let msg = self.extract_submit_message(&body);
+        let msg = if msg.is_empty() { "waitlist submit failed".to_string() } else { format!("waitlist failed: {}", msg) };
+        self.set_last_error(&msg).await;
+        Ok(SubmitOrderResult {
+            success: false,
+            status: false,
+            message: msg,
+            url: None,
+            captcha: None,
+            ..Default::default()
         })
     }
 
     /// Submit an order with optional proxy
-    pub async fn submit_order(&self, params: &HashMap<String, String>, proxy_url: Option<String>) -> AppResult<SubmitOrderResult> {
+    /// When sign is set, the form carries an HMAC-SHA256 `_sig` keyed by the first access_hash
+    /// The form is sent as given: empty address fields are never re-filled from the ticket page
+    /// Each submit carries a nonce; a nonce that already succeeded returns the recorded result without re-sending,
+    /// and one still in flight or lost after it may have arrived fails with SubmitOutcomeUnknown instead of being sent again.
+    /// This is client-side only: the server is not known to honour the nonce, so it does not guarantee idempotency.
+    pub async fn submit_order(
+        &self,
+        params: &HashMap<String, String>,
+        proxy_url: Option<String>,
+        sign: bool,
+    ) -> AppResult<SubmitOrderResult> {
+        let mut span = self.tracer.start(SPAN_SUBMIT_ORDER);
+        span.set_attribute(KeyValue::new(ATTR_SCHEDULE_ID, params.get("schedule_id").cloned().unwrap_or_default()));
+
+        let nonce = params
+            .get(SUBMIT_NONCE_FIELD)
+            .filter(|n| !n.trim().is_empty())
+            .cloned()
+            .unwrap_or_else(new_submit_nonce);
+        match self.recorded_submit(&nonce).await {
+            Some(SubmitOutcome::Answered(cached)) if cached.success || cached.status => {
+                span.set_attribute(KeyValue::new(ATTR_SUCCESS, true));
+                return Ok(cached);
+            }
+            Some(SubmitOutcome::InFlight | SubmitOutcome::Unknown) => {
+                let err = AppError::SubmitOutcomeUnknown { nonce };
+                span.set_status(Status::error(err.to_string()));
+                return Err(err);
+            }
+            _ => {}
+        }
+
+        self.record_submit(&nonce, SubmitOutcome::InFlight).await;
+        let result = self.send_submit_order(params, proxy_url, sign, &nonce).await;
+        let outcome = match &result {
+            Ok(r) => SubmitOutcome::Answered(r.clone()),
+            Err(e) if submit_may_have_landed(e) => SubmitOutcome::Unknown,
+            Err(_) => SubmitOutcome::NotSent,
+        };
+        self.record_submit(&nonce, outcome).await;
+        match &result {
+            Ok(r) => span.set_attribute(KeyValue::new(ATTR_SUCCESS, r.success || r.status)),
+            Err(e) => {
+                span.set_attribute(KeyValue::new(ATTR_SUCCESS, false));
+                span.set_status(Status::error(e.to_string()));
+            }
+        }
+        result
+    }
+
+    /// Build, sign and send the ysubmit form
+    /// Cookies come from the jar only; no per-submit member/detl/accept cookies are derived from User_datas
+    async fn send_submit_order(
+        &self,
+        params: &HashMap<String, String>,
+        proxy_url: Option<String>,
+        sign: bool,
+        nonce: &str,
+    ) -> AppResult<SubmitOrderResult> {
         let mut data: HashMap<String, String> = HashMap::new();
         
         // Map parameters
@@ -648,6 +1572,13 @@ impl HealthClient {
         data.insert("detlid_realtime".into(), params.get("detlid_realtime").cloned().unwrap_or_default());
         data.insert("level_code".into(), params.get("level_code").cloned().unwrap_or_default());
         data.insert("is_hot".into(), params.get("is_hot").cloned().unwrap_or_default());
+        // Extra fields such as captcha solutions are passed through verbatim
+        for (key, value) in params {
+            if let Some(name) = key.strip_prefix(SUBMIT_EXTRA_FIELD_PREFIX) {
+                data.insert(name.to_string(), value.clone());
+            }
+        }
+        data.insert(SUBMIT_NONCE_FIELD.into(), nonce.to_string());
 
         let unit_id = data.get("unit_id").cloned().unwrap_or_default();
         let dep_id = data.get("dep_id").cloned().unwrap_or_default();
@@ -670,40 +1601,75 @@ impl HealthClient {
             headers.insert(REFERER, v);
         }
 
+        let via_proxy = proxy_url.is_some();
         let client = if let Some(url) = proxy_url {
             let proxy = reqwest::Proxy::all(&url).map_err(|e| AppError::ProxyError(e.to_string()))?;
             reqwest::Client::builder()
-                .user_agent(DEFAULT_USER_AGENT)
+                .user_agent(self.client_profile().user_agent.as_str())
                 .cookie_provider(self.cookie_jar.clone())
                 .proxy(proxy)
                 .timeout(Duration::from_secs(30))
                 .build()?
         } else {
-            self.client.clone()
+            self.http()
+        };
+
+        let signing_key = if sign {
+            self.user_keys_in_order().await.into_iter().next()
+        } else {
+            None
         };
+        // Without an access_hash the form goes unsigned; the grabber reports that before submitting
+        if let Some(key) = &signing_key {
+            let sig = sign_submit_form(&data, key);
+            data.insert(SUBMIT_SIG_FIELD.into(), sig);
+        }
 
-        let resp = client
-            .post("https://www.91160.com/guahao/ysubmit.html")
-            .headers(headers)
-            .form(&data)
-            .send()
-            .await?;
+        let url = "https://www.91160.com/guahao/ysubmit.html";
+        let headers = self.with_extra_headers(url, headers).await;
+        let _submit_window = SubmitWindow::enter(&self.cookie_persist);
+        let resp = with_retry(&self.retry_policy(REQUEST_SUBMIT), || {
+            self.send(client.post(url).headers(headers.clone()).form(&data))
+        })
+        .await
+        .map_err(|e| AppError::network(&e, via_proxy))?;
 
         let status = resp.status();
         let url = resp.url().to_string();
 
-        // Check for redirect to success
-        if url.to_lowercase().contains("success") {
-            return Ok(SubmitOrderResult {
-                success: true,
-                status: true,
-                message: "OK".into(),
-                url: Some(url),
-            });
+        match classify_submit_redirect(&url) {
+            SubmitRedirect::Other => {}
+            // The cashier page states the payment deadline
+            landing => {
+                let body = if landing == SubmitRedirect::Payment { resp.text().await.unwrap_or_default() } else { String::new() };
+                if let Some(result) = submit_landing_result(landing, url, &body) {
+                    return Ok(result);
+                }
+            }
         }
 
         let body = resp.text().await?;
 
+        // Some hospitals answer 200 with a meta refresh or script redirect instead of a Location header
+        if let Some(target) = parse_client_redirect(&body, &url) {
+            if let Some(result) = self.follow_client_redirect(&client, &target).await {
+                return Ok(result);
+            }
+        }
+
+        if let Some(challenge) = detect_captcha(&body) {
+            let msg = format!("submit requires {} captcha", challenge.kind);
+            self.set_last_error(&msg).await;
+            return Ok(SubmitOrderResult {
+                success: false,
+                status: false,
+                message: msg,
+                url: None,
+                captcha: Some(challenge),
+                ..Default::default()
+            });
+        }
+
         // Extract error message from response
         let msg = self.extract_submit_message(&body);
         if !msg.is_empty() {
@@ -713,6 +1679,8 @@ impl HealthClient {
                 status: false,
                 message: format!("submit failed: {}", msg),
                 url: None,
+                captcha: None,
+                ..Default::default()
             });
         }
 
@@ -725,11 +1693,46 @@ impl HealthClient {
             status: false,
             message: msg,
             url: None,
+            captcha: None,
+            ..Default::default()
         })
     }
 
+    /// Classify a client-side redirect target, fetching it once when its URL alone is not conclusive
+    async fn follow_client_redirect(&self, client: &Client, target: &str) -> Option<SubmitOrderResult> {
+        let landing = classify_submit_redirect(target);
+        if landing == SubmitRedirect::Success {
+            return submit_landing_result(landing, target.to_string(), "");
+        }
+
+        let headers = self.with_extra_headers(target, Self::default_headers()).await;
+        let resp = match self.send(client.get(target).headers(headers)).await {
+            Ok(resp) => resp,
+            Err(e) => {
+                println!(">>> following submit redirect {} failed: {}", target, e);
+                // A cashier URL is conclusive even if the page could not be loaded
+                return submit_landing_result(landing, target.to_string(), "");
+            }
+        };
+        let url = resp.url().to_string();
+        let body = resp.text().await.unwrap_or_default();
+        let landing = match classify_submit_redirect(&url) {
+            SubmitRedirect::Other => landing,
+            followed => followed,
+        };
+        submit_landing_result(landing, url, &body)
+    }
+
     /// Extract error message from submit response
     fn extract_submit_message(&self, body: &str) -> String {
+        // JSON responses carry the message in the same fields as other API errors
+        if let Ok(payload) = serde_json::from_str::<serde_json::Value>(body) {
+            let (_, msg) = parse_api_error(&payload, &self.config.error_message_fields);
+            if !msg.is_empty() {
+                return msg;
+            }
+        }
+
         // Try to find common error patterns
         let patterns = [
             r#"<div class="error"[^>]*>([^<]+)</div>"#,
@@ -757,12 +1760,9 @@ impl HealthClient {
 
     /// Get server datetime
     pub async fn get_server_datetime(&self) -> AppResult<chrono::DateTime<chrono::Local>> {
-        let resp = self
-            .client
-            .get("https://www.91160.com/favicon.ico")
-            .headers(Self::default_headers())
-            .send()
-            .await?;
+        let url = "https://www.91160.com/favicon.ico";
+        let headers = self.with_extra_headers(url, Self::default_headers()).await;
+        let resp = self.send(self.http().get(url).headers(headers)).await?;
 
         if let Some(date_header) = resp.headers().get("date") {
             if let Ok(date_str) = date_header.to_str() {
@@ -776,8 +1776,2108 @@ impl HealthClient {
     }
 }
 
-impl Default for HealthClient {
-    fn default() -> Self {
-        Self::new().expect("Failed to create HealthClient")
+/// Send a request, retrying transport errors and retryable status codes per policy
+async fn with_retry<F, Fut>(policy: &RetryPolicy, send: F) -> reqwest::Result<reqwest::Response>
+where
+    F: Fn() -> Fut,
+    Fut: Future<Output = reqwest::Result<reqwest::Response>>,
+{
+    let mut attempt = 0;
+    loop {
+        let result = send().await;
+        let retryable = match &result {
+            Ok(resp) => policy.retryable_status_codes.contains(&resp.status().as_u16()),
+            Err(e) => e.is_timeout() || e.is_connect(),
+        };
+        if !retryable || attempt >= policy.max_retries {
+            return result;
+        }
+        let delay = policy.backoff().delay(attempt, &mut rand::thread_rng());
+        attempt += 1;
+        if !delay.is_zero() {
+            tokio::time::sleep(delay).await;
+        }
+    }
+}
+
+/// Put the preferred key first if it is still among the keys; the rest keep jar order
+fn order_user_keys(mut keys: Vec<String>, preferred: Option<&str>) -> Vec<String> {
+    if let Some(pos) = preferred.and_then(|p| keys.iter().position(|k| k == p)) {
+        let key = keys.remove(pos);
+        keys.insert(0, key);
+    }
+    keys
+}
+
+/// Keep the first and last 4 characters of a secret
+fn mask_secret(value: &str) -> String {
+    let chars: Vec<char> = value.chars().collect();
+    if chars.len() <= 8 {
+        return "***".into();
+    }
+    let head: String = chars[..4].iter().collect();
+    let tail: String = chars[chars.len() - 4..].iter().collect();
+    format!("{}***{}", head, tail)
+}
+
+/// Replace records with the same name, domain and path by their rotated values
+async fn merge_cookie_records(cookies: &RwLock<Vec<CookieRecord>>, rotated: Vec<CookieRecord>) {
+    let mut current = cookies.write().await;
+    let mut merged = current.clone();
+    merged.extend(touch_cookie_records(rotated, &current));
+    *current = normalize_cookie_records(merged);
+}
+
+/// Await a request unless cancel fires first; dropping the request future aborts its connection,
+/// so a stopped run does not wait for a slow answer
+/// Submits are not sent through this: an order POST in flight is always awaited (see the grabber)
+async fn with_cancel<T>(cancel: &CancellationToken, request: impl Future<Output = AppResult<T>>) -> AppResult<T> {
+    if cancel.is_cancelled() {
+        return Err(AppError::Cancelled);
+    }
+    tokio::select! {
+        _ = cancel.cancelled() => Err(AppError::Cancelled),
+        result = request => result,
+    }
+}
+
+/// Extract (code, message) from an API error payload
+/// The message is the first non-empty field in message_fields; codes may be strings or numbers
+fn parse_api_error(payload: &serde_json::Value, message_fields: &[String]) -> (String, String) {
+    let code = ERROR_CODE_FIELDS
+        .iter()
+        .filter_map(|field| match payload.get(*field) {
+            Some(serde_json::Value::String(s)) if !s.is_empty() => Some(s.clone()),
+            Some(serde_json::Value::Number(n)) => Some(n.to_string()),
+            _ => None,
+        })
+        .next()
+        .unwrap_or_default();
+
+    let message = message_fields
+        .iter()
+        .filter_map(|field| payload.get(field.as_str()).and_then(|v| v.as_str()))
+        .map(str::trim)
+        .find(|msg| !msg.is_empty())
+        .unwrap_or_default()
+        .to_string();
+
+    (code, message)
+}
+
+/// Decode the getunitbycity answer
+/// An invalid city or an odd session gets an object like {"error":"..."} or an HTML error page
+/// instead of the hospital array; those become BadCity / UnexpectedResponse rather than a serde error
+fn parse_hospitals_response(text: &str, city_id: &str, message_fields: &[String]) -> AppResult<Vec<Hospital>> {
+    let unexpected = || AppError::UnexpectedResponse {
+        what: "getunitbycity".into(),
+        snippet: response_snippet(text),
+    };
+    let body = text.trim_start_matches('\u{feff}').trim();
+    if body.starts_with('[') {
+        return serde_json::from_str(body).map_err(|_| unexpected());
+    }
+    if body.starts_with('{') {
+        let payload: serde_json::Value = serde_json::from_str(body).map_err(|_| unexpected())?;
+        let message = match payload.get("error") {
+            Some(serde_json::Value::String(msg)) if !msg.trim().is_empty() => msg.trim().to_string(),
+            _ => parse_api_error(&payload, message_fields).1,
+        };
+        if message.is_empty() {
+            return Err(unexpected());
+        }
+        return Err(AppError::BadCity { city_id: city_id.to_string(), message });
+    }
+    Err(unexpected())
+}
+
+/// Decode the getdepbyunit answer into categories of departments, each stamped with unit_id
+/// Usually [{pubcat, yuyue_num, childs: [departments]}]; a flat department list or an object
+/// {"childs": [...]} also shows up, and its departments become one unnamed category
+fn parse_departments_response(text: &str, unit_id: &str) -> AppResult<Vec<DepartmentCategory>> {
+    let unexpected = || AppError::UnexpectedResponse {
+        what: "getdepbyunit".into(),
+        snippet: response_snippet(text),
+    };
+    let body = text.trim_start_matches('\u{feff}').trim();
+    let payload: serde_json::Value = serde_json::from_str(body).map_err(|_| unexpected())?;
+    let items = match payload {
+        serde_json::Value::Array(items) => items,
+        serde_json::Value::Object(mut object) => match object.remove("childs") {
+            Some(serde_json::Value::Array(items)) => items,
+            _ => return Err(unexpected()),
+        },
+        _ => return Err(unexpected()),
+    };
+
+    let is_category = |item: &serde_json::Value| item.get("pubcat").is_some() || (item.get("dep_id").is_none() && item.get("childs").is_some());
+    let mut categories: Vec<DepartmentCategory> = if items.iter().all(is_category) {
+        serde_json::from_value(serde_json::Value::Array(items)).map_err(|_| unexpected())?
+    } else {
+        let childs = serde_json::from_value(serde_json::Value::Array(items)).map_err(|_| unexpected())?;
+        vec![DepartmentCategory { pubcat: String::new(), yuyue_num: 0, childs }]
+    };
+
+    fn stamp(departments: &mut [Department], unit_id: &str) {
+        for department in departments {
+            department.unit_id = unit_id.to_string();
+            stamp(&mut department.childs, unit_id);
+        }
+    }
+    for category in &mut categories {
+        stamp(&mut category.childs, unit_id);
+    }
+    Ok(categories)
+}
+
+/// AppError::HttpStatus for a non-success answer, with the start of its body
+pub async fn status_error(resp: reqwest::Response) -> AppError {
+    let status = resp.status().as_u16();
+    let url = redact_secrets(resp.url().as_str());
+    let body = resp.text().await.unwrap_or_default();
+    AppError::HttpStatus { status, url, snippet: response_snippet(&body) }
+}
+
+/// First characters of a response body with tags dropped and whitespace collapsed, for error messages
+fn response_snippet(body: &str) -> String {
+    static TAG_RE: OnceLock<regex::Regex> = OnceLock::new();
+    let re = TAG_RE.get_or_init(|| regex::Regex::new(r"(?s)<(script|style)\b.*?</(script|style)>|<[^>]*>").unwrap());
+    let text = re.replace_all(body, " ");
+    let collapsed = text.split_whitespace().collect::<Vec<_>>().join(" ");
+    let mut chars = collapsed.chars();
+    let snippet: String = chars.by_ref().take(RESPONSE_SNIPPET_CHARS).collect();
+    if chars.next().is_some() {
+        format!("{}...", snippet)
+    } else {
+        snippet
+    }
+}
+
+/// Whether a failed submit may still have reached the hospital and booked
+/// Only failures before the connection was up (DNS, connect, TLS, the proxy) say for sure it did not
+fn submit_may_have_landed(err: &AppError) -> bool {
+    match err {
+        AppError::ProxyError(_) => false,
+        _ => !matches!(
+            err.net_kind(),
+            Some(NetErrorKind::Dns | NetErrorKind::Connect | NetErrorKind::ConnectTimeout | NetErrorKind::Tls | NetErrorKind::ProxyUnreachable)
+        ),
+    }
+}
+
+/// Build the canonical form string: fields sorted by name, `_sig` excluded, values url-encoded
+fn canonical_form_string(data: &HashMap<String, String>) -> String {
+    let mut keys: Vec<&String> = data.keys().filter(|k| k.as_str() != SUBMIT_SIG_FIELD).collect();
+    keys.sort();
+    keys.iter()
+        .map(|k| format!("{}={}", k, urlencoding::encode(&data[k.as_str()])))
+        .collect::<Vec<_>>()
+        .join("&")
+}
+
+/// Compute the hex-encoded `_sig` for a submit form
+fn sign_submit_form(data: &HashMap<String, String>, key: &str) -> String {
+    let mut mac = Hmac::<Sha256>::new_from_slice(key.as_bytes()).expect("HMAC accepts keys of any length");
+    mac.update(canonical_form_string(data).as_bytes());
+    mac.finalize().into_bytes().iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+/// Check a re-fetched ystep1 page still offers the given time slot
+/// A "已约满" marker or a missing slot means the ticket is gone
+fn ticket_still_available(body: &str, member_id: &str, detlid: &str) -> bool {
+    if body.contains(FULLY_BOOKED_MARKER) {
+        return false;
+    }
+    let detail = parse_ticket_detail(body, member_id);
+    let times = if detail.times.is_empty() { &detail.time_slots } else { &detail.times };
+    times.iter().any(|slot| slot.value == detlid)
+}
+
+/// Name of a booking flow that replaced ystep1 for the page, if any
+/// Departments moved to the internet hospital redirect to a pre-consultation page without the booking form
+fn detect_unsupported_flow(url: &str, body: &str) -> Option<&'static str> {
+    if body.contains("sch_data") || body.contains("detlid_realtime") {
+        return None;
+    }
+    let url = url.to_lowercase();
+    let internet_url = INTERNET_HOSPITAL_URL_MARKERS.iter().any(|m| url.contains(m));
+    let internet_page = body.contains("预问诊") || (body.contains("互联网医院") && body.contains("问诊"));
+    (internet_url || internet_page).then_some(FLOW_INTERNET_HOSPITAL)
+}
+
+/// Parse the member page, recording why rows were skipped
+fn parse_members_page(body: &str, url: &str) -> MembersResult {
+    let document = Html::parse_document(body);
+    let mut result = MembersResult {
+        page_title: Selector::parse("title")
+            .ok()
+            .and_then(|sel| document.select(&sel).next())
+            .map(|el| el.text().collect::<String>().trim().to_string())
+            .unwrap_or_default(),
+        ..Default::default()
+    };
+
+    // Redirected to login
+    if url.to_lowercase().contains("login") || body.contains("登录") {
+        result.login_redirect = true;
+        return result;
+    }
+
+    let list_selector = Selector::parse("tbody#mem_list").unwrap();
+    let row_selector = Selector::parse("tr").unwrap();
+    let td_selector = Selector::parse("td").unwrap();
+
+    let Some(list) = document.select(&list_selector).next() else {
+        return result;
+    };
+    result.list_found = true;
+
+    for row in list.select(&row_selector) {
+        result.rows_seen += 1;
+        let index = result.rows_seen;
+        let row_text = row.text().collect::<Vec<_>>().join(" ").split_whitespace().collect::<Vec<_>>().join(" ");
+        let fallback = member_row_fallback(&row);
+
+        let mut id = row
+            .value()
+            .attr("id")
+            .unwrap_or("")
+            .trim_start_matches("mem")
+            .to_string();
+
+        let tds: Vec<_> = row.select(&td_selector).collect();
+        let mut name = tds
+            .first()
+            .map(|td| normalize_member_name(&td.text().collect::<String>()))
+            .unwrap_or_default();
+        if name.is_empty() {
+            name = fallback.name;
+        }
+        if id.is_empty() {
+            id = fallback.id;
+        }
+
+        if tds.is_empty() && name.is_empty() {
+            result.skip(index, MEMBER_SKIP_NO_CELLS, &row_text);
+            continue;
+        }
+        if id.is_empty() && name.is_empty() {
+            result.skip(index, MEMBER_SKIP_NO_ID_OR_NAME, &row_text);
+            continue;
+        }
+        if id.is_empty() {
+            result.skip(index, MEMBER_SKIP_NO_ID, &name);
+            continue;
+        }
+
+        let certified = tds.iter().any(|td| td.text().collect::<String>().contains("认证"));
+        result.members.push(Member { id, name, certified });
+    }
+    result
+}
+
+/// Member id and name taken from a row's title attribute or its edit link
+#[derive(Default)]
+struct MemberRowFallback {
+    id: String,
+    name: String,
+}
+
+/// Recover a member from markup that doesn't follow the usual cell layout
+fn member_row_fallback(row: &scraper::ElementRef) -> MemberRowFallback {
+    static MEMBER_ID_RE: OnceLock<regex::Regex> = OnceLock::new();
+    let id_re = MEMBER_ID_RE.get_or_init(|| regex::Regex::new(r"(?:mid|mem_id|member_id|id)[=/-](\d+)").unwrap());
+    let link_selector = Selector::parse("a[href]").unwrap();
+
+    let mut fallback = MemberRowFallback {
+        name: normalize_member_name(row.value().attr("title").unwrap_or("")),
+        ..Default::default()
+    };
+
+    let edit_link = row.select(&link_selector).find(|a| {
+        let href = a.value().attr("href").unwrap_or("").to_lowercase();
+        href.contains("edit") || href.contains("member")
+    });
+    if let Some(link) = edit_link {
+        let href = link.value().attr("href").unwrap_or("");
+        if let Some(caps) = id_re.captures(href) {
+            fallback.id = caps[1].to_string();
+        }
+        if fallback.name.is_empty() {
+            fallback.name = ["title", "data-name"]
+                .iter()
+                .filter_map(|attr| link.value().attr(attr))
+                .map(|v| normalize_member_name(v.trim().trim_start_matches("编辑")))
+                .find(|v| !v.is_empty())
+                .unwrap_or_default();
+        }
+    }
+    fallback
+}
+
+/// Find the waitlist form on a ystep1 page, returning its absolute action URL and fields
+fn parse_waitlist_form(body: &str) -> Option<(String, HashMap<String, String>)> {
+    let document = Html::parse_document(body);
+    let form_sel = Selector::parse("form").ok()?;
+    let input_sel = Selector::parse("input[name]").ok()?;
+
+    let form = document.select(&form_sel).find(|form| {
+        let action = form.value().attr("action").unwrap_or("").to_lowercase();
+        let id = form.value().attr("id").unwrap_or("").to_lowercase();
+        WAITLIST_MARKERS.iter().any(|m| action.contains(m) || id.contains(m))
+            || form.text().collect::<String>().contains("候补")
+    })?;
+
+    let action = form.value().attr("action").unwrap_or("").trim();
+    if action.is_empty() {
+        return None;
+    }
+    let action = Url::parse("https://www.91160.com/").ok()?.join(action).ok()?.to_string();
+
+    let fields = form
+        .select(&input_sel)
+        .filter_map(|input| {
+            let name = input.value().attr("name")?;
+            Some((name.to_string(), input.value().attr("value").unwrap_or("").to_string()))
+        })
+        .collect();
+    Some((action, fields))
+}
+
+/// Check whether a schedule slot advertises a waitlist, e.g. "houbu": 1
+fn slot_offers_waitlist(slot: &serde_json::Value) -> bool {
+    ["houbu", "is_houbu", "waitlist", "is_waitlist"].iter().any(|key| match slot.get(*key) {
+        Some(serde_json::Value::Bool(b)) => *b,
+        Some(serde_json::Value::Number(n)) => n.as_i64().unwrap_or(0) > 0,
+        Some(serde_json::Value::String(s)) => s == "1" || s == "true",
+        _ => false,
+    })
+}
+
+/// Check whether a schedule slot or doctor entry is restricted to real-name verified (实名认证) accounts
+/// The gate API marks them with a flag, or only with a note such as "仅限实名认证用户预约"
+fn requires_verification(value: &serde_json::Value) -> bool {
+    let flagged = ["need_realname", "is_realname", "realname", "need_auth", "is_auth", "shiming"].iter().any(|key| match value.get(*key) {
+        Some(serde_json::Value::Bool(b)) => *b,
+        Some(serde_json::Value::Number(n)) => n.as_i64().unwrap_or(0) > 0,
+        Some(serde_json::Value::String(s)) => s == "1" || s == "true",
+        _ => false,
+    });
+    flagged
+        || ["limit_desc", "remark", "tips"]
+            .iter()
+            .filter_map(|key| value.get(*key).and_then(|v| v.as_str()))
+            .any(|note| note.contains("实名"))
+}
+
+/// Check a waitlist response for success, either JSON flags or the success text
+fn is_waitlist_success(body: &str) -> bool {
+    if let Ok(payload) = serde_json::from_str::<serde_json::Value>(body) {
+        let code = payload.get("result_code").map(|v| v.to_string().trim_matches('"').to_string());
+        if code.as_deref() == Some("1") || payload.get("success").and_then(|v| v.as_bool()) == Some(true) {
+            return true;
+        }
+    }
+    WAITLIST_SUCCESS_MARKERS.iter().any(|m| body.contains(m))
+}
+
+/// Where the submit response landed after redirects
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum SubmitRedirect {
+    Success,
+    /// Cashier page: booked, but unpaid
+    Payment,
+    Other,
+}
+
+/// Classify the final submit URL; cashier pages win over a "success" return parameter
+fn classify_submit_redirect(url: &str) -> SubmitRedirect {
+    let url = url.to_lowercase();
+    if CASHIER_URL_MARKERS.iter().any(|m| url.contains(m)) {
+        SubmitRedirect::Payment
+    } else if url.contains("success") {
+        SubmitRedirect::Success
+    } else {
+        SubmitRedirect::Other
+    }
+}
+
+/// Order number from a success or cashier page URL (order_id / order_no / orderid query parameter)
+pub fn parse_order_no(url: &str) -> Option<String> {
+    let url = Url::parse(url).ok()?;
+    url.query_pairs()
+        .find(|(key, value)| matches!(key.to_lowercase().as_str(), "order_id" | "order_no" | "orderid") && !value.trim().is_empty())
+        .map(|(_, value)| value.trim().to_string())
+}
+
+/// Submit result for a success or cashier landing page; None for any other page
+fn submit_landing_result(landing: SubmitRedirect, url: String, body: &str) -> Option<SubmitOrderResult> {
+    match landing {
+        SubmitRedirect::Success => Some(SubmitOrderResult {
+            success: true,
+            status: true,
+            message: "OK".into(),
+            url: Some(url),
+            captcha: None,
+            ..Default::default()
+        }),
+        // The order exists but is cancelled unless paid in time
+        SubmitRedirect::Payment => Some(SubmitOrderResult {
+            success: true,
+            status: true,
+            message: "payment required".into(),
+            url: Some(url.clone()),
+            payment_required: true,
+            payment_url: Some(url),
+            payment_deadline: parse_payment_deadline(body, chrono::Local::now().naive_local()),
+            ..Default::default()
+        }),
+        SubmitRedirect::Other => None,
+    }
+}
+
+/// Target of a meta refresh or window.location redirect in a page, resolved against its URL
+fn parse_client_redirect(body: &str, base: &str) -> Option<String> {
+    static META_REFRESH_RE: OnceLock<regex::Regex> = OnceLock::new();
+    static SCRIPT_REDIRECT_RE: OnceLock<regex::Regex> = OnceLock::new();
+    // <meta http-equiv="refresh" content="0; url=/guahao/success.html">
+    let meta = META_REFRESH_RE.get_or_init(|| {
+        regex::Regex::new(r#"(?is)<meta[^>]+http-equiv\s*=\s*["']?refresh["']?[^>]*content\s*=\s*["']\s*\d*\s*;?\s*url\s*=\s*['"]?([^"'>\s]+)"#).unwrap()
+    });
+    // window.location.href = '...', location.replace("..."), top.location = '...'
+    let script = SCRIPT_REDIRECT_RE.get_or_init(|| {
+        regex::Regex::new(r#"(?:window\.|top\.|self\.|document\.)?location(?:\.href)?\s*(?:=|\.replace\(|\.assign\()\s*["']([^"']+)["']"#).unwrap()
+    });
+
+    let target = meta
+        .captures(body)
+        .or_else(|| script.captures(body))
+        .map(|caps| caps[1].trim().replace("&amp;", "&"))?;
+    let resolved = Url::parse(base).ok()?.join(&target).ok()?;
+    matches!(resolved.scheme(), "http" | "https").then(|| resolved.to_string())
+}
+
+/// Parse the payment deadline from a cashier page, either a stated time or "N分钟内" relative to now
+fn parse_payment_deadline(body: &str, now: chrono::NaiveDateTime) -> Option<String> {
+    static ABSOLUTE_RE: OnceLock<regex::Regex> = OnceLock::new();
+    static RELATIVE_RE: OnceLock<regex::Regex> = OnceLock::new();
+    // "支付截止时间：2026-10-16 08:15" or "请于2026-10-16 08:15前完成支付"
+    let absolute = ABSOLUTE_RE.get_or_init(|| {
+        let time = r"(\d{4}-\d{1,2}-\d{1,2}\s+\d{1,2}:\d{2}(?::\d{2})?)";
+        regex::Regex::new(&format!(r"(?:支付|付款)[^0-9<]{{0,20}}{time}|{time}\s*(?:之前|前)[^0-9<]{{0,10}}(?:支付|付款)")).unwrap()
+    });
+    let relative = RELATIVE_RE.get_or_init(|| regex::Regex::new(r"(\d+)\s*分钟内[^0-9<]{0,10}(?:支付|付款)").unwrap());
+
+    if let Some(caps) = absolute.captures(body) {
+        let text = caps.get(1).or_else(|| caps.get(2)).map_or("", |m| m.as_str());
+        let text = text.split_whitespace().collect::<Vec<_>>().join(" ");
+        for format in ["%Y-%m-%d %H:%M:%S", "%Y-%m-%d %H:%M"] {
+            if let Ok(deadline) = chrono::NaiveDateTime::parse_from_str(&text, format) {
+                return Some(deadline.format("%Y-%m-%d %H:%M:%S").to_string());
+            }
+        }
+    }
+    let minutes: i64 = relative.captures(body)?[1].parse().ok()?;
+    Some((now + chrono::Duration::minutes(minutes)).format("%Y-%m-%d %H:%M:%S").to_string())
+}
+
+/// Parse the ystep1 appointment page into a ticket detail
+pub(crate) fn parse_ticket_detail(body: &str, member_id: &str) -> TicketDetail {
+    let document = Html::parse_document(body);
+
+    let time_slots = parse_time_slots(&document);
+    let (address_id, address, addresses) = parse_address(&document, member_id);
+
+    let mut detail = parse_hidden_fields(&document);
+    detail.times = time_slots.clone();
+    detail.time_slots = time_slots;
+    detail.his_mem_id = parse_mid(&document, member_id);
+    detail.his_mem_required = parse_his_mem_required(&document, member_id);
+    detail.address_id = address_id;
+    detail.address = address;
+    detail.addresses = addresses;
+    detail.disease_requirement = parse_disease_requirement(&document);
+    detail.consents = parse_consents(&document);
+    detail
+}
+
+/// Parse the consent checkboxes of the submit form (ysubmit), leaving out accept which is always posted
+fn parse_consents(document: &Html) -> Vec<ConsentField> {
+    let (Ok(form_sel), Ok(box_sel), Ok(label_sel)) = (
+        Selector::parse("form#submitForm, form[action*='ysubmit']"),
+        Selector::parse("input[type='checkbox'][name]"),
+        Selector::parse("label[for]"),
+    ) else {
+        return Vec::new();
+    };
+    let Some(form) = document.select(&form_sel).next() else {
+        return Vec::new();
+    };
+
+    let mut consents: Vec<ConsentField> = Vec::new();
+    for input in form.select(&box_sel) {
+        let attr = |name: &str| input.value().attr(name).map(str::trim);
+        let name = attr("name").unwrap_or("").to_string();
+        if name.is_empty() || name == "accept" || consents.iter().any(|c| c.name == name) {
+            continue;
+        }
+
+        // <label for=id> anywhere on the page, else the label wrapping the checkbox
+        let label = attr("id")
+            .filter(|id| !id.is_empty())
+            .and_then(|id| document.select(&label_sel).find(|l| l.value().attr("for").map(str::trim) == Some(id)))
+            .or_else(|| input.ancestors().filter_map(scraper::ElementRef::wrap).find(|el| el.value().name() == "label"))
+            .map(|el| collapse_whitespace(&el.text().collect::<String>()))
+            .unwrap_or_default();
+
+        consents.push(ConsentField {
+            name,
+            value: attr("value").filter(|v| !v.is_empty()).unwrap_or("on").to_string(),
+            label,
+            checked: attr("checked").is_some(),
+            required: attr("required").is_some()
+                || matches!(attr("data-required"), Some("1" | "true"))
+                || matches!(attr("aria-required"), Some("true")),
+        });
+    }
+    consents
+}
+
+/// Parse the 病情描述 requirement from the disease_input field and its hint text
+/// Some departments mark the field required or ask for a minimum length, e.g. 请至少输入10个字
+fn parse_disease_requirement(document: &Html) -> DiseaseRequirement {
+    static MIN_LENGTH_RE: OnceLock<regex::Regex> = OnceLock::new();
+    let min_length_re = MIN_LENGTH_RE.get_or_init(|| regex::Regex::new(r"(?:至少|不少于|不得少于|最少)\s*(\d+)\s*个?字").unwrap());
+
+    let mut requirement = DiseaseRequirement::default();
+    let Ok(field_sel) = Selector::parse("textarea[name='disease_input'], #disease_input") else {
+        return requirement;
+    };
+    let Some(field) = document.select(&field_sel).next() else {
+        return requirement;
+    };
+
+    let attr = |name: &str| field.value().attr(name).map(str::trim);
+    requirement.required = attr("required").is_some()
+        || matches!(attr("data-required"), Some("1" | "true"))
+        || matches!(attr("aria-required"), Some("true"));
+    requirement.min_length = ["minlength", "data-minlength", "data-min"]
+        .iter()
+        .find_map(|name| attr(name).and_then(|v| v.parse().ok()))
+        .unwrap_or(0);
+
+    // Dedicated tip elements first; they are more specific than the placeholder
+    let mut hints = Vec::new();
+    if let Ok(tip_sel) = Selector::parse("#disease_tip, .disease_tip, .disease-tip") {
+        hints.extend(document.select(&tip_sel).map(|el| collapse_whitespace(&el.text().collect::<String>())));
+    }
+    hints.push(attr("placeholder").unwrap_or("").to_string());
+    for hint in hints.into_iter().filter(|h| !h.is_empty()) {
+        if requirement.min_length == 0 {
+            if let Some(n) = min_length_re.captures(&hint).and_then(|c| c[1].parse().ok()) {
+                requirement.min_length = n;
+            }
+        }
+        if hint.contains("必填") {
+            requirement.required = true;
+        }
+        if requirement.hint.is_empty() {
+            requirement.hint = hint;
+        }
+    }
+    if requirement.min_length > 0 {
+        requirement.required = true;
+    }
+    requirement
+}
+
+/// Parse time slots, supporting both list and card layouts
+fn parse_time_slots(document: &Html) -> Vec<TimeSlot> {
+    for selector in ["#delts li", "#delts [val]"] {
+        let Ok(sel) = Selector::parse(selector) else {
+            continue;
+        };
+        let slots: Vec<TimeSlot> = document
+            .select(&sel)
+            .filter_map(|el| {
+                let name = el.text().collect::<String>().trim().to_string();
+                let value = el.value().attr("val").unwrap_or("").trim().to_string();
+                if value.is_empty() {
+                    None
+                } else {
+                    Some(TimeSlot { name, value })
+                }
+            })
+            .collect();
+        if !slots.is_empty() {
+            return slots;
+        }
+    }
+    Vec::new()
+}
+
+/// Parse the address options and the selected address
+/// Falls back to the address attributes on the member element, then to the first option
+fn parse_address(document: &Html, member_id: &str) -> (String, String, Vec<AddressOption>) {
+    let mut addresses = Vec::new();
+    let address_selectors = ["select[name='addressId']", "#addressId", "#useraddress_area"];
+    for selector in address_selectors {
+        if let Ok(sel) = Selector::parse(selector) {
+            if let Some(select_el) = document.select(&sel).next() {
+                if let Ok(option_sel) = Selector::parse("option") {
+                    for option in select_el.select(&option_sel) {
+                        let id = option.value().attr("value").unwrap_or("").trim().to_string();
+                        let text = option.text().collect::<String>().trim().to_string();
+                        if !id.is_empty() && id != "0" && id != "-1" && !text.is_empty() {
+                            addresses.push(AddressOption { id, text });
+                        }
+                    }
+                }
+                break;
+            }
+        }
+    }
+
+    let mut address_id = input_value(document, &["input[name='addressId']", "#addressId"]);
+    let mut address = input_value(document, &["input[name='address']", "#address"]);
+
+    if address_id.is_empty() || address.is_empty() {
+        if let Some(member) = member_element(document, member_id) {
+            if address_id.is_empty() {
+                address_id = member.value().attr("addressid").unwrap_or("").trim().to_string();
+            }
+            if address.is_empty() {
+                address = member.value().attr("address").unwrap_or("").trim().to_string();
+            }
+        }
+    }
+
+    // Fallback to first address
+    if (address_id.is_empty() || address.is_empty()) && !addresses.is_empty() {
+        if address_id.is_empty() {
+            address_id = addresses[0].id.clone();
+        }
+        if address.is_empty() {
+            address = addresses[0].text.clone();
+        }
+    }
+
+    (address_id, address, addresses)
+}
+
+/// Parse the hospital member ID, falling back to the member element's attributes
+fn parse_mid(document: &Html, member_id: &str) -> String {
+    let his_mem_id = input_value(document, &["input[name='hisMemId']", "#hismemid"]);
+    if !his_mem_id.is_empty() {
+        return his_mem_id;
+    }
+
+    member_element(document, member_id)
+        .and_then(|el| el.value().attr("hismemid").or_else(|| el.value().attr("his_mem_id")))
+        .map(|v| v.trim().to_string())
+        .unwrap_or_default()
+}
+
+/// Whether the hospital requires a HIS member id: a hisMemId field without a value, and the member
+/// flagged with need_check
+fn parse_his_mem_required(document: &Html, member_id: &str) -> bool {
+    let Ok(sel) = Selector::parse("input[name='hisMemId'], #hismemid") else {
+        return false;
+    };
+    let field_empty = document
+        .select(&sel)
+        .next()
+        .map_or(false, |el| el.value().attr("value").map_or(true, |v| v.trim().is_empty()));
+    let need_check = member_element(document, member_id)
+        .and_then(|el| el.value().attr("need_check"))
+        .map_or(false, |v| !matches!(v.trim(), "0" | "false"));
+    field_empty && need_check
+}
+
+/// Parse the hidden form fields required for submission
+fn parse_hidden_fields(document: &Html) -> TicketDetail {
+    TicketDetail {
+        sch_data: input_value(document, &["input[name='sch_data']"]),
+        detlid_realtime: input_value(document, &["#detlid_realtime"]),
+        level_code: input_value(document, &["#level_code"]),
+        sch_date: input_value(document, &["input[name='sch_date']", "#sch_date"]),
+        order_no: input_value(document, &["input[name='order_no']", "#order_no"]),
+        disease_content: input_value(document, &["input[name='disease_content']", "#disease_content"]),
+        disease_input: input_value(document, &["textarea[name='disease_input']", "#disease_input"]),
+        is_hot: input_value(document, &["input[name='is_hot']", "#is_hot"]),
+        ..Default::default()
+    }
+}
+
+/// Get the value attribute of the first matching element
+fn input_value(document: &Html, selectors: &[&str]) -> String {
+    for selector in selectors {
+        if let Ok(sel) = Selector::parse(selector) {
+            if let Some(el) = document.select(&sel).next() {
+                if let Some(val) = el.value().attr("value") {
+                    return val.trim().to_string();
+                }
+            }
+        }
+    }
+    String::new()
+}
+
+/// Find the member element carrying a mid attribute for the given member
+fn member_element<'a>(document: &'a Html, member_id: &str) -> Option<scraper::ElementRef<'a>> {
+    let member_id = member_id.trim();
+    if member_id.is_empty() || !member_id.chars().all(|c| c.is_ascii_alphanumeric()) {
+        return None;
+    }
+    let sel = Selector::parse(&format!("[mid='{}']", member_id)).ok()?;
+    document.select(&sel).next()
+}
+
+/// Parse announcement articles or cards from a news page
+fn parse_announcements(body: &str, page_url: &str) -> Vec<Announcement> {
+    let document = Html::parse_document(body);
+    let base = Url::parse(page_url).ok();
+
+    let first_text = |el: &scraper::ElementRef, selector: &str| -> String {
+        Selector::parse(selector)
+            .ok()
+            .and_then(|sel| el.select(&sel).next())
+            .map(|found| collapse_whitespace(&found.text().collect::<String>()))
+            .unwrap_or_default()
+    };
+
+    let mut announcements = Vec::new();
+    for selector in ["article", ".notice-item", ".news-item", ".announcement"] {
+        let Ok(sel) = Selector::parse(selector) else {
+            continue;
+        };
+        for el in document.select(&sel) {
+            let mut title = first_text(&el, "h1, h2, h3, h4, .title");
+            if title.is_empty() {
+                title = first_text(&el, "a");
+            }
+            if title.is_empty() {
+                continue;
+            }
+
+            let mut date = first_text(&el, "time, .date, .time");
+            if date.is_empty() {
+                if let Ok(time_sel) = Selector::parse("time") {
+                    date = el
+                        .select(&time_sel)
+                        .next()
+                        .and_then(|t| t.value().attr("datetime"))
+                        .unwrap_or("")
+                        .trim()
+                        .to_string();
+                }
+            }
+
+            let url = Selector::parse("a[href]")
+                .ok()
+                .and_then(|sel| el.select(&sel).next())
+                .and_then(|a| a.value().attr("href"))
+                .map(|href| match &base {
+                    Some(base) => base.join(href.trim()).map(|u| u.to_string()).unwrap_or_else(|_| href.trim().to_string()),
+                    None => href.trim().to_string(),
+                })
+                .unwrap_or_default();
+
+            let mut body = first_text(&el, ".content, .summary, .desc");
+            if body.is_empty() {
+                if let Ok(p_sel) = Selector::parse("p") {
+                    body = el
+                        .select(&p_sel)
+                        .map(|p| collapse_whitespace(&p.text().collect::<String>()))
+                        .filter(|t| !t.is_empty())
+                        .collect::<Vec<_>>()
+                        .join("\n");
+                }
+            }
+
+            announcements.push(Announcement { title, date, url, body });
+        }
+        if !announcements.is_empty() {
+            break;
+        }
+    }
+
+    announcements
+}
+
+/// Doctors on the department page; cards carry the id as data-doctor-id or in a docid-N link
+fn parse_department_doctors(body: &str) -> Vec<DepartmentDoctor> {
+    static DOCID_RE: OnceLock<regex::Regex> = OnceLock::new();
+    let docid_re = DOCID_RE.get_or_init(|| regex::Regex::new(r"docid[-_=](\d+)").unwrap());
+    let document = Html::parse_document(body);
+
+    let first_text = |el: &scraper::ElementRef, selector: &str| -> String {
+        Selector::parse(selector)
+            .ok()
+            .and_then(|sel| el.select(&sel).next())
+            .map(|found| collapse_whitespace(&found.text().collect::<String>()))
+            .unwrap_or_default()
+    };
+
+    let mut doctors: Vec<DepartmentDoctor> = Vec::new();
+    for selector in DEP_DOCTOR_CARD_SELECTORS {
+        let Ok(sel) = Selector::parse(selector) else {
+            continue;
+        };
+        for el in document.select(&sel) {
+            let link = Selector::parse("a[href*=\"docid\"]")
+                .ok()
+                .and_then(|sel| el.select(&sel).next());
+            let doctor_id = ["data-doctor-id", "data-docid"]
+                .iter()
+                .find_map(|attr| el.value().attr(attr))
+                .map(|id| id.trim().to_string())
+                .or_else(|| {
+                    let href = link?.value().attr("href")?;
+                    Some(docid_re.captures(href)?[1].to_string())
+                })
+                .unwrap_or_default();
+            if doctor_id.is_empty() || doctors.iter().any(|d| d.doctor_id == doctor_id) {
+                continue;
+            }
+
+            let mut doctor_name = first_text(&el, ".doctor-name, .doc-name, .name");
+            if doctor_name.is_empty() {
+                doctor_name = link.map(|a| collapse_whitespace(&a.text().collect::<String>())).unwrap_or_default();
+            }
+            let specialty = first_text(&el, ".expert, .goodat, .skill, .specialty");
+            let specialty = ["擅长：", "擅长:", "擅长"]
+                .iter()
+                .find_map(|prefix| specialty.strip_prefix(prefix))
+                .unwrap_or(specialty.as_str())
+                .trim()
+                .to_string();
+            doctors.push(DepartmentDoctor {
+                doctor_id,
+                doctor_name,
+                title: first_text(&el, ".doctor-title, .zc, .title"),
+                specialty,
+            });
+        }
+        if !doctors.is_empty() {
+            break;
+        }
+    }
+    doctors
+}
+
+/// Markers the member page renders next to a name
+const MEMBER_NAME_MARKERS: [&str; 5] = ["默认", "已认证", "未认证", "已实名", "本人"];
+/// Invisible characters that survive copy and paste from the member page
+const ZERO_WIDTH_CHARS: [char; 5] = ['\u{200B}', '\u{200C}', '\u{200D}', '\u{2060}', '\u{FEFF}'];
+
+/// Collapse runs of whitespace into single spaces
+fn collapse_whitespace(value: &str) -> String {
+    value.split_whitespace().collect::<Vec<_>>().join(" ")
+}
+
+/// Normalize the doctors and slots of a sch/dep payload
+/// Doctors without any slot are dropped; doctor_id limits the result to one doctor
+fn parse_schedule_docs(data: &serde_json::Value, only_doctor: Option<&str>) -> Vec<DoctorSchedule> {
+    let (Some(doc_list), Some(sch_map)) = (
+        data.get("doc").and_then(|d| d.as_array()),
+        data.get("sch").and_then(|s| s.as_object()),
+    ) else {
+        return Vec::new();
+    };
+
+    doc_list
+        .iter()
+        .filter(|doc_value| only_doctor.map_or(true, |only| only == schedule_doctor_id(doc_value)))
+        .filter_map(|doc_value| parse_schedule_doc(doc_value, sch_map))
+        .collect()
+}
+
+/// Like parse_schedule_docs, but stops after the first doctor with a slot for which ready(doctor_id, slot) holds
+fn parse_schedule_docs_until(data: &serde_json::Value, ready: &dyn Fn(&str, &ScheduleSlot) -> bool) -> Vec<DoctorSchedule> {
+    let (Some(doc_list), Some(sch_map)) = (
+        data.get("doc").and_then(|d| d.as_array()),
+        data.get("sch").and_then(|s| s.as_object()),
+    ) else {
+        return Vec::new();
+    };
+
+    let mut valid_docs = Vec::new();
+    for doc_value in doc_list {
+        let Some(doc) = parse_schedule_doc(doc_value, sch_map) else {
+            continue;
+        };
+        let done = doc.schedules.iter().any(|slot| ready(&doc.doctor_id, slot));
+        valid_docs.push(doc);
+        if done {
+            break;
+        }
+    }
+    valid_docs
+}
+
+/// Normalize one doctor and its sch entry; None without an id or any slot
+fn parse_schedule_doc(
+    doc_value: &serde_json::Value,
+    sch_map: &serde_json::Map<String, serde_json::Value>,
+) -> Option<DoctorSchedule> {
+    let doctor_id = schedule_doctor_id(doc_value);
+    if doctor_id.is_empty() {
+        return None;
+    }
+
+    let sch_data = sch_map.get(&doctor_id)?;
+    let doctor_verification = requires_verification(doc_value);
+
+    let mut schedules = Vec::new();
+
+    if let Some(sch_data) = sch_data.as_object() {
+        for time_type in ["am", "pm"] {
+            if let Some(type_data) = sch_data.get(time_type) {
+                let slots: Vec<&serde_json::Value> = if type_data.is_object() {
+                    type_data.as_object().unwrap().values().collect()
+                } else if type_data.is_array() {
+                    type_data.as_array().unwrap().iter().collect()
+                } else {
+                    continue;
+                };
+
+                for slot in slots {
+                    let fields = GateSlot::from_value(slot);
+                    if !fields.schedule_id.is_empty() {
+                        schedules.push(ScheduleSlot {
+                            schedule_id: fields.schedule_id,
+                            time_type: fields.time_type,
+                            time_type_desc: fields.time_type_desc,
+                            left_num: fields.left_num,
+                            sch_date: fields.sch_date,
+                            waitlist: slot_offers_waitlist(slot),
+                            verification_required: doctor_verification || requires_verification(slot),
+                        });
+                    }
+                }
+            }
+        }
+    }
+
+    if schedules.is_empty() {
+        return None;
+    }
+
+    let total_left: i32 = schedules.iter().map(|s| s.left_num).sum();
+    let doctor = GateDoctor::from_value(doc_value);
+
+    Some(DoctorSchedule {
+        doctor_id,
+        doctor_name: doctor.doctor_name,
+        title: DOCTOR_TITLE_FIELDS
+            .iter()
+            .filter_map(|field| doc_value.get(*field).and_then(|v| v.as_str()))
+            .map(str::trim)
+            .find(|t| !t.is_empty())
+            .unwrap_or_default()
+            .to_string(),
+        reg_fee: doctor.reg_fee,
+        photo_url: DOCTOR_PHOTO_FIELDS
+            .iter()
+            .filter_map(|field| doc_value.get(*field).and_then(|v| v.as_str()))
+            .map(str::trim)
+            .find(|url| url.starts_with("http") || url.starts_with("//"))
+            .map(|url| if url.starts_with("//") { format!("https:{}", url) } else { url.to_string() })
+            .unwrap_or_default(),
+        total_left_num: total_left,
+        his_doc_id: doctor.his_doc_id,
+        his_dep_id: doctor.his_dep_id,
+        schedule_id: schedules.first().map(|s| s.schedule_id.clone()).unwrap_or_default(),
+        time_type_desc: schedules.first().map(|s| s.time_type_desc.clone()).unwrap_or_default(),
+        verification_required: doctor_verification,
+        schedules,
+    })
+}
+
+/// Generate a random UUID v4 string for the submit nonce
+pub fn new_submit_nonce() -> String {
+    let mut bytes: [u8; 16] = rand::random();
+    bytes[6] = (bytes[6] & 0x0f) | 0x40;
+    bytes[8] = (bytes[8] & 0x3f) | 0x80;
+    let hex: String = bytes.iter().map(|b| format!("{:02x}", b)).collect();
+    format!("{}-{}-{}-{}-{}", &hex[0..8], &hex[8..12], &hex[12..16], &hex[16..20], &hex[20..32])
+}
+
+/// Normalize a name for matching: lowercase, no whitespace, full-width parentheses folded
+fn normalize_keyword(value: &str) -> String {
+    value
+        .chars()
+        .filter(|c| !c.is_whitespace())
+        .map(|c| match c {
+            '（' => '(',
+            '）' => ')',
+            _ => c,
+        })
+        .flat_map(|c| c.to_lowercase())
+        .collect()
+}
+
+/// Member name as shown to the user: NFC, zero-width characters dropped, whitespace (full-width included)
+/// collapsed, and page markers such as 默认 or 已认证 stripped from either end
+pub fn normalize_member_name(value: &str) -> String {
+    let cleaned: String = value.nfc().filter(|c| !ZERO_WIDTH_CHARS.contains(c)).collect();
+    let mut name = collapse_whitespace(&cleaned);
+    loop {
+        let stripped = MEMBER_NAME_MARKERS.iter().find_map(|marker| {
+            [format!("({})", marker), format!("（{}）", marker), format!("[{}]", marker), format!("【{}】", marker), marker.to_string()]
+                .iter()
+                .find_map(|m| name.strip_suffix(m.as_str()).or_else(|| name.strip_prefix(m.as_str())).map(|rest| rest.trim().to_string()))
+        });
+        match stripped {
+            Some(rest) if rest != name => name = rest,
+            _ => return name,
+        }
+    }
+}
+
+/// Key two member names are compared by; also ignores case and inner spaces
+fn member_name_key(value: &str) -> String {
+    normalize_keyword(&normalize_member_name(value))
+}
+
+/// Hospitals whose name contains the keyword, or is contained in it
+fn filter_by_keyword<'a>(hospitals: &'a [Hospital], keyword: &str) -> Vec<&'a Hospital> {
+    let keyword = normalize_keyword(keyword);
+    if keyword.is_empty() {
+        return hospitals.iter().collect();
+    }
+    hospitals
+        .iter()
+        .filter(|h| {
+            let name = normalize_keyword(&h.unit_name);
+            !name.is_empty() && (name.contains(&keyword) || keyword.contains(&name))
+        })
+        .collect()
+}
+
+/// Pick the unit_id for a hospital name: exact name match first, then the first contains match
+fn best_unit_match(hospitals: &[Hospital], hospital_name: &str) -> Option<String> {
+    let name = normalize_keyword(hospital_name);
+    let matches = filter_by_keyword(hospitals, hospital_name);
+    matches
+        .iter()
+        .find(|h| normalize_keyword(&h.unit_name) == name)
+        .or_else(|| matches.first())
+        .map(|h| h.unit_id.clone())
+}
+
+/// Pick a member by name, or the only certified member when name is empty
+/// Errors list the available members so the user can pick one
+fn select_member(members: &[Member], member_name: &str) -> AppResult<Member> {
+    let name = member_name_key(member_name);
+    let candidates: Vec<&Member> = if name.is_empty() {
+        members.iter().filter(|m| m.certified).collect()
+    } else {
+        members.iter().filter(|m| member_name_key(&m.name) == name).collect()
+    };
+    // Two members may share a name; only one of them can be certified
+    let certified: Vec<&Member> = candidates.iter().copied().filter(|m| m.certified).collect();
+    match (candidates.as_slice(), certified.as_slice()) {
+        ([only], _) | (_, [only]) => Ok((*only).clone()),
+        ([], _) if name.is_empty() => Err(AppError::ConfigError(format!(
+            "no certified member on this account; available: {}",
+            describe_members(members)
+        ))),
+        ([], _) => Err(AppError::ConfigError(format!(
+            "no member named \"{}\"; available: {}",
+            member_name.trim(),
+            describe_members(members)
+        ))),
+        _ => Err(AppError::ConfigError(format!(
+            "several members match, set member_id; available: {}",
+            describe_members(members)
+        ))),
+    }
+}
+
+/// "张三(1001, certified), 李四(1002)" for error messages
+fn describe_members(members: &[Member]) -> String {
+    if members.is_empty() {
+        return "none".into();
+    }
+    members
+        .iter()
+        .map(|m| {
+            if m.certified {
+                format!("{}({}, certified)", m.name, m.id)
+            } else {
+                format!("{}({})", m.name, m.id)
+            }
+        })
+        .collect::<Vec<_>>()
+        .join(", ")
+}
+
+/// Build the schedule cache key
+fn schedule_cache_key(unit_id: &str, dep_id: &str, date: &str) -> String {
+    format!("{}|{}|{}", unit_id, dep_id, date)
+}
+
+impl Default for HealthClient {
+    fn default() -> Self {
+        Self::new().expect("Failed to create HealthClient")
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::path::PathBuf;
+
+    const TEST_MEMBER_ID: &str = "1001";
+
+    /// Soak: 10k monitor cycles through every budgeted buffer stay within the caps
+    #[tokio::test]
+    async fn test_buffers_bounded_over_long_session() {
+        let budget = MemoryBudget {
+            schedule_cache_entries: 16,
+            hospital_cache_cities: 4,
+            department_cache_units: 4,
+            submit_audit_entries: 8,
+            log_ring_records: 32,
+            log_ring_bytes: 4096,
+        };
+        let client = HealthClient::new().unwrap().with_memory_budget(budget.clone());
+        let mut recorder = crate::core::logfile::FlightRecorder::new(budget.log_ring_records, budget.log_ring_bytes);
+        let evicted_before = crate::core::memory::evictions(Buffer::ScheduleCache);
+
+        for cycle in 0..10_000u32 {
+            let date = format!("2026-{:02}-{:02}", cycle % 12 + 1, cycle % 28 + 1);
+            client.store_schedule_cache("1040", &format!("dep{}", cycle % 97), &date, &[]).await;
+            client.store_hospital_cache(&format!("{}", cycle % 50), &[]).await;
+            client.store_department_cache(&format!("{}", cycle % 70), &[]).await;
+            client.record_submit(&format!("nonce-{}", cycle), SubmitOutcome::Answered(SubmitOrderResult::default())).await;
+            recorder.record(&crate::core::messages::LogMessage::new("debug.detail").param("cycle", cycle).param("body", "x".repeat(cycle as usize % 300)));
+        }
+
+        for stats in client.buffer_stats().await {
+            assert!(stats.entries <= stats.capacity, "{} grew to {}", stats.name, stats.entries);
+        }
+        let (records, bytes) = recorder.size();
+        assert!(records <= budget.log_ring_records && bytes <= budget.log_ring_bytes);
+        assert!(crate::core::memory::evictions(Buffer::ScheduleCache) > evicted_before);
+    }
+
+    #[tokio::test]
+    async fn test_gate_probe_once_per_unit() {
+        let client = HealthClient::new().unwrap();
+        let mut probes = Vec::new();
+        for _ in 0..5 {
+            probes.push(client.note_empty_schedule("1040").await);
+        }
+        // Only the streak reaching the threshold triggers a probe, and only once
+        assert_eq!(probes, vec![false, false, true, false, false]);
+        assert!(!client.note_empty_schedule("1041").await);
+    }
+
+    #[tokio::test]
+    async fn test_user_key_sticks_to_last_good() {
+        let client = HealthClient::new().unwrap();
+        let record = |value: &str, domain: &str| CookieRecord {
+            name: "access_hash".into(),
+            value: value.into(),
+            domain: domain.into(),
+            path: "/".into(),
+            ..Default::default()
+        };
+        *client.cookies.write().await = vec![record("dead-key-000000", ".91160.com"), record("good-key-111111", "www.91160.com")];
+
+        // Simulate the schedule loop: only the second key is accepted
+        let mut query = || async {
+            let mut tried = Vec::new();
+            for key in client.user_keys_in_order().await {
+                tried.push(key.clone());
+                if key.starts_with("good") {
+                    client.promote_user_key(&key).await;
+                    break;
+                }
+            }
+            tried
+        };
+
+        assert_eq!(query().await, vec!["dead-key-000000", "good-key-111111"]);
+        assert_eq!(query().await, vec!["good-key-111111"]);
+        assert_eq!(client.active_user_key().await, "good***1111");
+    }
+
+    #[test]
+    fn test_detect_unsupported_flow() {
+        let ystep1 = "https://www.91160.com/guahao/ystep1/uid-1/depid-2/schid-3.html";
+        let booking = r#"<html><nav>互联网医院 在线问诊</nav><form><input name="sch_data" value="x"></form></html>"#;
+        assert_eq!(detect_unsupported_flow(ystep1, booking), None);
+
+        let precheck = "<html><title>互联网医院</title><div>请先完成预问诊</div></html>";
+        assert_eq!(detect_unsupported_flow(ystep1, precheck), Some(FLOW_INTERNET_HOSPITAL));
+        assert_eq!(
+            detect_unsupported_flow("https://www.91160.com/hlwyy/guide.html?dep=2", "<html></html>"),
+            Some(FLOW_INTERNET_HOSPITAL)
+        );
+        assert_eq!(detect_unsupported_flow(ystep1, "<html>系统繁忙</html>"), None);
+    }
+
+    #[test]
+    fn test_order_user_keys() {
+        let keys = vec!["a".to_string(), "b".to_string(), "c".to_string()];
+        assert_eq!(order_user_keys(keys.clone(), Some("c")), vec!["c", "a", "b"]);
+        assert_eq!(order_user_keys(keys.clone(), Some("gone")), keys);
+        assert_eq!(order_user_keys(keys.clone(), None), keys);
+        assert_eq!(mask_secret("short"), "***");
+    }
+
+    fn testdata_dir() -> PathBuf {
+        PathBuf::from(env!("CARGO_MANIFEST_DIR")).join("testdata").join("ticket_detail")
+    }
+
+    /// Compare the parsed detail with the golden file; set UPDATE_GOLDEN=1 to rewrite it
+    fn assert_golden(name: &str) {
+        let dir = testdata_dir();
+        let html = std::fs::read_to_string(dir.join(format!("{}.html", name))).unwrap();
+        let actual = serde_json::to_value(parse_ticket_detail(&html, TEST_MEMBER_ID)).unwrap();
+
+        let golden_path = dir.join(format!("{}.golden.json", name));
+        if std::env::var("UPDATE_GOLDEN").is_ok() {
+            std::fs::write(&golden_path, serde_json::to_string_pretty(&actual).unwrap() + "\n").unwrap();
+            return;
+        }
+
+        let expected: serde_json::Value =
+            serde_json::from_str(&std::fs::read_to_string(&golden_path).unwrap()).unwrap();
+        assert_eq!(actual, expected, "golden mismatch: {}", name);
+    }
+
+    #[test]
+    fn test_parse_api_error() {
+        let fields = ClientConfig::default().error_message_fields;
+        let cases = [
+            (r#"{"result_code":"0","error_code":"10022","error_msg":"登录已失效"}"#, "10022", "登录已失效"),
+            (r#"{"result_code":"0","error_desc":"参数错误"}"#, "0", "参数错误"),
+            (r#"{"result_code":0,"msg":"系统繁忙"}"#, "0", "系统繁忙"),
+            (r#"{"error_code":500,"message":"internal"}"#, "500", "internal"),
+            (r#"{"result_code":"-1","result_msg":"号源已满"}"#, "-1", "号源已满"),
+            // Empty higher-priority fields are skipped
+            (r#"{"error_code":"","result_code":"2","error_msg":" ","msg":"稍后再试"}"#, "2", "稍后再试"),
+            (r#"{"status":"fail"}"#, "", ""),
+        ];
+
+        for (body, code, message) in cases {
+            let payload: serde_json::Value = serde_json::from_str(body).unwrap();
+            assert_eq!(parse_api_error(&payload, &fields), (code.to_string(), message.to_string()), "payload {}", body);
+        }
+
+        // Custom priority order
+        let payload: serde_json::Value = serde_json::from_str(r#"{"msg":"a","result_msg":"b"}"#).unwrap();
+        assert_eq!(parse_api_error(&payload, &["result_msg".to_string(), "msg".to_string()]).1, "b");
+    }
+
+    #[test]
+    fn test_ticket_still_available() {
+        let body = std::fs::read_to_string(testdata_dir().join("standard.html")).unwrap();
+        let detail = parse_ticket_detail(&body, TEST_MEMBER_ID);
+        let times = if detail.times.is_empty() { &detail.time_slots } else { &detail.times };
+        let detlid = times[0].value.clone();
+
+        assert!(ticket_still_available(&body, TEST_MEMBER_ID, &detlid));
+        assert!(!ticket_still_available(&body, TEST_MEMBER_ID, "no-such-slot"));
+        let booked = body.replacen("<body>", "<body><div class=\"tip\">已约满</div>", 1);
+        assert!(!ticket_still_available(&booked, TEST_MEMBER_ID, &detlid));
+    }
+
+    #[test]
+    fn test_sign_submit_form() {
+        let mut data = HashMap::new();
+        data.insert("unit_id".to_string(), "21".to_string());
+        data.insert("address".to_string(), "深圳 南山".to_string());
+        assert_eq!(canonical_form_string(&data), "address=%E6%B7%B1%E5%9C%B3%20%E5%8D%97%E5%B1%B1&unit_id=21");
+
+        let sig = sign_submit_form(&data, "hash");
+        assert_eq!(sig, "0b9f57b86d2143501833752c206f0542c1d5ffa26dc06fcd994ec38d7f6b8a67");
+        assert_ne!(sign_submit_form(&data, "other"), sig);
+
+        // The signature field itself is not signed
+        data.insert(SUBMIT_SIG_FIELD.to_string(), sig.clone());
+        assert_eq!(sign_submit_form(&data, "hash"), sig);
+        data.insert("unit_id".to_string(), "22".to_string());
+        assert_ne!(sign_submit_form(&data, "hash"), sig);
+    }
+
+    #[test]
+    fn test_parse_announcements() {
+        let html = r#"<html><body>
+            <article>
+                <h3><a href="/news/detail-1.html">明日 08:30 开放下周号源</a></h3>
+                <span class="date">2026-10-14</span>
+                <p>请提前登录。</p>
+                <p>号源有限。</p>
+            </article>
+            <article><p>no title</p></article>
+        </body></html>"#;
+
+        let items = parse_announcements(html, "https://www.91160.com/news/uid-100.html");
+        assert_eq!(items.len(), 1);
+        assert_eq!(items[0].title, "明日 08:30 开放下周号源");
+        assert_eq!(items[0].date, "2026-10-14");
+        assert_eq!(items[0].url, "https://www.91160.com/news/detail-1.html");
+        assert_eq!(items[0].body, "请提前登录。\n号源有限。");
+    }
+
+    #[test]
+    fn test_ticket_detail_standard() {
+        assert_golden("standard");
+    }
+
+    #[test]
+    fn test_ticket_detail_select_address() {
+        assert_golden("select_address");
+    }
+
+    #[test]
+    fn test_ticket_detail_mid_address() {
+        assert_golden("mid_address");
+    }
+
+    #[test]
+    fn test_ticket_detail_missing_level_code() {
+        assert_golden("missing_level_code");
+    }
+
+    #[test]
+    fn test_ticket_detail_card_slots() {
+        assert_golden("card_slots");
+    }
+
+    #[test]
+    fn test_ticket_detail_night_clinic() {
+        assert_golden("night_clinic");
+    }
+
+    #[test]
+    fn test_ticket_detail_disease_required() {
+        assert_golden("disease_required");
+    }
+
+    #[test]
+    fn test_ticket_detail_consents() {
+        assert_golden("consents");
+
+        let html = std::fs::read_to_string(testdata_dir().join("consents.html")).unwrap();
+        let detail = parse_ticket_detail(&html, TEST_MEMBER_ID);
+        let names = |consents: Vec<&ConsentField>| consents.iter().map(|c| c.name.clone()).collect::<Vec<_>>();
+        assert_eq!(names(detail.missing_consents(&[])), ["privacy_agree", "first_visit"]);
+        assert_eq!(names(detail.missing_consents(&[" privacy_agree ".into()])), ["first_visit"]);
+        assert_eq!(names(detail.consents_to_submit(&[])), ["notice_read"]);
+        assert_eq!(
+            names(detail.consents_to_submit(&["privacy_agree".into(), "first_visit".into()])),
+            ["notice_read", "privacy_agree", "first_visit"]
+        );
+
+        // Checkboxes outside the submit form are not ours to tick
+        let outside = html.replace("</form>", "").replace("<div class=\"agreement\">", "</form><div class=\"agreement\">");
+        assert!(parse_ticket_detail(&outside, TEST_MEMBER_ID).consents.is_empty());
+    }
+
+    #[test]
+    fn test_ticket_detail_his_mem() {
+        assert_golden("his_mem_required");
+        assert_golden("his_mem_not_required");
+
+        // A filled-in field satisfies the hospital even with need_check set
+        let html = std::fs::read_to_string(testdata_dir().join("his_mem_required.html")).unwrap();
+        let bound = html.replace(r#"name="hisMemId" value="""#, r#"name="hisMemId" value="H7001""#);
+        let detail = parse_ticket_detail(&bound, TEST_MEMBER_ID);
+        assert!(!detail.his_mem_required);
+        assert_eq!(detail.his_mem_id, "H7001");
+    }
+
+    #[test]
+    fn test_classify_submit_redirect() {
+        assert_eq!(classify_submit_redirect("https://www.91160.com/guahao/success.html?id=1"), SubmitRedirect::Success);
+        assert_eq!(classify_submit_redirect("https://pay.91160.com/order/index.html?order=9"), SubmitRedirect::Payment);
+        assert_eq!(
+            classify_submit_redirect("https://www.91160.com/Cashier/index?return=/guahao/success.html"),
+            SubmitRedirect::Payment
+        );
+        assert_eq!(classify_submit_redirect("https://www.91160.com/guahao/ysubmit.html"), SubmitRedirect::Other);
+    }
+
+    #[test]
+    fn test_parse_payment_deadline() {
+        let now = chrono::NaiveDate::from_ymd_opt(2026, 10, 16).unwrap().and_hms_opt(8, 0, 5).unwrap();
+        assert_eq!(
+            parse_payment_deadline("<p>请于 2026-10-16 08:15 前完成支付</p>", now).as_deref(),
+            Some("2026-10-16 08:15:00")
+        );
+        assert_eq!(
+            parse_payment_deadline("<p>支付截止时间：2026-10-16 08:15:00</p>", now).as_deref(),
+            Some("2026-10-16 08:15:00")
+        );
+        assert_eq!(parse_payment_deadline("<p>请在15分钟内完成支付，超时订单自动取消</p>", now).as_deref(), Some("2026-10-16 08:15:05"));
+        assert_eq!(parse_payment_deadline("<p>订单详情</p>", now), None);
+    }
+
+    #[test]
+    fn test_new_submit_nonce() {
+        let nonce = new_submit_nonce();
+        assert_eq!(nonce.len(), 36);
+        assert_eq!(nonce.as_bytes()[14], b'4');
+        assert!(matches!(nonce.as_bytes()[19], b'8' | b'9' | b'a' | b'b'));
+        assert_ne!(nonce, new_submit_nonce());
+    }
+
+    #[tokio::test]
+    async fn test_submit_audit_returns_cached_success() {
+        let client = HealthClient::new().unwrap();
+        let failed = SubmitOrderResult {
+            success: false,
+            status: false,
+            message: "号源已满".into(),
+            url: None,
+            captcha: None,
+            ..Default::default()
+        };
+        client.record_submit("n1", SubmitOutcome::Answered(failed)).await;
+        assert!(matches!(client.recorded_submit("n1").await, Some(SubmitOutcome::Answered(r)) if !r.success));
+
+        let ok = SubmitOrderResult {
+            success: true,
+            status: true,
+            message: "OK".into(),
+            url: Some("https://www.91160.com/guahao/success.html".into()),
+            captcha: None,
+            ..Default::default()
+        };
+        client.record_submit("n1", SubmitOutcome::Answered(ok.clone())).await;
+        let mut params = HashMap::new();
+        params.insert(SUBMIT_NONCE_FIELD.to_string(), "n1".to_string());
+        assert_eq!(client.submit_order(&params, None, false).await.unwrap().url, ok.url);
+        assert!(client.recorded_submit("n2").await.is_none());
+
+        // A submit still in flight or lost after sending is not sent again
+        for outcome in [SubmitOutcome::InFlight, SubmitOutcome::Unknown] {
+            client.record_submit("n3", outcome).await;
+            params.insert(SUBMIT_NONCE_FIELD.to_string(), "n3".to_string());
+            let err = client.submit_order(&params, None, false).await.unwrap_err();
+            assert!(matches!(&err, AppError::SubmitOutcomeUnknown { nonce } if nonce == "n3"), "{:?}", err);
+        }
+    }
+
+    #[test]
+    fn test_submit_windows_overlap() {
+        let state = Arc::new(CookiePersistState::default());
+        let first = SubmitWindow::enter(&state);
+        let second = SubmitWindow::enter(&state);
+        // One submit finishing must not open persistence while the other is still in flight
+        drop(first);
+        assert_eq!(state.submitting.load(Ordering::SeqCst), 1);
+        drop(second);
+        assert_eq!(state.submitting.load(Ordering::SeqCst), 0);
+    }
+
+    #[test]
+    fn test_submit_may_have_landed() {
+        let network = |kind| AppError::Network { kind, detail: String::new() };
+        assert!(!submit_may_have_landed(&network(NetErrorKind::Connect)));
+        assert!(!submit_may_have_landed(&network(NetErrorKind::ProxyUnreachable)));
+        assert!(!submit_may_have_landed(&AppError::ProxyError("bad url".into())));
+        assert!(submit_may_have_landed(&network(NetErrorKind::ReadTimeout)));
+        assert!(submit_may_have_landed(&AppError::HttpStatus { status: 502, url: String::new(), snippet: String::new() }));
+    }
+
+    #[tokio::test(flavor = "multi_thread", worker_threads = 4)]
+    async fn test_shared_client_concurrent_state() {
+        let client = Arc::new(HealthClient::new().unwrap());
+        let doc = |id: &str| -> DoctorSchedule {
+            serde_json::from_value(serde_json::json!({ "doctor_id": id, "doctor_name": id })).unwrap()
+        };
+
+        // Two grabber workloads hammering the shared state for a few hundred cycles
+        let tasks: Vec<_> = ["a", "b"]
+            .into_iter()
+            .map(|name| {
+                let client = client.clone();
+                let docs = vec![doc(name)];
+                tokio::spawn(async move {
+                    for i in 0..300 {
+                        let date = format!("2026-10-{:02}", 16 + i % 7);
+                        client.store_schedule_cache("1", name, &date, &docs).await;
+                        let cached = client.cached_schedule("1", name, &date, Duration::from_secs(60)).await.unwrap();
+                        assert_eq!(cached[0].doctor_id, name);
+
+                        let key = format!("{}-key-{:06}", name, i);
+                        client.promote_user_key(&key).await;
+                        let _ = client.user_keys_in_order().await;
+
+                        let nonce = format!("{}-{}", name, i);
+                        let result = SubmitOrderResult {
+                            success: true,
+                            status: true,
+                            message: name.into(),
+                            url: None,
+                            captcha: None,
+                            ..Default::default()
+                        };
+                        client.record_submit(&nonce, SubmitOutcome::Answered(result)).await;
+                        assert!(matches!(client.recorded_submit(&nonce).await, Some(SubmitOutcome::Answered(r)) if r.message == name));
+
+                        let extra = ExtraHeaders {
+                            global: [("X-Grabber".to_string(), name.to_string())].into_iter().collect(),
+                            domains: HashMap::new(),
+                        };
+                        client.set_extra_headers(extra).await;
+                        let headers = client.with_extra_headers("https://www.91160.com/", HealthClient::default_headers()).await;
+                        let value = headers["x-grabber"].to_str().unwrap();
+                        assert!(value == "a" || value == "b");
+                        tokio::task::yield_now().await;
+                    }
+                })
+            })
+            .collect();
+        for task in tasks {
+            task.await.unwrap();
+        }
+
+        // Each grabber's cache entries survived the other's writes
+        for name in ["a", "b"] {
+            assert!(client.cached_schedule("1", name, "2026-10-16", Duration::from_secs(60)).await.is_some());
+        }
+    }
+
+    #[test]
+    fn test_parse_members_page() {
+        let page = r#"<html><head><title>就诊人管理</title></head><body><table><tbody id="mem_list">
+            <tr id="mem1001"><td>张三默认</td><td>已认证</td></tr>
+            <tr id="mem1002"><td>李四</td><td>未验证</td></tr>
+            <tr></tr>
+            <tr><td> </td></tr>
+        </tbody></table></body></html>"#;
+        let result = parse_members_page(page, "https://user.91160.com/member.html");
+        assert!(result.list_found);
+        assert_eq!(result.page_title, "就诊人管理");
+        assert_eq!(result.rows_seen, 4);
+        assert_eq!(result.rows_skipped, 2);
+        assert_eq!(result.skip_reasons[MEMBER_SKIP_NO_CELLS], 1);
+        assert_eq!(result.skip_reasons[MEMBER_SKIP_NO_ID_OR_NAME], 1);
+        assert_eq!(result.members.len(), 2);
+        assert_eq!(result.members[0].name, "张三");
+        assert!(result.members[0].certified);
+
+        let missing = parse_members_page("<html><title>会员中心</title><table></table></html>", "https://user.91160.com/member.html");
+        assert!(!missing.list_found && !missing.login_redirect);
+        assert_eq!(missing.page_title, "会员中心");
+
+        let login = parse_members_page("<html><title>登录</title></html>", "https://user.91160.com/login.html");
+        assert!(login.login_redirect);
+    }
+
+    #[test]
+    fn test_parse_members_page_malformed_rows() {
+        let path = PathBuf::from(env!("CARGO_MANIFEST_DIR")).join("testdata").join("members").join("malformed.html");
+        let result = parse_members_page(&std::fs::read_to_string(path).unwrap(), "https://user.91160.com/member.html");
+
+        let members: Vec<(&str, &str, bool)> =
+            result.members.iter().map(|m| (m.id.as_str(), m.name.as_str(), m.certified)).collect();
+        assert_eq!(
+            members,
+            vec![("1001", "张三", true), ("1002", "王秀兰", true), ("1003", "李四", false), ("1004", "赵六", false)]
+        );
+
+        let skipped: Vec<(u32, &str)> = result.skipped_rows.iter().map(|s| (s.index, s.reason.as_str())).collect();
+        assert_eq!(
+            skipped,
+            vec![(5, MEMBER_SKIP_NO_CELLS), (6, MEMBER_SKIP_NO_ID_OR_NAME), (7, MEMBER_SKIP_NO_ID)]
+        );
+        assert_eq!(result.skipped_rows[2].detail, "孙七");
+        assert_eq!(result.rows_skipped, 3);
+    }
+
+    #[test]
+    fn test_request_retry_policy_override() {
+        let mut ticket = RetryPolicy::new(5, 100);
+        ticket.retryable_status_codes = vec![429, 503];
+        let client = HealthClient::new()
+            .unwrap()
+            .with_request_retry_policies([(REQUEST_TICKET.to_string(), ticket)].into_iter().collect());
+
+        // The override replaces the default for its kind only
+        let policy = client.retry_policy(REQUEST_TICKET);
+        assert_eq!((policy.max_retries, policy.backoff_ms), (5, 100));
+        assert_eq!(policy.retryable_status_codes, vec![429, 503]);
+        let schedule = client.retry_policy(REQUEST_SCHEDULE);
+        assert_eq!((schedule.max_retries, schedule.backoff_ms), (2, 500));
+        assert_eq!(schedule.retryable_status_codes, DEFAULT_RETRYABLE_STATUS_CODES.to_vec());
+        assert_eq!(client.retry_policy(REQUEST_SUBMIT).max_retries, 0);
+    }
+
+    #[tokio::test]
+    async fn test_status_error_keeps_response_details() {
+        use reqwest::ResponseBuilderExt;
+        let url = reqwest::Url::parse("https://www.91160.com/ajax/getcitylist.html?user_key=abc123").unwrap();
+        let resp = http::Response::builder()
+            .url(url)
+            .status(503)
+            .body("<html><body><h1>系统繁忙</h1></body></html>".to_string())
+            .unwrap();
+        match status_error(reqwest::Response::from(resp)).await {
+            AppError::HttpStatus { status, url, snippet } => {
+                assert_eq!(status, 503);
+                assert_eq!(url, "https://www.91160.com/ajax/getcitylist.html?user_key=***");
+                assert_eq!(snippet, "系统繁忙");
+            }
+            other => panic!("expected HttpStatus, got {:?}", other),
+        }
+    }
+
+    /// Cookies set before a profile rotation are sent by the rotated client
+    #[tokio::test]
+    async fn test_cookie_jar_survives_profile_rotation() {
+        use tokio::io::{AsyncReadExt, AsyncWriteExt};
+
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let base = format!("http://{}/", listener.local_addr().unwrap());
+        tokio::spawn(async move {
+            while let Ok((mut socket, _)) = listener.accept().await {
+                let mut buf = vec![0u8; 4096];
+                let n = socket.read(&mut buf).await.unwrap_or(0);
+                let request = String::from_utf8_lossy(&buf[..n]).to_lowercase();
+                let response = format!("HTTP/1.1 200 OK\r\ncontent-length: {}\r\nconnection: close\r\n\r\n{}", request.len(), request);
+                let _ = socket.write_all(response.as_bytes()).await;
+            }
+        });
+
+        let client = HealthClient::new()
+            .unwrap()
+            .with_client_profiles(vec![ClientProfile::chrome_120(), ClientProfile::edge_122()])
+            .unwrap();
+        client.cookie_jar.add_cookie_str("access_hash=abc123; Path=/", &Url::parse(&base).unwrap());
+        async fn echo(client: &HealthClient, url: &str) -> String {
+            let headers = client.with_extra_headers(url, HealthClient::default_headers()).await;
+            client.http().get(url).headers(headers).send().await.unwrap().text().await.unwrap()
+        }
+
+        let before = echo(&client, &base).await;
+        assert!(before.contains("access_hash=abc123"));
+        assert!(before.contains("chrome/120"));
+
+        assert_eq!(client.rotate_client_profile().unwrap().as_deref(), Some("edge_122"));
+        let after = echo(&client, &base).await;
+        assert!(after.contains("access_hash=abc123"));
+        assert!(after.contains("edg/122"));
+
+        // Round robin back to the first profile; a single profile has nothing to rotate to
+        assert_eq!(client.rotate_client_profile().unwrap().as_deref(), Some("chrome_120"));
+        let single = HealthClient::new().unwrap().with_client_profiles(vec![ClientProfile::chrome_120()]).unwrap();
+        assert_eq!(single.rotate_client_profile().unwrap(), None);
+
+        // The default client rotates through every built-in profile
+        let default = HealthClient::new().unwrap();
+        assert_eq!(default.client_profile().name, "chrome_120");
+        assert_eq!(default.rotate_client_profile().unwrap().as_deref(), Some("edge_122"));
+        assert_eq!(default.rotate_client_profile().unwrap().as_deref(), Some("firefox_123"));
+    }
+
+    #[tokio::test]
+    async fn test_department_doctors() {
+        let path = PathBuf::from(env!("CARGO_MANIFEST_DIR")).join("testdata").join("doctors").join("dep_page.html");
+        let doctors = parse_department_doctors(&std::fs::read_to_string(path).unwrap());
+        let summary: Vec<(&str, &str, &str, &str)> = doctors
+            .iter()
+            .map(|d| (d.doctor_id.as_str(), d.doctor_name.as_str(), d.title.as_str(), d.specialty.as_str()))
+            .collect();
+        assert_eq!(
+            summary,
+            [("200101", "张建国", "主任医师", "冠心病、高血压的诊治"), ("200102", "李 雪梅", "副主任医师", "心律失常")]
+        );
+        assert!(parse_department_doctors("<html><body>系统繁忙</body></html>").is_empty());
+
+        // Without a session the page is not requested
+        let client = HealthClient::new().unwrap();
+        assert!(matches!(client.get_doctors_by_dep("1", "2").await, Err(AppError::LoginRequired(_))));
+    }
+
+    #[test]
+    fn test_parse_departments_response_shapes() {
+        let dir = PathBuf::from(env!("CARGO_MANIFEST_DIR")).join("testdata").join("departments");
+        let read = |name: &str| std::fs::read_to_string(dir.join(name)).unwrap();
+        let ids = |categories: &[DepartmentCategory]| {
+            categories
+                .iter()
+                .map(|c| (c.pubcat.clone(), c.childs.iter().map(|d| d.dep_id.clone()).collect::<Vec<_>>()))
+                .collect::<Vec<_>>()
+        };
+
+        let nested = parse_departments_response(&read("nested.json"), "200001").unwrap();
+        assert_eq!(
+            ids(&nested),
+            vec![("内科".to_string(), vec!["300001".to_string(), "300002".to_string()]), ("外科".to_string(), vec!["300101".to_string()])]
+        );
+        assert!(nested.iter().flat_map(|c| &c.childs).all(|d| d.unit_id == "200001"));
+        assert_eq!(nested[0].childs[0].childs[0].dep_id, "300011");
+        assert_eq!(nested[0].childs[0].childs[0].unit_id, "200001");
+
+        let flat = parse_departments_response(&read("flat.json"), "200001").unwrap();
+        assert_eq!(ids(&flat), vec![(String::new(), vec!["300001".to_string(), "300101".to_string()])]);
+
+        let wrapped = parse_departments_response(&read("childs_object.json"), "200001").unwrap();
+        assert_eq!(ids(&wrapped), vec![("儿科".to_string(), vec!["300201".to_string()])]);
+
+        assert!(matches!(parse_departments_response("<html>系统繁忙</html>", "1"), Err(AppError::UnexpectedResponse { .. })));
+        assert!(matches!(parse_departments_response(r#"{"msg":"x"}"#, "1"), Err(AppError::UnexpectedResponse { .. })));
+    }
+
+    #[test]
+    fn test_parse_hospitals_response_failure_shapes() {
+        let dir = PathBuf::from(env!("CARGO_MANIFEST_DIR")).join("testdata").join("hospitals");
+        let fields = ClientConfig::default().error_message_fields;
+
+        let hospitals = parse_hospitals_response(r#"[{"unit_id":200001,"unit_name":"市人民医院"}]"#, "5", &fields).unwrap();
+        assert_eq!(hospitals[0].unit_id, "200001");
+        assert_eq!(hospitals[0].level, None);
+
+        let typed = std::fs::read_to_string(dir.join("by_city.json")).unwrap();
+        let hospitals = parse_hospitals_response(&typed, "5", &fields).unwrap();
+        assert_eq!(hospitals.len(), 2);
+        assert_eq!((hospitals[0].unit_id.as_str(), hospitals[0].unit_name.as_str()), ("131", "深圳市人民医院"));
+        assert_eq!(hospitals[0].level.as_deref(), Some("三级甲等"));
+        assert_eq!(hospitals[0].address.as_deref(), Some("深圳市罗湖区东门北路1017号"));
+        assert_eq!(hospitals[0].district.as_deref(), Some("罗湖区"));
+        assert_eq!(hospitals[0].extra["unit_logo"], "https://img.91160.com/unit/131.png");
+        assert_eq!((hospitals[1].unit_id.as_str(), hospitals[1].level.as_deref()), ("200001", Some("2")));
+        assert_eq!(hospitals[1].address, None);
+        // Unknown fields go back out untouched, under their own names
+        let echoed = serde_json::to_value(&hospitals[0]).unwrap();
+        assert_eq!(echoed["unit_logo"], "https://img.91160.com/unit/131.png");
+        assert_eq!(echoed["level"], "三级甲等");
+
+        let object = std::fs::read_to_string(dir.join("error_object.json")).unwrap();
+        match parse_hospitals_response(&object, "999", &fields) {
+            Err(AppError::BadCity { city_id, message }) => {
+                assert_eq!(city_id, "999");
+                assert_eq!(message, "城市参数错误");
+            }
+            other => panic!("expected BadCity, got {:?}", other),
+        }
+        let by_msg = parse_hospitals_response(r#"{"result_code":"0","msg":"参数错误"}"#, "999", &fields);
+        assert!(matches!(by_msg, Err(AppError::BadCity { message, .. }) if message == "参数错误"));
+
+        let page = std::fs::read_to_string(dir.join("error_page.html")).unwrap();
+        match parse_hospitals_response(&page, "5", &fields) {
+            Err(AppError::UnexpectedResponse { snippet, .. }) => {
+                assert_eq!(snippet, "出错了 - 健康160 系统繁忙 请求异常，请稍后再试");
+            }
+            other => panic!("expected UnexpectedResponse, got {:?}", other),
+        }
+        assert!(matches!(parse_hospitals_response("{}", "5", &fields), Err(AppError::UnexpectedResponse { .. })));
+        assert!(matches!(parse_hospitals_response("[{\"x\":1}]", "5", &fields), Err(AppError::UnexpectedResponse { .. })));
+        assert!(response_snippet(&"长".repeat(200)).ends_with("..."));
+    }
+
+    #[test]
+    fn test_parse_client_redirect_success_variants() {
+        let dir = PathBuf::from(env!("CARGO_MANIFEST_DIR")).join("testdata").join("submit");
+        let base = "https://www.91160.com/guahao/ysubmit.html";
+        let cases = [
+            ("meta_refresh_success.html", "https://www.91160.com/guahao/success.html?order_id=88001234&unit_id=200001"),
+            ("js_redirect_success.html", "https://www.91160.com/guahao/success.html?order_id="),
+        ];
+        for (file, expected) in cases {
+            let body = std::fs::read_to_string(dir.join(file)).unwrap();
+            let target = parse_client_redirect(&body, base).unwrap();
+            assert_eq!(target, expected, "{}", file);
+            assert_eq!(classify_submit_redirect(&target), SubmitRedirect::Success, "{}", file);
+        }
+        assert_eq!(parse_order_no(cases[0].1).as_deref(), Some("88001234"));
+        assert_eq!(parse_order_no(cases[1].1), None);
+
+        let cashier = r#"<script>location.replace('/pay/cashier.html?order=1')</script>"#;
+        let target = parse_client_redirect(cashier, base).unwrap();
+        assert_eq!(classify_submit_redirect(&target), SubmitRedirect::Payment);
+
+        assert!(parse_client_redirect("<script>if (location == '') {}</script>", base).is_none());
+        assert!(parse_client_redirect(r#"<script>location.href = 'javascript:void(0)'</script>"#, base).is_none());
+        assert!(parse_client_redirect("<div class=\"error\">号源已满</div>", base).is_none());
+    }
+
+    #[test]
+    fn test_parse_waitlist_form() {
+        let page = r#"<html><body>
+            <form id="submitForm" action="/guahao/ysubmit.html"><input name="sch_data" value="x"></form>
+            <form id="houbuForm" action="/guahao/houbu/submit.html">
+                <input type="hidden" name="schedule_id" value="9001">
+                <input type="hidden" name="mid" value="">
+                <button>加入候补</button>
+            </form>
+        </body></html>"#;
+        let (action, fields) = parse_waitlist_form(page).unwrap();
+        assert_eq!(action, "https://www.91160.com/guahao/houbu/submit.html");
+        assert_eq!(fields["schedule_id"], "9001");
+        assert_eq!(fields["mid"], "");
+
+        assert!(parse_waitlist_form(r#"<form action="/guahao/ysubmit.html"></form>"#).is_none());
+
+        assert!(is_waitlist_success(r#"{"result_code": 1, "msg": "ok"}"#));
+        assert!(is_waitlist_success("<div>您已加入候补，请留意通知</div>"));
+        assert!(!is_waitlist_success(r#"{"result_code": "0", "error_msg": "候补已满"}"#));
+    }
+
+    #[test]
+    fn test_filter_by_keyword() {
+        let hospital = |id: &str, name: &str| Hospital {
+            unit_id: id.into(),
+            unit_name: name.into(),
+            ..Default::default()
+        };
+        let hospitals = vec![
+            hospital("1", "深圳市人民医院（龙华分院）"),
+            hospital("2", "深圳市人民医院"),
+            hospital("3", "北京大学深圳医院"),
+        ];
+
+        let ids = |matches: Vec<&Hospital>| matches.iter().map(|h| h.unit_id.clone()).collect::<Vec<_>>();
+        assert_eq!(ids(filter_by_keyword(&hospitals, "人民医院")), ["1", "2"]);
+        assert_eq!(ids(filter_by_keyword(&hospitals, " 深圳市人民医院(龙华分院) ")), ["1", "2"]);
+        assert_eq!(ids(filter_by_keyword(&hospitals, "北大")), Vec::<String>::new());
+        assert_eq!(filter_by_keyword(&hospitals, "").len(), 3);
+
+        assert_eq!(best_unit_match(&hospitals, "深圳市人民医院").as_deref(), Some("2"));
+        assert_eq!(best_unit_match(&hospitals, "深圳市人民医院（龙华分院）").as_deref(), Some("1"));
+        assert_eq!(best_unit_match(&hospitals, "北京大学深圳").as_deref(), Some("3"));
+        assert_eq!(best_unit_match(&hospitals, "协和医院"), None);
+    }
+
+    #[test]
+    fn test_select_member() {
+        let member = |id: &str, name: &str, certified: bool| Member {
+            id: id.into(),
+            name: name.into(),
+            certified,
+        };
+        let one = vec![member("1001", "张三", true), member("1002", "李四", false)];
+        assert_eq!(select_member(&one, "").unwrap().id, "1001");
+        assert_eq!(select_member(&one, " 李 四 ").unwrap().id, "1002");
+
+        let error = select_member(&one, "王五").unwrap_err().to_string();
+        assert!(error.contains("张三(1001, certified), 李四(1002)"), "{}", error);
+
+        let two = vec![member("1001", "张三", true), member("1003", "张三", true)];
+        assert!(select_member(&two, "").unwrap_err().to_string().contains("several members"));
+        assert!(select_member(&two, "张三").is_err());
+        assert!(select_member(&[member("1002", "李四", false)], "").is_err());
+    }
+
+    #[test]
+    fn test_normalize_member_name() {
+        assert_eq!(normalize_member_name("张三\u{3000}默认"), "张三");
+        assert_eq!(normalize_member_name(" 张\u{200B}三\u{FEFF} "), "张三");
+        assert_eq!(normalize_member_name("李四 (已认证) 默认"), "李四");
+        assert_eq!(normalize_member_name("【默认】王五"), "王五");
+        assert_eq!(normalize_member_name("Li\u{3000}\u{3000}Si"), "Li Si");
+        // Decomposed e + combining acute composes to é
+        assert_eq!(normalize_member_name("Ame\u{0301}lie"), "Am\u{00E9}lie");
+
+        let members = vec![Member { id: "1001".into(), name: normalize_member_name("张三\u{3000}默认"), certified: true }];
+        assert_eq!(select_member(&members, "张\u{200D}三\u{3000}").unwrap().id, "1001");
+        assert_eq!(select_member(&members, "张三 默认").unwrap().id, "1001");
+    }
+
+    #[test]
+    fn test_parse_schedule_docs() {
+        let data = serde_json::json!({
+            "doc": [
+                {"doctor_id": "11", "doctor_name": "张医生"},
+                {"doctor_id": 22, "doctor_name": "李医生"},
+                {"doctor_id": "33", "doctor_name": "无号医生"}
+            ],
+            "sch": {
+                "11": {"am": {"a": {"schedule_id": "s1", "time_type": "am", "left_num": 2}}},
+                "22": {"pm": [{"schedule_id": 501, "time_type": "pm", "left_num": 0, "houbu": "1"}, {"schedule_id": 502, "time_type": "pm", "left_num": 1}]}
+            }
+        });
+
+        let docs = parse_schedule_docs(&data, None);
+        assert_eq!(docs.len(), 2);
+        assert_eq!(docs[0].total_left_num, 2);
+
+        let only = parse_schedule_docs(&data, Some("22"));
+        assert_eq!(only.len(), 1);
+        assert_eq!(only[0].doctor_name, "李医生");
+        let ids: Vec<&str> = only[0].schedules.iter().map(|s| s.schedule_id.as_str()).collect();
+        assert_eq!(ids, ["501", "502"]);
+        assert!(only[0].schedules[0].waitlist);
+        assert!(!only[0].schedules[1].waitlist);
+
+        assert!(parse_schedule_docs(&data, Some("33")).is_empty());
+        assert!(parse_schedule_docs(&serde_json::Value::Null, None).is_empty());
+    }
+
+    /// The gate API sends counts and HIS ids as strings on some hospitals and numbers on others
+    #[test]
+    fn test_parse_schedule_docs_mixed_field_types() {
+        let data = serde_json::json!({
+            "doc": [{"doctor_id": "11", "doctor_name": "张医生", "his_doc_id": 9001, "his_dep_id": "D7", "reg_fee": null}],
+            "sch": {"11": {"am": [
+                {"schedule_id": 601, "time_type": "am", "left_num": "3", "sch_date": "2026-10-20"},
+                {"schedule_id": "602", "time_type": "am", "left_num": null},
+                {"time_type": "am", "left_num": 5}
+            ]}}
+        });
+
+        let docs = parse_schedule_docs(&data, None);
+        assert_eq!(docs.len(), 1);
+        let doc = &docs[0];
+        assert_eq!((doc.his_doc_id.as_str(), doc.his_dep_id.as_str(), doc.reg_fee.as_str()), ("9001", "D7", ""));
+        let slots: Vec<(&str, i32, &str)> = doc.schedules.iter().map(|s| (s.schedule_id.as_str(), s.left_num, s.sch_date.as_str())).collect();
+        assert_eq!(slots, [("601", 3, "2026-10-20"), ("602", 0, "")]);
+        assert_eq!(doc.total_left_num, 3);
+    }
+
+    #[test]
+    fn test_parse_schedule_verification_required() {
+        let data = serde_json::json!({
+            "doc": [
+                {"doctor_id": "11", "doctor_name": "张医生", "need_realname": 1},
+                {"doctor_id": "22", "doctor_name": "李医生"}
+            ],
+            "sch": {
+                "11": {"am": [{"schedule_id": "s1", "time_type": "am", "left_num": 2}]},
+                "22": {"pm": [
+                    {"schedule_id": "s2", "time_type": "pm", "left_num": 1, "limit_desc": "仅限实名认证用户预约"},
+                    {"schedule_id": "s3", "time_type": "pm", "left_num": 1, "is_auth": "0"}
+                ]}
+            }
+        });
+
+        let docs = parse_schedule_docs(&data, None);
+        assert!(docs[0].verification_required);
+        assert!(docs[0].schedules[0].verification_required);
+        assert!(!docs[1].verification_required);
+        let flags: Vec<bool> = docs[1].schedules.iter().map(|s| s.verification_required).collect();
+        assert_eq!(flags, [true, false]);
+    }
+
+    #[test]
+    fn test_schedule_unmatched_doctors() {
+        let body = r#"{"result_code":"1","data":{
+            "doc": [{"doctor_id": "11", "doctor_name": "张医生"}, {"doctor_id": 22, "doctor_name": "李医生"}, {"doctor_id": "33", "doctor_name": "王医生"}],
+            "sch": {"11": {"am": []}, "H022": {"pm": []}}
+        }}"#;
+        let payload = decode_schedule_payload(body.as_bytes(), None).unwrap();
+        let meta = ScheduleMeta {
+            fetched_at: chrono::Local::now(),
+            round_trip_ms: 0,
+            host: String::new(),
+            user_key: String::new(),
+            http_status: 200,
+            roster: payload.data.roster,
+            sch_keys: payload.data.sch_keys,
+        };
+        let result = ScheduleResult { docs: Vec::new(), meta };
+
+        let unmatched = result.unmatched_doctors();
+        let doctors: Vec<&str> = unmatched.doctors.iter().map(|d| d.doctor_id.as_str()).collect();
+        assert_eq!(doctors, ["22", "33"]);
+        assert_eq!(unmatched.orphan_sch_keys, ["H022"]);
+        assert_eq!(unmatched.summary(), "unmatched_docs=2 orphan_sch_keys=1");
+        assert!(!unmatched.is_empty());
+    }
+
+    /// sch/dep body shaped like the 2.3 MB answer of a large department: doctors x am/pm x slots
+    fn large_schedule_body(doctors: usize, slots: usize) -> Vec<u8> {
+        let mut doc = Vec::new();
+        let mut sch = serde_json::Map::new();
+        for d in 0..doctors {
+            let doctor_id = format!("{}", 100000 + d);
+            doc.push(serde_json::json!({
+                "doctor_id": doctor_id,
+                "doctor_name": format!("医生{}", d),
+                "zc_name": "主任医师",
+                "reg_fee": "50",
+                "expert": "擅长各类常见病、多发病的诊治，对疑难杂症有丰富的临床经验。".repeat(4),
+            }));
+            let mut entry = serde_json::Map::new();
+            for time_type in ["am", "pm"] {
+                let list: serde_json::Map<String, serde_json::Value> = (0..slots)
+                    .map(|i| {
+                        (
+                            format!("{}", i),
+                            serde_json::json!({
+                                "schedule_id": format!("{}{}{:03}", doctor_id, time_type, i),
+                                "time_type": time_type,
+                                "time_type_desc": if time_type == "am" { "上午" } else { "下午" },
+                                "left_num": (d + i) % 3,
+                                "sch_date": "2026-10-20",
+                                "his_sch_id": format!("H{}{:03}", d, i),
+                                "level_name": "专家门诊",
+                            }),
+                        )
+                    })
+                    .collect();
+                entry.insert(time_type.into(), serde_json::Value::Object(list));
+            }
+            sch.insert(doctor_id, serde_json::Value::Object(entry));
+        }
+        serde_json::to_vec(&serde_json::json!({"result_code": "1", "data": {"doc": doc, "sch": sch}})).unwrap()
+    }
+
+    fn ready_slot(_: &str, slot: &ScheduleSlot) -> bool {
+        slot.left_num > 0 && !slot.schedule_id.is_empty()
+    }
+
+    #[test]
+    fn test_filtered_schedule_decode_matches_full() {
+        let body = large_schedule_body(40, 12);
+        let full: serde_json::Value = serde_json::from_slice(&body).unwrap();
+        let full_docs = parse_schedule_docs(&full["data"], Some("100017"));
+
+        let doctors: HashSet<String> = ["100017".to_string(), "100030".to_string()].into_iter().collect();
+        let payload = decode_schedule_payload(&body, Some(&doctors)).unwrap();
+        assert_eq!(payload.data.doc_total, 40);
+        let data = payload.data.into_value();
+        assert_eq!(data["sch"].as_object().unwrap().len(), 2);
+
+        let docs = parse_schedule_docs(&data, None);
+        assert_eq!(docs.len(), 2);
+        assert_eq!(docs[0].schedules.len(), full_docs[0].schedules.len());
+        assert_eq!(docs[0].total_left_num, full_docs[0].total_left_num);
+
+        // The first doctor already holds a ready slot, so the second is never normalized
+        let docs = parse_schedule_docs_until(&data, &ready_slot);
+        assert_eq!(docs.len(), 1);
+        assert_eq!(docs[0].doctor_id, "100017");
+        assert_eq!(parse_schedule_docs_until(&data, &|_, _| false).len(), 2);
+    }
+
+    /// Timing of full vs filtered decoding on a ~2.3 MB payload with 420 doctors
+    /// Run with: cargo test --release bench_large_schedule -- --ignored --nocapture
+    #[test]
+    #[ignore]
+    fn bench_large_schedule_decode() {
+        let body = large_schedule_body(420, 14);
+        println!("payload: {} bytes", body.len());
+        let doctors: HashSet<String> = ["100205".to_string()].into_iter().collect();
+        let rounds = 20;
+
+        let started = Instant::now();
+        for _ in 0..rounds {
+            let payload: serde_json::Value = serde_json::from_slice(&body).unwrap();
+            let docs = parse_schedule_docs(&payload["data"], None);
+            assert!(docs.iter().any(|doc| doctors.contains(&doc.doctor_id)));
+        }
+        let full = started.elapsed() / rounds;
+
+        let started = Instant::now();
+        for _ in 0..rounds {
+            let payload = decode_schedule_payload(&body, Some(&doctors)).unwrap();
+            let docs = parse_schedule_docs_until(&payload.data.into_value(), &ready_slot);
+            assert_eq!(docs.len(), 1);
+        }
+        let filtered = started.elapsed() / rounds;
+
+        println!("full: {:?}/cycle, filtered: {:?}/cycle", full, filtered);
+        assert!(filtered < full);
     }
 }
@@ -3,19 +3,34 @@
 
 use std::collections::HashMap;
 use std::fs;
+use std::path::Path;
+use std::sync::Mutex;
+
+use chrono::{DateTime, Duration, Local};
+use reqwest::cookie::{CookieStore, Jar};
+use reqwest::header::HeaderValue;
+use url::Url;
 
 use super::errors::{AppError, AppResult};
-use super::paths::cookies_path;
+use super::paths::{write_file_atomic, ConfigDir, COOKIES_FILE};
 use super::types::CookieRecord;
 
-/// Load cookies from file
-pub fn load_cookie_file() -> AppResult<Vec<CookieRecord>> {
-    let path = cookies_path()?;
+/// Records unused for this many days are dropped on normalize
+const COOKIE_STALE_AGE_DAYS: i64 = 30;
+
+/// Load cookies from file, leaving out expired records
+pub fn load_cookie_file(dir: &ConfigDir) -> AppResult<Vec<CookieRecord>> {
+    let records = read_cookie_file(&dir.join(COOKIES_FILE)?)?;
+    Ok(migrate_cookie_records(dir, records))
+}
+
+/// Parse a cookie file in either format; stale and expired records are dropped
+fn read_cookie_file(path: &Path) -> AppResult<Vec<CookieRecord>> {
     if !path.exists() {
         return Ok(Vec::new());
     }
 
-    let data = fs::read_to_string(&path)?;
+    let data = fs::read_to_string(path)?;
 
     // Try parsing as array first
     if let Ok(list) = serde_json::from_str::<Vec<CookieRecord>>(&data) {
@@ -31,6 +46,7 @@ pub fn load_cookie_file() -> AppResult<Vec<CookieRecord>> {
                 value,
                 domain: ".91160.com".into(),
                 path: "/".into(),
+                ..Default::default()
             })
             .collect();
         return Ok(normalize_cookie_records(list));
@@ -40,30 +56,114 @@ pub fn load_cookie_file() -> AppResult<Vec<CookieRecord>> {
 }
 
 /// Save cookies to file
-pub fn save_cookie_file(records: &[CookieRecord]) -> AppResult<()> {
+pub fn save_cookie_file(dir: &ConfigDir, records: &[CookieRecord]) -> AppResult<()> {
     let normalized = normalize_cookie_records(records.to_vec());
     if normalized.is_empty() {
         return Err(AppError::ConfigError("No cookies to save".into()));
     }
 
-    let path = cookies_path()?;
-    if let Some(parent) = path.parent() {
-        fs::create_dir_all(parent)?;
+    let path = dir.join(COOKIES_FILE)?;
+    let data = serde_json::to_string_pretty(&normalized)?;
+    write_file_atomic(&path, data.as_bytes())
+}
+
+/// Parse a Set-Cookie header into a record; deletions (empty value or Max-Age=0) yield None
+pub fn parse_set_cookie(header: &str, default_domain: &str) -> Option<CookieRecord> {
+    let mut parts = header.split(';');
+    let (name, value) = parts.next()?.split_once('=')?;
+    let name = name.trim();
+    let value = value.trim().trim_matches('"');
+    if name.is_empty() || value.is_empty() {
+        return None;
     }
 
-    let data = serde_json::to_string_pretty(&normalized)?;
-    fs::write(&path, data)?;
-    Ok(())
+    let mut record = CookieRecord {
+        name: name.to_string(),
+        value: value.to_string(),
+        domain: default_domain.to_string(),
+        path: "/".into(),
+        ..Default::default()
+    };
+    for attr in parts {
+        let (key, val) = attr.split_once('=').unwrap_or((attr, ""));
+        match key.trim().to_lowercase().as_str() {
+            "domain" if !val.trim().is_empty() => record.domain = val.trim().to_string(),
+            "path" if !val.trim().is_empty() => record.path = val.trim().to_string(),
+            "max-age" => match val.trim().parse::<i64>() {
+                Ok(secs) if secs <= 0 => return None,
+                Ok(secs) => {
+                    record.expires = Some(Local::now() + Duration::seconds(secs));
+                    record.max_age = Some(secs);
+                }
+                Err(_) => {}
+            },
+            // Max-Age takes precedence over Expires
+            "expires" if record.max_age.is_none() => {
+                record.expires = DateTime::parse_from_rfc2822(val.trim().replace('-', " ").as_str())
+                    .ok()
+                    .map(|t| t.with_timezone(&Local));
+            }
+            _ => {}
+        }
+    }
+    Some(record)
+}
+
+/// Earliest expiry among the named cookies; None when none of them carries one
+pub fn earliest_expiry(records: &[CookieRecord], names: &[&str]) -> Option<DateTime<Local>> {
+    records
+        .iter()
+        .filter(|r| names.contains(&r.name.as_str()) && !r.value.is_empty())
+        .filter_map(|r| r.expires)
+        .min()
+}
+
+/// Set first_seen on records saved before it was tracked and persist them
+fn migrate_cookie_records(dir: &ConfigDir, mut records: Vec<CookieRecord>) -> Vec<CookieRecord> {
+    let now = Local::now();
+    let mut migrated = false;
+    for record in records.iter_mut().filter(|r| r.first_seen.is_none()) {
+        record.first_seen = Some(now);
+        migrated = true;
+    }
+    if migrated && !records.is_empty() {
+        if let Err(e) = save_cookie_file(dir, &records) {
+            println!(">>> Warning: cookie first_seen migration not saved: {}", e);
+        }
+    }
+    records
 }
 
-/// Normalize cookie records (deduplicate and fill defaults)
+/// Mark records as used now, preserving first_seen from previously stored records
+pub fn touch_cookie_records(records: Vec<CookieRecord>, previous: &[CookieRecord]) -> Vec<CookieRecord> {
+    let now = Local::now();
+    records
+        .into_iter()
+        .map(|mut record| {
+            let key = cookie_key(&record);
+            let first_seen = previous
+                .iter()
+                .find(|p| cookie_key(p) == key)
+                .and_then(|p| p.first_seen);
+            record.first_seen = first_seen.or(record.first_seen).or(Some(now));
+            record.last_used = Some(now);
+            record
+        })
+        .collect()
+}
+
+/// Normalize cookie records (deduplicate, fill defaults and drop stale or expired records)
 pub fn normalize_cookie_records(records: Vec<CookieRecord>) -> Vec<CookieRecord> {
     let mut unique: HashMap<String, CookieRecord> = HashMap::new();
+    let stale_before = Local::now() - Duration::days(COOKIE_STALE_AGE_DAYS);
 
     for mut record in records {
         if record.name.is_empty() {
             continue;
         }
+        if record.last_used.is_some_and(|used| used < stale_before) || record.is_expired() {
+            continue;
+        }
         if record.domain.is_empty() {
             record.domain = ".91160.com".into();
         }
@@ -71,21 +171,25 @@ pub fn normalize_cookie_records(records: Vec<CookieRecord>) -> Vec<CookieRecord>
             record.path = "/".into();
         }
 
-        let key = format!(
-            "{}|{}|{}",
-            record.domain.to_lowercase(),
-            record.path,
-            record.name
-        );
-        unique.insert(key, record);
+        unique.insert(cookie_key(&record), record);
     }
 
     unique.into_values().collect()
 }
 
-/// Check if access_hash cookie exists
+/// Identity of a cookie: domain, path and name
+pub fn cookie_key(record: &CookieRecord) -> String {
+    format!(
+        "{}|{}|{}",
+        record.domain.to_lowercase(),
+        record.path,
+        record.name
+    )
+}
+
+/// Check if an unexpired access_hash cookie exists
 pub fn has_access_hash(records: &[CookieRecord]) -> bool {
-    records.iter().any(|r| r.name == "access_hash" && !r.value.is_empty())
+    records.iter().any(|r| r.name == "access_hash" && !r.value.is_empty() && !r.is_expired())
 }
 
 /// Get cookie values by name
@@ -98,6 +202,63 @@ pub fn get_cookie_values(records: &[CookieRecord], name: &str) -> Vec<String> {
         .collect()
 }
 
+/// Cookie jar that remembers the expiry of each Set-Cookie it stores, which reqwest's Jar
+/// does not give back when cookies are read out of it
+#[derive(Default)]
+pub struct ExpiryJar {
+    jar: Jar,
+    /// Last Set-Cookie record per cookie name
+    seen: Mutex<HashMap<String, CookieRecord>>,
+}
+
+impl ExpiryJar {
+    /// Cookies the jar would send to url, with the expiry of the Set-Cookie that set each value
+    pub fn records_for(&self, url: &Url) -> Vec<CookieRecord> {
+        let Some(header) = self.jar.cookies(url) else {
+            return Vec::new();
+        };
+        let seen = self.seen.lock().unwrap_or_else(|e| e.into_inner());
+        header
+            .to_str()
+            .unwrap_or_default()
+            .split(';')
+            .filter_map(|pair| pair.split_once('='))
+            .map(|(name, value)| (name.trim(), value.trim()))
+            .filter(|(name, value)| !name.is_empty() && !value.is_empty())
+            .map(|(name, value)| {
+                let set = seen.get(name).filter(|r| r.value == value);
+                CookieRecord {
+                    name: name.to_string(),
+                    value: value.to_string(),
+                    domain: ".91160.com".into(),
+                    path: "/".into(),
+                    expires: set.and_then(|r| r.expires),
+                    max_age: set.and_then(|r| r.max_age),
+                    ..Default::default()
+                }
+            })
+            .collect()
+    }
+}
+
+impl CookieStore for ExpiryJar {
+    fn set_cookies(&self, cookie_headers: &mut dyn Iterator<Item = &HeaderValue>, url: &Url) {
+        let headers: Vec<&HeaderValue> = cookie_headers.collect();
+        let host = url.host_str().unwrap_or_default();
+        {
+            let mut seen = self.seen.lock().unwrap_or_else(|e| e.into_inner());
+            for record in headers.iter().filter_map(|h| h.to_str().ok()).filter_map(|h| parse_set_cookie(h, host)) {
+                seen.insert(record.name.clone(), record);
+            }
+        }
+        self.jar.set_cookies(&mut headers.into_iter(), url);
+    }
+
+    fn cookies(&self, url: &Url) -> Option<HeaderValue> {
+        self.jar.cookies(url)
+    }
+}
+
 /// Remove duplicate values from cookie list
 pub fn unique_strings(values: Vec<String>) -> Vec<String> {
     let mut seen = std::collections::HashSet::new();
@@ -108,6 +269,55 @@ pub fn unique_strings(values: Vec<String>) -> Vec<String> {
 mod tests {
     use super::*;
 
+    #[test]
+    fn test_parse_set_cookie() {
+        let record = parse_set_cookie("access_hash=abc123; Domain=.91160.com; Path=/; HttpOnly", "www.91160.com").unwrap();
+        assert_eq!((record.name.as_str(), record.value.as_str()), ("access_hash", "abc123"));
+        assert_eq!((record.domain.as_str(), record.path.as_str()), (".91160.com", "/"));
+
+        let record = parse_set_cookie("PHPSESSID=xyz", "gate.91160.com").unwrap();
+        assert_eq!(record.domain, "gate.91160.com");
+
+        assert!(parse_set_cookie("access_hash=deleted; Max-Age=0", "www.91160.com").is_none());
+        assert!(parse_set_cookie("access_hash=; Path=/", "www.91160.com").is_none());
+        assert!(parse_set_cookie("garbage", "www.91160.com").is_none());
+    }
+
+    #[test]
+    fn test_parse_set_cookie_expiry() {
+        let record = parse_set_cookie("access_hash=a; Expires=Thu, 15 Oct 2026 15:59:00 GMT; Path=/", "www.91160.com").unwrap();
+        assert_eq!(record.expires.unwrap().to_rfc3339(), DateTime::parse_from_rfc3339("2026-10-15T15:59:00Z").unwrap().with_timezone(&Local).to_rfc3339());
+
+        let record = parse_set_cookie("access_hash=a; Expires=Thu, 15-Oct-2026 15:59:00 GMT", "www.91160.com").unwrap();
+        assert!(record.expires.is_some());
+
+        let before = Local::now();
+        let record = parse_set_cookie("access_hash=a; Expires=Thu, 15 Oct 2026 15:59:00 GMT; Max-Age=3600", "www.91160.com").unwrap();
+        let expires = record.expires.unwrap();
+        assert!(expires >= before + Duration::seconds(3600) && expires <= Local::now() + Duration::seconds(3600));
+
+        assert!(parse_set_cookie("PHPSESSID=xyz", "www.91160.com").unwrap().expires.is_none());
+    }
+
+    #[test]
+    fn test_earliest_expiry() {
+        let now = Local::now();
+        let record = |name: &str, expires: Option<DateTime<Local>>| CookieRecord {
+            name: name.into(),
+            value: "v".into(),
+            expires,
+            ..Default::default()
+        };
+        let records = vec![
+            record("access_hash", Some(now + Duration::hours(5))),
+            record("PHPSESSID", Some(now + Duration::hours(2))),
+            record("other", Some(now + Duration::hours(1))),
+            record("access_hash", None),
+        ];
+        assert_eq!(earliest_expiry(&records, &["access_hash", "PHPSESSID"]), Some(now + Duration::hours(2)));
+        assert_eq!(earliest_expiry(&records, &["missing"]), None);
+    }
+
     #[test]
     fn test_normalize_cookies() {
         let records = vec![
@@ -116,12 +326,14 @@ mod tests {
                 value: "value1".into(),
                 domain: "".into(),
                 path: "".into(),
+                ..Default::default()
             },
             CookieRecord {
                 name: "test".into(),
                 value: "value2".into(),
                 domain: ".91160.com".into(),
                 path: "/".into(),
+                ..Default::default()
             },
         ];
 
@@ -137,7 +349,107 @@ mod tests {
             value: "abc123".into(),
             domain: ".91160.com".into(),
             path: "/".into(),
+            ..Default::default()
         }];
         assert!(has_access_hash(&records));
     }
+
+    #[test]
+    fn test_expired_cookie_file_is_rejected() {
+        let dir = std::env::temp_dir().join(format!("skylinemed_cookies_expired_{}", std::process::id()));
+        fs::create_dir_all(&dir).unwrap();
+        let path = dir.join("cookies.json");
+        let past = (Local::now() - Duration::hours(1)).to_rfc3339();
+        let future = (Local::now() + Duration::hours(1)).to_rfc3339();
+        fs::write(
+            &path,
+            format!(
+                r#"[{{"name":"access_hash","value":"old","expires":"{past}","max_age":86400}},
+                    {{"name":"PHPSESSID","value":"s","expires":"{future}"}}]"#
+            ),
+        )
+        .unwrap();
+
+        let records = read_cookie_file(&path).unwrap();
+        assert_eq!(records.len(), 1);
+        assert_eq!(records[0].name, "PHPSESSID");
+        assert!(!has_access_hash(&records));
+
+        // Records already in memory stop counting once they expire
+        let expired = CookieRecord {
+            name: "access_hash".into(),
+            value: "old".into(),
+            expires: Some(Local::now() - Duration::seconds(1)),
+            ..Default::default()
+        };
+        assert!(expired.is_expired());
+        assert!(!has_access_hash(&[expired]));
+        let _ = fs::remove_dir_all(&dir);
+    }
+
+    #[test]
+    fn test_expiry_jar_keeps_set_cookie_expiry() {
+        let jar = ExpiryJar::default();
+        let url = Url::parse("https://www.91160.com/").unwrap();
+        let headers = [
+            HeaderValue::from_static("access_hash=abc; Domain=.91160.com; Path=/; Max-Age=3600"),
+            HeaderValue::from_static("PHPSESSID=xyz; Path=/"),
+        ];
+        jar.set_cookies(&mut headers.iter(), &url);
+
+        let mut records = jar.records_for(&url);
+        records.sort_by(|a, b| a.name.cmp(&b.name));
+        assert_eq!(records[0].name, "PHPSESSID");
+        assert!(records[0].expires.is_none());
+        assert_eq!(records[1].name, "access_hash");
+        assert_eq!(records[1].max_age, Some(3600));
+        assert!(records[1].expires.is_some_and(|t| t > Local::now()));
+    }
+
+    #[test]
+    fn test_normalize_drops_stale_cookies() {
+        let now = Local::now();
+        let record = |name: &str, last_used: Option<chrono::DateTime<Local>>| CookieRecord {
+            name: name.into(),
+            value: "v".into(),
+            last_used,
+            ..Default::default()
+        };
+        let records = vec![
+            record("fresh", Some(now - Duration::days(1))),
+            record("stale", Some(now - Duration::days(COOKIE_STALE_AGE_DAYS + 1))),
+            record("legacy", None),
+        ];
+
+        let mut names: Vec<String> = normalize_cookie_records(records).into_iter().map(|r| r.name).collect();
+        names.sort();
+        assert_eq!(names, vec!["fresh", "legacy"]);
+    }
+
+    #[test]
+    fn test_touch_cookie_records() {
+        let first_seen = Local::now() - Duration::days(3);
+        let previous = vec![CookieRecord {
+            name: "access_hash".into(),
+            value: "old".into(),
+            domain: ".91160.com".into(),
+            path: "/".into(),
+            first_seen: Some(first_seen),
+            ..Default::default()
+        }];
+        let fresh = vec![
+            CookieRecord { name: "access_hash".into(), value: "new".into(), domain: ".91160.com".into(), path: "/".into(), ..Default::default() },
+            CookieRecord { name: "other".into(), value: "x".into(), domain: ".91160.com".into(), path: "/".into(), ..Default::default() },
+        ];
+
+        let touched = touch_cookie_records(fresh, &previous);
+        assert_eq!(touched[0].first_seen, Some(first_seen));
+        assert!(touched[0].last_used.is_some());
+        assert!(touched[1].first_seen.is_some_and(|t| t > first_seen));
+
+        // Timestamps persist as ISO-8601 strings
+        let json = serde_json::to_value(&touched[0]).unwrap();
+        let stored = json["first_seen"].as_str().unwrap();
+        assert!(chrono::DateTime::parse_from_rfc3339(stored).is_ok());
+    }
 }
@@ -1,15 +1,20 @@
 //! Error types for QuickDoctor
 //! Corresponds to core/errors.go
 
+use std::sync::OnceLock;
+
+use regex::Regex;
 use thiserror::Error;
 
+use super::netclass::NetErrorKind;
+
 /// Application error types
 #[derive(Error, Debug)]
 pub enum AppError {
     #[error("Login required: {0}")]
     LoginRequired(String),
 
-    #[error("HTTP request failed: {0}")]
+    #[error("HTTP request failed: {}", redact_secrets(&.0.to_string()))]
     HttpError(#[from] reqwest::Error),
 
     #[error("JSON parse error: {0}")]
@@ -18,6 +23,10 @@ pub enum AppError {
     #[error("IO error: {0}")]
     IoError(#[from] std::io::Error),
 
+    #[cfg(feature = "sqlite-store")]
+    #[error("Database error: {0}")]
+    DatabaseError(#[from] rusqlite::Error),
+
     #[error("Configuration error: {0}")]
     ConfigError(String),
 
@@ -27,13 +36,59 @@ pub enum AppError {
     #[error("API error: {0}")]
     ApiError(String),
 
-    #[allow(dead_code)]
     #[error("Timeout: {0}")]
     Timeout(String),
 
     #[error("Cancelled")]
     Cancelled,
 
+    #[error("Daily quota exceeded: {0}")]
+    QuotaExceeded(String),
+
+    #[error("Unsupported booking flow: {flow} ({url})")]
+    FlowUnsupported { flow: String, url: String },
+
+    #[error("Disease description required (min length {min_length})")]
+    DiseaseDescriptionRequired { min_length: usize },
+
+    #[error("Required consent not granted: {names}")]
+    ConsentRequired { names: String, labels: String },
+
+    #[error("Member is not registered with the hospital (hisMemId missing)")]
+    HisMemberRequired,
+
+    #[error("None of the configured doctors ({configured}) is in the department; available: {available}")]
+    DoctorNotInDepartment { configured: String, available: String },
+
+    #[error("City {city_id} rejected: {message}")]
+    BadCity { city_id: String, message: String },
+
+    #[error("Unexpected {what} response: {snippet}")]
+    UnexpectedResponse { what: String, snippet: String },
+
+    #[error("Submit limit of {limit} reached (per_day: {per_day})")]
+    SubmitLimitReached { per_day: bool, limit: u32 },
+
+    /// Every gate host answered, none listed a doctor for the date
+    #[error("Schedule is empty")]
+    ScheduleEmpty,
+
+    /// A non-success HTTP answer; url has session tokens redacted
+    #[error("HTTP {status} from {url}: {snippet}")]
+    HttpStatus { status: u16, url: String, snippet: String },
+
+    /// A transport failure with where it happened; see netclass
+    #[error("Network error ({}): {detail}", .kind.as_str())]
+    Network { kind: NetErrorKind, detail: String },
+
+    /// A submit with this nonce was sent and never answered; sending it again could book twice
+    #[error("Outcome of submit {nonce} is unknown")]
+    SubmitOutcomeUnknown { nonce: String },
+
+    /// Every proxy source was tried and none gave a working proxy
+    #[error("No proxy available: {0}")]
+    ProxyExhausted(String),
+
     #[allow(dead_code)]
     #[error("Proxy error: {0}")]
     ProxyError(String),
@@ -59,20 +114,55 @@ impl AppError {
     pub fn to_frontend_string(&self) -> String {
         match self {
             AppError::LoginRequired(_) => "登录已失效，请重新扫码".to_string(),
-            AppError::HttpError(e) => format!("网络请求失败: {}", e),
+            AppError::HttpError(e) => format!("网络请求失败: {}", redact_secrets(&e.to_string())),
             AppError::JsonError(e) => format!("数据解析失败: {}", e),
             AppError::IoError(e) => format!("文件操作失败: {}", e),
+            #[cfg(feature = "sqlite-store")]
+            AppError::DatabaseError(e) => format!("本地数据库操作失败: {}", e),
             AppError::ConfigError(msg) => format!("配置错误: {}", msg),
             AppError::ParseError(msg) => format!("解析错误: {}", msg),
             AppError::ApiError(msg) => format!("API 错误: {}", msg),
             AppError::Timeout(msg) => format!("超时: {}", msg),
             AppError::Cancelled => "操作已取消".to_string(),
+            AppError::QuotaExceeded(msg) => format!("今日挂号次数已达上限: {}", msg),
+            AppError::FlowUnsupported { flow, .. } => format!("该科室已改为{}流程，暂不支持自动挂号", flow),
+            AppError::DiseaseDescriptionRequired { min_length: 0 } => "该科室要求填写病情描述，请在配置中填写后重新开始".to_string(),
+            AppError::DiseaseDescriptionRequired { min_length } => {
+                format!("该科室要求填写病情描述（至少 {} 字），请在配置中填写后重新开始", min_length)
+            }
+            AppError::ConsentRequired { names, labels } => {
+                format!("该科室要求勾选同意项「{}」，确认同意后请将 {} 加入配置的 consents 再重新开始", labels, names)
+            }
+            AppError::HisMemberRequired => "该医院要求就诊人先在医院平台绑定建档，请绑定后重新开始".to_string(),
+            AppError::DoctorNotInDepartment { configured, available } => {
+                format!("配置的医生 {} 均不在该科室，请修正医生 ID 后重新开始。科室医生: {}", configured, available)
+            }
+            AppError::BadCity { city_id, message } if message.is_empty() => format!("城市 {} 无效，请重新选择城市", city_id),
+            AppError::BadCity { city_id, message } => format!("城市 {} 无效，请重新选择城市: {}", city_id, message),
+            AppError::UnexpectedResponse { .. } => "服务器返回了无法识别的内容，请稍后重试或重新登录".to_string(),
+            AppError::SubmitLimitReached { per_day: true, limit } => format!("今日提交次数已达上限（{} 次），已停止", limit),
+            AppError::SubmitLimitReached { per_day: false, limit } => format!("本次运行提交次数已达上限（{} 次），已停止", limit),
+            AppError::ScheduleEmpty => "该日期暂无排班".to_string(),
+            AppError::HttpStatus { status, .. } => format!("服务器返回 HTTP {}，请稍后重试", status),
+            AppError::Network { kind, .. } => kind.hint().to_string(),
+            AppError::SubmitOutcomeUnknown { .. } => "上一次提交已发出但未收到结果，可能已挂号成功，请先在“我的预约”中确认再重新开始".to_string(),
+            AppError::ProxyExhausted(msg) => format!("没有可用的代理: {}", msg),
             AppError::ProxyError(msg) => format!("代理错误: {}", msg),
             AppError::Other(msg) => msg.clone(),
         }
     }
 }
 
+/// Redact session tokens (user_key / access_hash values) from a message
+/// Transport errors echo the request URL, which carries user_key in its query
+pub fn redact_secrets(message: &str) -> String {
+    static SECRET_RE: OnceLock<Regex> = OnceLock::new();
+    let re = SECRET_RE.get_or_init(|| {
+        Regex::new(r#"(?i)\b(user_key|access_hash)(=|%3D|"\s*:\s*")[^&\s"';)]+"#).unwrap()
+    });
+    re.replace_all(message, "${1}${2}***").into_owned()
+}
+
 /// Result type alias for the application
 pub type AppResult<T> = Result<T, AppError>;
 
@@ -85,3 +175,43 @@ impl serde::Serialize for AppError {
         serializer.serialize_str(&self.to_frontend_string())
     }
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_redact_secrets() {
+        assert_eq!(
+            redact_secrets("https://gate.91160.com/guahao/v1/pc/sch/dep?unit_id=1&user_key=abc123&p=0"),
+            "https://gate.91160.com/guahao/v1/pc/sch/dep?unit_id=1&user_key=***&p=0"
+        );
+        assert_eq!(redact_secrets("access_hash=deadbeef; other=1"), "access_hash=***; other=1");
+        assert_eq!(redact_secrets(r#"{"access_hash": "deadbeef"}"#), r#"{"access_hash": "***"}"#);
+        assert_eq!(redact_secrets("no secrets here"), "no secrets here");
+    }
+
+    #[tokio::test]
+    async fn test_transport_error_is_redacted() {
+        const SECRET: &str = "secret-token-123";
+        let url = format!("http://127.0.0.1:1/guahao/v1/pc/sch/dep?unit_id=1&user_key={}", SECRET);
+
+        let client = reqwest::Client::builder()
+            .timeout(std::time::Duration::from_secs(2))
+            .build()
+            .unwrap();
+        let err = client.get(&url).send().await.unwrap_err();
+
+        // Some reqwest versions echo the URL in the error text, others only keep it in url()
+        let echoed = match err.url() {
+            Some(u) => format!("schedule request failed: {} for url ({})", err, u),
+            None => format!("schedule request failed: {} for url ({})", err, url),
+        };
+        assert!(echoed.contains(SECRET));
+        assert!(!redact_secrets(&echoed).contains(SECRET));
+
+        let err = AppError::from(err);
+        assert!(!err.to_string().contains(SECRET));
+        assert!(!err.to_frontend_string().contains(SECRET));
+    }
+}
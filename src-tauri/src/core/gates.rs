@@ -0,0 +1,145 @@
+//! Gate API host resolution for SkylineMed
+//! Some hospitals are served by regional gate mirrors; config/gates.json maps unit_id to the
+//! gate host that answers for it, and every other unit uses the default host.
+
+use std::collections::HashMap;
+use std::fs;
+
+use serde::{Deserialize, Serialize};
+
+use super::errors::AppResult;
+use super::paths::{write_file_atomic, ConfigDir, GATES_FILE};
+
+/// Gate host used when a unit has no mapping
+pub const DEFAULT_GATE_HOST: &str = "gate.91160.com";
+
+/// Default host, alternates worth probing, and per-unit overrides
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct GateHosts {
+    #[serde(default = "default_gate_host")]
+    pub default: String,
+    /// Mirrors tried once when the default keeps returning nothing for a unit
+    #[serde(default)]
+    pub alternates: Vec<String>,
+    #[serde(default)]
+    pub units: HashMap<String, String>,
+}
+
+impl Default for GateHosts {
+    fn default() -> Self {
+        Self {
+            default: default_gate_host(),
+            alternates: Vec::new(),
+            units: HashMap::new(),
+        }
+    }
+}
+
+fn default_gate_host() -> String {
+    DEFAULT_GATE_HOST.to_string()
+}
+
+impl GateHosts {
+    /// Gate host for a unit; unknown units and invalid entries use the default
+    pub fn host_for(&self, unit_id: &str) -> String {
+        self.units
+            .get(unit_id.trim())
+            .and_then(|h| normalize_gate_host(h))
+            .or_else(|| normalize_gate_host(&self.default))
+            .unwrap_or_else(default_gate_host)
+    }
+
+    /// Alternates to probe for a unit, excluding the host it already uses
+    pub fn probe_candidates(&self, unit_id: &str) -> Vec<String> {
+        let current = self.host_for(unit_id);
+        let mut hosts: Vec<String> = Vec::new();
+        for host in self.alternates.iter().chain(std::iter::once(&self.default)) {
+            if let Some(host) = normalize_gate_host(host) {
+                if host != current && !hosts.contains(&host) {
+                    hosts.push(host);
+                }
+            }
+        }
+        hosts
+    }
+}
+
+/// Strip scheme and trailing slash; None when what is left is not a plain host[:port]
+pub fn normalize_gate_host(raw: &str) -> Option<String> {
+    let host = raw.trim();
+    let host = host.strip_prefix("https://").or_else(|| host.strip_prefix("http://")).unwrap_or(host);
+    let host = host.trim_end_matches('/').to_ascii_lowercase();
+    let valid = !host.is_empty()
+        && host.chars().all(|c| c.is_ascii_alphanumeric() || matches!(c, '.' | '-' | ':'));
+    valid.then_some(host)
+}
+
+/// Load the gate host mapping, falling back to the default host when the file is missing
+pub fn load_gate_hosts(dir: &ConfigDir) -> AppResult<GateHosts> {
+    let path = dir.join(GATES_FILE)?;
+    if !path.exists() {
+        return Ok(GateHosts::default());
+    }
+
+    let data = fs::read_to_string(&path)?;
+    Ok(serde_json::from_str(&data).unwrap_or_default())
+}
+
+/// Save the gate host mapping
+pub fn save_gate_hosts(dir: &ConfigDir, hosts: &GateHosts) -> AppResult<()> {
+    let data = serde_json::to_string_pretty(hosts)?;
+    write_file_atomic(&dir.join(GATES_FILE)?, data.as_bytes())
+}
+
+/// Gate host for a unit, read from config
+pub fn gate_host_for(dir: &ConfigDir, unit_id: &str) -> String {
+    load_gate_hosts(dir).unwrap_or_default().host_for(unit_id)
+}
+
+/// Remember which gate host answered for a unit
+pub fn record_gate_host(dir: &ConfigDir, unit_id: &str, host: &str) -> AppResult<()> {
+    let mut hosts = load_gate_hosts(dir)?;
+    hosts.units.insert(unit_id.trim().to_string(), host.to_string());
+    save_gate_hosts(dir, &hosts)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_host_for() {
+        let mut hosts = GateHosts::default();
+        hosts.units.insert("1040".into(), "https://gate-sz.91160.com/".into());
+        hosts.units.insert("1041".into(), "bad host/path".into());
+
+        assert_eq!(hosts.host_for("1040"), "gate-sz.91160.com");
+        assert_eq!(hosts.host_for(" 1040 "), "gate-sz.91160.com");
+        assert_eq!(hosts.host_for("1041"), DEFAULT_GATE_HOST);
+        assert_eq!(hosts.host_for("9999"), DEFAULT_GATE_HOST);
+
+        hosts.default = String::new();
+        assert_eq!(hosts.host_for("9999"), DEFAULT_GATE_HOST);
+    }
+
+    #[test]
+    fn test_probe_candidates() {
+        let hosts = GateHosts {
+            alternates: vec!["gate-sz.91160.com".into(), "GATE-SZ.91160.com".into(), "".into()],
+            units: HashMap::from([("1040".to_string(), "gate-sz.91160.com".to_string())]),
+            ..Default::default()
+        };
+
+        // A unit on the default tries the alternates once each
+        assert_eq!(hosts.probe_candidates("9999"), vec!["gate-sz.91160.com"]);
+        // A mapped unit can fall back to the default
+        assert_eq!(hosts.probe_candidates("1040"), vec![DEFAULT_GATE_HOST]);
+    }
+
+    #[test]
+    fn test_gate_hosts_file_defaults() {
+        let hosts: GateHosts = serde_json::from_str(r#"{"units":{"1040":"gate-sz.91160.com"}}"#).unwrap();
+        assert_eq!(hosts.default, DEFAULT_GATE_HOST);
+        assert!(hosts.alternates.is_empty());
+    }
+}
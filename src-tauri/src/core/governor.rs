@@ -0,0 +1,174 @@
+//! Adaptive retry interval for SkylineMed
+//! Watches the last requests for throttled answers (HTTP 429 or "too fast" submits) and widens
+//! the schedule retry interval while they pile up, narrowing it again after a clean stretch.
+
+use std::collections::VecDeque;
+
+use serde::{Deserialize, Serialize};
+
+/// Requests the throttle ratio is measured over
+pub const GOVERNOR_WINDOW: usize = 20;
+/// Share of throttled requests in a full window that widens the interval
+const RAISE_RATIO: f64 = 0.25;
+/// Factor applied per raise, undone per lowering
+const STEP_FACTOR: f64 = 1.5;
+/// Largest widening of the configured interval
+const MAX_FACTOR: f64 = 4.0;
+
+/// Governor state shown in the grab status
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct GovernorStatus {
+    /// Retry interval the run was configured with, in seconds; 0 before the first run
+    pub base_interval: f64,
+    /// Retry interval currently waited between attempts
+    pub effective_interval: f64,
+    pub factor: f64,
+    /// Throttled requests among the last `window`
+    pub throttled: usize,
+    pub window: usize,
+}
+
+/// A change of the effective interval, reported to the user
+#[derive(Debug, Clone, Copy, PartialEq)]
+pub enum GovernorChange {
+    /// Widened after `throttled` of the last GOVERNOR_WINDOW requests were throttled
+    Raised { throttled: usize },
+    Lowered,
+}
+
+/// Sliding window of request outcomes driving the retry interval factor
+#[derive(Debug, Clone)]
+pub struct RetryGovernor {
+    outcomes: VecDeque<bool>,
+    factor: f64,
+    base_interval: f64,
+    /// Change not yet picked up by the grabber
+    pending: Option<GovernorChange>,
+}
+
+impl Default for RetryGovernor {
+    fn default() -> Self {
+        Self {
+            outcomes: VecDeque::with_capacity(GOVERNOR_WINDOW),
+            factor: 1.0,
+            base_interval: 0.0,
+            pending: None,
+        }
+    }
+}
+
+impl RetryGovernor {
+    /// Start a run from the configured interval; the factor learned so far is kept
+    pub fn set_base_interval(&mut self, seconds: f64) {
+        self.base_interval = seconds;
+    }
+
+    /// Record one answered request
+    pub fn observe(&mut self, throttled: bool) {
+        if self.outcomes.len() == GOVERNOR_WINDOW {
+            self.outcomes.pop_front();
+        }
+        self.outcomes.push_back(throttled);
+        self.adjust();
+    }
+
+    /// Re-mark the last request as throttled, for answers that only say so in their body
+    pub fn mark_last_throttled(&mut self) {
+        match self.outcomes.back_mut() {
+            Some(last) => *last = true,
+            None => self.outcomes.push_back(true),
+        }
+        self.adjust();
+    }
+
+    /// Take the change since the last call, if any
+    pub fn take_change(&mut self) -> Option<GovernorChange> {
+        self.pending.take()
+    }
+
+    /// Interval to wait for a base interval in seconds
+    pub fn effective_interval(&self, base: f64) -> f64 {
+        base * self.factor
+    }
+
+    pub fn status(&self) -> GovernorStatus {
+        GovernorStatus {
+            base_interval: self.base_interval,
+            effective_interval: self.effective_interval(self.base_interval),
+            factor: self.factor,
+            throttled: self.throttled(),
+            window: self.outcomes.len(),
+        }
+    }
+
+    fn throttled(&self) -> usize {
+        self.outcomes.iter().filter(|t| **t).count()
+    }
+
+    /// Judged on full windows only; the window restarts after each change so one burst counts once
+    fn adjust(&mut self) {
+        if self.outcomes.len() < GOVERNOR_WINDOW {
+            return;
+        }
+        let throttled = self.throttled();
+        let ratio = throttled as f64 / self.outcomes.len() as f64;
+        if ratio > RAISE_RATIO && self.factor < MAX_FACTOR {
+            self.factor = (self.factor * STEP_FACTOR).min(MAX_FACTOR);
+            self.pending = Some(GovernorChange::Raised { throttled });
+            self.outcomes.clear();
+        } else if ratio == 0.0 && self.factor > 1.0 {
+            self.factor = (self.factor / STEP_FACTOR).max(1.0);
+            self.pending = Some(GovernorChange::Lowered);
+            self.outcomes.clear();
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_governor_raises_and_recovers() {
+        let mut governor = RetryGovernor::default();
+        governor.set_base_interval(0.5);
+
+        // 4 of 20 throttled stays at the configured interval
+        for i in 0..GOVERNOR_WINDOW {
+            governor.observe(i % 5 == 0);
+        }
+        assert_eq!(governor.take_change(), None);
+        assert_eq!(governor.status().effective_interval, 0.5);
+
+        // A window of 429s widens the interval and starts a new window
+        let mut governor = RetryGovernor::default();
+        governor.set_base_interval(0.5);
+        for _ in 0..GOVERNOR_WINDOW {
+            governor.observe(true);
+        }
+        assert_eq!(governor.take_change(), Some(GovernorChange::Raised { throttled: GOVERNOR_WINDOW }));
+        assert_eq!(governor.status().effective_interval, 0.75);
+        assert_eq!(governor.status().window, 0);
+
+        // A throttled submit answered 200 is re-marked
+        governor.observe(false);
+        governor.mark_last_throttled();
+        assert_eq!(governor.status().throttled, 1);
+
+        // Clean windows step back down to the configured interval and no further
+        for _ in 0..GOVERNOR_WINDOW * 3 {
+            governor.observe(false);
+        }
+        assert_eq!(governor.take_change(), Some(GovernorChange::Lowered));
+        assert_eq!(governor.status().factor, 1.0);
+    }
+
+    #[test]
+    fn test_governor_factor_is_capped() {
+        let mut governor = RetryGovernor::default();
+        for _ in 0..GOVERNOR_WINDOW * 10 {
+            governor.observe(true);
+        }
+        assert_eq!(governor.status().factor, MAX_FACTOR);
+    }
+}
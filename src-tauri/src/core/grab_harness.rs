@@ -0,0 +1,420 @@
+//! End-to-end harness for the grab engine
+//! Runs the real Grabber and HealthClient against a scripted 91160: every request is answered by a
+//! chaos scenario from testdata/grab_e2e, whose rules act as per-path state machines (a rule with
+//! "times" answers that many requests, then the next rule for the path takes over) and serve
+//! recorded pages from testdata. A final catch-all rule answers anything unscripted, so nothing
+//! reaches the network. Tokio's clock is paused, so throttle and backoff waits cost no real time.
+
+use std::path::PathBuf;
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::Arc;
+use std::time::Instant;
+
+use tokio_util::sync::CancellationToken;
+
+use super::chaos::FaultInjector;
+use super::client::HealthClient;
+use super::grabber::{Clock, Grabber};
+use super::messages::LogMessage;
+use super::paths::ConfigDir;
+use super::types::{CookieRecord, GrabConfig, GrabResult, GrabStats};
+
+/// Phase timing on tokio's clock, which the harness pauses and advances
+struct TokioClock;
+
+impl Clock for TokioClock {
+    fn now(&self) -> Instant {
+        tokio::time::Instant::now().into_std()
+    }
+}
+
+/// A fresh config dir for one client, so a run's pacing, insights, counters and last submit time
+/// stay out of the tree and out of every other test
+fn scratch_config_dir() -> ConfigDir {
+    static NEXT: AtomicUsize = AtomicUsize::new(0);
+    let dir = std::env::temp_dir()
+        .join(format!("skylinemed_grab_harness_{}", std::process::id()))
+        .join(NEXT.fetch_add(1, Ordering::SeqCst).to_string());
+    let _ = std::fs::remove_dir_all(&dir);
+    ConfigDir::at(dir)
+}
+
+/// What a scripted run produced
+struct ScriptedRun {
+    result: GrabResult,
+    stats: GrabStats,
+    /// Raw log lines ("key name=value"); debug lines only show up around errors
+    logs: Vec<String>,
+    /// Requests each scenario rule answered, in rule order
+    hits: Vec<u32>,
+    /// Request URLs in arrival order
+    requests: Vec<String>,
+}
+
+impl ScriptedRun {
+    /// Dates of the schedule queries, in the order they reached the server
+    fn schedule_query_dates(&self) -> Vec<String> {
+        self.requests
+            .iter()
+            .filter(|url| url.contains("/guahao/v1/pc/sch/dep"))
+            .filter_map(|url| url.split("date=").nth(1))
+            .map(|rest| rest.split('&').next().unwrap_or_default().to_string())
+            .collect()
+    }
+
+    fn logged(&self, key: &str) -> Vec<&str> {
+        self.logs
+            .iter()
+            .map(String::as_str)
+            .filter(|line| line.split(' ').next() == Some(key))
+            .collect()
+    }
+}
+
+/// Run a logged-in grabber with config against testdata/grab_e2e/<scenario>.json
+async fn run_scripted(scenario: &str, config: serde_json::Value) -> ScriptedRun {
+    run_scripted_stopping(scenario, config, None).await
+}
+
+/// Like run_scripted, pressing stop as soon as a request whose URL contains stop_on reaches the
+/// server, while that request is still waiting for its answer
+async fn run_scripted_stopping(scenario: &str, config: serde_json::Value, stop_on: Option<&'static str>) -> ScriptedRun {
+    run_scripted_with(scenario, config, stop_on, |client| client).await
+}
+
+/// A logged-in client answered by testdata/grab_e2e/<scenario>.json, with setup applied
+async fn scripted_client(scenario: &str, setup: impl FnOnce(HealthClient) -> HealthClient) -> (Arc<FaultInjector>, HealthClient) {
+    let path = PathBuf::from(env!("CARGO_MANIFEST_DIR")).join("testdata").join("grab_e2e").join(format!("{}.json", scenario));
+    let injector = Arc::new(FaultInjector::load(&path).unwrap());
+    let client = setup(HealthClient::new_in(scratch_config_dir()).unwrap().with_fault_injector(injector.clone()));
+    client
+        .set_cookie_records(vec![CookieRecord {
+            name: "access_hash".into(),
+            value: "harness-key-000000".into(),
+            domain: ".91160.com".into(),
+            path: "/".into(),
+            ..Default::default()
+        }])
+        .await;
+    (injector, client)
+}
+
+/// Like run_scripted_stopping, with setup applied to the client before the run
+async fn run_scripted_with(
+    scenario: &str,
+    config: serde_json::Value,
+    stop_on: Option<&'static str>,
+    setup: impl FnOnce(HealthClient) -> HealthClient,
+) -> ScriptedRun {
+    let (injector, client) = scripted_client(scenario, setup).await;
+    let grabber = Grabber::new(Arc::new(client)).with_clock(Arc::new(TokioClock));
+    let config: GrabConfig = serde_json::from_value(config).unwrap();
+    let cancel_token = CancellationToken::new();
+    let stopper = stop_on.map(|path| {
+        let (injector, cancel_token) = (injector.clone(), cancel_token.clone());
+        tokio::spawn(async move {
+            while !injector.requests().iter().any(|url| url.contains(path)) {
+                tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+            }
+            cancel_token.cancel();
+        })
+    });
+    let mut logs = Vec::new();
+    let result = grabber
+        .run(config, cancel_token, |_: &str, message: &LogMessage| logs.push(message.raw()))
+        .await;
+    if let Some(stopper) = stopper {
+        stopper.abort();
+    }
+    ScriptedRun {
+        result,
+        stats: grabber.stats().await,
+        logs,
+        hits: injector.rule_hits(),
+        requests: injector.requests(),
+    }
+}
+
+/// Two cycles without a schedule, a slot on the third, "操作频繁" on its submit, booked on the next cycle
+#[tokio::test(start_paused = true)]
+async fn test_books_after_empty_cycles_and_too_fast_submit() {
+    let started = tokio::time::Instant::now();
+    let run = run_scripted(
+        "slot_after_two_cycles",
+        serde_json::json!({
+            "unit_id": "200001", "unit_name": "市人民医院", "dep_id": "300001", "dep_name": "心内科",
+            "member_id": "1001", "target_dates": ["2026-10-20"],
+            "retry_interval": 0.5, "submit_interval": 8.0,
+            "use_proxy_submit": false, "persist_rotated_cookies": false
+        }),
+    )
+    .await;
+    let elapsed = started.elapsed();
+
+    // Result
+    assert!(run.result.success, "{}: {:#?}", run.result.message, run.logs);
+    assert_eq!(run.result.message, "success");
+    let booked = run.result.detail.as_ref().unwrap();
+    assert_eq!(
+        (booked.kind.as_str(), booked.unit_name.as_str(), booked.dep_name.as_str(), booked.doctor_name.as_str()),
+        ("booked", "市人民医院", "心内科", "张医生")
+    );
+    assert_eq!((booked.date.as_str(), booked.time_slot.as_str()), ("2026-10-20", "08:00-08:30"));
+    assert_eq!((booked.doctor_id.as_str(), booked.member_id.as_str()), ("900001", "1001"));
+    assert_eq!(booked.order_no.as_deref(), Some("88001234"));
+    assert_eq!(booked.url.as_deref(), Some("https://www.91160.com/guahao/success.html?order_id=88001234&unit_id=200001"));
+    assert!(!booked.payment_required);
+
+    // Stats: four cycles, the last two saw the slot and submitted
+    assert_eq!(run.stats.attempts, 4);
+    assert_eq!(run.stats.timeouts, 0);
+    let day = &run.stats.dates["2026-10-20"];
+    assert_eq!((day.queries, day.bookable_answers, day.submits), (2, 2, 2));
+    assert_eq!(run.stats.phases["submit"].count, 2);
+    assert_eq!(run.stats.phases["throttle"].count, 2);
+    // Both submits were timed from their schedule answer: the too-fast one failed, the next one booked
+    let survival = &run.stats.slot_survival;
+    assert_eq!((survival.successes, survival.failures), (1, 1));
+    // Phase timing runs on the paused clock: the throttled submit shows its virtual wait
+    assert!(run.stats.phases["throttle"].max_ms >= 1000, "{:?}", run.stats.phases["throttle"]);
+
+    // Scripted paths: empty schedule x2, schedule x2, ticket page x2, member page once (then cached),
+    // the too-fast submit, the successful submit, nothing unscripted
+    assert_eq!(run.hits, vec![2, 2, 2, 1, 1, 1, 0]);
+
+    // The too-fast answer backed off, and the second submit still waited out submit_interval
+    assert_eq!(run.logged("submit.throttled").len(), 1);
+    assert_eq!(run.logged("throttle.wait").len(), 1);
+    assert!(elapsed >= std::time::Duration::from_secs(8), "{:?}", elapsed);
+
+    // use_proxy_submit=false never touches the proxy pool
+    assert!(run.logged("proxy.using").is_empty() && run.logged("proxy.failed").is_empty());
+    assert_eq!(run.logged("submit.success").len(), 1);
+}
+
+/// Three target dates whose schedules answer slowly: queried one at a time the cycle waits for
+/// every answer in turn, fanned out it waits for the slowest, and either way the answers are
+/// walked in the configured date order
+#[tokio::test(start_paused = true)]
+async fn test_concurrent_schedule_queries_keep_date_order() {
+    let dates = ["2026-10-20", "2026-10-21", "2026-10-22"];
+    let config = |concurrency: u32| {
+        serde_json::json!({
+            "unit_id": "200001", "dep_id": "300001", "member_id": "1001",
+            "target_dates": dates, "max_retries": 1, "schedule_query_concurrency": concurrency,
+            "use_proxy_submit": false, "persist_rotated_cookies": false
+        })
+    };
+    let empty_logs = |run: &ScriptedRun| -> Vec<String> { run.logged("schedule.empty").iter().map(|line| line.to_string()).collect() };
+    let expected_empty: Vec<String> = dates.iter().map(|date| format!("schedule.empty date={}", date)).collect();
+
+    // One at a time: requests arrive in date order and the latencies add up (600 + 300 + 100 ms)
+    let started = tokio::time::Instant::now();
+    let serial = run_scripted("multi_date_concurrent", config(1)).await;
+    let serial_elapsed = started.elapsed();
+    assert!(!serial.result.success);
+    assert_eq!(serial.schedule_query_dates(), dates);
+    assert_eq!(empty_logs(&serial), expected_empty);
+    assert!(serial_elapsed >= std::time::Duration::from_millis(1000), "{:?}", serial_elapsed);
+
+    // Fanned out: every date is queried, the slowest answer bounds the cycle, results keep date order
+    let started = tokio::time::Instant::now();
+    let concurrent = run_scripted("multi_date_concurrent", config(3)).await;
+    let concurrent_elapsed = started.elapsed();
+    assert!(!concurrent.result.success);
+    let mut queried = concurrent.schedule_query_dates();
+    queried.sort();
+    assert_eq!(queried, dates);
+    assert_eq!(empty_logs(&concurrent), expected_empty);
+    assert!(concurrent_elapsed < std::time::Duration::from_millis(900), "{:?}", concurrent_elapsed);
+    assert_eq!(concurrent.hits[..3], [1, 1, 1]);
+}
+
+/// A submit answered after 45s, well past the 10s attempt timeout: the POST is awaited and the
+/// booking reported instead of being dropped as a timed-out attempt
+#[tokio::test(start_paused = true)]
+async fn test_slow_submit_outlives_attempt_timeout() {
+    let started = tokio::time::Instant::now();
+    let run = run_scripted(
+        "slow_submit",
+        serde_json::json!({
+            "unit_id": "200001", "dep_id": "300001", "member_id": "1001", "target_dates": ["2026-10-20"],
+            "attempt_timeout_seconds": 10.0, "use_proxy_submit": false, "persist_rotated_cookies": false
+        }),
+    )
+    .await;
+
+    assert!(run.result.success, "{}: {:#?}", run.result.message, run.logs);
+    assert_eq!(run.result.detail.as_ref().unwrap().order_no.as_deref(), Some("88001234"));
+    assert_eq!((run.stats.attempts, run.stats.timeouts), (1, 0));
+    assert!(run.logged("attempt.timeout").is_empty());
+    assert!(started.elapsed() >= std::time::Duration::from_secs(45), "{:?}", started.elapsed());
+    assert_eq!(run.hits, vec![1, 1, 1, 1, 0]);
+}
+
+/// Stop pressed while the ticket detail is loading: the run ends before anything is submitted
+#[tokio::test(start_paused = true)]
+async fn test_stop_during_detail_sends_no_submit() {
+    let run = run_scripted_stopping(
+        "slow_detail",
+        serde_json::json!({
+            "unit_id": "200001", "dep_id": "300001", "member_id": "1001", "target_dates": ["2026-10-20"],
+            "use_proxy_submit": false, "persist_rotated_cookies": false
+        }),
+        Some("/guahao/ystep1/"),
+    )
+    .await;
+
+    assert!(!run.result.success);
+    assert_eq!(run.result.message, "stopped");
+    assert!(!run.requests.iter().any(|url| url.contains("/guahao/ysubmit.html")), "{:#?}", run.requests);
+    assert_eq!(run.stats.phases.get("submit").map_or(0, |t| t.count), 0);
+    assert_eq!(run.logged("submit.cancelled"), vec!["submit.cancelled phase=detail"]);
+}
+
+/// Stop pressed while the submit POST is in flight: its answer is still awaited and the booking
+/// it made is reported
+#[tokio::test(start_paused = true)]
+async fn test_stop_during_submit_reports_booking() {
+    let run = run_scripted_stopping(
+        "slow_submit",
+        serde_json::json!({
+            "unit_id": "200001", "dep_id": "300001", "member_id": "1001", "target_dates": ["2026-10-20"],
+            "use_proxy_submit": false, "persist_rotated_cookies": false
+        }),
+        Some("/guahao/ysubmit.html"),
+    )
+    .await;
+
+    assert!(run.result.success, "{}: {:#?}", run.result.message, run.logs);
+    assert_eq!(run.result.detail.as_ref().unwrap().order_no.as_deref(), Some("88001234"));
+    assert_eq!(run.logged("submit.completed_after_stop").len(), 1);
+    assert_eq!(run.logged("submit.success").len(), 1);
+    assert_eq!(run.hits, vec![1, 1, 1, 1, 0]);
+}
+
+/// Stop pressed as a waitlist attempt starts: nothing is sent and the stop is logged against the
+/// waitlist phase
+#[tokio::test(start_paused = true)]
+async fn test_stop_before_waitlist_submit_sends_nothing() {
+    let (injector, client) = scripted_client("waitlist_only", |client| client).await;
+    let grabber = Grabber::new(Arc::new(client)).with_clock(Arc::new(TokioClock));
+    let config: GrabConfig = serde_json::from_value(serde_json::json!({
+        "unit_id": "200001", "dep_id": "300001", "member_id": "1001", "target_dates": ["2026-10-20"],
+        "allow_waitlist": true, "use_proxy_submit": false, "persist_rotated_cookies": false
+    }))
+    .unwrap();
+    let cancel_token = CancellationToken::new();
+    let stop = cancel_token.clone();
+    let mut logs = Vec::new();
+    let result = grabber
+        .run(config, cancel_token, |_: &str, message: &LogMessage| {
+            let line = message.raw();
+            if line.starts_with("waitlist.trying ") {
+                stop.cancel();
+            }
+            logs.push(line);
+        })
+        .await;
+
+    assert!(!result.success);
+    assert_eq!(result.message, "stopped");
+    let cancelled: Vec<&String> = logs.iter().filter(|line| line.starts_with("submit.cancelled ")).collect();
+    assert_eq!(cancelled, vec!["submit.cancelled phase=waitlist"]);
+    // Only the schedule query reached the server
+    assert_eq!(injector.rule_hits(), vec![1, 0]);
+}
+
+/// Client spans of an attempt are children of its grab.try_grab_once span, in the same trace
+#[tokio::test(start_paused = true)]
+async fn test_client_spans_nest_under_attempt_span() {
+    use opentelemetry::trace::SpanId;
+    use opentelemetry_sdk::testing::trace::InMemorySpanExporter;
+    use opentelemetry_sdk::trace::TracerProvider;
+
+    use super::telemetry::{SPAN_GET_SCHEDULE, SPAN_GET_TICKET_DETAIL, SPAN_SUBMIT_ORDER, SPAN_TRY_GRAB_ONCE};
+
+    let exporter = InMemorySpanExporter::default();
+    let provider = TracerProvider::builder().with_simple_exporter(exporter.clone()).build();
+    let run = run_scripted_with(
+        "slow_submit",
+        serde_json::json!({
+            "unit_id": "200001", "dep_id": "300001", "member_id": "1001", "target_dates": ["2026-10-20"],
+            "use_proxy_submit": false, "persist_rotated_cookies": false
+        }),
+        None,
+        |client| client.with_tracer(&provider),
+    )
+    .await;
+    assert!(run.result.success, "{}: {:#?}", run.result.message, run.logs);
+
+    let spans = exporter.get_finished_spans().unwrap();
+    let attempt = spans.iter().find(|span| span.name == SPAN_TRY_GRAB_ONCE).expect("attempt span");
+    assert_eq!(attempt.parent_span_id, SpanId::INVALID);
+    for name in [SPAN_GET_SCHEDULE, SPAN_GET_TICKET_DETAIL, SPAN_SUBMIT_ORDER] {
+        let child = spans.iter().find(|span| span.name == name).unwrap_or_else(|| panic!("no {} span", name));
+        assert_eq!(child.parent_span_id, attempt.span_context.span_id(), "{}", name);
+        assert_eq!(child.span_context.trace_id(), attempt.span_context.trace_id(), "{}", name);
+    }
+}
+
+/// A member_id the account does not have is looked up once per run, not once per slot
+#[tokio::test(start_paused = true)]
+async fn test_missing_member_is_looked_up_once() {
+    let run = run_scripted(
+        "slot_after_two_cycles",
+        serde_json::json!({
+            "unit_id": "200001", "dep_id": "300001", "member_id": "9999", "target_dates": ["2026-10-20"],
+            "retry_interval": 0.5, "use_proxy_submit": false, "persist_rotated_cookies": false
+        }),
+    )
+    .await;
+
+    assert!(run.result.success, "{}: {:#?}", run.result.message, run.logs);
+    // Both slots warned about the member, but only the first one fetched the member page
+    assert_eq!(run.logged("member.not_found").len(), 2);
+    assert_eq!(run.hits[3], 1);
+}
+
+/// Two grabbers running at once on one shared client: each walks only its own dates and reports
+/// only its own answers, and the client sends each query exactly once
+#[tokio::test(start_paused = true)]
+async fn test_two_grabbers_share_one_client() {
+    let (injector, client) = scripted_client("multi_date_concurrent", |client| client).await;
+    let client = Arc::new(client);
+    let config = |dates: &[&str]| -> GrabConfig {
+        serde_json::from_value(serde_json::json!({
+            "unit_id": "200001", "dep_id": "300001", "member_id": "1001",
+            "target_dates": dates, "max_retries": 1, "schedule_query_concurrency": 2,
+            "use_proxy_submit": false, "persist_rotated_cookies": false
+        }))
+        .unwrap()
+    };
+    let run = |dates: &'static [&'static str]| {
+        let grabber = Grabber::new(client.clone()).with_clock(Arc::new(TokioClock));
+        async move {
+            let mut logs = Vec::new();
+            let result = grabber
+                .run(config(dates), CancellationToken::new(), |_: &str, message: &LogMessage| logs.push(message.raw()))
+                .await;
+            (result, grabber.stats().await, logs)
+        }
+    };
+
+    let ((first, first_stats, first_logs), (second, second_stats, second_logs)) =
+        tokio::join!(run(&["2026-10-20"]), run(&["2026-10-21", "2026-10-22"]));
+
+    assert!(!first.success && !second.success);
+    let empty = |logs: &[String]| -> Vec<String> { logs.iter().filter(|line| line.starts_with("schedule.empty ")).cloned().collect() };
+    assert_eq!(empty(&first_logs), vec!["schedule.empty date=2026-10-20"]);
+    assert_eq!(empty(&second_logs), vec!["schedule.empty date=2026-10-21", "schedule.empty date=2026-10-22"]);
+    let dates = |stats: &GrabStats| -> Vec<String> {
+        let mut dates: Vec<String> = stats.dates.keys().cloned().collect();
+        dates.sort();
+        dates
+    };
+    assert_eq!(dates(&first_stats), vec!["2026-10-20"]);
+    assert_eq!(dates(&second_stats), vec!["2026-10-21", "2026-10-22"]);
+    // Every date reached the server once, nothing went unscripted
+    assert_eq!(injector.rule_hits(), vec![1, 1, 1, 0]);
+}
@@ -1,40 +1,420 @@
 //! Grabber engine for QuickDoctor
 //! Corresponds to core/grabber.go - appointment grabbing logic
 
-use std::collections::HashSet;
+use std::collections::{HashMap, HashSet};
+use std::sync::atomic::{AtomicBool, AtomicU32, Ordering};
 use std::sync::Arc;
-use std::time::Duration;
+use std::time::{Duration, Instant};
 
-use chrono::Local;
-use rand::Rng;
+use chrono::{DateTime, Duration as ChronoDuration, Local, Offset};
+use opentelemetry::trace::{FutureExt as _, Span, Status, TraceContextExt, Tracer};
+use opentelemetry::{Context, KeyValue};
+use futures::stream::{self, StreamExt};
 use tokio::sync::RwLock;
 use tokio_util::sync::CancellationToken;
 
-use super::client::HealthClient;
+use super::areas::cached_area_label;
+use super::backoff::BackoffPolicy;
+use super::booking_rules::{parse_booking_rules, BookingRules};
+use super::captcha::{CaptchaSolver, NoopCaptchaSolver};
+use super::client::{new_submit_nonce, parse_order_no, HealthClient, SUBMIT_EXTRA_FIELD_PREFIX, SUBMIT_NONCE_FIELD};
 use super::errors::{AppError, AppResult};
+use super::history::{append_history_in, HistoryEntry, HISTORY_KIND_QUOTA_EXCEEDED, HISTORY_KIND_WAITLISTED};
+use super::insights::{record_availability_change, AvailabilityChange};
+use super::logfile::{with_flight_recorder, LEVEL_DEBUG};
+use super::messages::LogMessage;
+use super::netclass::NetErrorKind;
+use super::notifier::{EventPublisher, NotifyEvent};
+use super::governor::{GovernorChange, GOVERNOR_WINDOW};
+use super::pacing::{load_pacing_profile_in, record_throttle_observed, PacingProfile};
+use super::paths::ConfigDir;
+use super::prefetch::{run_prefetch, summarize_prefetch, PREFETCH_WINDOW_END};
 use super::proxy::ProxyPool;
-use super::types::{GrabConfig, GrabResult, GrabSuccess, TicketDetail, TimeSlot};
+use super::state::{load_account_verified, load_last_submit_at, save_account_verified, save_last_submit_at};
+use super::submit_counts::{record_submit, submits_today_in};
+use super::telemetry::{ATTR_ATTEMPT, SPAN_TRY_GRAB_ONCE};
+use super::types::{
+    Announcement, CaptchaChallenge, CaptchaSolution, DepartmentDoctor, DoctorSchedule, GrabConfig, ScheduleResult, GRAB_SUCCESS_BOOKED, GRAB_SUCCESS_WAITLISTED, GrabResult, GrabStats, GrabSuccess, Member, PreferSequence, ScheduleSlot, UnsupportedFlow,
+    SubmitOrderResult, TicketDetail, TimeSlot, DiseaseRequirement, china_offset, MAX_SCHEDULE_QUERY_CONCURRENCY, MIN_RETRY_INTERVAL_SECS, START_TIME_ZONE_CHINA, START_TIME_ZONE_LOCAL,
+};
+
+const DATE_QUERY_JITTER: BackoffPolicy = BackoffPolicy::jittered(Duration::ZERO, Duration::from_millis(40));
+const DEFAULT_RETRY_INTERVAL_SECS: f64 = 0.5;
 
-const DATE_QUERY_JITTER_MAX_MS: u64 = 40;
 const SUBMIT_MIN_INTERVAL_MS: u64 = 1800;
-const SUBMIT_BACKOFF_MIN_MS: u64 = 2500;
-const SUBMIT_BACKOFF_MAX_MS: u64 = 4200;
+/// Pause after a "too fast" submit answer, before the pacing multiplier
+const SUBMIT_BACKOFF: BackoffPolicy = BackoffPolicy::jittered(Duration::from_millis(2500), Duration::from_millis(4200));
+/// "Too fast" submit answers in a row before the client switches to its next profile
+const THROTTLE_STREAK_ROTATE: u32 = 3;
+const SUBMIT_RESTORE_WINDOW_MS: i64 = 5000;
+const DEFAULT_ATTEMPT_TIMEOUT_SECS: f64 = 30.0;
+const MAX_LOGGED_ANNOUNCEMENTS: usize = 5;
+const PAUSE_POLL_INTERVAL_MS: u64 = 200;
+/// Wait between checks while every target date is beyond the booking window
+const WINDOW_IDLE_INTERVAL: Duration = Duration::from_secs(60);
+/// Single-doctor refreshes allowed per doctor after a submit lost the slot
+const MAX_DOCTOR_SLOT_REFRESHES: u32 = 2;
+/// Log the phase timing summary every this many attempts
+const PHASE_SUMMARY_EVERY: i32 = 20;
+/// Phases in the timing summary, with their short labels
+const PHASE_SUMMARY_LABELS: [(&str, &str); 4] = [
+    (PHASE_SCHEDULE, "sched"),
+    (PHASE_DETAIL, "detail"),
+    (PHASE_THROTTLE, "throttle"),
+    (PHASE_SUBMIT, "submit"),
+];
+
+/// Time source for phase timing; replaced in tests
+pub trait Clock: Send + Sync {
+    fn now(&self) -> Instant;
+}
+
+/// Clock backed by Instant::now
+pub struct SystemClock;
+
+impl Clock for SystemClock {
+    fn now(&self) -> Instant {
+        Instant::now()
+    }
+}
+
+/// Grab phases tracked for timing and timeout reporting
+const PHASE_SCHEDULE: &str = "schedule";
+const PHASE_REFRESH: &str = "refresh";
+const PHASE_DETAIL: &str = "detail";
+const PHASE_MEMBER: &str = "member";
+const PHASE_THROTTLE: &str = "throttle";
+const PHASE_PROXY: &str = "proxy";
+const PHASE_RECHECK: &str = "recheck";
+const PHASE_SUBMIT: &str = "submit";
+const PHASE_CAPTCHA: &str = "captcha";
+const PHASE_WAITLIST: &str = "waitlist";
+
+/// Request pacing resolved for one run
+#[derive(Debug, Clone, Copy, PartialEq)]
+struct Pacing {
+    retry_interval: f64,
+    submit_interval: Duration,
+    backoff_multiplier: f64,
+}
+
+impl Default for Pacing {
+    fn default() -> Self {
+        Self {
+            retry_interval: DEFAULT_RETRY_INTERVAL_SECS,
+            submit_interval: Duration::from_millis(SUBMIT_MIN_INTERVAL_MS),
+            backoff_multiplier: 1.0,
+        }
+    }
+}
+
+/// Full slot that offers a waitlist, kept until the cycle's real slots are exhausted
+struct WaitlistCandidate {
+    date: String,
+    doctor_id: String,
+    doctor_name: String,
+    slot: ScheduleSlot,
+}
+
+/// A schedule answer with its round trip and when it arrived
+struct ScheduleAnswer {
+    result: AppResult<ScheduleResult>,
+    round_trip_ms: u64,
+    received_at: Instant,
+}
+
+/// Ticket detail outcomes of one cycle, to tell a department-wide flow change from one odd schedule
+#[derive(Default)]
+struct DetailTally {
+    fetched: u32,
+    unsupported: u32,
+    last_unsupported: Option<(String, String)>,
+}
+
+impl DetailTally {
+    /// (flow, url) when every detail fetch of the cycle hit an unsupported flow
+    fn all_unsupported(&self) -> Option<(String, String)> {
+        if self.fetched > 0 && self.unsupported == self.fetched {
+            self.last_unsupported.clone()
+        } else {
+            None
+        }
+    }
+}
+
+/// Bookings the site will refuse for the rest of the run
+/// 91160 allows one booking per member and doctor within seven days, and one per member, department and date
+#[derive(Default)]
+struct BookingExclusions {
+    /// (member, doctor)
+    doctors: HashSet<(String, String)>,
+    /// (member, dep, date)
+    dates: HashSet<(String, String, String)>,
+}
+
+impl BookingExclusions {
+    /// Whether a booking of this doctor on this date would be refused
+    fn excludes(&self, member_id: &str, dep_id: &str, doctor_id: &str, date: &str) -> bool {
+        self.doctors.contains(&(member_id.to_string(), doctor_id.to_string()))
+            || self.dates.contains(&(member_id.to_string(), dep_id.to_string(), date.to_string()))
+    }
+
+    /// Exclude a doctor for a member; returns false if already excluded
+    fn exclude_doctor(&mut self, member_id: &str, doctor_id: &str) -> bool {
+        self.doctors.insert((member_id.to_string(), doctor_id.to_string()))
+    }
+
+    /// Remember a booking so later tickets of the run skip what the site would refuse
+    fn record_booking(&mut self, member_id: &str, dep_id: &str, doctor_id: &str, date: &str) {
+        self.exclude_doctor(member_id, doctor_id);
+        self.dates.insert((member_id.to_string(), dep_id.to_string(), date.to_string()));
+    }
+}
 
 /// Appointment grabber
 pub struct Grabber {
     client: Arc<HealthClient>,
     proxy_pool: Arc<ProxyPool>,
     last_submit_at: RwLock<Option<std::time::Instant>>,
+    /// Background write of the last submit time, checked for failure by the next submit
+    last_submit_save: std::sync::Mutex<Option<tokio::task::JoinHandle<AppResult<()>>>>,
+    current_phase: RwLock<&'static str>,
+    /// Deadline of the pre-submit phases of the current attempt, with the configured seconds
+    attempt_deadline: RwLock<Option<(tokio::time::Instant, f64)>>,
+    stats: RwLock<GrabStats>,
+    paused: Arc<AtomicBool>,
+    target_dates: Arc<RwLock<Vec<String>>>,
+    captcha_solver: Arc<dyn CaptchaSolver>,
+    /// Receives events worth a notification; none by default
+    events: Option<EventPublisher>,
+    pacing: RwLock<Pacing>,
+    /// Submit nonce per schedule/slot/member, reused when the same slot is resubmitted
+    submit_nonces: RwLock<HashMap<String, String>>,
+    exclusions: RwLock<BookingExclusions>,
+    /// The run's member as the member page answered it, None until the first answer
+    /// A member missing from the account is kept too, so neither case is looked up per slot
+    member: RwLock<Option<Option<Member>>>,
+    /// Set once the first ticket detail of the run was checked for a missing hisMemId
+    his_mem_checked: AtomicBool,
+    /// Set once the configured doctors were checked against the department's doctor list
+    doctor_match_checked: AtomicBool,
+    /// Last bookability seen per schedule date, to record only the changes in config/insights.json
+    availability: RwLock<HashMap<String, (bool, DateTime<Local>)>>,
+    /// Order and waitlist submits sent by this run, captcha resubmits included
+    run_submits: AtomicU32,
+    /// Consecutive "too fast" submit answers
+    throttle_streak: AtomicU32,
+    /// account_verified hint from user state, updated by submit answers
+    account_verified: RwLock<Option<bool>>,
+    /// Schedules rejected for real-name verification although the schedule API did not mark them
+    verification_rejected: RwLock<HashSet<String>>,
+    /// Advance-booking window resolved at run start
+    booking_rules: RwLock<BookingRules>,
+    /// Target dates skipped by wait_for_window, to log when each enters the window
+    window_waiting: RwLock<HashSet<String>>,
+    clock: Arc<dyn Clock>,
 }
 
 impl Grabber {
     /// Create a new grabber
     pub fn new(client: Arc<HealthClient>) -> Self {
+        let last_submit_at = restore_last_submit_at(client.config_dir());
         Self {
             client,
             proxy_pool: Arc::new(ProxyPool::new()),
-            last_submit_at: RwLock::new(None),
+            last_submit_at: RwLock::new(last_submit_at),
+            last_submit_save: std::sync::Mutex::new(None),
+            current_phase: RwLock::new(""),
+            attempt_deadline: RwLock::new(None),
+            stats: RwLock::new(GrabStats::default()),
+            paused: Arc::new(AtomicBool::new(false)),
+            target_dates: Arc::new(RwLock::new(Vec::new())),
+            captcha_solver: Arc::new(NoopCaptchaSolver),
+            events: None,
+            pacing: RwLock::new(Pacing::default()),
+            submit_nonces: RwLock::new(HashMap::new()),
+            exclusions: RwLock::new(BookingExclusions::default()),
+            member: RwLock::new(None),
+            his_mem_checked: AtomicBool::new(false),
+            doctor_match_checked: AtomicBool::new(false),
+            availability: RwLock::new(HashMap::new()),
+            run_submits: AtomicU32::new(0),
+            throttle_streak: AtomicU32::new(0),
+            account_verified: RwLock::new(None),
+            verification_rejected: RwLock::new(HashSet::new()),
+            booking_rules: RwLock::new(BookingRules::default()),
+            window_waiting: RwLock::new(HashSet::new()),
+            clock: Arc::new(SystemClock),
+        }
+    }
+
+    /// Use a different time source for phase timing
+    #[allow(dead_code)]
+    pub fn with_clock(mut self, clock: Arc<dyn Clock>) -> Self {
+        self.clock = clock;
+        self
+    }
+
+    /// Use a shared proxy pool, e.g. one restored from config/proxies.json
+    pub fn with_proxy_pool(mut self, proxy_pool: Arc<ProxyPool>) -> Self {
+        self.proxy_pool = proxy_pool;
+        self
+    }
+
+    /// Share a pause flag with the caller; attempts wait while it is set
+    pub fn with_pause_flag(mut self, paused: Arc<AtomicBool>) -> Self {
+        self.paused = paused;
+        self
+    }
+
+    /// Share the target date list with the caller so dates can be appended while running
+    /// An empty list falls back to config.target_dates
+    pub fn with_target_dates(mut self, dates: Arc<RwLock<Vec<String>>>) -> Self {
+        self.target_dates = dates;
+        self
+    }
+
+    /// Use a captcha solver for challenges attached to submit; the default fails fast
+    pub fn with_captcha_solver(mut self, solver: Arc<dyn CaptchaSolver>) -> Self {
+        self.captcha_solver = solver;
+        self
+    }
+
+    /// Publish notification events (throttling storms) through publisher
+    pub fn with_event_publisher(mut self, publisher: EventPublisher) -> Self {
+        self.events = Some(publisher);
+        self
+    }
+
+    fn publish(&self, event: NotifyEvent) {
+        if let Some(publisher) = &self.events {
+            publisher(event);
+        }
+    }
+
+    /// Ask the solver for a captcha answer, bounded by captcha_timeout_seconds and cancellation
+    /// The captcha arrives with a submit answer, so the wait has its own budget outside attempt_timeout_seconds
+    async fn solve_captcha(
+        &self,
+        config: &GrabConfig,
+        challenge: &CaptchaChallenge,
+        cancel_token: &CancellationToken,
+    ) -> AppResult<CaptchaSolution> {
+        let timeout = Duration::from_secs_f64(config.captcha_timeout_seconds.max(1.0));
+        tokio::select! {
+            _ = cancel_token.cancelled() => Err(AppError::Cancelled),
+            solved = tokio::time::timeout(timeout, self.captcha_solver.solve(challenge)) => {
+                solved.unwrap_or_else(|_| Err(AppError::Timeout("captcha solving".into())))
+            }
+        }
+    }
+
+    /// Dates to query in this attempt, re-read every cycle
+    async fn current_target_dates(&self, config: &GrabConfig) -> Vec<String> {
+        let dates = self.target_dates.read().await;
+        if dates.is_empty() {
+            config.target_dates.clone()
+        } else {
+            dates.clone()
+        }
+    }
+
+    /// Wait while the grab is paused, returns false if cancelled meanwhile
+    async fn wait_while_paused<F>(&self, cancel_token: &CancellationToken, on_log: &mut F) -> bool
+    where
+        F: FnMut(&str, &LogMessage) + Send,
+    {
+        if !self.paused.load(Ordering::SeqCst) {
+            return true;
+        }
+
+        emit_log(on_log, "info", LogMessage::new("grab.paused"));
+        while self.paused.load(Ordering::SeqCst) {
+            if !sleep_with_cancel(Duration::from_millis(PAUSE_POLL_INTERVAL_MS), cancel_token.clone()).await {
+                return false;
+            }
         }
+        emit_log(on_log, "info", LogMessage::new("grab.resumed"));
+        true
+    }
+
+    /// Get a snapshot of the run statistics
+    pub async fn stats(&self) -> GrabStats {
+        self.stats.read().await.clone()
+    }
+
+    /// Mark the start of a phase
+    async fn begin_phase(&self, phase: &'static str) -> Instant {
+        *self.current_phase.write().await = phase;
+        self.clock.now()
+    }
+
+    /// Record the duration of a finished phase, returning it in milliseconds
+    async fn end_phase(&self, phase: &'static str, started: Instant) -> u64 {
+        let elapsed_ms = self.clock.now().saturating_duration_since(started).as_millis() as u64;
+        let mut stats = self.stats.write().await;
+        stats.phases.entry(phase.to_string()).or_default().record(elapsed_ms);
+        elapsed_ms
+    }
+
+    /// Run a pre-submit request within the attempt deadline
+    /// Submits never go through here: once a POST is sent the hospital may book it, so its answer is
+    /// always awaited
+    async fn within_attempt<T>(&self, phase: &'static str, request: impl std::future::Future<Output = AppResult<T>>) -> AppResult<T> {
+        let Some((deadline, seconds)) = *self.attempt_deadline.read().await else {
+            return request.await;
+        };
+        tokio::time::timeout_at(deadline, request)
+            .await
+            .unwrap_or_else(|_| Err(AppError::Timeout(format!("attempt exceeded {:.1}s in phase {}", seconds, phase))))
+    }
+
+    /// Look up the configured member once per run; failed lookups are retried on the next slot
+    async fn run_member(&self, config: &GrabConfig, cancel_token: &CancellationToken) -> AppResult<Option<Member>> {
+        if let Some(member) = self.member.read().await.clone() {
+            return Ok(member);
+        }
+        let member = self
+            .within_attempt(PHASE_MEMBER, self.client.get_member_by_id_with_cancel(&config.member_id, cancel_token))
+            .await?;
+        *self.member.write().await = Some(member.clone());
+        Ok(member)
+    }
+
+    /// Note whether a whole-department answer for date had a bookable slot, recording releases and
+    /// sellouts of the date for the learned booking windows
+    async fn note_availability<F>(&self, config: &GrabConfig, date: &str, bookable: bool, on_log: &mut F)
+    where
+        F: FnMut(&str, &LogMessage) + Send,
+    {
+        let now = Local::now();
+        let previous = self.availability.write().await.insert(date.to_string(), (bookable, now));
+        let change = match (previous, bookable) {
+            (None, true) => AvailabilityChange::Released { at: now, unbookable_at: None },
+            (Some((false, seen_at)), true) => AvailabilityChange::Released { at: now, unbookable_at: Some(seen_at) },
+            (Some((true, _)), false) => AvailabilityChange::SoldOut { at: now },
+            _ => return,
+        };
+        let recorded = self
+            .client
+            .store()
+            .and_then(|store| record_availability_change(store, &config.unit_id, &config.dep_id, date, &change));
+        if let Err(e) = recorded {
+            emit_log(on_log, "warn", LogMessage::new("insights.persist_failed").param("error", e));
+        }
+    }
+
+    /// Median per phase, e.g. "sched=0.2s detail=0.4s submit=0.9s"
+    async fn phase_summary(&self) -> String {
+        let stats = self.stats.read().await;
+        PHASE_SUMMARY_LABELS
+            .iter()
+            .filter_map(|(phase, label)| {
+                let timing = stats.phases.get(*phase)?;
+                Some(format!("{}={:.1}s", label, timing.p50_ms as f64 / 1000.0))
+            })
+            .collect::<Vec<_>>()
+            .join(" ")
     }
 
     /// Run the grabber with configuration
@@ -42,14 +422,17 @@ impl Grabber {
         &self,
         config: GrabConfig,
         cancel_token: CancellationToken,
-        mut on_log: F,
+        on_log: F,
     ) -> GrabResult
     where
-        F: FnMut(&str, &str) + Send,
+        F: FnMut(&str, &LogMessage) + Send,
     {
-        // Validate config
-        if let Err(e) = config.validate() {
-            emit_log(&mut on_log, "error", &e);
+        let mut on_log = with_flight_recorder(on_log, self.client.memory_budget());
+
+        // Validate config; entries like "2026-10-20 上午" become a date plus a preference for it
+        let mut config = config;
+        if let Err(e) = config.split_target_dates().and_then(|_| config.validate()) {
+            emit_log(&mut on_log, "error", LogMessage::new("grab.config_invalid").param("error", &e));
             return GrabResult {
                 success: false,
                 message: e,
@@ -57,18 +440,30 @@ impl Grabber {
             };
         }
 
-        emit_log(&mut on_log, "info", "grab engine started");
+        self.client.set_cookie_persistence(config.persist_rotated_cookies);
+        *self.account_verified.write().await = load_account_verified(self.client.config_dir());
+        emit_log(&mut on_log, "info", LogMessage::new("grab.started"));
         emit_log(
             &mut on_log,
             "info",
-            &format!(
-                "grab config: dates={} doctor_ids={} time_types={} preferred={}",
-                config.target_dates.join(","),
-                config.doctor_ids.join(","),
-                config.time_types.join(","),
-                config.preferred_hours.join(",")
-            ),
+            LogMessage::new("grab.config")
+                .param("dates", config.target_dates.join(","))
+                .param("doctors", config.doctor_ids.join(","))
+                .param("time_types", config.time_types.join(","))
+                .param("preferred", config.preferred_hours.join(",")),
         );
+        for date in &config.target_dates {
+            if let Some(preference) = config.date_preferences.get(date) {
+                emit_log(
+                    &mut on_log,
+                    "info",
+                    LogMessage::new("grab.date_preference")
+                        .param("date", date)
+                        .param("time_types", config.time_types_for(date).join(","))
+                        .param("preferred", preference.preferred_hours.join(",")),
+                );
+            }
+        }
 
         let is_precise = !config.doctor_ids.is_empty()
             || !config.preferred_hours.is_empty()
@@ -77,16 +472,26 @@ impl Grabber {
         emit_log(
             &mut on_log,
             "info",
-            if is_precise { "grab mode: precise" } else { "grab mode: fuzzy" },
+            LogMessage::new(if is_precise { "grab.mode_precise" } else { "grab.mode_fuzzy" }),
         );
 
         if config.time_types.is_empty() {
-            emit_log(&mut on_log, "info", "time_types 未设置，默认 am/pm");
+            emit_log(&mut on_log, "info", LogMessage::new("grab.default_time_types"));
         }
 
+        let announcements = if config.check_announcements {
+            self.log_announcements(&config.unit_id, &mut on_log).await
+        } else {
+            Vec::new()
+        };
+        self.resolve_booking_window(&config, &announcements, &mut on_log).await;
+
         // Wait for start time if specified
         if !config.start_time.is_empty() {
-            self.wait_until(&config.start_time, config.use_server_time, cancel_token.clone(), &mut on_log).await;
+            if let Some(warning) = start_time_zone_warning(&config, Local::now()) {
+                emit_log(&mut on_log, "warn", warning);
+            }
+            self.wait_until(&config, cancel_token.clone(), &mut on_log).await;
             if cancel_token.is_cancelled() {
                 return GrabResult {
                     success: false,
@@ -96,8 +501,38 @@ impl Grabber {
             }
         }
 
-        let retry_interval = if config.retry_interval <= 0.0 { 0.5 } else { config.retry_interval };
+        let profile = self.client.store().ok().and_then(|store| load_pacing_profile_in(store, &config.unit_id));
+        let pacing = resolve_pacing(&config, profile.as_ref(), Local::now());
+        if let Some(profile) = &profile {
+            emit_log(
+                &mut on_log,
+                "info",
+                LogMessage::new("pacing.profile")
+                    .param("unit", &config.unit_id)
+                    .param("schedule", format!("{:.1}", pacing.retry_interval))
+                    .param("submit", format!("{:.1}", pacing.submit_interval.as_secs_f64()))
+                    .param("throttled", profile.recently_throttled(Local::now())),
+            );
+        }
+        if config.retry_interval > 0.0 && config.retry_interval < MIN_RETRY_INTERVAL_SECS {
+            emit_log(
+                &mut on_log,
+                "warn",
+                LogMessage::new("pacing.retry_interval_clamped")
+                    .param("configured", config.retry_interval)
+                    .param("floor", MIN_RETRY_INTERVAL_SECS),
+            );
+        }
+        *self.pacing.write().await = pacing;
+        let retry_interval = pacing.retry_interval;
+        self.client.set_governor_base_interval(retry_interval).await;
+        let attempt_timeout = if config.attempt_timeout_seconds <= 0.0 {
+            DEFAULT_ATTEMPT_TIMEOUT_SECS
+        } else {
+            config.attempt_timeout_seconds
+        };
         let mut attempt = 0;
+        let mut window_idle = false;
 
         loop {
             if cancel_token.is_cancelled() {
@@ -108,21 +543,176 @@ impl Grabber {
                 };
             }
 
+            if !self.wait_while_paused(&cancel_token, &mut on_log).await {
+                return GrabResult {
+                    success: false,
+                    message: "stopped".into(),
+                    detail: None,
+                };
+            }
+
+            if config.wait_for_window {
+                if let Some(opens) = self.window_opening(&config).await {
+                    if !window_idle {
+                        emit_log(&mut on_log, "info", LogMessage::new("booking_window.idle").param("opens", opens));
+                        window_idle = true;
+                    }
+                    if !sleep_with_cancel(WINDOW_IDLE_INTERVAL, cancel_token.clone()).await {
+                        return GrabResult {
+                            success: false,
+                            message: "stopped".into(),
+                            detail: None,
+                        };
+                    }
+                    continue;
+                }
+                window_idle = false;
+            }
+
             attempt += 1;
-            emit_log(&mut on_log, "info", &format!("attempt {}", attempt));
+            self.stats.write().await.attempts += 1;
+            emit_log(&mut on_log, "info", LogMessage::new("attempt.start").param("attempt", attempt));
+
+            let mut span = self.client.tracer().start(SPAN_TRY_GRAB_ONCE);
+            span.set_attribute(KeyValue::new(ATTR_ATTEMPT, attempt as i64));
+            let deadline = tokio::time::Instant::now() + Duration::from_secs_f64(attempt_timeout);
+            *self.attempt_deadline.write().await = Some((deadline, attempt_timeout));
+            // The attempt's span is the current context while it runs, so the client spans nest under it
+            let cx = Context::current_with_span(span);
+            let outcome = self
+                .try_grab_once(&config, cancel_token.clone(), &mut on_log)
+                .with_context(cx.clone())
+                .await;
+            *self.attempt_deadline.write().await = None;
+            if let Err(e) = &outcome {
+                cx.span().set_status(Status::error(e.to_string()));
+            }
+            cx.span().end();
+
+            if attempt % PHASE_SUMMARY_EVERY == 0 {
+                let summary = self.phase_summary().await;
+                if !summary.is_empty() {
+                    emit_log(&mut on_log, "info", LogMessage::new("phase.summary").param("timing", summary));
+                }
+            }
 
-            match self.try_grab_once(&config, cancel_token.clone(), &mut on_log).await {
+            match outcome {
                 Ok(Some(success)) => {
-                    emit_log(&mut on_log, "success", "grab success");
+                    let waitlisted = success.kind == GRAB_SUCCESS_WAITLISTED;
+                    emit_log(
+                        &mut on_log,
+                        "success",
+                        LogMessage::new(if waitlisted { "grab.waitlisted" } else { "grab.success" }),
+                    );
+                    let message = if waitlisted {
+                        "已加入候补"
+                    } else if success.payment_required {
+                        "挂号成功，待支付"
+                    } else {
+                        "success"
+                    };
                     return GrabResult {
                         success: true,
-                        message: "success".into(),
+                        message: message.into(),
                         detail: Some(success),
                     };
                 }
                 Ok(None) => {}
+                Err(AppError::QuotaExceeded(msg)) => {
+                    let mut entry = HistoryEntry::new(HISTORY_KIND_QUOTA_EXCEEDED, &msg);
+                    entry.unit_id = config.unit_id.clone();
+                    entry.dep_id = config.dep_id.clone();
+                    entry.member_id = config.member_id.clone();
+                    if let Err(e) = self.client.store().and_then(|store| append_history_in(store, entry)) {
+                        emit_log(&mut on_log, "warn", LogMessage::new("history.write_failed").param("error", e));
+                    }
+
+                    if !config.wait_for_quota_reset {
+                        emit_log(&mut on_log, "error", LogMessage::new("quota.stop"));
+                        return GrabResult {
+                            success: false,
+                            message: AppError::QuotaExceeded(msg).to_frontend_string(),
+                            detail: None,
+                        };
+                    }
+
+                    let wait = duration_until_next_midnight();
+                    emit_log(
+                        &mut on_log,
+                        "warn",
+                        LogMessage::new("quota.wait").param("seconds", format!("{:.0}", wait.as_secs_f64())),
+                    );
+                    if !sleep_with_cancel(wait, cancel_token.clone()).await {
+                        return GrabResult {
+                            success: false,
+                            message: "stopped".into(),
+                            detail: None,
+                        };
+                    }
+                    emit_log(&mut on_log, "info", LogMessage::new("quota.reset"));
+                    continue;
+                }
+                Err(AppError::SubmitLimitReached { per_day: true, limit }) if config.wait_for_quota_reset => {
+                    let wait = duration_until_next_midnight();
+                    emit_log(
+                        &mut on_log,
+                        "warn",
+                        LogMessage::new("submit_limit.wait")
+                            .param("limit", limit)
+                            .param("seconds", format!("{:.0}", wait.as_secs_f64())),
+                    );
+                    if !sleep_with_cancel(wait, cancel_token.clone()).await {
+                        return GrabResult {
+                            success: false,
+                            message: "stopped".into(),
+                            detail: None,
+                        };
+                    }
+                    emit_log(&mut on_log, "info", LogMessage::new("quota.reset"));
+                    continue;
+                }
+                Err(AppError::Timeout(msg)) => {
+                    self.stats.write().await.timeouts += 1;
+                    emit_log(&mut on_log, "warn", LogMessage::new("attempt.timeout").param("attempt", attempt).param("error", &msg));
+                }
                 Err(e) => {
-                    if matches!(e, AppError::LoginRequired(_)) {
+                    if let Some(kind) = e.net_kind() {
+                        emit_log(&mut on_log, "warn", network_failed(kind, &e));
+                    }
+                    if let AppError::FlowUnsupported { flow, .. } = &e {
+                        emit_log(&mut on_log, "error", LogMessage::new("grab.flow_unsupported").param("flow", flow));
+                    }
+                    if let AppError::DiseaseDescriptionRequired { min_length } = &e {
+                        emit_log(&mut on_log, "error", LogMessage::new("grab.disease_required").param("min", min_length));
+                    }
+                    if let AppError::ConsentRequired { names, labels } = &e {
+                        emit_log(&mut on_log, "error", LogMessage::new("grab.consent_required").param("names", names).param("labels", labels));
+                    }
+                    if matches!(e, AppError::HisMemberRequired) {
+                        emit_log(&mut on_log, "error", LogMessage::new("grab.his_mem_required"));
+                    }
+                    if let AppError::DoctorNotInDepartment { configured, available } = &e {
+                        emit_log(
+                            &mut on_log,
+                            "error",
+                            LogMessage::new("grab.doctor_mismatch").param("configured", configured).param("available", available),
+                        );
+                    }
+                    if let AppError::SubmitLimitReached { per_day, limit } = &e {
+                        let key = if *per_day { "submit_limit.day" } else { "submit_limit.run" };
+                        emit_log(&mut on_log, "error", LogMessage::new(key).param("limit", limit));
+                    }
+                    if matches!(
+                        e,
+                        AppError::LoginRequired(_)
+                            | AppError::FlowUnsupported { .. }
+                            | AppError::DiseaseDescriptionRequired { .. }
+                            | AppError::ConsentRequired { .. }
+                            | AppError::HisMemberRequired
+                            | AppError::DoctorNotInDepartment { .. }
+                            | AppError::SubmitLimitReached { .. }
+                            | AppError::SubmitOutcomeUnknown { .. }
+                    ) {
                         return GrabResult {
                             success: false,
                             message: e.to_frontend_string(),
@@ -133,7 +723,7 @@ impl Grabber {
             }
 
             if config.max_retries > 0 && attempt >= config.max_retries {
-                emit_log(&mut on_log, "warn", &format!("max retries reached ({})", config.max_retries));
+                emit_log(&mut on_log, "warn", LogMessage::new("attempt.max_retries").param("max", config.max_retries));
                 return GrabResult {
                     success: false,
                     message: "max retries reached".into(),
@@ -141,7 +731,25 @@ impl Grabber {
                 };
             }
 
-            if !sleep_with_cancel(Duration::from_secs_f64(retry_interval), cancel_token.clone()).await {
+            let (interval, change) = self.client.governed_interval(retry_interval).await;
+            if let Some(change) = change {
+                let status = self.client.governor_status().await;
+                let message = match change {
+                    GovernorChange::Raised { throttled } => {
+                        self.publish(NotifyEvent::Throttled {
+                            throttled,
+                            window: GOVERNOR_WINDOW,
+                            interval: status.effective_interval,
+                        });
+                        LogMessage::new("pacing.governor_raised")
+                            .param("throttled", throttled)
+                            .param("window", GOVERNOR_WINDOW)
+                    }
+                    GovernorChange::Lowered => LogMessage::new("pacing.governor_lowered"),
+                };
+                emit_log(&mut on_log, "warn", message.param("interval", format!("{:.2}", status.effective_interval)));
+            }
+            if !sleep_with_cancel(Duration::from_secs_f64(interval), cancel_token.clone()).await {
                 return GrabResult {
                     success: false,
                     message: "stopped".into(),
@@ -151,6 +759,63 @@ impl Grabber {
         }
     }
 
+    /// Record a "too fast" answer; after THROTTLE_STREAK_ROTATE in a row the client moves to its next profile
+    fn count_throttle_streak<F>(&self, streak: u32, on_log: &mut F)
+    where
+        F: FnMut(&str, &LogMessage) + Send,
+    {
+        if streak < THROTTLE_STREAK_ROTATE {
+            self.throttle_streak.store(streak, Ordering::SeqCst);
+            return;
+        }
+        match self.client.rotate_client_profile() {
+            Ok(Some(name)) => emit_log(on_log, "warn", LogMessage::new("client.profile_rotated").param("profile", name).param("streak", streak)),
+            Ok(None) => {}
+            Err(e) => emit_log(on_log, "warn", LogMessage::new("client.profile_rotate_failed").param("error", e)),
+        }
+    }
+
+    /// Keep the page URL of an unsupported flow for diagnostics, once per URL
+    async fn record_unsupported_flow(&self, flow: &str, url: &str, schedule_id: &str) {
+        let mut stats = self.stats.write().await;
+        if stats.unsupported_flows.iter().any(|f| f.url == url) {
+            return;
+        }
+        stats.unsupported_flows.push(UnsupportedFlow {
+            flow: flow.to_string(),
+            url: url.to_string(),
+            schedule_id: schedule_id.to_string(),
+        });
+    }
+
+    /// Whether a slot is out of reach for this account: marked 实名认证-only while the account is known
+    /// to be unverified, or already rejected for verification in this run
+    async fn verification_blocks(&self, slot: &ScheduleSlot) -> bool {
+        (slot.verification_required && *self.account_verified.read().await == Some(false))
+            || self.verification_rejected.read().await.contains(&slot.schedule_id)
+    }
+
+    /// Record what a submit answer revealed about the account's real-name verification
+    async fn learn_account_verified<F>(&self, verified: bool, on_log: &mut F)
+    where
+        F: FnMut(&str, &LogMessage) + Send,
+    {
+        if self.account_verified.write().await.replace(verified) == Some(verified) {
+            return;
+        }
+        if let Err(e) = save_account_verified(self.client.config_dir(), verified) {
+            emit_log(on_log, "warn", LogMessage::new("account.verified_persist_failed").param("error", e));
+        }
+    }
+
+    /// Keep the department's 病情描述 requirement for the UI and build the error that stops the run
+    async fn disease_required(&self, requirement: &DiseaseRequirement) -> AppError {
+        let requirement = DiseaseRequirement { required: true, ..requirement.clone() };
+        let min_length = requirement.min_length;
+        self.stats.write().await.disease_requirement = Some(requirement);
+        AppError::DiseaseDescriptionRequired { min_length }
+    }
+
     /// Try to grab once (one complete cycle through all dates)
     async fn try_grab_once<F>(
         &self,
@@ -159,34 +824,59 @@ impl Grabber {
         on_log: &mut F,
     ) -> AppResult<Option<GrabSuccess>>
     where
-        F: FnMut(&str, &str) + Send,
+        F: FnMut(&str, &LogMessage) + Send,
     {
         let doctor_set: HashSet<String> = config.doctor_ids.iter().cloned().collect();
-        let time_set: HashSet<String> = if config.time_types.is_empty() {
-            vec!["am".into(), "pm".into()].into_iter().collect()
+
+        let target_dates = self.current_target_dates(config).await;
+        let target_dates = self.dates_in_window(config, target_dates, on_log).await;
+        let mut waitlist = Vec::new();
+        let mut tally = DetailTally::default();
+
+        // Fan the schedule queries out up front; answers are still walked in date order below
+        let concurrency = config.schedule_query_concurrency.clamp(1, MAX_SCHEDULE_QUERY_CONCURRENCY) as usize;
+        let prefetched = if concurrency > 1 && target_dates.len() > 1 {
+            for date in &target_dates {
+                emit_log(on_log, "info", LogMessage::new("schedule.query").param("date", date));
+            }
+            self.query_schedules(config, &target_dates, &doctor_set, concurrency, &cancel_token).await
         } else {
-            config.time_types.iter().cloned().collect()
+            Vec::new()
         };
+        let mut prefetched = prefetched.into_iter();
 
-        for date in &config.target_dates {
+        for date in &target_dates {
             if cancel_token.is_cancelled() {
                 return Err(AppError::Cancelled);
             }
 
-            // Add jitter
-            if DATE_QUERY_JITTER_MAX_MS > 0 {
-                let jitter = {
-                    let mut rng = rand::thread_rng();
-                    rng.gen_range(0..DATE_QUERY_JITTER_MAX_MS)
-                };
-                tokio::time::sleep(Duration::from_millis(jitter)).await;
+            let answer = prefetched.next();
+            if answer.is_none() {
+                // Add jitter
+                let jitter = DATE_QUERY_JITTER.delay(0, &mut rand::thread_rng());
+                tokio::time::sleep(jitter).await;
             }
 
-            match self.try_grab_date(config, date, &doctor_set, &time_set, cancel_token.clone(), on_log).await {
+            let time_set = time_set_for(config, date);
+            match self
+                .try_grab_date(config, date, &doctor_set, &time_set, answer, &mut waitlist, &mut tally, cancel_token.clone(), on_log)
+                .await
+            {
                 Ok(Some(success)) => return Ok(Some(success)),
                 Ok(None) => continue,
                 Err(e) => {
-                    if matches!(e, AppError::LoginRequired(_)) {
+                    if matches!(
+                        e,
+                        AppError::LoginRequired(_)
+                            | AppError::QuotaExceeded(_)
+                            | AppError::DiseaseDescriptionRequired { .. }
+                            | AppError::ConsentRequired { .. }
+                            | AppError::HisMemberRequired
+                            | AppError::DoctorNotInDepartment { .. }
+                            | AppError::SubmitLimitReached { .. }
+                            | AppError::SubmitOutcomeUnknown { .. }
+                            | AppError::Timeout(_)
+                    ) {
                         return Err(e);
                     }
                     continue;
@@ -194,32 +884,256 @@ impl Grabber {
             }
         }
 
+        if let Some((flow, url)) = tally.all_unsupported() {
+            return Err(AppError::FlowUnsupported { flow, url });
+        }
+
+        // Only waitlist once every real slot of this cycle has been tried
+        if config.allow_waitlist && !waitlist.is_empty() {
+            return self.try_waitlist(config, &waitlist, &cancel_token, on_log).await;
+        }
+
         Ok(None)
     }
 
-    /// Try to grab for a specific date
+    /// Join the first waitlist that accepts us
+    async fn try_waitlist<F>(
+        &self,
+        config: &GrabConfig,
+        candidates: &[WaitlistCandidate],
+        cancel_token: &CancellationToken,
+        on_log: &mut F,
+    ) -> AppResult<Option<GrabSuccess>>
+    where
+        F: FnMut(&str, &LogMessage) + Send,
+    {
+        for candidate in candidates {
+            if cancel_token.is_cancelled() {
+                return Ok(None);
+            }
+            emit_log(
+                on_log,
+                "info",
+                LogMessage::new("waitlist.trying")
+                    .param("doctor", &candidate.doctor_name)
+                    .param("date", &candidate.date)
+                    .param("time", &candidate.slot.time_type_desc),
+            );
+
+            if !self.apply_submit_throttle(cancel_token, on_log).await {
+                emit_log(on_log, "warn", LogMessage::new("submit.cancelled").param("phase", PHASE_THROTTLE));
+                return Ok(None);
+            }
+            self.count_submit(config, on_log).await?;
+            let started = self.begin_phase(PHASE_WAITLIST).await;
+            let result = submit_unless_cancelled(cancel_token, || {
+                self.client.submit_waitlist(&config.unit_id, &config.dep_id, &candidate.slot.schedule_id, &config.member_id)
+            })
+            .await;
+            self.end_phase(PHASE_WAITLIST, started).await;
+            if matches!(result, Err(AppError::Cancelled)) {
+                emit_log(on_log, "warn", LogMessage::new("submit.cancelled").param("phase", PHASE_WAITLIST));
+                return Ok(None);
+            }
+
+            match result {
+                Ok(result) if result.success || result.status => {
+                    if cancel_token.is_cancelled() {
+                        emit_log(on_log, "warn", LogMessage::new("submit.completed_after_stop"));
+                    }
+                    let unit_name = if config.unit_name.is_empty() { &config.unit_id } else { &config.unit_name };
+                    let dep_name = if config.dep_name.is_empty() { &config.dep_id } else { &config.dep_name };
+                    let member_name = if config.member_name.is_empty() { &config.member_id } else { &config.member_name };
+
+                    let mut entry = HistoryEntry::new(HISTORY_KIND_WAITLISTED, &result.message);
+                    entry.unit_id = config.unit_id.clone();
+                    entry.dep_id = config.dep_id.clone();
+                    entry.member_id = config.member_id.clone();
+                    if let Err(e) = self.client.store().and_then(|store| append_history_in(store, entry)) {
+                        emit_log(on_log, "warn", LogMessage::new("history.write_failed").param("error", e));
+                    }
+
+                    emit_log(on_log, "success", LogMessage::new("waitlist.success").param("doctor", &candidate.doctor_name));
+                    return Ok(Some(GrabSuccess {
+                        kind: GRAB_SUCCESS_WAITLISTED.into(),
+                        unit_name: unit_name.clone(),
+                        dep_name: dep_name.clone(),
+                        doctor_name: candidate.doctor_name.clone(),
+                        date: candidate.date.clone(),
+                        time_slot: candidate.slot.time_type_desc.clone(),
+                        member_name: member_name.clone(),
+                        unit_id: config.unit_id.clone(),
+                        dep_id: config.dep_id.clone(),
+                        doctor_id: candidate.doctor_id.clone(),
+                        member_id: config.member_id.clone(),
+                        url: result.url,
+                        ..Default::default()
+                    }));
+                }
+                Ok(result) => {
+                    emit_log(on_log, "warn", LogMessage::new("waitlist.failed").param("error", result.message));
+                }
+                Err(e) => {
+                    emit_log(on_log, "warn", LogMessage::new("waitlist.failed").param("error", e));
+                }
+            }
+        }
+        Ok(None)
+    }
+
+    /// Query the schedules of dates, up to concurrency at once, answering in date order
+    async fn query_schedules(
+        &self,
+        config: &GrabConfig,
+        dates: &[String],
+        doctor_set: &HashSet<String>,
+        concurrency: usize,
+        cancel_token: &CancellationToken,
+    ) -> Vec<ScheduleAnswer> {
+        stream::iter(dates)
+            .map(|date| async move {
+                let jitter = DATE_QUERY_JITTER.delay(0, &mut rand::thread_rng());
+                tokio::time::sleep(jitter).await;
+                let time_set = time_set_for(config, date);
+                self.query_schedule(config, date, doctor_set, &time_set, cancel_token).await
+            })
+            .buffered(concurrency)
+            .collect()
+            .await
+    }
+
+    /// Query the schedule of one date
+    async fn query_schedule(
+        &self,
+        config: &GrabConfig,
+        date: &str,
+        doctor_set: &HashSet<String>,
+        time_set: &HashSet<String>,
+        cancel_token: &CancellationToken,
+    ) -> ScheduleAnswer {
+        let started = self.begin_phase(PHASE_SCHEDULE).await;
+        let result = if doctor_set.is_empty() {
+            self.within_attempt(
+                PHASE_SCHEDULE,
+                self.client.get_schedule_result_with_cancel(&config.unit_id, &config.dep_id, date, cancel_token),
+            )
+            .await
+        } else {
+            // Precise mode: other doctors are skipped while decoding, and the scan stops at the first
+            // submit-ready doctor unless full slots are still collected for the waitlist
+            let excluded: HashSet<String> = {
+                let exclusions = self.exclusions.read().await;
+                doctor_set
+                    .iter()
+                    .filter(|doctor_id| exclusions.excludes(&config.member_id, &config.dep_id, doctor_id, date))
+                    .cloned()
+                    .collect()
+            };
+            let unverified = *self.account_verified.read().await == Some(false);
+            let ready = |doctor_id: &str, slot: &ScheduleSlot| {
+                !excluded.contains(doctor_id)
+                    && slot_submit_ready(slot, time_set, config.min_left_num)
+                    && !(unverified && slot.verification_required)
+            };
+            let ready: Option<&(dyn Fn(&str, &ScheduleSlot) -> bool + Sync)> =
+                if config.allow_waitlist { None } else { Some(&ready) };
+            self.within_attempt(
+                PHASE_SCHEDULE,
+                self.client.get_doctors_schedule_with_cancel(&config.unit_id, &config.dep_id, date, doctor_set, ready, cancel_token),
+            )
+            .await
+        };
+        let round_trip_ms = self.end_phase(PHASE_SCHEDULE, started).await;
+        ScheduleAnswer { result, round_trip_ms, received_at: self.clock.now() }
+    }
+
+    /// Try to grab for a specific date, with its schedule answer when it was already queried
     async fn try_grab_date<F>(
         &self,
         config: &GrabConfig,
         date: &str,
         doctor_set: &HashSet<String>,
         time_set: &HashSet<String>,
+        answer: Option<ScheduleAnswer>,
+        waitlist: &mut Vec<WaitlistCandidate>,
+        tally: &mut DetailTally,
         cancel_token: CancellationToken,
         on_log: &mut F,
     ) -> AppResult<Option<GrabSuccess>>
     where
-        F: FnMut(&str, &str) + Send,
+        F: FnMut(&str, &LogMessage) + Send,
     {
-        emit_log(on_log, "info", &format!("schedule query: {}", date));
+        let ScheduleAnswer { result, round_trip_ms: schedule_ms, received_at } = match answer {
+            Some(answer) => answer,
+            None => {
+                emit_log(on_log, "info", LogMessage::new("schedule.query").param("date", date));
+                self.query_schedule(config, date, doctor_set, time_set, &cancel_token).await
+            }
+        };
+        let result = match result {
+            Err(AppError::ScheduleEmpty) => {
+                emit_log(on_log, "warn", LogMessage::new("schedule.empty").param("date", date));
+                return Ok(None);
+            }
+            other => other?,
+        };
+        let unmatched = result.unmatched_doctors();
+        let ScheduleResult { docs, meta } = result;
+        // A typo in doctor_ids would otherwise just never match; checked on the first answer only,
+        // and a doctor who is listed but has no slots yet keeps the run going
+        if config.require_doctor_match_enabled() && !meta.roster.is_empty() && !self.doctor_match_checked.swap(true, Ordering::SeqCst) {
+            if let Some(e) = doctor_mismatch(&config.doctor_ids, &meta.roster) {
+                return Err(e);
+            }
+        }
+        emit_log(
+            on_log,
+            LEVEL_DEBUG,
+            LogMessage::new("debug.schedule_meta")
+                .param("date", date)
+                .param("host", &meta.host)
+                .param("status", meta.http_status)
+                .param("ms", meta.round_trip_ms)
+                .param("user_key", &meta.user_key)
+                .param("fetched_at", meta.fetched_at.format("%H:%M:%S%.3f")),
+        );
+        if !unmatched.is_empty() {
+            let doctors: Vec<String> = unmatched.doctors.iter().map(|d| format!("{}({})", d.doctor_id, d.doctor_name)).collect();
+            emit_log(
+                on_log,
+                LEVEL_DEBUG,
+                LogMessage::new("debug.schedule_unmatched")
+                    .param("date", date)
+                    .param("doctors", doctors.join(", "))
+                    .param("keys", unmatched.orphan_sch_keys.join(", ")),
+            );
+        }
 
-        let docs = self.client.get_schedule(&config.unit_id, &config.dep_id, date).await?;
+        let bookable = docs.iter().flat_map(|d| d.schedules.iter()).any(|slot| slot.left_num > 0);
+        {
+            let mut stats = self.stats.write().await;
+            let day = stats.dates.entry(date.to_string()).or_default();
+            day.queries += 1;
+            if bookable {
+                day.bookable_answers += 1;
+            }
+        }
+        // Answers filtered to the configured doctors say nothing about the department as a whole
+        if doctor_set.is_empty() {
+            self.note_availability(config, date, bookable, on_log).await;
+        }
 
         if docs.is_empty() {
-            emit_log(on_log, "warn", &format!("no schedule on {}", date));
+            emit_log(on_log, "warn", LogMessage::new("schedule.empty").param("date", date));
             return Ok(None);
         }
 
-        emit_log(on_log, "info", &format!("schedule result: docs={}", docs.len()));
+        let result_log = if unmatched.is_empty() {
+            LogMessage::new("schedule.result")
+        } else {
+            LogMessage::new("schedule.result_unmatched").param("unmatched", unmatched.summary())
+        };
+        emit_log(on_log, "info", result_log.param("count", docs.len()).param("ms", schedule_ms));
 
         for doc in &docs {
             if cancel_token.is_cancelled() {
@@ -230,62 +1144,213 @@ impl Grabber {
             if !doctor_set.is_empty() && !doctor_set.contains(&doc.doctor_id) {
                 continue;
             }
+            if self.exclusions.read().await.excludes(&config.member_id, &config.dep_id, &doc.doctor_id, date) {
+                emit_log(on_log, LEVEL_DEBUG, LogMessage::new("debug.doctor_excluded").param("doctor", &doc.doctor_name).param("date", date));
+                continue;
+            }
 
-            for slot in &doc.schedules {
+            let mut slots = doc.schedules.clone();
+            // When the slots being tried were seen, for how long a slot survives until our submit lands
+            let mut seen_at = received_at;
+            let mut refreshes = 0;
+            let mut index = 0;
+            while index < slots.len() {
+                let slot = slots[index].clone();
+                index += 1;
                 if cancel_token.is_cancelled() {
                     return Err(AppError::Cancelled);
                 }
 
                 // Filter by time type
                 if !time_set.is_empty() && !time_set.contains(&slot.time_type) {
+                    emit_log(on_log, LEVEL_DEBUG, slot_skipped(doc, &slot, "time_type"));
                     continue;
                 }
 
-                // Check availability
+                // Check availability; full slots may still offer a waitlist
                 if slot.left_num <= 0 {
+                    if slot.waitlist && !slot.schedule_id.is_empty() {
+                        waitlist.push(WaitlistCandidate {
+                            date: date.to_string(),
+                            doctor_id: doc.doctor_id.clone(),
+                            doctor_name: doc.doctor_name.clone(),
+                            slot: slot.clone(),
+                        });
+                    }
                     continue;
                 }
 
                 if slot.schedule_id.is_empty() {
+                    emit_log(on_log, LEVEL_DEBUG, slot_skipped(doc, &slot, "no_schedule_id"));
+                    continue;
+                }
+
+                // Reported like any slot above, but an unverified account cannot book it
+                if self.verification_blocks(&slot).await {
+                    emit_log(
+                        on_log,
+                        "info",
+                        LogMessage::new("slot.verification_skip").param("doctor", &doc.doctor_name).param("time", &slot.time_type_desc),
+                    );
+                    continue;
+                }
+
+                if slot.left_num < config.min_left_num {
+                    self.stats.write().await.below_min += 1;
+                    emit_log(
+                        on_log,
+                        "info",
+                        LogMessage::new("slot.below_min")
+                            .param("doctor", &doc.doctor_name)
+                            .param("time", &slot.time_type_desc)
+                            .param("left", slot.left_num)
+                            .param("min", config.min_left_num),
+                    );
                     continue;
                 }
 
                 emit_log(
                     on_log,
                     "success",
-                    &format!("found slot: {} - {} (left {})", doc.doctor_name, slot.time_type_desc, slot.left_num),
+                    LogMessage::new("slot.found")
+                        .param("doctor", &doc.doctor_name)
+                        .param("time", &slot.time_type_desc)
+                        .param("left", slot.left_num)
+                        .param("age", format!("{:.1}", meta.age_secs(Local::now()))),
                 );
 
                 // Get ticket detail
-                let detail = match self.client.get_ticket_detail(&config.unit_id, &config.dep_id, &slot.schedule_id, &config.member_id).await {
+                let started = self.begin_phase(PHASE_DETAIL).await;
+                let detail = self
+                    .within_attempt(
+                        PHASE_DETAIL,
+                        self.client.get_ticket_detail_with_cancel(&config.unit_id, &config.dep_id, &slot.schedule_id, &config.member_id, &cancel_token),
+                    )
+                    .await;
+                let detail_ms = self.end_phase(PHASE_DETAIL, started).await;
+                tally.fetched += 1;
+                stop_between_phases(&cancel_token, PHASE_DETAIL, on_log)?;
+                let detail = match detail {
                     Ok(d) => d,
+                    Err(AppError::FlowUnsupported { flow, url }) => {
+                        emit_log(on_log, "warn", LogMessage::new("detail.flow_unsupported").param("flow", &flow).param("url", &url));
+                        self.record_unsupported_flow(&flow, &url, &slot.schedule_id).await;
+                        tally.unsupported += 1;
+                        tally.last_unsupported = Some((flow, url));
+                        continue;
+                    }
+                    Err(e @ AppError::Timeout(_)) => return Err(e),
                     Err(_) => {
-                        emit_log(on_log, "warn", "ticket detail unavailable");
+                        emit_log(on_log, "warn", LogMessage::new("detail.unavailable"));
                         continue;
                     }
                 };
 
+                emit_log(
+                    on_log,
+                    LEVEL_DEBUG,
+                    LogMessage::new("debug.detail")
+                        .param("schedule", &slot.schedule_id)
+                        .param("times", detail.times.len().max(detail.time_slots.len()))
+                        .param("sch_data", !detail.sch_data.is_empty())
+                        .param("detlid_realtime", !detail.detlid_realtime.is_empty())
+                        .param("level_code", !detail.level_code.is_empty())
+                        .param("ms", detail_ms),
+                );
+
+                // Every submit would fail the same way, so stop before the first one
+                if !self.his_mem_checked.swap(true, Ordering::SeqCst) && detail.his_mem_required && detail.his_mem_id.is_empty() {
+                    if !config.ignore_hismem_check {
+                        self.stats.write().await.his_mem_missing = true;
+                        return Err(AppError::HisMemberRequired);
+                    }
+                    emit_log(on_log, "warn", LogMessage::new("member.his_mem_ignored"));
+                }
+
                 let times = if detail.times.is_empty() { &detail.time_slots } else { &detail.times };
                 if times.is_empty() {
                     continue;
                 }
 
                 if detail.sch_data.is_empty() || detail.detlid_realtime.is_empty() || detail.level_code.is_empty() {
-                    emit_log(on_log, "warn", "ticket detail missing fields");
+                    emit_log(on_log, "warn", LogMessage::new("detail.missing_fields"));
                     continue;
                 }
 
                 // Select time slot
-                let selected = pick_time_slot(times, &config.preferred_hours);
-                emit_log(on_log, "info", &format!("selected time slot: {}", selected.name));
+                let Some((selected, reason)) = pick_time_slot(
+                    times,
+                    config.preferred_hours_for(date),
+                    config.prefer_sequence.as_ref(),
+                    config.auto_select_first_time_slot,
+                ) else {
+                    emit_log(on_log, "warn", LogMessage::new("slot.no_match"));
+                    continue;
+                };
+                emit_log(
+                    on_log,
+                    "info",
+                    LogMessage::new("slot.selected")
+                        .param("slot", &selected.name)
+                        .param("reason", reason)
+                        .param("detail_ms", detail_ms),
+                );
 
                 // Resolve address
                 let (address_id, address_text) = resolve_address(config, &detail, on_log);
                 if address_id.is_empty() || address_text.is_empty() {
-                    emit_log(on_log, "error", "missing address info");
+                    emit_log(on_log, "error", LogMessage::new("address.missing"));
                     continue;
                 }
 
+                // A pre-written description wins over whatever the page had
+                let disease_input = if config.disease_description.trim().is_empty() {
+                    detail.disease_input.clone()
+                } else {
+                    config.disease_description.trim().to_string()
+                };
+                if let Err(reason) = detail.disease_requirement.check(&disease_input) {
+                    emit_log(
+                        on_log,
+                        "error",
+                        LogMessage::new("disease.invalid").param("reason", reason).param("hint", &detail.disease_requirement.hint),
+                    );
+                    return Err(self.disease_required(&detail.disease_requirement).await);
+                }
+
+                // A required consent the page leaves unticked is the user's call, not ours
+                let missing = detail.missing_consents(&config.consents);
+                if !missing.is_empty() {
+                    let names: Vec<&str> = missing.iter().map(|c| c.name.as_str()).collect();
+                    let labels: Vec<&str> = missing.iter().map(|c| if c.label.is_empty() { c.name.as_str() } else { c.label.as_str() }).collect();
+                    return Err(AppError::ConsentRequired { names: names.join(","), labels: labels.join("、") });
+                }
+
+                // Verify member certification
+                let started = self.begin_phase(PHASE_MEMBER).await;
+                let member = self.run_member(config, &cancel_token).await;
+                self.end_phase(PHASE_MEMBER, started).await;
+                match member {
+                    Ok(Some(member)) if !member.certified => {
+                        if config.require_certified_member {
+                            emit_log(on_log, "warn", LogMessage::new("member.uncertified_skip"));
+                            continue;
+                        }
+                        emit_log(on_log, "warn", LogMessage::new("member.uncertified_submit"));
+                    }
+                    Ok(Some(_)) => {}
+                    Ok(None) => {
+                        emit_log(on_log, "warn", LogMessage::new("member.not_found"));
+                    }
+                    // Reported by the phase check below
+                    Err(AppError::Cancelled) => {}
+                    Err(e @ AppError::Timeout(_)) => return Err(e),
+                    Err(e) => {
+                        emit_log(on_log, "warn", LogMessage::new("member.lookup_failed").param("error", e));
+                    }
+                }
+                stop_between_phases(&cancel_token, PHASE_MEMBER, on_log)?;
+
                 // Build submit params
                 let mut submit_params = std::collections::HashMap::new();
                 submit_params.insert("unit_id".into(), config.unit_id.clone());
@@ -305,62 +1370,299 @@ impl Grabber {
                 submit_params.insert("sch_date".into(), detail.sch_date.clone());
                 submit_params.insert("hisMemId".into(), detail.his_mem_id.clone());
                 submit_params.insert("order_no".into(), detail.order_no.clone());
-                submit_params.insert("disease_input".into(), detail.disease_input.clone());
+                submit_params.insert("disease_input".into(), disease_input);
                 submit_params.insert("disease_content".into(), detail.disease_content.clone());
                 submit_params.insert("is_hot".into(), detail.is_hot.clone());
+                for consent in detail.consents_to_submit(&config.consents) {
+                    submit_params.insert(format!("{}{}", SUBMIT_EXTRA_FIELD_PREFIX, consent.name), consent.value.clone());
+                }
+                let nonce_key = format!("{}|{}|{}", slot.schedule_id, selected.value, config.member_id);
+                let nonce = self
+                    .submit_nonces
+                    .write()
+                    .await
+                    .entry(nonce_key)
+                    .or_insert_with(new_submit_nonce)
+                    .clone();
+                submit_params.insert(SUBMIT_NONCE_FIELD.into(), nonce);
+
+                // Re-check the slot is still there; the last ticket often vanishes between query and submit
+                // Runs before the throttle, which stamps last_submit_at for a submit that may never be sent
+                if config.recheck_before_submit_enabled() {
+                    let started = self.begin_phase(PHASE_RECHECK).await;
+                    let available = self
+                        .within_attempt(
+                            PHASE_RECHECK,
+                            self.client.recheck_ticket_available_with_cancel(
+                                &config.unit_id,
+                                &config.dep_id,
+                                &slot.schedule_id,
+                                &config.member_id,
+                                &selected.value,
+                                &cancel_token,
+                            ),
+                        )
+                        .await;
+                    self.end_phase(PHASE_RECHECK, started).await;
+                    match available {
+                        Ok(false) => {
+                            self.stats.write().await.saved_submits += 1;
+                            emit_log(on_log, "warn", LogMessage::new("recheck.slot_gone").param("slot", &selected.name));
+                            continue;
+                        }
+                        Ok(true) => {}
+                        // Reported by the phase check below
+                        Err(AppError::Cancelled) => {}
+                        Err(e @ AppError::Timeout(_)) => return Err(e),
+                        Err(e) => {
+                            emit_log(on_log, "warn", LogMessage::new("recheck.failed").param("error", e));
+                        }
+                    }
+                    stop_between_phases(&cancel_token, PHASE_RECHECK, on_log)?;
+                }
 
                 // Apply throttle
-                self.apply_submit_throttle(on_log).await;
+                let started = self.begin_phase(PHASE_THROTTLE).await;
+                let throttled = self.apply_submit_throttle(&cancel_token, on_log).await;
+                let throttle_ms = self.end_phase(PHASE_THROTTLE, started).await;
+                if !throttled {
+                    stop_between_phases(&cancel_token, PHASE_THROTTLE, on_log)?;
+                }
 
                 // Proxy rotation
+                let started = self.begin_phase(PHASE_PROXY).await;
                 let proxy_url = if config.use_proxy_submit {
-                    match self.proxy_pool.rotate_proxy("https", "CN").await {
+                    match self.proxy_pool.rotate().await {
                         Ok(url) => {
-                            emit_log(on_log, "info", &format!("using proxy: {}", url));
+                            emit_log(on_log, "info", LogMessage::new("proxy.using").param("url", &url));
                             Some(url)
                         }
                         Err(e) => {
-                            emit_log(on_log, "warn", &format!("proxy rotation failed: {}, using direct connection", e));
+                            emit_log(on_log, "warn", LogMessage::new("proxy.failed").param("error", e));
                             None
                         }
                     }
                 } else {
                     None
                 };
+                self.end_phase(PHASE_PROXY, started).await;
 
                 // Submit
-                match self.client.submit_order(&submit_params, proxy_url).await {
+                emit_log(
+                    on_log,
+                    LEVEL_DEBUG,
+                    LogMessage::new("debug.submit_request")
+                        .param("schedule", &slot.schedule_id)
+                        .param("detlid", &selected.value)
+                        .param("proxy", proxy_url.as_deref().unwrap_or("-")),
+                );
+                stop_between_phases(&cancel_token, PHASE_PROXY, on_log)?;
+                if config.sign_submit_form && self.client.get_access_hash_values().await.is_empty() {
+                    emit_log(on_log, "warn", LogMessage::new("submit.unsigned"));
+                }
+                self.count_submit(config, on_log).await?;
+                self.stats.write().await.dates.entry(date.to_string()).or_default().submits += 1;
+                let started = self.begin_phase(PHASE_SUBMIT).await;
+                let mut submit_result = submit_unless_cancelled(&cancel_token, || {
+                    self.client.submit_order(&submit_params, proxy_url.clone(), config.sign_submit_form)
+                })
+                .await;
+                let mut submit_ms = self.end_phase(PHASE_SUBMIT, started).await;
+                if matches!(submit_result, Err(AppError::Cancelled)) {
+                    return Err(AppError::Cancelled);
+                }
+
+                // Solve an attached captcha and resubmit once with the solution fields
+                if let Ok(SubmitOrderResult { captcha: Some(challenge), .. }) = &submit_result {
+                    let challenge = challenge.clone();
+                    emit_log(on_log, "warn", LogMessage::new("captcha.required").param("kind", &challenge.kind));
+                    let started = self.begin_phase(PHASE_CAPTCHA).await;
+                    let solution = self.solve_captcha(config, &challenge, &cancel_token).await;
+                    self.end_phase(PHASE_CAPTCHA, started).await;
+                    match solution {
+                        Ok(solution) => {
+                            emit_log(on_log, "info", LogMessage::new("captcha.solved"));
+                            for (name, value) in solution.fields {
+                                submit_params.insert(format!("{}{}", SUBMIT_EXTRA_FIELD_PREFIX, name), value);
+                            }
+                            stop_between_phases(&cancel_token, PHASE_CAPTCHA, on_log)?;
+                            self.count_submit(config, on_log).await?;
+                            let started = self.begin_phase(PHASE_SUBMIT).await;
+                            submit_result = submit_unless_cancelled(&cancel_token, || {
+                                self.client.submit_order(&submit_params, proxy_url.clone(), config.sign_submit_form)
+                            })
+                            .await;
+                            submit_ms = self.end_phase(PHASE_SUBMIT, started).await;
+                        }
+                        Err(AppError::Cancelled) => return Err(AppError::Cancelled),
+                        Err(e) => {
+                            emit_log(on_log, "error", LogMessage::new("captcha.failed").param("error", e));
+                        }
+                    }
+                }
+                let survived_ms = self.clock.now().saturating_duration_since(seen_at).as_millis() as u64;
+                let booked = matches!(&submit_result, Ok(result) if result.success || result.status);
+                self.stats.write().await.slot_survival.record(survived_ms, booked);
+                emit_log(
+                    on_log,
+                    LEVEL_DEBUG,
+                    LogMessage::new("debug.slot_survival").param("ms", survived_ms).param("booked", booked),
+                );
+                if let Ok(result) = &submit_result {
+                    emit_log(
+                        on_log,
+                        LEVEL_DEBUG,
+                        LogMessage::new("debug.submit_response")
+                            .param("success", result.success)
+                            .param("message", &result.message)
+                            .param("url", result.url.as_deref().unwrap_or("-"))
+                            .param("ms", submit_ms),
+                    );
+                }
+                let throttle_streak = self.throttle_streak.swap(0, Ordering::SeqCst);
+                match submit_result {
                     Ok(result) if result.success || result.status => {
+                        if cancel_token.is_cancelled() {
+                            emit_log(on_log, "warn", LogMessage::new("submit.completed_after_stop"));
+                        }
                         let unit_name = if config.unit_name.is_empty() { &config.unit_id } else { &config.unit_name };
                         let dep_name = if config.dep_name.is_empty() { &config.dep_id } else { &config.dep_name };
                         let member_name = if config.member_name.is_empty() { &config.member_id } else { &config.member_name };
 
                         let success = GrabSuccess {
+                            kind: GRAB_SUCCESS_BOOKED.into(),
                             unit_name: unit_name.clone(),
                             dep_name: dep_name.clone(),
                             doctor_name: doc.doctor_name.clone(),
                             date: date.to_string(),
                             time_slot: selected.name.clone(),
                             member_name: member_name.clone(),
+                            unit_id: config.unit_id.clone(),
+                            dep_id: config.dep_id.clone(),
+                            doctor_id: doc.doctor_id.clone(),
+                            member_id: config.member_id.clone(),
+                            order_no: result.url.as_deref().and_then(parse_order_no),
                             url: result.url,
+                            payment_required: result.payment_required,
+                            payment_url: result.payment_url,
+                            payment_deadline: result.payment_deadline,
                         };
+                        self.exclusions.write().await.record_booking(&config.member_id, &config.dep_id, &doc.doctor_id, date);
+                        if slot.verification_required {
+                            self.learn_account_verified(true, on_log).await;
+                        }
+                        if success.payment_required {
+                            emit_log(
+                                on_log,
+                                "warn",
+                                LogMessage::new("submit.payment_required")
+                                    .param("deadline", success.payment_deadline.as_deref().unwrap_or("-"))
+                                    .param("url", success.payment_url.as_deref().unwrap_or_default()),
+                            );
+                        }
 
-                        emit_log(on_log, "success", &format!("success: {} / {} / {}", unit_name, dep_name, doc.doctor_name));
+                        emit_log(
+                            on_log,
+                            "success",
+                            LogMessage::new("submit.success")
+                                .param("unit", unit_name)
+                                .param("dep", dep_name)
+                                .param("doctor", &doc.doctor_name)
+                                .param("ms", submit_ms)
+                                .param("throttle_ms", throttle_ms),
+                        );
                         return Ok(Some(success));
                     }
                     Ok(result) => {
                         let msg = if result.message.is_empty() { "submit failed".to_string() } else { result.message };
-                        
-                        if is_too_fast_message(&msg) {
-                            emit_log(on_log, "warn", &format!("submit throttled, backoff"));
-                            let backoff = Duration::from_millis(random_backoff_ms(SUBMIT_BACKOFF_MIN_MS, SUBMIT_BACKOFF_MAX_MS));
-                            tokio::time::sleep(backoff).await;
-                        } else {
-                            emit_log(on_log, "error", &msg);
+                        match classify_submit_message(&msg) {
+                            SubmitFailureKind::TooFast => {
+                                emit_log(on_log, "warn", LogMessage::new("submit.throttled"));
+                                self.client.note_throttled_answer().await;
+                                self.count_throttle_streak(throttle_streak + 1, on_log);
+                                if let Err(e) = self.client.store().and_then(|store| record_throttle_observed(store, &config.unit_id)) {
+                                    emit_log(on_log, "warn", LogMessage::new("pacing.persist_failed").param("error", e));
+                                }
+                                let multiplier = self.pacing.read().await.backoff_multiplier;
+                                let backoff = SUBMIT_BACKOFF.delay(0, &mut rand::thread_rng()).mul_f64(multiplier);
+                                if !sleep_with_cancel(backoff, cancel_token.clone()).await {
+                                    return Err(AppError::Cancelled);
+                                }
+                            }
+                            SubmitFailureKind::DailyQuota => {
+                                emit_log(on_log, "error", LogMessage::new("submit.quota").param("message", &msg));
+                                return Err(AppError::QuotaExceeded(msg));
+                            }
+                            SubmitFailureKind::BookingLimit => {
+                                emit_log(on_log, "error", LogMessage::new("submit.booking_limit").param("message", &msg));
+                            }
+                            SubmitFailureKind::SameDoctorLimit => {
+                                if self.exclusions.write().await.exclude_doctor(&config.member_id, &doc.doctor_id) {
+                                    emit_log(
+                                        on_log,
+                                        "warn",
+                                        LogMessage::new("submit.same_doctor_limit").param("doctor", &doc.doctor_name).param("message", &msg),
+                                    );
+                                }
+                                break;
+                            }
+                            SubmitFailureKind::DiseaseRequired => {
+                                emit_log(on_log, "error", LogMessage::new("submit.disease_required").param("message", &msg));
+                                return Err(self.disease_required(&detail.disease_requirement).await);
+                            }
+                            SubmitFailureKind::VerificationRequired => {
+                                emit_log(on_log, "warn", LogMessage::new("submit.verification_required").param("message", &msg));
+                                self.verification_rejected.write().await.insert(slot.schedule_id.clone());
+                                self.learn_account_verified(false, on_log).await;
+                            }
+                            SubmitFailureKind::SlotTaken => {
+                                emit_log(on_log, "warn", LogMessage::new("submit.slot_taken").param("message", &msg));
+                                if refreshes >= MAX_DOCTOR_SLOT_REFRESHES {
+                                    break;
+                                }
+                                refreshes += 1;
+                                // Re-pull only this doctor's slots before moving on to the next doctor
+                                match self.refresh_doctor_slots(config, date, &doc.doctor_id, time_set, on_log).await {
+                                    Some(fresh) => {
+                                        slots = fresh;
+                                        seen_at = self.clock.now();
+                                        index = 0;
+                                    }
+                                    None => break,
+                                }
+                            }
+                            SubmitFailureKind::Other => {
+                                emit_log(
+                                    on_log,
+                                    "error",
+                                    LogMessage::new("submit.failed")
+                                        .param("message", &msg)
+                                        .param("ms", submit_ms)
+                                        .param("throttle_ms", throttle_ms),
+                                );
+                            }
                         }
                     }
+                    Err(AppError::SubmitOutcomeUnknown { nonce }) => {
+                        emit_log(on_log, "error", LogMessage::new("submit.outcome_unknown").param("nonce", &nonce));
+                        return Err(AppError::SubmitOutcomeUnknown { nonce });
+                    }
                     Err(e) => {
-                        emit_log(on_log, "error", &format!("submit error: {}", e));
+                        match (e.net_kind(), &proxy_url) {
+                            (Some(NetErrorKind::ProxyUnreachable), Some(url)) => {
+                                self.proxy_pool.discard(url).await;
+                                emit_log(
+                                    on_log,
+                                    "warn",
+                                    LogMessage::new("network.proxy_skipped")
+                                        .param("category", NetErrorKind::ProxyUnreachable.as_str())
+                                        .param("proxy", url),
+                                );
+                            }
+                            (Some(kind), _) => emit_log(on_log, "warn", network_failed(kind, &e)),
+                            (None, _) => {}
+                        }
+                        emit_log(on_log, "error", LogMessage::new("submit.error").param("error", e));
                     }
                 }
             }
@@ -369,36 +1671,116 @@ impl Grabber {
         Ok(None)
     }
 
-    /// Wait until specified time
+    /// Log announcements found on the hospital's news page and return them
+    async fn log_announcements<F>(&self, unit_id: &str, on_log: &mut F) -> Vec<Announcement>
+    where
+        F: FnMut(&str, &LogMessage) + Send,
+    {
+        match self.client.get_hospital_announcements(unit_id).await {
+            Ok(items) if items.is_empty() => {
+                emit_log(on_log, "info", LogMessage::new("announcement.none"));
+                items
+            }
+            Ok(items) => {
+                for item in items.iter().take(MAX_LOGGED_ANNOUNCEMENTS) {
+                    emit_log(on_log, "info", LogMessage::new("announcement.item").param("date", &item.date).param("title", &item.title));
+                }
+                items
+            }
+            Err(e) => {
+                emit_log(on_log, "warn", LogMessage::new("announcement.unavailable").param("error", e));
+                Vec::new()
+            }
+        }
+    }
+
+    /// Take the booking window from the config or the announcements and warn about target dates beyond it
+    async fn resolve_booking_window<F>(&self, config: &GrabConfig, announcements: &[Announcement], on_log: &mut F)
+    where
+        F: FnMut(&str, &LogMessage) + Send,
+    {
+        let rules = if config.booking_window_days > 0 {
+            emit_log(on_log, "info", LogMessage::new("booking_window.configured").param("days", config.booking_window_days));
+            BookingRules { advance_days: Some(config.booking_window_days) }
+        } else {
+            let rules = parse_booking_rules(announcements);
+            if let Some(days) = rules.advance_days {
+                emit_log(on_log, "info", LogMessage::new("booking_window.announced").param("days", days));
+            }
+            rules
+        };
+
+        if let Some(days) = rules.advance_days {
+            let dates = self.current_target_dates(config).await;
+            for (date, opens) in rules.outside_window(&dates, Local::now().date_naive()) {
+                emit_log(
+                    on_log,
+                    "warn",
+                    LogMessage::new("booking_window.outside").param("date", date).param("days", days).param("opens", opens),
+                );
+            }
+        }
+        self.window_waiting.write().await.clear();
+        *self.booking_rules.write().await = rules;
+    }
+
+    /// Earliest opening day when every target date is beyond the booking window, None if any can be queried
+    async fn window_opening(&self, config: &GrabConfig) -> Option<chrono::NaiveDate> {
+        let dates = self.current_target_dates(config).await;
+        let outside = self.booking_rules.read().await.outside_window(&dates, Local::now().date_naive());
+        if dates.is_empty() || outside.len() < dates.len() {
+            return None;
+        }
+        outside.into_iter().map(|(_, opens)| opens).min()
+    }
+
+    /// Target dates to query this cycle; under wait_for_window dates beyond the booking window are skipped
+    async fn dates_in_window<F>(&self, config: &GrabConfig, dates: Vec<String>, on_log: &mut F) -> Vec<String>
+    where
+        F: FnMut(&str, &LogMessage) + Send,
+    {
+        if !config.wait_for_window {
+            return dates;
+        }
+        let outside: HashMap<String, chrono::NaiveDate> =
+            self.booking_rules.read().await.outside_window(&dates, Local::now().date_naive()).into_iter().collect();
+        let mut waiting = self.window_waiting.write().await;
+        let mut queryable = Vec::with_capacity(dates.len());
+        for date in dates {
+            if let Some(opens) = outside.get(&date) {
+                if waiting.insert(date.clone()) {
+                    emit_log(on_log, LEVEL_DEBUG, LogMessage::new("debug.booking_window_skip").param("date", &date).param("opens", opens));
+                }
+                continue;
+            }
+            if waiting.remove(&date) {
+                emit_log(on_log, "info", LogMessage::new("booking_window.entered").param("date", &date));
+            }
+            queryable.push(date);
+        }
+        queryable
+    }
+
+    /// Wait until start_time, read in the configured start_time_timezone
     async fn wait_until<F>(
         &self,
-        target_time: &str,
-        use_server_time: bool,
+        config: &GrabConfig,
         cancel_token: CancellationToken,
         on_log: &mut F,
     ) where
-        F: FnMut(&str, &str) + Send,
+        F: FnMut(&str, &LogMessage) + Send,
     {
-        let parts: Vec<&str> = target_time.split(':').collect();
-        if parts.len() < 3 {
-            emit_log(on_log, "error", &format!("invalid time format: {}", target_time));
+        let (target_time, use_server_time) = (config.start_time.as_str(), config.use_server_time);
+        let Some(target) = config.start_time_at(Local::now()) else {
+            emit_log(on_log, "error", LogMessage::new("time.invalid_format").param("time", target_time));
             return;
-        }
-
-        let hour: u32 = parts[0].parse().unwrap_or(0);
-        let min: u32 = parts[1].parse().unwrap_or(0);
-        let sec: u32 = parts[2].parse().unwrap_or(0);
-
-        let now = Local::now();
-        let target = now.date_naive().and_hms_opt(hour, min, sec)
-            .map(|t| t.and_local_timezone(Local).unwrap())
-            .unwrap_or(now);
+        };
 
         let mut offset = chrono::Duration::zero();
         if use_server_time {
             if let Ok(server_time) = self.client.get_server_datetime().await {
                 offset = server_time - Local::now();
-                emit_log(on_log, "info", &format!("time offset {:.3}s", offset.num_milliseconds() as f64 / 1000.0));
+                emit_log(on_log, "info", LogMessage::new("time.offset").param("offset", format!("{:.3}", offset.num_milliseconds() as f64 / 1000.0)));
             }
         }
 
@@ -406,18 +1788,37 @@ impl Grabber {
         let now = Local::now();
 
         if adjusted <= now {
-            emit_log(on_log, "warn", &format!("target time already passed: {}", target_time));
+            emit_log(on_log, "warn", LogMessage::new("time.passed").param("time", target_time));
             return;
         }
 
         let wait = adjusted - now;
-        emit_log(on_log, "info", &format!("waiting {:.1}s to start", wait.num_seconds() as f64));
+        emit_log(on_log, "info", LogMessage::new("time.waiting").param("seconds", format!("{:.1}", wait.num_seconds() as f64)));
+
+        // Lookups for the hot phase run in the background between T-45s and T-15s; whatever is
+        // still running at the trigger or on cancel is dropped with the guard
+        let wait = wait.to_std().unwrap_or_default();
+        let prefetch_cancel = cancel_token.child_token();
+        let _prefetch_guard = prefetch_cancel.clone().drop_guard();
+        let mut prefetch = (wait > PREFETCH_WINDOW_END).then(|| {
+            let trigger = tokio::time::Instant::now() + wait;
+            tokio::spawn(run_prefetch(self.client.clone(), config.clone(), trigger, prefetch_cancel))
+        });
 
         // Wait with periodic checks
         while Local::now() < adjusted {
             if cancel_token.is_cancelled() {
                 return;
             }
+            if let Some(task) = prefetch.take() {
+                if !task.is_finished() {
+                    prefetch = Some(task);
+                } else if let Ok(outcomes) = task.await {
+                    if !outcomes.is_empty() {
+                        emit_log(on_log, "info", LogMessage::new("prefetch.summary").param("summary", summarize_prefetch(&outcomes)));
+                    }
+                }
+            }
             let remaining = adjusted - Local::now();
             if remaining.num_seconds() <= 2 {
                 break;
@@ -434,56 +1835,272 @@ impl Grabber {
             tokio::task::yield_now().await;
         }
 
-        emit_log(on_log, "info", "start trigger");
+        emit_log(on_log, "info", LogMessage::new("time.start_trigger"));
+    }
+
+    /// Re-pull one doctor's slots after a lost submit
+    /// Returns the still-available slots, or None when the doctor has nothing left
+    async fn refresh_doctor_slots<F>(
+        &self,
+        config: &GrabConfig,
+        date: &str,
+        doctor_id: &str,
+        time_set: &HashSet<String>,
+        on_log: &mut F,
+    ) -> Option<Vec<ScheduleSlot>>
+    where
+        F: FnMut(&str, &LogMessage) + Send,
+    {
+        let started = self.begin_phase(PHASE_REFRESH).await;
+        let fresh = self
+            .within_attempt(PHASE_REFRESH, self.client.refresh_doctor_slots(&config.unit_id, &config.dep_id, date, doctor_id))
+            .await;
+        self.end_phase(PHASE_REFRESH, started).await;
+
+        // Compare against the average full department query to validate the shortcut
+        let (refresh_ms, schedule_ms) = {
+            let stats = self.stats.read().await;
+            let refresh_ms = stats.phases.get(PHASE_REFRESH).map_or(0, |t| t.last_ms);
+            let schedule_ms = stats
+                .phases
+                .get(PHASE_SCHEDULE)
+                .filter(|t| t.count > 0)
+                .map_or(0, |t| t.total_ms / t.count as u64);
+            (refresh_ms, schedule_ms)
+        };
+
+        let fresh = match fresh {
+            Ok(slots) => slots,
+            Err(e) => {
+                emit_log(on_log, "warn", LogMessage::new("slot.refresh_failed").param("error", e));
+                return None;
+            }
+        };
+        let available: Vec<ScheduleSlot> = fresh
+            .into_iter()
+            .filter(|s| s.left_num > 0 && !s.schedule_id.is_empty())
+            .filter(|s| time_set.is_empty() || time_set.contains(&s.time_type))
+            .collect();
+
+        emit_log(
+            on_log,
+            "info",
+            LogMessage::new("slot.refreshed")
+                .param("doctor", doctor_id)
+                .param("count", available.len())
+                .param("ms", refresh_ms)
+                .param("full_ms", schedule_ms),
+        );
+        if available.is_empty() {
+            None
+        } else {
+            Some(available)
+        }
+    }
+
+    /// Count a submit against max_submits_per_run and max_submits_per_day right before it is sent
+    /// Fails without counting once either cap is reached; the daily count is kept even without a cap
+    async fn count_submit<F>(&self, config: &GrabConfig, on_log: &mut F) -> AppResult<()>
+    where
+        F: FnMut(&str, &LogMessage) + Send,
+    {
+        let sent = self.run_submits.load(Ordering::SeqCst);
+        if config.max_submits_per_run > 0 && sent >= config.max_submits_per_run {
+            return Err(AppError::SubmitLimitReached { per_day: false, limit: config.max_submits_per_run });
+        }
+        if config.max_submits_per_day > 0 {
+            // An unreadable counter does not block the run; the per-run cap still applies
+            match self.client.store().and_then(|store| submits_today_in(store, &config.member_id)) {
+                Ok(today) if today >= config.max_submits_per_day => {
+                    return Err(AppError::SubmitLimitReached { per_day: true, limit: config.max_submits_per_day });
+                }
+                Ok(_) => {}
+                Err(e) => emit_log(on_log, "warn", LogMessage::new("submit_counts.read_failed").param("error", e)),
+            }
+        }
+
+        let sent = self.run_submits.fetch_add(1, Ordering::SeqCst) + 1;
+        match self.client.store().and_then(|store| record_submit(store, &config.member_id)) {
+            Ok(today) => emit_log(on_log, LEVEL_DEBUG, LogMessage::new("debug.submit_count").param("run", sent).param("today", today)),
+            Err(e) => emit_log(on_log, "warn", LogMessage::new("submit_counts.persist_failed").param("error", e)),
+        }
+        Ok(())
     }
 
     /// Apply submit throttle
-    async fn apply_submit_throttle<F>(&self, on_log: &mut F)
+    async fn apply_submit_throttle<F>(&self, cancel_token: &CancellationToken, on_log: &mut F) -> bool
     where
-        F: FnMut(&str, &str) + Send,
+        F: FnMut(&str, &LogMessage) + Send,
     {
         let last = *self.last_submit_at.read().await;
         if let Some(last_time) = last {
             let elapsed = last_time.elapsed();
-            let min_interval = Duration::from_millis(SUBMIT_MIN_INTERVAL_MS);
+            let min_interval = self.pacing.read().await.submit_interval;
             if elapsed < min_interval {
                 let wait = min_interval - elapsed;
-                emit_log(on_log, "info", &format!("submit throttle: wait {}ms", wait.as_millis()));
-                tokio::time::sleep(wait).await;
+                emit_log(on_log, "info", LogMessage::new("throttle.wait").param("ms", wait.as_millis()));
+                if !sleep_with_cancel(wait, cancel_token.clone()).await {
+                    return false;
+                }
             }
         }
         let mut last_lock = self.last_submit_at.write().await;
         *last_lock = Some(std::time::Instant::now());
+        drop(last_lock);
+
+        // Written off the hot path; a write still running when the next submit comes is left to finish
+        let (dir, now) = (self.client.config_dir().clone(), Local::now());
+        let save = tokio::task::spawn_blocking(move || save_last_submit_at(&dir, now));
+        let previous = self.last_submit_save.lock().unwrap_or_else(|e| e.into_inner()).replace(save);
+        if let Some(previous) = previous.filter(|save| save.is_finished()) {
+            if let Ok(Err(e)) = previous.await {
+                emit_log(on_log, "warn", LogMessage::new("throttle.persist_failed").param("error", e));
+            }
+        }
+        true
+    }
+}
+
+/// Resolve request pacing; explicit config intervals win over the hospital profile
+fn resolve_pacing(config: &GrabConfig, profile: Option<&PacingProfile>, now: chrono::DateTime<Local>) -> Pacing {
+    let mut pacing = Pacing::default();
+    if let Some(profile) = profile {
+        let (schedule, submit) = profile.effective_intervals(now);
+        if schedule > 0.0 {
+            pacing.retry_interval = schedule;
+        }
+        if submit > 0.0 {
+            pacing.submit_interval = Duration::from_secs_f64(submit);
+        }
+        if profile.backoff_multiplier > 0.0 {
+            pacing.backoff_multiplier = profile.backoff_multiplier;
+        }
+    }
+    if config.retry_interval > 0.0 {
+        pacing.retry_interval = config.retry_interval.max(MIN_RETRY_INTERVAL_SECS);
+    }
+    if config.submit_interval > 0.0 {
+        pacing.submit_interval = Duration::from_secs_f64(config.submit_interval);
+    }
+    pacing
+}
+
+/// Restore the last submit time persisted by a previous run
+/// Only values within SUBMIT_RESTORE_WINDOW_MS are honoured
+fn restore_last_submit_at(dir: &ConfigDir) -> Option<std::time::Instant> {
+    let persisted = load_last_submit_at(dir)?;
+    let elapsed = Local::now() - persisted;
+    if elapsed < ChronoDuration::zero() || elapsed.num_milliseconds() > SUBMIT_RESTORE_WINDOW_MS {
+        return None;
     }
+    std::time::Instant::now().checked_sub(elapsed.to_std().ok()?)
 }
 
-/// Pick time slot based on preference
-fn pick_time_slot(slots: &[TimeSlot], preferred: &[String]) -> TimeSlot {
+/// Pick time slot based on preference, returning the slot and the selection reason
+/// Numbered slots follow prefer_sequence first; unnumbered or unmatched slots fall back to preferred hours
+/// Returns None when preferences are set, none match and auto_select_first is false
+fn pick_time_slot(
+    slots: &[TimeSlot],
+    preferred: &[String],
+    prefer_sequence: Option<&PreferSequence>,
+    auto_select_first: bool,
+) -> Option<(TimeSlot, &'static str)> {
     if slots.is_empty() {
-        return TimeSlot { name: String::new(), value: String::new() };
+        return None;
+    }
+
+    if let Some(pick) = prefer_sequence.and_then(|pref| pick_by_sequence(slots, pref)) {
+        return Some(pick);
     }
 
     if !preferred.is_empty() {
         for p in preferred {
             for slot in slots {
-                if &slot.name == p {
-                    return slot.clone();
+                // A bare clock time ("09:00") picks the slot starting then, e.g. "09:00-09:30"
+                if &slot.name == p || (is_clock_time(p) && slot.name.starts_with(p.as_str())) {
+                    return Some((slot.clone(), "preferred hour"));
                 }
             }
         }
     }
 
-    slots[0].clone()
+    if (!preferred.is_empty() || prefer_sequence.is_some()) && !auto_select_first {
+        return None;
+    }
+
+    Some((slots[0].clone(), "first available"))
+}
+
+/// "HH:MM"
+fn is_clock_time(text: &str) -> bool {
+    chrono::NaiveTime::parse_from_str(text, "%H:%M").is_ok()
+}
+
+/// Pick a numbered slot according to the sequence preference
+fn pick_by_sequence(slots: &[TimeSlot], pref: &PreferSequence) -> Option<(TimeSlot, &'static str)> {
+    let numbered: Vec<(u32, &TimeSlot)> = slots
+        .iter()
+        .filter_map(|slot| parse_sequence_number(&slot.name).map(|n| (n, slot)))
+        .collect();
+    if numbered.is_empty() {
+        return None;
+    }
+
+    match pref {
+        PreferSequence::Mode(mode) => match mode.trim().to_lowercase().as_str() {
+            "lowest" => numbered
+                .iter()
+                .min_by_key(|(n, _)| *n)
+                .map(|(_, slot)| ((*slot).clone(), "lowest available")),
+            "highest" => numbered
+                .iter()
+                .max_by_key(|(n, _)| *n)
+                .map(|(_, slot)| ((*slot).clone(), "highest available")),
+            _ => None,
+        },
+        PreferSequence::Numbers(wanted) => wanted.iter().find_map(|want| {
+            numbered
+                .iter()
+                .find(|(n, _)| n == want)
+                .map(|(_, slot)| ((*slot).clone(), "preferred sequence"))
+        }),
+    }
+}
+
+/// Parse a slot name like "3号", "第03号" or "12" into its sequence number
+fn parse_sequence_number(name: &str) -> Option<u32> {
+    let trimmed = name.trim();
+    let trimmed = trimmed.strip_prefix('第').unwrap_or(trimmed);
+    let trimmed = trimmed.strip_suffix('号').unwrap_or(trimmed).trim();
+    if trimmed.is_empty() || !trimmed.chars().all(|c| c.is_ascii_digit()) {
+        return None;
+    }
+    trimmed.parse().ok()
 }
 
 /// Resolve address from config or detail
 fn resolve_address<F>(config: &GrabConfig, detail: &TicketDetail, on_log: &mut F) -> (String, String)
 where
-    F: FnMut(&str, &str) + Send,
+    F: FnMut(&str, &LogMessage) + Send,
 {
     let mut address_id = normalize_address_id(&config.address_id);
     let mut address_text = normalize_address_text(&config.address);
 
+    // An area picked in the UI plus a typed street
+    if (address_id.is_empty() || address_text.is_empty()) && !config.address_area_id.trim().is_empty() {
+        let area_id = normalize_address_id(&config.address_area_id);
+        let street = normalize_address_text(&config.address_street);
+        if area_id.is_empty() || street.is_empty() {
+            emit_log(on_log, "warn", LogMessage::new("address.area_invalid"));
+        } else {
+            address_text = match cached_area_label(&area_id) {
+                Some(label) => format!("{} {}", label, street),
+                None => street,
+            };
+            address_id = area_id;
+        }
+    }
+
     if address_id.is_empty() || address_text.is_empty() {
         address_id = normalize_address_id(&detail.address_id);
         address_text = normalize_address_text(&detail.address);
@@ -496,7 +2113,7 @@ where
             if !cand_id.is_empty() && !cand_text.is_empty() {
                 address_id = cand_id;
                 address_text = cand_text.clone();
-                emit_log(on_log, "warn", &format!("fallback address: {}", cand_text));
+                emit_log(on_log, "warn", LogMessage::new("address.fallback").param("address", &cand_text));
                 break;
             }
         }
@@ -530,6 +2147,109 @@ fn normalize_address_text(value: &str) -> String {
     value.to_string()
 }
 
+/// Submit failure classification
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+enum SubmitFailureKind {
+    /// Rate limited, retry after backoff
+    TooFast,
+    /// Daily booking attempt quota exhausted, fatal for today
+    DailyQuota,
+    /// Duplicate booking or per-department booking limit
+    BookingLimit,
+    /// The slot was taken by someone else between query and submit
+    SlotTaken,
+    /// The member already booked this doctor within the last seven days
+    SameDoctorLimit,
+    /// The department wants a 病情描述 we did not send, or one that is too short
+    DiseaseRequired,
+    /// The schedule is only open to real-name verified (实名认证) accounts
+    VerificationRequired,
+    Other,
+}
+
+/// Classify a submit failure message
+fn classify_submit_message(message: &str) -> SubmitFailureKind {
+    let message = message.trim();
+    if message.contains("病情描述") {
+        return SubmitFailureKind::DiseaseRequired;
+    }
+    if message.contains("实名") {
+        return SubmitFailureKind::VerificationRequired;
+    }
+    if is_same_doctor_limit_message(message) {
+        return SubmitFailureKind::SameDoctorLimit;
+    }
+    if is_booking_limit_message(message) {
+        return SubmitFailureKind::BookingLimit;
+    }
+    if is_daily_quota_message(message) {
+        return SubmitFailureKind::DailyQuota;
+    }
+    if is_too_fast_message(message) {
+        return SubmitFailureKind::TooFast;
+    }
+    if is_slot_taken_message(message) {
+        return SubmitFailureKind::SlotTaken;
+    }
+    SubmitFailureKind::Other
+}
+
+/// Check if message indicates the daily booking attempt quota is exhausted
+fn is_daily_quota_message(message: &str) -> bool {
+    (message.contains("今日") || message.contains("当天") || message.contains("次数"))
+        && (message.contains("上限") || message.contains("超过"))
+}
+
+/// Check if message indicates the one-booking-per-doctor-per-week rule, e.g. 同一医生七天内只能预约一次
+fn is_same_doctor_limit_message(message: &str) -> bool {
+    (message.contains("同一医生") || message.contains("该医生"))
+        && (message.contains("七天") || message.contains("7天") || message.contains("一周"))
+}
+
+/// Check if message indicates a duplicate booking or per-department limit
+fn is_booking_limit_message(message: &str) -> bool {
+    if message.contains("重复") || message.contains("已预约") || message.contains("已有预约") {
+        return true;
+    }
+    (message.contains("科室") || message.contains("医生"))
+        && (message.contains("上限") || message.contains("限制") || message.contains("超过"))
+}
+
+/// Check if message indicates the slot is no longer available
+fn is_slot_taken_message(message: &str) -> bool {
+    ["已约满", "已满", "已被预约", "已被抢", "号源不足", "无号"]
+        .iter()
+        .any(|marker| message.contains(marker))
+}
+
+/// Duration until the next local midnight
+fn duration_until_next_midnight() -> Duration {
+    let now = Local::now();
+    let next = (now.date_naive() + ChronoDuration::days(1))
+        .and_hms_opt(0, 0, 0)
+        .and_then(|t| t.and_local_timezone(Local).earliest());
+    match next {
+        Some(next) => (next - now).to_std().unwrap_or(Duration::from_secs(60)),
+        None => Duration::from_secs(60),
+    }
+}
+
+/// Error listing configured and available doctors when none of doctor_ids is on the roster
+fn doctor_mismatch(doctor_ids: &[String], roster: &[DepartmentDoctor]) -> Option<AppError> {
+    let wanted: HashSet<&str> = doctor_ids.iter().map(|id| id.trim()).collect();
+    if roster.iter().any(|doctor| wanted.contains(doctor.doctor_id.as_str())) {
+        return None;
+    }
+    Some(AppError::DoctorNotInDepartment {
+        configured: doctor_ids.join(","),
+        available: roster
+            .iter()
+            .map(|doctor| format!("{}({})", doctor.doctor_name, doctor.doctor_id))
+            .collect::<Vec<_>>()
+            .join(", "),
+    })
+}
+
 /// Check if message indicates rate limiting
 fn is_too_fast_message(message: &str) -> bool {
     let message = message.trim();
@@ -539,17 +2259,37 @@ fn is_too_fast_message(message: &str) -> bool {
     message.contains("太快") || message.contains("频繁") || message.contains("刷新")
 }
 
-/// Random backoff in milliseconds
-fn random_backoff_ms(min_ms: u64, max_ms: u64) -> u64 {
-    if min_ms == 0 && max_ms == 0 {
-        return 0;
+/// Stop the submit pipeline when the run was stopped during phase; nothing has been submitted yet
+fn stop_between_phases<F>(cancel_token: &CancellationToken, phase: &str, on_log: &mut F) -> AppResult<()>
+where
+    F: FnMut(&str, &LogMessage) + Send,
+{
+    if cancel_token.is_cancelled() {
+        emit_log(on_log, "warn", LogMessage::new("submit.cancelled").param("phase", phase));
+        return Err(AppError::Cancelled);
     }
-    let max = if max_ms < min_ms { min_ms } else { max_ms };
-    if max == min_ms {
-        return max;
+    Ok(())
+}
+
+/// Log line naming the network category of a failure with the hint for it
+fn network_failed(kind: NetErrorKind, error: &AppError) -> LogMessage {
+    LogMessage::new("network.failed")
+        .param("category", kind.as_str())
+        .param("hint", kind.hint())
+        .param("error", error)
+}
+
+/// Send a submit POST unless the run was stopped first
+/// Once the request is on its way it is awaited even if stop arrives meanwhile: the hospital may have
+/// booked it already, and dropping the answer would hide an order the user has to know about
+async fn submit_unless_cancelled<T, Fut>(cancel_token: &CancellationToken, submit: impl FnOnce() -> Fut) -> AppResult<T>
+where
+    Fut: std::future::Future<Output = AppResult<T>>,
+{
+    if cancel_token.is_cancelled() {
+        return Err(AppError::Cancelled);
     }
-    let mut rng = rand::thread_rng();
-    rng.gen_range(min_ms..=max)
+    submit().await
 }
 
 /// Sleep with cancellation support
@@ -560,10 +2300,399 @@ async fn sleep_with_cancel(duration: Duration, cancel_token: CancellationToken)
     }
 }
 
+/// Time types wanted on date, am and pm when none are configured
+fn time_set_for(config: &GrabConfig, date: &str) -> HashSet<String> {
+    let time_types = config.time_types_for(date);
+    if time_types.is_empty() {
+        ["am", "pm"].iter().map(|t| t.to_string()).collect()
+    } else {
+        time_types.iter().cloned().collect()
+    }
+}
+
+/// Whether a slot passes every schedule-level check before the ticket detail is fetched
+fn slot_submit_ready(slot: &ScheduleSlot, time_set: &HashSet<String>, min_left_num: i32) -> bool {
+    (time_set.is_empty() || time_set.contains(&slot.time_type))
+        && !slot.schedule_id.is_empty()
+        && slot.left_num > 0
+        && slot.left_num >= min_left_num
+}
+
+/// Warning for a start_time on a machine whose zone is not China Standard Time
+/// Both readings are spelled out so a UTC machine cannot silently fire 8 hours late
+fn start_time_zone_warning(config: &GrabConfig, now: DateTime<Local>) -> Option<LogMessage> {
+    if now.offset().fix() == china_offset() {
+        return None;
+    }
+    let as_local = config.start_time_in(now, START_TIME_ZONE_LOCAL)?;
+    let as_china = config.start_time_in(now, START_TIME_ZONE_CHINA)?;
+    let zone = if config.start_time_timezone == START_TIME_ZONE_CHINA { START_TIME_ZONE_CHINA } else { START_TIME_ZONE_LOCAL };
+    Some(
+        LogMessage::new("time.zone_mismatch")
+            .param("offset", now.format("%:z"))
+            .param("time", config.start_time.trim())
+            .param("as_local", as_local.with_timezone(&china_offset()).format("%H:%M:%S"))
+            .param("as_china", as_china.format("%H:%M:%S"))
+            .param("zone", zone),
+    )
+}
+
+/// Debug record for a slot the grab loop passed over
+fn slot_skipped(doc: &DoctorSchedule, slot: &ScheduleSlot, reason: &str) -> LogMessage {
+    LogMessage::new("debug.slot_skipped")
+        .param("doctor", &doc.doctor_name)
+        .param("schedule", &slot.schedule_id)
+        .param("time_type", &slot.time_type)
+        .param("left", slot.left_num)
+        .param("reason", reason)
+}
+
 /// Emit log message
-fn emit_log<F>(on_log: &mut F, level: &str, message: &str)
+fn emit_log<F>(on_log: &mut F, level: &str, message: LogMessage)
 where
-    F: FnMut(&str, &str),
+    F: FnMut(&str, &LogMessage),
 {
-    on_log(level, message);
+    on_log(level, &message.redacted());
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[tokio::test]
+    async fn test_submit_cancel_boundary() {
+        use std::sync::atomic::AtomicU32;
+
+        // A fake submit that counts POSTs and can press stop while its request is in flight
+        let posts = AtomicU32::new(0);
+        let fake_submit = |cancel_while_in_flight: Option<CancellationToken>| {
+            let posts = &posts;
+            move || async move {
+                posts.fetch_add(1, Ordering::SeqCst);
+                if let Some(token) = cancel_while_in_flight {
+                    token.cancel();
+                    tokio::time::sleep(Duration::from_millis(5)).await;
+                }
+                Ok::<_, AppError>("booked")
+            }
+        };
+
+        // Stopped before the POST: nothing is sent
+        let cancel = CancellationToken::new();
+        cancel.cancel();
+        let mut logs = Vec::new();
+        let mut on_log = |_: &str, message: &LogMessage| logs.push(message.raw());
+        assert!(matches!(stop_between_phases(&cancel, PHASE_RECHECK, &mut on_log), Err(AppError::Cancelled)));
+        assert!(matches!(submit_unless_cancelled(&cancel, fake_submit(None)).await, Err(AppError::Cancelled)));
+        assert_eq!(posts.load(Ordering::SeqCst), 0);
+        assert_eq!(logs, vec!["submit.cancelled phase=recheck".to_string()]);
+
+        // Stopped while the POST is in flight: it finishes and its outcome is kept
+        let cancel = CancellationToken::new();
+        assert!(stop_between_phases(&cancel, PHASE_PROXY, &mut |_: &str, _: &LogMessage| {}).is_ok());
+        let result = submit_unless_cancelled(&cancel, fake_submit(Some(cancel.clone()))).await;
+        assert_eq!(result.unwrap(), "booked");
+        assert!(cancel.is_cancelled());
+        assert_eq!(posts.load(Ordering::SeqCst), 1);
+    }
+
+    #[test]
+    fn test_doctor_mismatch() {
+        let roster = vec![
+            DepartmentDoctor { doctor_id: "101".into(), doctor_name: "张医生".into(), ..Default::default() },
+            DepartmentDoctor { doctor_id: "102".into(), doctor_name: "李医生".into(), ..Default::default() },
+        ];
+        // Listed without slots is still a match
+        assert!(doctor_mismatch(&["102".into()], &roster).is_none());
+        assert!(doctor_mismatch(&["1O1".into(), " 101 ".into()], &roster).is_none());
+
+        match doctor_mismatch(&["1O1".into()], &roster) {
+            Some(AppError::DoctorNotInDepartment { configured, available }) => {
+                assert_eq!(configured, "1O1");
+                assert_eq!(available, "张医生(101), 李医生(102)");
+            }
+            other => panic!("unexpected {:?}", other),
+        }
+    }
+
+    #[test]
+    fn test_classify_submit_message() {
+        assert_eq!(classify_submit_message("submit failed: 今日挂号次数已达上限"), SubmitFailureKind::DailyQuota);
+        assert_eq!(classify_submit_message("您在该科室的预约已达上限"), SubmitFailureKind::BookingLimit);
+        assert_eq!(classify_submit_message("请勿重复预约"), SubmitFailureKind::BookingLimit);
+        assert_eq!(classify_submit_message("操作太快，请稍后再试"), SubmitFailureKind::TooFast);
+        assert_eq!(classify_submit_message("号源已满"), SubmitFailureKind::SlotTaken);
+        assert_eq!(classify_submit_message("该号源已被预约"), SubmitFailureKind::SlotTaken);
+        assert_eq!(classify_submit_message("同一医生七天内只能预约一次"), SubmitFailureKind::SameDoctorLimit);
+        assert_eq!(classify_submit_message("该号源仅限实名认证用户预约"), SubmitFailureKind::VerificationRequired);
+        assert_eq!(classify_submit_message("该医生7天内已有预约"), SubmitFailureKind::SameDoctorLimit);
+        assert_eq!(classify_submit_message("请填写病情描述"), SubmitFailureKind::DiseaseRequired);
+        assert_eq!(classify_submit_message("病情描述不得少于20字"), SubmitFailureKind::DiseaseRequired);
+        assert_eq!(classify_submit_message("系统繁忙"), SubmitFailureKind::Other);
+    }
+
+    #[test]
+    fn test_pick_time_slot() {
+        let slots = vec![
+            TimeSlot { name: "08:00-08:30".into(), value: "1".into() },
+            TimeSlot { name: "09:00-09:30".into(), value: "2".into() },
+        ];
+        let preferred = vec!["09:00-09:30".to_string()];
+        assert_eq!(pick_time_slot(&slots, &preferred, None, false).unwrap().0.value, "2");
+        assert_eq!(pick_time_slot(&slots, &[], None, false).unwrap().0.value, "1");
+        // A clock time from a target date like "2026-10-20 09:00" picks the slot starting then
+        assert_eq!(pick_time_slot(&slots, &["09:00".to_string()], None, false).unwrap().0.value, "2");
+
+        let unmatched = vec!["10:00-10:30".to_string()];
+        assert_eq!(pick_time_slot(&slots, &unmatched, None, true).unwrap().0.value, "1");
+        assert!(pick_time_slot(&slots, &unmatched, None, false).is_none());
+        assert!(pick_time_slot(&[], &[], None, true).is_none());
+    }
+
+    #[test]
+    fn test_pick_time_slot_by_sequence() {
+        let slots = vec![
+            TimeSlot { name: "5号".into(), value: "5".into() },
+            TimeSlot { name: "3号".into(), value: "3".into() },
+            TimeSlot { name: "第12号".into(), value: "12".into() },
+            TimeSlot { name: "14:00-14:30".into(), value: "t".into() },
+        ];
+        let lowest = PreferSequence::Mode("lowest".into());
+        let highest = PreferSequence::Mode("highest".into());
+        let list = PreferSequence::Numbers(vec![7, 12, 3]);
+
+        let (slot, reason) = pick_time_slot(&slots, &[], Some(&lowest), false).unwrap();
+        assert_eq!((slot.value.as_str(), reason), ("3", "lowest available"));
+        assert_eq!(pick_time_slot(&slots, &[], Some(&highest), false).unwrap().0.value, "12");
+        let (slot, reason) = pick_time_slot(&slots, &[], Some(&list), false).unwrap();
+        assert_eq!((slot.value.as_str(), reason), ("12", "preferred sequence"));
+
+        // Unmatched numbers fall back to preferred hours, then first slot when allowed
+        let missing = PreferSequence::Numbers(vec![99]);
+        let preferred = vec!["14:00-14:30".to_string()];
+        assert_eq!(pick_time_slot(&slots, &preferred, Some(&missing), false).unwrap().0.value, "t");
+        assert_eq!(pick_time_slot(&slots, &[], Some(&missing), true).unwrap().0.value, "5");
+        assert!(pick_time_slot(&slots, &[], Some(&missing), false).is_none());
+
+        // Time-named schedules ignore the sequence preference
+        let timed = vec![TimeSlot { name: "08:00-08:30".into(), value: "1".into() }];
+        assert_eq!(pick_time_slot(&timed, &[], Some(&lowest), true).unwrap().0.value, "1");
+    }
+
+    #[test]
+    fn test_parse_sequence_number() {
+        assert_eq!(parse_sequence_number("3号"), Some(3));
+        assert_eq!(parse_sequence_number(" 第03号 "), Some(3));
+        assert_eq!(parse_sequence_number("12"), Some(12));
+        assert_eq!(parse_sequence_number("08:00-08:30"), None);
+        assert_eq!(parse_sequence_number("号"), None);
+    }
+
+    /// Clock that only moves when told to
+    struct FakeClock {
+        base: Instant,
+        offset_ms: std::sync::atomic::AtomicU64,
+    }
+
+    impl FakeClock {
+        fn advance(&self, ms: u64) {
+            self.offset_ms.fetch_add(ms, Ordering::SeqCst);
+        }
+    }
+
+    impl Clock for FakeClock {
+        fn now(&self) -> Instant {
+            self.base + Duration::from_millis(self.offset_ms.load(Ordering::SeqCst))
+        }
+    }
+
+    #[tokio::test]
+    async fn test_phase_timing_uses_clock() {
+        let clock = Arc::new(FakeClock { base: Instant::now(), offset_ms: Default::default() });
+        let grabber = Grabber::new(Arc::new(HealthClient::new().unwrap())).with_clock(clock.clone());
+
+        for ms in [100, 200, 300, 400, 2000] {
+            let started = grabber.begin_phase(PHASE_SCHEDULE).await;
+            clock.advance(ms);
+            assert_eq!(grabber.end_phase(PHASE_SCHEDULE, started).await, ms);
+        }
+        let started = grabber.begin_phase(PHASE_SUBMIT).await;
+        clock.advance(850);
+        grabber.end_phase(PHASE_SUBMIT, started).await;
+
+        let stats = grabber.stats().await;
+        let schedule = &stats.phases[PHASE_SCHEDULE];
+        assert_eq!((schedule.count, schedule.p50_ms, schedule.p95_ms, schedule.max_ms), (5, 300, 2000, 2000));
+        assert_eq!(grabber.phase_summary().await, "sched=0.3s submit=0.8s");
+    }
+
+    #[test]
+    fn test_booking_exclusions() {
+        let mut exclusions = BookingExclusions::default();
+        assert!(!exclusions.excludes("m1", "d1", "doc1", "2026-10-16"));
+
+        exclusions.record_booking("m1", "d1", "doc1", "2026-10-16");
+        assert!(exclusions.excludes("m1", "d1", "doc1", "2026-10-20"));
+        assert!(exclusions.excludes("m1", "d1", "doc2", "2026-10-16"));
+        assert!(!exclusions.excludes("m1", "d1", "doc2", "2026-10-17"));
+        assert!(!exclusions.excludes("m2", "d1", "doc1", "2026-10-16"));
+
+        assert!(exclusions.exclude_doctor("m1", "doc3"));
+        assert!(!exclusions.exclude_doctor("m1", "doc3"));
+    }
+
+    #[test]
+    fn test_detail_tally_all_unsupported() {
+        let mut tally = DetailTally::default();
+        assert_eq!(tally.all_unsupported(), None);
+
+        tally.fetched = 2;
+        tally.unsupported = 2;
+        tally.last_unsupported = Some(("flow".into(), "https://example/hlwyy".into()));
+        assert_eq!(tally.all_unsupported(), Some(("flow".into(), "https://example/hlwyy".into())));
+
+        // One schedule still served a normal booking page
+        tally.fetched = 3;
+        assert_eq!(tally.all_unsupported(), None);
+    }
+
+    #[test]
+    fn test_min_left_num_validation() {
+        let mut config: GrabConfig = serde_json::from_value(serde_json::json!({
+            "unit_id": "1", "dep_id": "2", "doctor_ids": [], "member_id": "3", "target_dates": ["2026-10-16"]
+        }))
+        .unwrap();
+        assert_eq!(config.min_left_num, 1);
+        assert!(config.validate().is_ok());
+
+        config.min_left_num = 0;
+        assert!(config.validate().is_err());
+    }
+
+    #[test]
+    fn test_start_time_timezone() {
+        let now = Local::now();
+        let mut config: GrabConfig = serde_json::from_value(serde_json::json!({
+            "unit_id": "1", "dep_id": "2", "member_id": "3", "target_dates": ["2026-10-16"], "start_time": "07:30:00"
+        }))
+        .unwrap();
+        let local = config.start_time_at(now).unwrap();
+        assert_eq!(local.format("%H:%M:%S").to_string(), "07:30:00");
+
+        config.start_time_timezone = START_TIME_ZONE_CHINA.into();
+        assert!(config.validate().is_ok());
+        let china = config.start_time_at(now).unwrap();
+        assert_eq!(china.with_timezone(&china_offset()).format("%H:%M:%S").to_string(), "07:30:00");
+
+        // Only machines off China Standard Time are warned, with both readings
+        let warning = start_time_zone_warning(&config, now);
+        assert_eq!(warning.is_some(), now.offset().fix() != china_offset());
+        if let Some(warning) = warning {
+            assert_eq!(warning.params["as_china"], china.format("%H:%M:%S").to_string());
+            assert_eq!(warning.params["zone"], START_TIME_ZONE_CHINA);
+        }
+
+        config.start_time_timezone = "UTC".into();
+        assert!(config.validate().is_err());
+    }
+
+    #[test]
+    fn test_resolve_pacing() {
+        let now = Local::now();
+        let mut config: GrabConfig = serde_json::from_value(serde_json::json!({
+            "unit_id": "1", "dep_id": "2", "doctor_ids": [], "member_id": "3", "target_dates": ["2026-10-16"]
+        }))
+        .unwrap();
+        let profile = PacingProfile {
+            min_schedule_interval: 1.5,
+            min_submit_interval: 3.0,
+            backoff_multiplier: 2.0,
+            ..Default::default()
+        };
+
+        assert_eq!(resolve_pacing(&config, None, now), Pacing::default());
+
+        let pacing = resolve_pacing(&config, Some(&profile), now);
+        assert_eq!(pacing.retry_interval, 1.5);
+        assert_eq!(pacing.submit_interval, Duration::from_secs(3));
+        assert_eq!(pacing.backoff_multiplier, 2.0);
+
+        // Explicit intervals override the profile
+        config.retry_interval = 0.8;
+        config.submit_interval = 2.0;
+        let pacing = resolve_pacing(&config, Some(&profile), now);
+        assert_eq!(pacing.retry_interval, 0.8);
+        assert_eq!(pacing.submit_interval, Duration::from_secs(2));
+        assert_eq!(pacing.backoff_multiplier, 2.0);
+
+        // Too short intervals are rejected, or clamped to the floor when allowed
+        config.retry_interval = 0.05;
+        assert!(config.validate().unwrap_err().contains("retry_interval"));
+        config.allow_fast_retry = true;
+        assert!(config.validate().is_ok());
+        assert_eq!(resolve_pacing(&config, Some(&profile), now).retry_interval, MIN_RETRY_INTERVAL_SECS);
+    }
+
+    #[test]
+    fn test_resolve_address_with_picked_area() {
+        let mut config: GrabConfig = serde_json::from_value(serde_json::json!({
+            "unit_id": "1", "dep_id": "2", "doctor_ids": [], "member_id": "3", "target_dates": ["2026-10-16"],
+            "address_area_id": "440305", "address_street": "科技园南路 1 号"
+        }))
+        .unwrap();
+        let mut detail = TicketDetail::default();
+        detail.address_id = "-1".into();
+        detail.address = "请选择城市地址".into();
+        let mut logs = Vec::new();
+        let mut on_log = |level: &str, message: &LogMessage| logs.push((level.to_string(), message.key.clone()));
+
+        let (id, text) = resolve_address(&config, &detail, &mut on_log);
+        assert_eq!(id, "440305");
+        assert!(text.ends_with("科技园南路 1 号"));
+
+        // A placeholder street is rejected and nothing usable is left
+        config.address_street = "请填写详细地址".into();
+        let (id, text) = resolve_address(&config, &detail, &mut on_log);
+        assert!(id.is_empty() && text.is_empty());
+        assert_eq!(logs, vec![("warn".to_string(), "address.area_invalid".to_string())]);
+    }
+
+    #[tokio::test]
+    async fn test_booking_window_dates() {
+        let today = Local::now().date_naive();
+        let near = (today + ChronoDuration::days(2)).format("%Y-%m-%d").to_string();
+        let far = (today + ChronoDuration::days(10)).format("%Y-%m-%d").to_string();
+        let mut config: GrabConfig = serde_json::from_value(serde_json::json!({
+            "unit_id": "1", "dep_id": "2", "doctor_ids": [], "member_id": "3", "target_dates": [near, far],
+            "booking_window_days": 7, "wait_for_window": true
+        }))
+        .unwrap();
+        let grabber = Grabber::new(Arc::new(HealthClient::new().unwrap()));
+        let mut logs = Vec::new();
+        let mut on_log = |level: &str, message: &LogMessage| logs.push((level.to_string(), message.key.clone()));
+
+        grabber.resolve_booking_window(&config, &[], &mut on_log).await;
+        assert_eq!(grabber.window_opening(&config).await, None);
+        let dates = grabber.dates_in_window(&config, config.target_dates.clone(), &mut on_log).await;
+        assert_eq!(dates, vec![near.clone()]);
+
+        // Only the far date left: idle until it opens three days from now
+        config.target_dates = vec![far.clone()];
+        assert_eq!(grabber.window_opening(&config).await, Some(today + ChronoDuration::days(3)));
+
+        // Without wait_for_window the far date is still queried
+        config.wait_for_window = false;
+        let dates = grabber.dates_in_window(&config, config.target_dates.clone(), &mut on_log).await;
+        assert_eq!(dates, vec![far]);
+
+        let keys: Vec<&str> = logs.iter().map(|(_, key)| key.as_str()).collect();
+        assert_eq!(keys, vec!["booking_window.configured", "booking_window.outside", "debug.booking_window_skip"]);
+    }
+
+    #[test]
+    fn test_duration_until_next_midnight() {
+        let wait = duration_until_next_midnight();
+        assert!(wait > Duration::ZERO);
+        assert!(wait <= Duration::from_secs(25 * 3600));
+    }
 }
@@ -0,0 +1,294 @@
+//! Session import from HAR captures
+//! Users who capture the 91160 mobile app through a proxy tool (Stream, HttpCanary) end up with a
+//! HAR file rather than cookie JSON. Entries are decoded one at a time and response bodies are
+//! skipped by the parser, so a capture of tens of MB never sits in memory as a whole.
+
+use std::collections::HashMap;
+use std::fmt;
+use std::fs::File;
+use std::io::BufReader;
+use std::path::Path;
+
+use chrono::{DateTime, Local};
+use serde::de::{Deserializer, SeqAccess, Visitor};
+use serde::{Deserialize, Serialize};
+
+use super::cookies::{cookie_key, has_access_hash, parse_set_cookie};
+use super::errors::{AppError, AppResult};
+use super::types::CookieRecord;
+
+/// Distinct cookies kept from one capture; later ones are counted as truncated
+const MAX_HAR_COOKIES: usize = 500;
+/// Domain given to cookies read from request headers, which carry none
+const REQUEST_COOKIE_DOMAIN: &str = ".91160.com";
+
+/// What an import took from a HAR file; cookie values are never included
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct HarImportReport {
+    pub path: String,
+    /// Entries in the capture
+    pub entries: usize,
+    /// Entries that went to a 91160 host
+    pub matched_entries: usize,
+    pub cookies: Vec<HarImportedCookie>,
+    /// More than MAX_HAR_COOKIES distinct cookies were seen
+    pub truncated: bool,
+}
+
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct HarImportedCookie {
+    pub name: String,
+    pub domain: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub expires: Option<DateTime<Local>>,
+}
+
+/// Read the 91160 cookies of a HAR file, the newest value of each cookie winning
+/// Fails when the capture holds no access_hash, i.e. it was not taken while logged in
+pub fn read_har_cookies(path: &Path) -> AppResult<(Vec<CookieRecord>, HarImportReport)> {
+    let reader = BufReader::new(File::open(path)?);
+    let har: HarFile = serde_json::from_reader(reader).map_err(|e| AppError::ParseError(format!("invalid HAR: {}", e)))?;
+    let collected = har.log.entries;
+
+    if !has_access_hash(&collected.records) {
+        return Err(AppError::ConfigError(format!(
+            "no 91160 login cookie (access_hash) in {} of {} entries; capture while logged in",
+            collected.matched_entries, collected.entries
+        )));
+    }
+    let report = HarImportReport {
+        path: path.display().to_string(),
+        entries: collected.entries,
+        matched_entries: collected.matched_entries,
+        cookies: collected
+            .records
+            .iter()
+            .map(|r| HarImportedCookie {
+                name: r.name.clone(),
+                domain: r.domain.clone(),
+                expires: r.expires,
+            })
+            .collect(),
+        truncated: collected.truncated,
+    };
+    Ok((collected.records, report))
+}
+
+fn is_91160_host(host: &str) -> bool {
+    host == "91160.com" || host.ends_with(".91160.com")
+}
+
+#[derive(Deserialize)]
+struct HarFile {
+    log: HarLog,
+}
+
+#[derive(Deserialize)]
+struct HarLog {
+    #[serde(deserialize_with = "collect_entries")]
+    entries: HarCookies,
+}
+
+#[derive(Deserialize)]
+struct HarEntry {
+    request: HarRequest,
+    #[serde(default)]
+    response: HarResponse,
+}
+
+#[derive(Deserialize)]
+struct HarRequest {
+    url: String,
+    #[serde(default)]
+    headers: Vec<HarHeader>,
+    #[serde(default)]
+    cookies: Vec<HarCookie>,
+}
+
+#[derive(Default, Deserialize)]
+struct HarResponse {
+    #[serde(default)]
+    headers: Vec<HarHeader>,
+    #[serde(default)]
+    cookies: Vec<HarCookie>,
+}
+
+#[derive(Deserialize)]
+struct HarHeader {
+    name: String,
+    value: String,
+}
+
+#[derive(Deserialize)]
+struct HarCookie {
+    name: String,
+    value: String,
+    #[serde(default)]
+    domain: Option<String>,
+    #[serde(default)]
+    path: Option<String>,
+    /// ISO 8601, or null for session cookies
+    #[serde(default)]
+    expires: Option<String>,
+}
+
+impl HarCookie {
+    fn into_record(self, default_domain: &str) -> CookieRecord {
+        CookieRecord {
+            name: self.name.trim().to_string(),
+            value: self.value.trim().to_string(),
+            domain: self.domain.filter(|d| !d.trim().is_empty()).unwrap_or_else(|| default_domain.to_string()),
+            path: self.path.filter(|p| !p.trim().is_empty()).unwrap_or_else(|| "/".into()),
+            expires: self
+                .expires
+                .and_then(|e| DateTime::parse_from_rfc3339(e.trim()).ok())
+                .map(|t| t.with_timezone(&Local)),
+            ..Default::default()
+        }
+    }
+}
+
+/// Cookies collected while the entries stream by
+#[derive(Default)]
+struct HarCookies {
+    records: Vec<CookieRecord>,
+    index: HashMap<String, usize>,
+    entries: usize,
+    matched_entries: usize,
+    truncated: bool,
+}
+
+impl HarCookies {
+    fn add_entry(&mut self, entry: HarEntry) {
+        self.entries += 1;
+        let Some(host) = url::Url::parse(&entry.request.url).ok().and_then(|u| u.host_str().map(str::to_lowercase)) else {
+            return;
+        };
+        if !is_91160_host(&host) {
+            return;
+        }
+        self.matched_entries += 1;
+
+        for header in entry.request.headers.iter().filter(|h| h.name.eq_ignore_ascii_case("cookie")) {
+            for (name, value) in header.value.split(';').filter_map(|pair| pair.split_once('=')) {
+                self.add(CookieRecord {
+                    name: name.trim().to_string(),
+                    value: value.trim().to_string(),
+                    domain: REQUEST_COOKIE_DOMAIN.into(),
+                    path: "/".into(),
+                    ..Default::default()
+                });
+            }
+        }
+        for cookie in entry.request.cookies {
+            self.add(cookie.into_record(REQUEST_COOKIE_DOMAIN));
+        }
+        // Some tools fold several Set-Cookie headers into one value, one per line
+        for header in entry.response.headers.iter().filter(|h| h.name.eq_ignore_ascii_case("set-cookie")) {
+            for line in header.value.lines() {
+                if let Some(record) = parse_set_cookie(line, &host) {
+                    self.add(record);
+                }
+            }
+        }
+        for cookie in entry.response.cookies {
+            self.add(cookie.into_record(&host));
+        }
+    }
+
+    /// Keep the newest value of a cookie; an expiry seen for the same value is not lost to a
+    /// later request header, which carries none
+    fn add(&mut self, record: CookieRecord) {
+        if record.name.is_empty() || record.value.is_empty() {
+            return;
+        }
+        let key = cookie_key(&record);
+        match self.index.get(&key) {
+            Some(&i) => {
+                let existing = &mut self.records[i];
+                let expires = if existing.value == record.value { record.expires.or(existing.expires) } else { record.expires };
+                *existing = CookieRecord { expires, ..record };
+            }
+            None if self.records.len() >= MAX_HAR_COOKIES => self.truncated = true,
+            None => {
+                self.index.insert(key, self.records.len());
+                self.records.push(record);
+            }
+        }
+    }
+}
+
+fn collect_entries<'de, D: Deserializer<'de>>(deserializer: D) -> Result<HarCookies, D::Error> {
+    deserializer.deserialize_seq(EntriesVisitor)
+}
+
+struct EntriesVisitor;
+
+impl<'de> Visitor<'de> for EntriesVisitor {
+    type Value = HarCookies;
+
+    fn expecting(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        f.write_str("a list of HAR entries")
+    }
+
+    fn visit_seq<A: SeqAccess<'de>>(self, mut seq: A) -> Result<Self::Value, A::Error> {
+        let mut cookies = HarCookies::default();
+        while let Some(entry) = seq.next_element::<HarEntry>()? {
+            cookies.add_entry(entry);
+        }
+        Ok(cookies)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::path::PathBuf;
+
+    fn fixture(name: &str) -> PathBuf {
+        PathBuf::from(env!("CARGO_MANIFEST_DIR")).join("testdata").join("har").join(name)
+    }
+
+    #[test]
+    fn test_read_mobile_capture() {
+        let (records, report) = read_har_cookies(&fixture("mobile_capture.har")).unwrap();
+        assert_eq!((report.entries, report.matched_entries), (4, 3));
+        assert!(!report.truncated);
+
+        let find = |name: &str| records.iter().find(|r| r.name == name).unwrap();
+        // The Set-Cookie rotation wins over the value the first request sent
+        let access = find("access_hash");
+        assert_eq!((access.value.as_str(), access.domain.as_str()), ("hash-new", ".91160.com"));
+        assert!(access.expires.is_some());
+        assert_eq!(find("PHPSESSID").domain, "user.91160.com");
+        assert!(find("PHPSESSID").expires.is_some());
+        assert!(records.iter().all(|r| r.name != "tracker"));
+    }
+
+    #[test]
+    fn test_reject_capture_without_login() {
+        let error = read_har_cookies(&fixture("logged_out.har")).unwrap_err().to_string();
+        assert!(error.contains("access_hash"), "{}", error);
+    }
+
+    #[test]
+    fn test_large_bodies_are_skipped() {
+        let body = "x".repeat(4 << 20);
+        let entries: Vec<serde_json::Value> = (0..4)
+            .map(|i| {
+                serde_json::json!({
+                    "request": {"url": format!("https://gate.91160.com/api/{}", i), "headers": [{"name": "Cookie", "value": format!("access_hash=h{}", i)}]},
+                    "response": {"headers": [], "content": {"text": body}}
+                })
+            })
+            .collect();
+        let path = std::env::temp_dir().join(format!("skylinemed_har_{}.har", std::process::id()));
+        std::fs::write(&path, serde_json::to_vec(&serde_json::json!({"log": {"version": "1.2", "entries": entries}})).unwrap()).unwrap();
+
+        let (records, report) = read_har_cookies(&path).unwrap();
+        let _ = std::fs::remove_file(&path);
+        assert_eq!(report.entries, 4);
+        assert_eq!(records.len(), 1);
+        assert_eq!(records[0].value, "h3");
+    }
+}
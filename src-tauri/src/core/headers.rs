@@ -0,0 +1,124 @@
+//! User-configured extra request headers for QuickDoctor
+//! Lets blocks be diagnosed by trying header variants without a rebuild; stored under "extra_headers" in user state.
+
+use std::collections::BTreeMap;
+
+use reqwest::header::{HeaderMap, HeaderName, HeaderValue};
+
+use super::types::{ActiveExtraHeaders, ExtraHeaders};
+
+/// Headers that must stay under the client's control
+const BLOCKED_HEADERS: [&str; 2] = ["host", "cookie"];
+/// Scope name of the headers applied to every host
+pub const GLOBAL_SCOPE: &str = "*";
+
+/// Whether a host is the domain itself or one of its subdomains
+fn host_matches(host: &str, domain: &str) -> bool {
+    let host = host.to_lowercase();
+    let domain = domain.trim().trim_start_matches('.').to_lowercase();
+    !domain.is_empty() && (host == domain || host.ends_with(&format!(".{}", domain)))
+}
+
+/// Parse a configured header, rejecting blocked and malformed ones
+fn parse_header(name: &str, value: &str) -> Option<(HeaderName, HeaderValue)> {
+    let name = HeaderName::from_bytes(name.trim().as_bytes()).ok()?;
+    if BLOCKED_HEADERS.contains(&name.as_str()) {
+        return None;
+    }
+    Some((name, HeaderValue::from_str(value.trim()).ok()?))
+}
+
+impl ExtraHeaders {
+    /// Whether no headers are configured
+    pub fn is_empty(&self) -> bool {
+        self.global.is_empty() && self.domains.values().all(|h| h.is_empty())
+    }
+
+    /// Apply the headers for a host; domain-scoped values override global ones
+    pub fn apply(&self, host: &str, headers: &mut HeaderMap) {
+        let scoped = self
+            .domains
+            .iter()
+            .filter(|(domain, _)| host_matches(host, domain))
+            .flat_map(|(_, h)| h.iter());
+        for (name, value) in self.global.iter().chain(scoped) {
+            if let Some((name, value)) = parse_header(name, value) {
+                headers.insert(name, value);
+            }
+        }
+    }
+
+    /// Headers that will be sent per scope, plus the ones that were rejected
+    pub fn active(&self) -> ActiveExtraHeaders {
+        let mut active = ActiveExtraHeaders::default();
+        let scopes = std::iter::once((GLOBAL_SCOPE.to_string(), &self.global))
+            .chain(self.domains.iter().map(|(domain, h)| (domain.clone(), h)));
+        for (scope, headers) in scopes {
+            let mut applied = BTreeMap::new();
+            for (name, value) in headers {
+                match parse_header(name, value) {
+                    Some((name, value)) => {
+                        applied.insert(name.to_string(), value.to_str().unwrap_or_default().to_string());
+                    }
+                    None => active.rejected.push(format!("{}: {}", scope, name)),
+                }
+            }
+            if !applied.is_empty() {
+                active.scopes.insert(scope, applied);
+            }
+        }
+        active
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::collections::HashMap;
+
+    fn map(pairs: &[(&str, &str)]) -> HashMap<String, String> {
+        pairs.iter().map(|(k, v)| (k.to_string(), v.to_string())).collect()
+    }
+
+    #[test]
+    fn test_domain_scoping() {
+        let extra = ExtraHeaders {
+            global: map(&[("Accept-Language", "en-US"), ("X-Debug", "global")]),
+            domains: [("gate.91160.com".to_string(), map(&[("Sec-Fetch-Site", "same-site"), ("X-Debug", "gate")]))]
+                .into_iter()
+                .collect(),
+        };
+
+        let mut gate = HeaderMap::new();
+        extra.apply("gate.91160.com", &mut gate);
+        assert_eq!(gate["x-debug"], "gate");
+        assert_eq!(gate["sec-fetch-site"], "same-site");
+        assert_eq!(gate["accept-language"], "en-US");
+
+        let mut www = HeaderMap::new();
+        www.insert("sec-fetch-site", HeaderValue::from_static("same-origin"));
+        extra.apply("www.91160.com", &mut www);
+        assert_eq!(www["x-debug"], "global");
+        assert_eq!(www["sec-fetch-site"], "same-origin");
+
+        assert!(host_matches("gate.91160.com", ".91160.com"));
+        assert!(!host_matches("evil91160.com", "91160.com"));
+    }
+
+    #[test]
+    fn test_blocklist() {
+        let extra = ExtraHeaders {
+            global: map(&[("Host", "evil.example"), ("cookie", "access_hash=x"), ("X-Ok", "1"), ("bad header", "v")]),
+            domains: HashMap::new(),
+        };
+
+        let mut headers = HeaderMap::new();
+        extra.apply("www.91160.com", &mut headers);
+        assert_eq!(headers.len(), 1);
+        assert_eq!(headers["x-ok"], "1");
+
+        let active = extra.active();
+        assert_eq!(active.scopes[GLOBAL_SCOPE].len(), 1);
+        assert_eq!(active.rejected.len(), 3);
+    }
+}
@@ -0,0 +1,59 @@
+//! Grab history for SkylineMed
+//! Persists notable grab events so the user can see why a run stopped
+
+use chrono::Local;
+use serde::{Deserialize, Serialize};
+
+use super::errors::AppResult;
+use super::store::{store, Store};
+
+const MAX_HISTORY_ENTRIES: usize = 500;
+
+/// History entry kinds
+pub const HISTORY_KIND_QUOTA_EXCEEDED: &str = "quota_exceeded";
+pub const HISTORY_KIND_WAITLISTED: &str = "waitlisted";
+pub const HISTORY_KIND_TASK_FINISHED: &str = "task_finished";
+
+/// A single history entry
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct HistoryEntry {
+    pub time: String,
+    pub kind: String,
+    #[serde(default)]
+    pub unit_id: String,
+    #[serde(default)]
+    pub dep_id: String,
+    #[serde(default)]
+    pub member_id: String,
+    #[serde(default)]
+    pub message: String,
+}
+
+impl HistoryEntry {
+    /// Create a new entry stamped with the current local time
+    pub fn new(kind: &str, message: &str) -> Self {
+        Self {
+            time: Local::now().format("%Y-%m-%d %H:%M:%S").to_string(),
+            kind: kind.to_string(),
+            unit_id: String::new(),
+            dep_id: String::new(),
+            member_id: String::new(),
+            message: message.to_string(),
+        }
+    }
+}
+
+/// Load history entries, oldest first
+pub fn load_history() -> AppResult<Vec<HistoryEntry>> {
+    store()?.history()
+}
+
+/// Append an entry to the history, dropping the oldest entries past the cap
+pub fn append_history(entry: HistoryEntry) -> AppResult<()> {
+    append_history_in(store()?, entry)
+}
+
+/// Append an entry to the history kept in store
+pub fn append_history_in(store: &dyn Store, entry: HistoryEntry) -> AppResult<()> {
+    store.append_history(&entry, MAX_HISTORY_ENTRIES)
+}
@@ -0,0 +1,140 @@
+//! External commands run when a grab finishes, for user automation
+//! Only read from user state: a grab config may be imported from someone else and must never run commands.
+
+use std::process::Stdio;
+use std::time::Duration;
+
+use tokio::io::AsyncWriteExt;
+use tokio::process::Command;
+
+use super::errors::{AppError, AppResult};
+use super::types::{GrabResult, HookCommand};
+
+/// Captured output beyond this many bytes per stream is cut off
+const HOOK_OUTPUT_LIMIT: usize = 4096;
+
+/// Output of a finished hook command
+#[derive(Debug, Clone)]
+pub struct HookOutput {
+    pub code: Option<i32>,
+    pub stdout: String,
+    pub stderr: String,
+}
+
+/// Replace {placeholders} in an argument with fields of the grab result
+pub fn expand_placeholders(arg: &str, result: &GrabResult) -> String {
+    let detail = result.detail.as_ref();
+    let field = |f: fn(&super::types::GrabSuccess) -> &str| detail.map(f).unwrap_or_default().to_string();
+    [
+        ("{message}", result.message.clone()),
+        ("{kind}", field(|d| &d.kind)),
+        ("{unit}", field(|d| &d.unit_name)),
+        ("{dep}", field(|d| &d.dep_name)),
+        ("{doctor}", field(|d| &d.doctor_name)),
+        ("{date}", field(|d| &d.date)),
+        ("{time}", field(|d| &d.time_slot)),
+        ("{member}", field(|d| &d.member_name)),
+        ("{payment_url}", field(|d| d.payment_url.as_deref().unwrap_or_default())),
+        ("{payment_deadline}", field(|d| d.payment_deadline.as_deref().unwrap_or_default())),
+    ]
+    .iter()
+    .fold(arg.to_string(), |acc, (placeholder, value)| acc.replace(placeholder, value))
+}
+
+/// Lossy UTF-8 of captured output, cut to HOOK_OUTPUT_LIMIT bytes
+fn captured(bytes: &[u8]) -> String {
+    let text = String::from_utf8_lossy(&bytes[..bytes.len().min(HOOK_OUTPUT_LIMIT)]).trim().to_string();
+    if bytes.len() > HOOK_OUTPUT_LIMIT {
+        format!("{}...", text)
+    } else {
+        text
+    }
+}
+
+/// Run a hook with the given JSON on stdin; the process is killed when the timeout passes
+pub async fn run_hook(hook: &HookCommand, result: &GrabResult, stdin_json: &str) -> AppResult<HookOutput> {
+    if hook.path.trim().is_empty() {
+        return Err(AppError::ConfigError("hook command path is empty".into()));
+    }
+
+    let mut child = Command::new(hook.path.trim())
+        .args(hook.args.iter().map(|arg| expand_placeholders(arg, result)))
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .kill_on_drop(true)
+        .spawn()?;
+
+    if let Some(mut stdin) = child.stdin.take() {
+        // A command that ignores stdin may close it early; that is not an error
+        let _ = stdin.write_all(stdin_json.as_bytes()).await;
+    }
+
+    let timeout = Duration::from_secs_f64(hook.timeout_seconds.max(1.0));
+    match tokio::time::timeout(timeout, child.wait_with_output()).await {
+        Ok(output) => {
+            let output = output?;
+            Ok(HookOutput {
+                code: output.status.code(),
+                stdout: captured(&output.stdout),
+                stderr: captured(&output.stderr),
+            })
+        }
+        Err(_) => Err(AppError::Timeout(format!("hook {} after {:.0}s", hook.path, timeout.as_secs_f64()))),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::core::types::{GrabSuccess, GRAB_SUCCESS_BOOKED};
+
+    fn success() -> GrabResult {
+        GrabResult {
+            success: true,
+            message: "success".into(),
+            detail: Some(GrabSuccess {
+                kind: GRAB_SUCCESS_BOOKED.into(),
+                unit_name: "市一医院".into(),
+                dep_name: "儿科".into(),
+                doctor_name: "张医生".into(),
+                date: "2026-10-16".into(),
+                time_slot: "08:00-08:30".into(),
+                member_name: "张三".into(),
+                url: None,
+                ..Default::default()
+            }),
+        }
+    }
+
+    #[test]
+    fn test_expand_placeholders() {
+        assert_eq!(expand_placeholders("{doctor} {date} {time}", &success()), "张医生 2026-10-16 08:00-08:30");
+        let failure = GrabResult { success: false, message: "max retries reached".into(), detail: None };
+        assert_eq!(expand_placeholders("[{doctor}] {message}", &failure), "[] max retries reached");
+    }
+
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn test_run_hook_passes_stdin_and_args() {
+        let hook = HookCommand {
+            path: "sh".into(),
+            args: vec!["-c".into(), "cat; echo \" $0\"".into(), "{doctor}".into()],
+            timeout_seconds: 5.0,
+        };
+        let output = run_hook(&hook, &success(), r#"{"ok":true}"#).await.unwrap();
+        assert_eq!(output.code, Some(0));
+        assert_eq!(output.stdout, r#"{"ok":true} 张医生"#);
+    }
+
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn test_run_hook_timeout() {
+        let hook = HookCommand {
+            path: "sleep".into(),
+            args: vec!["5".into()],
+            timeout_seconds: 1.0,
+        };
+        assert!(matches!(run_hook(&hook, &success(), "{}").await, Err(AppError::Timeout(_))));
+    }
+}
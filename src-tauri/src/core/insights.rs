@@ -0,0 +1,308 @@
+//! Learned booking windows per department
+//! Grab runs note when a schedule date first turned bookable and when it sold out; over weeks
+//! the store shows when a unit/dep usually releases slots and how fast they go.
+//! Only transitions are written, never every poll, and the data is bounded in size.
+
+use std::collections::HashMap;
+
+use chrono::{DateTime, Duration, Local, Timelike};
+use serde::{Deserialize, Serialize};
+
+use super::errors::AppResult;
+use super::store::{store, Store};
+
+/// Schedule dates remembered per department; the oldest releases are dropped first
+const MAX_TRACKED_DATES: usize = 120;
+/// Departments remembered; the least recently updated are dropped first
+const MAX_DEPARTMENTS: usize = 50;
+/// A release only counts towards the pattern when the date was seen unbookable this shortly before
+const MAX_RELEASE_UNCERTAINTY_SECS: i64 = 600;
+/// Suggested start_time leads the usual release minute by this much
+const SUGGESTION_LEAD_SECS: i64 = 30;
+
+/// A bookability change of one schedule date, as seen by a run
+#[derive(Debug, Clone, PartialEq)]
+pub enum AvailabilityChange {
+    /// Slots with left_num > 0 appeared; unbookable_at is when the run last saw none, if it did
+    Released {
+        at: DateTime<Local>,
+        unbookable_at: Option<DateTime<Local>>,
+    },
+    /// No slot with left_num > 0 is left
+    SoldOut { at: DateTime<Local> },
+}
+
+/// What is known about one schedule date of a department
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ReleaseRecord {
+    pub sch_date: String,
+    /// First time a run saw the date bookable
+    pub released_at: DateTime<Local>,
+    /// How long before released_at the date was last seen unbookable; None when the run started
+    /// after the release, so released_at only bounds it from above
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub uncertainty_secs: Option<i64>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub sold_out_at: Option<DateTime<Local>>,
+}
+
+impl ReleaseRecord {
+    /// Whether released_at is close enough to the real release to learn from
+    fn is_precise(&self) -> bool {
+        self.uncertainty_secs.map_or(false, |secs| secs <= MAX_RELEASE_UNCERTAINTY_SECS)
+    }
+
+    /// Best estimate of the release: the middle of the window it happened in
+    fn estimated_release(&self) -> DateTime<Local> {
+        self.released_at - Duration::seconds(self.uncertainty_secs.unwrap_or(0) / 2)
+    }
+}
+
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct DepartmentStats {
+    #[serde(default)]
+    pub releases: Vec<ReleaseRecord>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub updated_at: Option<DateTime<Local>>,
+}
+
+impl DepartmentStats {
+    /// Apply a change; false when it told nothing new
+    pub fn record(&mut self, sch_date: &str, change: &AvailabilityChange) -> bool {
+        let existing = self.releases.iter_mut().find(|r| r.sch_date == sch_date);
+        let changed = match (change, existing) {
+            (AvailabilityChange::Released { at, unbookable_at }, None) => {
+                self.releases.push(ReleaseRecord {
+                    sch_date: sch_date.to_string(),
+                    released_at: *at,
+                    uncertainty_secs: unbookable_at.map(|u| (*at - u).num_seconds().max(0)),
+                    sold_out_at: None,
+                });
+                true
+            }
+            // A run that watched the release happen replaces one that only found it released
+            (AvailabilityChange::Released { at, unbookable_at: Some(u) }, Some(record)) if record.uncertainty_secs.is_none() => {
+                *record = ReleaseRecord {
+                    sch_date: sch_date.to_string(),
+                    released_at: *at,
+                    uncertainty_secs: Some((*at - *u).num_seconds().max(0)),
+                    sold_out_at: None,
+                };
+                true
+            }
+            (AvailabilityChange::SoldOut { at }, Some(record)) if record.sold_out_at.is_none() && *at > record.released_at => {
+                record.sold_out_at = Some(*at);
+                true
+            }
+            _ => false,
+        };
+        if changed && self.releases.len() > MAX_TRACKED_DATES {
+            self.releases.sort_by_key(|r| r.released_at);
+            let excess = self.releases.len() - MAX_TRACKED_DATES;
+            self.releases.drain(..excess);
+        }
+        changed
+    }
+
+    /// The learned pattern of this department
+    pub fn insights(&self, unit_id: &str, dep_id: &str) -> DepartmentInsights {
+        let precise: Vec<&ReleaseRecord> = self.releases.iter().filter(|r| r.is_precise()).collect();
+
+        let mut buckets: HashMap<(String, String), usize> = HashMap::new();
+        let mut minutes: HashMap<String, usize> = HashMap::new();
+        for record in &precise {
+            let minute = round_to_minute(record.estimated_release());
+            let time = minute.format("%H:%M").to_string();
+            *buckets.entry((minute.format("%a").to_string(), time.clone())).or_default() += 1;
+            *minutes.entry(time).or_default() += 1;
+        }
+        let mut release_histogram: Vec<ReleaseBucket> = buckets
+            .into_iter()
+            .map(|((weekday, time), count)| ReleaseBucket { weekday, time, count })
+            .collect();
+        release_histogram.sort_by(|a, b| b.count.cmp(&a.count).then_with(|| a.time.cmp(&b.time)).then_with(|| a.weekday.cmp(&b.weekday)));
+
+        let mut sellouts: Vec<i64> = self
+            .releases
+            .iter()
+            .filter_map(|r| Some((r.sold_out_at? - r.released_at).num_seconds()))
+            .collect();
+        sellouts.sort_unstable();
+        let median_sellout_secs = match sellouts.len() {
+            0 => None,
+            n if n % 2 == 1 => Some(sellouts[n / 2]),
+            n => Some((sellouts[n / 2 - 1] + sellouts[n / 2]) / 2),
+        };
+
+        // Ties go to the earlier minute, so the suggestion never starts after a known release
+        let suggestion = minutes
+            .into_iter()
+            .max_by(|a, b| a.1.cmp(&b.1).then_with(|| b.0.cmp(&a.0)))
+            .and_then(|(time, backed_by)| {
+                let release = chrono::NaiveTime::parse_from_str(&time, "%H:%M").ok()?;
+                let start = release - Duration::seconds(SUGGESTION_LEAD_SECS);
+                Some(StartTimeSuggestion {
+                    start_time: start.format("%H:%M:%S").to_string(),
+                    release_time: time,
+                    backed_by,
+                    observations: precise.len(),
+                })
+            });
+
+        DepartmentInsights {
+            unit_id: unit_id.trim().to_string(),
+            dep_id: dep_id.trim().to_string(),
+            dates_tracked: self.releases.len(),
+            observations: precise.len(),
+            release_histogram,
+            sellout_observations: sellouts.len(),
+            median_sellout_secs,
+            suggestion,
+            updated_at: self.updated_at,
+        }
+    }
+}
+
+/// Releases seen at one weekday and minute, in local time
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ReleaseBucket {
+    /// "Mon".."Sun"
+    pub weekday: String,
+    /// "HH:MM"
+    pub time: String,
+    pub count: usize,
+}
+
+/// Suggested start_time, to be read as local time
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct StartTimeSuggestion {
+    /// "HH:MM:SS", SUGGESTION_LEAD_SECS before release_time
+    pub start_time: String,
+    /// Most frequent release minute, "HH:MM"
+    pub release_time: String,
+    /// Observed releases at release_time
+    pub backed_by: usize,
+    /// Observed releases in total; backed_by of observations is the support of the suggestion
+    pub observations: usize,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct DepartmentInsights {
+    pub unit_id: String,
+    pub dep_id: String,
+    /// Schedule dates seen released, including ones whose release time is unknown
+    pub dates_tracked: usize,
+    /// Releases watched closely enough to learn the release time from
+    pub observations: usize,
+    /// Most frequent first
+    pub release_histogram: Vec<ReleaseBucket>,
+    pub sellout_observations: usize,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub median_sellout_secs: Option<i64>,
+    /// None until at least one release was observed
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub suggestion: Option<StartTimeSuggestion>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub updated_at: Option<DateTime<Local>>,
+}
+
+fn round_to_minute(at: DateTime<Local>) -> DateTime<Local> {
+    let at = at + Duration::seconds(30);
+    at - Duration::seconds(at.second() as i64) - Duration::nanoseconds(at.nanosecond() as i64)
+}
+
+fn department_key(unit_id: &str, dep_id: &str) -> String {
+    format!("{}/{}", unit_id.trim(), dep_id.trim())
+}
+
+/// Load the stats of all departments; nothing recorded is empty
+pub fn load_department_stats() -> AppResult<HashMap<String, DepartmentStats>> {
+    store()?.department_stats()
+}
+
+/// Record a bookability change of a schedule date; the store is only written when it changed
+pub fn record_availability_change(store: &dyn Store, unit_id: &str, dep_id: &str, sch_date: &str, change: &AvailabilityChange) -> AppResult<()> {
+    store.update_department_stats(&department_key(unit_id, dep_id), MAX_DEPARTMENTS, &mut |stats: &mut DepartmentStats| {
+        if !stats.record(sch_date, change) {
+            return false;
+        }
+        stats.updated_at = Some(Local::now());
+        true
+    })
+}
+
+/// The learned pattern of a department; empty when nothing was recorded yet
+pub fn department_insights(unit_id: &str, dep_id: &str) -> AppResult<DepartmentInsights> {
+    let all = load_department_stats()?;
+    let stats = all.get(&department_key(unit_id, dep_id)).cloned().unwrap_or_default();
+    Ok(stats.insights(unit_id, dep_id))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use chrono::TimeZone;
+
+    fn at(day: u32, h: u32, m: u32, s: u32) -> DateTime<Local> {
+        Local.with_ymd_and_hms(2026, 9, day, h, m, s).unwrap()
+    }
+
+    fn released(day: u32, h: u32, m: u32, s: u32, before_secs: i64) -> AvailabilityChange {
+        let at = at(day, h, m, s);
+        AvailabilityChange::Released { at, unbookable_at: Some(at - Duration::seconds(before_secs)) }
+    }
+
+    #[test]
+    fn test_record_transitions() {
+        let mut stats = DepartmentStats::default();
+        // Found already released: kept, but not learned from
+        assert!(stats.record("2026-09-08", &AvailabilityChange::Released { at: at(1, 16, 0, 0), unbookable_at: None }));
+        assert!(!stats.record("2026-09-08", &AvailabilityChange::Released { at: at(1, 16, 5, 0), unbookable_at: None }));
+        assert_eq!(stats.insights("1", "2").observations, 0);
+
+        // A run that watched the release wins
+        assert!(stats.record("2026-09-08", &released(2, 15, 0, 1, 1)));
+        assert!(stats.record("2026-09-08", &AvailabilityChange::SoldOut { at: at(2, 15, 2, 1) }));
+        assert!(!stats.record("2026-09-08", &AvailabilityChange::SoldOut { at: at(2, 15, 9, 0) }));
+        // Sold out without a known release tells nothing
+        assert!(!stats.record("2026-09-09", &AvailabilityChange::SoldOut { at: at(2, 15, 9, 0) }));
+        assert_eq!(stats.releases.len(), 1);
+        assert_eq!(stats.releases[0].sold_out_at, Some(at(2, 15, 2, 1)));
+    }
+
+    #[test]
+    fn test_insights_pattern() {
+        let mut stats = DepartmentStats::default();
+        stats.record("2026-09-08", &released(1, 15, 0, 1, 1));
+        stats.record("2026-09-08", &AvailabilityChange::SoldOut { at: at(1, 15, 1, 1) });
+        stats.record("2026-09-09", &released(2, 14, 59, 58, 2));
+        stats.record("2026-09-09", &AvailabilityChange::SoldOut { at: at(2, 15, 3, 58) });
+        stats.record("2026-09-10", &released(3, 20, 0, 0, 1));
+        // Too coarse to say when it happened
+        stats.record("2026-09-11", &released(4, 9, 0, 0, 3600));
+
+        let insights = stats.insights("1", "2");
+        assert_eq!((insights.dates_tracked, insights.observations), (4, 3));
+        assert_eq!(insights.release_histogram.len(), 3);
+        assert!(insights.release_histogram.iter().all(|b| b.count == 1));
+        assert_eq!(insights.sellout_observations, 2);
+        assert_eq!(insights.median_sellout_secs, Some(150));
+        assert_eq!(
+            insights.suggestion,
+            Some(StartTimeSuggestion { start_time: "14:59:30".into(), release_time: "15:00".into(), backed_by: 2, observations: 3 })
+        );
+
+        assert_eq!(DepartmentStats::default().insights("1", "2").suggestion, None);
+    }
+
+    #[test]
+    fn test_tracked_dates_are_bounded() {
+        let mut stats = DepartmentStats::default();
+        for i in 0..(MAX_TRACKED_DATES + 10) {
+            let at = at(1, 8, 0, 0) + Duration::minutes(i as i64);
+            stats.record(&format!("d{}", i), &AvailabilityChange::Released { at, unbookable_at: None });
+        }
+        assert_eq!(stats.releases.len(), MAX_TRACKED_DATES);
+        assert_eq!(stats.releases[0].sch_date, "d10");
+    }
+}
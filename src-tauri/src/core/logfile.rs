@@ -0,0 +1,297 @@
+//! Per-grab debug log files for QuickDoctor
+//! Each grab run writes JSON lines (one LogEntry per line) to logs/grab_debug_<timestamp>.log
+
+use std::collections::VecDeque;
+use std::fs::{self, File, OpenOptions};
+use std::io::{Read, Seek, SeekFrom, Write};
+use std::path::{Path, PathBuf};
+
+use super::errors::AppResult;
+use super::memory::{record_evictions, set_log_ring_size, Buffer, MemoryBudget};
+use super::messages::LogMessage;
+use super::paths::logs_dir;
+use super::types::LogEntry;
+
+const GRAB_LOG_PREFIX: &str = "grab_debug_";
+const GRAB_LOG_SUFFIX: &str = ".log";
+const TAIL_CHUNK_SIZE: u64 = 4096;
+pub const DEFAULT_RECENT_LOG_LINES: usize = 200;
+
+/// Level of records kept only in the flight recorder and the file log, never shown in the UI
+pub const LEVEL_DEBUG: &str = "debug";
+/// Param tying an error to the debug records flushed for it
+pub const CORRELATION_PARAM: &str = "correlation_id";
+/// Param carrying the time a flushed debug record was taken
+const RECORDED_AT_PARAM: &str = "recorded_at";
+
+/// Appends log entries of one grab run to its debug log file
+pub struct GrabLogWriter {
+    file: File,
+}
+
+impl GrabLogWriter {
+    /// Create a new log file for a grab run
+    pub fn create() -> AppResult<Self> {
+        let name = format!(
+            "{}{}{}",
+            GRAB_LOG_PREFIX,
+            chrono::Local::now().format("%Y%m%d_%H%M%S"),
+            GRAB_LOG_SUFFIX
+        );
+        let path = logs_dir()?.join(name);
+        let file = OpenOptions::new().create(true).append(true).open(path)?;
+        Ok(Self { file })
+    }
+
+    /// Append one entry with the rendered text plus raw key and params
+    pub fn write(&mut self, level: &str, rendered: &str, message: &LogMessage) -> AppResult<()> {
+        let entry = LogEntry {
+            time: chrono::Local::now().format("%Y-%m-%d %H:%M:%S").to_string(),
+            level: level.to_string(),
+            message: rendered.to_string(),
+            key: message.key.clone(),
+            params: message.params.clone(),
+        };
+        writeln!(self.file, "{}", serde_json::to_string(&entry)?)?;
+        Ok(())
+    }
+}
+
+/// Ring buffer of recent debug records, flushed when an error is logged
+/// Gives the context around a failure without running with debug output all the time
+pub struct FlightRecorder {
+    records: VecDeque<LogMessage>,
+    capacity: usize,
+    max_bytes: usize,
+    bytes: usize,
+    flushes: u32,
+}
+
+impl FlightRecorder {
+    pub fn new(capacity: usize, max_bytes: usize) -> Self {
+        Self {
+            records: VecDeque::new(),
+            capacity: capacity.max(1),
+            max_bytes,
+            bytes: 0,
+            flushes: 0,
+        }
+    }
+
+    /// Keep a debug record, dropping the oldest while over the record or byte cap
+    pub fn record(&mut self, message: &LogMessage) {
+        let at = chrono::Local::now().format("%H:%M:%S%.3f").to_string();
+        let record = message.clone().param(RECORDED_AT_PARAM, at);
+        self.bytes += message_bytes(&record);
+        self.records.push_back(record);
+
+        let mut evicted = 0;
+        while self.records.len() > self.capacity || (self.bytes > self.max_bytes && self.records.len() > 1) {
+            if let Some(old) = self.records.pop_front() {
+                self.bytes -= message_bytes(&old);
+                evicted += 1;
+            }
+        }
+        record_evictions(Buffer::LogRing, evicted);
+        set_log_ring_size(self.records.len(), self.bytes);
+    }
+
+    /// Buffered records and their captured bytes
+    pub fn size(&self) -> (usize, usize) {
+        (self.records.len(), self.bytes)
+    }
+
+    /// Take the buffered records, each tagged with a fresh correlation id that is returned too
+    pub fn flush(&mut self) -> (String, Vec<LogMessage>) {
+        self.flushes += 1;
+        let correlation_id = format!("{}-{}", chrono::Local::now().format("%H%M%S"), self.flushes);
+        let records = self
+            .records
+            .drain(..)
+            .map(|record| record.param(CORRELATION_PARAM, &correlation_id))
+            .collect();
+        self.bytes = 0;
+        set_log_ring_size(0, 0);
+        (correlation_id, records)
+    }
+}
+
+/// Approximate heap bytes held by a message
+fn message_bytes(message: &LogMessage) -> usize {
+    message.key.len() + message.params.iter().map(|(k, v)| k.len() + v.len()).sum::<usize>()
+}
+
+/// Wrap a log callback with a flight recorder: debug records are buffered instead of passed on,
+/// and an error first replays the buffer, tagged with the correlation id the error carries too
+pub fn with_flight_recorder<F>(mut on_log: F, budget: &MemoryBudget) -> impl FnMut(&str, &LogMessage) + Send
+where
+    F: FnMut(&str, &LogMessage) + Send,
+{
+    let mut recorder = FlightRecorder::new(budget.log_ring_records, budget.log_ring_bytes);
+    move |level: &str, message: &LogMessage| match level {
+        LEVEL_DEBUG => recorder.record(message),
+        "error" => {
+            let (correlation_id, records) = recorder.flush();
+            for record in &records {
+                on_log(LEVEL_DEBUG, record);
+            }
+            on_log(level, &message.clone().param(CORRELATION_PARAM, correlation_id));
+        }
+        _ => on_log(level, message),
+    }
+}
+
+/// Read the last n entries of the most recent grab log
+pub fn read_recent_logs(n: usize) -> AppResult<Vec<LogEntry>> {
+    let Some(path) = latest_grab_log(&logs_dir()?)? else {
+        return Ok(Vec::new());
+    };
+    let n = if n == 0 { DEFAULT_RECENT_LOG_LINES } else { n };
+    Ok(tail_file(&path, n)?
+        .iter()
+        .filter_map(|line| serde_json::from_str::<LogEntry>(line).ok())
+        .collect())
+}
+
+/// Find the most recently modified grab_debug_*.log in dir
+fn latest_grab_log(dir: &Path) -> AppResult<Option<PathBuf>> {
+    if !dir.exists() {
+        return Ok(None);
+    }
+
+    let mut latest: Option<(std::time::SystemTime, PathBuf)> = None;
+    for entry in fs::read_dir(dir)? {
+        let entry = entry?;
+        let name = entry.file_name().to_string_lossy().to_string();
+        if !name.starts_with(GRAB_LOG_PREFIX) || !name.ends_with(GRAB_LOG_SUFFIX) {
+            continue;
+        }
+        let modified = entry.metadata()?.modified()?;
+        if latest.as_ref().map_or(true, |(t, _)| modified > *t) {
+            latest = Some((modified, entry.path()));
+        }
+    }
+    Ok(latest.map(|(_, path)| path))
+}
+
+/// Return the last n lines of a file, scanning backwards in 4 KB chunks
+pub fn tail_file(path: &Path, n: usize) -> AppResult<Vec<String>> {
+    let mut file = File::open(path)?;
+    let mut pos = file.metadata()?.len();
+    let mut buf: Vec<u8> = Vec::new();
+    let mut newlines = 0;
+
+    // Stop once we hold n full lines (n + 1 separators, or n if the file doesn't end with one)
+    while pos > 0 && newlines <= n {
+        let size = TAIL_CHUNK_SIZE.min(pos);
+        pos -= size;
+        file.seek(SeekFrom::Start(pos))?;
+        let mut chunk = vec![0u8; size as usize];
+        file.read_exact(&mut chunk)?;
+        newlines += chunk.iter().filter(|b| **b == b'\n').count();
+        chunk.extend_from_slice(&buf);
+        buf = chunk;
+    }
+
+    let text = String::from_utf8_lossy(&buf);
+    let lines: Vec<&str> = text.lines().filter(|l| !l.trim().is_empty()).collect();
+    let start = lines.len().saturating_sub(n);
+    Ok(lines[start..].iter().map(|l| l.to_string()).collect())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn temp_test_dir(name: &str) -> PathBuf {
+        let dir = std::env::temp_dir().join(format!("skylinemed_{}_{}", name, std::process::id()));
+        let _ = fs::remove_dir_all(&dir);
+        fs::create_dir_all(&dir).unwrap();
+        dir
+    }
+
+    #[test]
+    fn test_flight_recorder() {
+        let budget = MemoryBudget::default();
+        let mut seen: Vec<(String, LogMessage)> = Vec::new();
+        {
+            let mut on_log = with_flight_recorder(|level: &str, message: &LogMessage| seen.push((level.to_string(), message.clone())), &budget);
+            for i in 0..budget.log_ring_records + 5 {
+                on_log(LEVEL_DEBUG, &LogMessage::new("debug.step").param("i", i));
+            }
+            on_log("info", &LogMessage::new("attempt.start"));
+            on_log("error", &LogMessage::new("submit.error"));
+            on_log("error", &LogMessage::new("submit.error"));
+        }
+
+        // Debug records only surface once an error arrives, oldest ones dropped
+        assert_eq!(seen[0].1.key, "attempt.start");
+        let flushed: Vec<_> = seen.iter().filter(|(level, _)| level == LEVEL_DEBUG).collect();
+        assert_eq!(flushed.len(), budget.log_ring_records);
+        assert_eq!(flushed[0].1.params["i"], "5");
+
+        let errors: Vec<_> = seen.iter().filter(|(level, _)| level == "error").collect();
+        let first_id = &errors[0].1.params[CORRELATION_PARAM];
+        assert!(flushed.iter().all(|(_, m)| &m.params[CORRELATION_PARAM] == first_id));
+        // The second error had nothing buffered but still gets its own id
+        assert_ne!(&errors[1].1.params[CORRELATION_PARAM], first_id);
+        assert_eq!(seen.last().unwrap().1.key, "submit.error");
+    }
+
+    #[test]
+    fn test_flight_recorder_byte_cap() {
+        let mut recorder = FlightRecorder::new(100, 1024);
+        for i in 0..50 {
+            recorder.record(&LogMessage::new("debug.submit_response").param("message", format!("{}{}", i, "x".repeat(200))));
+        }
+        let (records, bytes) = recorder.size();
+        assert!(bytes <= 1024);
+        assert!(records < 50 && records > 0);
+        // The newest record survives
+        let (_, flushed) = recorder.flush();
+        assert!(flushed.last().unwrap().params["message"].starts_with("49"));
+        assert_eq!(recorder.size(), (0, 0));
+    }
+
+    #[test]
+    fn test_tail_file() {
+        let dir = temp_test_dir("tail_file");
+        let path = dir.join("fixture.log");
+        // Lines long enough that the tail spans several 4 KB chunks
+        let lines: Vec<String> = (0..500).map(|i| format!("line {:04} {}", i, "x".repeat(60))).collect();
+        fs::write(&path, lines.join("\n") + "\n").unwrap();
+
+        let tail = tail_file(&path, 120).unwrap();
+        assert_eq!(tail.len(), 120);
+        assert_eq!(tail[0], lines[380]);
+        assert_eq!(tail[119], lines[499]);
+
+        assert_eq!(tail_file(&path, 1000).unwrap().len(), 500);
+        assert_eq!(tail_file(&path, 1).unwrap(), vec![lines[499].clone()]);
+
+        // No trailing newline
+        fs::write(&path, "a\nb\nc").unwrap();
+        assert_eq!(tail_file(&path, 2).unwrap(), vec!["b", "c"]);
+
+        fs::write(&path, "").unwrap();
+        assert!(tail_file(&path, 5).unwrap().is_empty());
+        let _ = fs::remove_dir_all(&dir);
+    }
+
+    #[test]
+    fn test_latest_grab_log() {
+        let dir = temp_test_dir("latest_grab_log");
+        assert!(latest_grab_log(&dir).unwrap().is_none());
+
+        let older = dir.join("grab_debug_20260101_080000.log");
+        let newer = dir.join("grab_debug_20260102_080000.log");
+        fs::write(&older, "").unwrap();
+        fs::write(dir.join("other.log"), "").unwrap();
+        fs::write(&newer, "").unwrap();
+        let past = std::time::SystemTime::now() - std::time::Duration::from_secs(3600);
+        File::options().write(true).open(&older).unwrap().set_modified(past).unwrap();
+
+        assert_eq!(latest_grab_log(&dir).unwrap(), Some(newer));
+        let _ = fs::remove_dir_all(&dir);
+    }
+}
@@ -0,0 +1,201 @@
+//! Memory budget for in-memory buffers of SkylineMed
+//! Long monitor sessions on small machines must not grow without bound: every buffer that keeps
+//! history consults MemoryBudget, evicts oldest-first, and counts what it evicted.
+
+use std::collections::HashMap;
+use std::hash::Hash;
+use std::sync::atomic::{AtomicU64, AtomicUsize, Ordering};
+use std::time::Instant;
+
+use serde::{Deserialize, Serialize};
+
+/// Caps per buffer, stored under "memory_budget" in user state
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct MemoryBudget {
+    #[serde(default = "default_schedule_cache_entries")]
+    pub schedule_cache_entries: usize,
+    #[serde(default = "default_hospital_cache_cities")]
+    pub hospital_cache_cities: usize,
+    #[serde(default = "default_department_cache_units")]
+    pub department_cache_units: usize,
+    #[serde(default = "default_submit_audit_entries")]
+    pub submit_audit_entries: usize,
+    /// Debug records kept by the flight recorder
+    #[serde(default = "default_log_ring_records")]
+    pub log_ring_records: usize,
+    /// Captured payload bytes (keys and params) kept by the flight recorder
+    #[serde(default = "default_log_ring_bytes")]
+    pub log_ring_bytes: usize,
+}
+
+impl Default for MemoryBudget {
+    fn default() -> Self {
+        Self {
+            schedule_cache_entries: default_schedule_cache_entries(),
+            hospital_cache_cities: default_hospital_cache_cities(),
+            department_cache_units: default_department_cache_units(),
+            submit_audit_entries: default_submit_audit_entries(),
+            log_ring_records: default_log_ring_records(),
+            log_ring_bytes: default_log_ring_bytes(),
+        }
+    }
+}
+
+fn default_schedule_cache_entries() -> usize {
+    64
+}
+
+fn default_hospital_cache_cities() -> usize {
+    32
+}
+
+fn default_department_cache_units() -> usize {
+    32
+}
+
+fn default_submit_audit_entries() -> usize {
+    50
+}
+
+fn default_log_ring_records() -> usize {
+    200
+}
+
+fn default_log_ring_bytes() -> usize {
+    256 * 1024
+}
+
+/// Buffers under the budget
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum Buffer {
+    ScheduleCache,
+    HospitalCache,
+    DepartmentCache,
+    SubmitAudit,
+    LogRing,
+}
+
+impl Buffer {
+    pub fn name(self) -> &'static str {
+        match self {
+            Buffer::ScheduleCache => "schedule_cache",
+            Buffer::HospitalCache => "hospital_cache",
+            Buffer::DepartmentCache => "department_cache",
+            Buffer::SubmitAudit => "submit_audit",
+            Buffer::LogRing => "log_ring",
+        }
+    }
+}
+
+/// Evictions per buffer since start, indexed by Buffer as usize
+static EVICTIONS: [AtomicU64; 5] = [AtomicU64::new(0), AtomicU64::new(0), AtomicU64::new(0), AtomicU64::new(0), AtomicU64::new(0)];
+/// Current flight recorder size; the recorder lives inside a grab run's log callback
+static LOG_RING_RECORDS: AtomicUsize = AtomicUsize::new(0);
+static LOG_RING_BYTES: AtomicUsize = AtomicUsize::new(0);
+
+/// Count evicted entries of a buffer
+pub fn record_evictions(buffer: Buffer, count: usize) {
+    if count > 0 {
+        EVICTIONS[buffer as usize].fetch_add(count as u64, Ordering::Relaxed);
+    }
+}
+
+/// Evicted entries of a buffer since start
+pub fn evictions(buffer: Buffer) -> u64 {
+    EVICTIONS[buffer as usize].load(Ordering::Relaxed)
+}
+
+/// Publish the flight recorder's current size
+pub fn set_log_ring_size(records: usize, bytes: usize) {
+    LOG_RING_RECORDS.store(records, Ordering::Relaxed);
+    LOG_RING_BYTES.store(bytes, Ordering::Relaxed);
+}
+
+/// Remove the oldest entries until at most cap remain, returning how many were removed
+pub fn evict_oldest<K, V>(map: &mut HashMap<K, V>, cap: usize, at: impl Fn(&V) -> Instant) -> usize
+where
+    K: Clone + Eq + Hash,
+{
+    if map.len() <= cap {
+        return 0;
+    }
+    let mut by_age: Vec<(Instant, K)> = map.iter().map(|(k, v)| (at(v), k.clone())).collect();
+    by_age.sort_by_key(|(at, _)| *at);
+    let excess = map.len() - cap;
+    for (_, key) in by_age.into_iter().take(excess) {
+        map.remove(&key);
+    }
+    excess
+}
+
+/// Size, cap and evictions of one buffer
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct BufferStats {
+    pub name: String,
+    pub entries: usize,
+    pub capacity: usize,
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub bytes: Option<usize>,
+    pub evictions: u64,
+}
+
+impl BufferStats {
+    pub fn new(buffer: Buffer, entries: usize, capacity: usize) -> Self {
+        Self {
+            name: buffer.name().to_string(),
+            entries,
+            capacity,
+            bytes: None,
+            evictions: evictions(buffer),
+        }
+    }
+}
+
+/// Process memory plus per-buffer sizes
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct MemoryStats {
+    /// Resident set size; only known on Linux
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub rss_bytes: Option<u64>,
+    pub buffers: Vec<BufferStats>,
+}
+
+/// Stats of the flight recorder
+pub fn log_ring_stats(budget: &MemoryBudget) -> BufferStats {
+    BufferStats {
+        bytes: Some(LOG_RING_BYTES.load(Ordering::Relaxed)),
+        ..BufferStats::new(Buffer::LogRing, LOG_RING_RECORDS.load(Ordering::Relaxed), budget.log_ring_records)
+    }
+}
+
+/// Resident set size from /proc/self/status
+pub fn process_rss_bytes() -> Option<u64> {
+    let status = std::fs::read_to_string("/proc/self/status").ok()?;
+    let line = status.lines().find(|line| line.starts_with("VmRSS:"))?;
+    let kb: u64 = line.split_whitespace().nth(1)?.parse().ok()?;
+    Some(kb * 1024)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::time::Duration;
+
+    #[test]
+    fn test_evict_oldest() {
+        let base = Instant::now();
+        let mut map: HashMap<u32, Instant> = (0..5).map(|i| (i, base + Duration::from_millis(i as u64))).collect();
+        assert_eq!(evict_oldest(&mut map, 3, |at| *at), 2);
+        let mut keys: Vec<u32> = map.keys().copied().collect();
+        keys.sort();
+        assert_eq!(keys, vec![2, 3, 4]);
+        assert_eq!(evict_oldest(&mut map, 3, |at| *at), 0);
+    }
+
+    #[test]
+    fn test_budget_defaults_fill_missing_fields() {
+        let budget: MemoryBudget = serde_json::from_str(r#"{"log_ring_records": 50}"#).unwrap();
+        assert_eq!(budget.log_ring_records, 50);
+        assert_eq!(budget.schedule_cache_entries, MemoryBudget::default().schedule_cache_entries);
+    }
+}
@@ -0,0 +1,306 @@
+//! Structured log messages for QuickDoctor
+//! Log call sites emit a message key plus named parameters; the command layer
+//! renders them for the UI locale while file logs keep the raw key and params.
+
+use std::collections::BTreeMap;
+use std::sync::RwLock;
+
+use serde::{Deserialize, Serialize};
+
+use super::errors::redact_secrets;
+
+pub const LOCALE_ZH_CN: &str = "zh-CN";
+pub const LOCALE_EN: &str = "en";
+
+static LOG_LOCALE: RwLock<String> = RwLock::new(String::new());
+
+/// (key, zh-CN, en) message table; placeholders are written as {name}
+const MESSAGES: &[(&str, &str, &str)] = &[
+    // Grab lifecycle
+    ("grab.started", "抢号引擎已启动", "grab engine started"),
+    ("grab.config", "抢号配置: 日期={dates} 医生={doctors} 时段={time_types} 偏好={preferred}", "grab config: dates={dates} doctor_ids={doctors} time_types={time_types} preferred={preferred}"),
+    ("grab.date_preference", "{date} 单独偏好: 时段 {time_types}, 偏好时间 {preferred}", "{date} own preference: time types {time_types}, preferred {preferred}"),
+    ("grab.mode_precise", "抢号模式: 精确", "grab mode: precise"),
+    ("grab.mode_fuzzy", "抢号模式: 模糊", "grab mode: fuzzy"),
+    ("grab.default_time_types", "time_types 未设置，默认 am/pm", "time_types not set, defaulting to am/pm"),
+    ("grab.config_invalid", "配置无效: {error}", "invalid config: {error}"),
+    ("grab.paused", "抢号已暂停", "grab paused"),
+    ("grab.resumed", "抢号已恢复", "grab resumed"),
+    ("grab.success", "抢号成功", "grab success"),
+    ("grab.waitlisted", "已加入候补", "joined the waitlist"),
+    ("grab.dates_updated", "抢号日期已更新: {dates}", "grab dates updated: {dates}"),
+    ("grab.flow_unsupported", "该科室的所有号源均已转为{flow}流程，暂不支持自动挂号，任务已停止", "every schedule of this department moved to the {flow} flow, which is not supported; grab stopped"),
+    ("grab.doctor_mismatch", "配置的医生 {configured} 均不在该科室，已停止以免挂到其他医生。科室医生: {available}", "none of the configured doctors ({configured}) is in this department; stopped instead of booking another doctor. Department doctors: {available}"),
+    ("grab.his_mem_required", "该医院要求就诊人先在医院平台绑定建档（缺少 hisMemId），请绑定后重新开始", "this hospital only books members registered with it (hisMemId missing); bind the patient on the hospital's platform and start again"),
+    ("grab.consent_required", "该科室要求勾选同意项: {labels}，确认同意后将 {names} 加入配置的 consents 再重新开始", "the booking page requires consents {names} ({labels}); add them to consents in the config if you agree and start again"),
+    ("grab.disease_required", "该科室要求填写病情描述（至少 {min} 字），请在配置中填写后重新开始", "this department requires a disease description (at least {min} characters); fill it in the config and start again"),
+    ("grab.unit_resolved", "已根据医院名称 {name} 匹配到医院 ID {unit}", "resolved hospital {name} to unit_id {unit}"),
+    ("grab.member_resolved", "已自动选择就诊人 {name}（ID {member}），请确认是否正确", "auto-selected member {name} (id {member}), please verify"),
+    ("grab.missing_access_hash", "缺少 access_hash，无法启动抢号", "missing access_hash, cannot start grab"),
+    ("grab.access_hash_found", "检测到 access_hash，允许启动抢号", "access_hash found, grab allowed"),
+    ("attempt.start", "第 {attempt} 次尝试", "attempt {attempt}"),
+    ("attempt.timeout", "第 {attempt} 次尝试超时: {error}", "attempt {attempt} timed out: {error}"),
+    ("attempt.max_retries", "已达最大重试次数 ({max})", "max retries reached ({max})"),
+    ("history.write_failed", "写入历史记录失败: {error}", "history write failed: {error}"),
+    ("quota.stop", "今日挂号次数已达上限，停止", "daily quota exceeded, stop"),
+    ("quota.wait", "今日挂号次数已达上限，暂停 {seconds}s 至零点", "daily quota exceeded, pause {seconds}s until midnight"),
+    ("quota.reset", "次数已重置，继续抢号", "quota reset, resume"),
+    ("submit_limit.run", "本次运行已提交 {limit} 次，达到上限，停止", "run submit limit of {limit} reached, stop"),
+    ("submit_limit.day", "今日已提交 {limit} 次，达到每日上限，停止", "daily submit limit of {limit} reached, stop"),
+    ("submit_limit.wait", "今日已提交 {limit} 次，达到每日上限，暂停 {seconds}s 至零点", "daily submit limit of {limit} reached, pause {seconds}s until midnight"),
+    // Schedule and slot selection
+    ("schedule.query", "查询排班: {date}", "schedule query: {date}"),
+    ("schedule.empty", "{date} 无排班", "no schedule on {date}"),
+    ("schedule.result", "排班结果: 医生数={count}", "schedule result: docs={count}"),
+    ("schedule.result_unmatched", "排班结果: 医生数={count} {unmatched}", "schedule result: docs={count} {unmatched}"),
+    ("slot.found", "检测到号源: {doctor} - {time} (剩余 {left}，数据 {age} 秒前)", "found slot: {doctor} - {time} (left {left}, data {age}s old)"),
+    ("slot.verification_skip", "号源仅限实名认证账号预约，当前账号未实名，跳过: {doctor} - {time}", "slot restricted to real-name verified accounts and this account is not verified, skip: {doctor} - {time}"),
+    ("slot.below_min", "号源余量不足，跳过: {doctor} - {time} (剩余 {left}，要求至少 {min})", "slot below minimum, skip: {doctor} - {time} (left {left}, need {min})"),
+    ("phase.summary", "阶段耗时 (中位数): {timing}", "phase timing (p50): {timing}"),
+    ("slot.no_match", "没有匹配的偏好时段，跳过 (auto_select_first=false)", "no preferred time slot matched, skip (auto_select_first=false)"),
+    ("slot.selected", "已选择 {slot} ({reason})", "selected {slot} ({reason})"),
+    ("slot.refreshed", "刷新医生 {doctor} 号源: 可用 {count} 个 (单医生 {ms}ms / 全科室平均 {full_ms}ms)", "refreshed doctor {doctor} slots: {count} available ({ms}ms vs full query avg {full_ms}ms)"),
+    ("slot.refresh_failed", "刷新医生号源失败: {error}", "doctor slot refresh failed: {error}"),
+    ("detail.unavailable", "号源详情获取失败", "ticket detail unavailable"),
+    ("detail.flow_unsupported", "该号源已转为{flow}流程，跳过: {url}", "schedule moved to the {flow} flow, skip: {url}"),
+    ("detail.missing_fields", "号源详情缺少字段", "ticket detail missing fields"),
+    ("disease.invalid", "病情描述不满足要求: {reason} {hint}", "disease description rejected before submit: {reason} {hint}"),
+    ("debug.slot_skipped", "跳过号源 {doctor} {schedule} ({time_type}, 剩余 {left}): {reason}", "skipped slot {doctor} {schedule} ({time_type}, {left} left): {reason}"),
+    ("debug.schedule_unmatched", "排班 {date} 键不匹配: 无排班医生 [{doctors}]，孤立 sch 键 [{keys}]", "schedule {date} key mismatch: doctors without sch [{doctors}], orphan sch keys [{keys}]"),
+    ("debug.schedule_meta", "排班数据 {date}: {host} HTTP {status}，耗时 {ms}ms，user_key {user_key}，获取于 {fetched_at}", "schedule {date}: {host} HTTP {status} in {ms}ms, user_key {user_key}, fetched at {fetched_at}"),
+    ("debug.booking_window_skip", "跳过 {date}：{opens} 才进入预约范围", "skipped {date}: enters the booking window on {opens}"),
+    ("debug.doctor_excluded", "跳过 {doctor} ({date})：本次运行已预约或被限制", "skipped {doctor} ({date}): already booked or restricted in this run"),
+    ("debug.detail", "号源详情 {schedule}: {times} 个时段 sch_data={sch_data} detlid_realtime={detlid_realtime} level_code={level_code} 耗时 {ms}ms", "detail {schedule}: {times} times sch_data={sch_data} detlid_realtime={detlid_realtime} level_code={level_code} in {ms}ms"),
+    ("debug.submit_count", "本次运行第 {run} 次提交，今日第 {today} 次", "submit {run} of this run, {today} today"),
+    ("debug.submit_request", "提交 {schedule} 时段 {detlid} 代理 {proxy}", "submitting {schedule} detlid {detlid} via proxy {proxy}"),
+    ("debug.slot_survival", "号源发现到提交响应 {ms}ms，成功={booked}", "slot seen to submit answer {ms}ms, booked={booked}"),
+    ("debug.submit_response", "提交响应 success={success} url={url} 耗时 {ms}ms: {message}", "submit response success={success} url={url} in {ms}ms: {message}"),
+    ("address.missing", "缺少地址信息", "missing address info"),
+    ("address.fallback", "使用备选地址: {address}", "fallback address: {address}"),
+    ("address.area_invalid", "所选地区或街道地址无效，已忽略", "picked area or street is invalid, ignored"),
+    ("member.uncertified_skip", "就诊人未认证，跳过提交", "member not certified, skip submit"),
+    ("member.uncertified_submit", "就诊人未认证，仍然提交", "member not certified, submitting anyway"),
+    ("member.his_mem_ignored", "就诊人未在该医院建档，已按配置忽略检查，提交可能失败", "member is not registered with this hospital; check ignored by config, submits may fail"),
+    ("member.not_found", "未找到就诊人，认证状态未知", "member not found, certification unknown"),
+    ("member.lookup_failed", "查询就诊人失败: {error}", "member lookup failed: {error}"),
+    ("member.row_skipped", "就诊人列表第 {index} 行未能解析 ({reason}): {detail}", "member row {index} skipped ({reason}): {detail}"),
+    // Submit
+    ("recheck.slot_gone", "提交前号源已被抢走，跳过: {slot}", "slot gone before submit, skip: {slot}"),
+    ("recheck.failed", "提交前复查失败: {error}，仍然提交", "recheck failed: {error}, submitting anyway"),
+    ("proxy.using", "使用代理: {url}", "using proxy: {url}"),
+    ("proxy.failed", "代理切换失败: {error}，使用直连", "proxy rotation failed: {error}, using direct connection"),
+    ("submit.success", "预约成功: {unit} / {dep} / {doctor}", "success: {unit} / {dep} / {doctor}"),
+    ("submit.throttled", "提交过快，退避等待", "submit throttled, backoff"),
+    ("submit.quota", "{message}", "{message}"),
+    ("submit.booking_limit", "预约已达上限: {message}", "booking limit: {message}"),
+    ("submit.failed", "{message}", "{message}"),
+    ("submit.payment_required", "挂号成功但需在线支付，请在 {deadline} 前完成支付，否则订单将被取消: {url}", "booked but payment is required before {deadline} or the order is cancelled: {url}"),
+    ("submit.same_doctor_limit", "7 天内已预约过 {doctor}，本次运行不再尝试该医生: {message}", "{doctor} was already booked within 7 days, skipping this doctor for the rest of the run: {message}"),
+    ("submit.verification_required", "该号源要求实名认证，已跳过并记录账号未实名: {message}", "schedule requires real-name verification; skipped and noted the account as unverified: {message}"),
+    ("submit.disease_required", "医院要求填写病情描述: {message}", "hospital requires a disease description: {message}"),
+    ("submit.slot_taken", "号源已被抢走: {message}", "slot taken: {message}"),
+    ("submit.outcome_unknown", "提交 {nonce} 已发出但结果未知，为避免重复挂号不再重发，请在“我的预约”中确认", "submit {nonce} was sent but its outcome is unknown; not sending it again to avoid a double booking, check your appointments"),
+    ("submit.unsigned", "缺少 access_hash，本次提交未签名", "no access_hash; this submit goes unsigned"),
+    ("submit.error", "提交出错: {error}", "submit error: {error}"),
+    ("network.failed", "网络异常 ({category})：{hint}", "network failure ({category}): {error}"),
+    ("network.proxy_skipped", "网络异常 ({category})：可能是代理不可用，已跳过代理 {proxy}", "network failure ({category}): the proxy seems unusable and was dropped: {proxy}"),
+    ("submit.cancelled", "已停止：{phase} 阶段后中止，未提交订单", "stopped after the {phase} phase; nothing was submitted"),
+    ("submit.completed_after_stop", "停止时提交请求已发出，以下为该请求的真实结果", "stop arrived while the submit was in flight; its real outcome follows"),
+    ("captcha.required", "提交需要验证码 ({kind})，等待处理", "submit requires {kind} captcha, waiting for solver"),
+    ("captcha.solved", "验证码已处理，重新提交", "captcha solved, resubmitting"),
+    ("captcha.failed", "验证码处理失败: {error}", "captcha solving failed: {error}"),
+    ("waitlist.trying", "号源已满，尝试候补: {doctor} {date} {time}", "slots gone, trying waitlist: {doctor} {date} {time}"),
+    ("waitlist.success", "已加入候补: {doctor}", "joined waitlist: {doctor}"),
+    ("waitlist.failed", "候补失败: {error}", "waitlist failed: {error}"),
+    ("client.profile_rotated", "连续 {streak} 次提交过快，已切换客户端指纹为 {profile}", "{streak} submits in a row were throttled; switched client profile to {profile}"),
+    ("client.profile_rotate_failed", "切换客户端指纹失败: {error}", "client profile rotation failed: {error}"),
+    ("throttle.wait", "提交节流: 等待 {ms}ms", "submit throttle: wait {ms}ms"),
+    ("pacing.profile", "医院 {unit} 使用节奏配置: 查询间隔 {schedule}s 提交间隔 {submit}s (近期限流={throttled})", "pacing profile for unit {unit}: schedule {schedule}s submit {submit}s (recently throttled={throttled})"),
+    ("pacing.retry_interval_clamped", "查询间隔 {configured}s 过短，已调整为 {floor}s", "retry_interval {configured}s is too short; using {floor}s"),
+    ("pacing.governor_raised", "近 {window} 次请求中 {throttled} 次被限流，查询间隔放宽至 {interval}s", "{throttled} of the last {window} requests were throttled; retry interval raised to {interval}s"),
+    ("pacing.governor_lowered", "请求恢复正常，查询间隔降至 {interval}s", "requests are clean again; retry interval lowered to {interval}s"),
+    ("pacing.persist_failed", "保存限流记录失败: {error}", "persist throttle observation failed: {error}"),
+    ("insights.persist_failed", "保存放号规律记录失败: {error}", "persist booking window observation failed: {error}"),
+    ("account.verified_persist_failed", "保存实名认证状态失败: {error}", "persist account verification state failed: {error}"),
+    ("throttle.persist_failed", "保存上次提交时间失败: {error}", "persist last submit time failed: {error}"),
+    ("submit_counts.read_failed", "读取今日提交次数失败: {error}", "read daily submit count failed: {error}"),
+    ("submit_counts.persist_failed", "保存今日提交次数失败: {error}", "persist daily submit count failed: {error}"),
+    // Announcements
+    ("announcement.none", "暂无医院公告", "no hospital announcements"),
+    ("announcement.item", "公告: [{date}] {title}", "announcement: [{date}] {title}"),
+    ("announcement.unavailable", "获取医院公告失败: {error}", "announcements unavailable: {error}"),
+    // Booking window
+    ("booking_window.configured", "预约窗口: 提前 {days} 天 (配置)", "booking window: {days} days ahead (configured)"),
+    ("booking_window.announced", "预约窗口: 提前 {days} 天 (医院公告)", "booking window: {days} days ahead (from announcements)"),
+    ("booking_window.outside", "{date} 超出医院提前 {days} 天的预约范围，最早 {opens} 放号", "{date} is beyond the hospital's {days}-day booking window; it opens on {opens} at the earliest"),
+    ("booking_window.idle", "所有目标日期均未进入预约范围，等待至 {opens}", "no target date is inside the booking window yet; idling until {opens}"),
+    ("booking_window.entered", "{date} 已进入预约范围，开始查询", "{date} entered the booking window; querying it now"),
+    // Timed start
+    ("time.invalid_format", "时间格式无效: {time}", "invalid time format: {time}"),
+    ("time.zone_mismatch", "本机时区为 UTC{offset}，不是北京时间：按本机时区 start_time {time} 即北京时间 {as_local}，按北京时间则为本机 {as_china}；当前使用{zone}，可通过 start_time_timezone 指定", "this machine is on UTC{offset}, not China Standard Time: start_time {time} read locally is {as_local} Beijing time, read as Beijing time it is {as_china} local; using {zone}, set start_time_timezone to pin it"),
+    ("time.offset", "服务器时间偏移 {offset}s", "time offset {offset}s"),
+    ("time.passed", "目标时间已过: {time}", "target time already passed: {time}"),
+    ("time.waiting", "等待 {seconds}s 后开始", "waiting {seconds}s to start"),
+    ("prefetch.summary", "开抢前预取: {summary}", "pre-trigger prefetch: {summary}"),
+    ("time.start_trigger", "到点开抢", "start trigger"),
+    // Notifications
+    ("session.will_expire", "登录将于 {expires} 过期，早于计划抢号时间 {start}，请提前重新扫码登录", "login expires at {expires}, before the grab scheduled at {start}; please log in again beforehand"),
+    ("hook.finished", "{hook} 已执行 (退出码 {code}) stdout: {stdout} stderr: {stderr}", "{hook} finished (exit {code}) stdout: {stdout} stderr: {stderr}"),
+    ("hook.failed", "{hook} 执行失败: {error}", "{hook} failed: {error}"),
+    ("notify.sent", "已通过 {sink} 发送 {event} 通知", "{event} notification sent via {sink}"),
+    ("notify.failed", "{sink} 通知发送失败: {error}", "{sink} notification failed: {error}"),
+    // Login
+    ("login.har_imported", "已从 HAR 导入 {count} 个 Cookie（{matched}/{entries} 条 91160 请求）", "imported {count} cookies from HAR ({matched}/{entries} entries to 91160)"),
+    ("login.no_cookie", "登录校验：未发现本地 Cookie", "login check: no local cookies"),
+    ("login.missing_access_hash", "登录校验：缺少 access_hash", "login check: missing access_hash"),
+    ("login.check_ok", "登录校验通过", "login check passed"),
+    ("login.check_failed", "登录校验失败", "login check failed"),
+    ("login.success", "登录成功", "login succeeded"),
+    ("login.failed", "登录失败: {error}", "login failed: {error}"),
+    ("qr.init_failed", "二维码登录初始化失败: {error}", "QR login init failed: {error}"),
+    ("qr.fetch_failed", "获取二维码失败: {error}", "failed to fetch QR code: {error}"),
+    ("qr.stale_discarded", "二维码登录会话 #{session} 已被取代，结果已丢弃", "QR login session #{session} was superseded; its result was discarded"),
+];
+
+/// A log message key with named parameters
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct LogMessage {
+    pub key: String,
+    #[serde(default)]
+    pub params: BTreeMap<String, String>,
+}
+
+impl LogMessage {
+    /// Create a message for the given key
+    pub fn new(key: &str) -> Self {
+        Self {
+            key: key.to_string(),
+            params: BTreeMap::new(),
+        }
+    }
+
+    /// Add a named parameter
+    pub fn param(mut self, name: &str, value: impl ToString) -> Self {
+        self.params.insert(name.to_string(), value.to_string());
+        self
+    }
+
+    /// Copy with secrets redacted from all parameter values
+    pub fn redacted(&self) -> Self {
+        Self {
+            key: self.key.clone(),
+            params: self
+                .params
+                .iter()
+                .map(|(k, v)| (k.clone(), redact_secrets(v)))
+                .collect(),
+        }
+    }
+
+    /// Raw form for file logs: key followed by name=value pairs
+    pub fn raw(&self) -> String {
+        let mut out = self.key.clone();
+        for (name, value) in &self.params {
+            out.push_str(&format!(" {}={}", name, value));
+        }
+        out
+    }
+
+    /// Render for the given locale; unknown locales use en, unknown keys render raw
+    pub fn render(&self, locale: &str) -> String {
+        match template(locale, &self.key) {
+            Some(tpl) => fill(tpl, &self.params),
+            None => self.raw(),
+        }
+    }
+}
+
+/// Set the locale used to render log messages for the UI
+pub fn set_log_locale(locale: &str) {
+    if let Ok(mut current) = LOG_LOCALE.write() {
+        *current = normalize_locale(locale).to_string();
+    }
+}
+
+/// Get the current UI log locale (zh-CN unless set)
+pub fn log_locale() -> String {
+    match LOG_LOCALE.read() {
+        Ok(current) if !current.is_empty() => current.clone(),
+        _ => LOCALE_ZH_CN.to_string(),
+    }
+}
+
+/// Map a locale tag to a supported table locale
+fn normalize_locale(locale: &str) -> &'static str {
+    let lower = locale.trim().to_lowercase();
+    if lower.starts_with("zh") {
+        LOCALE_ZH_CN
+    } else {
+        LOCALE_EN
+    }
+}
+
+/// Look up the template for a key
+fn template(locale: &str, key: &str) -> Option<&'static str> {
+    let (_, zh, en) = MESSAGES.iter().find(|(k, _, _)| *k == key)?;
+    if normalize_locale(locale) == LOCALE_ZH_CN {
+        Some(zh)
+    } else {
+        Some(en)
+    }
+}
+
+/// Substitute {name} placeholders; missing params are left as-is
+fn fill(template: &str, params: &BTreeMap<String, String>) -> String {
+    let mut out = template.to_string();
+    for (name, value) in params {
+        out = out.replace(&format!("{{{}}}", name), value);
+    }
+    out
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_render() {
+        let found = LogMessage::new("slot.found")
+            .param("doctor", "张医生")
+            .param("time", "上午")
+            .param("left", 3)
+            .param("age", "1.5");
+
+        let cases = [
+            (LOCALE_ZH_CN, found.clone(), "检测到号源: 张医生 - 上午 (剩余 3，数据 1.5 秒前)"),
+            (LOCALE_EN, found.clone(), "found slot: 张医生 - 上午 (left 3, data 1.5s old)"),
+            ("zh", found.clone(), "检测到号源: 张医生 - 上午 (剩余 3，数据 1.5 秒前)"),
+            ("fr-FR", found.clone(), "found slot: 张医生 - 上午 (left 3, data 1.5s old)"),
+            (LOCALE_EN, LogMessage::new("grab.started"), "grab engine started"),
+            // Missing params keep their placeholder
+            (LOCALE_EN, LogMessage::new("schedule.query"), "schedule query: {date}"),
+            // Unknown keys fall back to the raw form
+            (LOCALE_ZH_CN, LogMessage::new("no.such.key").param("b", 2).param("a", 1), "no.such.key a=1 b=2"),
+            (LOCALE_ZH_CN, LogMessage::new("no.such.key"), "no.such.key"),
+        ];
+
+        for (locale, message, expected) in cases {
+            assert_eq!(message.render(locale), expected, "locale={} key={}", locale, message.key);
+        }
+    }
+
+    #[test]
+    fn test_raw_and_redacted() {
+        let message = LogMessage::new("submit.error").param("error", "url?user_key=abc&x=1");
+        assert_eq!(message.raw(), "submit.error error=url?user_key=abc&x=1");
+        assert_eq!(message.redacted().raw(), "submit.error error=url?user_key=***&x=1");
+    }
+
+    #[test]
+    fn test_message_keys_unique() {
+        let mut keys: Vec<&str> = MESSAGES.iter().map(|(k, _, _)| *k).collect();
+        keys.sort();
+        keys.dedup();
+        assert_eq!(keys.len(), MESSAGES.len());
+    }
+}
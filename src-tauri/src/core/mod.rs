@@ -4,11 +4,47 @@ pub mod types;
 pub mod errors;
 pub mod paths;
 pub mod cookies;
+pub mod har;
 pub mod state;
+pub mod store;
+#[cfg(feature = "sqlite-store")]
+pub mod sqlite_store;
+pub mod history;
+pub mod pacing;
+pub mod governor;
+pub mod insights;
+pub mod submit_counts;
+pub mod backoff;
+pub mod messages;
+pub mod logfile;
+pub mod memory;
+pub mod notify;
+pub mod notifier;
+pub mod payload;
+pub mod hooks;
+pub mod captcha;
+pub mod chaos;
+pub mod telemetry;
+pub mod headers;
+pub mod cities;
+pub mod areas;
+pub mod gates;
+pub mod schedule_decode;
+pub mod booking_rules;
+pub mod target_dates;
+pub mod netclass;
+pub mod profiles;
 pub mod client;
 pub mod proxy;
 pub mod qr_login;
+pub mod prefetch;
 pub mod grabber;
+#[cfg(test)]
+mod grab_harness;
+pub mod taskmanager;
+pub mod scan;
+pub mod report;
+pub mod schedule_view;
 
 // Re-export common types
 pub use types::*;
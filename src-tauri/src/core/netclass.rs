@@ -0,0 +1,219 @@
+//! Transport error classification for SkylineMed
+//! "error sending request" does not tell a user whether their Wi-Fi, a proxy, DNS or the site is at
+//! fault. The category does, and each one comes with a short hint on what to check.
+
+use std::error::Error as StdError;
+use std::io;
+use std::time::{Duration, Instant};
+
+use serde::Serialize;
+
+use super::errors::{redact_secrets, AppError};
+use super::gates::DEFAULT_GATE_HOST;
+
+/// Timeout for one self-check hop
+const HOP_PROBE_TIMEOUT_SECS: u64 = 8;
+
+/// Where a request failed, as far as the transport error tells
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "snake_case")]
+pub enum NetErrorKind {
+    /// The host name did not resolve
+    Dns,
+    /// The TCP connection was refused or the network is unreachable
+    Connect,
+    /// The TCP connection was not established in time
+    ConnectTimeout,
+    /// Connected, but the TLS handshake failed
+    Tls,
+    /// The request went through a proxy and the proxy could not be reached
+    ProxyUnreachable,
+    /// The server answered with a 5xx status
+    ServerError,
+    /// Connected, but the answer did not arrive in time
+    ReadTimeout,
+    Other,
+}
+
+impl NetErrorKind {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            NetErrorKind::Dns => "dns",
+            NetErrorKind::Connect => "tcp_connect",
+            NetErrorKind::ConnectTimeout => "tcp_connect_timeout",
+            NetErrorKind::Tls => "tls",
+            NetErrorKind::ProxyUnreachable => "proxy_unreachable",
+            NetErrorKind::ServerError => "server_5xx",
+            NetErrorKind::ReadTimeout => "read_timeout",
+            NetErrorKind::Other => "other",
+        }
+    }
+
+    /// What the user can check for this category
+    pub fn hint(&self) -> &'static str {
+        match self {
+            NetErrorKind::Dns => "域名解析失败，请检查网络或 DNS 设置",
+            NetErrorKind::Connect => "无法连接服务器，请检查网络连接",
+            NetErrorKind::ConnectTimeout => "连接服务器超时，网络可能不稳定",
+            NetErrorKind::Tls => "TLS 握手失败，可能是网络被拦截或系统时间不准确",
+            NetErrorKind::ProxyUnreachable => "可能是代理不可用",
+            NetErrorKind::ServerError => "服务器出错，网站可能正在维护或过载",
+            NetErrorKind::ReadTimeout => "服务器响应超时，网站可能繁忙",
+            NetErrorKind::Other => "网络请求失败",
+        }
+    }
+}
+
+/// Classify a reqwest transport error; via_proxy marks requests sent through a proxy
+pub fn classify_transport(err: &reqwest::Error, via_proxy: bool) -> NetErrorKind {
+    let mut chain = err.to_string();
+    let mut io_kind = None;
+    let mut source = err.source();
+    while let Some(cause) = source {
+        chain.push_str(": ");
+        chain.push_str(&cause.to_string());
+        if let Some(io_err) = cause.downcast_ref::<io::Error>() {
+            io_kind = Some(io_err.kind());
+        }
+        source = cause.source();
+    }
+    classify_parts(&chain, io_kind, err.is_timeout(), err.is_connect(), via_proxy)
+}
+
+/// Classification on the rendered error chain, the innermost io::ErrorKind and reqwest's flags
+fn classify_parts(chain: &str, io_kind: Option<io::ErrorKind>, timeout: bool, connect: bool, via_proxy: bool) -> NetErrorKind {
+    let chain = chain.to_lowercase();
+    let mentions = |needles: &[&str]| needles.iter().any(|needle| chain.contains(needle));
+
+    // Through a proxy every connect-stage failure is the proxy's, whatever the target
+    if via_proxy && (connect || mentions(&["proxy"])) {
+        return NetErrorKind::ProxyUnreachable;
+    }
+    if mentions(&["dns error", "failed to lookup address", "name or service not known", "nodename nor servname", "no such host"]) {
+        return NetErrorKind::Dns;
+    }
+    if mentions(&["certificate", "handshake", "tls", "ssl"]) {
+        return NetErrorKind::Tls;
+    }
+    if timeout || io_kind == Some(io::ErrorKind::TimedOut) {
+        return if connect { NetErrorKind::ConnectTimeout } else { NetErrorKind::ReadTimeout };
+    }
+    if connect || io_kind == Some(io::ErrorKind::ConnectionRefused) || mentions(&["connection refused"]) {
+        return NetErrorKind::Connect;
+    }
+    NetErrorKind::Other
+}
+
+impl AppError {
+    /// A transport error with its category attached
+    pub fn network(err: &reqwest::Error, via_proxy: bool) -> AppError {
+        AppError::Network {
+            kind: classify_transport(err, via_proxy),
+            detail: redact_secrets(&err.to_string()),
+        }
+    }
+
+    /// Network category of the error, None when it is not a network failure
+    pub fn net_kind(&self) -> Option<NetErrorKind> {
+        match self {
+            AppError::Network { kind, .. } => Some(*kind),
+            AppError::HttpError(e) => Some(classify_transport(e, false)),
+            AppError::HttpStatus { status, .. } if *status >= 500 => Some(NetErrorKind::ServerError),
+            _ => None,
+        }
+    }
+}
+
+/// Outcome of one self-check hop
+#[derive(Debug, Clone, Serialize)]
+pub struct HopProbe {
+    pub hop: String,
+    pub url: String,
+    pub ok: bool,
+    pub status: Option<u16>,
+    pub kind: Option<NetErrorKind>,
+    pub hint: String,
+    pub ms: u64,
+}
+
+/// Request each hop the grabber depends on once, labelling the failing ones
+/// With a proxy the hops are requested through it, so a dead proxy shows as proxy_unreachable
+pub async fn probe_hops(proxy_url: Option<&str>) -> Vec<HopProbe> {
+    let mut builder = reqwest::Client::builder().timeout(Duration::from_secs(HOP_PROBE_TIMEOUT_SECS));
+    if let Some(url) = proxy_url {
+        match reqwest::Proxy::all(url) {
+            Ok(proxy) => builder = builder.proxy(proxy),
+            Err(e) => println!(">>> self-check proxy ignored: {}", e),
+        }
+    }
+    let client = match builder.build() {
+        Ok(client) => client,
+        Err(e) => {
+            println!(">>> self-check client failed: {}", e);
+            return Vec::new();
+        }
+    };
+
+    let hops = [
+        ("site", "https://www.91160.com/".to_string()),
+        ("gate", format!("https://{}/", DEFAULT_GATE_HOST)),
+    ];
+    let mut probes = Vec::new();
+    for (hop, url) in hops {
+        let started = Instant::now();
+        let (status, kind) = match client.get(&url).send().await {
+            Ok(resp) if resp.status().is_server_error() => (Some(resp.status().as_u16()), Some(NetErrorKind::ServerError)),
+            Ok(resp) => (Some(resp.status().as_u16()), None),
+            Err(e) => (None, Some(classify_transport(&e, proxy_url.is_some()))),
+        };
+        probes.push(HopProbe {
+            hop: hop.to_string(),
+            url,
+            ok: kind.is_none(),
+            status,
+            kind,
+            hint: kind.map(|k| k.hint().to_string()).unwrap_or_default(),
+            ms: started.elapsed().as_millis() as u64,
+        });
+    }
+    probes
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_classify_parts() {
+        let dns = "error sending request: client error (Connect): dns error: failed to lookup address information";
+        assert_eq!(classify_parts(dns, None, false, true, false), NetErrorKind::Dns);
+        let refused = "error sending request: client error (Connect): tcp connect error: Connection refused (os error 111)";
+        assert_eq!(classify_parts(refused, Some(io::ErrorKind::ConnectionRefused), false, true, false), NetErrorKind::Connect);
+        assert_eq!(classify_parts(refused, None, false, true, true), NetErrorKind::ProxyUnreachable);
+        let cert = "error sending request: client error (Connect): invalid peer certificate: Expired";
+        assert_eq!(classify_parts(cert, None, false, true, false), NetErrorKind::Tls);
+        assert_eq!(classify_parts("operation timed out", None, true, true, false), NetErrorKind::ConnectTimeout);
+        assert_eq!(classify_parts("error decoding response body: operation timed out", None, true, false, false), NetErrorKind::ReadTimeout);
+        assert_eq!(classify_parts("builder error", None, false, false, false), NetErrorKind::Other);
+    }
+
+    #[tokio::test]
+    async fn test_refused_connection_is_classified() {
+        let client = reqwest::Client::builder().timeout(Duration::from_secs(2)).build().unwrap();
+        let err = client.get("http://127.0.0.1:1/").send().await.unwrap_err();
+        assert_eq!(classify_transport(&err, false), NetErrorKind::Connect);
+        assert_eq!(classify_transport(&err, true), NetErrorKind::ProxyUnreachable);
+
+        let err = AppError::network(&err, false);
+        assert_eq!(err.net_kind(), Some(NetErrorKind::Connect));
+        assert_eq!(err.to_frontend_string(), "无法连接服务器，请检查网络连接");
+    }
+
+    #[test]
+    fn test_net_kind_of_status_errors() {
+        let status = |status| AppError::HttpStatus { status, url: "https://www.91160.com/".into(), snippet: String::new() };
+        assert_eq!(status(503).net_kind(), Some(NetErrorKind::ServerError));
+        assert_eq!(status(404).net_kind(), None);
+        assert_eq!(AppError::ScheduleEmpty.net_kind(), None);
+    }
+}
@@ -0,0 +1,352 @@
+//! Notification routing for SkylineMed
+//! The app and the grabber publish typed events into a registry, which hands each event to the sinks
+//! the user routed its type to. Each sink says which event types it can deliver, and a failing sink
+//! never keeps the others from being notified.
+
+use std::collections::HashMap;
+use std::future::Future;
+use std::pin::Pin;
+use std::sync::Arc;
+use std::time::Duration;
+
+use super::errors::{AppError, AppResult};
+use super::notify::{build_grab_summary, send_email};
+use super::types::{GrabResult, GrabStats, LogEntry, SmtpSettings};
+
+pub const EVENT_GRAB_SUCCESS: &str = "grab_success";
+pub const EVENT_GRAB_FAILURE: &str = "grab_failure";
+pub const EVENT_LOGIN_EXPIRING: &str = "login_expiring";
+pub const EVENT_THROTTLED: &str = "throttled";
+/// Sent by test_notification only, never routed
+pub const EVENT_TEST: &str = "test";
+/// Event types a routing matrix can name
+pub const EVENT_TYPES: [&str; 4] = [EVENT_GRAB_SUCCESS, EVENT_GRAB_FAILURE, EVENT_LOGIN_EXPIRING, EVENT_THROTTLED];
+
+pub const SINK_EMAIL: &str = "email";
+pub const SINK_DESKTOP: &str = "desktop";
+
+/// A sink that has not answered by then counts as failed
+const SINK_SEND_TIMEOUT: Duration = Duration::from_secs(30);
+
+/// Something worth telling the user about
+#[derive(Debug, Clone)]
+pub enum NotifyEvent {
+    GrabFinished {
+        result: GrabResult,
+        stats: GrabStats,
+        stopped: bool,
+        /// Recent log lines for the summary
+        logs: Vec<LogEntry>,
+    },
+    LoginExpiring {
+        expires_at: String,
+        grab_at: String,
+    },
+    /// The retry governor widened the interval after a throttling storm
+    Throttled {
+        throttled: usize,
+        window: usize,
+        interval: f64,
+    },
+    Test {
+        sink: String,
+    },
+}
+
+impl NotifyEvent {
+    /// Event type used as the routing key
+    pub fn event_type(&self) -> &'static str {
+        match self {
+            NotifyEvent::GrabFinished { result, .. } if result.success => EVENT_GRAB_SUCCESS,
+            NotifyEvent::GrabFinished { .. } => EVENT_GRAB_FAILURE,
+            NotifyEvent::LoginExpiring { .. } => EVENT_LOGIN_EXPIRING,
+            NotifyEvent::Throttled { .. } => EVENT_THROTTLED,
+            NotifyEvent::Test { .. } => EVENT_TEST,
+        }
+    }
+
+    /// Subject and body shared by every sink
+    pub fn render(&self) -> Notification {
+        match self {
+            NotifyEvent::GrabFinished { result, stats, stopped, logs } => {
+                let (subject, body) = build_grab_summary(result, stats, *stopped, logs);
+                Notification { subject, body }
+            }
+            NotifyEvent::LoginExpiring { expires_at, grab_at } => Notification {
+                subject: "[SkylineMed] Login expires before scheduled grab".into(),
+                body: format!(
+                    "The login expires at {} but the next grab is scheduled for {}.\nPlease scan the QR code again before then.\n",
+                    expires_at, grab_at
+                ),
+            },
+            NotifyEvent::Throttled { throttled, window, interval } => Notification {
+                subject: "[SkylineMed] Requests are being throttled".into(),
+                body: format!(
+                    "{} of the last {} requests were throttled; the retry interval was raised to {:.2}s.\n",
+                    throttled, window, interval
+                ),
+            },
+            NotifyEvent::Test { sink } => Notification {
+                subject: "[SkylineMed] Test notification".into(),
+                body: format!("The {} notification channel works.\n", sink),
+            },
+        }
+    }
+}
+
+/// Rendered event
+#[derive(Debug, Clone, PartialEq)]
+pub struct Notification {
+    pub subject: String,
+    pub body: String,
+}
+
+/// Boxed future returned by sinks
+pub type SendFuture<'a> = Pin<Box<dyn Future<Output = AppResult<()>> + Send + 'a>>;
+
+/// Delivers notifications over one channel
+pub trait NotificationSink: Send + Sync {
+    /// Id used in the routing matrix
+    fn id(&self) -> &str;
+    /// Event types this sink can deliver; routed events of other types are skipped
+    fn handles(&self) -> Vec<&'static str>;
+    fn send<'a>(&'a self, event: &'a NotifyEvent, notification: &'a Notification) -> SendFuture<'a>;
+}
+
+/// Callback the grabber publishes its events through
+pub type EventPublisher = Arc<dyn Fn(NotifyEvent) + Send + Sync>;
+
+/// Routing matrix: event type -> sink ids, stored under "notify_routes" in user state
+pub type NotifyRoutes = HashMap<String, Vec<String>>;
+
+/// Routes used until the user saves their own: the summary and expiry emails sent before routing existed
+pub fn default_notify_routes() -> NotifyRoutes {
+    [EVENT_GRAB_SUCCESS, EVENT_GRAB_FAILURE, EVENT_LOGIN_EXPIRING]
+        .iter()
+        .map(|event| (event.to_string(), vec![SINK_EMAIL.to_string()]))
+        .collect()
+}
+
+/// Outcome of one sink for a published event
+#[derive(Debug, Clone, PartialEq)]
+pub struct Delivery {
+    pub sink: String,
+    pub result: Result<(), String>,
+}
+
+/// Registered sinks
+#[derive(Default)]
+pub struct NotifierRegistry {
+    sinks: Vec<Arc<dyn NotificationSink>>,
+}
+
+impl NotifierRegistry {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Add a sink; a later sink with the same id replaces the earlier one
+    pub fn register(&mut self, sink: Arc<dyn NotificationSink>) {
+        self.sinks.retain(|s| s.id() != sink.id());
+        self.sinks.push(sink);
+    }
+
+    pub fn sink_ids(&self) -> Vec<String> {
+        self.sinks.iter().map(|s| s.id().to_string()).collect()
+    }
+
+    /// Hand event to every sink routed for its type that handles it, in route order
+    /// Unknown sink ids are skipped; one sink failing or hanging does not stop the rest
+    pub async fn publish(&self, event: &NotifyEvent, routes: &NotifyRoutes) -> Vec<Delivery> {
+        let Some(sink_ids) = routes.get(event.event_type()) else {
+            return Vec::new();
+        };
+        let notification = event.render();
+        let mut deliveries = Vec::new();
+        for id in sink_ids {
+            let Some(sink) = self.sinks.iter().find(|s| s.id() == id) else {
+                continue;
+            };
+            if !sink.handles().contains(&event.event_type()) {
+                continue;
+            }
+            let result = send_bounded(sink.as_ref(), event, &notification).await;
+            deliveries.push(Delivery { sink: id.clone(), result });
+        }
+        deliveries
+    }
+
+    /// Send a test notification through one sink, bypassing routing
+    pub async fn test(&self, sink_id: &str) -> AppResult<()> {
+        let sink = self
+            .sinks
+            .iter()
+            .find(|s| s.id() == sink_id)
+            .ok_or_else(|| AppError::ConfigError(format!("notification sink {} is not configured", sink_id)))?;
+        let event = NotifyEvent::Test { sink: sink_id.to_string() };
+        send_bounded(sink.as_ref(), &event, &event.render()).await.map_err(AppError::Other)
+    }
+}
+
+async fn send_bounded(sink: &dyn NotificationSink, event: &NotifyEvent, notification: &Notification) -> Result<(), String> {
+    match tokio::time::timeout(SINK_SEND_TIMEOUT, sink.send(event, notification)).await {
+        Ok(result) => result.map_err(|e| e.to_string()),
+        Err(_) => Err(AppError::Timeout(format!("{} notification", sink.id())).to_string()),
+    }
+}
+
+/// Sends notifications as plain text email over the saved SMTP settings
+/// Handles nothing while SMTP notifications are disabled, but can still be tested
+pub struct EmailSink {
+    settings: SmtpSettings,
+}
+
+impl EmailSink {
+    pub fn new(settings: SmtpSettings) -> Self {
+        Self { settings }
+    }
+}
+
+impl NotificationSink for EmailSink {
+    fn id(&self) -> &str {
+        SINK_EMAIL
+    }
+
+    fn handles(&self) -> Vec<&'static str> {
+        if self.settings.enabled {
+            EVENT_TYPES.to_vec()
+        } else {
+            Vec::new()
+        }
+    }
+
+    fn send<'a>(&'a self, _event: &'a NotifyEvent, notification: &'a Notification) -> SendFuture<'a> {
+        Box::pin(send_email(&self.settings, &notification.subject, &notification.body))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::Mutex;
+
+    struct RecordingSink {
+        id: &'static str,
+        handles: Vec<&'static str>,
+        fail: bool,
+        sent: Mutex<Vec<String>>,
+    }
+
+    impl RecordingSink {
+        fn new(id: &'static str, handles: &[&'static str], fail: bool) -> Arc<Self> {
+            Arc::new(Self { id, handles: handles.to_vec(), fail, sent: Mutex::new(Vec::new()) })
+        }
+
+        fn sent(&self) -> Vec<String> {
+            self.sent.lock().unwrap().clone()
+        }
+    }
+
+    impl NotificationSink for RecordingSink {
+        fn id(&self) -> &str {
+            self.id
+        }
+
+        fn handles(&self) -> Vec<&'static str> {
+            self.handles.clone()
+        }
+
+        fn send<'a>(&'a self, _event: &'a NotifyEvent, notification: &'a Notification) -> SendFuture<'a> {
+            Box::pin(async move {
+                if self.fail {
+                    return Err(AppError::Other("sink down".into()));
+                }
+                self.sent.lock().unwrap().push(notification.subject.clone());
+                Ok(())
+            })
+        }
+    }
+
+    fn grab_finished(success: bool) -> NotifyEvent {
+        NotifyEvent::GrabFinished {
+            result: GrabResult { success, message: String::new(), detail: None },
+            stats: GrabStats::default(),
+            stopped: false,
+            logs: Vec::new(),
+        }
+    }
+
+    fn routes(pairs: &[(&str, &[&str])]) -> NotifyRoutes {
+        pairs.iter().map(|(event, sinks)| (event.to_string(), sinks.iter().map(|s| s.to_string()).collect())).collect()
+    }
+
+    #[tokio::test]
+    async fn test_publish_follows_routes() {
+        let push = RecordingSink::new("push", &EVENT_TYPES, false);
+        let sound = RecordingSink::new("sound", &[EVENT_GRAB_SUCCESS], false);
+        let mut registry = NotifierRegistry::new();
+        registry.register(push.clone());
+        registry.register(sound.clone());
+        let routes = routes(&[
+            (EVENT_GRAB_SUCCESS, &["push", "sound"]),
+            (EVENT_LOGIN_EXPIRING, &["push", "sound", "missing"]),
+            (EVENT_THROTTLED, &[]),
+        ]);
+
+        let deliveries = registry.publish(&grab_finished(true), &routes).await;
+        assert_eq!(deliveries.iter().map(|d| d.sink.as_str()).collect::<Vec<_>>(), vec!["push", "sound"]);
+
+        // sound does not handle expiry and "missing" is not registered
+        let expiring = NotifyEvent::LoginExpiring { expires_at: "2026-10-16 08:00".into(), grab_at: "2026-10-17 08:00".into() };
+        let deliveries = registry.publish(&expiring, &routes).await;
+        assert_eq!(deliveries.iter().map(|d| d.sink.as_str()).collect::<Vec<_>>(), vec!["push"]);
+
+        // Routed to nothing, and failures have no route at all
+        let throttled = NotifyEvent::Throttled { throttled: 8, window: 20, interval: 0.75 };
+        assert!(registry.publish(&throttled, &routes).await.is_empty());
+        assert!(registry.publish(&grab_finished(false), &routes).await.is_empty());
+
+        assert_eq!(push.sent().len(), 2);
+        assert_eq!(sound.sent().len(), 1);
+    }
+
+    #[tokio::test]
+    async fn test_publish_without_sinks() {
+        let registry = NotifierRegistry::new();
+        assert!(registry.sink_ids().is_empty());
+        assert!(registry.publish(&grab_finished(true), &default_notify_routes()).await.is_empty());
+        assert!(registry.publish(&grab_finished(true), &NotifyRoutes::new()).await.is_empty());
+        assert!(registry.test(SINK_EMAIL).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_sink_errors_are_isolated() {
+        let broken = RecordingSink::new("broken", &EVENT_TYPES, true);
+        let push = RecordingSink::new("push", &EVENT_TYPES, false);
+        let mut registry = NotifierRegistry::new();
+        registry.register(broken.clone());
+        registry.register(push.clone());
+
+        let deliveries = registry.publish(&grab_finished(true), &routes(&[(EVENT_GRAB_SUCCESS, &["broken", "push"])])).await;
+        assert_eq!(
+            deliveries,
+            vec![
+                Delivery { sink: "broken".into(), result: Err(AppError::Other("sink down".into()).to_string()) },
+                Delivery { sink: "push".into(), result: Ok(()) },
+            ]
+        );
+        assert_eq!(push.sent(), vec!["[SkylineMed] Grab summary: booked".to_string()]);
+
+        assert!(registry.test("broken").await.is_err());
+        assert!(registry.test("push").await.is_ok());
+        assert_eq!(push.sent().last().unwrap(), "[SkylineMed] Test notification");
+    }
+
+    #[test]
+    fn test_disabled_email_sink_handles_nothing() {
+        let mut settings = SmtpSettings { host: "smtp.example.com".into(), to: "me@example.com".into(), ..Default::default() };
+        assert!(EmailSink::new(settings.clone()).handles().is_empty());
+        settings.enabled = true;
+        assert_eq!(EmailSink::new(settings).handles(), EVENT_TYPES.to_vec());
+    }
+}
@@ -0,0 +1,185 @@
+//! Run summary notifications for QuickDoctor
+//! Sends an email report over SMTP when a grab finishes, for unattended overnight runs.
+
+use std::time::Duration;
+
+use lettre::message::header::ContentType;
+use lettre::transport::smtp::authentication::Credentials;
+use lettre::{AsyncSmtpTransport, AsyncTransport, Message, Tokio1Executor};
+
+use super::errors::{AppError, AppResult};
+use super::types::{GrabResult, GrabStats, LogEntry, SmtpSettings, GRAB_SUCCESS_WAITLISTED};
+
+const SMTP_SEND_TIMEOUT: Duration = Duration::from_secs(20);
+/// Port using implicit TLS; other ports upgrade with STARTTLS
+const SMTP_IMPLICIT_TLS_PORT: u16 = 465;
+pub const SUMMARY_LOG_LINES: usize = 50;
+
+/// Send a plain text email using the given settings
+pub async fn send_email(settings: &SmtpSettings, subject: &str, body: &str) -> AppResult<()> {
+    if settings.host.trim().is_empty() || settings.to.trim().is_empty() {
+        return Err(AppError::ConfigError("smtp host and to address are required".into()));
+    }
+    let from = if settings.user.contains('@') { &settings.user } else { &settings.to };
+
+    let email = Message::builder()
+        .from(from.parse().map_err(|e| AppError::ConfigError(format!("invalid from address: {}", e)))?)
+        .to(settings.to.parse().map_err(|e| AppError::ConfigError(format!("invalid to address: {}", e)))?)
+        .subject(subject)
+        .header(ContentType::TEXT_PLAIN)
+        .body(body.to_string())
+        .map_err(|e| AppError::Other(format!("build email failed: {}", e)))?;
+
+    let host = settings.host.trim();
+    let builder = if settings.port == SMTP_IMPLICIT_TLS_PORT {
+        AsyncSmtpTransport::<Tokio1Executor>::relay(host)
+    } else {
+        AsyncSmtpTransport::<Tokio1Executor>::starttls_relay(host)
+    }
+    .map_err(|e| AppError::ConfigError(format!("smtp setup failed: {}", e)))?;
+
+    let mut builder = builder.port(settings.port).timeout(Some(SMTP_SEND_TIMEOUT));
+    if !settings.user.is_empty() {
+        builder = builder.credentials(Credentials::new(settings.user.clone(), settings.password.clone()));
+    }
+    let mailer: AsyncSmtpTransport<Tokio1Executor> = builder.build();
+
+    match tokio::time::timeout(SMTP_SEND_TIMEOUT, mailer.send(email)).await {
+        Ok(Ok(_)) => Ok(()),
+        Ok(Err(e)) => Err(AppError::Other(format!("smtp send failed: {}", e))),
+        Err(_) => Err(AppError::Timeout("smtp send".into())),
+    }
+}
+
+/// Build the subject and body of a grab summary email
+pub fn build_grab_summary(result: &GrabResult, stats: &GrabStats, stopped: bool, logs: &[LogEntry]) -> (String, String) {
+    let waitlisted = result.detail.as_ref().map_or(false, |d| d.kind == GRAB_SUCCESS_WAITLISTED);
+    let outcome = if result.success && waitlisted {
+        "waitlisted"
+    } else if result.success && result.detail.as_ref().map_or(false, |d| d.payment_required) {
+        "booked, payment required"
+    } else if result.success {
+        "booked"
+    } else if stopped {
+        "stopped"
+    } else {
+        "not booked"
+    };
+    let subject = format!("[SkylineMed] Grab summary: {}", outcome);
+
+    let mut body = String::new();
+    body.push_str(&format!("Finished: {}\n", chrono::Local::now().format("%Y-%m-%d %H:%M:%S")));
+    body.push_str(&format!("Result: {}\n", outcome));
+    if !result.message.is_empty() {
+        body.push_str(&format!("Message: {}\n", result.message));
+    }
+
+    if let Some(detail) = &result.detail {
+        body.push_str("\nBooking\n");
+        body.push_str(&format!("  Hospital: {}\n", detail.unit_name));
+        body.push_str(&format!("  Department: {}\n", detail.dep_name));
+        body.push_str(&format!("  Doctor: {}\n", detail.doctor_name));
+        body.push_str(&format!("  Date: {} {}\n", detail.date, detail.time_slot));
+        body.push_str(&format!("  Member: {}\n", detail.member_name));
+        if let Some(url) = &detail.url {
+            body.push_str(&format!("  URL: {}\n", url));
+        }
+        if detail.payment_required {
+            body.push_str("\nPayment required: the order is cancelled unless paid in time\n");
+            if let Some(deadline) = &detail.payment_deadline {
+                body.push_str(&format!("  Pay before: {}\n", deadline));
+            }
+            if let Some(url) = &detail.payment_url {
+                body.push_str(&format!("  Pay at: {}\n", url));
+            }
+        }
+    }
+
+    body.push_str("\nStats\n");
+    body.push_str(&format!("  Attempts: {}\n", stats.attempts));
+    body.push_str(&format!("  Timeouts: {}\n", stats.timeouts));
+    body.push_str(&format!("  Saved submits: {}\n", stats.saved_submits));
+    body.push_str(&format!("  Below min left: {}\n", stats.below_min));
+    for flow in &stats.unsupported_flows {
+        body.push_str(&format!("  Unsupported flow: {} {}\n", flow.flow, flow.url));
+    }
+    let mut phases: Vec<_> = stats.phases.iter().collect();
+    phases.sort_by(|a, b| a.0.cmp(b.0));
+    for (phase, timing) in phases {
+        body.push_str(&format!(
+            "  {}: count={} total={}ms p50={}ms p95={}ms max={}ms\n",
+            phase, timing.count, timing.total_ms, timing.p50_ms, timing.p95_ms, timing.max_ms
+        ));
+    }
+
+    if !logs.is_empty() {
+        body.push_str(&format!("\nLast {} log lines\n", logs.len()));
+        for entry in logs {
+            body.push_str(&format!("[{}] [{}] {}\n", entry.time, entry.level.to_uppercase(), entry.message));
+        }
+    }
+
+    (subject, body)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::core::types::{GrabSuccess, GRAB_SUCCESS_BOOKED};
+
+    #[test]
+    fn test_build_grab_summary() {
+        let result = GrabResult {
+            success: true,
+            message: "success".into(),
+            detail: Some(GrabSuccess {
+                kind: GRAB_SUCCESS_BOOKED.into(),
+                unit_name: "市人民医院".into(),
+                dep_name: "儿科".into(),
+                doctor_name: "张医生".into(),
+                date: "2026-10-16".into(),
+                time_slot: "3号".into(),
+                member_name: "小明".into(),
+                url: None,
+                ..Default::default()
+            }),
+        };
+        let stats = GrabStats {
+            attempts: 42,
+            ..Default::default()
+        };
+        let logs = vec![LogEntry {
+            time: "2026-10-16 07:00:01".into(),
+            level: "success".into(),
+            message: "抢号成功".into(),
+            ..Default::default()
+        }];
+
+        let (subject, body) = build_grab_summary(&result, &stats, false, &logs);
+        assert_eq!(subject, "[SkylineMed] Grab summary: booked");
+        assert!(body.contains("Doctor: 张医生"));
+        assert!(body.contains("Attempts: 42"));
+        assert!(body.contains("[2026-10-16 07:00:01] [SUCCESS] 抢号成功"));
+
+        let failed = GrabResult {
+            success: false,
+            message: "max retries reached".into(),
+            detail: None,
+        };
+        let (subject, body) = build_grab_summary(&failed, &stats, false, &[]);
+        assert_eq!(subject, "[SkylineMed] Grab summary: not booked");
+        assert!(!body.contains("Booking"));
+        assert_eq!(build_grab_summary(&failed, &stats, true, &[]).0, "[SkylineMed] Grab summary: stopped");
+
+        let mut unpaid = result.clone();
+        if let Some(detail) = unpaid.detail.as_mut() {
+            detail.payment_required = true;
+            detail.payment_url = Some("https://pay.91160.com/order/9".into());
+            detail.payment_deadline = Some("2026-10-16 07:15:00".into());
+        }
+        let (subject, body) = build_grab_summary(&unpaid, &stats, false, &[]);
+        assert_eq!(subject, "[SkylineMed] Grab summary: booked, payment required");
+        assert!(body.contains("Pay before: 2026-10-16 07:15:00"));
+        assert!(body.contains("Pay at: https://pay.91160.com/order/9"));
+    }
+}
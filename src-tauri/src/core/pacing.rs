@@ -0,0 +1,155 @@
+//! Per-hospital request pacing profiles for SkylineMed
+//! Hospitals tolerate different query rates; the store keeps a profile per unit_id
+
+use std::collections::HashMap;
+
+use chrono::{DateTime, Duration, Local};
+use serde::{Deserialize, Serialize};
+
+use super::errors::AppResult;
+use super::store::{store, Store};
+
+/// How long an observed throttle keeps a profile on the conservative side
+const THROTTLE_MEMORY_DAYS: i64 = 7;
+
+/// Request pacing for one hospital; intervals are in seconds
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct PacingProfile {
+    #[serde(default)]
+    pub name: String,
+    #[serde(default = "default_min_schedule_interval")]
+    pub min_schedule_interval: f64,
+    #[serde(default = "default_min_submit_interval")]
+    pub min_submit_interval: f64,
+    /// Multiplier for the random backoff after a too-fast response
+    #[serde(default = "default_multiplier")]
+    pub backoff_multiplier: f64,
+    /// Multiplier for both intervals while a recent throttle is remembered
+    #[serde(default = "default_throttled_multiplier")]
+    pub throttled_multiplier: f64,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub observed_throttle_at: Option<DateTime<Local>>,
+}
+
+impl Default for PacingProfile {
+    fn default() -> Self {
+        Self {
+            name: String::new(),
+            min_schedule_interval: default_min_schedule_interval(),
+            min_submit_interval: default_min_submit_interval(),
+            backoff_multiplier: default_multiplier(),
+            throttled_multiplier: default_throttled_multiplier(),
+            observed_throttle_at: None,
+        }
+    }
+}
+
+fn default_min_schedule_interval() -> f64 {
+    0.5
+}
+
+fn default_min_submit_interval() -> f64 {
+    1.8
+}
+
+fn default_multiplier() -> f64 {
+    1.0
+}
+
+fn default_throttled_multiplier() -> f64 {
+    1.5
+}
+
+impl PacingProfile {
+    /// Whether a throttle was observed recently enough to slow down
+    pub fn recently_throttled(&self, now: DateTime<Local>) -> bool {
+        self.observed_throttle_at
+            .map_or(false, |at| now - at < Duration::days(THROTTLE_MEMORY_DAYS))
+    }
+
+    /// Effective (schedule, submit) intervals, widened after a recent throttle
+    pub fn effective_intervals(&self, now: DateTime<Local>) -> (f64, f64) {
+        let factor = if self.recently_throttled(now) { self.throttled_multiplier.max(1.0) } else { 1.0 };
+        (self.min_schedule_interval * factor, self.min_submit_interval * factor)
+    }
+}
+
+/// Built-in profiles for hospitals known to throttle aggressively
+pub(super) fn default_pacing_profiles() -> HashMap<String, PacingProfile> {
+    let strict = |min_schedule_interval: f64, min_submit_interval: f64, backoff_multiplier: f64| PacingProfile {
+        min_schedule_interval,
+        min_submit_interval,
+        backoff_multiplier,
+        ..Default::default()
+    };
+
+    let mut profiles = HashMap::new();
+    profiles.insert("1040".into(), strict(1.5, 3.0, 1.5));
+    profiles.insert("1041".into(), strict(1.2, 2.5, 1.5));
+    profiles.insert("1154".into(), strict(2.0, 3.5, 2.0));
+    profiles.insert("2266".into(), strict(1.0, 2.5, 1.2));
+    profiles
+}
+
+/// Load all pacing profiles, falling back to the built-in defaults when none were saved
+pub fn load_pacing_profiles() -> AppResult<HashMap<String, PacingProfile>> {
+    store()?.pacing_profiles()
+}
+
+/// Get the pacing profile for a hospital, if one is stored
+pub fn load_pacing_profile(unit_id: &str) -> Option<PacingProfile> {
+    load_pacing_profiles().ok()?.remove(unit_id.trim())
+}
+
+/// Get the pacing profile for a hospital from store, if one is stored
+pub fn load_pacing_profile_in(store: &dyn Store, unit_id: &str) -> Option<PacingProfile> {
+    store.pacing_profiles().ok()?.remove(unit_id.trim())
+}
+
+/// Store the pacing profile for a hospital
+pub fn save_pacing_profile(unit_id: &str, profile: PacingProfile) -> AppResult<()> {
+    let unit_id = unit_id.trim().to_string();
+    store()?.update_pacing_profiles(&mut |profiles: &mut HashMap<String, PacingProfile>| {
+        profiles.insert(unit_id.clone(), profile.clone());
+    })
+}
+
+/// Record a too-fast response so future runs for this hospital start more conservatively
+/// Hospitals without a profile get the default one
+pub fn record_throttle_observed(store: &dyn Store, unit_id: &str) -> AppResult<()> {
+    store.update_pacing_profiles(&mut |profiles: &mut HashMap<String, PacingProfile>| {
+        profiles.entry(unit_id.trim().to_string()).or_default().observed_throttle_at = Some(Local::now());
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_effective_intervals() {
+        let now = Local::now();
+        let mut profile = PacingProfile {
+            min_schedule_interval: 1.0,
+            min_submit_interval: 2.0,
+            throttled_multiplier: 2.0,
+            ..Default::default()
+        };
+        assert_eq!(profile.effective_intervals(now), (1.0, 2.0));
+
+        profile.observed_throttle_at = Some(now - Duration::hours(3));
+        assert_eq!(profile.effective_intervals(now), (2.0, 4.0));
+
+        profile.observed_throttle_at = Some(now - Duration::days(THROTTLE_MEMORY_DAYS + 1));
+        assert_eq!(profile.effective_intervals(now), (1.0, 2.0));
+    }
+
+    #[test]
+    fn test_profile_defaults_from_partial_json() {
+        let profile: PacingProfile = serde_json::from_str(r#"{"min_submit_interval": 3.0}"#).unwrap();
+        assert_eq!(profile.min_submit_interval, 3.0);
+        assert_eq!(profile.min_schedule_interval, default_min_schedule_interval());
+        assert_eq!(profile.backoff_multiplier, 1.0);
+        assert!(profile.observed_throttle_at.is_none());
+    }
+}
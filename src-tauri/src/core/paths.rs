@@ -3,11 +3,28 @@
 
 use std::env;
 use std::fs;
-use std::path::PathBuf;
+use std::path::{Path, PathBuf};
+use std::sync::OnceLock;
 
 use super::errors::{AppError, AppResult};
 
 const CONFIG_DIR_ENV: &str = "SKYLINEMED_CONFIG_DIR";
+const APP_CACHE_DIR_NAME: &str = "SkylineMed";
+
+/// Files of the JSON store in the config dir, see store.rs
+pub const HISTORY_FILE: &str = "history.json";
+pub const PACING_FILE: &str = "pacing.json";
+pub const INSIGHTS_FILE: &str = "insights.json";
+pub const SUBMIT_COUNTS_FILE: &str = "submit_counts.json";
+pub const STORE_DB_FILE: &str = "skylinemed.db";
+/// Other files kept in the config dir
+pub const COOKIES_FILE: &str = "cookies.json";
+pub const USER_STATE_FILE: &str = "user_state.json";
+pub const AREAS_FILE: &str = "areas.json";
+pub const GATES_FILE: &str = "gates.json";
+
+/// Resolved logs directory and whether the fallback location is in use
+static LOGS_DIR: OnceLock<(PathBuf, bool)> = OnceLock::new();
 
 /// Get the configuration directory
 pub fn config_dir() -> AppResult<PathBuf> {
@@ -59,13 +76,120 @@ pub fn config_dir() -> AppResult<PathBuf> {
     ))
 }
 
+/// Config directory of one client: the process config dir, or a directory it was given
+/// Runs that share a process but not their files (tests, side-by-side accounts) each hold their own
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct ConfigDir(Option<PathBuf>);
+
+impl ConfigDir {
+    /// Keep files in dir instead of the process config dir
+    pub fn at(dir: impl Into<PathBuf>) -> Self {
+        Self(Some(dir.into()))
+    }
+
+    /// Whether this is the process config dir
+    pub fn is_default(&self) -> bool {
+        self.0.is_none()
+    }
+
+    /// The directory, created if needed
+    pub fn path(&self) -> AppResult<PathBuf> {
+        match &self.0 {
+            Some(dir) => {
+                fs::create_dir_all(dir)?;
+                Ok(dir.clone())
+            }
+            None => config_dir(),
+        }
+    }
+
+    /// Path of file in the directory
+    pub fn join(&self, file: &str) -> AppResult<PathBuf> {
+        Ok(self.path()?.join(file))
+    }
+}
+
+/// Write a file atomically: write a sibling temp file, then rename it over the target
+pub fn write_file_atomic(path: &Path, data: &[u8]) -> AppResult<()> {
+    if let Some(parent) = path.parent() {
+        fs::create_dir_all(parent)?;
+    }
+    let mut tmp_name = path.file_name().unwrap_or_default().to_os_string();
+    tmp_name.push(".tmp");
+    let tmp = path.with_file_name(tmp_name);
+    fs::write(&tmp, data)?;
+    if let Err(e) = fs::rename(&tmp, path) {
+        let _ = fs::remove_file(&tmp);
+        return Err(e.into());
+    }
+    Ok(())
+}
+
 /// Get the logs directory
+/// Falls back to the user cache directory when the primary location isn't writable
 pub fn logs_dir() -> AppResult<PathBuf> {
+    if let Some((dir, _)) = LOGS_DIR.get() {
+        return Ok(dir.clone());
+    }
+
     let config = config_dir()?;
     let root = config.parent().unwrap_or(&config);
-    let logs = root.join("logs");
-    fs::create_dir_all(&logs)?;
-    Ok(logs)
+    let primary = root.join("logs");
+    let fallback = directories::BaseDirs::new()
+        .map(|dirs| dirs.cache_dir().join(APP_CACHE_DIR_NAME).join("logs"));
+
+    let (dir, used_fallback) = resolve_logs_dir(&primary, fallback.as_deref())?;
+    if used_fallback {
+        println!(
+            ">>> Warning: logs directory {} is not writable, using {}",
+            primary.display(),
+            dir.display()
+        );
+    }
+    Ok(LOGS_DIR.get_or_init(|| (dir, used_fallback)).0.clone())
+}
+
+/// Get the scan reports directory, creating it if needed
+pub fn reports_dir() -> AppResult<PathBuf> {
+    let dir = logs_dir()?.join("reports");
+    fs::create_dir_all(&dir)?;
+    Ok(dir)
+}
+
+/// Check whether the logs directory fell back to the user cache directory
+pub fn logs_dir_is_fallback() -> bool {
+    LOGS_DIR.get().map(|(_, fallback)| *fallback).unwrap_or(false)
+}
+
+/// Resolve the logs directory, preferring primary when it is writable
+fn resolve_logs_dir(primary: &Path, fallback: Option<&Path>) -> AppResult<(PathBuf, bool)> {
+    if is_dir_writable(primary) {
+        return Ok((primary.to_path_buf(), false));
+    }
+    if let Some(fallback) = fallback {
+        if is_dir_writable(fallback) {
+            return Ok((fallback.to_path_buf(), true));
+        }
+    }
+    Err(AppError::ConfigError(format!(
+        "Unable to create logs directory: {}",
+        primary.display()
+    )))
+}
+
+/// Create the directory if needed and verify a file can be written into it
+fn is_dir_writable(dir: &Path) -> bool {
+    if fs::create_dir_all(dir).is_err() {
+        return false;
+    }
+    let probe = dir.join(".write_test");
+    match fs::write(&probe, b"") {
+        Ok(()) => {
+            let _ = fs::remove_file(&probe);
+            true
+        }
+        Err(_) => false,
+    }
 }
 
 /// Check if a file exists
@@ -76,12 +200,7 @@ pub fn file_exists(path: &PathBuf) -> bool {
 
 /// Get the cookies file path
 pub fn cookies_path() -> AppResult<PathBuf> {
-    Ok(config_dir()?.join("cookies.json"))
-}
-
-/// Get the user state file path
-pub fn user_state_path() -> AppResult<PathBuf> {
-    Ok(config_dir()?.join("user_state.json"))
+    ConfigDir::default().join(COOKIES_FILE)
 }
 
 /// Get the cities file path
@@ -89,10 +208,85 @@ pub fn cities_path() -> AppResult<PathBuf> {
     Ok(config_dir()?.join("cities.json"))
 }
 
+/// Get the cached address area tree file path
+pub fn areas_path() -> AppResult<PathBuf> {
+    ConfigDir::default().join(AREAS_FILE)
+}
+
+/// Get the proxy settings and known-good proxies file path
+pub fn proxies_path() -> AppResult<PathBuf> {
+    Ok(config_dir()?.join("proxies.json"))
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
 
+    fn temp_test_dir(name: &str) -> PathBuf {
+        let dir = env::temp_dir().join(format!("skylinemed_{}_{}", name, std::process::id()));
+        let _ = fs::remove_dir_all(&dir);
+        fs::create_dir_all(&dir).unwrap();
+        dir
+    }
+
+    #[test]
+    fn test_resolve_logs_dir_primary() {
+        let root = temp_test_dir("logs_primary");
+        let primary = root.join("logs");
+        let fallback = root.join("cache").join("logs");
+        let (dir, used_fallback) = resolve_logs_dir(&primary, Some(&fallback)).unwrap();
+        assert_eq!(dir, primary);
+        assert!(!used_fallback);
+        let _ = fs::remove_dir_all(&root);
+    }
+
+    #[test]
+    fn test_resolve_logs_dir_fallback_when_parent_is_file() {
+        let root = temp_test_dir("logs_file_parent");
+        let blocker = root.join("config");
+        fs::write(&blocker, b"").unwrap();
+        let primary = blocker.join("logs");
+        let fallback = root.join("cache").join("logs");
+        let (dir, used_fallback) = resolve_logs_dir(&primary, Some(&fallback)).unwrap();
+        assert_eq!(dir, fallback);
+        assert!(used_fallback);
+        assert!(resolve_logs_dir(&primary, None).is_err());
+        let _ = fs::remove_dir_all(&root);
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_resolve_logs_dir_fallback_when_read_only() {
+        use std::os::unix::fs::PermissionsExt;
+
+        let root = temp_test_dir("logs_read_only");
+        let install = root.join("install");
+        fs::create_dir_all(&install).unwrap();
+        fs::set_permissions(&install, fs::Permissions::from_mode(0o555)).unwrap();
+
+        // Permission bits don't apply to root, nothing to verify there
+        if !is_dir_writable(&install) {
+            let primary = install.join("logs");
+            let fallback = root.join("cache").join("logs");
+            let (dir, used_fallback) = resolve_logs_dir(&primary, Some(&fallback)).unwrap();
+            assert_eq!(dir, fallback);
+            assert!(used_fallback);
+        }
+
+        fs::set_permissions(&install, fs::Permissions::from_mode(0o755)).unwrap();
+        let _ = fs::remove_dir_all(&root);
+    }
+
+    #[test]
+    fn test_config_dir_at() {
+        let root = temp_test_dir("config_dir_at");
+        let dir = ConfigDir::at(root.join("client"));
+        assert!(!dir.is_default() && ConfigDir::default().is_default());
+        assert_eq!(dir.join(USER_STATE_FILE).unwrap(), root.join("client").join(USER_STATE_FILE));
+        assert!(root.join("client").is_dir());
+        let _ = fs::remove_dir_all(&root);
+    }
+
     #[test]
     fn test_config_dir() {
         // This test requires the config directory to exist
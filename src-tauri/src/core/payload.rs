@@ -0,0 +1,219 @@
+//! Machine-readable grab success payload for SkylineMed
+//! Every sender (hooks, UI events, future webhooks) serializes this one struct, so automation can rely
+//! on its shape. Fields are always present; unknown values are null. Bump SUCCESS_PAYLOAD_VERSION on
+//! any change that is not a pure addition. testdata/payload/success.example.json is a documented example.
+
+use std::sync::OnceLock;
+
+use serde::{Deserialize, Serialize};
+
+use super::types::{GrabStats, GrabSuccess};
+
+pub const SUCCESS_PAYLOAD_VERSION: u32 = 1;
+
+/// Event type prefix; the grab success kind ("booked", "waitlisted") completes it
+const EVENT_PREFIX: &str = "grab.";
+
+/// Id and display name of a hospital, department or doctor
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct NamedRef {
+    pub id: String,
+    pub name: String,
+}
+
+/// Booked time slot; start and end are null when the label has no "HH:MM-HH:MM" range
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct SlotRef {
+    pub label: String,
+    pub start: Option<String>,
+    pub end: Option<String>,
+}
+
+/// Member with id and name masked
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct MaskedMember {
+    pub id: String,
+    pub name: String,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct PaymentRef {
+    pub required: bool,
+    pub url: Option<String>,
+    pub deadline: Option<String>,
+}
+
+/// Success notification payload, schema version SUCCESS_PAYLOAD_VERSION
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct SuccessPayload {
+    pub version: u32,
+    /// "grab.booked" or "grab.waitlisted"
+    pub event: String,
+    pub task_id: String,
+    pub unit: NamedRef,
+    pub dep: NamedRef,
+    pub doctor: NamedRef,
+    pub date: String,
+    pub slot: SlotRef,
+    pub member: MaskedMember,
+    pub order_no: Option<String>,
+    pub payment: PaymentRef,
+    pub attempts: u32,
+}
+
+/// Build the success payload of a grab task
+pub fn build_success_payload(task_id: &str, detail: &GrabSuccess, stats: &GrabStats) -> SuccessPayload {
+    let (start, end) = parse_slot_range(&detail.time_slot).unzip();
+    SuccessPayload {
+        version: SUCCESS_PAYLOAD_VERSION,
+        event: format!("{}{}", EVENT_PREFIX, detail.kind),
+        task_id: task_id.to_string(),
+        unit: NamedRef { id: detail.unit_id.clone(), name: detail.unit_name.clone() },
+        dep: NamedRef { id: detail.dep_id.clone(), name: detail.dep_name.clone() },
+        doctor: NamedRef { id: detail.doctor_id.clone(), name: detail.doctor_name.clone() },
+        date: detail.date.clone(),
+        slot: SlotRef { label: detail.time_slot.clone(), start, end },
+        member: MaskedMember {
+            id: mask_member_id(&detail.member_id),
+            // member_name falls back to the id when the name is unknown
+            name: if detail.member_name == detail.member_id { String::new() } else { mask_member_name(&detail.member_name) },
+        },
+        order_no: detail.order_no.clone(),
+        payment: PaymentRef {
+            required: detail.payment_required,
+            url: detail.payment_url.clone(),
+            deadline: detail.payment_deadline.clone(),
+        },
+        attempts: stats.attempts,
+    }
+}
+
+/// Start and end of a "08:00-08:30" style slot label
+fn parse_slot_range(label: &str) -> Option<(String, String)> {
+    static SLOT_RANGE_RE: OnceLock<regex::Regex> = OnceLock::new();
+    let re = SLOT_RANGE_RE.get_or_init(|| regex::Regex::new(r"(\d{1,2}:\d{2})\s*(?:-|~|～|至|—)\s*(\d{1,2}:\d{2})").unwrap());
+    let caps = re.captures(label)?;
+    Some((caps[1].to_string(), caps[2].to_string()))
+}
+
+/// Keep the first and last 2 characters of a member id
+fn mask_member_id(id: &str) -> String {
+    let chars: Vec<char> = id.trim().chars().collect();
+    if chars.is_empty() {
+        return String::new();
+    }
+    if chars.len() <= 4 {
+        return "***".into();
+    }
+    let head: String = chars[..2].iter().collect();
+    let tail: String = chars[chars.len() - 2..].iter().collect();
+    format!("{}***{}", head, tail)
+}
+
+/// Keep the family name: "王秀兰" -> "王**"
+fn mask_member_name(name: &str) -> String {
+    let mut chars = name.trim().chars();
+    match chars.next() {
+        Some(first) => std::iter::once(first).chain(chars.map(|_| '*')).collect(),
+        None => String::new(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::core::types::{GRAB_SUCCESS_BOOKED, GRAB_SUCCESS_WAITLISTED};
+    use std::path::PathBuf;
+
+    fn booked() -> GrabSuccess {
+        GrabSuccess {
+            kind: GRAB_SUCCESS_BOOKED.into(),
+            unit_name: "市一医院".into(),
+            dep_name: "儿科".into(),
+            doctor_name: "张医生".into(),
+            date: "2026-10-20".into(),
+            time_slot: "08:00-08:30".into(),
+            member_name: "王秀兰".into(),
+            unit_id: "200001".into(),
+            dep_id: "300001".into(),
+            doctor_id: "900001".into(),
+            member_id: "10023401".into(),
+            url: Some("https://www.91160.com/pay/cashier.html?order_id=88001234".into()),
+            order_no: Some("88001234".into()),
+            payment_required: true,
+            payment_url: Some("https://www.91160.com/pay/cashier.html?order_id=88001234".into()),
+            payment_deadline: Some("2026-10-20 08:15:00".into()),
+        }
+    }
+
+    /// Schema check: every object carries exactly its documented fields with the documented JSON types
+    fn assert_schema(value: &serde_json::Value) {
+        fn keys(value: &serde_json::Value) -> Vec<&str> {
+            let mut keys: Vec<&str> = value.as_object().unwrap().keys().map(String::as_str).collect();
+            keys.sort();
+            keys
+        }
+        let nullable_string = |v: &serde_json::Value| v.is_null() || v.is_string();
+
+        assert_eq!(
+            keys(value),
+            vec!["attempts", "date", "dep", "doctor", "event", "member", "order_no", "payment", "slot", "task_id", "unit", "version"]
+        );
+        assert_eq!(value["version"], SUCCESS_PAYLOAD_VERSION);
+        assert!(value["event"].as_str().unwrap().starts_with(EVENT_PREFIX));
+        assert!(value["task_id"].is_string() && value["date"].is_string() && value["attempts"].is_u64());
+        for key in ["unit", "dep", "doctor", "member"] {
+            assert_eq!(keys(&value[key]), vec!["id", "name"], "{}", key);
+            assert!(value[key]["id"].is_string() && value[key]["name"].is_string(), "{}", key);
+        }
+        assert_eq!(keys(&value["slot"]), vec!["end", "label", "start"]);
+        assert!(value["slot"]["label"].is_string());
+        assert!(nullable_string(&value["slot"]["start"]) && nullable_string(&value["slot"]["end"]));
+        assert_eq!(keys(&value["payment"]), vec!["deadline", "required", "url"]);
+        assert!(value["payment"]["required"].is_boolean());
+        assert!(nullable_string(&value["payment"]["url"]) && nullable_string(&value["payment"]["deadline"]));
+        assert!(nullable_string(&value["order_no"]));
+    }
+
+    /// The documented example is what build_success_payload produces; set UPDATE_GOLDEN=1 to rewrite it
+    #[test]
+    fn test_success_payload_example() {
+        let stats = GrabStats { attempts: 37, ..Default::default() };
+        let actual = serde_json::to_value(build_success_payload("12", &booked(), &stats)).unwrap();
+        assert_schema(&actual);
+
+        let path = PathBuf::from(env!("CARGO_MANIFEST_DIR")).join("testdata").join("payload").join("success.example.json");
+        if std::env::var("UPDATE_GOLDEN").is_ok() {
+            std::fs::write(&path, serde_json::to_string_pretty(&actual).unwrap() + "\n").unwrap();
+            return;
+        }
+        let expected: serde_json::Value = serde_json::from_str(&std::fs::read_to_string(&path).unwrap()).unwrap();
+        assert_eq!(actual, expected, "success payload example mismatch");
+        assert_schema(&expected);
+    }
+
+    #[test]
+    fn test_success_payload_waitlisted_unknowns() {
+        let detail = GrabSuccess {
+            kind: GRAB_SUCCESS_WAITLISTED.into(),
+            time_slot: "上午".into(),
+            member_name: "1001".into(),
+            member_id: "1001".into(),
+            ..Default::default()
+        };
+        let payload = build_success_payload("3", &detail, &GrabStats::default());
+        assert_eq!(payload.event, "grab.waitlisted");
+        assert_eq!((payload.slot.start, payload.slot.end), (None, None));
+        assert_eq!((payload.member.id.as_str(), payload.member.name.as_str()), ("***", ""));
+        assert_eq!(payload.order_no, None);
+        assert!(!payload.payment.required);
+        assert_schema(&serde_json::to_value(build_success_payload("3", &detail, &GrabStats::default())).unwrap());
+    }
+
+    #[test]
+    fn test_masking_and_slot_range() {
+        assert_eq!(mask_member_name("王秀兰"), "王**");
+        assert_eq!(mask_member_id("10023401"), "10***01");
+        assert_eq!(parse_slot_range("14:00 至 14:30"), Some(("14:00".into(), "14:30".into())));
+    }
+}
@@ -0,0 +1,177 @@
+//! Pre-trigger prefetch for scheduled grabs
+//! Lookups the hot phase needs anyway (member list, address label) are run while waiting for
+//! start_time, between T-45s and T-15s: late enough to still be fresh, early enough not to compete
+//! with the schedule and submit requests at T-0. Results land in the caches the hot phase reads.
+
+use std::sync::Arc;
+use std::time::Duration;
+
+use tokio::time::Instant;
+use tokio_util::sync::CancellationToken;
+
+use super::areas::cached_area_label;
+use super::client::HealthClient;
+use super::types::GrabConfig;
+
+/// Prefetch starts this long before the trigger
+pub const PREFETCH_WINDOW_START: Duration = Duration::from_secs(45);
+/// No prefetch task starts or runs later than this before the trigger
+pub const PREFETCH_WINDOW_END: Duration = Duration::from_secs(15);
+/// Time box of a single task
+const PREFETCH_TASK_TIMEOUT: Duration = Duration::from_secs(5);
+
+/// Prefetch tasks, in run order
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum PrefetchTask {
+    /// Member list, read by the certification check before submit
+    Members,
+    /// Label of the configured address area
+    Address,
+}
+
+impl PrefetchTask {
+    pub fn name(self) -> &'static str {
+        match self {
+            PrefetchTask::Members => "members",
+            PrefetchTask::Address => "address",
+        }
+    }
+}
+
+/// How a prefetch task ended
+#[derive(Debug, Clone, PartialEq)]
+pub enum PrefetchStatus {
+    Done(String),
+    Failed(String),
+    TimedOut,
+    /// The window closed before the task could start
+    Skipped,
+}
+
+#[derive(Debug, Clone, PartialEq)]
+pub struct PrefetchOutcome {
+    pub task: PrefetchTask,
+    pub status: PrefetchStatus,
+}
+
+/// Tasks that apply to a config
+pub fn prefetch_tasks(config: &GrabConfig) -> Vec<PrefetchTask> {
+    let mut tasks = vec![PrefetchTask::Members];
+    if !config.address_area_id.trim().is_empty() {
+        tasks.push(PrefetchTask::Address);
+    }
+    tasks
+}
+
+/// Run the config's prefetch tasks inside the window before trigger
+/// Returns early with what finished when cancel fires; callers abort it at the trigger, so it never
+/// delays the grab itself
+pub async fn run_prefetch(
+    client: Arc<HealthClient>,
+    config: GrabConfig,
+    trigger: Instant,
+    cancel: CancellationToken,
+) -> Vec<PrefetchOutcome> {
+    let window_start = trigger.checked_sub(PREFETCH_WINDOW_START).unwrap_or(trigger);
+    let window_end = trigger.checked_sub(PREFETCH_WINDOW_END).unwrap_or(trigger);
+    tokio::select! {
+        _ = tokio::time::sleep_until(window_start) => {}
+        _ = cancel.cancelled() => return Vec::new(),
+    }
+
+    let mut outcomes = Vec::new();
+    for task in prefetch_tasks(&config) {
+        let now = Instant::now();
+        if now >= window_end {
+            outcomes.push(PrefetchOutcome { task, status: PrefetchStatus::Skipped });
+            continue;
+        }
+        let budget = PREFETCH_TASK_TIMEOUT.min(window_end - now);
+        let status = tokio::select! {
+            result = tokio::time::timeout(budget, run_task(&client, &config, task)) => match result {
+                Ok(Ok(detail)) => PrefetchStatus::Done(detail),
+                Ok(Err(error)) => PrefetchStatus::Failed(error),
+                Err(_) => PrefetchStatus::TimedOut,
+            },
+            _ = cancel.cancelled() => break,
+        };
+        outcomes.push(PrefetchOutcome { task, status });
+    }
+    outcomes
+}
+
+async fn run_task(client: &HealthClient, config: &GrabConfig, task: PrefetchTask) -> Result<String, String> {
+    match task {
+        PrefetchTask::Members => {
+            let members = client.get_members().await.map_err(|e| e.to_string())?;
+            match members.iter().find(|m| m.id == config.member_id) {
+                Some(member) if member.certified => Ok(format!("{} certified", member.name)),
+                Some(member) => Ok(format!("{} not certified", member.name)),
+                None => Err(format!("member {} not found", config.member_id)),
+            }
+        }
+        PrefetchTask::Address => {
+            cached_area_label(&config.address_area_id).ok_or_else(|| format!("area {} unknown", config.address_area_id.trim()))
+        }
+    }
+}
+
+/// "members=ok(张三 certified) address=skipped" for the log
+pub fn summarize_prefetch(outcomes: &[PrefetchOutcome]) -> String {
+    outcomes
+        .iter()
+        .map(|outcome| {
+            let status = match &outcome.status {
+                PrefetchStatus::Done(detail) => format!("ok({})", detail),
+                PrefetchStatus::Failed(error) => format!("failed({})", error),
+                PrefetchStatus::TimedOut => "timeout".to_string(),
+                PrefetchStatus::Skipped => "skipped".to_string(),
+            };
+            format!("{}={}", outcome.task.name(), status)
+        })
+        .collect::<Vec<_>>()
+        .join(" ")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn config(area: &str) -> GrabConfig {
+        serde_json::from_value(serde_json::json!({
+            "unit_id": "1", "dep_id": "2", "member_id": "3", "target_dates": ["2026-10-16"], "address_area_id": area
+        }))
+        .unwrap()
+    }
+
+    #[test]
+    fn test_prefetch_tasks_and_summary() {
+        assert_eq!(prefetch_tasks(&config("")), vec![PrefetchTask::Members]);
+        assert_eq!(prefetch_tasks(&config("440305")), vec![PrefetchTask::Members, PrefetchTask::Address]);
+
+        let outcomes = vec![
+            PrefetchOutcome { task: PrefetchTask::Members, status: PrefetchStatus::Done("张三 certified".into()) },
+            PrefetchOutcome { task: PrefetchTask::Address, status: PrefetchStatus::Skipped },
+        ];
+        assert_eq!(summarize_prefetch(&outcomes), "members=ok(张三 certified) address=skipped");
+    }
+
+    #[tokio::test]
+    async fn test_prefetch_skipped_after_window() {
+        // Trigger 10s away: the window already closed, nothing is requested
+        let client = Arc::new(HealthClient::new().unwrap());
+        let trigger = Instant::now() + Duration::from_secs(10);
+        let outcomes = run_prefetch(client, config("440305"), trigger, CancellationToken::new()).await;
+        assert!(outcomes.iter().all(|o| o.status == PrefetchStatus::Skipped));
+        assert_eq!(outcomes.len(), 2);
+    }
+
+    #[tokio::test]
+    async fn test_prefetch_cancelled_before_window() {
+        let client = Arc::new(HealthClient::new().unwrap());
+        let cancel = CancellationToken::new();
+        cancel.cancel();
+        let trigger = Instant::now() + Duration::from_secs(3600);
+        assert!(run_prefetch(client, config(""), trigger, cancel).await.is_empty());
+    }
+}
@@ -0,0 +1,127 @@
+//! Client profiles for SkylineMed
+//! A profile is the identity the client presents: the browser headers plus the TLS and ALPN
+//! choices reqwest lets us vary. rustls cannot reproduce a browser's exact ClientHello, so profiles
+//! differ by offered protocol versions rather than by cipher ordering.
+
+use std::sync::Arc;
+use std::time::Duration;
+
+use reqwest::cookie::Jar;
+use reqwest::header::{HeaderMap, HeaderValue, USER_AGENT};
+use reqwest::Client;
+
+/// Identity presented to the server
+#[derive(Debug, Clone, PartialEq)]
+pub struct ClientProfile {
+    pub name: String,
+    pub user_agent: String,
+    /// sec-ch-ua; None for browsers that send no client hints
+    pub sec_ch_ua: Option<String>,
+    /// Offer TLS 1.2 at most
+    pub tls12_only: bool,
+    /// Offer only http/1.1 in ALPN
+    pub http1_only: bool,
+}
+
+impl ClientProfile {
+    fn new(name: &str, user_agent: &str, sec_ch_ua: Option<&str>) -> Self {
+        Self {
+            name: name.into(),
+            user_agent: user_agent.into(),
+            sec_ch_ua: sec_ch_ua.map(str::to_string),
+            tls12_only: false,
+            http1_only: false,
+        }
+    }
+
+    /// Chrome 120 on Windows, the identity the client has always used
+    pub fn chrome_120() -> Self {
+        Self::new(
+            "chrome_120",
+            "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+            Some("\"Not_A Brand\";v=\"8\", \"Chromium\";v=\"120\", \"Google Chrome\";v=\"120\""),
+        )
+    }
+
+    /// Edge 122 on Windows over http/1.1
+    pub fn edge_122() -> Self {
+        Self {
+            http1_only: true,
+            ..Self::new(
+                "edge_122",
+                "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/122.0.0.0 Safari/537.36 Edg/122.0.0.0",
+                Some("\"Chromium\";v=\"122\", \"Not(A:Brand\";v=\"24\", \"Microsoft Edge\";v=\"122\""),
+            )
+        }
+    }
+
+    /// Firefox 123 on Windows, TLS 1.2 only
+    pub fn firefox_123() -> Self {
+        Self {
+            tls12_only: true,
+            ..Self::new("firefox_123", "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:123.0) Gecko/20100101 Firefox/123.0", None)
+        }
+    }
+
+    /// Replace the identity headers on a request; client hints are dropped for profiles without them
+    pub fn apply(&self, headers: &mut HeaderMap) {
+        if let Ok(value) = HeaderValue::from_str(&self.user_agent) {
+            headers.insert(USER_AGENT, value);
+        }
+        match self.sec_ch_ua.as_deref().and_then(|v| HeaderValue::from_str(v).ok()) {
+            Some(value) => {
+                headers.insert("sec-ch-ua", value);
+            }
+            None => {
+                for name in ["sec-ch-ua", "sec-ch-ua-mobile", "sec-ch-ua-platform"] {
+                    headers.remove(name);
+                }
+            }
+        }
+    }
+
+    /// Build an HTTP client for this profile on the given cookie jar
+    pub fn build_client(&self, cookie_jar: Arc<Jar>) -> reqwest::Result<Client> {
+        let mut builder = Client::builder()
+            .user_agent(self.user_agent.as_str())
+            .cookie_provider(cookie_jar)
+            .timeout(Duration::from_secs(30))
+            .connect_timeout(Duration::from_secs(10))
+            .gzip(true)
+            .brotli(true);
+        if self.tls12_only {
+            builder = builder.max_tls_version(reqwest::tls::Version::TLS_1_2);
+        }
+        if self.http1_only {
+            builder = builder.http1_only();
+        }
+        builder.build()
+    }
+}
+
+/// Profiles shipped with the app, the default first
+pub fn builtin_profiles() -> Vec<ClientProfile> {
+    vec![ClientProfile::chrome_120(), ClientProfile::edge_122(), ClientProfile::firefox_123()]
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_apply_profile_headers() {
+        let mut headers = HeaderMap::new();
+        headers.insert("sec-ch-ua", HeaderValue::from_static("x"));
+        headers.insert("sec-ch-ua-platform", HeaderValue::from_static("\"Windows\""));
+
+        ClientProfile::edge_122().apply(&mut headers);
+        assert!(headers[USER_AGENT].to_str().unwrap().contains("Edg/122"));
+        assert!(headers["sec-ch-ua"].to_str().unwrap().contains("Microsoft Edge"));
+        assert!(headers.contains_key("sec-ch-ua-platform"));
+
+        ClientProfile::firefox_123().apply(&mut headers);
+        assert!(headers[USER_AGENT].to_str().unwrap().contains("Firefox/123"));
+        assert!(!headers.contains_key("sec-ch-ua"));
+        assert!(!headers.contains_key("sec-ch-ua-platform"));
+    }
+}
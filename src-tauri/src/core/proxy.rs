@@ -1,14 +1,19 @@
 //! Proxy management for QuickDoctor
 //! Corresponds to core/proxy.go
 
+use std::fs;
+use std::sync::atomic::{AtomicU64, Ordering};
 use std::time::Duration;
 
-use rand::Rng;
+use chrono::{DateTime, Local};
 use reqwest::Client;
-use serde::Deserialize;
+use serde::{Deserialize, Serialize};
 use tokio::sync::RwLock;
 
+use super::backoff::{Backoff, BackoffPolicy};
+use super::client::status_error;
 use super::errors::{AppError, AppResult};
+use super::paths::{proxies_path, write_file_atomic};
 
 const PROXY_API_URL: &str = "https://proxy.scdn.io/api/get_proxy.php";
 const PROXY_PROBE_URL: &str = "https://www.91160.com/favicon.ico";
@@ -18,8 +23,120 @@ const DEFAULT_PROXY_FETCH_COUNT: i32 = 6;
 const PROXY_API_TIMEOUT_SECS: u64 = 12;
 const PROXY_PROBE_TIMEOUT_SECS: u64 = 6;
 const PROXY_API_RETRY_MAX: i32 = 3;
-const PROXY_API_RETRY_BACKOFF_MIN_MS: u64 = 400;
-const PROXY_API_RETRY_BACKOFF_MAX_MS: u64 = 900;
+const PROXY_API_RETRY_BACKOFF: BackoffPolicy = BackoffPolicy::jittered(Duration::from_millis(400), Duration::from_millis(900));
+const DEFAULT_PROXY_MAX_AGE_HOURS: u64 = 24;
+const DEFAULT_PROXY_KEEP: usize = 8;
+
+/// Proxy source and cache settings, kept in config/proxies.json
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ProxySettings {
+    /// "https", "http", "socks5" or "all"
+    #[serde(default = "default_proxy_protocol")]
+    pub protocol: String,
+    #[serde(default = "default_proxy_country")]
+    pub country: String,
+    /// Own proxy list, one host:port or URL per line; replaces the proxy API when set
+    #[serde(default)]
+    pub user_list_path: String,
+    /// Known-good proxies older than this are dropped
+    #[serde(default = "default_proxy_max_age_hours")]
+    pub max_age_hours: u64,
+    /// Known-good proxies kept, newest first
+    #[serde(default = "default_proxy_keep")]
+    pub keep: usize,
+}
+
+impl Default for ProxySettings {
+    fn default() -> Self {
+        Self {
+            protocol: default_proxy_protocol(),
+            country: default_proxy_country(),
+            user_list_path: String::new(),
+            max_age_hours: default_proxy_max_age_hours(),
+            keep: default_proxy_keep(),
+        }
+    }
+}
+
+fn default_proxy_protocol() -> String {
+    DEFAULT_PROXY_PROTOCOL.to_string()
+}
+
+fn default_proxy_country() -> String {
+    DEFAULT_PROXY_COUNTRY.to_string()
+}
+
+fn default_proxy_max_age_hours() -> u64 {
+    DEFAULT_PROXY_MAX_AGE_HOURS
+}
+
+fn default_proxy_keep() -> usize {
+    DEFAULT_PROXY_KEEP
+}
+
+/// A proxy that passed the probe, with when it last did
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct KnownProxy {
+    pub url: String,
+    pub last_success: DateTime<Local>,
+}
+
+/// Contents of config/proxies.json
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct ProxyCache {
+    #[serde(default)]
+    pub settings: ProxySettings,
+    /// Newest first
+    #[serde(default)]
+    pub known_good: Vec<KnownProxy>,
+}
+
+impl ProxyCache {
+    /// Drop entries older than max_age_hours and keep at most `keep`, newest first
+    pub fn prune(&mut self, now: DateTime<Local>) {
+        let max_age = chrono::Duration::hours(self.settings.max_age_hours as i64);
+        self.known_good.retain(|p| now - p.last_success <= max_age);
+        self.known_good.sort_by(|a, b| b.last_success.cmp(&a.last_success));
+        self.known_good.truncate(self.settings.keep);
+    }
+
+    /// Move a proxy to the front with a fresh timestamp
+    pub fn record_success(&mut self, url: &str, now: DateTime<Local>) {
+        self.known_good.retain(|p| p.url != url);
+        self.known_good.insert(0, KnownProxy { url: url.to_string(), last_success: now });
+        self.prune(now);
+    }
+}
+
+/// Persisted pool state for the settings screen
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ProxyPoolStatus {
+    pub settings: ProxySettings,
+    pub known_good: usize,
+    pub newest_success: Option<DateTime<Local>>,
+    pub oldest_success: Option<DateTime<Local>>,
+    /// Known-good proxies read from disk at startup, before the re-probe
+    pub restored: usize,
+    /// Rotations served from the known-good list instead of a fresh fetch
+    pub cache_hits: u64,
+}
+
+/// Load the proxy cache; defaults when the file is missing or invalid
+pub fn load_proxy_cache() -> AppResult<ProxyCache> {
+    let path = proxies_path()?;
+    if !path.exists() {
+        return Ok(ProxyCache::default());
+    }
+
+    let data = fs::read_to_string(&path)?;
+    Ok(serde_json::from_str(&data).unwrap_or_default())
+}
+
+/// Save the proxy cache
+pub fn save_proxy_cache(cache: &ProxyCache) -> AppResult<()> {
+    let data = serde_json::to_string_pretty(cache)?;
+    write_file_atomic(&proxies_path()?, data.as_bytes())
+}
 
 #[derive(Debug, Deserialize)]
 struct ProxyAPIResponse {
@@ -35,50 +152,153 @@ struct ProxyAPIData {
     count: i32,
 }
 
+/// Fetched proxies and the protocol/country they were fetched for
+/// Kept under one lock so a reader never sees a list from one fetch with the key of another
+#[derive(Default)]
+struct PoolState {
+    proxies: Vec<String>,
+    protocol: String,
+    country: String,
+}
+
 /// Proxy pool manager
+/// Safe to share between tasks; each fetched proxy is handed out at most once, while known-good
+/// proxies are reused until they fail a probe
 pub struct ProxyPool {
-    pool: RwLock<Vec<String>>,
-    protocol: RwLock<String>,
-    country: RwLock<String>,
+    state: RwLock<PoolState>,
+    cache: RwLock<ProxyCache>,
+    /// Whether the cache is written back to config/proxies.json
+    persist: bool,
+    restored: usize,
+    cache_hits: AtomicU64,
 }
 
 impl ProxyPool {
-    /// Create a new proxy pool
+    /// Create a new in-memory proxy pool with default settings
     pub fn new() -> Self {
         Self {
-            pool: RwLock::new(Vec::new()),
-            protocol: RwLock::new(String::new()),
-            country: RwLock::new(String::new()),
+            state: RwLock::new(PoolState::default()),
+            cache: RwLock::new(ProxyCache::default()),
+            persist: false,
+            restored: 0,
+            cache_hits: AtomicU64::new(0),
+        }
+    }
+
+    /// Create a pool from config/proxies.json, expired entries dropped; changes are written back
+    pub fn restore() -> Self {
+        let mut cache = load_proxy_cache().unwrap_or_default();
+        cache.prune(Local::now());
+        Self {
+            restored: cache.known_good.len(),
+            cache: RwLock::new(cache),
+            persist: true,
+            ..Self::new()
+        }
+    }
+
+    /// Probe every known-good proxy concurrently and drop the ones that fail; returns how many survived
+    pub async fn reprobe_known(&self) -> usize {
+        let urls: Vec<String> = self.cache.read().await.known_good.iter().map(|p| p.url.clone()).collect();
+        if urls.is_empty() {
+            return 0;
+        }
+
+        let probes: Vec<_> = urls
+            .iter()
+            .cloned()
+            .map(|url| tokio::spawn(async move { test_proxy_connectivity(&url).await.is_ok().then_some(url) }))
+            .collect();
+        let mut alive = Vec::new();
+        for probe in probes {
+            if let Ok(Some(url)) = probe.await {
+                alive.push(url);
+            }
+        }
+
+        let now = Local::now();
+        let mut cache = self.cache.write().await;
+        // Proxies recorded while probing were not part of this round
+        cache.known_good.retain(|p| alive.contains(&p.url) || !urls.contains(&p.url));
+        for proxy in cache.known_good.iter_mut().filter(|p| alive.contains(&p.url)) {
+            proxy.last_success = now;
         }
+        let survived = alive.len();
+        self.save(&cache);
+        survived
+    }
+
+    /// Current settings
+    pub async fn settings(&self) -> ProxySettings {
+        self.cache.read().await.settings.clone()
     }
 
-    /// Rotate to a new proxy
+    /// Replace the settings; a changed source empties the fetched list
+    pub async fn set_settings(&self, settings: ProxySettings) {
+        let mut cache = self.cache.write().await;
+        if cache.settings.protocol != settings.protocol
+            || cache.settings.country != settings.country
+            || cache.settings.user_list_path != settings.user_list_path
+        {
+            self.state.write().await.proxies.clear();
+        }
+        cache.settings = settings;
+        cache.prune(Local::now());
+        self.save(&cache);
+    }
+
+    /// Persisted pool state for display
+    pub async fn status(&self) -> ProxyPoolStatus {
+        let cache = self.cache.read().await;
+        ProxyPoolStatus {
+            settings: cache.settings.clone(),
+            known_good: cache.known_good.len(),
+            newest_success: cache.known_good.iter().map(|p| p.last_success).max(),
+            oldest_success: cache.known_good.iter().map(|p| p.last_success).min(),
+            restored: self.restored,
+            cache_hits: self.cache_hits.load(Ordering::Relaxed),
+        }
+    }
+
+    /// Rotate using the configured protocol and country
+    pub async fn rotate(&self) -> AppResult<String> {
+        let settings = self.settings().await;
+        self.rotate_proxy(&settings.protocol, &settings.country).await
+    }
+
+    /// Rotate to a new proxy; the newest known-good proxy still passing the probe wins
     pub async fn rotate_proxy(&self, protocol: &str, country: &str) -> AppResult<String> {
         let protocols = resolve_proxy_protocols(protocol)?;
         let normalized_country = normalize_proxy_country(country);
 
+        if let Some(proxy_url) = self.take_known_good(&protocols).await {
+            self.cache_hits.fetch_add(1, Ordering::Relaxed);
+            return Ok(proxy_url);
+        }
+
         let mut error_notes = Vec::new();
 
         for normalized_protocol in &protocols {
             // Check if we need to fetch new proxies
             let need_fetch = {
-                let current_protocol = self.protocol.read().await;
-                let current_country = self.country.read().await;
-                let pool = self.pool.read().await;
-                *normalized_protocol != *current_protocol
-                    || normalized_country != *current_country
-                    || pool.is_empty()
+                let state = self.state.read().await;
+                !state.matches(normalized_protocol, &normalized_country) || state.proxies.is_empty()
             };
 
             if need_fetch {
-                match fetch_proxy_list(normalized_protocol, &normalized_country, DEFAULT_PROXY_FETCH_COUNT).await {
+                let user_list_path = self.cache.read().await.settings.user_list_path.clone();
+                let fetched = if user_list_path.trim().is_empty() {
+                    fetch_proxy_list(normalized_protocol, &normalized_country, DEFAULT_PROXY_FETCH_COUNT).await
+                } else {
+                    read_proxy_list(user_list_path.trim())
+                };
+                match fetched {
                     Ok(list) => {
-                        let mut pool = self.pool.write().await;
-                        let mut protocol_lock = self.protocol.write().await;
-                        let mut country_lock = self.country.write().await;
-                        *pool = list;
-                        *protocol_lock = normalized_protocol.clone();
-                        *country_lock = normalized_country.clone();
+                        *self.state.write().await = PoolState {
+                            proxies: list,
+                            protocol: normalized_protocol.clone(),
+                            country: normalized_country.clone(),
+                        };
                     }
                     Err(e) => {
                         error_notes.push(format!("{}: {}", normalized_protocol, e));
@@ -91,12 +311,13 @@ impl ProxyPool {
             let mut last_err: Option<AppError> = None;
 
             loop {
+                // Another task may have refetched for a different protocol meanwhile
                 let proxy_host = {
-                    let mut pool = self.pool.write().await;
-                    if pool.is_empty() {
+                    let mut state = self.state.write().await;
+                    if state.proxies.is_empty() || !state.matches(normalized_protocol, &normalized_country) {
                         break;
                     }
-                    pool.remove(0)
+                    state.proxies.remove(0)
                 };
 
                 let proxy_host = proxy_host.trim().to_string();
@@ -114,6 +335,7 @@ impl ProxyPool {
                     continue;
                 }
 
+                self.record_success(&proxy_url).await;
                 return Ok(proxy_url);
             }
 
@@ -125,17 +347,69 @@ impl ProxyPool {
         }
 
         if error_notes.is_empty() {
-            Err(AppError::ProxyError("no proxy available".into()))
+            Err(AppError::ProxyExhausted("no proxy source configured".into()))
         } else {
-            Err(AppError::ProxyError(error_notes.join("; ")))
+            Err(AppError::ProxyExhausted(error_notes.join("; ")))
         }
     }
 
+    /// Stop handing out a proxy that failed a real request
+    pub async fn discard(&self, url: &str) {
+        let mut cache = self.cache.write().await;
+        cache.known_good.retain(|p| p.url != url);
+        self.save(&cache);
+    }
+
     /// Clear proxy pool
     #[allow(dead_code)]
     pub async fn clear(&self) {
-        let mut pool = self.pool.write().await;
-        pool.clear();
+        self.state.write().await.proxies.clear();
+    }
+
+    /// Newest known-good proxy of one of the protocols that passes the probe; failing ones are dropped
+    async fn take_known_good(&self, protocols: &[String]) -> Option<String> {
+        let candidates: Vec<String> = self
+            .cache
+            .read()
+            .await
+            .known_good
+            .iter()
+            .map(|p| p.url.clone())
+            .filter(|url| protocols.iter().any(|protocol| url.starts_with(&format!("{}://", protocol))))
+            .collect();
+
+        for url in candidates {
+            if test_proxy_connectivity(&url).await.is_ok() {
+                self.record_success(&url).await;
+                return Some(url);
+            }
+            let mut cache = self.cache.write().await;
+            cache.known_good.retain(|p| p.url != url);
+            self.save(&cache);
+        }
+        None
+    }
+
+    async fn record_success(&self, url: &str) {
+        let mut cache = self.cache.write().await;
+        cache.record_success(url, Local::now());
+        self.save(&cache);
+    }
+
+    fn save(&self, cache: &ProxyCache) {
+        if !self.persist {
+            return;
+        }
+        if let Err(e) = save_proxy_cache(cache) {
+            println!(">>> saving proxy cache failed: {}", e);
+        }
+    }
+}
+
+impl PoolState {
+    /// Whether the pool was fetched for this protocol and country
+    fn matches(&self, protocol: &str, country: &str) -> bool {
+        self.protocol == protocol && self.country == country
     }
 }
 
@@ -175,6 +449,7 @@ async fn fetch_proxy_list(protocol: &str, country: &str, count: i32) -> AppResul
     let country = normalize_proxy_country(country);
 
     let mut last_err: Option<AppError> = None;
+    let mut backoff = Backoff::new(PROXY_API_RETRY_BACKOFF);
 
     for attempt in 1..=PROXY_API_RETRY_MAX {
         match fetch_proxy_list_once(protocol, &country, count).await {
@@ -188,8 +463,7 @@ async fn fetch_proxy_list(protocol: &str, country: &str, count: i32) -> AppResul
         }
 
         if attempt < PROXY_API_RETRY_MAX {
-            let backoff = random_backoff_ms(PROXY_API_RETRY_BACKOFF_MIN_MS, PROXY_API_RETRY_BACKOFF_MAX_MS);
-            tokio::time::sleep(Duration::from_millis(backoff)).await;
+            backoff.wait().await;
         }
     }
 
@@ -209,7 +483,7 @@ async fn fetch_proxy_list_once(protocol: &str, country: &str, count: i32) -> App
 
     let resp = client.get(&url).send().await?;
     if !resp.status().is_success() {
-        return Err(AppError::ProxyError(format!("proxy api http {}", resp.status())));
+        return Err(status_error(resp).await);
     }
 
     let payload: ProxyAPIResponse = resp.json().await?;
@@ -238,6 +512,26 @@ async fn fetch_proxy_list_once(protocol: &str, country: &str, count: i32) -> App
     Ok(out)
 }
 
+/// Read a user-supplied proxy list; blank lines and # comments are skipped
+fn read_proxy_list(path: &str) -> AppResult<Vec<String>> {
+    let data = fs::read_to_string(path).map_err(|e| AppError::ProxyError(format!("proxy list {}: {}", path, e)))?;
+    let list = parse_proxy_list(&data);
+    if list.is_empty() {
+        return Err(AppError::ProxyError("proxy list is empty".into()));
+    }
+    Ok(list)
+}
+
+fn parse_proxy_list(data: &str) -> Vec<String> {
+    let mut unique = std::collections::HashSet::new();
+    data.lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty() && !line.starts_with('#'))
+        .map(str::to_string)
+        .filter(|line| unique.insert(line.clone()))
+        .collect()
+}
+
 /// Build proxy URL from protocol and host
 fn build_proxy_url(protocol: &str, host: &str) -> String {
     let host = host.trim();
@@ -262,25 +556,12 @@ async fn test_proxy_connectivity(proxy_url: &str) -> AppResult<()> {
     let resp = client.get(PROXY_PROBE_URL).send().await?;
 
     if !resp.status().is_success() && resp.status().as_u16() >= 400 {
-        return Err(AppError::ProxyError(format!("proxy probe http {}", resp.status())));
+        return Err(status_error(resp).await);
     }
 
     Ok(())
 }
 
-/// Random backoff in milliseconds
-fn random_backoff_ms(min_ms: u64, max_ms: u64) -> u64 {
-    if min_ms == 0 && max_ms == 0 {
-        return 0;
-    }
-    let max = if max_ms < min_ms { min_ms } else { max_ms };
-    if max == min_ms {
-        return max;
-    }
-    let mut rng = rand::thread_rng();
-    rng.gen_range(min_ms..=max)
-}
-
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -298,4 +579,46 @@ mod tests {
         assert_eq!(build_proxy_url("https", "http://1.2.3.4:8080"), "http://1.2.3.4:8080");
         assert!(build_proxy_url("https", "").is_empty());
     }
+
+    #[test]
+    fn test_proxy_cache_prune_and_record() {
+        let now = Local::now();
+        let mut cache = ProxyCache {
+            settings: ProxySettings { keep: 2, max_age_hours: 24, ..Default::default() },
+            known_good: vec![
+                KnownProxy { url: "https://1.1.1.1:80".into(), last_success: now - chrono::Duration::hours(30) },
+                KnownProxy { url: "https://2.2.2.2:80".into(), last_success: now - chrono::Duration::hours(2) },
+                KnownProxy { url: "https://3.3.3.3:80".into(), last_success: now - chrono::Duration::hours(1) },
+            ],
+        };
+        cache.prune(now);
+        let urls: Vec<&str> = cache.known_good.iter().map(|p| p.url.as_str()).collect();
+        assert_eq!(urls, ["https://3.3.3.3:80", "https://2.2.2.2:80"]);
+
+        cache.record_success("https://4.4.4.4:80", now);
+        let urls: Vec<&str> = cache.known_good.iter().map(|p| p.url.as_str()).collect();
+        assert_eq!(urls, ["https://4.4.4.4:80", "https://3.3.3.3:80"]);
+
+        // Old files without settings still load
+        let loaded: ProxyCache = serde_json::from_str(r#"{"known_good": []}"#).unwrap();
+        assert_eq!(loaded.settings, ProxySettings::default());
+    }
+
+    #[test]
+    fn test_parse_proxy_list() {
+        let list = parse_proxy_list("# office\n1.2.3.4:8080\n\n socks5://5.6.7.8:1080 \n1.2.3.4:8080\n");
+        assert_eq!(list, ["1.2.3.4:8080", "socks5://5.6.7.8:1080"]);
+    }
+
+    #[tokio::test]
+    async fn test_pool_status_counts_known_good() {
+        let pool = ProxyPool::new();
+        pool.record_success("https://1.2.3.4:8080").await;
+        let status = pool.status().await;
+        assert_eq!(status.known_good, 1);
+        assert_eq!(status.restored, 0);
+        assert!(status.newest_success.is_some());
+        // No known-good proxy for socks5
+        assert!(pool.take_known_good(&["socks5".to_string()]).await.is_none());
+    }
 }
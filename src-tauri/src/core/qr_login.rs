@@ -1,36 +1,69 @@
 //! QR Login for QuickDoctor
 //! Corresponds to core/qr_login.go - WeChat QR code login flow
 
-use std::sync::Arc;
+use std::future::Future;
+use std::sync::{Arc, OnceLock};
 use std::time::Duration;
 
 use base64::Engine;
 use regex::Regex;
-use reqwest::cookie::Jar;
-use reqwest::header::{HeaderValue, ACCEPT, CONNECTION, ORIGIN, REFERER, USER_AGENT};
+use reqwest::header::{HeaderValue, ACCEPT, CONNECTION, LOCATION, ORIGIN, REFERER, USER_AGENT};
 use reqwest::Client;
 use tokio::sync::RwLock;
+use tokio_util::sync::CancellationToken;
 use url::Url;
 
-use super::cookies::save_cookie_file;
+use super::cookies::{load_cookie_file, save_cookie_file, touch_cookie_records, ExpiryJar};
 use super::errors::{AppError, AppResult};
-use super::types::{CookieRecord, QRLoginResult};
+use super::paths::ConfigDir;
+use super::state::load_qr_warmup_urls;
+use super::types::QRLoginResult;
 
 const WECHAT_APP_ID: &str = "wxdfec0615563d691d";
 const WECHAT_REDIRECT: &str = "http://user.91160.com/supplier-wechat.html";
 const QR_CONNECT_ORIGIN: &str = "https://open.weixin.qq.com/";
+const QR_CONNECT_BASE: &str = "https://open.weixin.qq.com";
+/// Upper bound on fetching the connect page and the QR image together
+const QR_IMAGE_TIMEOUT: Duration = Duration::from_secs(15);
+/// Result message of a session that was stopped or replaced by a newer one
+pub const QR_SESSION_SUPERSEDED: &str = "session superseded";
 const DEFAULT_USER_AGENT: &str = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36";
+/// Redirects followed from the login callback before giving up
+const MAX_CALLBACK_HOPS: usize = 10;
+/// 91160 URLs found in the callback pages that are visited before the configured warm-up URLs
+const MAX_DISCOVERED_WARMUP_URLS: usize = 5;
+/// URL fragments never visited during warm-up, since they end the fresh session
+const WARMUP_SKIP_MARKERS: [&str; 3] = ["logout", "loginout", "exit"];
+
+/// One response in the login callback's redirect chain
+#[derive(Debug, Clone, Default, PartialEq, serde::Deserialize)]
+pub struct RedirectHop {
+    pub url: String,
+    pub status: u16,
+    #[serde(default)]
+    pub location: Option<String>,
+    /// Body of non-redirect responses, searched for further 91160 URLs
+    #[serde(default)]
+    pub body: String,
+}
 
 /// WeChat QR Login handler
 pub struct FastQRLogin {
     uuid: RwLock<String>,
     state: RwLock<String>,
     client: Client,
+    /// Cancelled when this login is stopped or a newer one starts
+    session: CancellationToken,
 }
 
 impl FastQRLogin {
     /// Create a new QR login handler
     pub fn new() -> AppResult<Self> {
+        Self::for_session(CancellationToken::new())
+    }
+
+    /// Create a handler tied to a login session; once session is cancelled it never persists cookies
+    pub fn for_session(session: CancellationToken) -> AppResult<Self> {
         let client = Client::builder()
             .user_agent(DEFAULT_USER_AGENT)
             .timeout(Duration::from_secs(30))
@@ -41,11 +74,25 @@ impl FastQRLogin {
             uuid: RwLock::new(String::new()),
             state: RwLock::new(String::new()),
             client,
+            session,
         })
     }
 
-    /// Get QR code image and UUID
-    pub async fn get_qr_image(&self) -> AppResult<(Vec<u8>, String)> {
+    /// Get QR code image and UUID; gives up after QR_IMAGE_TIMEOUT or as soon as cancel fires
+    pub async fn get_qr_image(&self, cancel: &CancellationToken) -> AppResult<(Vec<u8>, String)> {
+        self.get_qr_image_from(QR_CONNECT_BASE, cancel).await
+    }
+
+    async fn get_qr_image_from(&self, base: &str, cancel: &CancellationToken) -> AppResult<(Vec<u8>, String)> {
+        tokio::select! {
+            _ = cancel.cancelled() => Err(AppError::Cancelled),
+            result = tokio::time::timeout(QR_IMAGE_TIMEOUT, self.fetch_qr_image(base)) => {
+                result.unwrap_or_else(|_| Err(AppError::Timeout("QR image".into())))
+            }
+        }
+    }
+
+    async fn fetch_qr_image(&self, base: &str) -> AppResult<(Vec<u8>, String)> {
         let state = format!("login_{}", chrono::Utc::now().timestamp());
         {
             let mut state_lock = self.state.write().await;
@@ -54,8 +101,8 @@ impl FastQRLogin {
 
         let encoded_redirect = urlencoding::encode(WECHAT_REDIRECT);
         let target_url = format!(
-            "https://open.weixin.qq.com/connect/qrconnect?appid={}&redirect_uri={}&response_type=code&scope=snsapi_login&state={}#wechat_redirect",
-            WECHAT_APP_ID, encoded_redirect, state
+            "{}/connect/qrconnect?appid={}&redirect_uri={}&response_type=code&scope=snsapi_login&state={}#wechat_redirect",
+            base, WECHAT_APP_ID, encoded_redirect, state
         );
 
         let resp = self
@@ -81,7 +128,7 @@ impl FastQRLogin {
         }
 
         // Fetch QR code image
-        let qr_url = format!("https://open.weixin.qq.com/connect/qrcode/{}", uuid);
+        let qr_url = format!("{}/connect/qrcode/{}", base, uuid);
         let qr_resp = self
             .client
             .get(&qr_url)
@@ -138,6 +185,9 @@ impl FastQRLogin {
         let re_redirect = Regex::new(r#"window\.location(?:\.href|\.replace)?\s*\(?['"]([^'"]+)['"]"#).unwrap();
 
         loop {
+            if self.session.is_cancelled() {
+                return superseded_result();
+            }
             if start.elapsed() > timeout {
                 return QRLoginResult {
                     success: false,
@@ -258,7 +308,7 @@ impl FastQRLogin {
     /// Exchange code for cookies
     async fn exchange_cookie(&self, code: &str) -> QRLoginResult {
         println!(">>> Debug: Starting cookie exchange with code: {}", code);
-        let cookie_jar = Arc::new(Jar::default());
+        let cookie_jar = Arc::new(ExpiryJar::default());
 
         let client = match Client::builder()
             .user_agent(DEFAULT_USER_AGENT)
@@ -289,49 +339,37 @@ impl FastQRLogin {
         };
         println!(">>> Debug: Callback URL: {}", callback_url);
 
-        // Follow redirect chain
-        match client
-            .get(&callback_url)
-            .header(USER_AGENT, DEFAULT_USER_AGENT)
-            .header(REFERER, QR_CONNECT_ORIGIN)
-            .send()
-            .await 
-        {
-            Ok(resp) => println!(">>> Debug: Callback response: status={}, url={}", resp.status(), resp.url()),
-            Err(e) => println!(">>> Debug: Callback request failed: {}", e),
+        // Follow the callback's redirect chain by hand so every hop is known
+        let hop_client = Client::builder()
+            .user_agent(DEFAULT_USER_AGENT)
+            .cookie_provider(cookie_jar.clone())
+            .redirect(reqwest::redirect::Policy::none())
+            .build()
+            .unwrap_or_else(|_| client.clone());
+        let hops = follow_redirect_chain(&callback_url, |url| fetch_hop(&hop_client, url)).await;
+        for hop in &hops {
+            println!(">>> Debug: Callback hop: status={}, url={}", hop.status, hop.url);
         }
 
-        let _ = client.get("https://www.91160.com/").send().await;
-        let _ = client.get("https://user.91160.com/user/index.html").send().await;
+        for url in warmup_urls(&hops, &load_qr_warmup_urls()) {
+            match client.get(&url).header(REFERER, QR_CONNECT_ORIGIN).send().await {
+                Ok(resp) => println!(">>> Debug: Warm-up {} -> {}", url, resp.status()),
+                Err(e) => println!(">>> Debug: Warm-up {} failed: {}", url, e),
+            }
+        }
 
-        // Extract cookies from jar - use CookieStore trait
+        // Extract cookies from jar, with the expiry their Set-Cookie carried
         let mut records = Vec::new();
         // Check valid domains that would contain the cookies
         for start_url in ["https://www.91160.com", "https://user.91160.com"] {
             if let Ok(url) = Url::parse(start_url) {
-                use reqwest::cookie::CookieStore;
-                if let Some(header_value) = cookie_jar.cookies(&url) {
-                    println!(">>> Debug: Cookies for {}: {:?}", start_url, header_value);
-                    if let Ok(cookie_str) = header_value.to_str() {
-                        for part in cookie_str.split(';') {
-                            let part = part.trim();
-                            if let Some(eq_pos) = part.find('=') {
-                                let name = part[..eq_pos].trim().to_string();
-                                let value = part[eq_pos + 1..].trim().to_string();
-                                if !name.is_empty() && !value.is_empty() {
-                                    records.push(CookieRecord {
-                                        name,
-                                        value,
-                                        domain: ".91160.com".into(), // Default to root domain
-                                        path: "/".into(),
-                                    });
-                                }
-                            }
-                        }
-                    }
-                } else {
+                let found = cookie_jar.records_for(&url);
+                if found.is_empty() {
                     println!(">>> Debug: No cookies found for {}", start_url);
+                } else {
+                    println!(">>> Debug: Cookies for {}: {:?}", start_url, found.iter().map(|r| &r.name).collect::<Vec<_>>());
                 }
+                records.extend(found);
             }
         }
 
@@ -339,7 +377,7 @@ impl FastQRLogin {
             println!(">>> Debug: No cookies extracted from any domain");
             return QRLoginResult {
                 success: false,
-                message: "no cookies received".into(),
+                message: format!("no cookies received (hops: {})", hop_hosts(&hops)),
                 cookie_path: None,
             };
         }
@@ -353,15 +391,21 @@ impl FastQRLogin {
             // Actually, let's NOT fail, let's Try to save anyway so we can inspect the file
         }
 
-        match save_cookie_file(&records) {
-            Ok(()) => {
+        let saved = persist_if_current(&self.session, || {
+            let dir = ConfigDir::default();
+            let previous = load_cookie_file(&dir).unwrap_or_default();
+            save_cookie_file(&dir, &touch_cookie_records(records, &previous))
+        });
+        match saved {
+            None => superseded_result(),
+            Some(Ok(())) => {
                 let path = super::paths::cookies_path().ok().map(|p| p.to_string_lossy().to_string());
                 
                 // If we are strictly checking for access_hash, we should return error here if missing
                 if !has_access {
                      return QRLoginResult {
                         success: false,
-                        message: "missing access_hash (check console for details)".into(),
+                        message: format!("missing access_hash (hops: {})", hop_hosts(&hops)),
                         cookie_path: path, // Return path so we know it saved something
                     };
                 }
@@ -372,7 +416,7 @@ impl FastQRLogin {
                     cookie_path: path,
                 }
             }
-            Err(e) => QRLoginResult {
+            Some(Err(e)) => QRLoginResult {
                 success: false,
                 message: e.to_string(),
                 cookie_path: None,
@@ -381,8 +425,8 @@ impl FastQRLogin {
     }
 
     /// Get QR image as base64
-    pub async fn get_qr_image_base64(&self) -> AppResult<(String, String)> {
-        let (bytes, uuid) = self.get_qr_image().await?;
+    pub async fn get_qr_image_base64(&self, cancel: &CancellationToken) -> AppResult<(String, String)> {
+        let (bytes, uuid) = self.get_qr_image(cancel).await?;
         let base64 = base64::engine::general_purpose::STANDARD.encode(&bytes);
         Ok((base64, uuid))
     }
@@ -394,6 +438,145 @@ impl Default for FastQRLogin {
     }
 }
 
+/// Run save unless the session was superseded; None means nothing was written
+fn persist_if_current<F>(session: &CancellationToken, save: F) -> Option<AppResult<()>>
+where
+    F: FnOnce() -> AppResult<()>,
+{
+    if session.is_cancelled() {
+        return None;
+    }
+    Some(save())
+}
+
+fn superseded_result() -> QRLoginResult {
+    QRLoginResult {
+        success: false,
+        message: QR_SESSION_SUPERSEDED.into(),
+        cookie_path: None,
+    }
+}
+
+/// GET one URL without following redirects
+async fn fetch_hop(client: &Client, url: String) -> Option<RedirectHop> {
+    let resp = match client.get(&url).header(REFERER, QR_CONNECT_ORIGIN).send().await {
+        Ok(resp) => resp,
+        Err(e) => {
+            println!(">>> Debug: Callback hop {} failed: {}", url, e);
+            return None;
+        }
+    };
+    let status = resp.status();
+    let location = resp
+        .headers()
+        .get(LOCATION)
+        .and_then(|v| v.to_str().ok())
+        .map(str::to_string);
+    let body = if status.is_redirection() { String::new() } else { resp.text().await.unwrap_or_default() };
+    Some(RedirectHop { url, status: status.as_u16(), location, body })
+}
+
+/// Follow redirects from start, returning every response; stops at a non-redirect, a failed fetch or MAX_CALLBACK_HOPS
+async fn follow_redirect_chain<F, Fut>(start: &str, mut fetch: F) -> Vec<RedirectHop>
+where
+    F: FnMut(String) -> Fut,
+    Fut: Future<Output = Option<RedirectHop>>,
+{
+    let mut hops: Vec<RedirectHop> = Vec::new();
+    let mut next = Some(start.to_string());
+    while let Some(url) = next.take() {
+        if hops.len() >= MAX_CALLBACK_HOPS {
+            break;
+        }
+        let Some(hop) = fetch(url).await else {
+            break;
+        };
+        if (300..400).contains(&hop.status) {
+            next = hop
+                .location
+                .as_deref()
+                .and_then(|location| Url::parse(&hop.url).ok()?.join(location).ok())
+                .map(|url| url.to_string());
+        }
+        hops.push(hop);
+    }
+    hops
+}
+
+/// Whether a URL is a 91160 page that is safe to visit during warm-up
+fn is_warmup_candidate(url: &Url) -> bool {
+    let host = url.host_str().unwrap_or("");
+    let lower = url.as_str().to_lowercase();
+    matches!(url.scheme(), "http" | "https")
+        && (host == "91160.com" || host.ends_with(".91160.com"))
+        && !WARMUP_SKIP_MARKERS.iter().any(|m| lower.contains(m))
+}
+
+/// URLs to visit after the chain: 91160 pages linked or redirected to from its bodies, then the configured list
+fn warmup_urls(hops: &[RedirectHop], configured: &[String]) -> Vec<String> {
+    static URL_RE: OnceLock<Regex> = OnceLock::new();
+    // Absolute links plus script/meta redirect targets, which may be relative
+    let re = URL_RE.get_or_init(|| {
+        Regex::new(r#"(?i)(https?://[a-z0-9.-]*91160\.com[^\s"'<>)]*)|location(?:\.href)?\s*=\s*["']([^"']+)["']|url\s*=\s*([^"'>\s]+)"#).unwrap()
+    });
+
+    let visited: Vec<&str> = hops.iter().map(|h| h.url.as_str()).collect();
+    let mut urls: Vec<String> = Vec::new();
+    let mut push = |url: Url, urls: &mut Vec<String>| {
+        let url = url.to_string();
+        if !visited.contains(&url.as_str()) && !urls.contains(&url) {
+            urls.push(url);
+        }
+    };
+
+    for hop in hops {
+        let Ok(base) = Url::parse(&hop.url) else {
+            continue;
+        };
+        for caps in re.captures_iter(&hop.body) {
+            if urls.len() >= MAX_DISCOVERED_WARMUP_URLS {
+                break;
+            }
+            let Some(raw) = caps.get(1).or_else(|| caps.get(2)).or_else(|| caps.get(3)) else {
+                continue;
+            };
+            if let Ok(url) = base.join(&raw.as_str().replace("&amp;", "&")) {
+                if is_warmup_candidate(&url) {
+                    push(url, &mut urls);
+                }
+            }
+        }
+    }
+    for raw in configured {
+        if let Ok(url) = Url::parse(raw.trim()) {
+            if is_warmup_candidate(&url) {
+                push(url, &mut urls);
+            }
+        }
+    }
+    urls
+}
+
+/// Hosts of the hops, consecutive repeats collapsed, for error messages without query secrets
+fn hop_hosts(hops: &[RedirectHop]) -> String {
+    let mut hosts: Vec<String> = Vec::new();
+    for hop in hops {
+        let host = Url::parse(&hop.url)
+            .ok()
+            .and_then(|u| u.host_str().map(str::to_string))
+            .unwrap_or_else(|| "?".into());
+        let host = format!("{}({})", host, hop.status);
+        if hosts.last() != Some(&host) {
+            hosts.push(host);
+        }
+    }
+    if hosts.is_empty() {
+        "none".into()
+    } else {
+        hosts.join(" -> ")
+    }
+}
+
 /// Build WeChat API headers
 fn wechat_headers() -> reqwest::header::HeaderMap {
     let mut headers = reqwest::header::HeaderMap::new();
@@ -404,3 +587,98 @@ fn wechat_headers() -> reqwest::header::HeaderMap {
     headers.insert(CONNECTION, HeaderValue::from_static("keep-alive"));
     headers
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::collections::HashMap;
+    use std::path::PathBuf;
+
+    /// Replays a recorded callback chain: user.91160.com http -> https -> bind page with a script redirect to www
+    #[tokio::test]
+    async fn test_replay_wechat_bind_hops() {
+        let path = PathBuf::from(env!("CARGO_MANIFEST_DIR")).join("testdata").join("qr_login").join("wechat_bind_hops.json");
+        let recorded: Vec<RedirectHop> = serde_json::from_str(&std::fs::read_to_string(path).unwrap()).unwrap();
+        let start = recorded[0].url.clone();
+        let by_url: HashMap<String, RedirectHop> = recorded.iter().map(|hop| (hop.url.clone(), hop.clone())).collect();
+
+        let hops = follow_redirect_chain(&start, |url| {
+            let hop = by_url.get(&url).cloned();
+            async move { hop }
+        })
+        .await;
+        assert_eq!(hops, recorded);
+
+        let configured = vec!["https://www.91160.com/".to_string(), "https://example.com/".to_string()];
+        let urls = warmup_urls(&hops, &configured);
+        assert_eq!(urls, vec!["https://www.91160.com/wechat/landing.html?bind=1", "https://www.91160.com/"]);
+
+        assert_eq!(hop_hosts(&hops), "user.91160.com(302) -> user.91160.com(200)");
+    }
+
+    #[tokio::test]
+    async fn test_redirect_chain_stops_at_hop_limit() {
+        let hops = follow_redirect_chain("https://user.91160.com/loop", |url| async move {
+            Some(RedirectHop { location: Some("/loop".into()), status: 302, url, body: String::new() })
+        })
+        .await;
+        assert_eq!(hops.len(), MAX_CALLBACK_HOPS);
+        assert_eq!(hop_hosts(&[]), "none");
+    }
+
+    /// Two overlapping logins: starting the second cancels the first, whose late success must not be written
+    #[test]
+    fn test_only_latest_session_persists_cookies() {
+        let first = CancellationToken::new();
+        let mut current = Some(first.clone());
+        let start_session = |current: &mut Option<CancellationToken>| {
+            if let Some(previous) = current.take() {
+                previous.cancel();
+            }
+            let token = CancellationToken::new();
+            *current = Some(token.clone());
+            token
+        };
+        let second = start_session(&mut current);
+
+        let mut written: Vec<&str> = Vec::new();
+        let late = persist_if_current(&first, || {
+            written.push("first");
+            Ok(())
+        });
+        assert!(late.is_none());
+        let latest = persist_if_current(&second, || {
+            written.push("second");
+            Ok(())
+        });
+        assert!(matches!(latest, Some(Ok(()))));
+        assert_eq!(written, vec!["second"]);
+        assert_eq!(superseded_result().message, QR_SESSION_SUPERSEDED);
+    }
+
+    /// A server that accepts connections but never answers must not outlive Stop
+    #[tokio::test]
+    async fn test_qr_image_fetch_stops_on_cancel() {
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let base = format!("http://{}", listener.local_addr().unwrap());
+        tokio::spawn(async move {
+            let mut held = Vec::new();
+            while let Ok((socket, _)) = listener.accept().await {
+                held.push(socket);
+            }
+        });
+
+        let login = FastQRLogin::new().unwrap();
+        let cancel = CancellationToken::new();
+        let trigger = cancel.clone();
+        tokio::spawn(async move {
+            tokio::time::sleep(Duration::from_millis(100)).await;
+            trigger.cancel();
+        });
+
+        let started = std::time::Instant::now();
+        let result = login.get_qr_image_from(&base, &cancel).await;
+        assert!(matches!(result, Err(AppError::Cancelled)));
+        assert!(started.elapsed() < Duration::from_secs(2));
+    }
+}
@@ -0,0 +1,445 @@
+//! Run report for sharing a grab outcome
+//! Renders the config, a timeline of key events, per-date outcomes and the booking as Markdown or
+//! HTML. The page layout lives in templates/ with {{name}} placeholders; a file of the same name in
+//! config/templates/ replaces the built-in one.
+
+use std::fs;
+
+use chrono::{DateTime, Local};
+use serde::{Deserialize, Serialize};
+
+use super::errors::AppResult;
+use super::history::{HistoryEntry, HISTORY_KIND_QUOTA_EXCEEDED, HISTORY_KIND_TASK_FINISHED, HISTORY_KIND_WAITLISTED};
+use super::paths::config_dir;
+use super::types::{DateStats, GrabConfig, GrabResult, GrabStats, GRAB_SUCCESS_WAITLISTED};
+
+const MARKDOWN_TEMPLATE: &str = include_str!("templates/run_report.md");
+const HTML_TEMPLATE: &str = include_str!("templates/run_report.html");
+const TIME_FORMAT: &str = "%Y-%m-%d %H:%M:%S";
+
+/// Everything a report is rendered from, kept when a run finishes
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct RunReport {
+    pub config: GrabConfig,
+    pub result: GrabResult,
+    pub stats: GrabStats,
+    pub stopped: bool,
+    pub started_at: DateTime<Local>,
+    pub finished_at: DateTime<Local>,
+}
+
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum ReportFormat {
+    Markdown,
+    Html,
+}
+
+impl ReportFormat {
+    /// "md"/"markdown" or "html"
+    pub fn parse(value: &str) -> Option<Self> {
+        match value.trim().to_lowercase().as_str() {
+            "" | "md" | "markdown" => Some(ReportFormat::Markdown),
+            "html" | "htm" => Some(ReportFormat::Html),
+            _ => None,
+        }
+    }
+
+    pub fn extension(self) -> &'static str {
+        match self {
+            ReportFormat::Markdown => "md",
+            ReportFormat::Html => "html",
+        }
+    }
+
+    fn template_name(self) -> String {
+        format!("run_report.{}", self.extension())
+    }
+
+    fn builtin_template(self) -> &'static str {
+        match self {
+            ReportFormat::Markdown => MARKDOWN_TEMPLATE,
+            ReportFormat::Html => HTML_TEMPLATE,
+        }
+    }
+
+    fn escape(self, text: &str) -> String {
+        match self {
+            ReportFormat::Markdown => text.replace('|', "\\|").replace('\n', " "),
+            ReportFormat::Html => text
+                .replace('&', "&amp;")
+                .replace('<', "&lt;")
+                .replace('>', "&gt;")
+                .replace('"', "&quot;"),
+        }
+    }
+
+    /// Bullet list of (label, value)
+    fn list(self, items: &[(&str, String)]) -> String {
+        let lines: Vec<String> = items
+            .iter()
+            .map(|(label, value)| match self {
+                ReportFormat::Markdown => format!("- {}：{}", label, self.escape(value)),
+                ReportFormat::Html => format!("<li>{}：{}</li>", label, self.escape(value)),
+            })
+            .collect();
+        match self {
+            ReportFormat::Markdown => lines.join("\n"),
+            ReportFormat::Html => format!("<ul>\n{}\n</ul>", lines.join("\n")),
+        }
+    }
+
+    fn table(self, headers: &[&str], rows: &[Vec<String>]) -> String {
+        let cells = |row: &[String]| row.iter().map(|cell| self.escape(cell)).collect::<Vec<_>>();
+        match self {
+            ReportFormat::Markdown => {
+                let mut lines = vec![
+                    format!("| {} |", headers.join(" | ")),
+                    format!("|{}", "---|".repeat(headers.len())),
+                ];
+                lines.extend(rows.iter().map(|row| format!("| {} |", cells(row).join(" | "))));
+                lines.join("\n")
+            }
+            ReportFormat::Html => {
+                let mut lines = vec![
+                    "<table>".to_string(),
+                    format!("<tr><th>{}</th></tr>", headers.join("</th><th>")),
+                ];
+                lines.extend(rows.iter().map(|row| format!("<tr><td>{}</td></tr>", cells(row).join("</td><td>"))));
+                lines.push("</table>".into());
+                lines.join("\n")
+            }
+        }
+    }
+
+    fn paragraph(self, text: &str) -> String {
+        match self {
+            ReportFormat::Markdown => self.escape(text),
+            ReportFormat::Html => format!("<p>{}</p>", self.escape(text)),
+        }
+    }
+}
+
+/// The template for format: config/templates/run_report.<ext> when present, else the built-in one
+pub fn report_template(format: ReportFormat) -> String {
+    config_dir()
+        .ok()
+        .and_then(|dir| fs::read_to_string(dir.join("templates").join(format.template_name())).ok())
+        .unwrap_or_else(|| format.builtin_template().to_string())
+}
+
+/// Render a report with the user's or the built-in template
+pub fn render_run_report(report: &RunReport, history: &[HistoryEntry], format: ReportFormat) -> AppResult<String> {
+    Ok(render_with_template(&report_template(format), report, history, format))
+}
+
+/// Fill a template's {{name}} placeholders; unknown placeholders are left as they are
+pub fn render_with_template(template: &str, report: &RunReport, history: &[HistoryEntry], format: ReportFormat) -> String {
+    let outcome = outcome_label(report);
+    let message = if report.result.message.trim().is_empty() { "—".to_string() } else { report.result.message.clone() };
+    let values = [
+        ("outcome", format.escape(outcome)),
+        ("started_at", report.started_at.format(TIME_FORMAT).to_string()),
+        ("finished_at", report.finished_at.format(TIME_FORMAT).to_string()),
+        ("message", format.escape(&message)),
+        ("config", config_section(report, format)),
+        ("booking", booking_section(report, format)),
+        ("timeline", timeline_section(report, history, format)),
+        ("dates", dates_section(report, format)),
+        ("stats", stats_section(&report.stats, &report.config, format)),
+    ];
+
+    // One pass, so a value that happens to contain {{...}} is not expanded again
+    let mut out = String::with_capacity(template.len());
+    let mut rest = template;
+    while let Some(start) = rest.find("{{") {
+        out.push_str(&rest[..start]);
+        let after = &rest[start + 2..];
+        let found = after
+            .find("}}")
+            .and_then(|end| Some((end, values.iter().find(|(name, _)| *name == after[..end].trim())?)));
+        match found {
+            Some((end, (_, value))) => {
+                out.push_str(value);
+                rest = &after[end + 2..];
+            }
+            None => {
+                out.push_str("{{");
+                rest = after;
+            }
+        }
+    }
+    out.push_str(rest);
+    out
+}
+
+fn outcome_label(report: &RunReport) -> &'static str {
+    match &report.result.detail {
+        Some(detail) if report.result.success && detail.kind == GRAB_SUCCESS_WAITLISTED => "已候补",
+        Some(detail) if report.result.success && detail.payment_required => "已预约，待支付",
+        _ if report.result.success => "已预约",
+        _ if report.stopped => "已停止",
+        _ => "未约到",
+    }
+}
+
+fn or_dash(value: &str) -> String {
+    if value.trim().is_empty() { "—".to_string() } else { value.trim().to_string() }
+}
+
+/// "name (id)", or whichever of the two is set
+fn named(name: &str, id: &str) -> String {
+    match (name.trim(), id.trim()) {
+        ("", id) => or_dash(id),
+        (name, "") => name.to_string(),
+        (name, id) => format!("{} ({})", name, id),
+    }
+}
+
+fn config_section(report: &RunReport, format: ReportFormat) -> String {
+    let config = &report.config;
+    let join_or = |values: &[String], fallback: &str| if values.is_empty() { fallback.to_string() } else { values.join(", ") };
+    format.list(&[
+        ("医院", named(&config.unit_name, &config.unit_id)),
+        ("科室", named(&config.dep_name, &config.dep_id)),
+        ("医生", join_or(&config.doctor_ids, "不限")),
+        ("就诊人", named(&config.member_name, &config.member_id)),
+        ("日期", join_or(&config.target_dates, "—")),
+        ("时段", join_or(&config.time_types, "am, pm")),
+        ("开始时间", if config.start_time.trim().is_empty() { "立即".into() } else { config.start_time.trim().to_string() }),
+    ])
+}
+
+fn booking_section(report: &RunReport, format: ReportFormat) -> String {
+    let Some(detail) = report.result.detail.as_ref().filter(|_| report.result.success) else {
+        return format.paragraph("本次未预约成功。");
+    };
+    let mut items = vec![
+        ("医院", or_dash(&detail.unit_name)),
+        ("科室", or_dash(&detail.dep_name)),
+        ("医生", or_dash(&detail.doctor_name)),
+        ("就诊时间", format!("{} {}", detail.date, detail.time_slot).trim().to_string()),
+        ("就诊人", or_dash(&detail.member_name)),
+    ];
+    if let Some(order_no) = &detail.order_no {
+        items.push(("订单号", order_no.clone()));
+    }
+    if let Some(url) = &detail.url {
+        items.push(("订单页面", url.clone()));
+    }
+    if detail.payment_required {
+        items.push(("支付截止", detail.payment_deadline.clone().unwrap_or_else(|| "—".into())));
+        if let Some(url) = &detail.payment_url {
+            items.push(("支付页面", url.clone()));
+        }
+    }
+    format.list(&items)
+}
+
+fn history_label(kind: &str) -> &str {
+    match kind {
+        HISTORY_KIND_QUOTA_EXCEEDED => "达到每日挂号上限",
+        HISTORY_KIND_WAITLISTED => "加入候补",
+        other => other,
+    }
+}
+
+/// Start, the history entries of the run's unit written while it ran, and the end
+fn timeline_section(report: &RunReport, history: &[HistoryEntry], format: ReportFormat) -> String {
+    let started = report.started_at.format(TIME_FORMAT).to_string();
+    let finished = report.finished_at.format(TIME_FORMAT).to_string();
+    let unit_id = report.config.unit_id.trim();
+
+    let mut rows = vec![vec![started.clone(), "开始抢号".to_string(), String::new()]];
+    // Times share one fixed-width format, so they compare as strings
+    rows.extend(
+        history
+            .iter()
+            .filter(|entry| entry.kind != HISTORY_KIND_TASK_FINISHED)
+            .filter(|entry| entry.time >= started && entry.time <= finished)
+            .filter(|entry| entry.unit_id.is_empty() || entry.unit_id == unit_id)
+            .map(|entry| vec![entry.time.clone(), history_label(&entry.kind).to_string(), entry.message.clone()]),
+    );
+    if let Some(detail) = report.result.detail.as_ref().filter(|_| report.result.success) {
+        let event = if detail.kind == GRAB_SUCCESS_WAITLISTED { "候补成功" } else { "预约成功" };
+        rows.push(vec![finished.clone(), event.to_string(), format!("{} {} {}", detail.doctor_name, detail.date, detail.time_slot)]);
+    }
+    rows.push(vec![finished, format!("结束：{}", outcome_label(report)), report.result.message.clone()]);
+    format.table(&["时间", "事件", "说明"], &rows)
+}
+
+fn date_outcome(report: &RunReport, date: &str, day: &DateStats) -> &'static str {
+    match &report.result.detail {
+        Some(detail) if report.result.success && detail.date == date => {
+            if detail.kind == GRAB_SUCCESS_WAITLISTED { "已候补" } else { "已预约" }
+        }
+        _ if day.submits > 0 => "提交未成功",
+        _ if day.bookable_answers > 0 => "有号未提交",
+        _ if day.queries > 0 => "无号",
+        _ => "未查询",
+    }
+}
+
+/// Configured dates in order, then dates added while running
+fn dates_section(report: &RunReport, format: ReportFormat) -> String {
+    let mut dates: Vec<String> = report.config.target_dates.clone();
+    let mut extra: Vec<&String> = report.stats.dates.keys().filter(|d| !dates.contains(d)).collect();
+    extra.sort();
+    dates.extend(extra.into_iter().cloned());
+
+    let rows: Vec<Vec<String>> = dates
+        .iter()
+        .map(|date| {
+            let day = report.stats.dates.get(date).cloned().unwrap_or_default();
+            vec![
+                date.clone(),
+                day.queries.to_string(),
+                day.bookable_answers.to_string(),
+                day.submits.to_string(),
+                date_outcome(report, date, &day).to_string(),
+            ]
+        })
+        .collect();
+    format.table(&["日期", "查询", "有号", "提交", "结果"], &rows)
+}
+
+fn stats_section(stats: &GrabStats, config: &GrabConfig, format: ReportFormat) -> String {
+    let mut phases: Vec<_> = stats.phases.iter().collect();
+    phases.sort_by(|a, b| a.0.cmp(b.0));
+    let timing = phases
+        .iter()
+        .map(|(phase, timing)| format!("{} p50={}ms", phase, timing.p50_ms))
+        .collect::<Vec<_>>()
+        .join(", ");
+    let mut items = vec![
+        ("尝试次数", stats.attempts.to_string()),
+        ("超时", stats.timeouts.to_string()),
+        ("节省的提交", stats.saved_submits.to_string()),
+        ("余号不足跳过", stats.below_min.to_string()),
+        ("耗时", or_dash(&timing)),
+    ];
+    let survival = &stats.slot_survival;
+    if survival.successes + survival.failures > 0 {
+        items.push((
+            "有号到提交结果",
+            format!(
+                "成功 {} 次 p50={}ms，失败 {} 次 p50={}ms",
+                survival.successes, survival.success_p50_ms, survival.failures, survival.failure_p50_ms
+            ),
+        ));
+    }
+    items.extend(survival.remediation(config).into_iter().map(|advice| ("建议", advice.to_string())));
+    format.list(&items)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::core::types::{GrabSuccess, PhaseTiming};
+    use chrono::TimeZone;
+    use std::path::PathBuf;
+
+    fn golden(name: &str) -> PathBuf {
+        PathBuf::from(env!("CARGO_MANIFEST_DIR")).join("testdata").join("report").join(name)
+    }
+
+    fn sample() -> (RunReport, Vec<HistoryEntry>) {
+        let config: GrabConfig = serde_json::from_value(serde_json::json!({
+            "unit_id": "200", "unit_name": "市儿童医院", "dep_id": "300", "dep_name": "儿科",
+            "doctor_ids": ["101"], "member_id": "7", "member_name": "小明",
+            "target_dates": ["2026-10-16", "2026-10-17"], "start_time": "07:00:00"
+        }))
+        .unwrap();
+        let mut stats = GrabStats { attempts: 12, timeouts: 1, ..Default::default() };
+        let mut schedule = PhaseTiming::default();
+        schedule.record(180);
+        stats.phases.insert("schedule".into(), schedule);
+        stats.dates.insert("2026-10-16".into(), DateStats { queries: 12, bookable_answers: 2, submits: 1 });
+        stats.dates.insert("2026-10-17".into(), DateStats { queries: 11, bookable_answers: 0, submits: 0 });
+        stats.dates.insert("2026-10-18".into(), DateStats { queries: 3, bookable_answers: 1, submits: 0 });
+        let report = RunReport {
+            config,
+            result: GrabResult {
+                success: true,
+                message: "挂号成功，待支付".into(),
+                detail: Some(GrabSuccess {
+                    unit_name: "市儿童医院".into(),
+                    dep_name: "儿科".into(),
+                    doctor_name: "张医生".into(),
+                    date: "2026-10-16".into(),
+                    time_slot: "上午 3号".into(),
+                    member_name: "小明".into(),
+                    order_no: Some("A1001".into()),
+                    payment_required: true,
+                    payment_url: Some("https://pay.91160.com/?order=A1001&a=<b>".into()),
+                    payment_deadline: Some("2026-10-15 07:30".into()),
+                    ..Default::default()
+                }),
+            },
+            stats,
+            stopped: false,
+            started_at: Local.with_ymd_and_hms(2026, 10, 15, 6, 59, 30).unwrap(),
+            finished_at: Local.with_ymd_and_hms(2026, 10, 15, 7, 0, 12).unwrap(),
+        };
+        let history = vec![
+            HistoryEntry { time: "2026-10-14 07:00:00".into(), ..HistoryEntry::new(HISTORY_KIND_QUOTA_EXCEEDED, "昨天的") },
+            HistoryEntry { time: "2026-10-15 07:00:05".into(), unit_id: "200".into(), ..HistoryEntry::new(HISTORY_KIND_WAITLISTED, "候补 | 李医生") },
+            HistoryEntry { time: "2026-10-15 07:00:06".into(), unit_id: "999".into(), ..HistoryEntry::new(HISTORY_KIND_WAITLISTED, "其他医院") },
+            HistoryEntry { time: "2026-10-15 07:00:12".into(), ..HistoryEntry::new(HISTORY_KIND_TASK_FINISHED, "succeeded") },
+        ];
+        (report, history)
+    }
+
+    fn assert_golden(format: ReportFormat) {
+        let (report, history) = sample();
+        let rendered = render_with_template(format.builtin_template(), &report, &history, format);
+        let path = golden(&format!("run_report.golden.{}", format.extension()));
+        let expected = fs::read_to_string(&path).unwrap();
+        assert_eq!(rendered, expected, "{} differs", path.display());
+    }
+
+    #[test]
+    fn test_markdown_golden() {
+        assert_golden(ReportFormat::Markdown);
+    }
+
+    #[test]
+    fn test_html_golden() {
+        assert_golden(ReportFormat::Html);
+    }
+
+    #[test]
+    fn test_slot_survival_advice() {
+        let (mut report, _) = sample();
+        report.config.recheck_before_submit = Some(true);
+        report.stats.slot_survival.record(300, true);
+        for ms in [1800, 2100, 2500] {
+            report.stats.slot_survival.record(ms, false);
+        }
+        let rendered = render_with_template("{{stats}}", &report, &[], ReportFormat::Markdown);
+        assert!(rendered.contains("- 有号到提交结果：成功 1 次 p50=300ms，失败 3 次 p50=2100ms"), "{}", rendered);
+        assert!(rendered.contains("use_proxy_submit=false"));
+        assert!(rendered.contains("recheck_before_submit=false"));
+        // Doctors are already set, so precise mode is not suggested
+        assert!(!rendered.contains("doctor_ids"));
+
+        // Failures about as fast as the success say nothing about our speed
+        let (mut report, _) = sample();
+        report.stats.slot_survival.record(300, true);
+        for ms in [350, 400, 420] {
+            report.stats.slot_survival.record(ms, false);
+        }
+        let rendered = render_with_template("{{stats}}", &report, &[], ReportFormat::Markdown);
+        assert!(rendered.contains("有号到提交结果") && !rendered.contains("建议"), "{}", rendered);
+    }
+
+    #[test]
+    fn test_stopped_run_without_booking() {
+        let (mut report, _) = sample();
+        report.result = GrabResult { success: false, message: "stopped".into(), detail: None };
+        report.stopped = true;
+        let rendered = render_with_template("{{outcome}}|{{booking}}|{{unknown}}", &report, &[], ReportFormat::Markdown);
+        assert_eq!(rendered, "已停止|本次未预约成功。|{{unknown}}");
+        assert_eq!(ReportFormat::parse("HTML"), Some(ReportFormat::Html));
+        assert_eq!(ReportFormat::parse("pdf"), None);
+    }
+}
@@ -0,0 +1,228 @@
+//! One-shot schedule scan reports for QuickDoctor
+//! Queries a department's upcoming dates plus the past week so users can pick doctors before a release.
+
+use std::collections::HashMap;
+use std::time::Duration;
+
+use chrono::{Local, NaiveDate};
+use tokio_util::sync::CancellationToken;
+
+use super::client::HealthClient;
+use super::errors::{AppError, AppResult};
+use super::pacing::load_pacing_profile;
+use super::paths::{reports_dir, write_file_atomic};
+use super::types::{DoctorSchedule, ScanDay, ScanDoctor, ScanProgress, ScanReport, ScheduleStats};
+
+/// Upper bound on upcoming days per scan
+pub const MAX_SCAN_DAYS: u32 = 30;
+/// Past days queried for the release pattern
+const LAST_WEEK_DAYS: i64 = 7;
+/// Floor for the gap between scan queries, whatever the pacing profile says
+const MIN_SCAN_INTERVAL_SECS: f64 = 1.0;
+
+/// (date, last_week) pairs to query: the past week first, then today onwards
+fn scan_dates(today: NaiveDate, days: u32) -> Vec<(NaiveDate, bool)> {
+    let past = (1..=LAST_WEEK_DAYS).rev().map(|d| (today - chrono::Duration::days(d), true));
+    let upcoming = (0..days.clamp(1, MAX_SCAN_DAYS) as i64).map(|d| (today + chrono::Duration::days(d), false));
+    past.chain(upcoming).collect()
+}
+
+/// Seconds between queries for a hospital
+fn scan_interval(unit_id: &str) -> Duration {
+    let schedule_interval = load_pacing_profile(unit_id)
+        .map(|profile| profile.effective_intervals(Local::now()).0)
+        .unwrap_or(MIN_SCAN_INTERVAL_SECS);
+    Duration::from_secs_f64(schedule_interval.max(MIN_SCAN_INTERVAL_SECS))
+}
+
+/// Fold one date's schedule into the report
+fn add_scan_day(report: &mut ScanReport, index: &mut HashMap<String, usize>, mut day: ScanDay, docs: &[DoctorSchedule]) {
+    let stats = ScheduleStats::from_schedule(docs);
+    day.ok = true;
+    day.doctors = stats.total_doctors;
+    day.total_left = stats.total_left;
+    day.am_left = stats.am_left;
+    day.pm_left = stats.pm_left;
+
+    for doc in docs {
+        let i = *index.entry(doc.doctor_id.clone()).or_insert_with(|| {
+            report.doctors.push(ScanDoctor {
+                doctor_id: doc.doctor_id.clone(),
+                doctor_name: doc.doctor_name.clone(),
+                title: doc.title.clone(),
+                reg_fee: doc.reg_fee.clone(),
+                ..Default::default()
+            });
+            report.doctors.len() - 1
+        });
+        let doctor = &mut report.doctors[i];
+        doctor.verification_required |= doc.verification_required || doc.schedules.iter().any(|s| s.verification_required);
+        if day.last_week {
+            doctor.last_week_dates.push(day.date.clone());
+            continue;
+        }
+        let left: i32 = doc.schedules.iter().map(|s| s.left_num.max(0)).sum();
+        if left > 0 {
+            doctor.available_dates.push(day.date.clone());
+            doctor.total_left += left;
+        }
+    }
+    report.days.push(day);
+}
+
+/// Query every scan date with polite pacing; failed dates are recorded and the scan goes on
+/// Cancellation returns the partial report
+pub async fn generate_scan_report<F>(
+    client: &HealthClient,
+    unit_id: &str,
+    dep_id: &str,
+    days: u32,
+    cancel_token: CancellationToken,
+    mut on_progress: F,
+) -> ScanReport
+where
+    F: FnMut(&ScanProgress),
+{
+    let now = Local::now();
+    let dates = scan_dates(now.date_naive(), days);
+    let interval = scan_interval(unit_id);
+    let mut report = ScanReport {
+        unit_id: unit_id.to_string(),
+        dep_id: dep_id.to_string(),
+        generated_at: now.to_rfc3339(),
+        ..Default::default()
+    };
+    let mut index = HashMap::new();
+
+    for (i, (date, last_week)) in dates.iter().enumerate() {
+        if i > 0 {
+            tokio::select! {
+                _ = cancel_token.cancelled() => {}
+                _ = tokio::time::sleep(interval) => {}
+            }
+        }
+        if cancel_token.is_cancelled() {
+            report.cancelled = true;
+            break;
+        }
+
+        let date_str = date.format("%Y-%m-%d").to_string();
+        let day = ScanDay {
+            date: date_str.clone(),
+            weekday: date.format("%a").to_string(),
+            last_week: *last_week,
+            ..Default::default()
+        };
+        let ok = match client.get_schedule(unit_id, dep_id, &date_str).await {
+            Ok(docs) => {
+                add_scan_day(&mut report, &mut index, day, &docs);
+                true
+            }
+            // An empty schedule is an answer: a day without doctors, not a failed query
+            Err(AppError::ScheduleEmpty) => {
+                add_scan_day(&mut report, &mut index, day, &[]);
+                true
+            }
+            Err(e) => {
+                report.failed_dates.push(date_str.clone());
+                report.days.push(ScanDay { error: e.to_string(), ..day });
+                false
+            }
+        };
+        on_progress(&ScanProgress {
+            done: i + 1,
+            total: dates.len(),
+            date: date_str,
+            ok,
+        });
+    }
+
+    match save_scan_report(&report) {
+        Ok(path) => report.path = path,
+        Err(e) => println!(">>> Warning: save scan report failed: {}", e),
+    }
+    report
+}
+
+/// Save the report as JSON under logs/reports/
+fn save_scan_report(report: &ScanReport) -> AppResult<String> {
+    let name = format!(
+        "scan_{}_{}_{}.json",
+        report.unit_id,
+        report.dep_id,
+        Local::now().format("%Y%m%d_%H%M%S")
+    );
+    let path = reports_dir()?.join(name);
+    write_file_atomic(&path, serde_json::to_string_pretty(report)?.as_bytes())?;
+    Ok(path.to_string_lossy().to_string())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::core::types::ScheduleSlot;
+
+    fn doc(id: &str, left: &[(&str, i32)]) -> DoctorSchedule {
+        DoctorSchedule {
+            doctor_id: id.into(),
+            doctor_name: format!("doctor {}", id),
+            title: "主任医师".into(),
+            reg_fee: "50".into(),
+            photo_url: String::new(),
+            total_left_num: 0,
+            his_doc_id: String::new(),
+            his_dep_id: String::new(),
+            schedules: left
+                .iter()
+                .map(|(time_type, left_num)| ScheduleSlot {
+                    schedule_id: format!("{}-{}", id, time_type),
+                    time_type: time_type.to_string(),
+                    time_type_desc: String::new(),
+                    left_num: *left_num,
+                    sch_date: String::new(),
+                    waitlist: false,
+                    verification_required: false,
+                })
+                .collect(),
+            schedule_id: String::new(),
+            time_type_desc: String::new(),
+            verification_required: false,
+        }
+    }
+
+    #[test]
+    fn test_scan_dates() {
+        let today = NaiveDate::from_ymd_opt(2026, 10, 15).unwrap();
+        let dates = scan_dates(today, 3);
+        assert_eq!(dates.len(), 10);
+        assert_eq!(dates[0], (NaiveDate::from_ymd_opt(2026, 10, 8).unwrap(), true));
+        assert_eq!(dates[7], (today, false));
+        assert_eq!(scan_dates(today, 0).len(), 8);
+        assert_eq!(scan_dates(today, 500).len(), 7 + MAX_SCAN_DAYS as usize);
+    }
+
+    #[test]
+    fn test_add_scan_day() {
+        let mut report = ScanReport::default();
+        let mut index = HashMap::new();
+        let day = |date: &str, last_week: bool| ScanDay {
+            date: date.into(),
+            last_week,
+            ..Default::default()
+        };
+
+        add_scan_day(&mut report, &mut index, day("2026-10-08", true), &[doc("1", &[("am", 0)])]);
+        add_scan_day(&mut report, &mut index, day("2026-10-15", false), &[doc("1", &[("am", 2), ("pm", 1)]), doc("2", &[("pm", 0)])]);
+        add_scan_day(&mut report, &mut index, day("2026-10-16", false), &[doc("2", &[("am", 4)])]);
+
+        assert_eq!(report.doctors.len(), 2);
+        assert_eq!(report.doctors[0].last_week_dates, vec!["2026-10-08"]);
+        assert_eq!(report.doctors[0].available_dates, vec!["2026-10-15"]);
+        assert_eq!(report.doctors[0].total_left, 3);
+        assert_eq!(report.doctors[0].title, "主任医师");
+        assert_eq!(report.doctors[1].available_dates, vec!["2026-10-16"]);
+        assert_eq!(report.days[1].am_left, 2);
+        assert_eq!(report.days[1].pm_left, 1);
+        assert!(report.days.iter().all(|d| d.ok));
+    }
+}
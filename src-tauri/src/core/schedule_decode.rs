@@ -0,0 +1,325 @@
+//! Filtering decoder for sch/dep schedule payloads
+//! Big departments answer with megabytes of slots. When only some doctors are wanted, their sch
+//! entries are kept and every other doctor's entry is skipped by the parser without being built.
+
+use std::collections::HashSet;
+use std::fmt;
+
+use serde::de::{DeserializeSeed, Deserializer, IgnoredAny, MapAccess, SeqAccess, Visitor};
+use serde::Deserialize;
+use serde_json::{Map, Value};
+
+use super::types::DepartmentDoctor;
+
+/// A sch/dep response with data.doc and data.sch split out
+#[derive(Debug, Default)]
+pub struct SchedulePayload {
+    /// Top-level fields other than data (result_code, error_code, messages)
+    pub fields: Map<String, Value>,
+    pub data: ScheduleData,
+}
+
+#[derive(Debug, Default)]
+pub struct ScheduleData {
+    /// Doctors in the answer before filtering; 0 means the API answered without doctors
+    pub doc_total: usize,
+    /// Every doctor of the answer, kept before filtering
+    pub roster: Vec<DepartmentDoctor>,
+    pub doc: Vec<Value>,
+    pub sch: Map<String, Value>,
+    /// Every sch key of the answer, kept before filtering
+    pub sch_keys: Vec<String>,
+}
+
+impl ScheduleData {
+    /// {"doc": [...], "sch": {...}}, the shape the schedule parser reads
+    pub fn into_value(self) -> Value {
+        serde_json::json!({ "doc": self.doc, "sch": self.sch })
+    }
+}
+
+/// Decode a sch/dep response body; with doctors set, only their doc and sch entries are kept
+pub fn decode_schedule_payload(body: &[u8], doctors: Option<&HashSet<String>>) -> serde_json::Result<SchedulePayload> {
+    let mut de = serde_json::Deserializer::from_slice(body);
+    let payload = PayloadSeed { doctors }.deserialize(&mut de)?;
+    de.end()?;
+    Ok(payload)
+}
+
+/// doctor_id of a doc entry, which the API sends as a string or a number
+pub fn schedule_doctor_id(doc: &Value) -> String {
+    match doc.get("doctor_id") {
+        Some(Value::String(s)) => s.clone(),
+        Some(Value::Number(n)) if n.is_i64() => n.to_string(),
+        _ => String::new(),
+    }
+}
+
+fn wanted(doctors: Option<&HashSet<String>>, doctor_id: &str) -> bool {
+    doctors.map_or(true, |doctors| doctors.contains(doctor_id))
+}
+
+/// Visitor methods that read anything but an object as empty; PHP sends [] or null for empty maps
+macro_rules! non_object_is_empty {
+    () => {
+        fn visit_unit<E: serde::de::Error>(self) -> Result<Self::Value, E> {
+            Ok(Default::default())
+        }
+        fn visit_bool<E: serde::de::Error>(self, _: bool) -> Result<Self::Value, E> {
+            Ok(Default::default())
+        }
+        fn visit_i64<E: serde::de::Error>(self, _: i64) -> Result<Self::Value, E> {
+            Ok(Default::default())
+        }
+        fn visit_u64<E: serde::de::Error>(self, _: u64) -> Result<Self::Value, E> {
+            Ok(Default::default())
+        }
+        fn visit_f64<E: serde::de::Error>(self, _: f64) -> Result<Self::Value, E> {
+            Ok(Default::default())
+        }
+        fn visit_str<E: serde::de::Error>(self, _: &str) -> Result<Self::Value, E> {
+            Ok(Default::default())
+        }
+        fn visit_seq<A: SeqAccess<'de>>(self, mut seq: A) -> Result<Self::Value, A::Error> {
+            while seq.next_element::<IgnoredAny>()?.is_some() {}
+            Ok(Default::default())
+        }
+    };
+}
+
+#[derive(Clone, Copy)]
+struct PayloadSeed<'a> {
+    doctors: Option<&'a HashSet<String>>,
+}
+
+impl<'de> DeserializeSeed<'de> for PayloadSeed<'_> {
+    type Value = SchedulePayload;
+
+    fn deserialize<D: Deserializer<'de>>(self, deserializer: D) -> Result<Self::Value, D::Error> {
+        deserializer.deserialize_map(self)
+    }
+}
+
+impl<'de> Visitor<'de> for PayloadSeed<'_> {
+    type Value = SchedulePayload;
+
+    fn expecting(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        f.write_str("a schedule response object")
+    }
+
+    fn visit_map<A: MapAccess<'de>>(self, mut map: A) -> Result<Self::Value, A::Error> {
+        let mut payload = SchedulePayload::default();
+        while let Some(key) = map.next_key::<String>()? {
+            if key == "data" {
+                payload.data = map.next_value_seed(DataSeed { doctors: self.doctors })?;
+            } else {
+                let value: Value = map.next_value()?;
+                payload.fields.insert(key, value);
+            }
+        }
+        Ok(payload)
+    }
+}
+
+#[derive(Clone, Copy)]
+struct DataSeed<'a> {
+    doctors: Option<&'a HashSet<String>>,
+}
+
+impl<'de> DeserializeSeed<'de> for DataSeed<'_> {
+    type Value = ScheduleData;
+
+    fn deserialize<D: Deserializer<'de>>(self, deserializer: D) -> Result<Self::Value, D::Error> {
+        deserializer.deserialize_any(self)
+    }
+}
+
+impl<'de> Visitor<'de> for DataSeed<'_> {
+    type Value = ScheduleData;
+
+    fn expecting(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        f.write_str("schedule data")
+    }
+
+    non_object_is_empty!();
+
+    fn visit_map<A: MapAccess<'de>>(self, mut map: A) -> Result<Self::Value, A::Error> {
+        let mut data = ScheduleData::default();
+        while let Some(key) = map.next_key::<String>()? {
+            match key.as_str() {
+                // The doctor list is small; each entry is built and then filtered
+                "doc" => {
+                    if let Value::Array(docs) = map.next_value::<Value>()? {
+                        data.doc_total = docs.len();
+                        data.roster = docs
+                            .iter()
+                            .map(|doc| DepartmentDoctor {
+                                doctor_id: schedule_doctor_id(doc),
+                                doctor_name: doc.get("doctor_name").and_then(|n| n.as_str()).unwrap_or_default().to_string(),
+                                ..Default::default()
+                            })
+                            .filter(|doctor| !doctor.doctor_id.is_empty())
+                            .collect();
+                        data.doc = docs
+                            .into_iter()
+                            .filter(|doc| wanted(self.doctors, &schedule_doctor_id(doc)))
+                            .collect();
+                    }
+                }
+                "sch" => (data.sch, data.sch_keys) = map.next_value_seed(SchSeed { doctors: self.doctors })?,
+                _ => {
+                    map.next_value::<IgnoredAny>()?;
+                }
+            }
+        }
+        Ok(data)
+    }
+}
+
+#[derive(Clone, Copy)]
+struct SchSeed<'a> {
+    doctors: Option<&'a HashSet<String>>,
+}
+
+impl<'de> DeserializeSeed<'de> for SchSeed<'_> {
+    type Value = (Map<String, Value>, Vec<String>);
+
+    fn deserialize<D: Deserializer<'de>>(self, deserializer: D) -> Result<Self::Value, D::Error> {
+        deserializer.deserialize_any(self)
+    }
+}
+
+impl<'de> Visitor<'de> for SchSeed<'_> {
+    type Value = (Map<String, Value>, Vec<String>);
+
+    fn expecting(&self, f: &mut fmt::Formatter) -> fmt::Result {
+        f.write_str("a map of doctor schedules")
+    }
+
+    non_object_is_empty!();
+
+    fn visit_map<A: MapAccess<'de>>(self, mut map: A) -> Result<Self::Value, A::Error> {
+        let mut sch = Map::new();
+        let mut keys = Vec::new();
+        while let Some(doctor_id) = map.next_key::<String>()? {
+            keys.push(doctor_id.clone());
+            if wanted(self.doctors, &doctor_id) {
+                let value: Value = map.next_value()?;
+                sch.insert(doctor_id, value);
+            } else {
+                map.next_value::<IgnoredAny>()?;
+            }
+        }
+        Ok((sch, keys))
+    }
+}
+
+/// Slot fields of a sch entry; ids and counts arrive as strings or numbers, null reads as empty
+#[derive(Debug, Default, Deserialize)]
+#[serde(default)]
+pub struct GateSlot {
+    #[serde(deserialize_with = "lenient_string")]
+    pub schedule_id: String,
+    #[serde(deserialize_with = "lenient_string")]
+    pub time_type: String,
+    #[serde(deserialize_with = "lenient_string")]
+    pub time_type_desc: String,
+    #[serde(deserialize_with = "lenient_count")]
+    pub left_num: i32,
+    #[serde(deserialize_with = "lenient_string")]
+    pub sch_date: String,
+}
+
+/// Doctor fields of a doc entry that are copied as they are
+#[derive(Debug, Default, Deserialize)]
+#[serde(default)]
+pub struct GateDoctor {
+    #[serde(deserialize_with = "lenient_string")]
+    pub doctor_name: String,
+    #[serde(deserialize_with = "lenient_string")]
+    pub reg_fee: String,
+    #[serde(deserialize_with = "lenient_string")]
+    pub his_doc_id: String,
+    #[serde(deserialize_with = "lenient_string")]
+    pub his_dep_id: String,
+}
+
+impl GateSlot {
+    /// Read a slot entry; anything but an object gives an empty slot
+    pub fn from_value(value: &Value) -> Self {
+        Self::deserialize(value).unwrap_or_default()
+    }
+}
+
+impl GateDoctor {
+    /// Read a doc entry; anything but an object gives an empty doctor
+    pub fn from_value(value: &Value) -> Self {
+        Self::deserialize(value).unwrap_or_default()
+    }
+}
+
+/// String or number as a string; null, bools and containers read as empty
+fn lenient_string<'de, D: Deserializer<'de>>(deserializer: D) -> Result<String, D::Error> {
+    Ok(match Value::deserialize(deserializer)? {
+        Value::String(s) => s,
+        Value::Number(n) => n.to_string(),
+        _ => String::new(),
+    })
+}
+
+/// Number or numeric string; anything else counts as 0
+fn lenient_count<'de, D: Deserializer<'de>>(deserializer: D) -> Result<i32, D::Error> {
+    Ok(match Value::deserialize(deserializer)? {
+        Value::Number(n) => n.as_i64().unwrap_or(0) as i32,
+        Value::String(s) => s.trim().parse().unwrap_or(0),
+        _ => 0,
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use serde_json::json;
+
+    fn body() -> Vec<u8> {
+        serde_json::to_vec(&json!({
+            "result_code": "1",
+            "error_msg": "",
+            "data": {
+                "sch": {
+                    "11": {"am": {"a": {"schedule_id": "s1", "left_num": 2}}},
+                    "22": {"pm": [{"schedule_id": 502, "left_num": 1}]}
+                },
+                "doc": [{"doctor_id": "11"}, {"doctor_id": 22}, {"doctor_id": "33"}],
+                "dep": {"dep_name": "儿科"}
+            }
+        }))
+        .unwrap()
+    }
+
+    #[test]
+    fn test_decode_keeps_wanted_doctors() {
+        let all = decode_schedule_payload(&body(), None).unwrap();
+        assert_eq!(all.fields["result_code"], "1");
+        assert_eq!((all.data.doc_total, all.data.doc.len(), all.data.sch.len()), (3, 3, 2));
+
+        let doctors: HashSet<String> = ["22".to_string()].into_iter().collect();
+        let some = decode_schedule_payload(&body(), Some(&doctors)).unwrap();
+        assert_eq!(some.data.doc_total, 3);
+        assert_eq!(some.data.doc, vec![json!({"doctor_id": 22})]);
+        assert_eq!(some.data.sch.keys().collect::<Vec<_>>(), vec!["22"]);
+        // The roster still lists the whole department
+        let roster: Vec<&str> = some.data.roster.iter().map(|d| d.doctor_id.as_str()).collect();
+        assert_eq!(roster, vec!["11", "22", "33"]);
+        assert_eq!(some.data.sch_keys, vec!["11", "22"]);
+    }
+
+    #[test]
+    fn test_decode_php_empty_data() {
+        let payload = decode_schedule_payload(br#"{"result_code":"1","data":{"doc":[],"sch":[]}}"#, None).unwrap();
+        assert_eq!(payload.data.doc_total, 0);
+        let payload = decode_schedule_payload(br#"{"result_code":"0","error_code":"10022","data":null}"#, None).unwrap();
+        assert_eq!(payload.fields["error_code"], "10022");
+        assert!(decode_schedule_payload(b"[]", None).is_err());
+    }
+}
@@ -0,0 +1,102 @@
+//! Display-ready schedule views for QuickDoctor
+//! Built from the typed schedule so the frontend does not re-derive totals and labels on its own.
+
+use super::types::{DoctorSchedule, DoctorView, ScheduleStats, ScheduleView, SlotGroupView, SlotView};
+
+/// Time types in display order with their labels
+const TIME_TYPE_LABELS: [(&str, &str); 3] = [("am", "上午"), ("pm", "下午"), ("night", "夜间")];
+
+/// Display label for a time type; unknown types fall back to the hospital's description
+fn time_type_label(time_type: &str, desc: &str) -> String {
+    TIME_TYPE_LABELS
+        .iter()
+        .find(|(t, _)| *t == time_type)
+        .map(|(_, label)| label.to_string())
+        .unwrap_or_else(|| if desc.is_empty() { time_type.to_string() } else { desc.to_string() })
+}
+
+/// Sort key of a time type: known types in label order, others after them
+fn time_type_rank(time_type: &str) -> usize {
+    TIME_TYPE_LABELS.iter().position(|(t, _)| *t == time_type).unwrap_or(TIME_TYPE_LABELS.len())
+}
+
+/// Build the view of one doctor, grouping slots by time type
+fn doctor_view(doc: &DoctorSchedule) -> DoctorView {
+    let mut groups: Vec<SlotGroupView> = Vec::new();
+    for slot in &doc.schedules {
+        let index = match groups.iter().position(|g| g.time_type == slot.time_type) {
+            Some(index) => index,
+            None => {
+                groups.push(SlotGroupView {
+                    time_type: slot.time_type.clone(),
+                    label: time_type_label(&slot.time_type, &slot.time_type_desc),
+                    ..Default::default()
+                });
+                groups.len() - 1
+            }
+        };
+        let group = &mut groups[index];
+        group.total_left += slot.left_num.max(0);
+        group.slots.push(SlotView {
+            schedule_id: slot.schedule_id.clone(),
+            time_type: slot.time_type.clone(),
+            time_type_desc: slot.time_type_desc.clone(),
+            left_num: slot.left_num,
+            waitlist: slot.waitlist,
+            verification_required: slot.verification_required,
+        });
+    }
+    groups.sort_by_key(|g| time_type_rank(&g.time_type));
+
+    DoctorView {
+        doctor_id: doc.doctor_id.clone(),
+        doctor_name: doc.doctor_name.clone(),
+        title: doc.title.clone(),
+        reg_fee: doc.reg_fee.clone(),
+        photo_url: doc.photo_url.clone(),
+        total_left: groups.iter().map(|g| g.total_left).sum(),
+        groups,
+    }
+}
+
+/// Build the schedule view of a date; doctors with more tickets left come first, ties keep the API order
+pub fn build_schedule_view(date: &str, docs: &[DoctorSchedule]) -> ScheduleView {
+    let mut doctors: Vec<DoctorView> = docs.iter().map(doctor_view).collect();
+    doctors.sort_by(|a, b| b.total_left.cmp(&a.total_left));
+    ScheduleView {
+        date: date.to_string(),
+        summary: ScheduleStats::from_schedule(docs),
+        doctors,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::path::PathBuf;
+
+    /// Snapshot of the view for a typed schedule; set UPDATE_GOLDEN=1 to rewrite it
+    #[test]
+    fn test_schedule_view_snapshot() {
+        let dir = PathBuf::from(env!("CARGO_MANIFEST_DIR")).join("testdata").join("schedule_view");
+        let docs: Vec<DoctorSchedule> =
+            serde_json::from_str(&std::fs::read_to_string(dir.join("schedule.json")).unwrap()).unwrap();
+        let actual = serde_json::to_value(build_schedule_view("2026-10-20", &docs)).unwrap();
+
+        let golden_path = dir.join("schedule.golden.json");
+        if std::env::var("UPDATE_GOLDEN").is_ok() {
+            std::fs::write(&golden_path, serde_json::to_string_pretty(&actual).unwrap() + "\n").unwrap();
+            return;
+        }
+
+        let expected: serde_json::Value = serde_json::from_str(&std::fs::read_to_string(&golden_path).unwrap()).unwrap();
+        assert_eq!(actual, expected, "schedule view snapshot mismatch");
+    }
+
+    #[test]
+    fn test_time_type_label() {
+        assert_eq!(time_type_label("am", "上午门诊"), "上午");
+        assert_eq!(time_type_label("eve", "黄昏门诊"), "黄昏门诊");
+        assert_eq!(time_type_label("eve", ""), "eve");
+    }
+}
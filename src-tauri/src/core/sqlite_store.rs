@@ -0,0 +1,350 @@
+//! SQLite backend of the local store, built with the "sqlite-store" cargo feature
+//! Every table lives in config/skylinemed.db; the JSON files are imported the first time it opens.
+
+use std::collections::HashMap;
+use std::path::Path;
+use std::sync::Mutex;
+
+use chrono::{Local, NaiveDate};
+use rusqlite::{params, Connection, OptionalExtension};
+
+use super::errors::AppResult;
+use super::history::HistoryEntry;
+use super::insights::DepartmentStats;
+use super::pacing::{default_pacing_profiles, PacingProfile};
+use super::store::{JsonStore, Store};
+
+const SCHEMA: &str = "
+CREATE TABLE IF NOT EXISTS meta (key TEXT PRIMARY KEY, value TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS history (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    time TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    unit_id TEXT NOT NULL DEFAULT '',
+    dep_id TEXT NOT NULL DEFAULT '',
+    member_id TEXT NOT NULL DEFAULT '',
+    message TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS observations (department TEXT PRIMARY KEY, stats TEXT NOT NULL, updated_at TEXT);
+CREATE TABLE IF NOT EXISTS pacing_profiles (unit_id TEXT PRIMARY KEY, profile TEXT NOT NULL);
+CREATE TABLE IF NOT EXISTS submit_counters (account TEXT PRIMARY KEY, day TEXT NOT NULL, count INTEGER NOT NULL);
+";
+/// meta key set once the JSON files were imported
+const META_JSON_IMPORTED: &str = "json_imported";
+/// meta key set once pacing profiles were saved, so an empty table still means the built-in ones
+const META_PACING_SAVED: &str = "pacing_saved";
+
+/// Every table in one database file behind one connection
+pub struct SqliteStore {
+    conn: Mutex<Connection>,
+}
+
+impl SqliteStore {
+    /// Open or create the database at path, importing json's files on first open
+    pub fn open(path: &Path, json: &JsonStore) -> AppResult<Self> {
+        Self::with_connection(Connection::open(path)?, json)
+    }
+
+    fn with_connection(conn: Connection, json: &JsonStore) -> AppResult<Self> {
+        conn.busy_timeout(std::time::Duration::from_secs(5))?;
+        conn.execute_batch(SCHEMA)?;
+        let store = Self { conn: Mutex::new(conn) };
+        store.import_json(json)?;
+        Ok(store)
+    }
+
+    fn conn(&self) -> std::sync::MutexGuard<'_, Connection> {
+        self.conn.lock().unwrap_or_else(|poisoned| poisoned.into_inner())
+    }
+
+    /// Copy the JSON files into the tables, once; the files are left in place as a backup
+    fn import_json(&self, json: &JsonStore) -> AppResult<()> {
+        let mut conn = self.conn();
+        let tx = conn.transaction()?;
+        if meta(&tx, META_JSON_IMPORTED)?.is_some() {
+            return Ok(());
+        }
+        for entry in json.history()? {
+            insert_history(&tx, &entry)?;
+        }
+        for (key, stats) in json.department_stats()? {
+            save_department(&tx, &key, &stats)?;
+        }
+        if let Some(profiles) = json.stored_pacing_profiles()? {
+            save_pacing(&tx, &profiles)?;
+        }
+        for (account, entry) in json.submit_counts()? {
+            tx.execute(
+                "INSERT OR REPLACE INTO submit_counters (account, day, count) VALUES (?1, ?2, ?3)",
+                params![account, entry.date.to_string(), entry.count],
+            )?;
+        }
+        set_meta(&tx, META_JSON_IMPORTED, &Local::now().to_rfc3339())?;
+        tx.commit()?;
+        Ok(())
+    }
+}
+
+fn meta(conn: &Connection, key: &str) -> AppResult<Option<String>> {
+    Ok(conn.query_row("SELECT value FROM meta WHERE key = ?1", params![key], |row| row.get(0)).optional()?)
+}
+
+fn set_meta(conn: &Connection, key: &str, value: &str) -> AppResult<()> {
+    conn.execute("INSERT OR REPLACE INTO meta (key, value) VALUES (?1, ?2)", params![key, value])?;
+    Ok(())
+}
+
+fn insert_history(conn: &Connection, entry: &HistoryEntry) -> AppResult<()> {
+    conn.execute(
+        "INSERT INTO history (time, kind, unit_id, dep_id, member_id, message) VALUES (?1, ?2, ?3, ?4, ?5, ?6)",
+        params![entry.time, entry.kind, entry.unit_id, entry.dep_id, entry.member_id, entry.message],
+    )?;
+    Ok(())
+}
+
+fn save_department(conn: &Connection, key: &str, stats: &DepartmentStats) -> AppResult<()> {
+    conn.execute(
+        "INSERT OR REPLACE INTO observations (department, stats, updated_at) VALUES (?1, ?2, ?3)",
+        params![key, serde_json::to_string(stats)?, stats.updated_at.map(|at| at.to_rfc3339())],
+    )?;
+    Ok(())
+}
+
+fn load_pacing(conn: &Connection) -> AppResult<HashMap<String, PacingProfile>> {
+    if meta(conn, META_PACING_SAVED)?.is_none() {
+        return Ok(default_pacing_profiles());
+    }
+    let mut stmt = conn.prepare("SELECT unit_id, profile FROM pacing_profiles")?;
+    let rows = stmt.query_map([], |row| Ok((row.get::<_, String>(0)?, row.get::<_, String>(1)?)))?;
+    let mut profiles = HashMap::new();
+    for row in rows {
+        let (unit_id, profile) = row?;
+        if let Ok(profile) = serde_json::from_str(&profile) {
+            profiles.insert(unit_id, profile);
+        }
+    }
+    Ok(profiles)
+}
+
+fn save_pacing(conn: &Connection, profiles: &HashMap<String, PacingProfile>) -> AppResult<()> {
+    conn.execute("DELETE FROM pacing_profiles", [])?;
+    for (unit_id, profile) in profiles {
+        conn.execute(
+            "INSERT INTO pacing_profiles (unit_id, profile) VALUES (?1, ?2)",
+            params![unit_id, serde_json::to_string(profile)?],
+        )?;
+    }
+    set_meta(conn, META_PACING_SAVED, "1")
+}
+
+impl Store for SqliteStore {
+    fn history(&self) -> AppResult<Vec<HistoryEntry>> {
+        let conn = self.conn();
+        let mut stmt = conn.prepare("SELECT time, kind, unit_id, dep_id, member_id, message FROM history ORDER BY id")?;
+        let rows = stmt.query_map([], |row| {
+            Ok(HistoryEntry {
+                time: row.get(0)?,
+                kind: row.get(1)?,
+                unit_id: row.get(2)?,
+                dep_id: row.get(3)?,
+                member_id: row.get(4)?,
+                message: row.get(5)?,
+            })
+        })?;
+        Ok(rows.collect::<Result<Vec<_>, _>>()?)
+    }
+
+    fn append_history(&self, entry: &HistoryEntry, keep: usize) -> AppResult<()> {
+        let mut conn = self.conn();
+        let tx = conn.transaction()?;
+        insert_history(&tx, entry)?;
+        tx.execute(
+            "DELETE FROM history WHERE id NOT IN (SELECT id FROM history ORDER BY id DESC LIMIT ?1)",
+            params![keep as i64],
+        )?;
+        tx.commit()?;
+        Ok(())
+    }
+
+    fn department_stats(&self) -> AppResult<HashMap<String, DepartmentStats>> {
+        let conn = self.conn();
+        let mut stmt = conn.prepare("SELECT department, stats FROM observations")?;
+        let rows = stmt.query_map([], |row| Ok((row.get::<_, String>(0)?, row.get::<_, String>(1)?)))?;
+        let mut all = HashMap::new();
+        for row in rows {
+            let (key, stats) = row?;
+            all.insert(key, serde_json::from_str(&stats).unwrap_or_default());
+        }
+        Ok(all)
+    }
+
+    fn update_department_stats(&self, key: &str, keep: usize, update: &mut dyn FnMut(&mut DepartmentStats) -> bool) -> AppResult<()> {
+        let mut conn = self.conn();
+        let tx = conn.transaction()?;
+        let stored: Option<String> = tx
+            .query_row("SELECT stats FROM observations WHERE department = ?1", params![key], |row| row.get(0))
+            .optional()?;
+        let mut stats: DepartmentStats = stored.and_then(|s| serde_json::from_str(&s).ok()).unwrap_or_default();
+        if !update(&mut stats) {
+            return Ok(());
+        }
+        save_department(&tx, key, &stats)?;
+        // NULL updated_at sorts last here, so never-updated departments go first, as in the JSON store
+        tx.execute(
+            "DELETE FROM observations WHERE department NOT IN (SELECT department FROM observations ORDER BY updated_at DESC LIMIT ?1)",
+            params![keep as i64],
+        )?;
+        tx.commit()?;
+        Ok(())
+    }
+
+    fn pacing_profiles(&self) -> AppResult<HashMap<String, PacingProfile>> {
+        load_pacing(&self.conn())
+    }
+
+    fn update_pacing_profiles(&self, update: &mut dyn FnMut(&mut HashMap<String, PacingProfile>)) -> AppResult<()> {
+        let mut conn = self.conn();
+        let tx = conn.transaction()?;
+        let mut profiles = load_pacing(&tx)?;
+        update(&mut profiles);
+        save_pacing(&tx, &profiles)?;
+        tx.commit()?;
+        Ok(())
+    }
+
+    fn submit_count(&self, account: &str, day: NaiveDate) -> AppResult<u32> {
+        let count: Option<u32> = self
+            .conn()
+            .query_row(
+                "SELECT count FROM submit_counters WHERE account = ?1 AND day = ?2",
+                params![account.trim(), day.to_string()],
+                |row| row.get(0),
+            )
+            .optional()?;
+        Ok(count.unwrap_or(0))
+    }
+
+    fn increment_submit_count(&self, account: &str, day: NaiveDate) -> AppResult<u32> {
+        let mut conn = self.conn();
+        let tx = conn.transaction()?;
+        let day = day.to_string();
+        tx.execute("DELETE FROM submit_counters WHERE day != ?1", params![day])?;
+        tx.execute(
+            "INSERT INTO submit_counters (account, day, count) VALUES (?1, ?2, 1)
+             ON CONFLICT(account) DO UPDATE SET count = count + 1",
+            params![account.trim(), day],
+        )?;
+        let count: u32 = tx.query_row("SELECT count FROM submit_counters WHERE account = ?1", params![account.trim()], |row| row.get(0))?;
+        tx.commit()?;
+        Ok(count)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::fs;
+    use std::path::PathBuf;
+    use std::sync::Arc;
+
+    fn temp_store_dir(name: &str) -> PathBuf {
+        let dir = std::env::temp_dir().join(format!("skylinemed_store_{}_{}", name, std::process::id()));
+        let _ = fs::remove_dir_all(&dir);
+        fs::create_dir_all(&dir).unwrap();
+        dir
+    }
+
+    fn day(d: u32) -> NaiveDate {
+        NaiveDate::from_ymd_opt(2026, 10, d).unwrap()
+    }
+
+    #[test]
+    fn test_sqlite_imports_json_once() {
+        let dir = temp_store_dir("import");
+        let json = JsonStore::new(dir.clone());
+        json.append_history(&HistoryEntry::new("task_finished", "first"), 10).unwrap();
+        json.increment_submit_count("m1", day(16)).unwrap();
+        json.update_pacing_profiles(&mut |profiles: &mut HashMap<String, PacingProfile>| {
+            profiles.clear();
+            profiles.insert("1040".into(), PacingProfile::default());
+        })
+        .unwrap();
+        json.update_department_stats("1/2", 10, &mut |stats: &mut DepartmentStats| {
+            stats.updated_at = Some(Local::now());
+            true
+        })
+        .unwrap();
+
+        let sqlite = SqliteStore::open(&dir.join("store.db"), &json).unwrap();
+        assert_eq!(sqlite.history().unwrap()[0].message, "first");
+        assert_eq!(sqlite.submit_count("m1", day(16)).unwrap(), 1);
+        assert_eq!(sqlite.pacing_profiles().unwrap().keys().collect::<Vec<_>>(), vec!["1040"]);
+        assert!(sqlite.department_stats().unwrap().contains_key("1/2"));
+        drop(sqlite);
+
+        // Reopening does not import the files a second time
+        let sqlite = SqliteStore::open(&dir.join("store.db"), &json).unwrap();
+        assert_eq!(sqlite.history().unwrap().len(), 1);
+        let _ = fs::remove_dir_all(&dir);
+    }
+
+    #[test]
+    fn test_sqlite_tables_match_json_behaviour() {
+        let dir = temp_store_dir("behaviour");
+        let json = JsonStore::new(dir.clone());
+        let sqlite = SqliteStore::with_connection(Connection::open_in_memory().unwrap(), &json).unwrap();
+        let stores: [&dyn Store; 2] = [&json, &sqlite];
+        for store in stores {
+            for i in 0..5 {
+                store.append_history(&HistoryEntry::new("waitlisted", &i.to_string()), 3).unwrap();
+            }
+            let kept: Vec<String> = store.history().unwrap().into_iter().map(|e| e.message).collect();
+            assert_eq!(kept, ["2", "3", "4"]);
+
+            assert_eq!(store.increment_submit_count(" m1 ", day(15)).unwrap(), 1);
+            assert_eq!(store.increment_submit_count("m1", day(15)).unwrap(), 2);
+            assert_eq!(store.increment_submit_count("m1", day(16)).unwrap(), 1);
+            assert_eq!(store.submit_count("m1", day(15)).unwrap(), 0);
+
+            // Built-in profiles until the first save
+            assert_eq!(store.pacing_profiles().unwrap(), default_pacing_profiles());
+
+            for (i, key) in ["a", "b", "c"].iter().enumerate() {
+                store
+                    .update_department_stats(key, 2, &mut |stats: &mut DepartmentStats| {
+                        stats.updated_at = Some(Local::now() + chrono::Duration::seconds(i as i64));
+                        true
+                    })
+                    .unwrap();
+            }
+            let mut keys: Vec<String> = store.department_stats().unwrap().into_keys().collect();
+            keys.sort();
+            assert_eq!(keys, ["b", "c"]);
+        }
+        let _ = fs::remove_dir_all(&dir);
+    }
+
+    #[test]
+    fn test_sqlite_concurrent_increments() {
+        let dir = temp_store_dir("concurrent");
+        let json = JsonStore::new(dir.clone());
+        let store = Arc::new(SqliteStore::open(&dir.join("store.db"), &json).unwrap());
+        let threads: Vec<_> = (0..8)
+            .map(|_| {
+                let store = store.clone();
+                std::thread::spawn(move || {
+                    for _ in 0..25 {
+                        store.increment_submit_count("m1", day(16)).unwrap();
+                        store.append_history(&HistoryEntry::new("task_finished", ""), 1000).unwrap();
+                    }
+                })
+            })
+            .collect();
+        for thread in threads {
+            thread.join().unwrap();
+        }
+        assert_eq!(store.submit_count("m1", day(16)).unwrap(), 200);
+        assert_eq!(store.history().unwrap().len(), 200);
+        let _ = fs::remove_dir_all(&dir);
+    }
+}
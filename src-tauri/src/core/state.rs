@@ -4,18 +4,59 @@
 use std::collections::HashMap;
 use std::fs;
 
-use chrono::{Duration, Local};
+use chrono::{DateTime, Duration, Local};
 use serde_json::Value;
 
 use super::errors::{AppError, AppResult};
-use super::paths::user_state_path;
-use super::types::UserState;
+use super::memory::MemoryBudget;
+use super::notifier::{default_notify_routes, NotifyRoutes};
+use super::paths::{ConfigDir, USER_STATE_FILE};
+use super::types::{ExtraHeaders, GrabConfig, HookCommand, SmtpSettings, UserState};
 
 const DEFAULT_CITY_ID: &str = "5";
+const LAST_SUBMIT_AT_KEY: &str = "last_submit_at";
+const SMTP_KEY: &str = "smtp";
+const EXTRA_HEADERS_KEY: &str = "extra_headers";
+const MEMORY_BUDGET_KEY: &str = "memory_budget";
+const QR_WARMUP_URLS_KEY: &str = "qr_warmup_urls";
+/// Whether hospitals and departments are prefetched after login; off for metered connections
+const PREFETCH_ON_LOGIN_KEY: &str = "prefetch_on_login";
+/// Whether history, insights, pacing and submit counters live in SQLite instead of JSON files
+const SQLITE_STORE_KEY: &str = "sqlite_store";
+/// Which notification sinks each event type is sent to
+const NOTIFY_ROUTES_KEY: &str = "notify_routes";
+/// Whether the account passed real-name verification (实名认证), as learned from submit answers
+const ACCOUNT_VERIFIED_KEY: &str = "account_verified";
+/// Pages visited after the QR login callback so the session cookies get issued on every host
+const DEFAULT_QR_WARMUP_URLS: [&str; 2] = ["https://www.91160.com/", "https://user.91160.com/user/index.html"];
+pub const ON_SUCCESS_COMMAND_KEY: &str = "on_success_command";
+pub const ON_FAILURE_COMMAND_KEY: &str = "on_failure_command";
+
+/// Legacy (user state / UI) key and the canonical GrabConfig key it maps to
+/// User state is written with canonical keys; legacy keys are still read
+const KEY_ALIASES: [(&str, &str); 8] = [
+    ("time_slots", "time_types"),
+    ("time_type", "time_types"),
+    ("doctor_id", "doctor_ids"),
+    ("preferred_hour", "preferred_hours"),
+    ("preferredHours", "preferred_hours"),
+    ("address_id", "addressId"),
+    ("addressid", "addressId"),
+    ("proxy_submit_enabled", "use_proxy_submit"),
+];
+/// GrabConfig list fields; a scalar is taken as a one-element list
+const GRAB_CONFIG_LIST_KEYS: [&str; 5] = ["time_types", "doctor_ids", "target_dates", "preferred_hours", "consents"];
+/// GrabConfig id fields; numbers are taken as their decimal string
+const GRAB_CONFIG_ID_KEYS: [&str; 5] = ["unit_id", "dep_id", "member_id", "city_id", "addressId"];
 
 /// Load user state from file
 pub fn load_user_state() -> AppResult<HashMap<String, Value>> {
-    let path = user_state_path()?;
+    load_user_state_in(&ConfigDir::default())
+}
+
+/// Load user state from the file in dir
+pub fn load_user_state_in(dir: &ConfigDir) -> AppResult<HashMap<String, Value>> {
+    let path = dir.join(USER_STATE_FILE)?;
 
     if !path.exists() {
         return Ok(default_user_state());
@@ -23,17 +64,22 @@ pub fn load_user_state() -> AppResult<HashMap<String, Value>> {
 
     let data = fs::read_to_string(&path)?;
     let raw: HashMap<String, Value> = serde_json::from_str(&data)?;
-    let merged = merge_user_state(default_user_state(), raw);
+    let merged = merge_user_state(default_user_state(), canonicalize_keys(raw));
     Ok(normalize_user_state(merged))
 }
 
 /// Save user state to file
 pub fn save_user_state(update: HashMap<String, Value>) -> AppResult<()> {
+    save_user_state_in(&ConfigDir::default(), update)
+}
+
+/// Save user state to the file in dir
+pub fn save_user_state_in(dir: &ConfigDir, update: HashMap<String, Value>) -> AppResult<()> {
     if update.is_empty() {
         return Err(AppError::ConfigError("State is empty".into()));
     }
 
-    let path = user_state_path()?;
+    let path = dir.join(USER_STATE_FILE)?;
 
     // Load existing state
     let existing = if path.exists() {
@@ -43,9 +89,9 @@ pub fn save_user_state(update: HashMap<String, Value>) -> AppResult<()> {
         HashMap::new()
     };
 
-    // Merge states
-    let merged = merge_user_state(default_user_state(), existing);
-    let final_state = merge_user_state(merged, update);
+    // Merge states; each layer is canonicalized first so a newer legacy key replaces an older canonical one
+    let merged = merge_user_state(default_user_state(), canonicalize_keys(existing));
+    let final_state = merge_user_state(merged, canonicalize_keys(update));
     let normalized = normalize_user_state(final_state);
 
     // Save
@@ -57,21 +103,108 @@ pub fn save_user_state(update: HashMap<String, Value>) -> AppResult<()> {
     Ok(())
 }
 
+/// Load the persisted last submit time
+pub fn load_last_submit_at(dir: &ConfigDir) -> Option<DateTime<Local>> {
+    let state = load_user_state_in(dir).ok()?;
+    let raw = state.get(LAST_SUBMIT_AT_KEY)?.as_str()?;
+    DateTime::parse_from_rfc3339(raw.trim())
+        .ok()
+        .map(|t| t.with_timezone(&Local))
+}
+
+/// Persist the last submit time
+pub fn save_last_submit_at(dir: &ConfigDir, at: DateTime<Local>) -> AppResult<()> {
+    let mut update = HashMap::new();
+    update.insert(LAST_SUBMIT_AT_KEY.into(), Value::String(at.to_rfc3339()));
+    save_user_state_in(dir, update)
+}
+
+/// Load the account_verified hint; None until a submit answer told either way
+pub fn load_account_verified(dir: &ConfigDir) -> Option<bool> {
+    load_user_state_in(dir).ok()?.get(ACCOUNT_VERIFIED_KEY).filter(|v| !v.is_null()).map(|v| normalize_bool(Some(v), false))
+}
+
+/// Persist the account_verified hint
+pub fn save_account_verified(dir: &ConfigDir, verified: bool) -> AppResult<()> {
+    let mut update = HashMap::new();
+    update.insert(ACCOUNT_VERIFIED_KEY.into(), Value::Bool(verified));
+    save_user_state_in(dir, update)
+}
+
+/// Load the SMTP settings for summary emails
+pub fn load_smtp_settings() -> Option<SmtpSettings> {
+    let state = load_user_state().ok()?;
+    serde_json::from_value(state.get(SMTP_KEY)?.clone()).ok()
+}
+
+/// Load the extra request headers; empty when unset or invalid
+pub fn load_extra_headers(dir: &ConfigDir) -> ExtraHeaders {
+    load_user_state_in(dir)
+        .ok()
+        .and_then(|state| serde_json::from_value(state.get(EXTRA_HEADERS_KEY)?.clone()).ok())
+        .unwrap_or_default()
+}
+
+/// Load the in-memory buffer budget; defaults when unset or invalid
+pub fn load_memory_budget(dir: &ConfigDir) -> MemoryBudget {
+    load_user_state_in(dir)
+        .ok()
+        .and_then(|state| serde_json::from_value(state.get(MEMORY_BUDGET_KEY)?.clone()).ok())
+        .unwrap_or_default()
+}
+
+/// Load the QR login warm-up URLs; the defaults when unset, invalid or empty
+pub fn load_qr_warmup_urls() -> Vec<String> {
+    load_user_state()
+        .ok()
+        .and_then(|state| serde_json::from_value::<Vec<String>>(state.get(QR_WARMUP_URLS_KEY)?.clone()).ok())
+        .filter(|urls| !urls.is_empty())
+        .unwrap_or_else(|| DEFAULT_QR_WARMUP_URLS.iter().map(|url| url.to_string()).collect())
+}
+
+/// Whether to prefetch the saved city's hospitals and the last unit's departments after login
+pub fn load_prefetch_on_login() -> bool {
+    let state = load_user_state().unwrap_or_default();
+    normalize_bool(state.get(PREFETCH_ON_LOGIN_KEY), true)
+}
+
+/// Whether the SQLite store is enabled; off by default, read once per process by store.rs
+pub fn load_sqlite_store_enabled(dir: &ConfigDir) -> bool {
+    let state = load_user_state_in(dir).unwrap_or_default();
+    normalize_bool(state.get(SQLITE_STORE_KEY), false)
+}
+
+/// Load the notification routing matrix; the default routes when unset or invalid
+pub fn load_notify_routes() -> NotifyRoutes {
+    load_user_state()
+        .ok()
+        .and_then(|state| serde_json::from_value(state.get(NOTIFY_ROUTES_KEY)?.clone()).ok())
+        .unwrap_or_else(default_notify_routes)
+}
+
+/// Load a grab hook command ("on_success_command" or "on_failure_command")
+pub fn load_hook_command(key: &str) -> Option<HookCommand> {
+    let state = load_user_state().ok()?;
+    serde_json::from_value::<HookCommand>(state.get(key)?.clone())
+        .ok()
+        .filter(|hook| !hook.path.trim().is_empty())
+}
+
 /// Get default user state
 pub fn default_user_state() -> HashMap<String, Value> {
     let mut state = HashMap::new();
     state.insert("city_id".into(), Value::String(DEFAULT_CITY_ID.into()));
     state.insert("unit_id".into(), Value::Null);
     state.insert("dep_id".into(), Value::Null);
-    state.insert("doctor_id".into(), Value::Null);
+    state.insert("doctor_ids".into(), Value::Array(vec![]));
     state.insert("member_id".into(), Value::Null);
     state.insert("target_dates".into(), Value::Array(vec![]));
     state.insert("target_date".into(), Value::String(default_target_date()));
     state.insert(
-        "time_slots".into(),
+        "time_types".into(),
         Value::Array(vec![Value::String("am".into()), Value::String("pm".into())]),
     );
-    state.insert("proxy_submit_enabled".into(), Value::Bool(true));
+    state.insert("use_proxy_submit".into(), Value::Bool(true));
     state
 }
 
@@ -112,17 +245,84 @@ fn normalize_user_state(mut state: HashMap<String, Value>) -> HashMap<String, Va
     let target_dates = normalize_string_array(state.get("target_dates"));
     state.insert("target_dates".into(), Value::Array(target_dates));
 
-    // Normalize time_slots
-    let time_slots = normalize_time_slots(state.get("time_slots"));
-    state.insert("time_slots".into(), Value::Array(time_slots));
+    // Normalize doctor_ids
+    let doctor_ids = normalize_string_array(state.get("doctor_ids"));
+    state.insert("doctor_ids".into(), Value::Array(doctor_ids));
+
+    // Normalize time_types
+    let time_types = normalize_time_slots(state.get("time_types"));
+    state.insert("time_types".into(), Value::Array(time_types));
 
-    // Normalize proxy_submit_enabled
-    let proxy_enabled = normalize_bool(state.get("proxy_submit_enabled"), true);
-    state.insert("proxy_submit_enabled".into(), Value::Bool(proxy_enabled));
+    // Normalize use_proxy_submit
+    let proxy_enabled = normalize_bool(state.get("use_proxy_submit"), true);
+    state.insert("use_proxy_submit".into(), Value::Bool(proxy_enabled));
 
     state
 }
 
+/// Rename legacy keys to their canonical names; a canonical key already present wins
+fn canonicalize_keys(mut state: HashMap<String, Value>) -> HashMap<String, Value> {
+    for (legacy, canonical) in KEY_ALIASES {
+        let Some(value) = state.remove(legacy) else {
+            continue;
+        };
+        let canonical_set = state.get(canonical).map_or(false, |v| !is_blank(v));
+        if !canonical_set && !is_blank(&value) {
+            state.insert(canonical.into(), value);
+        }
+    }
+    state
+}
+
+/// Null, empty string or empty list
+fn is_blank(value: &Value) -> bool {
+    match value {
+        Value::Null => true,
+        Value::String(s) => s.trim().is_empty(),
+        Value::Array(arr) => arr.is_empty(),
+        _ => false,
+    }
+}
+
+/// Build a GrabConfig from a user state or UI map, accepting every legacy key
+/// target_date fills target_dates when no list is given
+pub fn user_state_to_grab_config(state: &HashMap<String, Value>) -> AppResult<GrabConfig> {
+    let mut map = canonicalize_keys(state.clone());
+
+    let target_dates_blank = map.get("target_dates").map_or(true, is_blank);
+    if let Some(target_date) = map.remove("target_date").filter(|v| !is_blank(v)) {
+        if target_dates_blank {
+            map.insert("target_dates".into(), target_date);
+        }
+    }
+
+    for key in GRAB_CONFIG_LIST_KEYS {
+        let list = normalize_string_array(map.get(key));
+        map.insert(key.into(), Value::Array(list));
+    }
+    for key in GRAB_CONFIG_ID_KEYS {
+        match map.get(key) {
+            Some(Value::Number(n)) => {
+                let id = n.to_string();
+                map.insert(key.into(), Value::String(id));
+            }
+            Some(Value::Null) => {
+                map.remove(key);
+            }
+            _ => {}
+        }
+    }
+    if let Some(value) = map.get("use_proxy_submit") {
+        let enabled = normalize_bool(Some(value), true);
+        map.insert("use_proxy_submit".into(), Value::Bool(enabled));
+    }
+
+    let mut config: GrabConfig = serde_json::from_value(Value::Object(map.into_iter().collect()))
+        .map_err(|e| AppError::ConfigError(format!("invalid grab config: {}", e)))?;
+    config.split_target_dates().map_err(AppError::ConfigError)?;
+    Ok(config)
+}
+
 /// Normalize a boolean value
 fn normalize_bool(value: Option<&Value>, default: bool) -> bool {
     match value {
@@ -189,7 +389,9 @@ pub fn to_user_state_struct(map: &HashMap<String, Value>) -> UserState {
             .and_then(|v| v.as_str())
             .map(|s| s.to_string()),
         doctor_id: map
-            .get("doctor_id")
+            .get("doctor_ids")
+            .and_then(|v| v.as_array())
+            .and_then(|arr| arr.first())
             .and_then(|v| v.as_str())
             .map(|s| s.to_string()),
         member_id: map
@@ -211,7 +413,7 @@ pub fn to_user_state_struct(map: &HashMap<String, Value>) -> UserState {
             })
             .unwrap_or_default(),
         time_slots: map
-            .get("time_slots")
+            .get("time_types")
             .and_then(|v| v.as_array())
             .map(|arr| {
                 arr.iter()
@@ -219,13 +421,30 @@ pub fn to_user_state_struct(map: &HashMap<String, Value>) -> UserState {
                     .collect()
             })
             .unwrap_or_else(|| vec!["am".into(), "pm".into()]),
-        proxy_submit_enabled: normalize_bool(map.get("proxy_submit_enabled"), true),
+        proxy_submit_enabled: normalize_bool(map.get("use_proxy_submit"), true),
+        extra_headers: map
+            .get(EXTRA_HEADERS_KEY)
+            .and_then(|v| serde_json::from_value(v.clone()).ok()),
+        max_submits_per_run: read_submit_cap(map, "max_submits_per_run"),
+        max_submits_per_day: read_submit_cap(map, "max_submits_per_day"),
+        prefetch_on_login: map.get(PREFETCH_ON_LOGIN_KEY).map(|v| normalize_bool(Some(v), true)),
+        sqlite_store: map.get(SQLITE_STORE_KEY).map(|v| normalize_bool(Some(v), false)),
+        notify_routes: map.get(NOTIFY_ROUTES_KEY).and_then(|v| serde_json::from_value(v.clone()).ok()),
+        account_verified: map.get(ACCOUNT_VERIFIED_KEY).filter(|v| !v.is_null()).map(|v| normalize_bool(Some(v), false)),
     }
 }
 
+/// A submit cap stored in user state; None when unset or not a non-negative number
+pub fn read_submit_cap(map: &HashMap<String, Value>, key: &str) -> Option<u32> {
+    map.get(key)
+        .and_then(|v| v.as_u64())
+        .map(|cap| u32::try_from(cap).unwrap_or(u32::MAX))
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
+    use serde_json::json;
 
     #[test]
     fn test_default_target_date() {
@@ -243,4 +462,81 @@ mod tests {
         assert!(!normalize_bool(Some(&Value::String("false".into())), true));
         assert!(normalize_bool(None, true));
     }
+
+    fn state(pairs: Value) -> HashMap<String, Value> {
+        serde_json::from_value(pairs).unwrap()
+    }
+
+    /// Every legacy key must reach its GrabConfig field; add a line here when a new alias appears
+    #[test]
+    fn test_grab_config_aliases() {
+        let base = json!({"unit_id": "1", "dep_id": "2", "member_id": "3", "target_dates": ["2026-10-16"]});
+        let convert = |extra: Value| {
+            let mut map = state(base.clone());
+            map.extend(state(extra));
+            user_state_to_grab_config(&map).unwrap()
+        };
+
+        assert_eq!(convert(json!({"time_slots": ["am"]})).time_types, vec!["am"]);
+        assert_eq!(convert(json!({"time_type": "pm"})).time_types, vec!["pm"]);
+        assert_eq!(convert(json!({"doctor_id": "42"})).doctor_ids, vec!["42"]);
+        assert_eq!(convert(json!({"preferred_hour": "08:00"})).preferred_hours, vec!["08:00"]);
+        assert_eq!(convert(json!({"preferredHours": ["09:00"]})).preferred_hours, vec!["09:00"]);
+        assert_eq!(convert(json!({"address_id": "7"})).address_id, "7");
+        assert_eq!(convert(json!({"addressid": 8})).address_id, "8");
+        assert!(!convert(json!({"proxy_submit_enabled": "false"})).use_proxy_submit);
+        assert_eq!(KEY_ALIASES.len(), 8, "new alias without a test line above");
+
+        // target_date only fills an empty target_dates
+        let mut map = state(base.clone());
+        map.insert("target_dates".into(), json!([]));
+        map.insert("target_date".into(), json!("2026-10-20"));
+        assert_eq!(user_state_to_grab_config(&map).unwrap().target_dates, vec!["2026-10-20"]);
+        map.insert("target_dates".into(), json!(["2026-10-16"]));
+        assert_eq!(user_state_to_grab_config(&map).unwrap().target_dates, vec!["2026-10-16"]);
+    }
+
+    #[test]
+    fn test_grab_config_canonical_wins() {
+        let map = state(json!({
+            "unit_id": 1, "dep_id": "2", "member_id": "3", "target_dates": "2026-10-16",
+            "time_types": ["pm"], "time_slots": ["am"], "doctor_id": null, "doctor_ids": ["5"]
+        }));
+        let config = user_state_to_grab_config(&map).unwrap();
+        assert_eq!(config.unit_id, "1");
+        assert_eq!(config.time_types, vec!["pm"]);
+        assert_eq!(config.doctor_ids, vec!["5"]);
+        assert_eq!(config.target_dates, vec!["2026-10-16"]);
+        assert!(config.use_proxy_submit);
+    }
+
+    #[test]
+    fn test_normalize_writes_canonical_keys() {
+        let raw = state(json!({"time_slots": ["am"], "doctor_id": "9", "proxy_submit_enabled": false}));
+        let normalized = normalize_user_state(merge_user_state(default_user_state(), canonicalize_keys(raw)));
+        for (legacy, _) in KEY_ALIASES {
+            assert!(!normalized.contains_key(legacy), "legacy key {} written", legacy);
+        }
+        assert_eq!(normalized["time_types"], json!(["am"]));
+        assert_eq!(normalized["doctor_ids"], json!(["9"]));
+        assert_eq!(normalized["use_proxy_submit"], json!(false));
+
+        let ui = to_user_state_struct(&normalized);
+        assert_eq!(ui.time_slots, vec!["am"]);
+        assert_eq!(ui.doctor_id.as_deref(), Some("9"));
+        assert!(!ui.proxy_submit_enabled);
+    }
+
+    #[test]
+    fn test_prefetch_on_login_round_trip() {
+        assert_eq!(to_user_state_struct(&state(json!({}))).prefetch_on_login, None);
+        let off = to_user_state_struct(&state(json!({"prefetch_on_login": "false"})));
+        assert_eq!(off.prefetch_on_login, Some(false));
+
+        // Saving the UI struct back keeps the setting; an unset one is not written
+        let saved = serde_json::to_value(&off).unwrap();
+        assert_eq!(saved[PREFETCH_ON_LOGIN_KEY], json!(false));
+        let unset = serde_json::to_value(to_user_state_struct(&state(json!({})))).unwrap();
+        assert!(unset.get(PREFETCH_ON_LOGIN_KEY).is_none());
+    }
 }
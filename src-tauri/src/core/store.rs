@@ -0,0 +1,193 @@
+//! Local storage for history, learned booking windows, pacing profiles and daily submit counters
+//! JSON files in the config dir are the default. Built with the "sqlite-store" feature and with
+//! "sqlite_store" set in user state, the same data lives in config/skylinemed.db instead (see sqlite_store).
+//! The choice is read once per process, so switching takes a restart.
+
+use std::collections::HashMap;
+use std::fs;
+use std::path::PathBuf;
+use std::sync::{Mutex, OnceLock};
+
+use chrono::{DateTime, Local, NaiveDate};
+use serde::de::DeserializeOwned;
+use serde::Serialize;
+
+use super::errors::AppResult;
+use super::history::HistoryEntry;
+use super::insights::DepartmentStats;
+use super::pacing::{default_pacing_profiles, PacingProfile};
+use super::paths::{write_file_atomic, ConfigDir, HISTORY_FILE, INSIGHTS_FILE, PACING_FILE, SUBMIT_COUNTS_FILE};
+#[cfg(feature = "sqlite-store")]
+use super::paths::STORE_DB_FILE;
+#[cfg(feature = "sqlite-store")]
+use super::sqlite_store::SqliteStore;
+use super::state::load_sqlite_store_enabled;
+use super::submit_counts::{count_on, increment_on, DailySubmitCount};
+
+/// Storage behind the history, insights, pacing and submit counter modules
+/// Read-modify-write methods are atomic per store, so concurrent runs never lose an update.
+pub trait Store: Send + Sync {
+    fn history(&self) -> AppResult<Vec<HistoryEntry>>;
+    /// Append an entry, dropping the oldest past keep
+    fn append_history(&self, entry: &HistoryEntry, keep: usize) -> AppResult<()>;
+
+    fn department_stats(&self) -> AppResult<HashMap<String, DepartmentStats>>;
+    /// Apply update to the stats of a department and save them when it returns true
+    /// Only the keep most recently updated departments are kept.
+    fn update_department_stats(&self, key: &str, keep: usize, update: &mut dyn FnMut(&mut DepartmentStats) -> bool) -> AppResult<()>;
+
+    /// Stored pacing profiles, or the built-in ones while none were ever saved
+    fn pacing_profiles(&self) -> AppResult<HashMap<String, PacingProfile>>;
+    fn update_pacing_profiles(&self, update: &mut dyn FnMut(&mut HashMap<String, PacingProfile>)) -> AppResult<()>;
+
+    /// Submits counted for account on day
+    fn submit_count(&self, account: &str, day: NaiveDate) -> AppResult<u32>;
+    /// Count one submit of account on day, dropping every other day's counts; returns the new count
+    fn increment_submit_count(&self, account: &str, day: NaiveDate) -> AppResult<u32>;
+}
+
+static STORE: OnceLock<Box<dyn Store>> = OnceLock::new();
+
+/// The store of this process: SQLite when enabled and it opens, the JSON files otherwise
+pub fn store() -> AppResult<&'static dyn Store> {
+    if let Some(store) = STORE.get() {
+        return Ok(store.as_ref());
+    }
+    let store = open_store(&ConfigDir::default())?;
+    Ok(STORE.get_or_init(|| store).as_ref())
+}
+
+/// Open the store of dir: SQLite when enabled there and it opens, the JSON files otherwise
+pub fn open_store(dir: &ConfigDir) -> AppResult<Box<dyn Store>> {
+    let json = JsonStore::new(dir.path()?);
+    if !load_sqlite_store_enabled(dir) {
+        return Ok(Box::new(json));
+    }
+    Ok(open_sqlite(dir, json))
+}
+
+#[cfg(feature = "sqlite-store")]
+fn open_sqlite(dir: &ConfigDir, json: JsonStore) -> Box<dyn Store> {
+    match dir.join(STORE_DB_FILE).and_then(|path| SqliteStore::open(&path, &json)) {
+        Ok(sqlite) => Box::new(sqlite),
+        Err(e) => {
+            println!(">>> SQLite store unavailable, using JSON files: {}", e);
+            Box::new(json)
+        }
+    }
+}
+
+#[cfg(not(feature = "sqlite-store"))]
+fn open_sqlite(_dir: &ConfigDir, json: JsonStore) -> Box<dyn Store> {
+    println!(">>> SQLite store not built in (sqlite-store feature), using JSON files");
+    Box::new(json)
+}
+
+/// Serializes the read-modify-write of each JSON file between tasks
+static HISTORY_LOCK: Mutex<()> = Mutex::new(());
+static INSIGHTS_LOCK: Mutex<()> = Mutex::new(());
+static PACING_LOCK: Mutex<()> = Mutex::new(());
+static SUBMIT_COUNTS_LOCK: Mutex<()> = Mutex::new(());
+
+fn lock(mutex: &Mutex<()>) -> std::sync::MutexGuard<'_, ()> {
+    mutex.lock().unwrap_or_else(|poisoned| poisoned.into_inner())
+}
+
+/// One JSON file per kind of data, each replaced atomically on write
+pub struct JsonStore {
+    dir: PathBuf,
+}
+
+impl JsonStore {
+    pub fn new(dir: PathBuf) -> Self {
+        Self { dir }
+    }
+
+    /// Parsed file; None when it is missing, the type's default when it is unreadable
+    fn read<T: DeserializeOwned + Default>(&self, file: &str) -> AppResult<Option<T>> {
+        let path = self.dir.join(file);
+        if !path.exists() {
+            return Ok(None);
+        }
+        let data = fs::read_to_string(&path)?;
+        Ok(Some(serde_json::from_str(&data).unwrap_or_default()))
+    }
+
+    fn write<T: Serialize>(&self, file: &str, value: &T) -> AppResult<()> {
+        let data = serde_json::to_string_pretty(value)?;
+        write_file_atomic(&self.dir.join(file), data.as_bytes())
+    }
+
+    pub(super) fn submit_counts(&self) -> AppResult<HashMap<String, DailySubmitCount>> {
+        Ok(self.read(SUBMIT_COUNTS_FILE)?.unwrap_or_default())
+    }
+
+    /// Profiles in pacing.json; None when the file is missing or unreadable
+    pub(super) fn stored_pacing_profiles(&self) -> AppResult<Option<HashMap<String, PacingProfile>>> {
+        let path = self.dir.join(PACING_FILE);
+        if !path.exists() {
+            return Ok(None);
+        }
+        Ok(serde_json::from_str(&fs::read_to_string(&path)?).ok())
+    }
+}
+
+impl Store for JsonStore {
+    fn history(&self) -> AppResult<Vec<HistoryEntry>> {
+        Ok(self.read(HISTORY_FILE)?.unwrap_or_default())
+    }
+
+    fn append_history(&self, entry: &HistoryEntry, keep: usize) -> AppResult<()> {
+        let _guard = lock(&HISTORY_LOCK);
+        let mut entries = self.history()?;
+        entries.push(entry.clone());
+        if entries.len() > keep {
+            let excess = entries.len() - keep;
+            entries.drain(..excess);
+        }
+        self.write(HISTORY_FILE, &entries)
+    }
+
+    fn department_stats(&self) -> AppResult<HashMap<String, DepartmentStats>> {
+        Ok(self.read(INSIGHTS_FILE)?.unwrap_or_default())
+    }
+
+    fn update_department_stats(&self, key: &str, keep: usize, update: &mut dyn FnMut(&mut DepartmentStats) -> bool) -> AppResult<()> {
+        let _guard = lock(&INSIGHTS_LOCK);
+        let mut all = self.department_stats()?;
+        if !update(all.entry(key.to_string()).or_default()) {
+            return Ok(());
+        }
+        if all.len() > keep {
+            let mut keys: Vec<(Option<DateTime<Local>>, String)> = all.iter().map(|(k, s)| (s.updated_at, k.clone())).collect();
+            keys.sort();
+            for (_, key) in keys.into_iter().take(all.len() - keep) {
+                all.remove(&key);
+            }
+        }
+        self.write(INSIGHTS_FILE, &all)
+    }
+
+    fn pacing_profiles(&self) -> AppResult<HashMap<String, PacingProfile>> {
+        Ok(self.stored_pacing_profiles()?.unwrap_or_else(default_pacing_profiles))
+    }
+
+    fn update_pacing_profiles(&self, update: &mut dyn FnMut(&mut HashMap<String, PacingProfile>)) -> AppResult<()> {
+        let _guard = lock(&PACING_LOCK);
+        let mut profiles = self.pacing_profiles()?;
+        update(&mut profiles);
+        self.write(PACING_FILE, &profiles)
+    }
+
+    fn submit_count(&self, account: &str, day: NaiveDate) -> AppResult<u32> {
+        Ok(count_on(&self.submit_counts()?, account, day))
+    }
+
+    fn increment_submit_count(&self, account: &str, day: NaiveDate) -> AppResult<u32> {
+        let _guard = lock(&SUBMIT_COUNTS_LOCK);
+        let mut counts = self.submit_counts()?;
+        let count = increment_on(&mut counts, account, day);
+        self.write(SUBMIT_COUNTS_FILE, &counts)?;
+        Ok(count)
+    }
+}
@@ -0,0 +1,86 @@
+//! Submits sent per account and local day
+//! The store keeps max_submits_per_day honest across restarts; a day rolls over at local
+//! midnight and only today's counts are kept.
+
+use std::collections::HashMap;
+
+use chrono::{Local, NaiveDate};
+use serde::{Deserialize, Serialize};
+
+use super::errors::AppResult;
+use super::store::{store, Store};
+
+/// Submits of one account on one local day
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct DailySubmitCount {
+    pub date: NaiveDate,
+    pub count: u32,
+}
+
+/// Submits counted for account on day; 0 when nothing was counted that day
+pub(super) fn count_on(counts: &HashMap<String, DailySubmitCount>, account: &str, day: NaiveDate) -> u32 {
+    counts
+        .get(account.trim())
+        .filter(|entry| entry.date == day)
+        .map_or(0, |entry| entry.count)
+}
+
+/// Count one submit of account on day, dropping every other day's counts; returns the new count
+pub(super) fn increment_on(counts: &mut HashMap<String, DailySubmitCount>, account: &str, day: NaiveDate) -> u32 {
+    counts.retain(|_, entry| entry.date == day);
+    let entry = counts
+        .entry(account.trim().to_string())
+        .or_insert(DailySubmitCount { date: day, count: 0 });
+    entry.count = entry.count.saturating_add(1);
+    entry.count
+}
+
+/// Submits account sent today
+pub fn submits_today(account: &str) -> AppResult<u32> {
+    submits_today_in(store()?, account)
+}
+
+/// Submits account sent today, as counted in store
+pub fn submits_today_in(store: &dyn Store, account: &str) -> AppResult<u32> {
+    store.submit_count(account, Local::now().date_naive())
+}
+
+/// Count one submit of account today; returns today's count including it
+pub fn record_submit(store: &dyn Store, account: &str) -> AppResult<u32> {
+    store.increment_submit_count(account, Local::now().date_naive())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn day(d: u32) -> NaiveDate {
+        NaiveDate::from_ymd_opt(2026, 10, d).unwrap()
+    }
+
+    #[test]
+    fn test_daily_count_rolls_over() {
+        let mut counts = HashMap::new();
+        assert_eq!(increment_on(&mut counts, "m1", day(15)), 1);
+        assert_eq!(increment_on(&mut counts, " m1 ", day(15)), 2);
+        assert_eq!(increment_on(&mut counts, "m2", day(15)), 1);
+        assert_eq!(count_on(&counts, "m1", day(15)), 2);
+        assert_eq!(count_on(&counts, "m3", day(15)), 0);
+
+        // Yesterday's counts read as 0 and are dropped on the next write
+        assert_eq!(count_on(&counts, "m1", day(16)), 0);
+        assert_eq!(increment_on(&mut counts, "m1", day(16)), 1);
+        assert_eq!(counts.len(), 1);
+        assert_eq!(count_on(&counts, "m2", day(16)), 0);
+    }
+
+    #[test]
+    fn test_counts_survive_serialization() {
+        let mut counts = HashMap::new();
+        increment_on(&mut counts, "m1", day(15));
+        increment_on(&mut counts, "m1", day(15));
+        let data = serde_json::to_string(&counts).unwrap();
+        let restored: HashMap<String, DailySubmitCount> = serde_json::from_str(&data).unwrap();
+        assert_eq!(count_on(&restored, "m1", day(15)), 2);
+    }
+}
@@ -0,0 +1,185 @@
+//! Target date input for SkylineMed
+//! Users paste "2025-03-05 上午" or "2025-03-05 09:00" into target dates. The date part is what the
+//! schedule query takes; the time-of-day part becomes a preference for that date only.
+
+use chrono::{NaiveDate, NaiveTime, Timelike};
+
+use super::types::{DatePreference, GrabConfig};
+
+/// How one target_dates entry was read
+#[derive(Debug, Clone, PartialEq)]
+pub struct TargetDateInput {
+    pub input: String,
+    /// YYYY-MM-DD, None when the entry is not a date
+    pub date: Option<String>,
+    /// "am" / "pm" from 上午/下午 or the clock time
+    pub time_type: Option<String>,
+    /// HH:MM from an explicit clock time
+    pub hour: Option<String>,
+    /// Trailing text that is neither a period nor a clock time
+    pub unknown: Option<String>,
+}
+
+impl TargetDateInput {
+    pub fn is_valid(&self) -> bool {
+        self.date.is_some() && self.unknown.is_none()
+    }
+
+    /// "\"2025-03-05 09:00\" → 2025-03-05 am, preferred 09:00"
+    pub fn describe(&self) -> String {
+        let Some(date) = &self.date else {
+            return format!("\"{}\" → not a date", self.input);
+        };
+        let mut parts = vec![date.clone()];
+        if let Some(time_type) = &self.time_type {
+            parts.push(time_type.clone());
+        }
+        let mut text = parts.join(" ");
+        if let Some(hour) = &self.hour {
+            text.push_str(&format!(", preferred {}", hour));
+        }
+        if let Some(unknown) = &self.unknown {
+            text.push_str(&format!(", time \"{}\" not understood", unknown));
+        }
+        format!("\"{}\" → {}", self.input, text)
+    }
+}
+
+/// Read one entry: a date, optionally followed by 上午/下午/am/pm or a clock time
+pub fn parse_target_date(input: &str) -> TargetDateInput {
+    let trimmed = input.trim();
+    let mut parsed = TargetDateInput {
+        input: trimmed.to_string(),
+        date: None,
+        time_type: None,
+        hour: None,
+        unknown: None,
+    };
+
+    let (date_part, rest) = match trimmed.find(|c: char| c.is_whitespace() || c == 'T') {
+        Some(at) => (&trimmed[..at], trimmed[at..].trim_start_matches('T').trim()),
+        None => (trimmed, ""),
+    };
+    let date = ["%Y-%m-%d", "%Y/%m/%d"]
+        .iter()
+        .find_map(|format| NaiveDate::parse_from_str(date_part, format).ok());
+    let Some(date) = date else {
+        return parsed;
+    };
+    parsed.date = Some(date.format("%Y-%m-%d").to_string());
+    if rest.is_empty() {
+        return parsed;
+    }
+
+    match rest.to_lowercase().as_str() {
+        "上午" | "早上" | "am" => parsed.time_type = Some("am".into()),
+        "下午" | "pm" => parsed.time_type = Some("pm".into()),
+        text => match ["%H:%M", "%H:%M:%S"].iter().find_map(|format| NaiveTime::parse_from_str(text, format).ok()) {
+            Some(time) => {
+                parsed.time_type = Some(if time.hour() < 12 { "am" } else { "pm" }.into());
+                parsed.hour = Some(time.format("%H:%M").to_string());
+            }
+            None => parsed.unknown = Some(rest.to_string()),
+        },
+    }
+    parsed
+}
+
+impl GrabConfig {
+    /// Reduce target_dates to plain dates, folding each entry's time of day into date_preferences
+    /// A bare date next to a qualified entry for the same day keeps the qualification
+    /// On failure the error lists how every entry was read
+    pub fn split_target_dates(&mut self) -> Result<Vec<TargetDateInput>, String> {
+        let inputs: Vec<TargetDateInput> = self.target_dates.iter().map(|entry| parse_target_date(entry)).collect();
+        if inputs.iter().any(|input| !input.is_valid()) {
+            let lines: Vec<String> = inputs.iter().map(TargetDateInput::describe).collect();
+            return Err(format!("target_dates not understood: {}", lines.join("; ")));
+        }
+
+        let mut dates: Vec<String> = Vec::new();
+        for input in &inputs {
+            let Some(date) = &input.date else { continue };
+            if !dates.contains(date) {
+                dates.push(date.clone());
+            }
+            if input.time_type.is_none() && input.hour.is_none() {
+                continue;
+            }
+            let preference = self.date_preferences.entry(date.clone()).or_insert_with(DatePreference::default);
+            if let Some(time_type) = &input.time_type {
+                if !preference.time_types.contains(time_type) {
+                    preference.time_types.push(time_type.clone());
+                }
+            }
+            if let Some(hour) = &input.hour {
+                if !preference.preferred_hours.contains(hour) {
+                    preference.preferred_hours.push(hour.clone());
+                }
+            }
+        }
+        self.target_dates = dates;
+        Ok(inputs)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn grab_config(dates: &[&str]) -> GrabConfig {
+        serde_json::from_value(serde_json::json!({
+            "unit_id": "1", "dep_id": "2", "member_id": "3", "target_dates": dates, "time_types": ["am", "pm"]
+        }))
+        .unwrap()
+    }
+
+    #[test]
+    fn test_parse_target_date() {
+        let plain = parse_target_date(" 2025-03-05 ");
+        assert_eq!(plain.date.as_deref(), Some("2025-03-05"));
+        assert_eq!((plain.time_type.as_deref(), plain.hour.as_deref()), (None, None));
+
+        let morning = parse_target_date("2025-03-05 上午");
+        assert_eq!(morning.time_type.as_deref(), Some("am"));
+        assert_eq!(morning.describe(), "\"2025-03-05 上午\" → 2025-03-05 am");
+
+        let clock = parse_target_date("2025/3/5 14:30");
+        assert_eq!(clock.date.as_deref(), Some("2025-03-05"));
+        assert_eq!(clock.describe(), "\"2025/3/5 14:30\" → 2025-03-05 pm, preferred 14:30");
+        assert_eq!(parse_target_date("2025-03-05T09:00:00").hour.as_deref(), Some("09:00"));
+
+        let evening = parse_target_date("2025-03-05 晚上");
+        assert!(!evening.is_valid());
+        assert_eq!(evening.describe(), "\"2025-03-05 晚上\" → 2025-03-05, time \"晚上\" not understood");
+        assert_eq!(parse_target_date("3月5日").describe(), "\"3月5日\" → not a date");
+    }
+
+    #[test]
+    fn test_split_target_dates() {
+        let mut config = grab_config(&["2025-03-05 上午", "2025-03-06 09:00", "2025-03-05", "2025-03-07"]);
+        config.split_target_dates().unwrap();
+        assert_eq!(config.target_dates, ["2025-03-05", "2025-03-06", "2025-03-07"]);
+        assert_eq!(config.date_preferences["2025-03-05"].time_types, ["am"]);
+        assert_eq!(config.date_preferences["2025-03-06"].preferred_hours, ["09:00"]);
+        assert!(!config.date_preferences.contains_key("2025-03-07"));
+
+        // Per-date preferences layer over the global ones
+        assert_eq!(config.time_types_for("2025-03-05"), ["am"]);
+        assert_eq!(config.time_types_for("2025-03-07"), ["am", "pm"]);
+        assert_eq!(config.preferred_hours_for("2025-03-06"), ["09:00"]);
+        assert!(config.preferred_hours_for("2025-03-07").is_empty());
+
+        // Splitting again changes nothing
+        let before = config.date_preferences.clone();
+        config.split_target_dates().unwrap();
+        assert_eq!(config.date_preferences, before);
+
+        let mut config = grab_config(&["2025-03-05 上午", "2025-03-06 傍晚", "下周三"]);
+        let error = config.split_target_dates().unwrap_err();
+        assert_eq!(
+            error,
+            "target_dates not understood: \"2025-03-05 上午\" → 2025-03-05 am; \
+             \"2025-03-06 傍晚\" → 2025-03-06, time \"傍晚\" not understood; \"下周三\" → not a date"
+        );
+    }
+}
@@ -0,0 +1,371 @@
+//! Task registry shared by the GUI and the CLI
+//! Every grab run is registered here. Besides the in-memory snapshot, each task's status is written
+//! to logs/tasks/<task_id>/status.json (atomically, at most once per second) so another process,
+//! e.g. `skylinemed-cli status` over SSH, can inspect a running GUI's tasks read-only.
+
+use std::collections::HashMap;
+use std::fs;
+use std::path::{Path, PathBuf};
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+
+use chrono::{DateTime, Local};
+use serde::{Deserialize, Serialize};
+
+use super::errors::AppResult;
+use super::history::{append_history, HistoryEntry, HISTORY_KIND_TASK_FINISHED};
+use super::messages::LogMessage;
+use super::paths::{logs_dir, write_file_atomic};
+use super::types::{GrabConfig, GrabberState};
+
+pub const TASK_KIND_GRAB: &str = "grab";
+
+pub const TASK_STATE_RUNNING: &str = "running";
+pub const TASK_STATE_PAUSED: &str = "paused";
+pub const TASK_STATE_STOPPING: &str = "stopping";
+pub const TASK_STATE_SUCCEEDED: &str = "succeeded";
+pub const TASK_STATE_FAILED: &str = "failed";
+pub const TASK_STATE_STOPPED: &str = "stopped";
+/// The owning process died without finishing the task
+pub const TASK_STATE_ABANDONED: &str = "abandoned";
+
+const TASKS_DIR_NAME: &str = "tasks";
+const STATUS_FILE_NAME: &str = "status.json";
+/// Minimum gap between two writes of the same status file
+pub const STATUS_WRITE_INTERVAL: Duration = Duration::from_secs(1);
+/// Finished task directories kept on startup
+const MAX_KEPT_TASKS: usize = 20;
+
+/// Snapshot of one task, as written to status.json
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct TaskStatus {
+    /// Unique across restarts: start time plus the session number
+    pub task_id: String,
+    /// Session number the GUI events carry
+    pub session: u64,
+    pub kind: String,
+    pub state: String,
+    /// Process that owns the task
+    pub pid: u32,
+    pub unit_id: String,
+    pub dep_id: String,
+    pub target_dates: Vec<String>,
+    pub started_at: DateTime<Local>,
+    pub updated_at: DateTime<Local>,
+    pub attempts: u32,
+    /// Last user-facing log line
+    #[serde(default)]
+    pub last_message: String,
+    /// Final message once the task finished
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub result: Option<String>,
+}
+
+impl TaskStatus {
+    /// Whether the task has not finished yet
+    pub fn is_active(&self) -> bool {
+        matches!(self.state.as_str(), TASK_STATE_RUNNING | TASK_STATE_PAUSED | TASK_STATE_STOPPING)
+    }
+}
+
+struct TaskEntry {
+    status: TaskStatus,
+    path: Option<PathBuf>,
+    last_write: Option<Instant>,
+    dirty: bool,
+}
+
+impl TaskEntry {
+    /// Write the status file if forced, or if it is dirty and the last write is old enough
+    /// Write errors are logged and retried on the next update, never surfaced to the task
+    fn write(&mut self, force: bool) {
+        let Some(path) = &self.path else {
+            self.dirty = false;
+            return;
+        };
+        let due = self.last_write.map_or(true, |at| at.elapsed() >= STATUS_WRITE_INTERVAL);
+        if !force && !(self.dirty && due) {
+            return;
+        }
+        let result = serde_json::to_vec_pretty(&self.status)
+            .map_err(Into::into)
+            .and_then(|data| write_file_atomic(path, &data));
+        match result {
+            Ok(()) => {
+                self.last_write = Some(Instant::now());
+                self.dirty = false;
+            }
+            Err(e) => println!(">>> task status write failed: {}", e),
+        }
+    }
+}
+
+/// Registry of the tasks of this process
+/// Safe to share between tasks; status files are written under the registry lock, so two updates
+/// never race on one file, and through write_file_atomic, so a crash never leaves a torn file
+pub struct TaskManager {
+    dir: Option<PathBuf>,
+    /// Whether finished tasks are recorded in the shared grab history
+    history: bool,
+    tasks: Mutex<HashMap<u64, TaskEntry>>,
+}
+
+impl TaskManager {
+    /// Registry writing under logs/tasks; tasks abandoned by a crashed process are marked as such
+    pub fn new() -> Self {
+        let dir = logs_dir().ok().map(|dir| dir.join(TASKS_DIR_NAME));
+        if let Some(dir) = &dir {
+            recover_abandoned(dir);
+        }
+        Self {
+            history: true,
+            ..Self::with_dir(dir)
+        }
+    }
+
+    /// Registry writing under dir and leaving the grab history alone; None keeps statuses in memory only
+    pub fn with_dir(dir: Option<PathBuf>) -> Self {
+        Self {
+            dir,
+            history: false,
+            tasks: Mutex::new(HashMap::new()),
+        }
+    }
+
+    /// Register a grab run and write its first status
+    pub fn start_grab(&self, session: u64, config: &GrabConfig) -> String {
+        let now = Local::now();
+        let task_id = format!("{}-{}", now.format("%Y%m%d-%H%M%S"), session);
+        let status = TaskStatus {
+            task_id: task_id.clone(),
+            session,
+            kind: TASK_KIND_GRAB.into(),
+            state: TASK_STATE_RUNNING.into(),
+            pid: std::process::id(),
+            unit_id: config.unit_id.clone(),
+            dep_id: config.dep_id.clone(),
+            target_dates: config.target_dates.clone(),
+            started_at: now,
+            updated_at: now,
+            attempts: 0,
+            last_message: String::new(),
+            result: None,
+        };
+        let mut entry = TaskEntry {
+            path: self.dir.as_ref().map(|dir| dir.join(&task_id).join(STATUS_FILE_NAME)),
+            status,
+            last_write: None,
+            dirty: true,
+        };
+        entry.write(true);
+        self.lock().insert(session, entry);
+        task_id
+    }
+
+    /// Note a log line of a task; attempt.start also advances the attempt counter
+    pub fn record_log(&self, session: u64, message: &LogMessage, rendered: &str) {
+        self.update(session, |status| {
+            if message.key == "attempt.start" {
+                if let Some(attempt) = message.params.get("attempt").and_then(|v| v.parse().ok()) {
+                    status.attempts = attempt;
+                }
+            }
+            status.last_message = rendered.to_string();
+        });
+    }
+
+    /// Mirror the GUI grabber state onto the active grab tasks
+    pub fn set_grabber_state(&self, state: GrabberState) {
+        let next = match state {
+            GrabberState::Running => TASK_STATE_RUNNING,
+            GrabberState::Paused => TASK_STATE_PAUSED,
+            GrabberState::Stopping => TASK_STATE_STOPPING,
+            GrabberState::Idle => return,
+        };
+        let mut tasks = self.lock();
+        for entry in tasks.values_mut().filter(|e| e.status.kind == TASK_KIND_GRAB && e.status.is_active()) {
+            entry.status.state = next.into();
+            entry.status.updated_at = Local::now();
+            entry.write(true);
+        }
+    }
+
+    /// Mark a task finished, write its final status and a history entry
+    pub fn finish(&self, session: u64, state: &str, message: &str) {
+        let mut tasks = self.lock();
+        let Some(entry) = tasks.get_mut(&session) else {
+            return;
+        };
+        entry.status.state = state.into();
+        entry.status.result = Some(message.to_string());
+        entry.status.updated_at = Local::now();
+        entry.write(true);
+        if !self.history {
+            return;
+        }
+
+        let mut history = HistoryEntry::new(HISTORY_KIND_TASK_FINISHED, &format!("{} {}: {}", entry.status.task_id, state, message));
+        history.unit_id = entry.status.unit_id.clone();
+        history.dep_id = entry.status.dep_id.clone();
+        drop(tasks);
+        if let Err(e) = append_history(history) {
+            println!(">>> history write failed: {}", e);
+        }
+    }
+
+    /// Write statuses whose last update was throttled
+    pub fn flush(&self) {
+        for entry in self.lock().values_mut() {
+            entry.write(false);
+        }
+    }
+
+    /// Whether a task is registered and not finished
+    pub fn is_active(&self, session: u64) -> bool {
+        self.lock().get(&session).map_or(false, |e| e.status.is_active())
+    }
+
+    /// Snapshots of all tasks of this process, newest first
+    pub fn snapshots(&self) -> Vec<TaskStatus> {
+        let mut list: Vec<TaskStatus> = self.lock().values().map(|e| e.status.clone()).collect();
+        list.sort_by(|a, b| b.started_at.cmp(&a.started_at));
+        list
+    }
+
+    fn update(&self, session: u64, apply: impl FnOnce(&mut TaskStatus)) {
+        let mut tasks = self.lock();
+        let Some(entry) = tasks.get_mut(&session) else {
+            return;
+        };
+        apply(&mut entry.status);
+        entry.status.updated_at = Local::now();
+        entry.dirty = true;
+        entry.write(false);
+    }
+
+    /// The registry stays usable after a panic in another holder; statuses are plain data
+    fn lock(&self) -> std::sync::MutexGuard<'_, HashMap<u64, TaskEntry>> {
+        self.tasks.lock().unwrap_or_else(|poisoned| poisoned.into_inner())
+    }
+}
+
+impl Default for TaskManager {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+/// logs/tasks, where status files are written
+pub fn tasks_dir() -> AppResult<PathBuf> {
+    Ok(logs_dir()?.join(TASKS_DIR_NAME))
+}
+
+/// Read every status file under dir, newest first; active tasks of dead processes read as abandoned
+/// Read-only: safe to call from another process while the owner keeps writing
+pub fn read_task_statuses(dir: &Path) -> Vec<TaskStatus> {
+    let Ok(entries) = fs::read_dir(dir) else {
+        return Vec::new();
+    };
+    let mut list: Vec<TaskStatus> = entries
+        .flatten()
+        .filter_map(|entry| fs::read_to_string(entry.path().join(STATUS_FILE_NAME)).ok())
+        .filter_map(|data| serde_json::from_str::<TaskStatus>(&data).ok())
+        .map(|mut status| {
+            if status.is_active() && process_alive(status.pid) == Some(false) {
+                status.state = TASK_STATE_ABANDONED.into();
+            }
+            status
+        })
+        .collect();
+    list.sort_by(|a, b| b.started_at.cmp(&a.started_at));
+    list
+}
+
+/// Persist the abandoned state of crashed tasks and drop the oldest finished task directories
+fn recover_abandoned(dir: &Path) {
+    let statuses = read_task_statuses(dir);
+    for status in statuses.iter().filter(|s| s.state == TASK_STATE_ABANDONED) {
+        if let Ok(data) = serde_json::to_vec_pretty(status) {
+            let _ = write_file_atomic(&dir.join(&status.task_id).join(STATUS_FILE_NAME), &data);
+        }
+    }
+    for status in statuses.iter().filter(|s| !s.is_active()).skip(MAX_KEPT_TASKS) {
+        let _ = fs::remove_dir_all(dir.join(&status.task_id));
+    }
+}
+
+/// Whether a process is alive; None where that cannot be told cheaply
+fn process_alive(pid: u32) -> Option<bool> {
+    if pid == std::process::id() {
+        return Some(true);
+    }
+    if cfg!(target_os = "linux") {
+        return Some(Path::new(&format!("/proc/{}", pid)).exists());
+    }
+    None
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn temp_dir(name: &str) -> PathBuf {
+        let dir = std::env::temp_dir().join(format!("skylinemed_tasks_{}_{}", name, std::process::id()));
+        let _ = fs::remove_dir_all(&dir);
+        dir
+    }
+
+    fn config() -> GrabConfig {
+        serde_json::from_value(serde_json::json!({
+            "unit_id": "21", "dep_id": "369", "member_id": "1001", "target_dates": ["2026-10-20"]
+        }))
+        .unwrap()
+    }
+
+    #[test]
+    fn test_status_file_lifecycle() {
+        let dir = temp_dir("lifecycle");
+        let tasks = TaskManager::with_dir(Some(dir.clone()));
+        let task_id = tasks.start_grab(3, &config());
+
+        let read = read_task_statuses(&dir);
+        assert_eq!(read.len(), 1);
+        assert_eq!((read[0].task_id.as_str(), read[0].state.as_str()), (task_id.as_str(), TASK_STATE_RUNNING));
+
+        // Throttled: an update right after the first write stays in memory until flushed
+        tasks.record_log(3, &LogMessage::new("attempt.start").param("attempt", 4), "第 4 次尝试");
+        assert_eq!(read_task_statuses(&dir)[0].attempts, 0);
+        assert_eq!(tasks.snapshots()[0].attempts, 4);
+
+        tasks.set_grabber_state(GrabberState::Paused);
+        assert_eq!(read_task_statuses(&dir)[0].state, TASK_STATE_PAUSED);
+
+        tasks.finish(3, TASK_STATE_STOPPED, "stopped");
+        let read = read_task_statuses(&dir);
+        assert_eq!(read[0].state, TASK_STATE_STOPPED);
+        assert_eq!(read[0].attempts, 4);
+        assert!(!tasks.is_active(3));
+        let _ = fs::remove_dir_all(&dir);
+    }
+
+    #[test]
+    fn test_dead_owner_reads_abandoned() {
+        let dir = temp_dir("abandoned");
+        let tasks = TaskManager::with_dir(Some(dir.clone()));
+        let task_id = tasks.start_grab(1, &config());
+
+        // Rewrite the file as if another, long gone process owned it
+        let path = dir.join(&task_id).join(STATUS_FILE_NAME);
+        let mut status: TaskStatus = serde_json::from_str(&fs::read_to_string(&path).unwrap()).unwrap();
+        status.pid = u32::MAX;
+        fs::write(&path, serde_json::to_vec(&status).unwrap()).unwrap();
+
+        let expected = if cfg!(target_os = "linux") { TASK_STATE_ABANDONED } else { TASK_STATE_RUNNING };
+        assert_eq!(read_task_statuses(&dir)[0].state, expected);
+        // Torn or foreign files are skipped
+        fs::create_dir_all(dir.join("junk")).unwrap();
+        fs::write(dir.join("junk").join(STATUS_FILE_NAME), "{\"task_id\":").unwrap();
+        assert_eq!(read_task_statuses(&dir).len(), 1);
+        let _ = fs::remove_dir_all(&dir);
+    }
+}
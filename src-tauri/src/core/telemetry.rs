@@ -0,0 +1,38 @@
+//! Trace span names and attributes for QuickDoctor
+//! Spans go to the global OpenTelemetry tracer provider, which is a no-op unless one is installed.
+
+use opentelemetry::global::{self, BoxedTracer};
+use opentelemetry::trace::{Tracer, TracerProvider};
+
+/// Instrumentation scope name
+pub const TRACER_NAME: &str = "skylinemed";
+
+/// Span per grab loop iteration
+pub const SPAN_TRY_GRAB_ONCE: &str = "grab.try_grab_once";
+/// Span per schedule query
+pub const SPAN_GET_SCHEDULE: &str = "client.get_schedule";
+/// Span per ticket detail fetch
+pub const SPAN_GET_TICKET_DETAIL: &str = "client.get_ticket_detail";
+/// Span per submit
+pub const SPAN_SUBMIT_ORDER: &str = "client.submit_order";
+
+pub const ATTR_ATTEMPT: &str = "grab.attempt";
+pub const ATTR_DATE: &str = "schedule.date";
+pub const ATTR_UNIT_ID: &str = "hospital.unit_id";
+pub const ATTR_SCHEDULE_ID: &str = "schedule.id";
+pub const ATTR_SUCCESS: &str = "submit.success";
+
+/// Tracer from the global provider (no-op by default)
+pub fn default_tracer() -> BoxedTracer {
+    global::tracer(TRACER_NAME)
+}
+
+/// Tracer from an explicit provider
+pub fn tracer_from_provider<P>(provider: &P) -> BoxedTracer
+where
+    P: TracerProvider,
+    P::Tracer: Send + Sync + 'static,
+    <P::Tracer as Tracer>::Span: Send + Sync + 'static,
+{
+    BoxedTracer::new(Box::new(provider.tracer(TRACER_NAME)))
+}
@@ -1,8 +1,12 @@
 //! Type definitions for SkylineMed
 //! Corresponds to core/types.go
 
+use std::collections::HashSet;
+
 use serde::{Deserialize, Serialize};
 
+use super::governor::GovernorStatus;
+
 /// Address option for patient location
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct AddressOption {
@@ -10,6 +14,15 @@ pub struct AddressOption {
     pub text: String,
 }
 
+/// Province, city or district in the site's cascading address selector
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct AreaNode {
+    pub id: String,
+    pub name: String,
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub children: Vec<AreaNode>,
+}
+
 /// Time slot for appointment
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct TimeSlot {
@@ -32,10 +45,64 @@ pub struct TicketDetail {
     pub is_hot: String,
     #[serde(rename = "hisMemId")]
     pub his_mem_id: String,
+    /// The hospital books only members registered with its HIS: the page has a hisMemId field and flags
+    /// the member with need_check. Booking fails while his_mem_id is empty.
+    #[serde(default, skip_serializing_if = "is_false")]
+    pub his_mem_required: bool,
     #[serde(rename = "addressId")]
     pub address_id: String,
     pub address: String,
     pub addresses: Vec<AddressOption>,
+    /// Whether the page asks for a disease description, and how long it must be
+    #[serde(default, skip_serializing_if = "DiseaseRequirement::is_empty")]
+    pub disease_requirement: DiseaseRequirement,
+    /// Checkboxes of the submit form other than the hard-wired accept=1
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub consents: Vec<ConsentField>,
+}
+
+/// A consent checkbox (同意书, 知情告知 ...) on the booking page's submit form
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct ConsentField {
+    pub name: String,
+    /// Value posted when ticked; browsers send "on" for a checkbox without one
+    pub value: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub label: String,
+    /// Ticked by default on the page
+    pub checked: bool,
+    /// The page refuses the submit while it is unticked
+    pub required: bool,
+}
+
+/// Disease description (病情描述) requirement parsed from the booking page
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct DiseaseRequirement {
+    pub required: bool,
+    /// Minimum length in characters; 0 when the page gives none
+    pub min_length: usize,
+    /// Hint text shown next to the field, e.g. 请至少输入10个字
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub hint: String,
+}
+
+impl DiseaseRequirement {
+    /// Whether the page carried no requirement at all
+    pub fn is_empty(&self) -> bool {
+        !self.required && self.min_length == 0 && self.hint.is_empty()
+    }
+
+    /// Check a description against the requirement, returning the problem if any
+    pub fn check(&self, description: &str) -> Result<(), String> {
+        let length = description.trim().chars().count();
+        if self.required && length == 0 {
+            return Err("disease description is required".into());
+        }
+        if length > 0 && length < self.min_length {
+            return Err(format!("disease description needs at least {} characters, got {}", self.min_length, length));
+        }
+        Ok(())
+    }
 }
 
 impl Default for TicketDetail {
@@ -52,13 +119,35 @@ impl Default for TicketDetail {
             disease_input: String::new(),
             is_hot: String::new(),
             his_mem_id: String::new(),
+            his_mem_required: false,
             address_id: String::new(),
             address: String::new(),
             addresses: Vec::new(),
+            disease_requirement: DiseaseRequirement::default(),
+            consents: Vec::new(),
         }
     }
 }
 
+impl TicketDetail {
+    /// Required consents that are neither ticked by default nor granted in config.consents
+    pub fn missing_consents(&self, granted: &[String]) -> Vec<&ConsentField> {
+        self.consents
+            .iter()
+            .filter(|consent| consent.required && !consent.checked)
+            .filter(|consent| !granted.iter().any(|name| name.trim() == consent.name))
+            .collect()
+    }
+
+    /// Consents to post with the order: the ticked-by-default ones plus those granted in config.consents
+    pub fn consents_to_submit(&self, granted: &[String]) -> Vec<&ConsentField> {
+        self.consents
+            .iter()
+            .filter(|consent| consent.checked || granted.iter().any(|name| name.trim() == consent.name))
+            .collect()
+    }
+}
+
 /// Member (patient) information
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct Member {
@@ -68,7 +157,7 @@ pub struct Member {
 }
 
 /// Order submission result
-#[derive(Debug, Clone, Serialize, Deserialize)]
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
 pub struct SubmitOrderResult {
     pub success: bool,
     pub status: bool,
@@ -76,6 +165,34 @@ pub struct SubmitOrderResult {
     pub message: String,
     #[serde(skip_serializing_if = "Option::is_none")]
     pub url: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub captcha: Option<CaptchaChallenge>,
+    /// The order exists but must be paid online before the deadline or it is cancelled
+    #[serde(default)]
+    pub payment_required: bool,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub payment_url: Option<String>,
+    /// Payment deadline as "YYYY-MM-DD HH:MM:SS" local time, when the cashier page states one
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub payment_deadline: Option<String>,
+}
+
+/// Captcha challenge attached to a submit response
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct CaptchaChallenge {
+    /// "image" or "slider"
+    pub kind: String,
+    /// Image URL or data URI, empty for sliders without an image
+    pub image: String,
+    /// Form field expected to carry the answer
+    pub field: String,
+    pub token: String,
+}
+
+/// Captcha answer as extra submit form fields
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct CaptchaSolution {
+    pub fields: std::collections::HashMap<String, String>,
 }
 
 /// QR login result
@@ -90,14 +207,20 @@ pub struct QRLoginResult {
 /// Grab configuration
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct GrabConfig {
+    #[serde(default)]
     pub unit_id: String,
     #[serde(default)]
     pub unit_name: String,
+    /// City used to resolve unit_id from unit_name when unit_id is empty
+    #[serde(default)]
+    pub city_id: String,
     pub dep_id: String,
     #[serde(default)]
     pub dep_name: String,
     #[serde(default)]
     pub doctor_ids: Vec<String>,
+    /// Empty is resolved before the run from member_name, or to the account's only certified member
+    #[serde(default)]
     pub member_id: String,
     #[serde(default)]
     pub member_name: String,
@@ -106,26 +229,144 @@ pub struct GrabConfig {
     pub time_types: Vec<String>,
     #[serde(default)]
     pub preferred_hours: Vec<String>,
+    /// Per target date (YYYY-MM-DD) time preferences over time_types and preferred_hours
+    #[serde(default, skip_serializing_if = "std::collections::HashMap::is_empty")]
+    pub date_preferences: std::collections::HashMap<String, DatePreference>,
     #[serde(rename = "addressId", default)]
     pub address_id: String,
     #[serde(default)]
     pub address: String,
+    /// District picked from the area tree, used with address_street when the member has no usable address
+    #[serde(default)]
+    pub address_area_id: String,
+    #[serde(default)]
+    pub address_street: String,
     #[serde(default)]
     pub start_time: String,
+    /// Zone start_time is read in: "local" (default) or "Asia/Shanghai"
+    #[serde(default)]
+    pub start_time_timezone: String,
     #[serde(default)]
     pub use_server_time: bool,
+    /// Seconds between schedule queries; values below MIN_RETRY_INTERVAL_SECS are rejected
     #[serde(default)]
     pub retry_interval: f64,
+    /// Clamp a retry_interval below the floor with a warning instead of rejecting the config
+    #[serde(default)]
+    pub allow_fast_retry: bool,
+    /// Target dates whose schedules are queried at once each cycle, 1 to MAX_SCHEDULE_QUERY_CONCURRENCY
+    #[serde(default = "default_schedule_query_concurrency")]
+    pub schedule_query_concurrency: u32,
+    /// Minimum seconds between submits; 0 uses the hospital pacing profile
+    #[serde(default)]
+    pub submit_interval: f64,
     #[serde(default)]
     pub max_retries: i32,
+    /// Submits one run may send before it stops; 0 is unlimited
+    #[serde(default)]
+    pub max_submits_per_run: u32,
+    /// Submits the member's account may send per local day, across runs and restarts; 0 is unlimited
+    #[serde(default)]
+    pub max_submits_per_day: u32,
     #[serde(default = "default_true")]
     pub use_proxy_submit: bool,
+    #[serde(default = "default_true")]
+    pub require_certified_member: bool,
+    #[serde(default)]
+    pub wait_for_quota_reset: bool,
+    /// Days ahead the hospital opens schedules; 0 reads it from the announcements when they are checked
+    #[serde(default)]
+    pub booking_window_days: u32,
+    /// Skip target dates beyond the booking window until they enter it instead of querying them
+    #[serde(default)]
+    pub wait_for_window: bool,
+    #[serde(default = "default_true")]
+    pub auto_select_first_time_slot: bool,
+    /// Budget for the requests leading up to a submit; the submit POST itself is always awaited
+    #[serde(default = "default_attempt_timeout_seconds")]
+    pub attempt_timeout_seconds: f64,
+    #[serde(default)]
+    pub check_announcements: bool,
+    #[serde(default)]
+    pub prefer_sequence: Option<PreferSequence>,
+    #[serde(default)]
+    pub sign_submit_form: bool,
+    #[serde(default)]
+    pub recheck_before_submit: Option<bool>,
+    /// Stop when none of doctor_ids is listed by the department; unset means on whenever doctor_ids is set
+    #[serde(default)]
+    pub require_doctor_match: Option<bool>,
+    #[serde(default = "default_true")]
+    pub persist_rotated_cookies: bool,
+    #[serde(default)]
+    pub manual_captcha: bool,
+    /// Join the waitlist (候补) when no real slot could be booked in a cycle
+    #[serde(default)]
+    pub allow_waitlist: bool,
+    /// Budget for solving a captcha attached to a submit answer, separate from attempt_timeout_seconds
+    #[serde(default = "default_captcha_timeout_seconds")]
+    pub captcha_timeout_seconds: f64,
+    /// Only chase slots with at least this many tickets left
+    #[serde(default = "default_min_left_num")]
+    pub min_left_num: i32,
+    /// Pre-written 病情描述 for departments that require one; overrides the page's value
+    #[serde(default)]
+    pub disease_description: String,
+    /// Keep going when the first booking page says the member is not registered with the hospital
+    #[serde(default)]
+    pub ignore_hismem_check: bool,
+    /// Names of consent checkboxes on the booking page the user agrees to tick
+    /// Required consents that are unticked by default and not listed here stop the run
+    #[serde(default)]
+    pub consents: Vec<String>,
+}
+
+/// Time preferences for one target date; an empty list falls back to the global setting
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct DatePreference {
+    #[serde(default)]
+    pub time_types: Vec<String>,
+    #[serde(default)]
+    pub preferred_hours: Vec<String>,
+}
+
+/// Preference for numbered slots (1号, 2号 ...)
+/// Either a mode ("lowest" | "highest") or an explicit list of numbers in priority order
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+#[serde(untagged)]
+pub enum PreferSequence {
+    Mode(String),
+    Numbers(Vec<u32>),
+}
+
+fn default_grab_success_kind() -> String {
+    GRAB_SUCCESS_BOOKED.into()
 }
 
 fn default_true() -> bool {
     true
 }
 
+fn is_false(value: &bool) -> bool {
+    !*value
+}
+
+fn default_attempt_timeout_seconds() -> f64 {
+    30.0
+}
+
+fn default_captcha_timeout_seconds() -> f64 {
+    60.0
+}
+
+fn default_min_left_num() -> i32 {
+    1
+}
+
+fn default_schedule_query_concurrency() -> u32 {
+    1
+}
+
 impl GrabConfig {
     /// Validate the configuration
     pub fn validate(&self) -> Result<(), String> {
@@ -141,21 +382,203 @@ impl GrabConfig {
         if self.target_dates.is_empty() {
             return Err("target_dates is required".into());
         }
+        if self.retry_interval > 0.0 && self.retry_interval < MIN_RETRY_INTERVAL_SECS && !self.allow_fast_retry {
+            return Err(format!(
+                "retry_interval must be at least {}s; faster queries get the account rate-limited",
+                MIN_RETRY_INTERVAL_SECS
+            ));
+        }
+        if self.min_left_num < 1 {
+            return Err("min_left_num must be at least 1".into());
+        }
+        if self.schedule_query_concurrency > MAX_SCHEDULE_QUERY_CONCURRENCY {
+            return Err(format!(
+                "schedule_query_concurrency must be at most {}",
+                MAX_SCHEDULE_QUERY_CONCURRENCY
+            ));
+        }
+        if !matches!(self.start_time_timezone.as_str(), "" | START_TIME_ZONE_LOCAL | START_TIME_ZONE_CHINA) {
+            return Err(format!("start_time_timezone must be \"{}\" or \"{}\"", START_TIME_ZONE_LOCAL, START_TIME_ZONE_CHINA));
+        }
         Ok(())
     }
+
+    /// Scheduled start today from start_time (HH:MM:SS), if it is still ahead of now
+    pub fn scheduled_start(&self, now: chrono::DateTime<chrono::Local>) -> Option<chrono::DateTime<chrono::Local>> {
+        self.start_time_at(now).filter(|start| *start > now)
+    }
+
+    /// start_time today in the configured start_time_timezone, as a local instant
+    pub fn start_time_at(&self, now: chrono::DateTime<chrono::Local>) -> Option<chrono::DateTime<chrono::Local>> {
+        self.start_time_in(now, &self.start_time_timezone)
+    }
+
+    /// start_time today read in zone ("local" or "Asia/Shanghai"), as a local instant
+    pub fn start_time_in(&self, now: chrono::DateTime<chrono::Local>, zone: &str) -> Option<chrono::DateTime<chrono::Local>> {
+        let time = chrono::NaiveTime::parse_from_str(self.start_time.trim(), "%H:%M:%S").ok()?;
+        if zone == START_TIME_ZONE_CHINA {
+            let china = china_offset();
+            let start = now.with_timezone(&china).date_naive().and_time(time).and_local_timezone(china).single()?;
+            return Some(start.with_timezone(&chrono::Local));
+        }
+        now.date_naive().and_time(time).and_local_timezone(chrono::Local).single()
+    }
+
+    /// Whether to re-check availability right before submit
+    /// Defaults to on for relaxed retry intervals (>= 2s), where the extra request is affordable
+    pub fn recheck_before_submit_enabled(&self) -> bool {
+        self.recheck_before_submit.unwrap_or(self.retry_interval >= 2.0)
+    }
+
+    /// Time types wanted on date: its own preference, else time_types
+    pub fn time_types_for(&self, date: &str) -> &[String] {
+        match self.date_preferences.get(date) {
+            Some(preference) if !preference.time_types.is_empty() => &preference.time_types,
+            _ => &self.time_types,
+        }
+    }
+
+    /// Preferred hours on date: its own preference, else preferred_hours
+    pub fn preferred_hours_for(&self, date: &str) -> &[String] {
+        match self.date_preferences.get(date) {
+            Some(preference) if !preference.preferred_hours.is_empty() => &preference.preferred_hours,
+            _ => &self.preferred_hours,
+        }
+    }
+
+    /// Whether configured doctors missing from the department stop the run
+    pub fn require_doctor_match_enabled(&self) -> bool {
+        !self.doctor_ids.is_empty() && self.require_doctor_match.unwrap_or(true)
+    }
+}
+
+/// Grabber lifecycle state
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize, Default)]
+#[serde(rename_all = "lowercase")]
+pub enum GrabberState {
+    #[default]
+    Idle,
+    Running,
+    Paused,
+    Stopping,
 }
 
+/// Grabber state with the member's submit count for today
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct GrabStatus {
+    pub state: GrabberState,
+    pub member_id: String,
+    pub submits_today: u32,
+    /// 0 is unlimited
+    pub max_submits_per_day: u32,
+    /// Adaptive retry interval of the current or last run
+    pub governor: GovernorStatus,
+}
+
+/// Reasons a member page row was skipped
+pub const MEMBER_SKIP_NO_CELLS: &str = "no_cells";
+pub const MEMBER_SKIP_NO_ID_OR_NAME: &str = "no_id_or_name";
+pub const MEMBER_SKIP_NO_ID: &str = "no_id";
+
+/// A member page row that was skipped
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct MemberRowSkip {
+    /// 1-based row index in tbody#mem_list
+    pub index: u32,
+    pub reason: String,
+    /// Trimmed row text, to tell users which person is missing
+    pub detail: String,
+}
+
+/// Parsed members plus diagnostics on how the member page was parsed
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct MembersResult {
+    pub members: Vec<Member>,
+    /// Whether the page was a login redirect instead of the member list
+    pub login_redirect: bool,
+    /// Whether tbody#mem_list was found
+    pub list_found: bool,
+    pub rows_seen: u32,
+    pub rows_skipped: u32,
+    /// Skipped row count per reason
+    pub skip_reasons: std::collections::BTreeMap<String, u32>,
+    #[serde(default)]
+    pub skipped_rows: Vec<MemberRowSkip>,
+    pub page_title: String,
+}
+
+impl MembersResult {
+    /// Record a skipped row
+    pub fn skip(&mut self, index: u32, reason: &str, detail: &str) {
+        self.rows_skipped += 1;
+        *self.skip_reasons.entry(reason.to_string()).or_default() += 1;
+        self.skipped_rows.push(MemberRowSkip {
+            index,
+            reason: reason.to_string(),
+            detail: detail.to_string(),
+        });
+    }
+}
+
+/// Shortest retry_interval a run accepts, in seconds
+pub const MIN_RETRY_INTERVAL_SECS: f64 = 0.2;
+
+/// Most schedule queries one cycle may have in flight; more looks like a burst to the hospital
+pub const MAX_SCHEDULE_QUERY_CONCURRENCY: u32 = 5;
+
+/// start_time_timezone values
+pub const START_TIME_ZONE_LOCAL: &str = "local";
+pub const START_TIME_ZONE_CHINA: &str = "Asia/Shanghai";
+
+/// China Standard Time, UTC+8 all year (no daylight saving)
+pub fn china_offset() -> chrono::FixedOffset {
+    chrono::FixedOffset::east_opt(8 * 3600).expect("valid offset")
+}
+
+/// Grab success kinds
+pub const GRAB_SUCCESS_BOOKED: &str = "booked";
+pub const GRAB_SUCCESS_WAITLISTED: &str = "waitlisted";
+
 /// Grab success result
-#[derive(Debug, Clone, Serialize, Deserialize)]
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
 pub struct GrabSuccess {
+    /// "booked" for a confirmed appointment, "waitlisted" for a 候补 registration
+    #[serde(default = "default_grab_success_kind")]
+    pub kind: String,
     pub unit_name: String,
     pub dep_name: String,
     pub doctor_name: String,
     pub date: String,
     pub time_slot: String,
     pub member_name: String,
+    #[serde(default)]
+    pub unit_id: String,
+    #[serde(default)]
+    pub dep_id: String,
+    #[serde(default)]
+    pub doctor_id: String,
+    #[serde(default)]
+    pub member_id: String,
     #[serde(skip_serializing_if = "Option::is_none")]
     pub url: Option<String>,
+    /// Order number read from the success page URL, when it carries one
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub order_no: Option<String>,
+    /// Booked but unpaid; the user has to pay at payment_url before payment_deadline
+    #[serde(default)]
+    pub payment_required: bool,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub payment_url: Option<String>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub payment_deadline: Option<String>,
+}
+
+impl GrabSuccess {
+    /// Page that opens this order: the payment page while unpaid, else the success page
+    pub fn order_url(&self) -> Option<&str> {
+        let payment = self.payment_url.as_deref().filter(|_| self.payment_required);
+        payment.or(self.url.as_deref()).filter(|url| !url.trim().is_empty())
+    }
 }
 
 /// Grab result (success or failure)
@@ -167,8 +590,160 @@ pub struct GrabResult {
     pub detail: Option<GrabSuccess>,
 }
 
+/// Accumulated timing for one grab phase
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct PhaseTiming {
+    pub count: u32,
+    pub total_ms: u64,
+    pub max_ms: u64,
+    pub last_ms: u64,
+    pub p50_ms: u64,
+    pub p95_ms: u64,
+    /// Most recent durations, for the percentiles
+    #[serde(skip)]
+    samples: std::collections::VecDeque<u64>,
+}
+
+/// Durations kept per phase for percentiles
+const PHASE_TIMING_SAMPLES: usize = 500;
+
+impl PhaseTiming {
+    /// Record one finished phase
+    pub fn record(&mut self, elapsed_ms: u64) {
+        self.count += 1;
+        self.total_ms += elapsed_ms;
+        self.last_ms = elapsed_ms;
+        self.max_ms = self.max_ms.max(elapsed_ms);
+
+        if self.samples.len() == PHASE_TIMING_SAMPLES {
+            self.samples.pop_front();
+        }
+        self.samples.push_back(elapsed_ms);
+        let mut sorted: Vec<u64> = self.samples.iter().copied().collect();
+        sorted.sort_unstable();
+        self.p50_ms = percentile(&sorted, 50);
+        self.p95_ms = percentile(&sorted, 95);
+    }
+}
+
+/// Nearest-rank percentile of sorted values
+fn percentile(sorted: &[u64], p: usize) -> u64 {
+    if sorted.is_empty() {
+        return 0;
+    }
+    let rank = (p * sorted.len()).div_ceil(100).max(1);
+    sorted[rank - 1]
+}
+
+/// Grab run statistics
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct GrabStats {
+    pub attempts: u32,
+    pub timeouts: u32,
+    pub saved_submits: u32,
+    /// Available slots skipped for having fewer than min_left_num tickets
+    pub below_min: u32,
+    /// Booking pages that redirected to a flow we cannot automate, one per URL
+    pub unsupported_flows: Vec<UnsupportedFlow>,
+    /// Set when the department rejected or would reject the order for a missing 病情描述
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub disease_requirement: Option<DiseaseRequirement>,
+    /// Set when the run stopped because the member must first be bound on the hospital's platform
+    #[serde(default, skip_serializing_if = "is_false")]
+    pub his_mem_missing: bool,
+    pub phases: std::collections::HashMap<String, PhaseTiming>,
+    /// Per target date (YYYY-MM-DD)
+    #[serde(default, skip_serializing_if = "std::collections::HashMap::is_empty")]
+    pub dates: std::collections::HashMap<String, DateStats>,
+    /// How long found slots lasted until our submit was answered
+    #[serde(default)]
+    pub slot_survival: SlotSurvival,
+}
+
+/// Milliseconds from the schedule answer that showed a slot to the answer of its submit,
+/// split by outcome; failures landing much later than successes mean we are too slow
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct SlotSurvival {
+    pub successes: u32,
+    pub failures: u32,
+    pub success_p50_ms: u64,
+    pub failure_p50_ms: u64,
+    #[serde(skip)]
+    success_samples: std::collections::VecDeque<u64>,
+    #[serde(skip)]
+    failure_samples: std::collections::VecDeque<u64>,
+}
+
+/// Failed submits needed before their median is compared with the successes
+const SURVIVAL_MIN_FAILURES: u32 = 3;
+/// Failure median over success median from which the run counts as too slow
+const SURVIVAL_SLOW_RATIO: u64 = 2;
+
+impl SlotSurvival {
+    /// Record one submit answered delta_ms after its slot was seen
+    pub fn record(&mut self, delta_ms: u64, succeeded: bool) {
+        let (count, samples, p50) = if succeeded {
+            (&mut self.successes, &mut self.success_samples, &mut self.success_p50_ms)
+        } else {
+            (&mut self.failures, &mut self.failure_samples, &mut self.failure_p50_ms)
+        };
+        *count += 1;
+        if samples.len() == PHASE_TIMING_SAMPLES {
+            samples.pop_front();
+        }
+        samples.push_back(delta_ms);
+        let mut sorted: Vec<u64> = samples.iter().copied().collect();
+        sorted.sort_unstable();
+        *p50 = percentile(&sorted, 50);
+    }
+
+    /// Whether failed submits typically land much later than successful ones
+    pub fn too_slow(&self) -> bool {
+        self.successes > 0
+            && self.failures >= SURVIVAL_MIN_FAILURES
+            && self.failure_p50_ms >= self.success_p50_ms.max(1) * SURVIVAL_SLOW_RATIO
+    }
+
+    /// Config changes that shorten the way from a found slot to its submit, for a run that was too slow
+    pub fn remediation(&self, config: &GrabConfig) -> Vec<&'static str> {
+        if !self.too_slow() {
+            return Vec::new();
+        }
+        let mut advice = Vec::new();
+        if config.use_proxy_submit {
+            advice.push("关闭代理提交 (use_proxy_submit=false)，直连提交少一跳延迟");
+        }
+        if config.recheck_before_submit_enabled() {
+            advice.push("关闭提交前复查 (recheck_before_submit=false)，省去一次号源详情请求");
+        }
+        if config.doctor_ids.is_empty() {
+            advice.push("指定医生 (doctor_ids) 使用精确模式，查到可提交的号即停止扫描");
+        }
+        advice
+    }
+}
+
+/// What a run saw and did for one target date
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct DateStats {
+    /// Schedule answers received
+    pub queries: u32,
+    /// Answers with at least one slot left
+    pub bookable_answers: u32,
+    pub submits: u32,
+}
+
+/// A booking page that led to an unsupported flow, kept for support diagnostics
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct UnsupportedFlow {
+    pub flow: String,
+    pub url: String,
+    pub schedule_id: String,
+}
+
 /// Cookie record for persistence
-#[derive(Debug, Clone, Serialize, Deserialize)]
+/// last_used/first_seen are stored as ISO-8601 strings
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
 pub struct CookieRecord {
     pub name: String,
     pub value: String,
@@ -176,6 +751,23 @@ pub struct CookieRecord {
     pub domain: String,
     #[serde(default = "default_path")]
     pub path: String,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub last_used: Option<chrono::DateTime<chrono::Local>>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub first_seen: Option<chrono::DateTime<chrono::Local>>,
+    /// Expiry from Set-Cookie Expires/Max-Age; None for session cookies
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub expires: Option<chrono::DateTime<chrono::Local>>,
+    /// Max-Age in seconds as the server sent it, kept for diagnostics; expires is what is checked
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_age: Option<i64>,
+}
+
+impl CookieRecord {
+    /// Whether the record carries an expiry that has passed; session cookies never expire here
+    pub fn is_expired(&self) -> bool {
+        self.expires.is_some_and(|expires| expires <= chrono::Local::now())
+    }
 }
 
 fn default_domain() -> String {
@@ -201,6 +793,16 @@ pub struct City {
     pub sanzima: String,
 }
 
+/// City list plus where it came from
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct CityList {
+    pub cities: Vec<City>,
+    /// "file", "network" or "embedded"
+    pub source: String,
+    /// The embedded fallback may be missing cities; the UI should offer a refresh
+    pub stale: bool,
+}
+
 /// Custom deserializer for fields that can be number or string
 fn deserialize_flexible_string<'de, D>(deserializer: D) -> Result<String, D::Error>
 where
@@ -244,16 +846,26 @@ where
 }
 
 /// Hospital information
-#[allow(dead_code)]
-#[derive(Debug, Clone, Serialize, Deserialize)]
+/// Ids arrive as strings or numbers; fields the app does not read are kept in extra and sent on as-is
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
 pub struct Hospital {
     #[serde(deserialize_with = "deserialize_flexible_string", alias = "id")]
     pub unit_id: String,
     #[serde(alias = "name")]
     pub unit_name: String,
+    /// Grade as listed, e.g. "三级甲等"
+    #[serde(default, alias = "unit_level", deserialize_with = "deserialize_flexible_string_option", skip_serializing_if = "Option::is_none")]
+    pub level: Option<String>,
+    #[serde(default, alias = "unit_addr", deserialize_with = "deserialize_flexible_string_option", skip_serializing_if = "Option::is_none")]
+    pub address: Option<String>,
+    #[serde(default, alias = "area_name", deserialize_with = "deserialize_flexible_string_option", skip_serializing_if = "Option::is_none")]
+    pub district: Option<String>,
+    #[serde(flatten)]
+    pub extra: serde_json::Map<String, serde_json::Value>,
 }
 
 /// Department information
+/// childs holds sub-departments where the hospital nests them
 #[allow(dead_code)]
 #[derive(Debug, Clone, Serialize, Deserialize)]
 pub struct Department {
@@ -262,6 +874,9 @@ pub struct Department {
     pub dep_name: String,
     #[serde(default)]
     pub childs: Vec<Department>,
+    /// Hospital the department was listed for, filled in after decoding
+    #[serde(default)]
+    pub unit_id: String,
     // API also returns these duplicate fields, capture them to avoid parse errors
     #[serde(default, deserialize_with = "deserialize_flexible_string_option")]
     id: Option<String>,
@@ -283,11 +898,15 @@ pub struct DepartmentCategory {
 }
 
 /// Log entry for export
-#[derive(Debug, Clone, Serialize, Deserialize)]
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
 pub struct LogEntry {
     pub time: String,
     pub level: String,
     pub message: String,
+    #[serde(default)]
+    pub key: String,
+    #[serde(default)]
+    pub params: std::collections::BTreeMap<String, String>,
 }
 
 /// Schedule slot information
@@ -299,6 +918,12 @@ pub struct ScheduleSlot {
     pub time_type_desc: String,
     pub left_num: i32,
     pub sch_date: String,
+    /// The hospital offers a waitlist (候补) for this schedule once it is full
+    #[serde(default)]
+    pub waitlist: bool,
+    /// Bookable only by real-name verified (实名认证) accounts; set when the slot or its doctor is marked
+    #[serde(default, skip_serializing_if = "is_false")]
+    pub verification_required: bool,
 }
 
 /// Doctor with schedule information
@@ -307,8 +932,13 @@ pub struct DoctorSchedule {
     #[serde(deserialize_with = "deserialize_flexible_string")]
     pub doctor_id: String,
     pub doctor_name: String,
+    /// Professional title, e.g. 主任医师
+    #[serde(default)]
+    pub title: String,
     #[serde(default)]
     pub reg_fee: String,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub photo_url: String,
     #[serde(default)]
     pub total_left_num: i32,
     #[serde(default, deserialize_with = "deserialize_flexible_string")]
@@ -321,6 +951,242 @@ pub struct DoctorSchedule {
     pub schedule_id: String,
     #[serde(default)]
     pub time_type_desc: String,
+    /// Every slot of the doctor is restricted to real-name verified (实名认证) accounts
+    #[serde(default, skip_serializing_if = "is_false")]
+    pub verification_required: bool,
+}
+
+/// Where and when a schedule answer came from, to tell stale data apart
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ScheduleMeta {
+    pub fetched_at: chrono::DateTime<chrono::Local>,
+    /// Request to last body byte, retries included
+    pub round_trip_ms: u64,
+    /// Gate host that answered
+    pub host: String,
+    /// access_hash that answered, masked
+    pub user_key: String,
+    pub http_status: u16,
+    /// Every doctor the department listed, with or without slots and before any doctor filter
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub roster: Vec<DepartmentDoctor>,
+    /// Raw keys of the answer's sch map, before any doctor filter
+    #[serde(default, skip_serializing_if = "Vec::is_empty")]
+    pub sch_keys: Vec<String>,
+}
+
+/// A doctor listed by a department schedule or the department page
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct DepartmentDoctor {
+    pub doctor_id: String,
+    #[serde(default)]
+    pub doctor_name: String,
+    /// Professional title, e.g. 主任医师; only the department page lists it
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub title: String,
+    /// What the doctor specializes in (擅长); only the department page lists it
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub specialty: String,
+}
+
+impl ScheduleMeta {
+    /// Seconds since the answer arrived
+    pub fn age_secs(&self, now: chrono::DateTime<chrono::Local>) -> f64 {
+        ((now - self.fetched_at).num_milliseconds().max(0) as f64) / 1000.0
+    }
+}
+
+/// Doctors of a department schedule with the metadata of the answer
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ScheduleResult {
+    pub docs: Vec<DoctorSchedule>,
+    pub meta: ScheduleMeta,
+}
+
+impl ScheduleResult {
+    /// Roster doctors without a sch entry and sch keys matching no roster doctor, for doctor id mismatch reports
+    pub fn unmatched_doctors(&self) -> UnmatchedDoctors {
+        let roster: HashSet<&str> = self.meta.roster.iter().map(|d| d.doctor_id.as_str()).collect();
+        let keys: HashSet<&str> = self.meta.sch_keys.iter().map(String::as_str).collect();
+        UnmatchedDoctors {
+            doctors: self.meta.roster.iter().filter(|d| !keys.contains(d.doctor_id.as_str())).cloned().collect(),
+            orphan_sch_keys: self.meta.sch_keys.iter().filter(|k| !roster.contains(k.as_str())).cloned().collect(),
+        }
+    }
+}
+
+/// Key sets of a schedule answer that did not line up
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct UnmatchedDoctors {
+    pub doctors: Vec<DepartmentDoctor>,
+    pub orphan_sch_keys: Vec<String>,
+}
+
+impl UnmatchedDoctors {
+    pub fn is_empty(&self) -> bool {
+        self.doctors.is_empty() && self.orphan_sch_keys.is_empty()
+    }
+
+    /// Compact form for the schedule log line, e.g. "unmatched_docs=3 orphan_sch_keys=2"
+    pub fn summary(&self) -> String {
+        format!("unmatched_docs={} orphan_sch_keys={}", self.doctors.len(), self.orphan_sch_keys.len())
+    }
+}
+
+/// One queried date of a schedule scan report
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct ScanDay {
+    pub date: String,
+    pub weekday: String,
+    /// Date from the past week, queried to show the release pattern
+    pub last_week: bool,
+    pub ok: bool,
+    #[serde(default, skip_serializing_if = "String::is_empty")]
+    pub error: String,
+    pub doctors: i32,
+    pub total_left: i32,
+    pub am_left: i32,
+    pub pm_left: i32,
+}
+
+/// A doctor seen during a schedule scan
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct ScanDoctor {
+    pub doctor_id: String,
+    pub doctor_name: String,
+    pub title: String,
+    pub reg_fee: String,
+    /// Upcoming dates with tickets left
+    pub available_dates: Vec<String>,
+    /// Past-week dates the doctor had a schedule on
+    pub last_week_dates: Vec<String>,
+    pub total_left: i32,
+    /// Seen with slots restricted to real-name verified (实名认证) accounts
+    #[serde(default, skip_serializing_if = "is_false")]
+    pub verification_required: bool,
+}
+
+/// One-shot schedule scan of a department
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct ScanReport {
+    pub unit_id: String,
+    pub dep_id: String,
+    pub generated_at: String,
+    pub days: Vec<ScanDay>,
+    pub doctors: Vec<ScanDoctor>,
+    pub failed_dates: Vec<String>,
+    /// Stopped before every date was queried
+    pub cancelled: bool,
+    /// Where the JSON report was saved; empty if saving failed
+    #[serde(default)]
+    pub path: String,
+}
+
+/// Progress of a running schedule scan
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ScanProgress {
+    pub done: usize,
+    pub total: usize,
+    pub date: String,
+    pub ok: bool,
+}
+
+/// Hospital news page announcement
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct Announcement {
+    pub title: String,
+    pub date: String,
+    pub url: String,
+    pub body: String,
+}
+
+/// Aggregate schedule statistics for a department on a date
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct ScheduleStats {
+    pub total_doctors: i32,
+    pub total_slots: i32,
+    pub total_left: i32,
+    pub am_left: i32,
+    pub pm_left: i32,
+    pub has_available: bool,
+}
+
+impl ScheduleStats {
+    /// Aggregate statistics from a schedule result
+    pub fn from_schedule(docs: &[DoctorSchedule]) -> Self {
+        let mut stats = Self {
+            total_doctors: docs.len() as i32,
+            ..Default::default()
+        };
+        for doc in docs {
+            for slot in &doc.schedules {
+                stats.total_slots += 1;
+                let left = slot.left_num.max(0);
+                stats.total_left += left;
+                match slot.time_type.as_str() {
+                    "am" => stats.am_left += left,
+                    "pm" => stats.pm_left += left,
+                    _ => {}
+                }
+            }
+        }
+        stats.has_available = stats.total_left > 0;
+        stats
+    }
+}
+
+/// Schedule of a department on one date, shaped for display
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct ScheduleView {
+    pub date: String,
+    pub summary: ScheduleStats,
+    /// Doctors with the most tickets left first
+    pub doctors: Vec<DoctorView>,
+}
+
+/// One doctor of a schedule view
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct DoctorView {
+    pub doctor_id: String,
+    pub doctor_name: String,
+    pub title: String,
+    pub reg_fee: String,
+    #[serde(skip_serializing_if = "String::is_empty")]
+    pub photo_url: String,
+    pub total_left: i32,
+    /// Slots grouped by time type, morning first
+    pub groups: Vec<SlotGroupView>,
+}
+
+/// A doctor's slots of one time type
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct SlotGroupView {
+    pub time_type: String,
+    /// Display label, e.g. 上午
+    pub label: String,
+    pub total_left: i32,
+    pub slots: Vec<SlotView>,
+}
+
+/// One bookable schedule of a doctor
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct SlotView {
+    pub schedule_id: String,
+    pub time_type: String,
+    pub time_type_desc: String,
+    pub left_num: i32,
+    pub waitlist: bool,
+    #[serde(default, skip_serializing_if = "is_false")]
+    pub verification_required: bool,
+}
+
+/// Resolved application paths for diagnostics
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct AppPaths {
+    pub config_dir: String,
+    pub logs_dir: String,
+    pub cookie_path: String,
+    pub logs_fallback: bool,
 }
 
 /// User state for UI persistence
@@ -340,6 +1206,84 @@ pub struct UserState {
     pub time_slots: Vec<String>,
     #[serde(default = "default_true")]
     pub proxy_submit_enabled: bool,
+    /// Omitted when the UI does not manage headers, so saving other fields keeps them
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub extra_headers: Option<ExtraHeaders>,
+    /// Submit caps; omitted when unset so saving other fields keeps them
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_submits_per_run: Option<u32>,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub max_submits_per_day: Option<u32>,
+    /// Prefetch hospitals and departments after login; omitted when unset, which means on
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub prefetch_on_login: Option<bool>,
+    /// Keep history and learned data in config/skylinemed.db; takes effect after a restart
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub sqlite_store: Option<bool>,
+    /// Notification routing: event type -> sink ids; omitted when unset, which routes as before (email only)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub notify_routes: Option<std::collections::HashMap<String, Vec<String>>>,
+    /// Whether the account passed real-name verification (实名认证); learned from submit answers, None until then
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub account_verified: Option<bool>,
+}
+
+/// Extra request headers, stored under "extra_headers" in user state
+/// Host and Cookie are never overridden
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct ExtraHeaders {
+    /// Sent to every host
+    #[serde(default)]
+    pub global: std::collections::HashMap<String, String>,
+    /// Per domain (matching subdomains too), overriding global values
+    #[serde(default)]
+    pub domains: std::collections::HashMap<String, std::collections::HashMap<String, String>>,
+}
+
+/// Extra headers as they will actually be sent, for the settings UI
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct ActiveExtraHeaders {
+    /// Scope ("*" or a domain) to header name and value
+    pub scopes: std::collections::BTreeMap<String, std::collections::BTreeMap<String, String>>,
+    /// "scope: name" of blocked or malformed headers
+    pub rejected: Vec<String>,
+}
+
+/// SMTP settings for the run summary email, stored under "smtp" in user state
+/// The password/app token is stored in plain text, like the rest of user state
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct SmtpSettings {
+    #[serde(default)]
+    pub enabled: bool,
+    #[serde(default)]
+    pub host: String,
+    #[serde(default = "default_smtp_port")]
+    pub port: u16,
+    #[serde(default)]
+    pub user: String,
+    #[serde(default)]
+    pub password: String,
+    #[serde(default)]
+    pub to: String,
+}
+
+/// External command run when a grab finishes, stored under "on_success_command" / "on_failure_command" in user state
+/// Args may use {message} {kind} {unit} {dep} {doctor} {date} {time} {member}; the grab result JSON goes to stdin
+#[derive(Debug, Clone, Default, Serialize, Deserialize)]
+pub struct HookCommand {
+    pub path: String,
+    #[serde(default)]
+    pub args: Vec<String>,
+    #[serde(default = "default_hook_timeout_seconds")]
+    pub timeout_seconds: f64,
+}
+
+fn default_hook_timeout_seconds() -> f64 {
+    30.0
+}
+
+fn default_smtp_port() -> u16 {
+    465
 }
 
 fn default_city_id() -> String {
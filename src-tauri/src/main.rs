@@ -7,28 +7,68 @@ mod commands;
 mod core;
 
 use commands::AppState;
+use tauri::Manager;
 
 fn main() {
     tauri::Builder::default()
         .plugin(tauri_plugin_shell::init())
         .plugin(tauri_plugin_dialog::init())
         .manage(AppState::default())
+        .setup(|app| {
+            let state = app.state::<AppState>();
+            commands::booking::prefetch_caches(state.client.clone(), state.prefetch_cancel.clone(), state.grab_state.clone());
+            commands::auth::spawn_session_expiry_check(app.handle().clone());
+            commands::settings::reprobe_proxies(state.proxy_pool.clone());
+            Ok(())
+        })
         .invoke_handler(tauri::generate_handler![
-            commands::get_cities,
-            commands::get_user_state,
-            commands::save_user_state_cmd,
-            commands::export_logs,
-            commands::get_hospitals_by_city,
-            commands::get_deps_by_unit,
-            commands::get_members,
-            commands::check_login,
-            commands::get_schedule,
-            commands::get_ticket_detail,
-            commands::submit_order,
-            commands::start_qr_login,
-            commands::stop_qr_login,
-            commands::start_grab,
-            commands::stop_grab,
+            commands::auth::check_login,
+            commands::auth::import_cookies_from_har,
+            commands::auth::start_qr_login,
+            commands::auth::stop_qr_login,
+            commands::booking::get_cities,
+            commands::booking::refresh_cities,
+            commands::booking::get_area_tree,
+            commands::booking::get_hospitals_by_city,
+            commands::booking::get_hospital_announcements,
+            commands::booking::get_deps_by_unit,
+            commands::booking::get_members,
+            commands::booking::get_doctors_by_dep,
+            commands::booking::get_schedule,
+            commands::booking::get_schedule_stats,
+            commands::booking::get_schedule_view,
+            commands::booking::generate_scan_report,
+            commands::booking::cancel_scan_report,
+            commands::booking::get_ticket_detail,
+            commands::booking::submit_order,
+            commands::booking::open_order_in_browser,
+            commands::grab::export_run_report,
+            commands::grab::start_grab,
+            commands::grab::stop_grab,
+            commands::grab::pause_grab,
+            commands::grab::append_grab_dates,
+            commands::grab::provide_captcha_solution,
+            commands::grab::resume_grab,
+            commands::grab::get_grabber_state,
+            commands::grab::get_grab_status,
+            commands::settings::get_user_state,
+            commands::settings::save_user_state_cmd,
+            commands::settings::set_log_locale,
+            commands::settings::send_test_email,
+            commands::settings::test_notification,
+            commands::settings::get_pacing_profile,
+            commands::settings::save_pacing_profile_cmd,
+            commands::settings::get_proxy_pool_status,
+            commands::settings::save_proxy_settings,
+            commands::settings::get_active_extra_headers,
+            commands::diagnostics::export_logs,
+            commands::diagnostics::get_paths,
+            commands::diagnostics::get_recent_logs,
+            commands::diagnostics::get_department_insights,
+            commands::diagnostics::get_members_diagnostics,
+            commands::diagnostics::get_active_user_key,
+            commands::diagnostics::get_memory_stats,
+            commands::diagnostics::probe_network,
         ])
         .run(tauri::generate_context!())
         .expect("error while running tauri application");